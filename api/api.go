@@ -0,0 +1,120 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package api serves the bridge's REST API and the read-only public status
+// page on the HTTP listener.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Server holds the handlers for the REST API and public status page
+type Server struct {
+	state        *State
+	token        string
+	publicToken  string
+	publicValues []string
+}
+
+// New creates an API server. An empty token leaves the values open and the
+// endpoints that control the boiler out; an empty publicToken disables the
+// public endpoints.
+func New(state *State, token, publicToken string, publicValues []string) *Server {
+	return &Server{
+		state:        state,
+		token:        token,
+		publicToken:  publicToken,
+		publicValues: publicValues,
+	}
+}
+
+// RegisterAPI adds the REST endpoints to mux
+func (s *Server) RegisterAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/values", s.requireToken(s.token, s.handleValues))
+	mux.HandleFunc("/api/public", s.requirePublicToken(s.handlePublic))
+}
+
+// requestToken returns the bearer token or, for shareable links, the token
+// query parameter
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func tokenMatches(expected, given string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
+
+// withoutToken reports, with a warning, that the endpoint at path is not
+// served because it controls the boiler and no token is set
+func (s *Server) withoutToken(path string) bool {
+	if s.token != "" {
+		return false
+	}
+	log.Warnf("Not serving %s without api.token", path)
+	return true
+}
+
+func (s *Server) requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !tokenMatches(token, requestToken(r)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requirePublicToken accepts the public token, or the full token which can
+// see everything the public one can
+func (s *Server) requirePublicToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.publicToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given := requestToken(r)
+		if !tokenMatches(s.publicToken, given) && (s.token == "" || !tokenMatches(s.token, given)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleValues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.state.Snapshot())
+}
+
+func (s *Server) handlePublic(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.state.Snapshot(s.publicValues...))
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Debugf("Failed to encode API response: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestServer(token, publicToken string) (*Server, *http.ServeMux) {
+	eventBus := bus.New()
+	state := NewState(eventBus)
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{
+		"boiler_temp": nbe.RoundedFloat(62.5),
+		"state_text":  "Power",
+		"oxygen":      nbe.RoundedFloat(12.5),
+	}})
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "boiler", Values: map[string]interface{}{
+		"temp": int64(70),
+	}})
+
+	server := New(state, token, publicToken, []string{"operating_data/boiler_temp", "operating_data/state_text"})
+	mux := http.NewServeMux()
+	server.RegisterAPI(mux)
+	server.RegisterWebUI(mux)
+	return server, mux
+}
+
+func get(mux *http.ServeMux, target, bearer string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	if bearer != "" {
+		request.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestStateFollowsBus(t *testing.T) {
+	server, _ := newTestServer("", "")
+	if value, ok := server.state.Get("boiler/temp"); !ok || value != int64(70) {
+		t.Errorf("Expected boiler/temp 70, got %v", value)
+	}
+	if snapshot := server.state.Snapshot("boiler/temp", "missing/key"); len(snapshot) != 1 {
+		t.Errorf("Expected only known paths in snapshot, got %v", snapshot)
+	}
+}
+
+func TestValuesRequireToken(t *testing.T) {
+	_, mux := newTestServer("admin", "tenant")
+
+	tests := []struct {
+		name     string
+		target   string
+		bearer   string
+		expected int
+	}{
+		{"no token", "/api/values", "", http.StatusUnauthorized},
+		{"public token", "/api/values", "tenant", http.StatusUnauthorized},
+		{"admin token", "/api/values", "admin", http.StatusOK},
+		{"public with public token", "/api/public", "tenant", http.StatusOK},
+		{"public with admin token", "/api/public", "admin", http.StatusOK},
+		{"public without token", "/api/public", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if recorder := get(mux, tt.target, tt.bearer); recorder.Code != tt.expected {
+				t.Errorf("GET %s = %d, want %d", tt.target, recorder.Code, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPublicExposesOnlyCuratedValues(t *testing.T) {
+	_, mux := newTestServer("admin", "tenant")
+
+	recorder := get(mux, "/api/public", "tenant")
+	var values map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&values); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(values) != 2 || values["operating_data/state_text"] != "Power" {
+		t.Errorf("Expected only the curated values, got %v", values)
+	}
+}
+
+func TestPublicDisabledWithoutToken(t *testing.T) {
+	_, mux := newTestServer("", "")
+	if recorder := get(mux, "/api/public", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a public token, got %d", recorder.Code)
+	}
+	if recorder := get(mux, "/api/values", ""); recorder.Code != http.StatusOK {
+		t.Errorf("Expected the API to be open without a token, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/audit"
+)
+
+// RegisterAudit adds GET /api/audit, returning the writes in the audit log.
+// The since parameter, as Unix milliseconds or RFC 3339, and the key
+// parameter narrow them down.
+func (s *Server) RegisterAudit(mux *http.ServeMux, log *audit.Log) {
+	mux.HandleFunc("/api/audit", s.requireToken(s.token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		since, err := parseTime(params.Get("since"), time.Time{})
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, log.Entries(since, params.Get("key")))
+	}))
+}
+
+// parseTime reads a time given as Unix milliseconds, as Grafana's
+// ${__from} and ${__to} expand to, or as RFC 3339
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,65 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/audit"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestAudit(t *testing.T) {
+	log := audit.New(filepath.Join(t.TempDir(), "audit.jsonl"), 10, nil)
+	log.Record(nbe.WriteAttempt{Source: "mqtt:nbe/123/set/boiler/temp", Path: "boiler.temp", Value: []byte("70")})
+	log.Record(nbe.WriteAttempt{Source: "clock", Path: "clock.hour", Value: []byte("12")})
+
+	server, _ := newTestServer("secret", "")
+	mux := http.NewServeMux()
+	server.RegisterAudit(mux, log)
+
+	if recorder := get(mux, "/api/audit", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token, got %d", recorder.Code)
+	}
+
+	recorder := get(mux, "/api/audit?key=boiler.temp", "secret")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	var entries []audit.Entry
+	if err := json.NewDecoder(recorder.Body).Decode(&entries); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Source != "mqtt:nbe/123/set/boiler/temp" || entries[0].New != "70" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	recorder = get(mux, "/api/audit?since="+future, "secret")
+	if body := recorder.Body.String(); body != "[]\n" {
+		t.Errorf("Expected no entries since an hour from now, got %s", body)
+	}
+	if recorder := get(mux, "/api/audit?since=yesterday", "secret"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid since, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// maxBatchBody is the largest /api/settings request body accepted
+const maxBatchBody = 64 << 10
+
+// BatchFunc applies settings, keyed by <category>.<name>, as one batch
+type BatchFunc func(ctx context.Context, values map[string]string) ([]nbe.BatchWrite, error)
+
+// BatchResult is the outcome of a batch of writes, as returned by
+// /api/settings and published on the batch/result topic
+type BatchResult struct {
+	OK     bool             `json:"ok"`
+	Error  string           `json:"error,omitempty"`
+	Writes []nbe.BatchWrite `json:"writes,omitempty"`
+}
+
+// NewBatchResult returns the result of a batch that returned writes and err
+func NewBatchResult(writes []nbe.BatchWrite, err error) BatchResult {
+	result := BatchResult{OK: err == nil, Writes: writes}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// ParseBatch reads a JSON object of settings to write, keyed by
+// <category>.<name> or <category>/<name>, with string, number or boolean
+// values
+func ParseBatch(data []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of settings: %w", err)
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("no settings to write")
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		path := strings.Replace(key, "/", ".", 1)
+		if category, name, ok := strings.Cut(path, "."); !ok || category == "" || name == "" {
+			return nil, fmt.Errorf("%q is not a <category>.<name> setting", key)
+		}
+		switch v := value.(type) {
+		case string:
+			values[path] = v
+		case json.Number:
+			values[path] = v.String()
+		case bool:
+			values[path] = "0"
+			if v {
+				values[path] = "1"
+			}
+		default:
+			return nil, fmt.Errorf("%s: expected a string, number or boolean", key)
+		}
+	}
+	return values, nil
+}
+
+// RegisterBatch adds POST /api/settings, which writes the JSON object of
+// settings in the body as one batch. It answers 200 when every setting was
+// written and 409 when the batch was rolled back, with a BatchResult either
+// way. It needs a token.
+func (s *Server) RegisterBatch(mux *http.ServeMux, apply BatchFunc) {
+	if s.withoutToken("/api/settings") {
+		return
+	}
+	mux.HandleFunc("/api/settings", s.requireToken(s.token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		values, err := ParseBatch(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writes, err := apply(nbe.WithSource(r.Context(), "api:"+r.RemoteAddr), values)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+		}
+		writeJSON(w, NewBatchResult(writes, err))
+	}))
+}
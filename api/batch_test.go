@@ -0,0 +1,102 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestParseBatch(t *testing.T) {
+	values, err := ParseBatch([]byte(`{"boiler.temp": 70, "hot_water/temp": "55.5", "weather.active": true}`))
+	if err != nil {
+		t.Fatalf("ParseBatch() error = %v", err)
+	}
+	want := map[string]string{"boiler.temp": "70", "hot_water.temp": "55.5", "weather.active": "1"}
+	if len(values) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, values)
+	}
+	for path, value := range want {
+		if values[path] != value {
+			t.Errorf("Expected %s=%s, got %q", path, value, values[path])
+		}
+	}
+
+	for _, data := range []string{``, `[]`, `{}`, `{"temp": 70}`, `{"boiler.temp": [70]}`, `{"boiler.temp": null}`} {
+		if _, err := ParseBatch([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %s", data)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	server, _ := newTestServer("secret", "")
+	mux := http.NewServeMux()
+	var applied map[string]string
+	server.RegisterBatch(mux, func(ctx context.Context, values map[string]string) ([]nbe.BatchWrite, error) {
+		if source := nbe.Source(ctx); source != "api:192.0.2.1:1234" {
+			t.Errorf("Expected the api source with the client address, got %q", source)
+		}
+		applied = values
+		if values["boiler.temp"] == "90" {
+			return nil, errors.New("out of range")
+		}
+		return []nbe.BatchWrite{{Path: "boiler.temp", Value: values["boiler.temp"]}}, nil
+	})
+
+	send := func(method, body string) (*httptest.ResponseRecorder, BatchResult) {
+		request := httptest.NewRequest(method, "/api/settings", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		var result BatchResult
+		if recorder.Code == http.StatusOK || recorder.Code == http.StatusConflict {
+			if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode the response: %v", err)
+			}
+		}
+		return recorder, result
+	}
+
+	recorder, result := send(http.MethodPost, `{"boiler.temp": 70}`)
+	if recorder.Code != http.StatusOK || !result.OK || len(result.Writes) != 1 {
+		t.Errorf("Expected the batch to be applied, got %d %+v", recorder.Code, result)
+	}
+	if applied["boiler.temp"] != "70" {
+		t.Errorf("Expected boiler.temp=70 to be applied, got %v", applied)
+	}
+	if recorder, result := send(http.MethodPost, `{"boiler.temp": 90}`); recorder.Code != http.StatusConflict || result.OK || result.Error == "" {
+		t.Errorf("Expected 409 for a failed batch, got %d %+v", recorder.Code, result)
+	}
+	if recorder, _ := send(http.MethodPost, `{"boiler": 70}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid body, got %d", recorder.Code)
+	}
+	if recorder, _ := send(http.MethodGet, ``); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", recorder.Code)
+	}
+	if recorder := get(mux, "/api/settings", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token, got %d", recorder.Code)
+	}
+}
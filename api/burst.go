@@ -0,0 +1,66 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+)
+
+// burstState is the body of the /api/burst responses
+type burstState struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// RegisterBurst adds /api/burst: GET returns whether the operating data is
+// being polled at the burst interval, POST starts a burst for the duration
+// parameter (minutes or a Go duration, the default if omitted) and DELETE
+// ends it. It needs a token.
+func (s *Server) RegisterBurst(mux *http.ServeMux, burst *monitor.Burst) {
+	if s.withoutToken("/api/burst") {
+		return
+	}
+	mux.HandleFunc("/api/burst", s.requireToken(s.token, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			duration, err := monitor.ParseBurstDuration(r.URL.Query().Get("duration"))
+			if err == nil {
+				_, err = burst.Start(duration)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			burst.Cancel()
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var state burstState
+		if until, ok := burst.Until(); ok {
+			state.Active, state.Until = true, &until
+		}
+		writeJSON(w, state)
+	}))
+}
@@ -0,0 +1,74 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+)
+
+func TestBurst(t *testing.T) {
+	burst := monitor.NewBurst(time.Second, 10*time.Minute, time.Hour)
+	server, _ := newTestServer("secret", "")
+	mux := http.NewServeMux()
+	server.RegisterBurst(mux, burst)
+
+	send := func(method, target string) (*httptest.ResponseRecorder, burstState) {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		var state burstState
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&state); err != nil {
+				t.Fatalf("Failed to decode the response: %v", err)
+			}
+		}
+		return recorder, state
+	}
+
+	if recorder := get(mux, "/api/burst", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token, got %d", recorder.Code)
+	}
+	if _, state := send(http.MethodGet, "/api/burst"); state.Active {
+		t.Error("Expected no burst before one is started")
+	}
+
+	recorder, state := send(http.MethodPost, "/api/burst?duration=5")
+	if recorder.Code != http.StatusOK || !state.Active || state.Until == nil {
+		t.Fatalf("Expected the burst to start, got %d %+v", recorder.Code, state)
+	}
+	if remaining := time.Until(*state.Until); remaining <= 4*time.Minute || remaining > 5*time.Minute {
+		t.Errorf("Expected a 5 minute burst, ends in %s", remaining)
+	}
+	if recorder, _ := send(http.MethodPost, "/api/burst?duration=soon"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid duration, got %d", recorder.Code)
+	}
+
+	if _, state := send(http.MethodDelete, "/api/burst"); state.Active {
+		t.Error("Expected the burst to end")
+	}
+	if recorder, _ := send(http.MethodPut, "/api/burst"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for PUT, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,188 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/history"
+)
+
+// grafanaRange is the default range of an Infinity query without one
+const grafanaRange = 24 * time.Hour
+
+// grafanaQuery is the body of a SimpleJSON /query request
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	MaxDataPoints int `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+		Type   string `json:"type"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is a time series in a SimpleJSON /query response
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// grafanaTable is a table in a SimpleJSON /query response
+type grafanaTable struct {
+	Type    string              `json:"type"`
+	Columns []map[string]string `json:"columns"`
+	Rows    [][2]float64        `json:"rows"`
+}
+
+// RegisterGrafana adds the Grafana endpoints below /grafana/, backed by the
+// history store. They implement the SimpleJSON and JSON datasource API
+// (search, metrics, query and annotations) and, for the Infinity datasource,
+// /grafana/series?target=<path>&from=<time>&to=<time> returning plain JSON.
+func (s *Server) RegisterGrafana(mux *http.ServeMux, store *history.Store) {
+	mux.HandleFunc("/grafana/", s.requireToken(s.token, func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/grafana") {
+		case "", "/":
+			// the datasource's connection test
+			w.WriteHeader(http.StatusOK)
+		case "/search":
+			handleGrafanaSearch(w, r, store)
+		case "/metrics":
+			handleGrafanaMetrics(w, r, store)
+		case "/query":
+			handleGrafanaQuery(w, r, store)
+		case "/annotations":
+			writeJSON(w, []interface{}{})
+		case "/series":
+			handleGrafanaSeries(w, r, store)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// matchingSeries returns the recorded paths containing filter
+func matchingSeries(store *history.Store, filter string) []string {
+	paths := []string{}
+	for _, path := range store.Series() {
+		if strings.Contains(path, filter) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func handleGrafanaSearch(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	var body struct {
+		Target string `json:"target"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	writeJSON(w, matchingSeries(store, body.Target))
+}
+
+func handleGrafanaMetrics(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	var body struct {
+		Metric string `json:"metric"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	metrics := []map[string]string{}
+	for _, path := range matchingSeries(store, body.Metric) {
+		metrics = append(metrics, map[string]string{"label": path, "value": path})
+	}
+	writeJSON(w, metrics)
+}
+
+func handleGrafanaQuery(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var query grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := []interface{}{}
+	for _, target := range query.Targets {
+		if target.Target == "" {
+			continue
+		}
+		points := store.Query(target.Target, query.Range.From, query.Range.To, query.MaxDataPoints)
+		if target.Type == "table" {
+			rows := make([][2]float64, len(points))
+			for i, point := range points {
+				rows[i] = [2]float64{float64(point.Time.UnixMilli()), point.Value}
+			}
+			results = append(results, grafanaTable{
+				Type: "table",
+				Columns: []map[string]string{
+					{"text": "Time", "type": "time"},
+					{"text": target.Target, "type": "number"},
+				},
+				Rows: rows,
+			})
+			continue
+		}
+		datapoints := make([][2]float64, len(points))
+		for i, point := range points {
+			datapoints[i] = [2]float64{point.Value, float64(point.Time.UnixMilli())}
+		}
+		results = append(results, grafanaSeries{Target: target.Target, Datapoints: datapoints})
+	}
+	writeJSON(w, results)
+}
+
+func handleGrafanaSeries(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(params.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTime(params.Get("from"), to.Add(-grafanaRange))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxPoints, _ := strconv.Atoi(params.Get("max_points"))
+
+	type sample struct {
+		Time  time.Time `json:"time"`
+		Value float64   `json:"value"`
+	}
+	samples := []sample{}
+	for _, point := range store.Query(target, from, to, maxPoints) {
+		samples = append(samples, sample{Time: point.Time, Value: point.Value})
+	}
+	writeJSON(w, samples)
+}
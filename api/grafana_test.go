@@ -0,0 +1,142 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/history"
+)
+
+var grafanaStart = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func newGrafanaServer(token string) *http.ServeMux {
+	store := history.New("", 24*time.Hour, time.Second)
+	for i := 0; i < 3; i++ {
+		store.Record("operating_data", map[string]interface{}{"boiler_temp": int64(60 + i)}, grafanaStart.Add(time.Duration(i)*time.Minute))
+	}
+	store.Record("boiler", map[string]interface{}{"temp": int64(70)}, grafanaStart)
+
+	server, _ := newTestServer(token, "")
+	mux := http.NewServeMux()
+	server.RegisterGrafana(mux, store)
+	return mux
+}
+
+func post(mux *http.ServeMux, target, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestGrafanaSearch(t *testing.T) {
+	mux := newGrafanaServer("")
+
+	if recorder := get(mux, "/grafana/", ""); recorder.Code != http.StatusOK {
+		t.Errorf("Expected the connection test to succeed, got %d", recorder.Code)
+	}
+
+	var series []string
+	if err := json.NewDecoder(post(mux, "/grafana/search", `{"target": "operating"}`).Body).Decode(&series); err != nil {
+		t.Fatalf("Failed to decode search: %v", err)
+	}
+	if len(series) != 1 || series[0] != "operating_data/boiler_temp" {
+		t.Errorf("Expected the matching series, got %v", series)
+	}
+
+	var metrics []map[string]string
+	if err := json.NewDecoder(post(mux, "/grafana/metrics", `{}`).Body).Decode(&metrics); err != nil {
+		t.Fatalf("Failed to decode metrics: %v", err)
+	}
+	if len(metrics) != 2 || metrics[0]["value"] != "boiler/temp" {
+		t.Errorf("Expected every series as a metric, got %v", metrics)
+	}
+}
+
+func TestGrafanaQuery(t *testing.T) {
+	mux := newGrafanaServer("")
+	body := `{
+		"range": {"from": "2024-01-10T12:00:00Z", "to": "2024-01-10T13:00:00Z"},
+		"maxDataPoints": 100,
+		"targets": [
+			{"target": "operating_data/boiler_temp", "refId": "A", "type": "timeserie"},
+			{"target": "boiler/temp", "refId": "B", "type": "table"}
+		]
+	}`
+	recorder := post(mux, "/grafana/query", body)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var results []json.RawMessage
+	if err := json.NewDecoder(recorder.Body).Decode(&results); err != nil || len(results) != 2 {
+		t.Fatalf("Expected two results, got %s (%v)", recorder.Body.String(), err)
+	}
+
+	var series grafanaSeries
+	json.Unmarshal(results[0], &series)
+	if series.Target != "operating_data/boiler_temp" || len(series.Datapoints) != 3 {
+		t.Fatalf("Unexpected series %+v", series)
+	}
+	if series.Datapoints[2] != [2]float64{62, float64(grafanaStart.Add(2 * time.Minute).UnixMilli())} {
+		t.Errorf("Expected [value, unix ms] datapoints, got %v", series.Datapoints[2])
+	}
+
+	var table grafanaTable
+	json.Unmarshal(results[1], &table)
+	if table.Type != "table" || len(table.Rows) != 1 || table.Rows[0][1] != 70 {
+		t.Errorf("Unexpected table %+v", table)
+	}
+
+	if recorder := post(mux, "/grafana/query", "not json"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid query, got %d", recorder.Code)
+	}
+}
+
+func TestGrafanaSeries(t *testing.T) {
+	mux := newGrafanaServer("admin")
+	target := "/grafana/series?target=operating_data/boiler_temp&from=1704888060000&to=2024-01-10T13:00:00Z"
+
+	if recorder := get(mux, target, ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the API token to be required, got %d", recorder.Code)
+	}
+
+	recorder := get(mux, target, "admin")
+	var samples []struct {
+		Time  time.Time `json:"time"`
+		Value float64   `json:"value"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&samples); err != nil {
+		t.Fatalf("Failed to decode series: %s (%v)", recorder.Body.String(), err)
+	}
+	if len(samples) != 2 || samples[0].Value != 61 || !samples[0].Time.Equal(grafanaStart.Add(time.Minute)) {
+		t.Errorf("Unexpected samples %v", samples)
+	}
+
+	if recorder := get(mux, "/grafana/series", "admin"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a target, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,40 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/mlipscombe/boiler-mate/monitor"
+)
+
+// RegisterRefresh adds /api/refresh: POST makes every monitor poll right away
+// and republish all its values. It needs a token.
+func (s *Server) RegisterRefresh(mux *http.ServeMux) {
+	if s.withoutToken("/api/refresh") {
+		return
+	}
+	mux.HandleFunc("/api/refresh", s.requireToken(s.token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		monitor.Refresh()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+}
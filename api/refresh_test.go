@@ -0,0 +1,65 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefresh(t *testing.T) {
+	server, _ := newTestServer("secret", "")
+	mux := http.NewServeMux()
+	server.RegisterRefresh(mux)
+
+	send := func(method string) int {
+		request := httptest.NewRequest(method, "/api/refresh", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if recorder := get(mux, "/api/refresh", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token, got %d", recorder.Code)
+	}
+	if code := send(http.MethodPost); code != http.StatusAccepted {
+		t.Errorf("Expected 202, got %d", code)
+	}
+	if code := send(http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", code)
+	}
+}
+
+func TestControlsNeedToken(t *testing.T) {
+	server, _ := newTestServer("", "")
+	mux := http.NewServeMux()
+	server.RegisterRefresh(mux)
+	server.RegisterBurst(mux, nil)
+	server.RegisterBatch(mux, nil)
+
+	for _, path := range []string{"/api/refresh", "/api/burst", "/api/settings"} {
+		request := httptest.NewRequest(http.MethodPost, path, nil)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to be left out without a token, got %d", path, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+)
+
+// State keeps the latest published value of every key, addressed by the MQTT
+// style path "<category>/<key>"
+type State struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// NewState creates a state that follows the value changes on the bus
+func NewState(eventBus *bus.Bus) *State {
+	s := &State{values: make(map[string]interface{})}
+	eventBus.Subscribe(func(event bus.Event) {
+		s.Update(event.Category, event.Values)
+	}, bus.ValueChanged)
+	return s
+}
+
+// Update records changed values of a category
+func (s *State) Update(category string, values map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range values {
+		s.values[category+"/"+key] = value
+	}
+}
+
+// Get returns the latest value of path
+func (s *State) Get(path string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[path]
+	return value, ok
+}
+
+// Snapshot returns a copy of all values, or only those in paths if given
+func (s *State) Snapshot(paths ...string) map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(paths) == 0 {
+		result := make(map[string]interface{}, len(s.values))
+		for path, value := range s.values {
+			result[path] = value
+		}
+		return result
+	}
+
+	result := make(map[string]interface{}, len(paths))
+	for _, path := range paths {
+		if value, ok := s.values[path]; ok {
+			result[path] = value
+		}
+	}
+	return result
+}
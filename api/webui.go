@@ -0,0 +1,98 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebUIAvailable reports whether this build includes the web UI
+const WebUIAvailable = true
+
+// RegisterWebUI adds the public status page to mux
+func (s *Server) RegisterWebUI(mux *http.ServeMux) {
+	mux.HandleFunc("/public", s.requirePublicToken(s.handlePublicPage))
+}
+
+var publicPage = template.Must(template.New("public").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="30">
+<title>Boiler status</title>
+<style>body{font-family:sans-serif;margin:2em}td{padding:.3em 1em .3em 0}</style>
+</head>
+<body>
+<h1>Boiler status</h1>
+<table>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type publicRow struct {
+	Name  string
+	Value string
+}
+
+// describe returns a readable name and the value with its unit, using the
+// field dictionary for operating and advanced data
+func describe(path string, value interface{}) publicRow {
+	category, key := path, path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		category, key = path[:i], path[i+1:]
+	}
+
+	row := publicRow{Name: strings.ReplaceAll(key, "_", " "), Value: fmt.Sprintf("%v", value)}
+	fields := map[string]map[string]nbe.FieldDefinition{
+		"operating_data": nbe.OperatingFields,
+		"advanced_data":  nbe.AdvancedFields,
+	}[category]
+	if field, ok := fields[key]; ok {
+		row.Name = field.Description
+		if field.Unit != "" {
+			row.Value += " " + field.Unit
+		}
+	}
+	return row
+}
+
+func (s *Server) handlePublicPage(w http.ResponseWriter, r *http.Request) {
+	values := s.state.Snapshot(s.publicValues...)
+	rows := make([]publicRow, 0, len(values))
+	for _, path := range s.publicValues {
+		if value, ok := values[path]; ok {
+			rows = append(rows, describe(path, value))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := publicPage.Execute(w, rows); err != nil {
+		log.Debugf("Failed to render public page: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WebUIAvailable reports whether this build includes the web UI
+const WebUIAvailable = false
+
+// RegisterWebUI does nothing in minimal builds, which leave out the web UI
+func (s *Server) RegisterWebUI(mux *http.ServeMux) {
+	log.Warn("The web UI is not included in minimal builds")
+}
@@ -0,0 +1,46 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPublicPage(t *testing.T) {
+	_, mux := newTestServer("admin", "tenant")
+
+	if recorder := get(mux, "/public", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", recorder.Code)
+	}
+
+	recorder := get(mux, "/public?token=tenant", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with the public token in the link, got %d", recorder.Code)
+	}
+	page := recorder.Body.String()
+	if !strings.Contains(page, "Boiler temperature") || !strings.Contains(page, "62.5 °C") {
+		t.Errorf("Expected described boiler temperature on the page, got:\n%s", page)
+	}
+	if strings.Contains(page, "oxygen") {
+		t.Error("Expected oxygen to stay off the public page")
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package audit keeps a persistent log of every write made to the controller:
+// where it came from, the value it replaced, the value written and whether
+// the controller accepted it.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	log "github.com/sirupsen/logrus"
+)
+
+// Entry is one write in the audit log
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Source is what made the write, such as "mqtt:<topic>" or
+	// "scheduler:<name>"; empty when the writer did not name itself
+	Source string `json:"source,omitempty"`
+	Key    string `json:"key"`
+	// Old is the last value read for the key before the write, empty when
+	// none was read yet. Like New, it is in the controller's units.
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+	// Error is why the write failed; empty when the controller accepted it
+	Error string `json:"error,omitempty"`
+}
+
+// OK reports whether the controller accepted the write
+func (e Entry) OK() bool {
+	return e.Error == ""
+}
+
+// Log appends the writes to a JSON lines file, keeping the latest MaxEntries.
+// The old value of a write is the last value of the key seen on the bus, with
+// its pipeline undone.
+type Log struct {
+	Path       string
+	MaxEntries int
+
+	pipelines *pipeline.Pipelines
+
+	mu      sync.Mutex
+	entries []Entry
+	// lines is how many entries the file holds; it is rewritten with the
+	// latest MaxEntries once it holds twice as many
+	lines  int
+	values map[string]string
+	now    func() time.Time
+}
+
+// New creates a log appending to path, undoing pipelines on the values seen
+// on the bus
+func New(path string, maxEntries int, pipelines *pipeline.Pipelines) *Log {
+	return &Log{
+		Path:       path,
+		MaxEntries: maxEntries,
+		pipelines:  pipelines,
+		values:     make(map[string]string),
+		now:        time.Now,
+	}
+}
+
+// Run loads the saved log, follows the values on the bus and records every
+// write attempted on boiler
+func (l *Log) Run(boiler *nbe.NBE, eventBus *bus.Bus) error {
+	entries, err := Load(l.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l.mu.Lock()
+	l.lines = len(entries)
+	l.entries = latest(entries, l.MaxEntries)
+	l.mu.Unlock()
+
+	eventBus.Subscribe(func(event bus.Event) {
+		l.Observe(event.Category, event.Values)
+	}, bus.ValueChanged)
+	boiler.OnWriteAttempt(func(attempt nbe.WriteAttempt) {
+		if err := l.Record(attempt); err != nil {
+			log.Errorf("Failed to write the audit log: %v", err)
+		}
+	})
+	return nil
+}
+
+// Observe remembers the values of a category as the old values of later
+// writes. A value its pipeline cannot be undone for is forgotten.
+func (l *Log) Observe(category string, values map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, value := range values {
+		path := category + "." + key
+		raw, err := l.pipelines.Write(path, []byte(fmt.Sprintf("%v", value)))
+		if err != nil {
+			delete(l.values, path)
+			continue
+		}
+		l.values[path] = string(raw)
+	}
+}
+
+// Record appends a write attempt to the log
+func (l *Log) Record(attempt nbe.WriteAttempt) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := Entry{
+		Time:   l.now(),
+		Source: attempt.Source,
+		Key:    attempt.Path,
+		Old:    l.values[attempt.Path],
+		New:    string(attempt.Value),
+	}
+	if attempt.Err != nil {
+		entry.Error = attempt.Err.Error()
+	} else {
+		l.values[attempt.Path] = entry.New
+	}
+	l.entries = latest(append(l.entries, entry), l.MaxEntries)
+
+	if l.lines >= 2*l.MaxEntries {
+		return l.rewrite()
+	}
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(entry); err != nil {
+		return err
+	}
+	l.lines++
+	return nil
+}
+
+// rewrite replaces the file with the entries kept in memory
+func (l *Log) rewrite() error {
+	tmp := l.Path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range l.entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.Path); err != nil {
+		return err
+	}
+	l.lines = len(l.entries)
+	return nil
+}
+
+// Entries returns the writes since the given time, oldest first; a non-empty
+// key keeps only the writes to it
+func (l *Log) Entries(since time.Time, key string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Filter(l.entries, since, key)
+}
+
+// Filter returns the entries made at or after since, and to key unless it is
+// empty
+func Filter(entries []Entry, since time.Time, key string) []Entry {
+	result := []Entry{}
+	for _, entry := range entries {
+		if entry.Time.Before(since) || (key != "" && entry.Key != key) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Load reads the entries of a log file, oldest first
+func Load(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// latest returns the last n entries
+func latest(entries []Entry, n int) []Entry {
+	if len(entries) <= n {
+		return entries
+	}
+	return append([]Entry(nil), entries[len(entries)-n:]...)
+}
@@ -0,0 +1,129 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package audit
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+var start = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func newTestLog(t *testing.T, maxEntries int) *Log {
+	l := New(filepath.Join(t.TempDir(), "audit.jsonl"), maxEntries, nil)
+	now := start
+	l.now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	return l
+}
+
+func TestRecordOldAndNewValues(t *testing.T) {
+	l := newTestLog(t, 10)
+	l.Observe("boiler", map[string]interface{}{"temp": nbe.RoundedFloat(65)})
+
+	attempts := []nbe.WriteAttempt{
+		{Source: "mqtt:nbe/123/set/boiler/temp", Path: "boiler.temp", Value: []byte("70")},
+		{Source: "scheduler:night", Path: "boiler.temp", Value: []byte("90"), Err: errors.New("permission denied")},
+		{Source: "scheduler:night", Path: "boiler.temp", Value: []byte("60")},
+	}
+	for _, attempt := range attempts {
+		if err := l.Record(attempt); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	entries := l.Entries(time.Time{}, "")
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %+v", entries)
+	}
+	if e := entries[0]; e.Old != "65" || e.New != "70" || !e.OK() || e.Source != "mqtt:nbe/123/set/boiler/temp" {
+		t.Errorf("Unexpected first entry %+v", e)
+	}
+	// the denied write leaves the old value in place
+	if e := entries[1]; e.Old != "70" || e.OK() || e.Error != "permission denied" {
+		t.Errorf("Unexpected second entry %+v", e)
+	}
+	if e := entries[2]; e.Old != "70" || e.New != "60" {
+		t.Errorf("Unexpected third entry %+v", e)
+	}
+
+	saved, err := Load(l.Path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(saved) != 3 || saved[1] != entries[1] {
+		t.Errorf("Expected the saved entries to match, got %+v", saved)
+	}
+}
+
+func TestRecordOldValueInControllerUnits(t *testing.T) {
+	l := newTestLog(t, 10)
+	l.pipelines = pipeline.New(map[string][]config.PipelineStep{
+		"hot_water/temp": {{Convert: "c_to_f"}},
+	})
+	// 131 °F as published is 55 °C on the controller
+	l.Observe("hot_water", map[string]interface{}{"temp": nbe.RoundedFloat(131)})
+	if err := l.Record(nbe.WriteAttempt{Path: "hot_water.temp", Value: []byte("60")}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	if entries := l.Entries(time.Time{}, ""); len(entries) != 1 || entries[0].Old != "55" || entries[0].New != "60" {
+		t.Errorf("Expected 55 replaced by 60, got %+v", entries)
+	}
+}
+
+func TestEntriesFilter(t *testing.T) {
+	l := newTestLog(t, 10)
+	l.Record(nbe.WriteAttempt{Path: "boiler.temp", Value: []byte("70")})
+	l.Record(nbe.WriteAttempt{Path: "hot_water.temp", Value: []byte("55")})
+	l.Record(nbe.WriteAttempt{Path: "boiler.temp", Value: []byte("72")})
+
+	if entries := l.Entries(time.Time{}, "boiler.temp"); len(entries) != 2 || entries[1].New != "72" {
+		t.Errorf("Unexpected entries for boiler.temp: %+v", entries)
+	}
+	if entries := l.Entries(start.Add(2*time.Minute), ""); len(entries) != 2 || entries[0].Key != "hot_water.temp" {
+		t.Errorf("Unexpected entries since the second write: %+v", entries)
+	}
+}
+
+func TestRecordKeepsLatestEntries(t *testing.T) {
+	l := newTestLog(t, 2)
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		if err := l.Record(nbe.WriteAttempt{Path: "boiler.temp", Value: []byte(value)}); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	if entries := l.Entries(time.Time{}, ""); len(entries) != 2 || entries[0].New != "4" {
+		t.Errorf("Expected the last two writes, got %+v", entries)
+	}
+	saved, err := Load(l.Path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(saved) > 4 || saved[len(saved)-1].New != "5" {
+		t.Errorf("Expected the file to be compacted, got %+v", saved)
+	}
+}
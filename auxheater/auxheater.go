@@ -0,0 +1,102 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package auxheater meters the electric backup element some controllers
+// drive. From the element's state, rated power and runtime counter in the
+// aux_heater setup category, it derives the power drawn now and the energy
+// used so far, for Home Assistant's energy dashboard.
+package auxheater
+
+import (
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Category is the setup category of the element, and the bus category the
+// derived values are published in
+const Category = "aux_heater"
+
+// Meter follows the element's settings on the bus and publishes
+// aux_heater/current_power in W and aux_heater/energy in kWh as they change
+type Meter struct {
+	eventBus *bus.Bus
+
+	mu        sync.Mutex
+	on        bool
+	rated     float64 // kW
+	runtime   float64 // hours
+	haveRated bool
+	published map[string]interface{}
+}
+
+// New creates a meter publishing on eventBus
+func New(eventBus *bus.Bus) *Meter {
+	return &Meter{eventBus: eventBus, published: make(map[string]interface{})}
+}
+
+// Run starts following the element's settings
+func (m *Meter) Run() {
+	m.eventBus.Subscribe(m.handle, bus.ValueChanged)
+}
+
+func (m *Meter) handle(event bus.Event) {
+	if event.Category != Category {
+		return
+	}
+	if changes := m.update(event.Values); len(changes) > 0 {
+		m.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: Category, Values: changes})
+	}
+}
+
+// update takes the element's state, rated power and runtime from values and
+// returns the derived values that changed
+func (m *Meter) update(values map[string]interface{}) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := nbe.ToFloat(values["state"]); ok {
+		m.on = state != 0
+	}
+	if rated, ok := nbe.ToFloat(values["power"]); ok {
+		m.rated, m.haveRated = rated, true
+	}
+	if runtime, ok := nbe.ToFloat(values["runtime"]); ok {
+		m.runtime = runtime
+	}
+	if !m.haveRated {
+		return nil
+	}
+
+	power := 0.0
+	if m.on {
+		power = m.rated * 1000
+	}
+	derived := map[string]interface{}{
+		"current_power": nbe.RoundedFloat(power),
+		"energy":        nbe.RoundedFloat(m.runtime * m.rated),
+	}
+	changes := make(map[string]interface{})
+	for key, value := range derived {
+		if m.published[key] != value {
+			changes[key] = value
+			m.published[key] = value
+		}
+	}
+	return changes
+}
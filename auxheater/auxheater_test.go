@@ -0,0 +1,64 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package auxheater
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestMeterDerivesPowerAndEnergy(t *testing.T) {
+	eventBus := bus.New()
+	meter := New(eventBus)
+	meter.Run()
+	var published []map[string]interface{}
+	eventBus.Subscribe(func(event bus.Event) {
+		_, power := event.Values["current_power"]
+		_, energy := event.Values["energy"]
+		if event.Category == Category && (power || energy) {
+			published = append(published, event.Values)
+		}
+	}, bus.ValueChanged)
+
+	// nothing is derived before the rated power is known
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: Category, Values: map[string]interface{}{"state": int64(1)}})
+	if len(published) != 0 {
+		t.Fatalf("Expected nothing without the rated power, got %v", published)
+	}
+
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: Category, Values: map[string]interface{}{
+		"power":   nbe.RoundedFloat(3),
+		"runtime": int64(12),
+	}})
+	if len(published) != 1 || published[0]["current_power"] != nbe.RoundedFloat(3000) || published[0]["energy"] != nbe.RoundedFloat(36) {
+		t.Fatalf("Expected 3000 W and 36 kWh, got %v", published)
+	}
+
+	// only the values that changed are published
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: Category, Values: map[string]interface{}{"state": int64(0)}})
+	if len(published) != 2 || len(published[1]) != 1 || published[1]["current_power"] != nbe.RoundedFloat(0) {
+		t.Errorf("Expected only the power to drop to 0, got %v", published)
+	}
+
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{"power": nbe.RoundedFloat(20)}})
+	if len(published) != 2 {
+		t.Errorf("Expected other categories to be ignored, got %v", published)
+	}
+}
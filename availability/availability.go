@@ -0,0 +1,303 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package availability records whether the controller answers over time and
+// derives the monthly uptime and outage count, to tell a flaky WiFi dongle
+// from a boiler that is merely idle.
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// monthLayout keys the months of the history
+	monthLayout = "2006-01"
+	// keepMonths is how many months of figures the history keeps
+	keepMonths = 13
+	// keepOutages is how many of the most recent outages the history keeps
+	keepOutages = 100
+	// saveInterval is how often the history is saved while nothing changes
+	saveInterval = 5 * time.Minute
+)
+
+// History is the reachability record kept in the history file
+type History struct {
+	// Months holds the figures of each month, keyed "2006-01"
+	Months map[string]*Month `json:"months"`
+	// Outages lists the most recent outages, oldest first
+	Outages []Outage `json:"outages"`
+}
+
+// Month is the time the controller was watched and unreachable in a month
+type Month struct {
+	ObservedSeconds float64 `json:"observed_s"`
+	DownSeconds     float64 `json:"down_s"`
+	Outages         int     `json:"outages"`
+}
+
+// Uptime returns the share of the watched time the controller answered, in
+// percent, or false if the month was not watched
+func (m *Month) Uptime() (float64, bool) {
+	if m == nil || m.ObservedSeconds <= 0 {
+		return 0, false
+	}
+	return (m.ObservedSeconds - m.DownSeconds) / m.ObservedSeconds * 100, true
+}
+
+// Outage is a period the controller did not answer; End is zero while it
+// lasts
+type Outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Tracker samples the controller's reachability, keeps the history in a file
+// and publishes the figures below availability/. Time the bridge itself was
+// not running is not counted against the controller.
+type Tracker struct {
+	Path     string
+	Interval time.Duration
+
+	eventBus  *bus.Bus
+	reachable func(now time.Time) bool
+	now       func() time.Time
+
+	mu      sync.Mutex
+	history *History
+	last    time.Time
+	down    bool
+	saved   time.Time
+}
+
+// New creates a tracker counting the boiler as unreachable once it has not
+// answered for maxAge, sampling every interval and keeping the history at path
+func New(boiler *nbe.NBE, eventBus *bus.Bus, path string, interval, maxAge time.Duration) *Tracker {
+	return &Tracker{
+		Path:     path,
+		Interval: interval,
+		eventBus: eventBus,
+		reachable: func(now time.Time) bool {
+			last := boiler.LastResponse()
+			return !last.IsZero() && now.Sub(last) <= maxAge
+		},
+		now:     time.Now,
+		history: &History{Months: make(map[string]*Month)},
+	}
+}
+
+// Run loads the history and samples the controller every interval
+func (t *Tracker) Run() error {
+	if err := t.load(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			t.Sample()
+			t.Publish()
+			time.Sleep(t.Interval)
+		}
+	}()
+	return nil
+}
+
+// Sample records whether the controller is reachable now, saving the history
+// when an outage starts or ends and otherwise every few minutes
+func (t *Tracker) Sample() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	changed := t.record(now, t.reachable(now))
+	if !changed && now.Sub(t.saved) < saveInterval {
+		return
+	}
+	if err := t.save(); err != nil {
+		log.Errorf("Failed to save the availability history: %v", err)
+		return
+	}
+	t.saved = now
+}
+
+// record accounts the time since the previous sample to the state seen then
+// and returns whether an outage started or ended. A gap of more than two
+// intervals is time the bridge was not running and is left out.
+func (t *Tracker) record(now time.Time, up bool) bool {
+	if !t.last.IsZero() && now.Sub(t.last) <= 2*t.Interval {
+		for from := t.last; from.Before(now); {
+			until := nextMonth(from)
+			if until.After(now) {
+				until = now
+			}
+			month := t.month(from)
+			month.ObservedSeconds += until.Sub(from).Seconds()
+			if t.down {
+				month.DownSeconds += until.Sub(from).Seconds()
+			}
+			from = until
+		}
+	}
+	t.last = now
+
+	switch {
+	case !up && !t.down:
+		t.down = true
+		t.month(now).Outages++
+		t.history.Outages = append(t.history.Outages, Outage{Start: now})
+		if len(t.history.Outages) > keepOutages {
+			t.history.Outages = t.history.Outages[len(t.history.Outages)-keepOutages:]
+		}
+		log.Warnf("Controller unreachable since %s", now.Format(time.RFC3339))
+		return true
+	case up && t.down:
+		t.down = false
+		if n := len(t.history.Outages); n > 0 {
+			outage := &t.history.Outages[n-1]
+			outage.End = now
+			log.Infof("Controller reachable again after %s", now.Sub(outage.Start).Round(time.Second))
+		}
+		return true
+	}
+	return false
+}
+
+// month returns the figures of the month containing when, dropping months
+// older than the history keeps
+func (t *Tracker) month(when time.Time) *Month {
+	key := when.Format(monthLayout)
+	if month, ok := t.history.Months[key]; ok {
+		return month
+	}
+	month := &Month{}
+	t.history.Months[key] = month
+
+	keys := make([]string, 0, len(t.history.Months))
+	for key := range t.history.Months {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for len(keys) > keepMonths {
+		delete(t.history.Months, keys[0])
+		keys = keys[1:]
+	}
+	return month
+}
+
+// Values returns the figures published for the current month: the uptime in
+// "uptime", once the month has been watched, the outage count in "outages",
+// and the downtime, the previous month and the last outage in "attributes"
+func (t *Tracker) Values() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	current := t.history.Months[now.Format(monthLayout)]
+	previous := t.history.Months[previousMonth(now).Format(monthLayout)]
+
+	attributes := map[string]interface{}{
+		"month": now.Format(monthLayout),
+	}
+	values := map[string]interface{}{
+		"outages":    int64(0),
+		"attributes": attributes,
+	}
+	if current != nil {
+		values["outages"] = int64(current.Outages)
+		attributes["downtime_minutes"] = nbe.RoundedFloat(current.DownSeconds / 60)
+	}
+	if uptime, ok := current.Uptime(); ok {
+		values["uptime"] = nbe.RoundedFloat(uptime)
+	}
+	if uptime, ok := previous.Uptime(); ok {
+		attributes["previous_month_uptime"] = nbe.RoundedFloat(uptime)
+		attributes["previous_month_outages"] = int64(previous.Outages)
+	}
+	if n := len(t.history.Outages); n > 0 {
+		outage := t.history.Outages[n-1]
+		attributes["last_outage_start"] = outage.Start.Format(time.RFC3339)
+		if !outage.End.IsZero() {
+			attributes["last_outage_end"] = outage.End.Format(time.RFC3339)
+		}
+	}
+	return values
+}
+
+// Publish publishes the current figures on the bus
+func (t *Tracker) Publish() {
+	t.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "availability", Values: t.Values()})
+}
+
+// load reads the history file; a missing file starts an empty history. An
+// outage still open in the file continues until the controller answers.
+func (t *Tracker) load() error {
+	data, err := os.ReadFile(t.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var history History
+	if err := json.Unmarshal(data, &history); err != nil {
+		return fmt.Errorf("parsing %s: %w", t.Path, err)
+	}
+	if history.Months == nil {
+		history.Months = make(map[string]*Month)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.history = &history
+	if n := len(history.Outages); n > 0 && history.Outages[n-1].End.IsZero() {
+		t.down = true
+	}
+	return nil
+}
+
+// save writes the history file; the caller holds t.mu
+func (t *Tracker) save() error {
+	data, err := json.MarshalIndent(t.history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.Path)
+}
+
+func nextMonth(when time.Time) time.Time {
+	year, month, _ := when.Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, when.Location())
+}
+
+func previousMonth(when time.Time) time.Time {
+	year, month, _ := when.Date()
+	return time.Date(year, month-1, 1, 0, 0, 0, 0, when.Location())
+}
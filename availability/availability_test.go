@@ -0,0 +1,140 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package availability
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestTracker(t *testing.T, start time.Time) (*Tracker, *clock.Fake, *bool) {
+	c := clock.NewFake(start)
+	up := true
+	tracker := &Tracker{
+		Path:      filepath.Join(t.TempDir(), "availability.json"),
+		Interval:  time.Minute,
+		eventBus:  bus.New(),
+		reachable: func(time.Time) bool { return up },
+		now:       c.Now,
+		history:   &History{Months: make(map[string]*Month)},
+	}
+	return tracker, c, &up
+}
+
+func TestTrackerUptime(t *testing.T) {
+	tracker, fake, up := newTestTracker(t, time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	tracker.Sample()
+	if _, ok := tracker.Values()["uptime"]; ok {
+		t.Error("Expected no uptime before any time was watched")
+	}
+
+	// 9 minutes up, then one outage of 1 minute
+	for i := 0; i < 9; i++ {
+		fake.Advance(time.Minute)
+		tracker.Sample()
+	}
+	*up = false
+	tracker.Sample()
+	fake.Advance(time.Minute)
+	*up = true
+	tracker.Sample()
+
+	values := tracker.Values()
+	if values["uptime"] != nbe.RoundedFloat(90) {
+		t.Errorf("Expected 90%% uptime, got %v", values["uptime"])
+	}
+	if values["outages"] != int64(1) {
+		t.Errorf("Expected 1 outage, got %v", values["outages"])
+	}
+	attributes := values["attributes"].(map[string]interface{})
+	if attributes["downtime_minutes"] != nbe.RoundedFloat(1) {
+		t.Errorf("Expected 1 minute of downtime, got %v", attributes["downtime_minutes"])
+	}
+	if attributes["last_outage_start"] != "2024-01-10T08:09:00Z" || attributes["last_outage_end"] != "2024-01-10T08:10:00Z" {
+		t.Errorf("Unexpected last outage in %v", attributes)
+	}
+}
+
+func TestTrackerSkipsBridgeDowntime(t *testing.T) {
+	tracker, fake, _ := newTestTracker(t, time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	tracker.Sample()
+	fake.Advance(time.Minute)
+	tracker.Sample()
+	// the bridge was stopped for an hour
+	fake.Advance(time.Hour)
+	tracker.Sample()
+
+	month := tracker.history.Months["2024-01"]
+	if month.ObservedSeconds != 60 {
+		t.Errorf("Expected only the watched minute to count, got %vs", month.ObservedSeconds)
+	}
+}
+
+func TestTrackerSplitsMonths(t *testing.T) {
+	tracker, fake, up := newTestTracker(t, time.Date(2024, 1, 31, 23, 59, 30, 0, time.UTC))
+
+	*up = false
+	tracker.Sample()
+	fake.Advance(time.Minute)
+	tracker.Sample()
+
+	january, february := tracker.history.Months["2024-01"], tracker.history.Months["2024-02"]
+	if january.DownSeconds != 30 || february.DownSeconds != 30 {
+		t.Errorf("Expected the outage split between months, got %+v and %+v", january, february)
+	}
+	if january.Outages != 1 || february.Outages != 0 {
+		t.Errorf("Expected the outage counted in the month it started, got %d and %d", january.Outages, february.Outages)
+	}
+
+	attributes := tracker.Values()["attributes"].(map[string]interface{})
+	if attributes["previous_month_uptime"] != nbe.RoundedFloat(0) {
+		t.Errorf("Expected the previous month in the attributes, got %v", attributes)
+	}
+}
+
+func TestTrackerKeepsHistory(t *testing.T) {
+	tracker, fake, up := newTestTracker(t, time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	tracker.Sample()
+	*up = false
+	fake.Advance(time.Minute)
+	tracker.Sample()
+	if _, err := os.Stat(tracker.Path); err != nil {
+		t.Fatalf("Expected the history to be saved when the outage started: %v", err)
+	}
+
+	restarted, _, _ := newTestTracker(t, fake.Now())
+	restarted.Path = tracker.Path
+	if err := restarted.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if !restarted.down {
+		t.Error("Expected the open outage to continue after a restart")
+	}
+	if month := restarted.history.Months["2024-01"]; month == nil || month.ObservedSeconds != 60 || month.Outages != 1 {
+		t.Errorf("Unexpected history after a restart: %+v", month)
+	}
+}
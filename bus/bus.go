@@ -0,0 +1,116 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package bus carries events from the monitors to the sinks, notifiers and
+// rules that act on them, so producers don't need to know who consumes them.
+package bus
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Kind identifies what an Event describes
+type Kind string
+
+const (
+	// ValueChanged carries the values of Category that changed since the last poll
+	ValueChanged Kind = "value_changed"
+	// Alarm is raised when the controller reports an alarm code in Value
+	Alarm Kind = "alarm"
+	// StateTransition is raised when the power state Key moves from Previous to Value
+	StateTransition Kind = "state_transition"
+	// WritePerformed reports the outcome of writing Value to setting Key
+	WritePerformed Kind = "write_performed"
+	// ConnectivityChanged reports whether the connection named by Key is up
+	ConnectivityChanged Kind = "connectivity_changed"
+)
+
+// Event is a single occurrence published on the bus. Which fields are set
+// depends on Kind.
+type Event struct {
+	Kind     Kind
+	Time     time.Time
+	Category string
+	Key      string
+	Values   map[string]interface{}
+	Value    interface{}
+	Previous interface{}
+	Text     string
+	Err      error
+	// Guaranteed marks a value change that queued subscribers must not drop
+	Guaranteed bool
+	// Context carries the trace of the command that caused the event, if any
+	Context context.Context
+}
+
+// Handler receives events from the bus
+type Handler func(Event)
+
+type subscriber struct {
+	kinds   map[Kind]bool
+	handler Handler
+}
+
+// Bus delivers published events to every subscriber interested in their kind
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []subscriber
+}
+
+// New creates an empty bus
+func New() *Bus {
+	return &Bus{}
+}
+
+// Subscribe registers handler for the given kinds, or for every kind if none
+// are given
+func (b *Bus) Subscribe(handler Handler, kinds ...Kind) {
+	sub := subscriber{handler: handler}
+	if len(kinds) > 0 {
+		sub.kinds = make(map[Kind]bool, len(kinds))
+		for _, kind := range kinds {
+			sub.kinds[kind] = true
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, sub)
+}
+
+// Publish delivers event to the matching subscribers in the order they
+// subscribed. Publishing on a nil bus does nothing.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+
+	for _, sub := range subscribers {
+		if sub.kinds == nil || sub.kinds[event.Kind] {
+			sub.handler(event)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package bus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestPublishDeliversToMatchingSubscribers(t *testing.T) {
+	b := New()
+
+	var all, alarms []Kind
+	b.Subscribe(func(event Event) { all = append(all, event.Kind) })
+	b.Subscribe(func(event Event) { alarms = append(alarms, event.Kind) }, Alarm)
+
+	b.Publish(Event{Kind: ValueChanged, Category: "operating_data"})
+	b.Publish(Event{Kind: Alarm, Value: int64(9)})
+
+	if len(all) != 2 {
+		t.Errorf("Expected unfiltered subscriber to see 2 events, got %v", all)
+	}
+	if len(alarms) != 1 || alarms[0] != Alarm {
+		t.Errorf("Expected alarm subscriber to see only the alarm, got %v", alarms)
+	}
+}
+
+func TestPublishSetsTime(t *testing.T) {
+	b := New()
+	var received Event
+	b.Subscribe(func(event Event) { received = event })
+
+	b.Publish(Event{Kind: ConnectivityChanged, Key: "mqtt", Value: true})
+	if received.Time.IsZero() {
+		t.Error("Expected the event time to be set on publish")
+	}
+}
+
+func TestPublishOnNilBus(t *testing.T) {
+	var b *Bus
+	b.Publish(Event{Kind: ValueChanged})
+}
+
+func TestSetResult(t *testing.T) {
+	result := setResult([]byte("75"), nil, nil)
+	if result["success"] != true || result["value"] != "75" {
+		t.Errorf("Expected successful result for 75, got %v", result)
+	}
+	if _, ok := result["error"]; ok {
+		t.Errorf("Expected no error in successful result, got %v", result["error"])
+	}
+	if _, ok := result["stored"]; ok {
+		t.Errorf("Expected no stored value without a read back, got %v", result["stored"])
+	}
+
+	result = setResult([]byte("80"), int64(75), errors.New("controller stored 75 instead of 80"))
+	if result["success"] != false || result["stored"] != "75" {
+		t.Errorf("Expected failed result storing 75, got %v", result)
+	}
+
+	result = setResult([]byte("120"), nil, errors.New("boiler.temp: 120 is outside 0..85"))
+	if result["success"] != false {
+		t.Errorf("Expected failed result, got %v", result)
+	}
+	if result["error"] != "boiler.temp: 120 is outside 0..85" {
+		t.Errorf("Expected error message in result, got %v", result["error"])
+	}
+	if _, ok := result["error_code"]; ok {
+		t.Errorf("Expected no error code for a rejected value, got %v", result["error_code"])
+	}
+
+	result = setResult([]byte("70"), nil, &nbe.StatusError{Path: "boiler.temp", Status: nbe.StatusDenied})
+	if result["success"] != false || result["error_code"] != "permission_denied" {
+		t.Errorf("Expected a permission denied result, got %v", result)
+	}
+}
+
+func TestAggregatePayload(t *testing.T) {
+	values := map[string]interface{}{"boiler_temp": nbe.RoundedFloat(65.5), "state": int64(5)}
+
+	topic, payload, err := aggregatePayload("operating_data", values, false)
+	if err != nil {
+		t.Fatalf("aggregatePayload() error = %v", err)
+	}
+	if topic != "json/operating_data" || string(payload) != `{"boiler_temp":65.50,"state":5}` {
+		t.Errorf("Unexpected aggregate %s %s", topic, payload)
+	}
+
+	topic, compressed, err := aggregatePayload("operating_data", values, true)
+	if err != nil {
+		t.Fatalf("aggregatePayload() error = %v", err)
+	}
+	if topic != "json/operating_data.gz" {
+		t.Errorf("Expected the .gz topic, got %s", topic)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Expected a gzip payload: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decompressed, payload) {
+		t.Errorf("Expected the compressed payload to hold %s, got %s (%v)", payload, decompressed, err)
+	}
+}
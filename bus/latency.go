@@ -0,0 +1,86 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var publishLatencyHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "boiler_mate",
+		Subsystem: "bus",
+		Name:      "publish_latency_seconds",
+		Help:      "Time from a poll completing to the broker acknowledging its values",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	},
+	[]string{"category"},
+)
+
+func init() {
+	prometheus.MustRegister(publishLatencyHistogram)
+}
+
+// Latency collects the publish latencies of value changes: the time from the
+// poll that produced them to the broker acknowledging every value
+type Latency struct {
+	mu      sync.Mutex
+	samples int64
+	total   time.Duration
+	max     time.Duration
+}
+
+// Observe records the latency of a value change of category
+func (l *Latency) Observe(category string, latency time.Duration) {
+	publishLatencyHistogram.WithLabelValues(category).Observe(latency.Seconds())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples++
+	l.total += latency
+	if latency > l.max {
+		l.max = latency
+	}
+}
+
+// Collect returns the mean latency in milliseconds in "publish_ms", with the
+// maximum and the sample count in "attributes", and starts a new period. It
+// returns nil if nothing was published since the last call.
+func (l *Latency) Collect() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == 0 {
+		return nil
+	}
+	values := map[string]interface{}{
+		"publish_ms": nbe.RoundedFloat(milliseconds(l.total) / float64(l.samples)),
+		"attributes": map[string]interface{}{
+			"max_ms":  nbe.RoundedFloat(milliseconds(l.max)),
+			"samples": l.samples,
+		},
+	}
+	l.samples, l.total, l.max = 0, 0, 0
+	return values
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
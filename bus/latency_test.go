@@ -0,0 +1,48 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestLatencyCollect(t *testing.T) {
+	latency := &Latency{}
+	if values := latency.Collect(); values != nil {
+		t.Fatalf("Expected nothing before any publish, got %v", values)
+	}
+
+	latency.Observe("operating_data", 10*time.Millisecond)
+	latency.Observe("operating_data", 30*time.Millisecond)
+	latency.Observe("boiler", 20*time.Millisecond)
+
+	values := latency.Collect()
+	if values["publish_ms"] != nbe.RoundedFloat(20) {
+		t.Errorf("Expected a mean of 20ms, got %v", values["publish_ms"])
+	}
+	attributes := values["attributes"].(map[string]interface{})
+	if attributes["max_ms"] != nbe.RoundedFloat(30) || attributes["samples"] != int64(3) {
+		t.Errorf("Unexpected attributes %v", attributes)
+	}
+
+	if values := latency.Collect(); values != nil {
+		t.Errorf("Expected a new period after collecting, got %v", values)
+	}
+}
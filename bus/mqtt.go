@@ -0,0 +1,207 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package bus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/tracing"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// mqttQueueSize is the number of events buffered for a slow broker
+	mqttQueueSize = 256
+	// latencyInterval is how often the publish latency is published
+	latencyInterval = time.Minute
+)
+
+// MQTTSink publishes changed values on <category>/<key> and write outcomes on
+// set_result/<category>/<param>. The latency from each poll to the broker
+// acknowledging its values is published every minute on bridge/latency.
+type MQTTSink struct {
+	client  *mqtt.Client
+	options MQTTSinkOptions
+	latency *Latency
+	done    chan struct{}
+
+	// latest holds every category's values for the aggregate topics; only
+	// Handle uses it
+	latest map[string]map[string]interface{}
+}
+
+// MQTTSinkOptions are the optional topics of an MQTT sink
+type MQTTSinkOptions struct {
+	// Aggregate also publishes all values of a category as one JSON object
+	// on json/<category> whenever one of them changes
+	Aggregate bool
+	// Gzip compresses the aggregate objects, published on
+	// json/<category>.gz instead
+	Gzip bool
+}
+
+// NewMQTTSink creates a sink publishing through mqttClient
+func NewMQTTSink(mqttClient *mqtt.Client) *MQTTSink {
+	return NewMQTTSinkWithOptions(mqttClient, MQTTSinkOptions{})
+}
+
+// NewMQTTSinkWithOptions creates a sink publishing through mqttClient, with
+// the optional topics in options
+func NewMQTTSinkWithOptions(mqttClient *mqtt.Client, options MQTTSinkOptions) *MQTTSink {
+	s := &MQTTSink{
+		client:  mqttClient,
+		options: options,
+		latency: &Latency{},
+		done:    make(chan struct{}),
+		latest:  make(map[string]map[string]interface{}),
+	}
+	go s.publishLatency()
+	return s
+}
+
+// PublishToMQTT subscribes an MQTT sink to the bus
+func PublishToMQTT(b *Bus, mqttClient *mqtt.Client) {
+	b.SubscribeQueued("mqtt", mqttQueueSize, NewMQTTSink(mqttClient).Handle, ValueChanged, WritePerformed)
+}
+
+// Handle publishes value changes and write outcomes
+func (s *MQTTSink) Handle(event Event) {
+	switch event.Kind {
+	case ValueChanged:
+		polled := event.Time
+		if err := s.client.PublishManyAcked(event.Category, event.Values, func() {
+			s.latency.Observe(event.Category, time.Since(polled))
+		}); err != nil {
+			log.Debugf("Failed to publish %s changes: %v", event.Category, err)
+		}
+		if s.options.Aggregate {
+			s.publishAggregate(event.Category, event.Values)
+		}
+	case WritePerformed:
+		parts := strings.SplitN(event.Key, ".", 2)
+		if len(parts) != 2 {
+			return
+		}
+		topic := fmt.Sprintf("set_result/%s", parts[0])
+		_, span := tracing.Start(event.Context, "mqtt publish")
+		span.SetAttributes(attribute.String("mqtt.topic", topic+"/"+parts[1]))
+		err := s.client.PublishMany(topic, map[string]interface{}{
+			parts[1]: setResult(event.Value, event.Values["stored"], event.Err),
+		})
+		if err != nil {
+			log.Debugf("Failed to publish set result for %s: %v", event.Key, err)
+		}
+		tracing.End(span, err)
+	}
+}
+
+// Close stops publishing the latency
+func (s *MQTTSink) Close() error {
+	close(s.done)
+	return nil
+}
+
+func (s *MQTTSink) publishLatency() {
+	ticker := time.NewTicker(latencyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if values := s.latency.Collect(); values != nil {
+			if err := s.client.PublishMany("bridge/latency", values); err != nil {
+				log.Debugf("Failed to publish the publish latency: %v", err)
+			}
+		}
+	}
+}
+
+// publishAggregate merges values into the category's latest values and
+// publishes them all as one object
+func (s *MQTTSink) publishAggregate(category string, values map[string]interface{}) {
+	latest, ok := s.latest[category]
+	if !ok {
+		latest = make(map[string]interface{}, len(values))
+		s.latest[category] = latest
+	}
+	for key, value := range values {
+		latest[key] = value
+	}
+	topic, payload, err := aggregatePayload(category, latest, s.options.Gzip)
+	if err != nil {
+		log.Debugf("Failed to encode the %s aggregate: %v", category, err)
+		return
+	}
+	if err := s.client.PublishRaw(s.client.Prefix+"/"+topic, payload); err != nil {
+		log.Debugf("Failed to publish the %s aggregate: %v", category, err)
+	}
+}
+
+// aggregatePayload returns the topic below the prefix and the payload of a
+// category's aggregate, gzipped with compress
+func aggregatePayload(category string, values map[string]interface{}, compress bool) (string, []byte, error) {
+	topic := "json/" + category
+	payload, err := json.Marshal(values)
+	if err != nil || !compress {
+		return topic, payload, err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(payload); err != nil {
+		return "", nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return "", nil, err
+	}
+	return topic + ".gz", compressed.Bytes(), nil
+}
+
+// setResult builds the payload published on the set_result topic for a write,
+// with the value read back from the controller when there is one and the
+// code of a write the controller rejected
+func setResult(value, stored interface{}, err error) map[string]interface{} {
+	if raw, ok := value.([]byte); ok {
+		value = string(raw)
+	}
+	result := map[string]interface{}{
+		"value":   fmt.Sprintf("%v", value),
+		"success": err == nil,
+	}
+	if stored != nil {
+		result["stored"] = fmt.Sprintf("%v", stored)
+	}
+	if err != nil {
+		result["error"] = err.Error()
+		var statusErr *nbe.StatusError
+		if errors.As(err, &statusErr) {
+			result["error_code"] = statusErr.Code()
+		}
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package bus
+
+import (
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepthGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "bus",
+			Name:      "queue_depth",
+			Help:      "Events waiting to be handled by a queued subscriber",
+		},
+		[]string{"subscriber"},
+	)
+	queueDroppedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "bus",
+			Name:      "dropped_total",
+			Help:      "Value changes dropped because a queued subscriber fell behind",
+		},
+		[]string{"subscriber"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueDepthGauge, queueDroppedCounter)
+}
+
+type queuedEvent struct {
+	event      Event
+	guaranteed bool
+}
+
+// queue is a bounded FIFO between the publisher and a slow subscriber. When
+// it is full, the oldest lossy event is dropped to make room; guaranteed
+// events are never dropped and block the publisher instead when nothing
+// lossy is left to drop.
+type queue struct {
+	name    string
+	size    int
+	mu      sync.Mutex
+	cond    *sync.Cond
+	events  []queuedEvent
+	dropped int64
+}
+
+func newQueue(name string, size int) *queue {
+	if size < 1 {
+		size = 1
+	}
+	q := &queue{name: name, size: size}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// guaranteed reports whether event must be delivered even when the queue is
+// full. Only plain value changes may be dropped.
+func guaranteed(event Event) bool {
+	return event.Kind != ValueChanged || event.Guaranteed
+}
+
+func (q *queue) push(event Event) {
+	item := queuedEvent{event: event, guaranteed: guaranteed(event)}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.events) >= q.size {
+		if q.dropOldestLossy() {
+			break
+		}
+		if !item.guaranteed {
+			// Everything queued must be delivered, so this value goes instead
+			q.drop()
+			return
+		}
+		q.cond.Wait()
+	}
+
+	q.events = append(q.events, item)
+	queueDepthGauge.WithLabelValues(q.name).Set(float64(len(q.events)))
+	q.cond.Broadcast()
+}
+
+// dropOldestLossy removes the oldest event that may be dropped. The caller
+// must hold q.mu.
+func (q *queue) dropOldestLossy() bool {
+	for i, item := range q.events {
+		if !item.guaranteed {
+			q.events = append(q.events[:i], q.events[i+1:]...)
+			q.drop()
+			return true
+		}
+	}
+	return false
+}
+
+func (q *queue) drop() {
+	q.dropped++
+	queueDroppedCounter.WithLabelValues(q.name).Inc()
+}
+
+func (q *queue) pop() Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.events) == 0 {
+		q.cond.Wait()
+	}
+	item := q.events[0]
+	q.events = q.events[1:]
+	queueDepthGauge.WithLabelValues(q.name).Set(float64(len(q.events)))
+	q.cond.Broadcast()
+	return item.event
+}
+
+// Len returns the number of events waiting in the queue
+func (q *queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// Dropped returns the number of events dropped so far
+func (q *queue) Dropped() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// SubscribeQueued registers handler behind a bounded queue of size events,
+// so a slow handler never holds up the publisher for value changes. The
+// handler runs on its own goroutine; queue depth is reported to diagnostics
+// and Prometheus under name.
+func (b *Bus) SubscribeQueued(name string, size int, handler Handler, kinds ...Kind) {
+	q := newQueue(name, size)
+	stats := diagnostics.Track("bus_" + name)
+	stats.SetQueueDepth(q.Len)
+
+	stats.Go(func() {
+		for {
+			handler(q.pop())
+		}
+	})
+	b.Subscribe(q.push, kinds...)
+}
@@ -0,0 +1,107 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueDropsOldestValueChange(t *testing.T) {
+	q := newQueue("test_drop", 2)
+	q.push(Event{Kind: ValueChanged, Key: "first"})
+	q.push(Event{Kind: ValueChanged, Key: "second"})
+	q.push(Event{Kind: ValueChanged, Key: "third"})
+
+	if q.Len() != 2 || q.Dropped() != 1 {
+		t.Fatalf("Expected 2 queued and 1 dropped, got %d and %d", q.Len(), q.Dropped())
+	}
+	if key := q.pop().Key; key != "second" {
+		t.Errorf("Expected oldest value to be dropped, got %s first", key)
+	}
+}
+
+func TestQueueKeepsGuaranteedEvents(t *testing.T) {
+	q := newQueue("test_guaranteed", 2)
+	q.push(Event{Kind: Alarm, Key: "alarm"})
+	q.push(Event{Kind: ValueChanged, Key: "value"})
+	q.push(Event{Kind: ValueChanged, Key: "setting", Guaranteed: true})
+
+	if key := q.pop().Key; key != "alarm" {
+		t.Errorf("Expected alarm to survive, got %s", key)
+	}
+	if key := q.pop().Key; key != "setting" {
+		t.Errorf("Expected guaranteed setting to replace the value change, got %s", key)
+	}
+
+	// A full queue of guaranteed events drops incoming value changes
+	q.push(Event{Kind: Alarm})
+	q.push(Event{Kind: WritePerformed})
+	q.push(Event{Kind: ValueChanged, Key: "late"})
+	if q.Len() != 2 || q.Dropped() != 2 {
+		t.Errorf("Expected the late value change to be dropped, got %d queued, %d dropped", q.Len(), q.Dropped())
+	}
+}
+
+func TestQueueBlocksGuaranteedUntilSpace(t *testing.T) {
+	q := newQueue("test_block", 1)
+	q.push(Event{Kind: Alarm, Key: "first"})
+
+	pushed := make(chan bool)
+	go func() {
+		q.push(Event{Kind: Alarm, Key: "second"})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("Expected push to block while the queue is full of guaranteed events")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.pop()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected push to complete once space was freed")
+	}
+	if key := q.pop().Key; key != "second" {
+		t.Errorf("Expected second alarm, got %s", key)
+	}
+}
+
+func TestSubscribeQueuedDeliversInOrder(t *testing.T) {
+	b := New()
+	received := make(chan string, 3)
+	b.SubscribeQueued("test_order", 8, func(event Event) { received <- event.Key }, Alarm)
+
+	b.Publish(Event{Kind: Alarm, Key: "a"})
+	b.Publish(Event{Kind: ValueChanged, Key: "ignored"})
+	b.Publish(Event{Kind: Alarm, Key: "b"})
+
+	for _, expected := range []string{"a", "b"} {
+		select {
+		case key := <-received:
+			if key != expected {
+				t.Errorf("Expected %s, got %s", expected, key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", expected)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package calibration guides the controller through an oxygen sensor
+// calibration and reports its progress and outcome.
+package calibration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Key is the setting that starts a calibration; the controller clears it
+	// once the calibration has finished
+	Key = "oxygen.start_calibrate"
+	// topic is where the workflow is published, below the MQTT prefix
+	topic = "calibration/oxygen"
+)
+
+// States of a calibration
+const (
+	Idle        = "idle"
+	Calibrating = "calibrating"
+	Succeeded   = "succeeded"
+	Failed      = "failed"
+)
+
+// ErrRunning is returned when a calibration is started while one is running
+var ErrRunning = errors.New("calibration already running")
+
+// Calibration starts the controller's oxygen sensor calibration on
+// calibration/oxygen/start, follows it until the controller clears
+// oxygen.start_calibrate and publishes the progress below calibration/oxygen
+type Calibration struct {
+	// PollInterval is how often the calibration status is read
+	PollInterval time.Duration
+	// Timeout fails a calibration the controller has not finished in time
+	Timeout time.Duration
+
+	mqttClient  *mqtt.Client
+	start       func() error
+	calibrating func() (bool, error)
+	oxygen      func() (float64, error)
+	now         func() time.Time
+
+	mu             sync.Mutex
+	state          string
+	started        time.Time
+	finished       time.Time
+	lastCalibrated time.Time
+	reading        float64
+	haveReading    bool
+	err            error
+}
+
+// New creates the calibration workflow for boiler, publishing on mqttClient
+func New(boiler *nbe.NBE, mqttClient *mqtt.Client) *Calibration {
+	return &Calibration{
+		PollInterval: 5 * time.Second,
+		Timeout:      10 * time.Minute,
+		mqttClient:   mqttClient,
+		start: func() error {
+			response, err := boiler.SetContext(nbe.WithSource(context.Background(), "calibration"), Key, []byte("1"))
+			if err == nil && response.Status != 0 {
+				err = fmt.Errorf("controller returned status %d", response.Status)
+			}
+			return err
+		},
+		calibrating: func() (bool, error) {
+			response, err := boiler.Get(nbe.GetSetupFunction, Key)
+			if err != nil {
+				return false, err
+			}
+			value, ok := nbe.ParseFloat(response.Payload["start_calibrate"])
+			if !ok {
+				return false, fmt.Errorf("unexpected response for %s: %v", Key, response.Payload)
+			}
+			return value != 0, nil
+		},
+		oxygen: func() (float64, error) {
+			response, err := boiler.Get(nbe.GetOperatingDataFunction, "oxygen")
+			if err != nil {
+				return 0, err
+			}
+			nbe.ScaleFields(nbe.OperatingFields, response.Payload)
+			value, ok := nbe.ParseFloat(response.Payload["oxygen"])
+			if !ok {
+				return 0, fmt.Errorf("unexpected oxygen reading: %v", response.Payload)
+			}
+			return value, nil
+		},
+		now:   time.Now,
+		state: Idle,
+	}
+}
+
+// Run subscribes to the start command and publishes the idle state. The
+// retained last calibration time is read back, so it survives a restart.
+func (c *Calibration) Run() error {
+	if err := c.mqttClient.Subscribe(topic+"/last_calibrated", 1, func(client *mqtt.Client, msg mqtt.Message) {
+		last, err := time.Parse(time.RFC3339, string(msg.Payload()))
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		if c.lastCalibrated.IsZero() {
+			c.lastCalibrated = last
+		}
+		c.mu.Unlock()
+	}); err != nil {
+		return err
+	}
+	if err := c.mqttClient.Subscribe(topic+"/start", 1, func(client *mqtt.Client, msg mqtt.Message) {
+		if err := c.Start(); err != nil {
+			log.Errorf("Failed to start the oxygen sensor calibration: %v", err)
+		}
+	}); err != nil {
+		return err
+	}
+	c.publish()
+	return nil
+}
+
+// Start triggers a calibration and follows it in the background
+func (c *Calibration) Start() error {
+	c.mu.Lock()
+	if c.state == Calibrating {
+		c.mu.Unlock()
+		return ErrRunning
+	}
+	c.state = Calibrating
+	c.started = c.now()
+	c.finished = time.Time{}
+	c.haveReading = false
+	c.err = nil
+	c.mu.Unlock()
+
+	if err := c.start(); err != nil {
+		c.finish(fmt.Errorf("starting: %w", err))
+		return err
+	}
+	log.Infof("Started oxygen sensor calibration")
+	c.publish()
+
+	go c.follow()
+	return nil
+}
+
+// follow polls the calibration status until the controller clears it or the
+// timeout passes. A failed read is retried until the timeout.
+func (c *Calibration) follow() {
+	for {
+		time.Sleep(c.PollInterval)
+
+		calibrating, err := c.calibrating()
+		switch {
+		case err == nil && !calibrating:
+			c.finish(nil)
+			return
+		case c.elapsed() >= c.Timeout:
+			c.finish(fmt.Errorf("not finished after %s", c.Timeout))
+			return
+		case err != nil:
+			log.Debugf("Failed to read the calibration status: %v", err)
+		}
+		c.publish()
+	}
+}
+
+// finish records the outcome of the running calibration, reading the oxygen
+// level the sensor was calibrated to on success
+func (c *Calibration) finish(err error) {
+	var reading float64
+	var readErr error
+	if err == nil {
+		reading, readErr = c.oxygen()
+	}
+
+	c.mu.Lock()
+	c.finished = c.now()
+	c.err = err
+	if err != nil {
+		c.state = Failed
+		log.Warnf("Oxygen sensor calibration failed: %v", err)
+	} else {
+		c.state = Succeeded
+		c.lastCalibrated = c.finished
+		c.reading, c.haveReading = reading, readErr == nil
+		log.Infof("Oxygen sensor calibration finished after %s", c.finished.Sub(c.started).Round(time.Second))
+	}
+	c.mu.Unlock()
+	c.publish()
+}
+
+// elapsed returns how long the current or last calibration ran
+func (c *Calibration) elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsedLocked()
+}
+
+func (c *Calibration) elapsedLocked() time.Duration {
+	if c.started.IsZero() {
+		return 0
+	}
+	if !c.finished.IsZero() {
+		return c.finished.Sub(c.started)
+	}
+	return c.now().Sub(c.started)
+}
+
+// Values returns the published state: "state", the elapsed seconds in
+// "elapsed", "last_calibrated" once known, and the timing, the oxygen
+// reading and any error in "attributes"
+func (c *Calibration) Values() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elapsed := int64(c.elapsedLocked() / time.Second)
+	attributes := map[string]interface{}{
+		"elapsed_s": elapsed,
+		"timeout_s": int64(c.Timeout / time.Second),
+	}
+	if !c.started.IsZero() {
+		attributes["started"] = c.started.Format(time.RFC3339)
+	}
+	if c.haveReading {
+		attributes["oxygen"] = nbe.RoundedFloat(c.reading)
+	}
+	if c.err != nil {
+		attributes["error"] = c.err.Error()
+	}
+
+	values := map[string]interface{}{
+		"state":      c.state,
+		"elapsed":    elapsed,
+		"attributes": attributes,
+	}
+	if !c.lastCalibrated.IsZero() {
+		values["last_calibrated"] = c.lastCalibrated.Format(time.RFC3339)
+	}
+	return values
+}
+
+func (c *Calibration) publish() {
+	if c.mqttClient == nil {
+		return
+	}
+	if err := c.mqttClient.PublishMany(topic, c.Values()); err != nil {
+		log.Debugf("Failed to publish the calibration state: %v", err)
+	}
+}
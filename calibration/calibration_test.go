@@ -0,0 +1,138 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package calibration
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeController clears the calibration flag after a number of status reads
+type fakeController struct {
+	mu       sync.Mutex
+	starts   int
+	pending  int
+	startErr error
+}
+
+func (f *fakeController) start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.starts++
+	return f.startErr
+}
+
+func (f *fakeController) calibrating() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending > 0 {
+		f.pending--
+		return true, nil
+	}
+	return false, nil
+}
+
+func newTestCalibration(f *fakeController, timeout time.Duration) *Calibration {
+	return &Calibration{
+		PollInterval: time.Millisecond,
+		Timeout:      timeout,
+		start:        f.start,
+		calibrating:  f.calibrating,
+		oxygen:       func() (float64, error) { return 20.9, nil },
+		now:          time.Now,
+		state:        Idle,
+	}
+}
+
+// waitFor waits until the calibration leaves the calibrating state
+func waitFor(t *testing.T, c *Calibration) map[string]interface{} {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if values := c.Values(); values["state"] != Calibrating {
+			return values
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Calibration never finished")
+	return nil
+}
+
+func TestCalibrationSucceeds(t *testing.T) {
+	controller := &fakeController{pending: 3}
+	c := newTestCalibration(controller, time.Minute)
+
+	if values := c.Values(); values["state"] != Idle || values["last_calibrated"] != nil {
+		t.Fatalf("Expected an idle calibration, got %v", values)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	values := waitFor(t, c)
+	if values["state"] != Succeeded {
+		t.Fatalf("Expected a successful calibration, got %v", values)
+	}
+	if _, err := time.Parse(time.RFC3339, values["last_calibrated"].(string)); err != nil {
+		t.Errorf("Expected a last calibrated timestamp, got %v", values["last_calibrated"])
+	}
+	attributes := values["attributes"].(map[string]interface{})
+	if attributes["oxygen"] == nil || attributes["error"] != nil {
+		t.Errorf("Unexpected attributes %v", attributes)
+	}
+	if controller.starts != 1 {
+		t.Errorf("Expected one start, got %d", controller.starts)
+	}
+}
+
+func TestCalibrationTimesOut(t *testing.T) {
+	controller := &fakeController{pending: 1 << 30}
+	c := newTestCalibration(controller, 20*time.Millisecond)
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := c.Start(); !errors.Is(err, ErrRunning) {
+		t.Errorf("Start() while running error = %v, want %v", err, ErrRunning)
+	}
+
+	values := waitFor(t, c)
+	if values["state"] != Failed {
+		t.Fatalf("Expected a failed calibration, got %v", values)
+	}
+	if values["last_calibrated"] != nil {
+		t.Errorf("Expected no last calibrated time after a failure, got %v", values["last_calibrated"])
+	}
+	if attributes := values["attributes"].(map[string]interface{}); attributes["error"] == nil {
+		t.Errorf("Expected the timeout in the attributes, got %v", attributes)
+	}
+}
+
+func TestCalibrationStartFails(t *testing.T) {
+	controller := &fakeController{startErr: errors.New("read-only")}
+	c := newTestCalibration(controller, time.Minute)
+
+	if err := c.Start(); err == nil {
+		t.Fatal("Expected Start() to fail")
+	}
+	if values := c.Values(); values["state"] != Failed {
+		t.Errorf("Expected a failed calibration, got %v", values)
+	}
+}
@@ -0,0 +1,309 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of debug capture that can be toggled at runtime
+const (
+	// Trace logs every controller packet at info level
+	Trace = "trace"
+	// Pcap records controller traffic to a pcap file
+	Pcap = "pcap"
+	// Verbose raises the log level to debug
+	Verbose = "verbose"
+)
+
+// Kinds lists every debug capture kind
+var Kinds = []string{Trace, Pcap, Verbose}
+
+// Capture toggles debug captures for a bounded duration, switching each one
+// off again once it expires
+type Capture struct {
+	Dir             string
+	DefaultDuration time.Duration
+	MaxDuration     time.Duration
+
+	mqttClient *mqtt.Client
+	setTracer  func(nbe.Tracer)
+	now        func() time.Time
+
+	mu       sync.Mutex
+	timers   map[string]*time.Timer
+	until    map[string]time.Time
+	pcap     *PcapWriter
+	pcapFile string
+	level    log.Level
+}
+
+// New creates a capture controller for the boiler, writing pcap files to dir
+// and publishing its state below bridge/debug
+func New(boiler *nbe.NBE, mqttClient *mqtt.Client, dir string, defaultDuration, maxDuration time.Duration) *Capture {
+	return &Capture{
+		Dir:             dir,
+		DefaultDuration: defaultDuration,
+		MaxDuration:     maxDuration,
+		mqttClient:      mqttClient,
+		setTracer:       boiler.SetTracer,
+		now:             time.Now,
+		timers:          make(map[string]*time.Timer),
+		until:           make(map[string]time.Time),
+	}
+}
+
+// Run subscribes to bridge/debug/<kind>/set, which accepts ON, OFF or a
+// duration such as "15m"
+func (c *Capture) Run() error {
+	if err := c.mqttClient.Subscribe("bridge/debug/+/set", 1, func(client *mqtt.Client, msg mqtt.Message) {
+		c.handleCommand(msg.Topic(), msg.Payload())
+	}); err != nil {
+		return err
+	}
+	c.publish()
+	return nil
+}
+
+func (c *Capture) handleCommand(topic string, payload []byte) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 {
+		return
+	}
+	kind := parts[len(parts)-2]
+
+	enable, duration, err := parseCommand(string(payload))
+	if err == nil {
+		if enable {
+			err = c.Enable(kind, duration)
+		} else {
+			err = c.Disable(kind)
+		}
+	}
+	if err != nil {
+		log.Errorf("Debug %s command %q failed: %v", kind, payload, err)
+	}
+	c.publish()
+}
+
+// parseCommand reads ON, OFF or a duration. ON returns a zero duration, meaning
+// the default.
+func parseCommand(payload string) (bool, time.Duration, error) {
+	switch strings.ToUpper(strings.TrimSpace(payload)) {
+	case "ON", "1", "TRUE":
+		return true, 0, nil
+	case "OFF", "0", "FALSE":
+		return false, 0, nil
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(payload))
+	if err != nil {
+		return false, 0, fmt.Errorf("expected ON, OFF or a duration")
+	}
+	if duration <= 0 {
+		return false, 0, fmt.Errorf("duration must be positive")
+	}
+	return true, duration, nil
+}
+
+// Enable starts a capture for duration (the default if zero), capped at the
+// maximum. Enabling an active capture extends it.
+func (c *Capture) Enable(kind string, duration time.Duration) error {
+	if !validKind(kind) {
+		return fmt.Errorf("unknown capture %q", kind)
+	}
+	if duration <= 0 {
+		duration = c.DefaultDuration
+	}
+	if c.MaxDuration > 0 && duration > c.MaxDuration {
+		duration = c.MaxDuration
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if timer, ok := c.timers[kind]; ok {
+		timer.Stop()
+	} else if err := c.start(kind); err != nil {
+		return err
+	}
+
+	until := c.now().Add(duration)
+	c.until[kind] = until
+	c.timers[kind] = time.AfterFunc(duration, func() {
+		c.expire(kind, until)
+	})
+	c.updateTracer()
+	log.Infof("Debug %s enabled for %s", kind, duration)
+	return nil
+}
+
+// Disable stops a capture; stopping an inactive capture is a no-op
+func (c *Capture) Disable(kind string) error {
+	if !validKind(kind) {
+		return fmt.Errorf("unknown capture %q", kind)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stop(kind)
+}
+
+// expire stops a capture when its timer fires, unless it has been extended
+// in the meantime
+func (c *Capture) expire(kind string, until time.Time) {
+	c.mu.Lock()
+	var err error
+	if c.until[kind].Equal(until) {
+		err = c.stop(kind)
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("Debug %s failed to stop: %v", kind, err)
+	}
+	c.publish()
+}
+
+// stop ends a running capture; the caller holds c.mu
+func (c *Capture) stop(kind string) error {
+	timer, ok := c.timers[kind]
+	if !ok {
+		return nil
+	}
+	timer.Stop()
+	delete(c.timers, kind)
+	delete(c.until, kind)
+	c.updateTracer()
+
+	switch kind {
+	case Pcap:
+		err := c.pcap.Close()
+		c.pcap = nil
+		log.Infof("Debug pcap written to %s", c.pcapFile)
+		if err != nil {
+			return err
+		}
+	case Verbose:
+		log.SetLevel(c.level)
+	}
+	log.Infof("Debug %s disabled", kind)
+	return nil
+}
+
+// Active reports whether a capture is running
+func (c *Capture) Active(kind string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.timers[kind]
+	return ok
+}
+
+func (c *Capture) start(kind string) error {
+	switch kind {
+	case Pcap:
+		name := filepath.Join(c.Dir, fmt.Sprintf("boiler-mate-%s.pcap", c.now().Format("20060102-150405")))
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		writer, err := NewPcapWriter(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		c.pcap = writer
+		c.pcapFile = name
+	case Verbose:
+		c.level = log.GetLevel()
+		log.SetLevel(log.DebugLevel)
+	}
+	return nil
+}
+
+// updateTracer installs the packet tracer while a trace or pcap capture is
+// running; the caller holds c.mu
+func (c *Capture) updateTracer() {
+	_, trace := c.timers[Trace]
+	_, pcap := c.timers[Pcap]
+	if !trace && !pcap {
+		c.setTracer(nil)
+		return
+	}
+	c.setTracer(c.tracePacket)
+}
+
+func (c *Capture) tracePacket(outgoing bool, local, remote net.Addr, packet []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	src, dst, direction := remote, local, "recv"
+	if outgoing {
+		src, dst, direction = local, remote, "send"
+	}
+	if _, ok := c.timers[Trace]; ok {
+		log.Infof("trace %s %s %q", direction, remote, packet)
+	}
+	if c.pcap != nil {
+		if err := c.pcap.WritePacket(c.now(), src, dst, packet); err != nil {
+			log.Errorf("Failed to write pcap: %v", err)
+		}
+	}
+}
+
+func (c *Capture) publish() {
+	if c.mqttClient == nil {
+		return
+	}
+
+	c.mu.Lock()
+	values := map[string]interface{}{
+		"pcap_file": c.pcapFile,
+	}
+	for _, kind := range Kinds {
+		state, until := "OFF", ""
+		if _, ok := c.timers[kind]; ok {
+			state, until = "ON", c.until[kind].Format(time.RFC3339)
+		}
+		values[kind] = state
+		values[kind+"_until"] = until
+	}
+	c.mu.Unlock()
+
+	if err := c.mqttClient.PublishMany("bridge/debug", values); err != nil {
+		log.Errorf("Failed to publish debug state: %v", err)
+	}
+}
+
+func validKind(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
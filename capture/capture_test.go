@@ -0,0 +1,184 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+type fakeTracer struct {
+	mu     sync.Mutex
+	tracer nbe.Tracer
+}
+
+func (f *fakeTracer) set(tracer nbe.Tracer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tracer = tracer
+}
+
+func (f *fakeTracer) get() nbe.Tracer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tracer
+}
+
+func newTestCapture(t *testing.T, tracer *fakeTracer) *Capture {
+	return &Capture{
+		Dir:             t.TempDir(),
+		DefaultDuration: time.Minute,
+		MaxDuration:     time.Hour,
+		setTracer:       tracer.set,
+		now:             time.Now,
+		timers:          make(map[string]*time.Timer),
+		until:           make(map[string]time.Time),
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		payload  string
+		enable   bool
+		duration time.Duration
+		wantErr  bool
+	}{
+		{"ON", true, 0, false},
+		{"on", true, 0, false},
+		{"OFF", false, 0, false},
+		{"15m", true, 15 * time.Minute, false},
+		{"-5m", false, 0, true},
+		{"sometimes", false, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			enable, duration, err := parseCommand(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommand(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			}
+			if enable != tt.enable || duration != tt.duration {
+				t.Errorf("parseCommand(%q) = %v, %v, want %v, %v", tt.payload, enable, duration, tt.enable, tt.duration)
+			}
+		})
+	}
+}
+
+func TestVerboseRestoresLevel(t *testing.T) {
+	previous := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(previous)
+
+	c := newTestCapture(t, &fakeTracer{})
+	if err := c.Enable(Verbose, 50*time.Millisecond); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("level = %v while verbose, want debug", log.GetLevel())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Active(Verbose) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Active(Verbose) {
+		t.Fatal("verbose capture did not expire")
+	}
+	if log.GetLevel() != log.WarnLevel {
+		t.Errorf("level = %v after expiry, want warning", log.GetLevel())
+	}
+}
+
+func TestEnableCapsDuration(t *testing.T) {
+	c := newTestCapture(t, &fakeTracer{})
+	c.MaxDuration = time.Minute
+	if err := c.Enable(Trace, 24*time.Hour); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	defer c.Disable(Trace)
+
+	if remaining := time.Until(c.until[Trace]); remaining > time.Minute {
+		t.Errorf("capture runs for %s, want at most 1m", remaining)
+	}
+	if err := c.Enable("everything", 0); err == nil {
+		t.Error("Enable() accepted an unknown capture")
+	}
+}
+
+func TestPcapCapture(t *testing.T) {
+	tracer := &fakeTracer{}
+	c := newTestCapture(t, tracer)
+	if err := c.Enable(Pcap, 0); err != nil {
+		t.Fatalf("Enable() error = %v", err)
+	}
+	trace := tracer.get()
+	if trace == nil {
+		t.Fatal("pcap capture did not install a tracer")
+	}
+
+	local := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 50000}
+	remote := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 100), Port: 8483}
+	trace(true, local, remote, []byte("request"))
+	trace(false, local, remote, []byte("response"))
+
+	if err := c.Disable(Pcap); err != nil {
+		t.Fatalf("Disable() error = %v", err)
+	}
+	if tracer.get() != nil {
+		t.Error("tracer still installed after Disable()")
+	}
+
+	data, err := os.ReadFile(c.pcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.LittleEndian.Uint32(data); magic != 0xa1b2c3d4 {
+		t.Fatalf("magic = %x", magic)
+	}
+	if link := binary.LittleEndian.Uint32(data[20:]); link != linkTypeIPv4 {
+		t.Errorf("link type = %d, want %d", link, linkTypeIPv4)
+	}
+
+	// first record: sent from the local port to the controller
+	record := data[24:]
+	length := binary.LittleEndian.Uint32(record[8:])
+	packet := record[16 : 16+length]
+	if checksum(packet[:20]) != 0 {
+		t.Error("invalid IPv4 header checksum")
+	}
+	if src, dst := binary.BigEndian.Uint16(packet[20:]), binary.BigEndian.Uint16(packet[22:]); src != 50000 || dst != 8483 {
+		t.Errorf("ports = %d -> %d, want 50000 -> 8483", src, dst)
+	}
+	if !bytes.Equal(packet[28:], []byte("request")) {
+		t.Errorf("payload = %q", packet[28:])
+	}
+
+	// second record: received from the controller
+	packet = record[16+length+16:]
+	if !bytes.Equal(packet[12:16], remote.IP.To4()) || !bytes.Equal(packet[28:], []byte("response")) {
+		t.Errorf("response record = % x", packet)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Frame is a controller frame recorded by a FrameLog
+type Frame struct {
+	Time     time.Time
+	Outgoing bool
+	Data     []byte
+}
+
+// FrameLog writes every decrypted controller frame to a file per day in Dir,
+// one line per frame with its time, direction and quoted bytes, for replay
+// with "boiler-mate replay"
+type FrameLog struct {
+	Dir string
+
+	now func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	day  string
+}
+
+// NewFrameLog creates a frame log writing to dir, which is created if needed
+func NewFrameLog(dir string) (*FrameLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FrameLog{Dir: dir, now: time.Now}, nil
+}
+
+// Record appends a frame; it is installed with nbe.SetFrameRecorder
+func (f *FrameLog) Record(outgoing bool, data []byte) {
+	if data == nil {
+		return
+	}
+	frame := Frame{Time: f.now(), Outgoing: outgoing, Data: data}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.rotate(frame.Time); err != nil {
+		log.Errorf("Failed to open frame capture: %v", err)
+		return
+	}
+	if _, err := io.WriteString(f.file, FormatFrame(frame)+"\n"); err != nil {
+		log.Errorf("Failed to write frame capture: %v", err)
+	}
+}
+
+// rotate opens a new timestamped file on the first frame of each day; the
+// caller holds f.mu
+func (f *FrameLog) rotate(t time.Time) error {
+	day := t.Format("20060102")
+	if f.file != nil && f.day == day {
+		return nil
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	name := filepath.Join(f.Dir, fmt.Sprintf("boiler-mate-%s.nbe", t.Format("20060102-150405")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	log.Infof("Recording controller frames to %s", name)
+	f.file, f.day = file, day
+	return nil
+}
+
+// Close closes the current file
+func (f *FrameLog) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// FormatFrame returns the line a frame is recorded as
+func FormatFrame(frame Frame) string {
+	direction := "recv"
+	if frame.Outgoing {
+		direction = "send"
+	}
+	return fmt.Sprintf("%s %s %s", frame.Time.UTC().Format(time.RFC3339Nano), direction, strconv.Quote(string(frame.Data)))
+}
+
+// ReadFrames parses the lines written by a FrameLog, skipping blank lines
+func ReadFrames(r io.Reader) ([]Frame, error) {
+	var frames []Frame
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		frame, err := parseFrame(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, scanner.Err()
+}
+
+func parseFrame(line string) (Frame, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return Frame{}, fmt.Errorf("expected a time, a direction and a frame")
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return Frame{}, fmt.Errorf("invalid time %q", fields[0])
+	}
+	var outgoing bool
+	switch fields[1] {
+	case "send":
+		outgoing = true
+	case "recv":
+	default:
+		return Frame{}, fmt.Errorf("invalid direction %q", fields[1])
+	}
+	data, err := strconv.Unquote(fields[2])
+	if err != nil {
+		return Frame{}, fmt.Errorf("invalid frame: %w", err)
+	}
+	return Frame{Time: t, Outgoing: outgoing, Data: []byte(data)}, nil
+}
+
+// Decoded is a recorded frame run through the protocol parser
+type Decoded struct {
+	Time      time.Time              `json:"time"`
+	Direction string                 `json:"direction"`
+	Function  string                 `json:"function,omitempty"`
+	SeqNo     int8                   `json:"seq"`
+	Status    uint8                  `json:"status"`
+	Encrypted bool                   `json:"encrypted,omitempty"`
+	Request   string                 `json:"request,omitempty"`
+	Payload   map[string]interface{} `json:"payload,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Raw       string                 `json:"raw,omitempty"`
+}
+
+// Decode parses a recorded frame as the client does: requests as sent, and
+// responses including their continuation frames. A frame the parser rejects
+// keeps its raw bytes and the error.
+func Decode(frame Frame) Decoded {
+	decoded := Decoded{Time: frame.Time, Direction: "recv"}
+	var err error
+	if frame.Outgoing {
+		decoded.Direction = "send"
+		var request nbe.NBERequest
+		if err = request.Unpack(bytes.NewReader(frame.Data)); err == nil {
+			decoded.Function = request.Function.String()
+			decoded.SeqNo = request.SeqNo
+			decoded.Encrypted = frame.Data[nbe.AppIDSize+nbe.ControllerIDSize] == '*'
+			decoded.Request = string(request.Payload)
+		}
+	} else {
+		var response nbe.NBEResponse
+		if err = response.Unpack(bytes.NewReader(frame.Data)); err == nil {
+			decoded.Function = response.Function.String()
+			decoded.SeqNo = response.SeqNo
+			decoded.Status = response.Status
+			decoded.Payload = response.Payload
+		}
+	}
+	if err != nil {
+		decoded.Error = err.Error()
+		decoded.Raw = string(frame.Data)
+	}
+	return decoded
+}
@@ -0,0 +1,82 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameLogRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	frames, err := NewFrameLog(dir)
+	if err != nil {
+		t.Fatalf("NewFrameLog() error = %v", err)
+	}
+	now := time.Date(2024, 1, 10, 23, 59, 0, 0, time.UTC)
+	frames.now = func() time.Time { return now }
+
+	request := []byte("APPID0000000CTRL00 \x020101**********1704931140extr011boiler.temp\x04")
+	response := []byte("APPID0000000CTRL00\x020101000temp=65;diff_under=5\x04")
+	frames.Record(true, request)
+	frames.Record(false, response)
+	now = now.Add(2 * time.Minute)
+	frames.Record(false, response)
+	if err := frames.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "boiler-mate-*.nbe"))
+	if len(files) != 2 {
+		t.Fatalf("Expected a file per day, got %v", files)
+	}
+	if filepath.Base(files[0]) != "boiler-mate-20240110-235900.nbe" {
+		t.Errorf("Unexpected file name %s", files[0])
+	}
+
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	read, err := ReadFrames(file)
+	if err != nil {
+		t.Fatalf("ReadFrames() error = %v", err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("Expected 2 frames, got %d", len(read))
+	}
+	if !read[0].Outgoing || string(read[0].Data) != string(request) {
+		t.Errorf("Unexpected request %+v", read[0])
+	}
+	if read[1].Outgoing || string(read[1].Data) != string(response) || !read[1].Time.Equal(time.Date(2024, 1, 10, 23, 59, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected response %+v", read[1])
+	}
+}
+
+func TestReadFramesRejectsGarbage(t *testing.T) {
+	if _, err := ReadFrames(strings.NewReader("2024-01-10T12:00:00Z sideways \"x\"\n")); err == nil {
+		t.Error("Expected an error for an unknown direction")
+	}
+	if _, err := ReadFrames(strings.NewReader("not a capture\n")); err == nil {
+		t.Error("Expected an error for a line without a frame")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// linkTypeIPv4 marks pcap records that start directly with an IPv4 header
+const linkTypeIPv4 = 228
+
+// PcapWriter writes UDP datagrams to a pcap file, synthesizing the IPv4 and
+// UDP headers that the socket API strips
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewPcapWriter writes the pcap file header to w
+func NewPcapWriter(w io.WriteCloser) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeIPv4)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket records a datagram sent from src to dst
+func (p *PcapWriter) WritePacket(t time.Time, src, dst net.Addr, payload []byte) error {
+	srcIP, srcPort := udpEndpoint(src)
+	dstIP, dstPort := udpEndpoint(dst)
+
+	packet := make([]byte, 28+len(payload))
+	packet[0] = 0x45 // IPv4, 20 byte header
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+	packet[8] = 64
+	packet[9] = 17 // UDP
+	copy(packet[12:16], srcIP)
+	copy(packet[16:20], dstIP)
+	binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20]))
+
+	binary.BigEndian.PutUint16(packet[20:], uint16(srcPort))
+	binary.BigEndian.PutUint16(packet[22:], uint16(dstPort))
+	binary.BigEndian.PutUint16(packet[24:], uint16(8+len(payload)))
+	copy(packet[28:], payload)
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(record); err != nil {
+		return err
+	}
+	_, err := p.w.Write(packet)
+	return err
+}
+
+// Close closes the underlying file
+func (p *PcapWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.w.Close()
+}
+
+func udpEndpoint(addr net.Addr) (net.IP, int) {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return net.IPv4zero.To4(), 0
+	}
+	ip := udp.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	return ip, udp.Port
+}
+
+// checksum is the internet checksum of an IPv4 header
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,178 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package clock keeps the controller's clock in step with the host, as its
+// built-in schedule and the consumption by hour depend on it.
+package clock
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Registers name the setup keys holding the controller's clock and the Go
+// time layouts of their values
+type Registers struct {
+	DateKey    string
+	DateFormat string
+	TimeKey    string
+	TimeFormat string
+}
+
+// DefaultRegisters are the clock registers of current NBE firmware
+var DefaultRegisters = Registers{
+	DateKey:    "misc.date",
+	DateFormat: "02-01-06",
+	TimeKey:    "misc.time",
+	TimeFormat: "15:04",
+}
+
+// Result describes one synchronization
+type Result struct {
+	// Time is the host time written to the controller
+	Time time.Time
+	// Drift is how far the controller was ahead of the host, zero when its
+	// clock could not be read
+	Drift time.Duration
+	// Written is false when the drift was too small to correct
+	Written bool
+}
+
+// Syncer writes the host time to the controller
+type Syncer struct {
+	Registers Registers
+	// MaxDrift is the drift tolerated before the clock is written; the
+	// controller keeps whole minutes, so drift below a minute is not seen
+	MaxDrift time.Duration
+
+	read  func(key string) (string, error)
+	write func(key, value string) error
+	now   func() time.Time
+}
+
+// New creates a syncer for the boiler's clock
+func New(boiler *nbe.NBE, registers Registers, maxDrift time.Duration) *Syncer {
+	return &Syncer{
+		Registers: registers,
+		MaxDrift:  maxDrift,
+		read: func(key string) (string, error) {
+			response, err := boiler.GetWithPriority(nbe.PriorityRead, nbe.GetSetupFunction, key)
+			if err != nil {
+				return "", err
+			}
+			_, name, _ := strings.Cut(key, ".")
+			value, ok := response.Payload[name]
+			if !ok {
+				return "", fmt.Errorf("controller did not return %s", key)
+			}
+			return fmt.Sprintf("%v", value), nil
+		},
+		write: func(key, value string) error {
+			response, err := boiler.SetContext(nbe.WithSource(context.Background(), "clock"), key, []byte(value))
+			if err != nil {
+				return err
+			}
+			return nbe.StatusErr(key, response)
+		},
+		now: time.Now,
+	}
+}
+
+// Drift reads the controller's clock and returns how far it is ahead of the
+// host, to the minute
+func (s *Syncer) Drift() (time.Duration, error) {
+	date, err := s.read(s.Registers.DateKey)
+	if err != nil {
+		return 0, err
+	}
+	clock, err := s.read(s.Registers.TimeKey)
+	if err != nil {
+		return 0, err
+	}
+	now := s.now()
+	controller, err := time.ParseInLocation(s.Registers.DateFormat+" "+s.Registers.TimeFormat, date+" "+clock, now.Location())
+	if err != nil {
+		return 0, fmt.Errorf("parsing the controller clock: %w", err)
+	}
+	return controller.Sub(now.Truncate(time.Minute)), nil
+}
+
+// Sync writes the host time to the controller when its clock is off by more
+// than MaxDrift, cannot be read, or force is set
+func (s *Syncer) Sync(force bool) (Result, error) {
+	drift, err := s.Drift()
+	if err != nil {
+		log.Warnf("Failed to read the controller clock: %v", err)
+		force = true
+	}
+	result := Result{Time: s.now(), Drift: drift}
+	if !force && drift.Abs() <= s.MaxDrift {
+		return result, nil
+	}
+
+	// The time is written last, so a minute ticking over between the two
+	// writes cannot leave the controller a day out
+	result.Time = s.now()
+	if err := s.write(s.Registers.DateKey, result.Time.Format(s.Registers.DateFormat)); err != nil {
+		return result, err
+	}
+	if err := s.write(s.Registers.TimeKey, result.Time.Format(s.Registers.TimeFormat)); err != nil {
+		return result, err
+	}
+	result.Written = true
+	return result, nil
+}
+
+// Run synchronizes the clock every interval and whenever clock/sync is
+// received, publishing the drift found on clock/drift (in seconds) and the
+// time of the last write on clock/synced
+func (s *Syncer) Run(mqttClient *mqtt.Client, interval time.Duration) error {
+	sync := func(force bool) {
+		result, err := s.Sync(force)
+		if err != nil {
+			log.Errorf("Failed to set the controller clock: %v", err)
+			return
+		}
+		values := map[string]interface{}{"drift": int64(result.Drift.Seconds())}
+		if result.Written {
+			log.Infof("Set the controller clock to %s (was %s off)", result.Time.Format(time.DateTime), result.Drift)
+			values["synced"] = result.Time.Format(time.RFC3339)
+		}
+		if err := mqttClient.PublishMany("clock", values); err != nil {
+			log.Debugf("Failed to publish the clock drift: %v", err)
+		}
+	}
+
+	if err := mqttClient.Subscribe("clock/sync", 1, func(_ *mqtt.Client, _ mqtt.Message) {
+		go sync(true)
+	}); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			sync(false)
+			time.Sleep(interval)
+		}
+	}()
+	return nil
+}
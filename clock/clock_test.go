@@ -0,0 +1,117 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package clock
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestSyncer(t *testing.T, controller map[string]string, now time.Time) (*Syncer, map[string]string) {
+	t.Helper()
+	written := make(map[string]string)
+	return &Syncer{
+		Registers: DefaultRegisters,
+		MaxDrift:  time.Minute,
+		read: func(key string) (string, error) {
+			value, ok := controller[key]
+			if !ok {
+				return "", errors.New("no such key")
+			}
+			return value, nil
+		},
+		write: func(key, value string) error {
+			written[key] = value
+			return nil
+		},
+		now: func() time.Time { return now },
+	}, written
+}
+
+func TestSync(t *testing.T) {
+	now := time.Date(2024, 3, 10, 14, 30, 42, 0, time.Local)
+	tests := []struct {
+		name       string
+		controller map[string]string
+		force      bool
+		drift      time.Duration
+		written    bool
+	}{
+		{"in step", map[string]string{"misc.date": "10-03-24", "misc.time": "14:30"}, false, 0, false},
+		{"within max drift", map[string]string{"misc.date": "10-03-24", "misc.time": "14:29"}, false, -time.Minute, false},
+		{"forced", map[string]string{"misc.date": "10-03-24", "misc.time": "14:30"}, true, 0, true},
+		{"ahead", map[string]string{"misc.date": "10-03-24", "misc.time": "14:45"}, false, 15 * time.Minute, true},
+		{"wrong day", map[string]string{"misc.date": "09-03-24", "misc.time": "14:30"}, false, -24 * time.Hour, true},
+		{"unreadable", map[string]string{}, false, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncer, written := newTestSyncer(t, tt.controller, now)
+			result, err := syncer.Sync(tt.force)
+			if err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			if result.Drift != tt.drift {
+				t.Errorf("Expected drift %s, got %s", tt.drift, result.Drift)
+			}
+			if result.Written != tt.written {
+				t.Errorf("Expected written %v, got %v", tt.written, result.Written)
+			}
+			if !tt.written {
+				if len(written) != 0 {
+					t.Errorf("Expected no writes, got %v", written)
+				}
+				return
+			}
+			if written["misc.date"] != "10-03-24" || written["misc.time"] != "14:30" {
+				t.Errorf("Expected the host time to be written, got %v", written)
+			}
+		})
+	}
+}
+
+func TestSyncReportsWriteErrors(t *testing.T) {
+	syncer, _ := newTestSyncer(t, map[string]string{}, time.Now())
+	syncer.write = func(key, value string) error {
+		return errors.New("controller returned status 1")
+	}
+	if _, err := syncer.Sync(true); err == nil {
+		t.Error("Expected the write error to be returned")
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+	fake.Advance(90 * time.Minute)
+	if now := fake.Now(); !now.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("Expected 09:30 after advancing, got %v", now)
+	}
+}
+
+func TestMidnight(t *testing.T) {
+	now := time.Date(2024, 1, 31, 14, 30, 0, 0, time.UTC)
+	if midnight := Midnight(now); !midnight.Equal(time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the start of the day, got %v", midnight)
+	}
+	if next := NextMidnight(now); !next.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the start of the next month, got %v", next)
+	}
+}
@@ -0,0 +1,610 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/audit"
+	"github.com/mlipscombe/boiler-mate/capture"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/homeassistant"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/simulator"
+)
+
+// runCommand dispatches boiler-mate subcommands and returns the exit code
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "config":
+		return runConfigCommand(args[1:], stdout, stderr)
+	case "ha-cleanup":
+		return runHACleanupCommand(args[1:], stdout, stderr)
+	case "events":
+		return runEventsCommand(args[1:], stdout, stderr)
+	case "logs":
+		return runLogsCommand(args[1:], stdout, stderr)
+	case "provision-wifi":
+		return runProvisionWiFiCommand(args[1:], stdout, stderr)
+	case "sync-clock":
+		return runSyncClockCommand(args[1:], stdout, stderr)
+	case "export":
+		return runExportCommand(args[1:], stdout, stderr)
+	case "audit":
+		return runAuditCommand(args[1:], stdout, stderr)
+	case "simulate":
+		return runSimulateCommand(args[1:], stdout, stderr)
+	case "replay":
+		return runReplayCommand(args[1:], stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+	fmt.Fprintln(stderr, "usage: boiler-mate [flags] | boiler-mate config <validate|schema> | boiler-mate ha-cleanup <device-id> | boiler-mate events [-follow] | boiler-mate logs [-download] | boiler-mate provision-wifi -ssid <ssid> | boiler-mate sync-clock | boiler-mate export -history <file> | boiler-mate audit -file <file> | boiler-mate simulate | boiler-mate replay <file>...")
+	return 2
+}
+
+// runHACleanupCommand removes every Home Assistant discovery message retained
+// on the broker for a device, including entities no longer announced
+func runHACleanupCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ha-cleanup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	mqttURI := flags.String("mqtt", os.Getenv("BOILER_MATE_MQTT"), "MQTT URI, in the format mqtt[s]://[<user>:<password>]@<host>:<port>, or ws[s]:// for MQTT over WebSockets")
+	deviceID := flags.String("device-id", os.Getenv("BOILER_MATE_DEVICE_ID"), "device ID or controller serial the entities were published for")
+	wait := flags.Duration("wait", 3*time.Second, "how long to collect retained discovery messages")
+	dryRun := flags.Bool("dry-run", false, "list the discovery topics without removing them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		*deviceID = flags.Arg(0)
+	}
+	if *deviceID == "" {
+		fmt.Fprintln(stderr, "usage: boiler-mate ha-cleanup [-mqtt <uri>] [-dry-run] <device-id>")
+		return 2
+	}
+	if err := config.ValidateDeviceID(*deviceID); err != nil {
+		fmt.Fprintf(stderr, "invalid device ID: %v\n", err)
+		return 2
+	}
+	if *mqttURI == "" {
+		*mqttURI = "mqtt://localhost:1883"
+	}
+	mqttURL, err := config.ParseURL(*mqttURI)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid MQTT URI: %v\n", err)
+		return 2
+	}
+
+	mqttClient, err := mqtt.NewClient(mqttURL, fmt.Sprintf("boiler-mate-cleanup-%s", *deviceID), "")
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to connect to %s: %v\n", mqttURL.Host, err)
+		return 1
+	}
+	defer mqttClient.Close()
+
+	topics, err := homeassistant.FindDiscoveryTopics(mqttClient, *deviceID, *wait)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read discovery topics: %v\n", err)
+		return 1
+	}
+	for _, topic := range topics {
+		fmt.Fprintln(stdout, topic)
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, "%d discovery topics found for %s\n", len(topics), *deviceID)
+		return 0
+	}
+	homeassistant.ClearDiscoveryTopics(mqttClient, topics)
+	fmt.Fprintf(stdout, "%d discovery topics removed for %s\n", len(topics), *deviceID)
+	return 0
+}
+
+// runEventsCommand prints the controller's event log, optionally following it
+// as new events and alarms are logged
+func runEventsCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	controller := flags.String("controller", os.Getenv("BOILER_MATE_CONTROLLER"), "controller URI, in the format tcp://<serial>:<password>@<host>:<port>")
+	follow := flags.Bool("follow", false, "keep printing events as they are logged")
+	since := flags.String("since", "", "only show events from this time on, as a duration (e.g. 2h) or a date and time (e.g. \"2024-01-10 08:00\")")
+	asJSON := flags.Bool("json", false, "print one JSON object per event")
+	interval := flags.Duration("interval", 5*time.Second, "how often the event log is polled with -follow")
+	locale := flags.String("locale", "", "translate the event texts to this locale, e.g. en; empty prints them as they are")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *controller == "" {
+		fmt.Fprintln(stderr, "usage: boiler-mate events -controller <uri> [-follow] [-since <time>] [-json]")
+		return 2
+	}
+	from, err := parseSince(*since, time.Now())
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -since: %v\n", err)
+		return 2
+	}
+	translations, err := nbe.LoadTranslations(*locale, "")
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -locale: %v\n", err)
+		return 2
+	}
+	uri, err := config.ParseURL(*controller)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid controller URI: %v\n", err)
+		return 2
+	}
+
+	boiler, err := nbe.NewNBE(uri)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to connect to %s: %v\n", uri.Host, err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(stdout)
+	printEvent := func(event nbe.Event) {
+		if event.Time.Before(from) {
+			return
+		}
+		event.Text = translations.Text(event.Text)
+		if *asJSON {
+			encoder.Encode(event)
+			return
+		}
+		fmt.Fprintf(stdout, "%s  %3d  %s\n", event.Time.Format("2006-01-02 15:04:05"), event.Code, event.Text)
+	}
+
+	eventLog := monitor.NewEventLog(boiler)
+	if !*follow {
+		events, err := eventLog.Poll()
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to read the event log: %v\n", err)
+			return 1
+		}
+		for _, event := range events {
+			printEvent(event)
+		}
+		return 0
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	eventLog.Follow(*interval, stop, printEvent, func(err error) {
+		fmt.Fprintf(stderr, "failed to read the event log: %v\n", err)
+	})
+	return 0
+}
+
+// runLogsCommand lists the controller's internal log files, or downloads them
+// into a new directory per download, keeping the latest few downloads
+func runLogsCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	controller := flags.String("controller", os.Getenv("BOILER_MATE_CONTROLLER"), "controller URI, in the format tcp://<serial>:<password>@<host>:<port>")
+	download := flags.Bool("download", false, "download the log files instead of listing them")
+	dir := flags.String("dir", "controller-logs", "directory the downloads are stored in")
+	keep := flags.Int("keep", 5, "how many downloads of the controller to keep; older ones are removed")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *controller == "" || *keep < 1 {
+		fmt.Fprintln(stderr, "usage: boiler-mate logs -controller <uri> [-download] [-dir <dir>] [-keep <n>]")
+		return 2
+	}
+	uri, err := config.ParseURL(*controller)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid controller URI: %v\n", err)
+		return 2
+	}
+
+	boiler, err := nbe.NewNBE(uri)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to connect to %s: %v\n", uri.Host, err)
+		return 1
+	}
+	files, err := boiler.LogFiles()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to list the log files: %v\n", err)
+		return 1
+	}
+	if !*download {
+		for _, file := range files {
+			fmt.Fprintf(stdout, "%-24s %10d\n", file.Name, file.Size)
+		}
+		return 0
+	}
+
+	target, err := downloadLogs(boiler, files, *dir, time.Now())
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to download the log files: %v\n", err)
+		return 1
+	}
+	if err := pruneLogDownloads(*dir, boiler.Serial, *keep); err != nil {
+		fmt.Fprintf(stderr, "failed to remove old downloads: %v\n", err)
+	}
+	fmt.Fprintf(stdout, "Downloaded %d log files to %s\n", len(files), target)
+	return 0
+}
+
+// downloadLogs stores every log file in <dir>/<serial>-<time of download> and
+// returns that directory. A failed download leaves no directory behind.
+func downloadLogs(boiler *nbe.NBE, files []nbe.LogFile, dir string, now time.Time) (string, error) {
+	target := filepath.Join(dir, fmt.Sprintf("%s-%s", boiler.Serial, now.Format("20060102-150405")))
+	if err := os.MkdirAll(target, 0o700); err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if err := downloadLog(boiler, file.Name, filepath.Join(target, filepath.Base(file.Name))); err != nil {
+			os.RemoveAll(target)
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+func downloadLog(boiler *nbe.NBE, name, path string) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := boiler.ReadLogFile(name, out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pruneLogDownloads removes all but the keep latest downloads of serial from
+// dir; the timestamps in their names sort oldest first
+func pruneLogDownloads(dir, serial string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var downloads []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), serial+"-") {
+			downloads = append(downloads, entry.Name())
+		}
+	}
+	sort.Strings(downloads)
+	for len(downloads) > keep {
+		if err := os.RemoveAll(filepath.Join(dir, downloads[0])); err != nil {
+			return err
+		}
+		downloads = downloads[1:]
+	}
+	return nil
+}
+
+// runProvisionWiFiCommand writes the home network to a controller whose WiFi
+// dongle is still in setup mode, with this host joined to the dongle's network
+func runProvisionWiFiCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("provision-wifi", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	controller := flags.String("controller", os.Getenv("BOILER_MATE_CONTROLLER"), "controller URI, in the format tcp://<serial>:<password>@<host>:<port>; the host \"ap\" is the dongle in setup mode")
+	ssid := flags.String("ssid", "", "name of the WiFi network the dongle should join")
+	password := flags.String("password", os.Getenv("BOILER_MATE_WIFI_PASSWORD"), "password of the WiFi network, empty for an open network")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *ssid == "" {
+		fmt.Fprintln(stderr, "usage: boiler-mate provision-wifi [-controller <uri>] -ssid <ssid> [-password <password>]")
+		return 2
+	}
+	if *controller == "" {
+		*controller = "tcp://" + nbe.APModeHost
+	}
+	uri, err := config.ParseURL(*controller)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid controller URI: %v\n", err)
+		return 2
+	}
+
+	boiler, err := nbe.NewNBE(uri)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to connect to %s: %v\n", uri.Host, err)
+		return 1
+	}
+	if err := boiler.ProvisionWiFi(*ssid, *password); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Sent WiFi network %q to controller %s\n", *ssid, boiler.Serial)
+	return 0
+}
+
+// runSyncClockCommand writes the host's current time to the controller clock
+func runSyncClockCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sync-clock", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	controller := flags.String("controller", os.Getenv("BOILER_MATE_CONTROLLER"), "controller URI, in the format tcp://<serial>:<password>@<host>:<port>")
+	maxDrift := flags.Duration("max-drift", 0, "only set the clock when it is off by more than this")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *controller == "" {
+		fmt.Fprintln(stderr, "usage: boiler-mate sync-clock -controller <uri> [-max-drift <duration>]")
+		return 2
+	}
+	uri, err := config.ParseURL(*controller)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid controller URI: %v\n", err)
+		return 2
+	}
+
+	boiler, err := nbe.NewNBE(uri)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to connect to %s: %v\n", uri.Host, err)
+		return 1
+	}
+	result, err := clock.New(boiler, clock.DefaultRegisters, *maxDrift).Sync(*maxDrift == 0)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to set the controller clock: %v\n", err)
+		return 1
+	}
+	if !result.Written {
+		fmt.Fprintf(stdout, "Controller clock is %s off, not set\n", result.Drift)
+		return 0
+	}
+	fmt.Fprintf(stdout, "Set the controller clock to %s (was %s off)\n", result.Time.Format("2006-01-02 15:04"), result.Drift)
+	return 0
+}
+
+// runAuditCommand prints the writes recorded in the audit log file
+func runAuditCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "audit log written by the bridge, the audit.file setting")
+	since := flags.String("since", "", "only show writes from this time on, as a duration (e.g. 2h) or a date and time (e.g. \"2024-01-10 08:00\")")
+	key := flags.String("key", "", "only show writes to this <category>.<key>")
+	asJSON := flags.Bool("json", false, "print one JSON object per write")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(stderr, "usage: boiler-mate audit -file <file> [-since <time>] [-key <category.key>] [-json]")
+		return 2
+	}
+	from, err := parseSince(*since, time.Now())
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -since: %v\n", err)
+		return 2
+	}
+
+	entries, err := audit.Load(*file)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read the audit log: %v\n", err)
+		return 1
+	}
+	encoder := json.NewEncoder(stdout)
+	for _, entry := range audit.Filter(entries, from, *key) {
+		if *asJSON {
+			encoder.Encode(entry)
+			continue
+		}
+		result := "ok"
+		if !entry.OK() {
+			result = entry.Error
+		}
+		fmt.Fprintf(stdout, "%s  %-30s  %s: %s -> %s  %s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), orDash(entry.Source), entry.Key, orDash(entry.Old), entry.New, result)
+	}
+	return 0
+}
+
+// orDash prints an empty value as "-"
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// runSimulateCommand runs a simulated controller heating a house, for trying
+// out the bridge and Home Assistant without a boiler
+func runSimulateCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	serial := flags.String("serial", "DEMO", "serial number the simulated controller reports")
+	profile := flags.String("profile", "house_20kw", "boiler and house to simulate: "+strings.Join(simulator.ProfileNames(), ", "))
+	listen := flags.String("listen", "127.0.0.1:8483", "UDP address to answer on; :8483 for bridges on other hosts")
+	speed := flags.Float64("speed", 1, "how much faster than real time the simulation runs")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	model, ok := simulator.Profiles[*profile]
+	if *serial == "" || !ok || *speed <= 0 {
+		fmt.Fprintf(stderr, "usage: boiler-mate simulate [-serial <serial>] [-profile %s] [-listen <address>] [-speed <factor>]\n", strings.Join(simulator.ProfileNames(), "|"))
+		return 2
+	}
+
+	mock, err := nbe.NewMockBoiler(*serial)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to create the simulated controller: %v\n", err)
+		return 1
+	}
+	if err := mock.Listen(*listen); err != nil {
+		fmt.Fprintf(stderr, "failed to listen on %s: %v\n", *listen, err)
+		return 1
+	}
+	defer mock.Stop()
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	host := *listen
+	if strings.HasPrefix(host, ":") {
+		host = "<this host>" + host
+	}
+	fmt.Fprintf(stdout, "Simulating a %s boiler, serial %s, on %s\n", *profile, *serial, *listen)
+	fmt.Fprintf(stdout, "Connect the bridge with --controller tcp://%s:0000@%s\n", *serial, host)
+	simulator.New(mock, model, time.Now()).Run(time.Second, *speed, stop)
+	return 0
+}
+
+// runReplayCommand feeds frames recorded with -pcap-dir through the protocol
+// parser and prints what the client made of them
+func runReplayCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print one JSON object per frame")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: boiler-mate replay [-json] <file>...")
+		return 2
+	}
+
+	code := 0
+	encoder := json.NewEncoder(stdout)
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to open the capture: %v\n", err)
+			return 1
+		}
+		frames, err := capture.ReadFrames(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to read %s: %v\n", name, err)
+			return 1
+		}
+
+		for _, frame := range frames {
+			decoded := capture.Decode(frame)
+			if decoded.Error != "" {
+				code = 1
+			}
+			if *asJSON {
+				encoder.Encode(decoded)
+				continue
+			}
+			fmt.Fprintf(stdout, "%s  %s  %3d  %-22s  %s\n", decoded.Time.Local().Format("2006-01-02 15:04:05.000"), decoded.Direction, decoded.SeqNo, orDash(decoded.Function), describeFrame(decoded))
+		}
+	}
+	return code
+}
+
+// describeFrame summarizes the request, status and payload of a frame, or
+// why it could not be parsed
+func describeFrame(decoded capture.Decoded) string {
+	if decoded.Error != "" {
+		return fmt.Sprintf("error: %s: %q", decoded.Error, decoded.Raw)
+	}
+	if decoded.Direction == "send" {
+		if decoded.Encrypted {
+			return decoded.Request + " (encrypted)"
+		}
+		return decoded.Request
+	}
+	keys := make([]string, 0, len(decoded.Payload))
+	for key := range decoded.Payload {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = fmt.Sprintf("%s=%v", key, decoded.Payload[key])
+	}
+	return fmt.Sprintf("status %d  %s", decoded.Status, strings.Join(fields, " "))
+}
+
+// parseSince interprets the -since flag: empty for no limit, a duration
+// before now, or a local date with an optional time
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration nor a date and time", value)
+}
+
+func runConfigCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "usage: boiler-mate config <validate [file]|schema>")
+		return 2
+	}
+
+	switch args[0] {
+	case "validate":
+		flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+		flags.SetOutput(stderr)
+		filename := flags.String("config", os.Getenv("BOILER_MATE_CONFIG"), "path to the YAML configuration file")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if flags.NArg() > 0 {
+			*filename = flags.Arg(0)
+		}
+		if *filename == "" {
+			fmt.Fprintln(stderr, "no configuration file given")
+			return 2
+		}
+		if err := config.ValidateFile(*filename); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *filename, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s: OK\n", *filename)
+		return 0
+
+	case "schema":
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(config.Schema()); err != nil {
+			fmt.Fprintf(stderr, "failed to encode schema: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "unknown config command %q\n", args[0])
+	return 2
+}
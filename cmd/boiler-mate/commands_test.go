@@ -0,0 +1,330 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/audit"
+	"github.com/mlipscombe/boiler-mate/capture"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestRunConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(valid, []byte("features:\n  consumption: true\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if err := os.WriteFile(invalid, []byte("features:\n  warp_drive: true\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"config", "validate", valid}, &stdout, &stderr); code != 0 {
+		t.Errorf("Expected exit code 0 for valid config, got %d (%s)", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "OK") {
+		t.Errorf("Expected OK in output, got %q", stdout.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := runCommand([]string{"config", "validate", "-config", invalid}, &stdout, &stderr); code != 1 {
+		t.Errorf("Expected exit code 1 for invalid config, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "warp_drive") {
+		t.Errorf("Expected offending key in error, got %q", stderr.String())
+	}
+}
+
+func TestRunConfigSchema(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"config", "schema"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &schema); err != nil {
+		t.Fatalf("Expected JSON schema output, got error %v", err)
+	}
+	if schema["type"] != "object" {
+		t.Errorf("Expected object schema, got %v", schema["type"])
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"frobnicate"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 for unknown command, got %d", code)
+	}
+	if code := runCommand([]string{"config"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 for missing config command, got %d", code)
+	}
+}
+
+func TestRunHACleanupUsage(t *testing.T) {
+	t.Setenv("BOILER_MATE_DEVICE_ID", "")
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"ha-cleanup"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 without a device ID, got %d", code)
+	}
+	if code := runCommand([]string{"ha-cleanup", "home/+"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 for a wildcard device ID, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "invalid device ID") {
+		t.Errorf("Expected invalid device ID error, got %q", stderr.String())
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2h", now.Add(-2 * time.Hour), false},
+		{"2024-01-09", time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC), false},
+		{"2024-01-09 08:30", time.Date(2024, 1, 9, 8, 30, 0, 0, time.UTC), false},
+		{"2024-01-09T08:30:00Z", time.Date(2024, 1, 9, 8, 30, 0, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSince(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSince(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseSince(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunEventsCommand(t *testing.T) {
+	mockBoiler, _ := newMockNBE(t, "EVENTS123")
+	mockBoiler.RaiseAlarm(9, "Alarm burner is too hot")
+	controller := fmt.Sprintf("tcp://EVENTS123:1234@%s", mockBoiler.GetAddr())
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"events", "-controller", controller}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Alarm burner is too hot") {
+		t.Errorf("Expected the alarm in the output, got %q", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := runCommand([]string{"events", "-controller", controller, "-json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	var event nbe.Event
+	if err := json.Unmarshal(stdout.Bytes(), &event); err != nil || event.Code != 9 {
+		t.Errorf("Expected a JSON event with code 9, got %q (%v)", stdout.String(), err)
+	}
+
+	stdout.Reset()
+	if code := runCommand([]string{"events", "-controller", controller, "-since", "2999-01-01"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no events after -since, got %q", stdout.String())
+	}
+}
+
+func TestRunLogsCommand(t *testing.T) {
+	mockBoiler, _ := newMockNBE(t, "LOGS123")
+	mockBoiler.AddLogFile("system.log", []byte("ignition started\n"))
+	controller := fmt.Sprintf("tcp://LOGS123:1234@%s", mockBoiler.GetAddr())
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"logs", "-controller", controller}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "system.log") {
+		t.Errorf("Expected the log file in the listing, got %q", stdout.String())
+	}
+
+	dir := t.TempDir()
+	for _, old := range []string{"LOGS123-20200101-000000", "LOGS123-20200102-000000", "OTHER-20200101-000000"} {
+		if err := os.Mkdir(filepath.Join(dir, old), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stdout.Reset()
+	if code := runCommand([]string{"logs", "-controller", controller, "-download", "-dir", dir, "-keep", "2"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 3 || names[0] != "LOGS123-20200102-000000" || names[2] != "OTHER-20200101-000000" {
+		t.Fatalf("Expected the oldest download to be removed, got %v", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, names[1], "system.log"))
+	if err != nil || string(data) != "ignition started\n" {
+		t.Errorf("Expected the downloaded log file, got %q (%v)", data, err)
+	}
+}
+
+func TestRunSyncClockCommand(t *testing.T) {
+	mockBoiler, _ := newMockNBE(t, "CLOCK123")
+	controller := fmt.Sprintf("tcp://CLOCK123:1234@%s", mockBoiler.GetAddr())
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"sync-clock", "-controller", controller}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	writes := mockBoiler.Writes()
+	if len(writes) != 2 || !strings.HasPrefix(writes[0], "misc.date=") || !strings.HasPrefix(writes[1], "misc.time=") {
+		t.Errorf("Expected the date and then the time to be written, got %v", writes)
+	}
+
+	stdout.Reset()
+	if code := runCommand([]string{"sync-clock", "-controller", controller, "-max-drift", "5m"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "not set") || len(mockBoiler.Writes()) != 2 {
+		t.Errorf("Expected a clock in step to be left alone, got %q and %v", stdout.String(), mockBoiler.Writes())
+	}
+}
+
+func TestRunProvisionWiFiCommand(t *testing.T) {
+	mockBoiler, _ := newMockNBE(t, "WIFI123")
+	controller := fmt.Sprintf("tcp://WIFI123:1234@%s", mockBoiler.GetAddr())
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"provision-wifi", "-controller", controller}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 without an SSID, got %d", code)
+	}
+
+	t.Setenv("BOILER_MATE_WIFI_PASSWORD", "hunter22")
+	if code := runCommand([]string{"provision-wifi", "-controller", controller, "-ssid", "Home"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"Home"`) {
+		t.Errorf("Expected the network in the output, got %q", stdout.String())
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 2 || writes[1] != "wifi.password=hunter22" {
+		t.Errorf("Unexpected writes %v", writes)
+	}
+}
+
+func TestRunAuditCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	log := audit.New(file, 10, nil)
+	log.Observe("boiler", map[string]interface{}{"temp": 65})
+	log.Record(nbe.WriteAttempt{Source: "scheduler:night", Path: "boiler.temp", Value: []byte("70")})
+	log.Record(nbe.WriteAttempt{Path: "hot_water.temp", Value: []byte("90"), Err: errors.New("permission denied")})
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"audit"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 without -file, got %d", code)
+	}
+	if code := runCommand([]string{"audit", "-file", file, "-key", "hot_water.temp"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if output := stdout.String(); !strings.Contains(output, "hot_water.temp: - -> 90  permission denied") || strings.Contains(output, "boiler.temp") {
+		t.Errorf("Unexpected output %q", output)
+	}
+
+	stdout.Reset()
+	if code := runCommand([]string{"audit", "-file", file, "-json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	var entry audit.Entry
+	if err := json.NewDecoder(&stdout).Decode(&entry); err != nil || entry.Source != "scheduler:night" || entry.Old != "65" {
+		t.Errorf("Unexpected first entry %+v (%v)", entry, err)
+	}
+}
+
+func TestRunSimulateCommandUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"simulate", "-profile", "castle_500kw"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown profile, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "house_20kw") {
+		t.Errorf("Expected the usage to list the profiles, got %q", stderr.String())
+	}
+}
+
+func TestRunReplayCommand(t *testing.T) {
+	at := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	var request, response bytes.Buffer
+	(&nbe.NBERequest{AppID: "APPID0000000", ControllerID: "CTRL00", Function: nbe.GetSetupFunction, SeqNo: 7, Timestamp: at, Payload: []byte("boiler.temp")}).Pack(&request)
+	(&nbe.NBEResponse{AppID: "APPID0000000", ControllerID: "CTRL00", Function: nbe.GetSetupFunction, SeqNo: 7, Payload: map[string]interface{}{"temp": "65"}}).Pack(&response)
+
+	file := filepath.Join(t.TempDir(), "boiler-mate.nbe")
+	lines := capture.FormatFrame(capture.Frame{Time: at, Outgoing: true, Data: request.Bytes()}) + "\n" +
+		capture.FormatFrame(capture.Frame{Time: at, Data: response.Bytes()}) + "\n"
+	if err := os.WriteFile(file, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"replay"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 without a file, got %d", code)
+	}
+	if code := runCommand([]string{"replay", file}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	output := stdout.String()
+	if !strings.Contains(output, "send    7  get_setup               boiler.temp") || !strings.Contains(output, "status 0  temp=65") {
+		t.Errorf("Unexpected output %q", output)
+	}
+
+	stdout.Reset()
+	broken := lines + capture.FormatFrame(capture.Frame{Time: at, Data: response.Bytes()[:30]}) + "\n"
+	if err := os.WriteFile(file, []byte(broken), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCommand([]string{"replay", "-json", file}, &stdout, &stderr); code != 1 {
+		t.Errorf("Expected exit code 1 for a frame the parser rejects, got %d", code)
+	}
+	var decoded []capture.Decoded
+	decoder := json.NewDecoder(&stdout)
+	for decoder.More() {
+		var d capture.Decoded
+		if err := decoder.Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, d)
+	}
+	if len(decoded) != 3 || fmt.Sprint(decoded[1].Payload["temp"]) != "65" || decoded[2].Error == "" {
+		t.Errorf("Unexpected frames %+v", decoded)
+	}
+}
@@ -0,0 +1,116 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/export"
+	"github.com/mlipscombe/boiler-mate/history"
+)
+
+// runExportCommand writes the series of the local history file as CSV or
+// Parquet, with a column per series and a row per change
+func runExportCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	historyFile := flags.String("history", "", "history file written by the bridge, the history.file setting")
+	fromFlag := flags.String("from", "", "start of the export, as a duration before now (e.g. 24h) or a date and time (e.g. \"2024-01-10 08:00\"); empty for all")
+	toFlag := flags.String("to", "", "end of the export, in the same form as -from; empty for now")
+	keys := flags.String("keys", "", "comma-separated <category>/<key> series to export, with * wildcards; empty for all")
+	format := flags.String("format", "csv", "file format, csv or parquet")
+	output := flags.String("output", "", "file to write; empty for standard output")
+	utc := flags.Bool("utc", false, "write CSV times in UTC instead of local time")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *historyFile == "" || (*format != "csv" && *format != "parquet") {
+		fmt.Fprintln(stderr, "usage: boiler-mate export -history <file> [-from <time>] [-to <time>] [-keys <key,...>] [-format csv|parquet] [-output <file>]")
+		return 2
+	}
+	now := time.Now()
+	from, err := parseSince(*fromFlag, now)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -from: %v\n", err)
+		return 2
+	}
+	to := now
+	if *toFlag != "" {
+		if to, err = parseSince(*toFlag, now); err != nil {
+			fmt.Fprintf(stderr, "invalid -to: %v\n", err)
+			return 2
+		}
+	}
+	var patterns []string
+	for _, key := range strings.Split(*keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			patterns = append(patterns, key)
+		}
+	}
+
+	if _, err := os.Stat(*historyFile); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	store := history.New(*historyFile, 0, 0)
+	if err := store.Load(); err != nil {
+		fmt.Fprintf(stderr, "failed to read the history: %v\n", err)
+		return 1
+	}
+	table, err := export.Build(store, patterns, from, to)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if len(table.Columns) == 0 {
+		fmt.Fprintln(stderr, "no series in the history match -keys")
+		return 1
+	}
+	if *utc {
+		for i := range table.Rows {
+			table.Rows[i].Time = table.Rows[i].Time.UTC()
+		}
+	}
+
+	out := stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	write := export.WriteCSV
+	if *format == "parquet" {
+		write = export.WriteParquet
+	}
+	if err := write(out, table); err != nil {
+		fmt.Fprintf(stderr, "failed to write the export: %v\n", err)
+		return 1
+	}
+	return 0
+}
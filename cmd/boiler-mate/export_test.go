@@ -0,0 +1,61 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/history"
+)
+
+func TestRunExportCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+	store := history.New(file, 100*365*24*time.Hour, 0)
+	store.Record("operating_data", map[string]interface{}{"boiler_temp": 65.5, "power_pct": 40.0}, time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC))
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"export", "-format", "xlsx", "-history", file}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown format, got %d", code)
+	}
+	if code := runCommand([]string{"export", "-history", file, "-keys", "*/boiler_temp", "-utc", "-from", "2024-01-01"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if expected := "time,operating_data/boiler_temp\n2024-01-10 12:00:00,65.5\n"; stdout.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, stdout.String())
+	}
+	if code := runCommand([]string{"export", "-history", file, "-keys", "settings/*"}, &stdout, &stderr); code != 1 {
+		t.Errorf("Expected exit code 1 when no series match, got %d", code)
+	}
+
+	output := filepath.Join(t.TempDir(), "history.parquet")
+	if code := runCommand([]string{"export", "-history", file, "-format", "parquet", "-output", output}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d (%s)", code, stderr.String())
+	}
+	if data, err := os.ReadFile(output); err != nil || !bytes.HasPrefix(data, []byte("PAR1")) {
+		t.Errorf("Expected a Parquet file, got %q (%v)", data, err)
+	}
+}
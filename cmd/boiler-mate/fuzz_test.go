@@ -0,0 +1,87 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+)
+
+// FuzzSetCommand feeds arbitrary set topics and payloads through the command
+// path into a mock boiler and checks that only valid writes reach it
+func FuzzSetCommand(f *testing.F) {
+	mockBoiler, boiler := newMockNBE(f, "FUZZ123")
+
+	eventBus := bus.New()
+	results := make(chan bus.Event, 16)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	seeds := []struct {
+		topic   string
+		payload string
+	}{
+		{"nbe/FUZZ123/set/boiler/temp", "70"},
+		{"nbe/FUZZ123/set/boiler/temp", " 70\n"},
+		{"nbe/FUZZ123/set/boiler/temp", "NaN"},
+		{"nbe/FUZZ123/set/boiler/temp", "0x1p6"},
+		{"nbe/FUZZ123/set/boiler/temp", "7e1"},
+		{"nbe/FUZZ123/set/boiler/temp", "70;misc.start=1"},
+		{"nbe/FUZZ123/set/boiler/temp", "70\x00"},
+		{"nbe/FUZZ123/set/hot_water/temp", "-1"},
+		{"nbe/FUZZ123/set/device/power_switch", "ON"},
+		{"nbe/FUZZ123/set/device/power_switch", "garbage"},
+		{"nbe/FUZZ123/set/misc/start=1;boiler/temp", "1"},
+		{"nbe/FUZZ123/set/", ""},
+		{"set", "1"},
+		{"", ""},
+		{"nbe/FUZZ123/set/bøiler/témp", "७०"},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.topic, []byte(seed.payload))
+	}
+
+	f.Fuzz(func(t *testing.T, topic string, payload []byte) {
+		before := len(mockBoiler.Writes())
+
+		handleSetCommand(boiler, eventBus, nil, nil, nil, topic, payload)
+
+		select {
+		case <-results:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No write result for %q = %q", topic, payload)
+		}
+
+		for _, write := range mockBoiler.Writes()[before:] {
+			key, value, found := strings.Cut(write, "=")
+			if !found {
+				t.Fatalf("Malformed write %q from %q = %q", write, topic, payload)
+			}
+			if strings.ContainsAny(value, ";= \t\r\n") {
+				t.Fatalf("Unsanitised write %q from %q = %q", write, topic, payload)
+			}
+			if err := boiler.ValidateSetting(key, []byte(value)); err != nil {
+				t.Fatalf("Invalid write %q from %q = %q: %v", write, topic, payload, err)
+			}
+		}
+	})
+}
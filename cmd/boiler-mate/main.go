@@ -18,23 +18,72 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	healthz "github.com/klyve/go-healthz"
+	"github.com/mlipscombe/boiler-mate/api"
+	"github.com/mlipscombe/boiler-mate/audit"
+	"github.com/mlipscombe/boiler-mate/auxheater"
+	"github.com/mlipscombe/boiler-mate/availability"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/calibration"
+	"github.com/mlipscombe/boiler-mate/capture"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/combustion"
+	"github.com/mlipscombe/boiler-mate/compat"
 	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/degreedays"
+	"github.com/mlipscombe/boiler-mate/derive"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+	"github.com/mlipscombe/boiler-mate/drift"
+	"github.com/mlipscombe/boiler-mate/efficiency"
+	"github.com/mlipscombe/boiler-mate/firmware"
+	"github.com/mlipscombe/boiler-mate/health"
+	"github.com/mlipscombe/boiler-mate/history"
 	"github.com/mlipscombe/boiler-mate/homeassistant"
+	"github.com/mlipscombe/boiler-mate/homekit"
+	"github.com/mlipscombe/boiler-mate/hydronic"
+	"github.com/mlipscombe/boiler-mate/mapping"
 	"github.com/mlipscombe/boiler-mate/monitor"
 	"github.com/mlipscombe/boiler-mate/mqtt"
 	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/notify"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	"github.com/mlipscombe/boiler-mate/profile"
+	"github.com/mlipscombe/boiler-mate/quiethours"
+	"github.com/mlipscombe/boiler-mate/remap"
+	"github.com/mlipscombe/boiler-mate/scheduler"
+	"github.com/mlipscombe/boiler-mate/shadow"
+	"github.com/mlipscombe/boiler-mate/sink"
+	"github.com/mlipscombe/boiler-mate/state"
+	"github.com/mlipscombe/boiler-mate/systemd"
+	"github.com/mlipscombe/boiler-mate/tracing"
+	"github.com/mlipscombe/boiler-mate/watchdog"
+	"github.com/mlipscombe/boiler-mate/writelimit"
+	"github.com/mlipscombe/boiler-mate/zeroconf"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// healthMaxAge is how long the controller may go without answering, or the
+// operating data monitor without polling, before the bridge reports unhealthy
+const healthMaxAge = time.Minute
+
 // determineMQTTPrefix extracts the MQTT prefix from the URL path, or generates one from the serial
 func determineMQTTPrefix(mqttURL *url.URL, serial string) string {
 	if len(mqttURL.Path) > 1 {
@@ -43,6 +92,15 @@ func determineMQTTPrefix(mqttURL *url.URL, serial string) string {
 	return fmt.Sprintf("nbe/%s", serial)
 }
 
+// determineDeviceID returns the configured device identifier, falling back to
+// the controller serial
+func determineDeviceID(alias, serial string) string {
+	if alias != "" {
+		return alias
+	}
+	return serial
+}
+
 // parseSetTopic extracts the key from a set topic (e.g., "prefix/set/category/param" -> "category.param")
 func parseSetTopic(topic string) string {
 	topicParts := strings.Split(topic, "/")
@@ -65,48 +123,430 @@ func translatePowerCommand(key string, value []byte) (string, []byte) {
 	return "misc.stop", []byte("1")
 }
 
-func main() {
-	cfg := config.Load()
-	cfg.SetupLogging()
+// handleSetCommand validates a command received on a set topic and writes it
+// to the controller, publishing the outcome as a WritePerformed event once the
+// value the controller stored has been read back
+func handleSetCommand(boiler *nbe.NBE, eventBus *bus.Bus, pipelines *pipeline.Pipelines, hours *quiethours.Hours, limits *writelimit.Limiter, topic string, payload []byte) {
+	setCommand(boiler, eventBus, pipelines, hours, limits, topic, payload, true)
+}
 
-	if cfg.Bind != "false" {
-		go func(listenAddress string) {
-			log.Infof("Starting metrics server on %s", listenAddress)
-			instance := healthz.Instance{
-				Logger:   log.New(),
-				Detailed: true,
-			}
+// handleRawSetCommand is handleSetCommand for a value already in the
+// controller's units, which skips inverting the write pipeline
+func handleRawSetCommand(boiler *nbe.NBE, eventBus *bus.Bus, pipelines *pipeline.Pipelines, hours *quiethours.Hours, limits *writelimit.Limiter, topic string, payload []byte) {
+	setCommand(boiler, eventBus, pipelines, hours, limits, topic, payload, false)
+}
 
-			http.Handle("/metrics", promhttp.Handler())
-			http.Handle("/healthz", instance.Healthz())
-			http.Handle("/liveness", instance.Liveness())
+// setCommand writes a set command, inverting the write pipeline of the key if
+// invert is set
+func setCommand(boiler *nbe.NBE, eventBus *bus.Bus, pipelines *pipeline.Pipelines, hours *quiethours.Hours, limits *writelimit.Limiter, topic string, payload []byte, invert bool) {
+	topicKey := parseSetTopic(topic)
 
-			if err := http.ListenAndServe(listenAddress, nil); err != nil {
-				log.Errorf("HTTP server error: %v", err)
-			}
-		}(cfg.Bind)
+	// Translate power switch commands
+	key, value := translatePowerCommand(topicKey, bytes.TrimSpace(payload))
+
+	ctx, writeResult := startCommand(eventBus, topic, topicKey, key, payload)
+
+	if err := hours.Check(key); err != nil {
+		log.Warnf("Rejected set %s to %q: %v", key, payload, err)
+		writeResult(err, nil)
+		return
+	}
+
+	if invert {
+		var err error
+		if value, err = pipelines.Write(key, value); err != nil {
+			log.Warnf("Rejected set %s to %q: %v", key, payload, err)
+			writeResult(err, nil)
+			return
+		}
+	}
+
+	if err := boiler.ValidateSetting(key, value); err != nil {
+		log.Warnf("Rejected set %s to %q: %v", key, value, err)
+		writeResult(err, nil)
+		return
+	}
+
+	if err := limits.Allow(key); err != nil {
+		log.Warnf("Rejected set %s to %q: %v", key, value, err)
+		writeResult(err, nil)
+		return
+	}
+
+	_, err := boiler.SetAsyncContext(ctx, key, value, func(response *nbe.NBEResponse) {
+		log.Infof("Set %s to %s: %v", key, value, response)
+		if err := nbe.StatusErr(key, response); err != nil {
+			log.Warnf("Failed to set %s to %s: %v", key, value, err)
+			writeResult(err, nil)
+			return
+		}
+		if definition, ok := boiler.SettingSchema[key]; ok && definition.Action {
+			writeResult(nil, nil)
+			return
+		}
+		// The read back waits for a response, which is delivered on the
+		// goroutine running this callback
+		go confirmWrite(boiler, eventBus, pipelines, key, value, writeResult)
+	})
+	if err != nil {
+		log.Errorf("Failed to set %s to %s: %v", key, value, err)
+		writeResult(err, nil)
+	}
+}
+
+// handleMappedCommand writes a value received on the set topic of a writable
+// key mapping, already checked and scaled by the mapping, to its key. The
+// quiet hours and write limits apply; the setting schema and pipelines don't,
+// as the key is defined by the mapping alone.
+func handleMappedCommand(boiler *nbe.NBE, eventBus *bus.Bus, hours *quiethours.Hours, limits *writelimit.Limiter, topic, key string, value []byte) {
+	ctx, writeResult := startCommand(eventBus, topic, key, key, value)
+
+	if err := hours.Check(key); err != nil {
+		log.Warnf("Rejected set %s to %q: %v", key, value, err)
+		writeResult(err, nil)
+		return
+	}
+	if err := limits.Allow(key); err != nil {
+		log.Warnf("Rejected set %s to %q: %v", key, value, err)
+		writeResult(err, nil)
+		return
+	}
+
+	_, err := boiler.SetAsyncContext(ctx, key, value, func(response *nbe.NBEResponse) {
+		log.Infof("Set %s to %s: %v", key, value, response)
+		err := nbe.StatusErr(key, response)
+		if err != nil {
+			log.Warnf("Failed to set %s to %s: %v", key, value, err)
+		}
+		writeResult(err, nil)
+	})
+	if err != nil {
+		log.Errorf("Failed to set %s to %s: %v", key, value, err)
+		writeResult(err, nil)
+	}
+}
+
+// startCommand starts the trace of a command received on topic to write key,
+// returning its context and the function publishing its outcome as a
+// WritePerformed event for resultKey
+func startCommand(eventBus *bus.Bus, topic, resultKey, key string, payload []byte) (context.Context, func(err error, stored interface{})) {
+	ctx, span := tracing.Start(nbe.WithSource(context.Background(), "mqtt:"+topic), "mqtt command", trace.WithSpanKind(trace.SpanKindConsumer))
+	span.SetAttributes(attribute.String("mqtt.topic", topic), attribute.String("nbe.key", key))
+	return ctx, func(err error, stored interface{}) {
+		tracing.End(span, err)
+		event := bus.Event{Kind: bus.WritePerformed, Key: resultKey, Value: payload, Err: err, Context: ctx}
+		if stored != nil {
+			event.Values = map[string]interface{}{"stored": stored}
+		}
+		eventBus.Publish(event)
+	}
+}
+
+// writeBatch writes settings as one batch after the quiet hours, write
+// pipelines and write limits, publishing the outcome of each write and the
+// values the settings were left at
+func writeBatch(ctx context.Context, boiler *nbe.NBE, eventBus *bus.Bus, pipelines *pipeline.Pipelines, hours *quiethours.Hours, limits *writelimit.Limiter, values map[string]string) ([]nbe.BatchWrite, error) {
+	ctx, span := tracing.Start(ctx, "batch write")
+	span.SetAttributes(attribute.Int("nbe.batch_size", len(values)))
+
+	written := make(map[string]string, len(values))
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		if err := hours.Check(key); err != nil {
+			tracing.End(span, err)
+			return nil, &nbe.BatchError{Path: key, Err: err}
+		}
+		transformed, err := pipelines.Write(key, []byte(value))
+		if err != nil {
+			tracing.End(span, err)
+			return nil, &nbe.BatchError{Path: key, Err: err}
+		}
+		written[key] = string(transformed)
+		keys = append(keys, key)
+	}
+	if err := limits.Allow(keys...); err != nil {
+		tracing.End(span, err)
+		var limited *writelimit.Error
+		errors.As(err, &limited)
+		return nil, &nbe.BatchError{Path: limited.Key, Err: err}
+	}
+
+	writes, err := boiler.SetManyContext(ctx, written)
+	tracing.End(span, err)
+	if err != nil {
+		log.Warnf("Failed to write a batch of %d settings: %v", len(values), err)
+	} else {
+		log.Infof("Wrote a batch of %d settings", len(values))
+	}
+	for _, write := range writes {
+		event := bus.Event{Kind: bus.WritePerformed, Key: write.Path, Value: []byte(values[write.Path]), Context: ctx}
+		current := write.Stored
+		switch {
+		case write.Error != "":
+			event.Err = errors.New(write.Error)
+		case err != nil:
+			event.Err = fmt.Errorf("rolled back: %w", err)
+		}
+		if write.RolledBack {
+			current = write.Previous
+		}
+		if current == nil {
+			eventBus.Publish(event)
+			continue
+		}
+		category, name, _ := strings.Cut(write.Path, ".")
+		stored := map[string]interface{}{name: current}
+		pipelines.Read(category, stored)
+		event.Values = map[string]interface{}{"stored": stored[name]}
+		eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: category, Values: stored, Guaranteed: true})
+		eventBus.Publish(event)
+	}
+	return writes, err
+}
+
+// handleBatchCommand writes the JSON object of settings received on
+// set/batch as one batch, publishing the result on batch/result
+func handleBatchCommand(mqttClient *mqtt.Client, boiler *nbe.NBE, eventBus *bus.Bus, pipelines *pipeline.Pipelines, hours *quiethours.Hours, limits *writelimit.Limiter, topic string, payload []byte) {
+	values, err := api.ParseBatch(payload)
+	var writes []nbe.BatchWrite
+	if err != nil {
+		log.Warnf("Rejected batch on %s: %v", topic, err)
+	} else {
+		writes, err = writeBatch(nbe.WithSource(context.Background(), "mqtt:"+topic), boiler, eventBus, pipelines, hours, limits, values)
+	}
+	if err := mqttClient.PublishJSON(mqttClient.Prefix+"/batch/result", api.NewBatchResult(writes, err)); err != nil {
+		log.Errorf("Failed to publish the batch result: %v", err)
+	}
+}
+
+// confirmWrite reads a written setting back from the controller, which clamps
+// out-of-range values without an error, publishes the stored value as its new
+// state and reports it, failing the write when it differs from what was sent
+func confirmWrite(boiler *nbe.NBE, eventBus *bus.Bus, pipelines *pipeline.Pipelines, key string, written []byte, done func(err error, stored interface{})) {
+	category, name, _ := strings.Cut(key, ".")
+	response, err := boiler.Get(nbe.GetSetupFunction, key)
+	if err != nil {
+		log.Warnf("Failed to read back %s: %v", key, err)
+		done(fmt.Errorf("written, but reading it back failed: %w", err), nil)
+		return
+	}
+	raw, ok := response.Payload[name]
+	if !ok {
+		done(fmt.Errorf("written, but the controller did not return %s", key), nil)
+		return
+	}
+
+	values := map[string]interface{}{name: raw}
+	pipelines.Read(category, values)
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: category, Values: values, Guaranteed: true})
+
+	if !nbe.SameValue(written, raw) {
+		log.Warnf("Controller stored %v for %s instead of %s", raw, key, written)
+		done(fmt.Errorf("controller stored %v instead of %s", raw, written), values[name])
+		return
+	}
+	done(nil, values[name])
+}
+
+// discoverBroker replaces the host and port of the MQTT URL with the first
+// broker advertised over mDNS, keeping the configured ones when none answers
+func discoverBroker(mqttURL *url.URL, timeout time.Duration) *url.URL {
+	serviceType := "_mqtt._tcp"
+	if mqttURL.Scheme == "mqtts" {
+		serviceType = "_secure-mqtt._tcp"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	brokers, err := zeroconf.Browse(ctx, serviceType)
+	if err != nil {
+		log.Warnf("Failed to discover an MQTT broker: %v", err)
+		return mqttURL
+	}
+	for _, broker := range brokers {
+		if len(broker.Addrs) == 0 {
+			continue
+		}
+		discovered := *mqttURL
+		discovered.Host = net.JoinHostPort(broker.Addrs[0].String(), strconv.Itoa(broker.Port))
+		log.Infof("Discovered MQTT broker %q at %s", broker.Instance, discovered.Host)
+		return &discovered
+	}
+	log.Warnf("No %s broker found, using %s", serviceType, mqttURL.Host)
+	return mqttURL
+}
+
+// advertiseAPI announces the HTTP server over mDNS as a _boiler-mate._tcp
+// service, with the serial and API path in its TXT record
+func advertiseAPI(cfg *config.Config, deviceID, serial string) (*zeroconf.Server, error) {
+	_, port, err := net.SplitHostPort(cfg.Bind)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	instance := cfg.Zeroconf.Instance
+	if instance == "" {
+		instance = "boiler-mate " + deviceID
+	}
+	text := map[string]string{"serial": serial, "device_id": deviceID}
+	if cfg.Features.REST {
+		text["path"] = "/api"
+	}
+	server, err := zeroconf.Advertise(zeroconf.Service{
+		Instance: instance,
+		Type:     zeroconf.ServiceType,
+		Host:     strings.SplitN(hostname, ".", 2)[0],
+		Port:     portNumber,
+		Text:     text,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Advertising %q as %s on port %d", instance, zeroconf.ServiceType, portNumber)
+	return server, nil
+}
+
+// republishStates publishes the latest value of every key again, for a Home
+// Assistant that lost the retained states
+func republishStates(mqttClient *mqtt.Client, state *api.State) {
+	values := state.Snapshot()
+	for path, value := range values {
+		if err := mqttClient.PublishRaw(fmt.Sprintf("%s/%s", mqttClient.Prefix, path), value); err != nil {
+			log.Debugf("Failed to republish %s: %v", path, err)
+		}
+	}
+	log.Infof("Republished %d states", len(values))
+}
+
+// keepState restores a tracker's baseline from the state directory and keeps
+// saving it; it does nothing without a state directory
+func keepState[T any](stateDir *state.Dir, name string, restore func(T), snapshot func() T) {
+	if stateDir == nil {
+		return
+	}
+	if err := state.Track(stateDir, name, restore, snapshot); err != nil {
+		log.Warnf("Ignoring the saved %s state: %v", name, err)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
 	}
 
-	uri, err := url.Parse(cfg.ControllerURL)
+	started := time.Now()
+	cfg := config.Load()
+	cfg.SetupLogging()
+	if cfg.StokerCloud.Enabled {
+		runStokerCloud(cfg)
+		return
+	}
+
+	uri, err := config.ParseURL(cfg.ControllerURL)
 	if err != nil {
 		panic(err)
 	}
-	boiler, err := nbe.NewNBE(uri)
+	var stateDir *state.Dir
+	var saved state.Controller
+	var savedKey *rsa.PublicKey
+	if cfg.StateDir != "" {
+		stateDir, err = state.Open(cfg.StateDir, uri.User.Username())
+		if err != nil {
+			log.Fatalf("Failed to open the state directory: %v", err)
+		}
+		if _, err := stateDir.Load("controller", &saved); err != nil {
+			log.Warnf("Ignoring the saved controller state: %v", err)
+		}
+		if saved.PublicKey != "" {
+			if savedKey, err = nbe.ParsePublicKey(saved.PublicKey); err != nil {
+				log.Warnf("Ignoring the saved public key: %v", err)
+			}
+		}
+	}
+	boiler, err := nbe.NewNBEWithKey(uri, savedKey)
+	var mismatch *nbe.KeyMismatchError
+	if errors.As(err, &mismatch) {
+		log.Fatalf("Refusing to connect: %v", err)
+	}
 	if err != nil {
 		panic(err)
 	}
+	if cfg.PcapDir != "" {
+		frames, err := capture.NewFrameLog(cfg.PcapDir)
+		if err != nil {
+			log.Fatalf("Failed to record controller frames: %v", err)
+		}
+		boiler.SetFrameRecorder(frames.Record)
+		defer frames.Close()
+	}
+	boiler.SetRateLimit(cfg.Polling.RateLimit, cfg.Polling.Burst)
+	boiler.SetCacheTTLs(cfg.Polling.CacheTTL)
+	boiler.SetReadOnly(cfg.ReadOnly)
+	if !cfg.Maintenance.Destructive {
+		boiler.SettingSchema = nbe.WithoutDestructive(boiler.SettingSchema)
+	}
+	if cfg.InstallerPassword != "" {
+		boiler.SetPasswords(boiler.PinCode, cfg.InstallerPassword)
+	}
+	settingRanges, err := boiler.LoadSettingRanges()
+	if err != nil && len(saved.Ranges) > 0 {
+		log.Warnf("Failed to read the setting ranges from the controller, using the ranges saved on a previous run: %v", err)
+		for key, setting := range settingRanges {
+			saved.Ranges[key] = setting
+		}
+		settingRanges = boiler.ApplySettingRanges(saved.Ranges)
+	} else if err != nil {
+		log.Warnf("Failed to read the setting ranges from the controller, keeping the built-in ranges of the rest: %v", err)
+	}
+	if len(settingRanges) > 0 {
+		log.Infof("Read the ranges of %d settings from the controller", len(settingRanges))
+	}
+	if stateDir != nil {
+		if savedKey != nil && !savedKey.Equal(boiler.PublicKey()) {
+			log.Warnf("The controller's public key changed since the last run, from %s to %s", nbe.KeyFingerprint(savedKey), boiler.PublicKeyFingerprint())
+		}
+		publicKey, _ := nbe.MarshalPublicKey(boiler.PublicKey())
+		if err := stateDir.Save("controller", state.Controller{PublicKey: publicKey, Ranges: settingRanges}); err != nil {
+			log.Warnf("Failed to save the controller state: %v", err)
+		}
+	}
 
 	doneChan := make(chan error, 1)
-	log.Infof("Connected to boiler at %s (serial: %s)", uri.Host, boiler.Serial)
+	log.Infof("Connected to boiler at %s (serial: %s, key: %s)", uri.Host, boiler.Serial, boiler.PublicKeyFingerprint())
+
+	stopTracing := func(context.Context) error { return nil }
+	if tracingCfg := cfg.Tracing; tracingCfg.Enabled {
+		stop, err := tracing.Setup(tracing.Config{
+			Endpoint:    tracingCfg.Endpoint,
+			SampleRatio: tracingCfg.SampleRatio,
+			ServiceName: tracingCfg.ServiceName,
+			Serial:      boiler.Serial,
+		})
+		if err != nil {
+			log.Errorf("Failed to start tracing: %v", err)
+		} else {
+			stopTracing = stop
+		}
+	}
 
-	mqttUrl, err := url.Parse(cfg.MQTTURL)
+	mqttUrl, err := config.ParseURL(cfg.MQTTURL)
 	if err != nil {
-		log.Fatalf("Invalid MQTT URL: %s", cfg.MQTTURL)
+		log.Fatalf("Invalid MQTT URL: %v", err)
 		os.Exit(1)
 	}
+	if cfg.Zeroconf.DiscoverMQTT {
+		mqttUrl = discoverBroker(mqttUrl, cfg.Zeroconf.Timeout)
+	}
 
-	mqttPrefix := determineMQTTPrefix(mqttUrl, boiler.Serial)
-	mqttClient, err := mqtt.NewClient(mqttUrl, fmt.Sprintf("nbemqtt-%s", boiler.Serial), mqttPrefix)
+	deviceID := determineDeviceID(cfg.DeviceID, boiler.Serial)
+	mqttPrefix := determineMQTTPrefix(mqttUrl, deviceID)
+	mqttClient, err := mqtt.NewClient(mqttUrl, fmt.Sprintf("nbemqtt-%s", deviceID), mqttPrefix)
 
 	if err != nil {
 		log.Errorf("Failed to create MQTT client: %s", err)
@@ -114,68 +554,633 @@ func main() {
 	}
 
 	log.Infof("Connected to MQTT broker %s (publishing on \"%s\")", mqttUrl.Host, mqttPrefix)
+	if cfg.MQTT.BufferSize > 0 {
+		mqttClient.SetBufferSize(cfg.MQTT.BufferSize)
+	}
 
-	if err := mqttClient.Subscribe("set/+/+", 1, func(client *mqtt.Client, msg mqtt.Message) {
-		key := parseSetTopic(msg.Topic())
-		value := msg.Payload()
-
-		// Translate power switch commands
-		key, value = translatePowerCommand(key, value)
+	eventBus := bus.New()
+	sinks, err := sink.Start(eventBus, cfg.Sinks, sink.Deps{Broker: mqttClient, Serial: boiler.Serial})
+	if err != nil {
+		log.Fatalf("Failed to start the sinks: %v", err)
+	}
+	mqttClient.OnConnectionChange(func(connected bool) {
+		eventBus.Publish(bus.Event{Kind: bus.ConnectivityChanged, Key: "mqtt", Value: connected})
+	})
 
-		_, err := boiler.SetAsync(key, value, func(response *nbe.NBEResponse) {
-			log.Infof("Set %s to %s: %v", key, value, response)
-		})
+	if cfg.ShadowBoiler {
+		shadowBoiler, err := shadow.New(eventBus, cfg.Shadow.Rules)
 		if err != nil {
-			log.Errorf("Failed to set %s to %s: %v", key, value, err)
+			log.Fatalf("Failed to create the shadow boiler: %v", err)
+		}
+		shadowBoiler.Run()
+		boiler.SetWriteGuard(shadowBoiler.Check)
+		log.Infof("Shadow mode: writes are simulated against %d rules before they are sent", len(cfg.Shadow.Rules))
+	}
+
+	readiness := &health.Readiness{}
+	state := api.NewState(eventBus)
+	apiServer := api.New(state, cfg.API.Token, cfg.API.PublicToken, cfg.API.PublicValues)
+	pipelines := pipeline.New(cfg.Pipelines)
+	quietHours := quiethours.New(cfg.QuietHours)
+	writeLimit := writelimit.New(cfg.WriteLimit)
+	burstCfg := cfg.Polling.BurstMode
+	burst := monitor.NewBurst(burstCfg.Interval, burstCfg.Duration, burstCfg.MaxDuration)
+	var historyStore *history.Store
+	if historyCfg := cfg.History; historyCfg.Enabled {
+		historyStore = history.New(historyCfg.File, historyCfg.Retention, historyCfg.Resolution)
+		if err := historyStore.Run(eventBus, historyCfg.SaveInterval); err != nil {
+			log.Errorf("Failed to load the history: %v", err)
+			historyStore = nil
+		}
+	}
+	var auditLog *audit.Log
+	if auditCfg := cfg.Audit; auditCfg.Enabled {
+		auditLog = audit.New(auditCfg.File, auditCfg.MaxEntries, pipelines)
+		if err := auditLog.Run(boiler, eventBus); err != nil {
+			log.Errorf("Failed to load the audit log: %v", err)
+			auditLog = nil
+		}
+	}
+	activated, err := systemd.Listeners()
+	if err != nil {
+		log.Errorf("Failed to use the sockets passed by systemd: %v", err)
+	}
+	if cfg.Bind != "false" || len(activated) > 0 {
+		go func(listenAddress string) {
+			if len(activated) > 0 {
+				log.Infof("Starting metrics server on %s, passed by systemd", activated[0].Addr())
+			} else {
+				log.Infof("Starting metrics server on %s", listenAddress)
+			}
+			checks := []healthz.Provider{
+				health.NBE(boiler, healthMaxAge),
+				health.MQTT(mqttClient),
+				health.Poll(diagnostics.Track("operating_data"), healthMaxAge),
+			}
+			instance := healthz.Instance{
+				Logger:    log.New(),
+				Detailed:  true,
+				Providers: checks,
+			}
+			readyInstance := healthz.Instance{
+				Logger:    log.New(),
+				Detailed:  true,
+				Providers: append(checks, healthz.Provider{Name: "initial_data", Handle: readiness}),
+			}
+
+			http.Handle("/metrics", promhttp.Handler())
+			http.Handle("/healthz", instance.Healthz())
+			http.Handle("/readyz", readyInstance.Healthz())
+			http.Handle("/liveness", instance.Liveness())
+			if cfg.Features.REST {
+				apiServer.RegisterAPI(http.DefaultServeMux)
+				apiServer.RegisterBurst(http.DefaultServeMux, burst)
+				apiServer.RegisterRefresh(http.DefaultServeMux)
+				apiServer.RegisterBatch(http.DefaultServeMux, func(ctx context.Context, values map[string]string) ([]nbe.BatchWrite, error) {
+					return writeBatch(ctx, boiler, eventBus, pipelines, quietHours, writeLimit, values)
+				})
+			}
+			if cfg.Features.WebUI {
+				apiServer.RegisterWebUI(http.DefaultServeMux)
+			}
+			if historyStore != nil {
+				apiServer.RegisterGrafana(http.DefaultServeMux, historyStore)
+			}
+			if auditLog != nil {
+				apiServer.RegisterAudit(http.DefaultServeMux, auditLog)
+			}
+
+			var err error
+			if len(activated) > 0 {
+				for _, listener := range activated[1:] {
+					go func(listener net.Listener) {
+						log.Errorf("HTTP server error: %v", http.Serve(listener, nil))
+					}(listener)
+				}
+				err = http.Serve(activated[0], nil)
+			} else {
+				err = http.ListenAndServe(listenAddress, nil)
+			}
+			if err != nil {
+				log.Errorf("HTTP server error: %v", err)
+			}
+		}(cfg.Bind)
+	}
+
+	var advertised *zeroconf.Server
+	if cfg.Zeroconf.Enabled {
+		if cfg.Bind == "false" {
+			log.Warn("Zeroconf: not advertising, the HTTP server is disabled")
+		} else if advertised, err = advertiseAPI(cfg, deviceID, boiler.Serial); err != nil {
+			log.Errorf("Failed to advertise over mDNS: %v", err)
 		}
+	}
+
+	if cfg.ReadOnly {
+		log.Warn("Read-only mode: ignoring set commands and rejecting writes to the controller")
+	} else if err := mqttClient.Subscribe("set/+/+", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		handleSetCommand(boiler, eventBus, pipelines, quietHours, writeLimit, msg.Topic(), msg.Payload())
 	}); err != nil {
 		log.Errorf("Failed to subscribe to set topics: %v", err)
 	}
+	if !cfg.ReadOnly {
+		if err := mqttClient.Subscribe("set/batch", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+			handleBatchCommand(mqttClient, boiler, eventBus, pipelines, quietHours, writeLimit, msg.Topic(), msg.Payload())
+		}); err != nil {
+			log.Errorf("Failed to subscribe to the batch topic: %v", err)
+		}
+	}
+	if len(cfg.Templates) > 0 {
+		rules := make([]*remap.Rule, 0, len(cfg.Templates))
+		for i, t := range cfg.Templates {
+			rule, err := remap.Compile(t.Match, t.Topic, t.Payload)
+			if err != nil {
+				log.Fatalf("Invalid templates[%d]: %v", i, err)
+			}
+			rules = append(rules, rule)
+		}
+		remap.New(mqttClient, rules).Run(eventBus)
+	}
+	if compatCfg := cfg.Compat; compatCfg.Enabled {
+		if err := compat.New(mqttClient, compatCfg.Topic).Run(mqttClient, eventBus, cfg.ReadOnly, func(key string, payload []byte) {
+			handleSetCommand(boiler, eventBus, pipelines, quietHours, writeLimit, "set/"+strings.Replace(key, ".", "/", 1), payload)
+		}); err != nil {
+			log.Errorf("Failed to subscribe to the %s compatibility topics: %v", compatCfg.Layout, err)
+		}
+	}
 
-	go func() {
+	publishDevice := func() {
 		if err := mqttClient.PublishMany("device", map[string]interface{}{
 			"status":     "online",
 			"serial":     boiler.Serial,
-			"ip_address": boiler.IPAddress,
+			"device_id":  deviceID,
+			"ip_address": boiler.Address(),
 		}); err != nil {
 			log.Errorf("Failed to publish device status: %v", err)
 		}
-	}()
+		if err := mqttClient.PublishMany("bridge", map[string]interface{}{
+			"features":    cfg.Features.Enabled(),
+			"read_only":   cfg.ReadOnly,
+			"unsupported": monitor.Unsupported(),
+		}); err != nil {
+			log.Errorf("Failed to publish bridge features: %v", err)
+		}
+	}
+	go publishDevice()
+	boiler.OnAddressChange(func(ip string) {
+		if err := mqttClient.PublishMany("device", map[string]interface{}{"ip_address": ip}); err != nil {
+			log.Errorf("Failed to publish the controller's new address: %v", err)
+		}
+	})
+
+	debugCapture := capture.New(boiler, mqttClient, cfg.Debug.PcapDir, cfg.Debug.Duration, cfg.Debug.MaxDuration)
+	if err := debugCapture.Run(); err != nil {
+		log.Errorf("Failed to subscribe to debug topics: %v", err)
+	}
+
+	diagnostics.Track("nbe").SetQueueDepth(boiler.Pending)
+	diagnostics.StartPublisher(mqttClient, time.Minute)
+
+	monitor.SetMaxSilence(cfg.Polling.MaxSilence)
+	monitor.SetPollInterval(cfg.Polling.Interval)
+	advancedFields, _ := nbe.SelectAdvancedFields(cfg.Polling.AdvancedFields)
+	monitor.SetAdvancedFields(advancedFields)
+	monitor.SetPipelines(pipelines)
+	monitor.SetQuietHours(quietHours)
+	monitor.SetBurst(burst)
+	if err := burst.Run(mqttClient); err != nil {
+		log.Errorf("Failed to subscribe to the burst topics: %v", err)
+	}
+	if err := monitor.RunRefresh(mqttClient); err != nil {
+		log.Errorf("Failed to subscribe to the refresh topic: %v", err)
+	}
+
+	var profiles *profile.Profiles
+	if len(cfg.Profiles) > 0 {
+		profiles = profile.New(eventBus, cfg.Profiles, func(ctx context.Context, values map[string]string) ([]nbe.BatchWrite, error) {
+			return writeBatch(ctx, boiler, eventBus, pipelines, quietHours, writeLimit, values)
+		})
+		keepState(stateDir, "profile", profiles.Restore, profiles.Baseline)
+		boiler.OnWrite(profiles.Written)
+		if !cfg.ReadOnly {
+			if err := profiles.Run(mqttClient); err != nil {
+				log.Errorf("Failed to subscribe to the profile topic: %v", err)
+			}
+		}
+		profiles.Publish()
+	}
+
+	stateFile, err := nbe.LoadStates(cfg.States.File)
+	if err != nil {
+		log.Fatalf("Failed to load the power states: %v", err)
+	}
+	translations, err := nbe.LoadTranslations(cfg.States.Locale, cfg.States.Translations)
+	if err != nil {
+		log.Fatalf("Failed to load the text translations: %v", err)
+	}
+	version, model, err := firmware.Info(boiler)
+	if err != nil {
+		log.Warnf("Failed to read the firmware version, using the default power states: %v", err)
+	}
+	monitor.SetStates(stateFile.Table(version).Localize(translations))
+	diagnostics.StartInfoPublisher(mqttClient, time.Minute, func() diagnostics.Info {
+		controller := diagnostics.Controller{
+			Serial:    boiler.Serial,
+			DeviceID:  deviceID,
+			IPAddress: boiler.Address(),
+			Model:     model,
+			Firmware:  version,
+			Pending:   boiler.Pending(),
+			Dropped:   boiler.Dropped(),
+		}
+		if last := boiler.LastResponse(); !last.IsZero() {
+			controller.LastResponse = &last
+		}
+		info := diagnostics.NewInfo(started, time.Now(), controller)
+		info.ReadOnly = cfg.ReadOnly
+		info.Features = cfg.Features.Enabled()
+		return info
+	})
+
+	notify.New(mqttClient, quietHours.Active).Run(eventBus)
+	if quietHours != nil {
+		quietHours.Run(mqttClient)
+	}
+
+	var bridge *homekit.Bridge
+	if cfg.Features.HomeKit {
+		bridge, err = homekit.New(cfg.HomeKit, boiler.Serial, version, boiler.SettingSchema, pipelines, cfg.ReadOnly, func(key string, value []byte) {
+			handleRawSetCommand(boiler, eventBus, pipelines, quietHours, writeLimit, "set/"+strings.Replace(key, ".", "/", 1), value)
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up the HomeKit bridge: %v", err)
+		}
+		bridge.Run(eventBus)
+	}
 
 	// Start settings monitors for each category and collect ready channels
-	var settingsReady []chan bool
-	for _, category := range nbe.Settings {
-		ready := monitor.StartSettingsMonitor(boiler, mqttClient, category)
-		settingsReady = append(settingsReady, ready)
+	categories := nbe.Settings
+	if cfg.Features.Zones {
+		categories = append(append([]string(nil), categories...), nbe.CircuitSettings...)
 	}
+	if cfg.Features.AuxHeater {
+		categories = append(append([]string(nil), categories...), nbe.AuxHeaterSettings...)
+	}
+	settingsReady := monitor.StartSettingsMonitors(boiler, eventBus, categories, cfg.Polling.SettingsWorkers)
 
 	// Start operating data monitor
-	operatingReady := monitor.StartOperatingDataMonitor(boiler, mqttClient)
+	operatingReady := monitor.StartOperatingDataMonitor(boiler, eventBus)
 
 	// Start advanced data monitor (doesn't return ready channel yet)
-	monitor.StartAdvancedDataMonitor(boiler, mqttClient)
+	monitor.StartAdvancedDataMonitor(boiler, eventBus)
+
+	// Combine all ready signals
+	allReady := make(chan bool, 1)
+	go func() {
+		// Wait for all settings categories
+		for _, ready := range settingsReady {
+			<-ready
+		}
+		// Wait for operating data
+		<-operatingReady
+		// Signal all ready
+		readiness.MarkReady()
+		systemd.Ready(fmt.Sprintf("Publishing boiler %s", boiler.Serial))
+		allReady <- true
+	}()
+
+	firmware.Start(boiler, mqttClient, cfg.Firmware.CheckURL, cfg.Firmware.Interval)
+
+	if clockCfg := cfg.Clock; clockCfg.Enabled {
+		if err := clock.New(boiler, clockCfg.Registers(), clockCfg.MaxDrift).Run(mqttClient, clockCfg.Interval); err != nil {
+			log.Errorf("Failed to start the clock sync: %v", err)
+		}
+	}
+
+	if len(cfg.Mappings) > 0 {
+		mapping.Start(boiler, mqttClient, cfg.Mappings, func(topic, key string, value []byte) {
+			handleMappedCommand(boiler, eventBus, quietHours, writeLimit, topic, key, value)
+		})
+	}
+
+	if cfg.Features.Consumption {
+		monitor.StartConsumptionMonitor(boiler, eventBus, cfg.Consumption.CalorificValue)
+	}
+
+	// Publish whether each polled source answers, so its entities turn
+	// unavailable on their own
+	var sources []monitor.Source
+	var sourceNames []string
+	for _, source := range monitor.Sources() {
+		if source.Name != "consumption" || cfg.Features.Consumption {
+			sources = append(sources, source)
+			sourceNames = append(sourceNames, source.Name)
+		}
+	}
+	monitor.StartSourceAvailability(eventBus, sources)
+
+	if cfg.Efficiency.Enabled {
+		calorificValue := cfg.Efficiency.CalorificValue
+		if calorificValue == 0 {
+			calorificValue = cfg.Consumption.CalorificValue
+		}
+		tracker := efficiency.New(eventBus, pipelines, calorificValue)
+		keepState(stateDir, "efficiency", tracker.Restore, tracker.Baseline)
+		tracker.Run()
+	}
+
+	if degreeDaysCfg := cfg.DegreeDays; degreeDaysCfg.Enabled {
+		calorificValue := cfg.Efficiency.CalorificValue
+		if calorificValue == 0 {
+			calorificValue = cfg.Consumption.CalorificValue
+		}
+		tracker := degreedays.New(eventBus, pipelines, degreeDaysCfg.BaseTemp, calorificValue, degreeDaysCfg.Source == "controller")
+		keepState(stateDir, "degree_days", tracker.Restore, tracker.Baseline)
+		tracker.Run()
+		switch degreeDaysCfg.Source {
+		case "mqtt":
+			if err := tracker.FollowMQTT(mqttClient, degreeDaysCfg.Topic); err != nil {
+				log.Errorf("Failed to subscribe to the outdoor temperature: %v", err)
+			}
+		case "openweather":
+			tracker.FollowOpenWeather(degreeDaysCfg.APIKey, degreeDaysCfg.Latitude, degreeDaysCfg.Longitude, degreeDaysCfg.Interval)
+		}
+	}
+
+	if cfg.Derive.Enabled {
+		deriver := derive.New(eventBus, pipelines, cfg.Derive.Window)
+		keepState(stateDir, "derive", deriver.Restore, deriver.Baseline)
+		deriver.Run()
+	}
+	if hydronicCfg := cfg.Hydronic; hydronicCfg.Enabled {
+		hydronic.New(eventBus, pipelines, hydronicCfg.Supply, hydronicCfg.Return, hydronicCfg.FlowRate).Run()
+	}
+	if combustionCfg := cfg.Combustion; combustionCfg.Enabled {
+		combustion.New(eventBus, pipelines, combustionCfg.Window, combustionCfg.MinPower, combustion.Thresholds{
+			MaxExcessAir:  combustionCfg.MaxExcessAir,
+			MaxSmokeRatio: combustionCfg.MaxSmokeRatio,
+		}).Run()
+	}
+	if cfg.Features.AuxHeater {
+		auxheater.New(eventBus).Run()
+	}
+	if stateDir != nil {
+		stateDir.Run(time.Minute)
+	}
+
+	if cfg.Scheduler.DHWBoost.Enabled {
+		boost := scheduler.NewBoost(boiler, mqttClient, "dhw_boost", "hot_water.temp", cfg.Scheduler.DHWBoost.Delta, cfg.Scheduler.DHWBoost.Duration)
+		if err := boost.Run(); err != nil {
+			log.Errorf("Failed to start DHW boost: %v", err)
+		}
+	}
+
+	if setbackCfg := cfg.Scheduler.NightSetback; setbackCfg.Enabled {
+		setback := scheduler.NewNightSetback(boiler, mqttClient, "night_setback", "boiler.temp", setbackCfg.Delta, scheduler.Window{
+			Start:     setbackCfg.Start,
+			End:       setbackCfg.End,
+			Latitude:  setbackCfg.Latitude,
+			Longitude: setbackCfg.Longitude,
+		})
+		if err := setback.Run(); err != nil {
+			log.Errorf("Failed to start night setback: %v", err)
+		}
+	}
+
+	if preheatCfg := cfg.Scheduler.Preheat; preheatCfg.Enabled {
+		rules := make([]scheduler.PreheatRule, len(preheatCfg.Rules))
+		for i, rule := range preheatCfg.Rules {
+			rules[i] = scheduler.PreheatRule{
+				Below:  rule.Below,
+				Within: rule.Within,
+				Delta:  rule.Delta,
+				Start:  rule.Start,
+			}
+		}
+		preheat := scheduler.NewPreheat(boiler, mqttClient, "preheat", preheatCfg.Key, rules)
+		if err := preheat.Run(); err != nil {
+			log.Errorf("Failed to start forecast preheat: %v", err)
+		}
+		switch preheatCfg.Source {
+		case "mqtt":
+			if err := preheat.FollowMQTT(mqttClient, preheatCfg.Topic); err != nil {
+				log.Errorf("Failed to subscribe to the forecast: %v", err)
+			}
+		case "openmeteo":
+			preheat.FollowOpenMeteo(preheatCfg.Latitude, preheatCfg.Longitude, preheatCfg.Interval)
+		}
+	}
+
+	if weeklyCfg := cfg.Scheduler.Weekly; weeklyCfg.Enabled {
+		entries := make([]scheduler.Entry, len(weeklyCfg.Entries))
+		for i, entry := range weeklyCfg.Entries {
+			entries[i] = scheduler.Entry{
+				Days:   entry.Days,
+				At:     entry.At,
+				Action: entry.Action,
+				Key:    entry.Key,
+				Value:  entry.Value,
+			}
+		}
+		weekly, err := scheduler.NewWeekly(boiler, mqttClient, "weekly", entries)
+		if err == nil {
+			err = weekly.Run()
+		}
+		if err != nil {
+			log.Errorf("Failed to start weekly schedule: %v", err)
+		}
+	}
+
+	if driftCfg := cfg.Drift; driftCfg.Enabled {
+		detector := drift.New(boiler, mqttClient, driftCfg.BaselineFile, driftCfg.Interval, driftCfg.Ignore)
+		if err := detector.Run(); err != nil {
+			log.Errorf("Failed to start settings drift detection: %v", err)
+		}
+	}
+
+	if !cfg.ReadOnly {
+		if err := calibration.New(boiler, mqttClient).Run(); err != nil {
+			log.Errorf("Failed to subscribe to the calibration topics: %v", err)
+		}
+	}
+
+	if availabilityCfg := cfg.Availability; availabilityCfg.Enabled {
+		tracker := availability.New(boiler, eventBus, availabilityCfg.HistoryFile, availabilityCfg.Interval, availabilityCfg.MaxAge)
+		if err := tracker.Run(); err != nil {
+			log.Errorf("Failed to start availability tracking: %v", err)
+		}
+	}
+	if watchdogCfg := cfg.Watchdog; watchdogCfg.Enabled {
+		eventBus.Subscribe(func(event bus.Event) {
+			if event.Key == watchdog.Key {
+				online, _ := event.Value.(bool)
+				mqttClient.SetDeviceOnline(online)
+			}
+		}, bus.ConnectivityChanged)
+		watchdog.New(boiler, eventBus, watchdogCfg.Failures, watchdogCfg.Attempts, watchdogCfg.Interval).Run()
+	}
 
+	var ha *discovery
 	if cfg.HADiscovery {
-		go func() {
-			// Combine all ready signals
-			allReady := make(chan bool, 1)
-			go func() {
-				// Wait for all settings categories
-				for _, ready := range settingsReady {
-					<-ready
-				}
-				// Wait for operating data
-				<-operatingReady
-				// Signal all ready
-				allReady <- true
-			}()
+		entities := append(homeassistant.AllEntities(), homeassistant.OutputEntities()...)
+		if cfg.Features.Consumption {
+			entities = append(entities, homeassistant.ConsumptionEntities()...)
+		}
+		if cfg.Efficiency.Enabled {
+			entities = append(entities, homeassistant.EfficiencyEntities()...)
+		}
+		if cfg.DegreeDays.Enabled {
+			entities = append(entities, homeassistant.DegreeDayEntities()...)
+		}
+		if cfg.Derive.Enabled {
+			entities = append(entities, homeassistant.DeriveEntities()...)
+		}
+		if cfg.Combustion.Enabled {
+			entities = append(entities, homeassistant.CombustionEntities()...)
+		}
+		if cfg.Hydronic.Enabled {
+			entities = append(entities, homeassistant.HydronicEntities(cfg.Hydronic.FlowRate > 0)...)
+		}
+		if cfg.Features.Zones {
+			entities = append(entities, homeassistant.CircuitEntities()...)
+		}
+		if cfg.Features.AuxHeater {
+			entities = append(entities, homeassistant.AuxHeaterEntities()...)
+		}
+		entities = append(entities, homeassistant.DHWClimateEntities(cfg.Scheduler.DHWBoost.Enabled)...)
+		if cfg.Scheduler.DHWBoost.Enabled {
+			entities = append(entities, homeassistant.DHWBoostEntities()...)
+		}
+		if cfg.Scheduler.NightSetback.Enabled {
+			entities = append(entities, homeassistant.NightSetbackEntities()...)
+		}
+		if cfg.Scheduler.Preheat.Enabled {
+			entities = append(entities, homeassistant.PreheatEntities()...)
+		}
+		if cfg.Scheduler.Weekly.Enabled {
+			entities = append(entities, homeassistant.WeeklyScheduleEntities()...)
+		}
+		if cfg.QuietHours.Enabled {
+			entities = append(entities, homeassistant.QuietHoursEntities()...)
+		}
+		entities = append(entities, homeassistant.BurstEntities()...)
+		if profiles != nil {
+			entities = append(entities, homeassistant.ProfileEntities(profiles.Names())...)
+		}
+		if cfg.Drift.Enabled {
+			entities = append(entities, homeassistant.DriftEntities()...)
+		}
+		if cfg.Clock.Enabled {
+			entities = append(entities, homeassistant.ClockEntities()...)
+		}
+		if cfg.Availability.Enabled {
+			entities = append(entities, homeassistant.AvailabilityEntities()...)
+		}
+		if !cfg.ReadOnly {
+			entities = append(entities, homeassistant.CalibrationEntities()...)
+			entities = append(entities, homeassistant.MaintenanceEntities(cfg.Maintenance.Destructive)...)
+		}
+		entities = append(entities, homeassistant.FieldEntities(entities)...)
+		entities = homeassistant.WithSettingRanges(entities, settingRanges)
+		entities = homeassistant.WithPipelines(entities, pipelines)
+		homeassistant.SetOverrides(cfg.HomeAssistant.Overrides)
+		homeassistant.SetSources(sourceNames)
+		ha = &discovery{
+			mqttClient: mqttClient,
+			deviceID:   deviceID,
+			serial:     boiler.Serial,
+			prefix:     mqttPrefix,
+			readOnly:   cfg.ReadOnly,
+			candidates: entities,
+		}
+		entities, excluded := homeassistant.FilterEntities(entities, cfg.HomeAssistant.Include, cfg.HomeAssistant.Exclude)
+		var writable []homeassistant.EntityConfig
+		if cfg.ReadOnly {
+			entities, writable = homeassistant.ReadOnlyEntities(entities)
+		}
+		ha.announced = entities
 
-			homeassistant.PublishDiscovery(mqttClient, boiler.Serial, mqttPrefix, allReady)
+		go func() {
+			homeassistant.RemoveEntities(mqttClient, deviceID, writable)
+			homeassistant.PublishDiscovery(mqttClient, deviceID, boiler.Serial, mqttPrefix, entities, allReady)
+			homeassistant.RemoveEntities(mqttClient, deviceID, excluded)
 			time.Sleep(2 * time.Minute)
 		}()
+
+		if statusTopic := cfg.HomeAssistant.StatusTopic; statusTopic != "" {
+			if err := homeassistant.OnBirth(mqttClient, statusTopic, func() {
+				publishDevice()
+				homeassistant.PublishDiscovery(mqttClient, deviceID, boiler.Serial, mqttPrefix, ha.entities(), nil)
+				republishStates(mqttClient, state)
+			}); err != nil {
+				log.Errorf("Failed to subscribe to the Home Assistant status: %v", err)
+			}
+		}
+	}
+
+	reload := make(chan os.Signal, 1)
+	if cfg.ConfigFile != "" {
+		signal.Notify(reload, syscall.SIGHUP)
+	}
+	reloads := &reloader{cfg: cfg, boiler: boiler, ha: ha}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		log.Infof("Pinging the systemd watchdog while the controller answers, every %s", interval/2)
+		systemd.Watchdog(interval, health.NBE(boiler, healthMaxAge).Handle.Healthz)
+	}
+
+	var received os.Signal
+wait:
+	for {
+		select {
+		case <-reload:
+			log.Infof("Reloading %s", cfg.ConfigFile)
+			systemd.Reloading()
+			reloads.reload()
+			systemd.Ready(fmt.Sprintf("Publishing boiler %s", boiler.Serial))
+		case err = <-doneChan:
+			break wait
+		case received = <-signals:
+			log.Infof("Received %s, shutting down", received)
+			break wait
+		}
 	}
 
-	err = <-doneChan
+	if received != nil {
+		systemd.Stopping()
+		if cfg.HomeAssistant.CleanupOnShutdown && ha != nil {
+			announced := ha.entities()
+			log.Infof("Removing %d Home Assistant entities", len(announced))
+			homeassistant.RemoveEntities(mqttClient, deviceID, announced)
+		}
+		if advertised != nil {
+			advertised.Close()
+		}
+		if bridge != nil {
+			bridge.Close()
+		}
+		if historyStore != nil {
+			if err := historyStore.Save(); err != nil {
+				log.Errorf("Failed to save the history: %v", err)
+			}
+		}
+		if stateDir != nil {
+			if err := stateDir.SaveAll(); err != nil {
+				log.Errorf("Failed to save the state: %v", err)
+			}
+		}
+		sink.Close(sinks)
+		mqttClient.Close()
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := stopTracing(flushCtx); err != nil {
+		log.Warnf("Failed to flush traces: %v", err)
+	}
+	cancel()
 
 	if err != nil {
 		log.Fatal(err)
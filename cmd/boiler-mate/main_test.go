@@ -18,10 +18,44 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/url"
 	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	"github.com/mlipscombe/boiler-mate/quiethours"
+	"github.com/mlipscombe/boiler-mate/writelimit"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+// newMockNBE starts a mock boiler and connects to it without a rate limit
+func newMockNBE(tb testing.TB, serial string) (*nbe.MockBoiler, *nbe.NBE) {
+	mockBoiler, err := nbe.NewMockBoiler(serial)
+	if err != nil {
+		tb.Fatalf("Failed to create mock boiler: %v", err)
+	}
+	if err := mockBoiler.Start(); err != nil {
+		tb.Fatalf("Failed to start mock boiler: %v", err)
+	}
+	tb.Cleanup(mockBoiler.Stop)
+
+	boilerURI, _ := url.Parse(fmt.Sprintf("tcp://%s:1234@%s", serial, mockBoiler.GetAddr()))
+	boiler, err := nbe.NewNBE(boilerURI)
+	if err != nil {
+		tb.Fatalf("Failed to connect to mock boiler: %v", err)
+	}
+	boiler.SetRateLimit(0, 0)
+	return mockBoiler, boiler
+}
+
 func TestDetermineMQTTPrefix(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -76,6 +110,15 @@ func TestDetermineMQTTPrefix(t *testing.T) {
 	}
 }
 
+func TestDetermineDeviceID(t *testing.T) {
+	if id := determineDeviceID("", "ABC123"); id != "ABC123" {
+		t.Errorf("Expected serial fallback, got %q", id)
+	}
+	if id := determineDeviceID("home", "ABC123"); id != "home" {
+		t.Errorf("Expected alias, got %q", id)
+	}
+}
+
 func TestParseSetTopic(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -285,3 +328,308 @@ func TestPowerCommandTranslationFlow(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleSetCommandTracesWrite(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	_, boiler := newMockNBE(t, "TRACE123")
+	eventBus := bus.New()
+	results := make(chan bus.Event, 1)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	handleSetCommand(boiler, eventBus, nil, nil, nil, "nbe/TRACE123/set/boiler/temp", []byte("72"))
+	select {
+	case event := <-results:
+		if event.Err != nil {
+			t.Fatalf("Write failed: %v", event.Err)
+		}
+		if event.Context == nil {
+			t.Error("Expected the write result to carry the command's trace")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the write result")
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	command, request := spans["mqtt command"], spans["nbe set_setup"]
+	if command == nil || request == nil {
+		t.Fatalf("Expected command and request spans, got %v", spans)
+	}
+	if request.Parent().SpanID() != command.SpanContext().SpanID() {
+		t.Error("Expected the controller request to be a child of the MQTT command")
+	}
+}
+
+func TestHandleSetCommandInvertsPipeline(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "PIPE123")
+	eventBus := bus.New()
+	results := make(chan bus.Event, 1)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	offset := -2.0
+	pipelines := pipeline.New(map[string][]config.PipelineStep{
+		"boiler/temp": {{Offset: &offset}},
+	})
+	handleSetCommand(boiler, eventBus, pipelines, nil, nil, "nbe/PIPE123/set/boiler/temp", []byte("68"))
+	select {
+	case event := <-results:
+		if event.Err != nil {
+			t.Fatalf("Write failed: %v", event.Err)
+		}
+		if string(event.Value.([]byte)) != "68" {
+			t.Errorf("Expected the result to report the value as written, got %s", event.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the write result")
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 1 || writes[0] != "boiler.temp=70" {
+		t.Errorf("Expected the raw value to be written, got %v", writes)
+	}
+}
+
+func TestHandleRawSetCommandSkipsPipeline(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "RAW123")
+	eventBus := bus.New()
+	results := make(chan bus.Event, 1)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	offset := -2.0
+	pipelines := pipeline.New(map[string][]config.PipelineStep{
+		"boiler/temp": {{Offset: &offset}},
+	})
+	handleRawSetCommand(boiler, eventBus, pipelines, nil, nil, "set/boiler/temp", []byte("70"))
+	select {
+	case event := <-results:
+		if event.Err != nil {
+			t.Fatalf("Write failed: %v", event.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the write result")
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 1 || writes[0] != "boiler.temp=70" {
+		t.Errorf("Expected the value to be written as given, got %v", writes)
+	}
+}
+
+func TestHandleSetCommandQuietHours(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "QUIET123")
+	eventBus := bus.New()
+	results := make(chan bus.Event, 1)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	hours := quiethours.New(config.QuietHoursConfig{
+		Enabled:      true,
+		Start:        "00:00",
+		End:          "00:00",
+		PollInterval: time.Minute,
+		Block:        []string{"misc.start"},
+	})
+	handleSetCommand(boiler, eventBus, nil, hours, nil, "nbe/QUIET123/set/device/power_switch", []byte("ON"))
+	select {
+	case event := <-results:
+		if !errors.Is(event.Err, quiethours.ErrQuietHours) {
+			t.Errorf("Expected the write to be refused during quiet hours, got %v", event.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the write result")
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 0 {
+		t.Errorf("Expected nothing to be written, got %v", writes)
+	}
+}
+
+func TestHandleSetCommandWriteLimit(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "LIMIT123")
+	eventBus := bus.New()
+	results := make(chan bus.Event, 2)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	limits := writelimit.New(config.WriteLimitConfig{Enabled: true, MinInterval: time.Hour})
+	for _, payload := range []string{"70", "71"} {
+		handleSetCommand(boiler, eventBus, nil, nil, limits, "nbe/LIMIT123/set/boiler/temp", []byte(payload))
+		select {
+		case event := <-results:
+			if refused := errors.Is(event.Err, writelimit.ErrRateLimited); refused != (payload == "71") {
+				t.Errorf("Unexpected result of writing %s: %v", payload, event.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for the write result")
+		}
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 1 || writes[0] != "boiler.temp=70" {
+		t.Errorf("Expected only the first write, got %v", writes)
+	}
+}
+
+func TestHandleMappedCommand(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "MAP123")
+	if _, ok := boiler.SettingSchema["pump.speed"]; ok {
+		t.Fatal("Expected pump.speed to be unknown to the setting schema")
+	}
+	eventBus := bus.New()
+	results := make(chan bus.Event, 2)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	limits := writelimit.New(config.WriteLimitConfig{Enabled: true, MinInterval: time.Hour})
+	for _, value := range []string{"40", "45"} {
+		handleMappedCommand(boiler, eventBus, nil, limits, "nbe/MAP123/custom/pump_speed/set", "pump.speed", []byte(value))
+		select {
+		case event := <-results:
+			if refused := errors.Is(event.Err, writelimit.ErrRateLimited); refused != (value == "45") || (value == "40" && event.Err != nil) {
+				t.Errorf("Unexpected result of writing %s: %v", value, event.Err)
+			}
+			if event.Key != "pump.speed" {
+				t.Errorf("Expected the result for pump.speed, got %s", event.Key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for the write result")
+		}
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 1 || writes[0] != "pump.speed=40" {
+		t.Errorf("Expected only the first write, got %v", writes)
+	}
+}
+
+func TestHandleSetCommandReadsBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		stored  string
+		wantErr bool
+	}{
+		{"stored as written", "72", "72", false},
+		{"clamped", "80", "75", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockBoiler, boiler := newMockNBE(t, "READ123")
+			mockBoiler.SetLimit("boiler.temp", 0, 75)
+			eventBus := bus.New()
+			results := make(chan bus.Event, 1)
+			changes := make(chan bus.Event, 1)
+			eventBus.Subscribe(func(event bus.Event) {
+				results <- event
+			}, bus.WritePerformed)
+			eventBus.Subscribe(func(event bus.Event) {
+				changes <- event
+			}, bus.ValueChanged)
+
+			handleSetCommand(boiler, eventBus, nil, nil, nil, "nbe/READ123/set/boiler/temp", []byte(tt.payload))
+			select {
+			case event := <-results:
+				if (event.Err != nil) != tt.wantErr {
+					t.Errorf("Expected error %v, got %v", tt.wantErr, event.Err)
+				}
+				if stored := fmt.Sprintf("%v", event.Values["stored"]); stored != tt.stored {
+					t.Errorf("Expected stored value %s, got %s", tt.stored, stored)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timeout waiting for the write result")
+			}
+
+			select {
+			case event := <-changes:
+				if event.Category != "boiler" || fmt.Sprintf("%v", event.Values["temp"]) != tt.stored {
+					t.Errorf("Expected boiler/temp to change to %s, got %v", tt.stored, event)
+				}
+			default:
+				t.Error("Expected the stored value to be published before the result")
+			}
+		})
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "BATCH123")
+	mockBoiler.SetLimit("boiler.temp", 0, 75)
+	eventBus := bus.New()
+	var results, changes []bus.Event
+	eventBus.Subscribe(func(event bus.Event) {
+		results = append(results, event)
+	}, bus.WritePerformed)
+	eventBus.Subscribe(func(event bus.Event) {
+		changes = append(changes, event)
+	}, bus.ValueChanged)
+
+	offset := -2.0
+	pipelines := pipeline.New(map[string][]config.PipelineStep{
+		"boiler/temp": {{Offset: &offset}},
+	})
+	writes, err := writeBatch(context.Background(), boiler, eventBus, pipelines, nil, nil, map[string]string{"boiler.temp": "70", "boiler.diff_over": "20"})
+	if err != nil {
+		t.Fatalf("writeBatch() error = %v", err)
+	}
+	if len(writes) != 2 || writes[1].Value != "72" {
+		t.Errorf("Expected the raw value to be written, got %+v", writes)
+	}
+	if len(results) != 2 || results[1].Err != nil || string(results[1].Value.([]byte)) != "70" {
+		t.Errorf("Expected the results to report the values as sent, got %+v", results)
+	}
+	if len(changes) != 2 || fmt.Sprintf("%v", changes[1].Values["temp"]) != "70" {
+		t.Errorf("Expected the stored values to be published through the pipeline, got %+v", changes)
+	}
+
+	// the clamped temp rolls the batch back
+	results, changes = nil, nil
+	if _, err := writeBatch(context.Background(), boiler, eventBus, nil, nil, nil, map[string]string{"boiler.temp": "80", "boiler.diff_over": "25"}); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	for _, event := range results {
+		if event.Err == nil {
+			t.Errorf("Expected %s to report the failed batch", event.Key)
+		}
+	}
+	restored := map[string]string{"diff_over": "20", "temp": "72"}
+	for _, event := range changes {
+		for key, value := range event.Values {
+			if fmt.Sprintf("%v", value) != restored[key] {
+				t.Errorf("Expected boiler/%s to be published as restored to %s, got %v", key, restored[key], value)
+			}
+		}
+	}
+}
+
+func TestHandleSetCommandSkipsReadBackForActions(t *testing.T) {
+	mockBoiler, boiler := newMockNBE(t, "ACTION123")
+	eventBus := bus.New()
+	results := make(chan bus.Event, 1)
+	eventBus.Subscribe(func(event bus.Event) {
+		results <- event
+	}, bus.WritePerformed)
+
+	handleSetCommand(boiler, eventBus, nil, nil, nil, "nbe/ACTION123/set/device/power_switch", []byte("ON"))
+	select {
+	case event := <-results:
+		if event.Err != nil {
+			t.Fatalf("Write failed: %v", event.Err)
+		}
+		if event.Values != nil {
+			t.Errorf("Expected no stored value for an action, got %v", event.Values)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the write result")
+	}
+	if writes := mockBoiler.Writes(); len(writes) != 1 || writes[0] != "misc.start=1" {
+		t.Errorf("Expected the start command to be written, got %v", writes)
+	}
+}
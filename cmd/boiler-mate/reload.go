@@ -0,0 +1,173 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/homeassistant"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// discovery holds the Home Assistant entities announced, so that a change to
+// the entity filters only announces and removes the difference
+type discovery struct {
+	mqttClient *mqtt.Client
+	deviceID   string
+	serial     string
+	prefix     string
+	readOnly   bool
+	// candidates are all entities before the filters are applied
+	candidates []homeassistant.EntityConfig
+
+	mu        sync.Mutex
+	announced []homeassistant.EntityConfig
+}
+
+// entities returns the entities currently announced
+func (d *discovery) entities() []homeassistant.EntityConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]homeassistant.EntityConfig(nil), d.announced...)
+}
+
+// filter applies new entity filters and returns the entities to announce and
+// to remove, matched by their discovery topic
+func (d *discovery) filter(include, exclude []string) (added, removed []homeassistant.EntityConfig) {
+	kept, _ := homeassistant.FilterEntities(d.candidates, include, exclude)
+	if d.readOnly {
+		kept, _ = homeassistant.ReadOnlyEntities(kept)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	previous := make(map[string]bool, len(d.announced))
+	for _, entity := range d.announced {
+		previous[entity.GetDiscoveryTopic(d.deviceID)] = true
+	}
+	current := make(map[string]bool, len(kept))
+	for _, entity := range kept {
+		topic := entity.GetDiscoveryTopic(d.deviceID)
+		current[topic] = true
+		if !previous[topic] {
+			added = append(added, entity)
+		}
+	}
+	for _, entity := range d.announced {
+		if !current[entity.GetDiscoveryTopic(d.deviceID)] {
+			removed = append(removed, entity)
+		}
+	}
+	d.announced = kept
+	return added, removed
+}
+
+// refilter announces and removes the entities affected by new filters
+func (d *discovery) refilter(include, exclude []string) {
+	added, removed := d.filter(include, exclude)
+	homeassistant.RemoveEntities(d.mqttClient, d.deviceID, removed)
+	if len(added) > 0 {
+		homeassistant.PublishDiscovery(d.mqttClient, d.deviceID, d.serial, d.prefix, added, nil)
+	}
+	log.Infof("Home Assistant filters changed: %d entities added, %d removed", len(added), len(removed))
+}
+
+// republish announces the current entities again, e.g. after their
+// overrides changed
+func (d *discovery) republish() {
+	homeassistant.PublishDiscovery(d.mqttClient, d.deviceID, d.serial, d.prefix, d.entities(), nil)
+}
+
+// reloader applies the changes to the configuration file on SIGHUP without
+// reconnecting to the controller
+type reloader struct {
+	cfg    *config.Config
+	boiler *nbe.NBE
+	// ha is nil without Home Assistant discovery
+	ha *discovery
+}
+
+// reload reads the configuration file again and applies it, keeping the
+// running configuration if the file is invalid
+func (r *reloader) reload() {
+	next, err := r.cfg.Reload()
+	if err != nil {
+		log.Errorf("Not reloading the configuration: %v", err)
+		return
+	}
+	r.apply(next)
+}
+
+// apply makes the settings that can change at runtime take effect and warns
+// about the others
+func (r *reloader) apply(next *config.Config) {
+	for _, section := range r.cfg.RestartRequired(next) {
+		log.Warnf("Configuration %s changed, restart to apply it", section)
+	}
+
+	if next.LogLevel != r.cfg.LogLevel {
+		next.SetupLogging()
+		log.Infof("Log level set to %s", log.GetLevel())
+		r.cfg.LogLevel = next.LogLevel
+	}
+
+	polling, updated := r.cfg.Polling, next.Polling
+	if updated.Interval != polling.Interval {
+		monitor.SetPollInterval(updated.Interval)
+		log.Infof("Poll interval set to %s", updated.Interval)
+	}
+	if updated.RateLimit != polling.RateLimit || updated.Burst != polling.Burst {
+		r.boiler.SetRateLimit(updated.RateLimit, updated.Burst)
+		log.Infof("Rate limit set to %g requests per second, bursts of %d", updated.RateLimit, updated.Burst)
+	}
+	if !reflect.DeepEqual(updated.MaxSilence, polling.MaxSilence) {
+		monitor.SetMaxSilence(updated.MaxSilence)
+		log.Infof("Max silence set for %d keys", len(updated.MaxSilence))
+	}
+	if !reflect.DeepEqual(updated.CacheTTL, polling.CacheTTL) {
+		r.boiler.SetCacheTTLs(updated.CacheTTL)
+		log.Infof("Read cache TTLs set for %d categories", len(updated.CacheTTL))
+	}
+	r.cfg.Polling.Interval = updated.Interval
+	r.cfg.Polling.RateLimit = updated.RateLimit
+	r.cfg.Polling.Burst = updated.Burst
+	r.cfg.Polling.MaxSilence = updated.MaxSilence
+	r.cfg.Polling.CacheTTL = updated.CacheTTL
+
+	filters, updatedFilters := r.cfg.HomeAssistant, next.HomeAssistant
+	if !reflect.DeepEqual(filters.Include, updatedFilters.Include) || !reflect.DeepEqual(filters.Exclude, updatedFilters.Exclude) {
+		if r.ha != nil {
+			r.ha.refilter(updatedFilters.Include, updatedFilters.Exclude)
+		}
+		r.cfg.HomeAssistant.Include = updatedFilters.Include
+		r.cfg.HomeAssistant.Exclude = updatedFilters.Exclude
+	}
+	if !reflect.DeepEqual(filters.Overrides, updatedFilters.Overrides) {
+		homeassistant.SetOverrides(updatedFilters.Overrides)
+		if r.ha != nil {
+			r.ha.republish()
+		}
+		log.Infof("Home Assistant overrides set for %d entities", len(updatedFilters.Overrides))
+		r.cfg.HomeAssistant.Overrides = updatedFilters.Overrides
+	}
+}
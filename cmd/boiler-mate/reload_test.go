@@ -0,0 +1,119 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/homeassistant"
+	"github.com/mlipscombe/boiler-mate/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+func entityKeys(entities []homeassistant.EntityConfig) []string {
+	keys := make([]string, 0, len(entities))
+	for _, entity := range entities {
+		keys = append(keys, entity.Key)
+	}
+	return keys
+}
+
+func TestDiscoveryFilter(t *testing.T) {
+	candidates := []homeassistant.EntityConfig{
+		{Key: "boiler_temp", EntityType: homeassistant.Sensor},
+		{Key: "wifi_signal", EntityType: homeassistant.Sensor},
+		{Key: "boiler_setpoint", EntityType: homeassistant.Number},
+	}
+	ha := &discovery{deviceID: "TEST", candidates: candidates}
+	ha.announced, _ = homeassistant.FilterEntities(candidates, nil, []string{"wifi_*"})
+
+	added, removed := ha.filter(nil, []string{"boiler_setpoint"})
+	if keys := entityKeys(added); len(keys) != 1 || keys[0] != "wifi_signal" {
+		t.Errorf("Expected wifi_signal to be added, got %v", keys)
+	}
+	if keys := entityKeys(removed); len(keys) != 1 || keys[0] != "boiler_setpoint" {
+		t.Errorf("Expected boiler_setpoint to be removed, got %v", keys)
+	}
+	if keys := entityKeys(ha.entities()); len(keys) != 2 {
+		t.Errorf("Expected 2 announced entities, got %v", keys)
+	}
+
+	added, removed = ha.filter(nil, []string{"boiler_setpoint"})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Expected unchanged filters to change nothing, got +%v -%v", entityKeys(added), entityKeys(removed))
+	}
+}
+
+func TestDiscoveryFilterReadOnly(t *testing.T) {
+	candidates := []homeassistant.EntityConfig{
+		{Key: "boiler_setpoint", EntityType: homeassistant.Number},
+		{Key: "power_switch", EntityType: homeassistant.Button},
+	}
+	ha := &discovery{deviceID: "TEST", readOnly: true, candidates: candidates}
+
+	added, _ := ha.filter(nil, nil)
+	if len(added) != 1 || added[0].EntityType != homeassistant.Sensor {
+		t.Errorf("Expected the number to be announced as a sensor, got %+v", added)
+	}
+}
+
+func TestReloaderApply(t *testing.T) {
+	_, boiler := newMockNBE(t, "TEST12345")
+	level := log.GetLevel()
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		monitor.SetPollInterval(0)
+		monitor.SetMaxSilence(nil)
+		homeassistant.SetOverrides(nil)
+	})
+
+	cfg := &config.Config{LogLevel: "info"}
+	cfg.Polling.SettingsWorkers = 4
+	r := &reloader{cfg: cfg, boiler: boiler}
+
+	next := &config.Config{LogLevel: "debug"}
+	next.Polling.SettingsWorkers = 1
+	next.Polling.Interval = 10 * time.Second
+	next.Polling.MaxSilence = map[string]time.Duration{"operating_data/boiler_temp": time.Minute}
+	next.Polling.CacheTTL = map[string]time.Duration{"*": time.Second}
+	next.HomeAssistant.Exclude = []string{"wifi_*"}
+	next.HomeAssistant.Overrides = map[string]config.EntityOverride{"dhw_temp_sensor": {Name: "Hot Water Tank"}}
+	r.apply(next)
+
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("Expected debug logging, got %s", log.GetLevel())
+	}
+	if cfg.Polling.Interval != 10*time.Second || len(cfg.Polling.MaxSilence) != 1 || len(cfg.Polling.CacheTTL) != 1 {
+		t.Errorf("Expected the polling changes to be applied, got %+v", cfg.Polling)
+	}
+	if cfg.Polling.SettingsWorkers != 4 {
+		t.Errorf("Expected settings workers to wait for a restart, got %d", cfg.Polling.SettingsWorkers)
+	}
+	if len(cfg.HomeAssistant.Exclude) != 1 {
+		t.Errorf("Expected the entity filters to be applied, got %v", cfg.HomeAssistant.Exclude)
+	}
+	entity := homeassistant.EntityConfig{Key: "dhw_temp_sensor", Name: "DHW Temperature"}
+	if name := entity.Build("TEST", "nbe/TEST", nil)["name"]; name != "Hot Water Tank" {
+		t.Errorf("Expected the entity overrides to be applied, got %v", name)
+	}
+	if sections := cfg.RestartRequired(next); len(sections) != 1 || sections[0] != "polling" {
+		t.Errorf("Expected only polling to still need a restart, got %v", sections)
+	}
+}
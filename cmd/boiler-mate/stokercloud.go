@@ -0,0 +1,151 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/homeassistant"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/sink"
+	"github.com/mlipscombe/boiler-mate/stokercloud"
+	log "github.com/sirupsen/logrus"
+)
+
+// runStokerCloud publishes the boiler's StokerCloud data instead of reading the
+// controller, until the process is asked to stop. Nothing is written in this
+// mode.
+func runStokerCloud(cfg *config.Config) {
+	cloud := cfg.StokerCloud
+	serial, password := cloud.Serial, cloud.Password
+	if serial == "" || password == "" {
+		uri, err := config.ParseURL(cfg.ControllerURL)
+		if err != nil {
+			log.Fatalf("Invalid controller URL: %v", err)
+		}
+		if serial == "" {
+			serial = uri.User.Username()
+		}
+		if password == "" {
+			password, _ = uri.User.Password()
+		}
+	}
+	client := stokercloud.New(cloud.URL, serial, password, cloud.Fields)
+
+	mqttURL, err := config.ParseURL(cfg.MQTTURL)
+	if err != nil {
+		log.Fatalf("Invalid MQTT URL: %v", err)
+	}
+	if cfg.Zeroconf.DiscoverMQTT {
+		mqttURL = discoverBroker(mqttURL, cfg.Zeroconf.Timeout)
+	}
+	deviceID := determineDeviceID(cfg.DeviceID, serial)
+	mqttPrefix := determineMQTTPrefix(mqttURL, deviceID)
+	mqttClient, err := mqtt.NewClient(mqttURL, fmt.Sprintf("nbemqtt-%s", deviceID), mqttPrefix)
+	if err != nil {
+		log.Fatalf("Failed to create MQTT client: %s", err)
+	}
+	log.Infof("Connected to MQTT broker %s (publishing on \"%s\")", mqttURL.Host, mqttPrefix)
+	log.Infof("Reading boiler %s from StokerCloud at %s every %s, writes are disabled", serial, cloud.URL, cloud.Interval)
+
+	eventBus := bus.New()
+	sinks, err := sink.Start(eventBus, cfg.Sinks, sink.Deps{Broker: mqttClient, Serial: serial})
+	if err != nil {
+		log.Fatalf("Failed to start the sinks: %v", err)
+	}
+
+	stateFile, err := nbe.LoadStates(cfg.States.File)
+	if err != nil {
+		log.Fatalf("Failed to load the power states: %v", err)
+	}
+	translations, err := nbe.LoadTranslations(cfg.States.Locale, cfg.States.Translations)
+	if err != nil {
+		log.Fatalf("Failed to load the text translations: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client.Run(ctx, eventBus, stateFile.Table("").Localize(translations), cloud.Interval)
+
+	publishDevice := func() {
+		if err := mqttClient.PublishMany("device", map[string]interface{}{
+			"status":    "online",
+			"serial":    serial,
+			"device_id": deviceID,
+		}); err != nil {
+			log.Errorf("Failed to publish device status: %v", err)
+		}
+		if err := mqttClient.PublishMany("bridge", map[string]interface{}{
+			"features":  []string{"stokercloud"},
+			"read_only": true,
+		}); err != nil {
+			log.Errorf("Failed to publish bridge features: %v", err)
+		}
+	}
+	go publishDevice()
+
+	var announced []homeassistant.EntityConfig
+	if cfg.HADiscovery {
+		announced, _ = homeassistant.FilterEntities(stokerCloudEntities(client.Topics()), cfg.HomeAssistant.Include, cfg.HomeAssistant.Exclude)
+		go homeassistant.PublishDiscovery(mqttClient, deviceID, serial, mqttPrefix, announced, nil)
+		if statusTopic := cfg.HomeAssistant.StatusTopic; statusTopic != "" {
+			if err := homeassistant.OnBirth(mqttClient, statusTopic, func() {
+				publishDevice()
+				homeassistant.PublishDiscovery(mqttClient, deviceID, serial, mqttPrefix, announced, nil)
+			}); err != nil {
+				log.Errorf("Failed to subscribe to the Home Assistant status: %v", err)
+			}
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	log.Infof("Received %s, shutting down", received)
+	cancel()
+	if cfg.HomeAssistant.CleanupOnShutdown {
+		log.Infof("Removing %d Home Assistant entities", len(announced))
+		homeassistant.RemoveEntities(mqttClient, deviceID, announced)
+	}
+	sink.Close(sinks)
+	mqttClient.Close()
+}
+
+// stokerCloudEntities returns the read-only entities showing the given
+// topics, plus the device diagnostics
+func stokerCloudEntities(topics []string) []homeassistant.EntityConfig {
+	published := map[string]bool{"device/serial": true}
+	for _, topic := range topics {
+		published[topic] = true
+	}
+	entities, _ := homeassistant.ReadOnlyEntities(homeassistant.AllEntities())
+	entities = append(entities, homeassistant.FieldEntities(entities)...)
+
+	var kept []homeassistant.EntityConfig
+	for _, entity := range entities {
+		if published[entity.StateTopic] {
+			kept = append(kept, entity)
+		}
+	}
+	return kept
+}
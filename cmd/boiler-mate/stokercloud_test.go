@@ -0,0 +1,44 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/homeassistant"
+)
+
+func TestStokerCloudEntities(t *testing.T) {
+	entities := stokerCloudEntities([]string{"operating_data/boiler_temp", "operating_data/state_text", "operating_data/oxygen"})
+
+	topics := make(map[string]homeassistant.EntityConfig)
+	for _, entity := range entities {
+		topics[entity.StateTopic] = entity
+		if entity.EntityType != homeassistant.Sensor {
+			t.Errorf("Expected only sensors, got %s %s", entity.EntityType, entity.Key)
+		}
+	}
+	for _, topic := range []string{"device/serial", "operating_data/boiler_temp", "operating_data/state_text", "operating_data/oxygen"} {
+		if _, ok := topics[topic]; !ok {
+			t.Errorf("Expected an entity for %s", topic)
+		}
+	}
+	if _, ok := topics["device/ip_address"]; ok {
+		t.Error("Expected no entity for values StokerCloud doesn't report")
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package combustion rates how cleanly the burner runs: the excess air ratio
+// (lambda) from the flue gas oxygen, and the flue gas temperature per kW of
+// output, which creeps up as the heat exchanger fouls. Both are averaged over
+// the time the burner produces heat and compared with warning thresholds.
+package combustion
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+const (
+	// publishInterval is how often the figures are published
+	publishInterval = time.Minute
+	// airOxygen is the oxygen content of air in percent
+	airOxygen = 20.9
+	// minCoverage is how long the burner must have produced heat within the
+	// window before the figures are published
+	minCoverage = 5 * time.Minute
+)
+
+// Thresholds flag degraded combustion; zero disables a threshold
+type Thresholds struct {
+	// MaxExcessAir is the highest acceptable average excess air ratio
+	MaxExcessAir float64
+	// MaxSmokeRatio is the highest acceptable average flue gas temperature
+	// per kW of output, in °C/kW
+	MaxSmokeRatio float64
+}
+
+// segment is a stretch of burning with constant readings
+type segment struct {
+	end       time.Time
+	duration  time.Duration
+	excessAir float64
+	ratio     float64
+}
+
+// Tracker follows the oxygen, flue gas temperature and output on the bus and
+// publishes the averages below combustion/
+type Tracker struct {
+	Window     time.Duration
+	MinPower   float64
+	Thresholds Thresholds
+
+	eventBus  *bus.Bus
+	pipelines *pipeline.Pipelines
+	now       func() time.Time
+
+	mu       sync.Mutex
+	last     time.Time
+	oxygen   float64
+	smoke    float64
+	power    float64
+	segments []segment
+	degraded bool
+	reasons  []string
+}
+
+// New creates a tracker averaging over window, counting the burner as
+// producing heat from minPower kW, and undoing the conversions of pipelines
+func New(eventBus *bus.Bus, pipelines *pipeline.Pipelines, window time.Duration, minPower float64, thresholds Thresholds) *Tracker {
+	return &Tracker{
+		Window:     window,
+		MinPower:   minPower,
+		Thresholds: thresholds,
+		eventBus:   eventBus,
+		pipelines:  pipelines,
+		now:        time.Now,
+	}
+}
+
+// Run starts following the operating data
+func (t *Tracker) Run() {
+	t.eventBus.Subscribe(t.handle, bus.ValueChanged)
+
+	go func() {
+		for range time.Tick(publishInterval) {
+			t.Publish()
+		}
+	}()
+}
+
+func (t *Tracker) handle(event bus.Event) {
+	if event.Category != "operating_data" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+	if value, ok := nbe.ToFloat(event.Values["oxygen"]); ok {
+		t.oxygen = t.pipelines.Unconvert("operating_data/oxygen", value)
+	}
+	if value, ok := nbe.ToFloat(event.Values["smoke_temp"]); ok {
+		t.smoke = t.pipelines.Unconvert("operating_data/smoke_temp", value)
+	}
+	if value, ok := nbe.ToFloat(event.Values["power_kw"]); ok {
+		t.power = t.pipelines.Unconvert("operating_data/power_kw", value)
+	}
+}
+
+// advance closes the stretch since the last reading, if the burner was
+// producing heat, and drops the stretches that left the window
+func (t *Tracker) advance(now time.Time) {
+	if !t.last.IsZero() && now.After(t.last) && t.power >= t.MinPower && t.power > 0 && t.oxygen < airOxygen {
+		t.segments = append(t.segments, segment{
+			end:       now,
+			duration:  now.Sub(t.last),
+			excessAir: airOxygen / (airOxygen - t.oxygen),
+			ratio:     t.smoke / t.power,
+		})
+	}
+	if now.After(t.last) {
+		t.last = now
+	}
+
+	cutoff := now.Add(-t.Window)
+	kept := t.segments[:0]
+	for _, s := range t.segments {
+		if s.end.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	t.segments = kept
+}
+
+// averages returns the time-weighted excess air ratio and smoke ratio over
+// the window, false until the burner has produced heat for minCoverage
+func (t *Tracker) averages() (excessAir, ratio float64, coverage time.Duration, ok bool) {
+	for _, s := range t.segments {
+		weight := s.duration.Seconds()
+		excessAir += s.excessAir * weight
+		ratio += s.ratio * weight
+		coverage += s.duration
+	}
+	if coverage < minCoverage {
+		return 0, 0, coverage, false
+	}
+	return excessAir / coverage.Seconds(), ratio / coverage.Seconds(), coverage, true
+}
+
+// Values returns the averaged excess air ratio in "excess_air", the flue gas
+// temperature per kW in "smoke_ratio" and whether either crosses its
+// threshold in "degraded", with the reasons in "attributes". While the
+// burner has not produced heat long enough, only "degraded" is published,
+// keeping its last verdict.
+func (t *Tracker) Values() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+
+	excessAir, ratio, coverage, ok := t.averages()
+	if ok {
+		t.reasons = nil
+		if limit := t.Thresholds.MaxExcessAir; limit > 0 && excessAir > limit {
+			t.reasons = append(t.reasons, "excess_air")
+		}
+		if limit := t.Thresholds.MaxSmokeRatio; limit > 0 && ratio > limit {
+			t.reasons = append(t.reasons, "smoke_ratio")
+		}
+		t.degraded = len(t.reasons) > 0
+	}
+
+	reasons := append([]string{}, t.reasons...)
+	values := map[string]interface{}{
+		"degraded": onOff(t.degraded),
+		"attributes": map[string]interface{}{
+			"reasons":         reasons,
+			"burning_minutes": nbe.RoundedFloat(coverage.Minutes()),
+		},
+	}
+	if ok {
+		values["excess_air"] = nbe.RoundedFloat(excessAir)
+		values["smoke_ratio"] = nbe.RoundedFloat(ratio)
+	}
+	return values
+}
+
+// Publish publishes the current figures on the bus
+func (t *Tracker) Publish() {
+	t.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "combustion", Values: t.Values()})
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
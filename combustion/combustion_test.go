@@ -0,0 +1,92 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package combustion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestTracker(thresholds Thresholds) (*Tracker, *clock.Fake) {
+	c := clock.NewFake(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+	tracker := New(bus.New(), nil, 15*time.Minute, 1, thresholds)
+	tracker.now = c.Now
+	return tracker, c
+}
+
+func operating(oxygen, smoke, power float64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{
+		"oxygen":     nbe.RoundedFloat(oxygen),
+		"smoke_temp": nbe.RoundedFloat(smoke),
+		"power_kw":   nbe.RoundedFloat(power),
+	}}
+}
+
+func TestTrackerAverages(t *testing.T) {
+	tracker, fake := newTestTracker(Thresholds{MaxExcessAir: 2, MaxSmokeRatio: 12})
+
+	// 10.45% oxygen is a lambda of 2; 150°C at 15 kW is 10°C/kW
+	tracker.handle(operating(10.45, 150, 15))
+	fake.Advance(4 * time.Minute)
+	values := tracker.Values()
+	if _, ok := values["excess_air"]; ok {
+		t.Error("Expected no figures before 5 minutes of burning")
+	}
+	if values["degraded"] != "OFF" {
+		t.Errorf("Expected not degraded without figures, got %v", values["degraded"])
+	}
+
+	fake.Advance(6 * time.Minute)
+	values = tracker.Values()
+	if values["excess_air"] != nbe.RoundedFloat(2) || values["smoke_ratio"] != nbe.RoundedFloat(10) {
+		t.Errorf("Expected lambda 2 and 10°C/kW, got %v and %v", values["excess_air"], values["smoke_ratio"])
+	}
+	if values["degraded"] != "OFF" {
+		t.Errorf("Expected combustion at the thresholds not to be degraded, got %v", values["degraded"])
+	}
+}
+
+func TestTrackerFlagsDegradedCombustion(t *testing.T) {
+	tracker, fake := newTestTracker(Thresholds{MaxSmokeRatio: 12})
+
+	// 210°C at 15 kW is 14°C/kW
+	tracker.handle(operating(9, 210, 15))
+	fake.Advance(10 * time.Minute)
+	values := tracker.Values()
+	if values["degraded"] != "ON" {
+		t.Fatalf("Expected degraded combustion, got %v", values)
+	}
+	if reasons := values["attributes"].(map[string]interface{})["reasons"].([]string); len(reasons) != 1 || reasons[0] != "smoke_ratio" {
+		t.Errorf("Expected the smoke ratio as the reason, got %v", reasons)
+	}
+
+	// the burner stops: the verdict is kept until there is enough burning again
+	tracker.handle(operating(20.9, 60, 0))
+	fake.Advance(time.Hour)
+	values = tracker.Values()
+	if values["degraded"] != "ON" {
+		t.Errorf("Expected the verdict kept while the burner is off, got %v", values["degraded"])
+	}
+	if _, ok := values["smoke_ratio"]; ok {
+		t.Error("Expected no figures once the burning has left the window")
+	}
+}
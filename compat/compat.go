@@ -0,0 +1,131 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package compat mirrors the bridge's values onto the topics and payloads of
+// bridges built on pyduro, so automations and dashboards made for them keep
+// working after switching to boiler-mate.
+package compat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Bridge publishes the values on the bus below Topic in the pyduro layout:
+// each value as text on <topic>/<function>/<key>, and each function's values
+// as one JSON object of strings on <topic>/<function>, as pyduro returns
+// them. The functions are operating, advanced, consumption and
+// settings/<category>.
+type Bridge struct {
+	Topic string
+
+	mu      sync.Mutex
+	values  map[string]map[string]string
+	publish func(topic string, val interface{}) error
+}
+
+// New creates a bridge publishing with mqttClient below topic
+func New(mqttClient *mqtt.Client, topic string) *Bridge {
+	return &Bridge{
+		Topic:   topic,
+		values:  make(map[string]map[string]string),
+		publish: mqttClient.PublishRaw,
+	}
+}
+
+// Run publishes the value changes on the bus and, unless readOnly, passes
+// the commands received on <topic>/set/<category>.<key> to set
+func (b *Bridge) Run(mqttClient *mqtt.Client, eventBus *bus.Bus, readOnly bool, set func(key string, payload []byte)) error {
+	eventBus.SubscribeQueued("compat", 256, b.Handle, bus.ValueChanged)
+	if readOnly {
+		return nil
+	}
+	return mqttClient.SubscribeTopic(b.Topic+"/set/+", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		if key, ok := b.commandKey(msg.Topic()); ok {
+			set(key, msg.Payload())
+		}
+	})
+}
+
+// Handle publishes the changed values of an event in the pyduro layout
+func (b *Bridge) Handle(event bus.Event) {
+	function, ok := functionOf(event.Category)
+	if !ok || len(event.Values) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	values := b.values[function]
+	if values == nil {
+		values = make(map[string]string)
+		b.values[function] = values
+	}
+	for key, value := range event.Values {
+		values[key] = fmt.Sprintf("%v", value)
+	}
+	object := make(map[string]string, len(values))
+	for key, value := range values {
+		object[key] = value
+	}
+	b.mu.Unlock()
+
+	topic := b.Topic + "/" + function
+	for key := range event.Values {
+		if err := b.publish(topic+"/"+key, object[key]); err != nil {
+			log.Debugf("Failed to publish %s/%s: %v", topic, key, err)
+		}
+	}
+	if err := b.publish(topic, object); err != nil {
+		log.Debugf("Failed to publish %s: %v", topic, err)
+	}
+}
+
+// functionOf returns the pyduro function a bus category is published under
+func functionOf(category string) (string, bool) {
+	switch category {
+	case "operating_data":
+		return "operating", true
+	case "advanced_data":
+		return "advanced", true
+	case "consumption":
+		return "consumption", true
+	}
+	if nbe.IsSettingsCategory(category) {
+		return "settings/" + category, true
+	}
+	return "", false
+}
+
+// commandKey returns the "<category>.<key>" a command topic writes
+func (b *Bridge) commandKey(topic string) (string, bool) {
+	key, ok := strings.CutPrefix(topic, b.Topic+"/set/")
+	if !ok {
+		return "", false
+	}
+	category, name, ok := strings.Cut(key, ".")
+	if !ok || category == "" || name == "" || strings.Contains(name, "/") {
+		log.Warnf("Ignoring command on %s: expected %s/set/<category>.<key>", topic, b.Topic)
+		return "", false
+	}
+	return key, true
+}
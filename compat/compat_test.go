@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package compat
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestBridge() (*Bridge, map[string]interface{}) {
+	published := make(map[string]interface{})
+	b := &Bridge{
+		Topic:  "pyduro/1234",
+		values: make(map[string]map[string]string),
+		publish: func(topic string, val interface{}) error {
+			published[topic] = val
+			return nil
+		},
+	}
+	return b, published
+}
+
+func TestHandlePublishesPyduroLayout(t *testing.T) {
+	b, published := newTestBridge()
+
+	b.Handle(bus.Event{Kind: bus.ValueChanged, Category: "boiler", Values: map[string]interface{}{"temp": nbe.RoundedFloat(70), "diff_under": int64(5)}})
+	b.Handle(bus.Event{Kind: bus.ValueChanged, Category: "boiler", Values: map[string]interface{}{"temp": nbe.RoundedFloat(72.5)}})
+	b.Handle(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{"boiler_temp": nbe.RoundedFloat(61.2)}})
+	b.Handle(bus.Event{Kind: bus.ValueChanged, Category: "efficiency", Values: map[string]interface{}{"today": 0.9}})
+
+	if value := published["pyduro/1234/settings/boiler/temp"]; value != "72.5" {
+		t.Errorf("Expected the setting as text, got %v", value)
+	}
+	object, ok := published["pyduro/1234/settings/boiler"].(map[string]string)
+	if !ok || object["temp"] != "72.5" || object["diff_under"] != "5" {
+		t.Errorf("Expected every value of the category in the object, got %v", published["pyduro/1234/settings/boiler"])
+	}
+	if value := published["pyduro/1234/operating/boiler_temp"]; value != "61.2" {
+		t.Errorf("Expected operating data below operating, got %v", value)
+	}
+	for topic := range published {
+		if topic == "pyduro/1234/efficiency" || topic == "pyduro/1234/efficiency/today" {
+			t.Errorf("Expected values pyduro does not return to be left out, got %s", topic)
+		}
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	b, _ := newTestBridge()
+	tests := []struct {
+		topic string
+		key   string
+		ok    bool
+	}{
+		{"pyduro/1234/set/boiler.temp", "boiler.temp", true},
+		{"pyduro/1234/set/boiler", "", false},
+		{"pyduro/1234/set/.temp", "", false},
+		{"other/set/boiler.temp", "", false},
+	}
+	for _, tt := range tests {
+		key, ok := b.commandKey(tt.topic)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("commandKey(%q) = %q, %v, want %q, %v", tt.topic, key, ok, tt.key, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// secretsDir is where Docker and Compose mount secrets
+var secretsDir = "/run/secrets"
+
+// userinfo matches the credentials of a URL that could not be parsed
+var userinfo = regexp.MustCompile(`://([^:@/]*):[^@/]*@`)
+
+// lookupSecret returns the value of the environment variable key, or else the
+// contents of the file named by key_FILE, or else of the Docker secret named
+// after key in lower case, e.g. /run/secrets/boiler_mate_mqtt_password
+func lookupSecret(key string) (string, bool, error) {
+	if val, ok := os.LookupEnv(key); ok {
+		return val, true, nil
+	}
+	filename, ok := os.LookupEnv(key + "_FILE")
+	if !ok {
+		filename = filepath.Join(secretsDir, strings.ToLower(key))
+		if _, err := os.Stat(filename); err != nil {
+			return "", false, nil
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", key, err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+// lookupEnvOrSecret is lookupEnvOrString for values that may also be given
+// as a file or Docker secret
+func lookupEnvOrSecret(key string, defaultVal string) string {
+	val, ok, err := lookupSecret(key)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", key, err)
+	}
+	if !ok {
+		return defaultVal
+	}
+	return val
+}
+
+// ResolveCredentials replaces the credentials in the controller and MQTT URLs
+// with those given in the environment, as files or as Docker secrets:
+// BOILER_MATE_CONTROLLER_PASSWORD, BOILER_MATE_MQTT_USERNAME and either
+// BOILER_MATE_MQTT_PASSWORD or BOILER_MATE_MQTT_TOKEN, which is sent as the
+// password for brokers that authenticate with tokens
+func (cfg *Config) ResolveCredentials() error {
+	values := make(map[string]string)
+	for _, key := range []string{
+		"BOILER_MATE_CONTROLLER_PASSWORD",
+		"BOILER_MATE_MQTT_USERNAME",
+		"BOILER_MATE_MQTT_PASSWORD",
+		"BOILER_MATE_MQTT_TOKEN",
+	} {
+		val, ok, err := lookupSecret(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			values[key] = val
+		}
+	}
+
+	if password, ok := values["BOILER_MATE_CONTROLLER_PASSWORD"]; ok {
+		uri, err := withPassword(cfg.ControllerURL, password)
+		if err != nil {
+			return fmt.Errorf("controller URL: %w", err)
+		}
+		cfg.ControllerURL = uri
+	}
+
+	password, hasPassword := values["BOILER_MATE_MQTT_PASSWORD"]
+	if token, ok := values["BOILER_MATE_MQTT_TOKEN"]; ok {
+		if hasPassword {
+			return errors.New("set either BOILER_MATE_MQTT_PASSWORD or BOILER_MATE_MQTT_TOKEN, not both")
+		}
+		password, hasPassword = token, true
+	}
+	username, hasUsername := values["BOILER_MATE_MQTT_USERNAME"]
+	if !hasUsername && !hasPassword {
+		return nil
+	}
+	uri, err := url.Parse(cfg.MQTTURL)
+	if err != nil {
+		return fmt.Errorf("MQTT URL: %w", redactError(err))
+	}
+	if !hasUsername && uri.User != nil {
+		username = uri.User.Username()
+	}
+	if !hasPassword && uri.User != nil {
+		password, hasPassword = uri.User.Password()
+	}
+	if hasPassword {
+		uri.User = url.UserPassword(username, password)
+	} else {
+		uri.User = url.User(username)
+	}
+	cfg.MQTTURL = uri.String()
+	return nil
+}
+
+// withPassword returns rawURL with its password replaced, keeping the user
+func withPassword(rawURL, password string) (string, error) {
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return "", redactError(err)
+	}
+	username := ""
+	if uri.User != nil {
+		username = uri.User.Username()
+	}
+	uri.User = url.UserPassword(username, password)
+	return uri.String(), nil
+}
+
+// Redact returns rawURL with any password masked, for logging
+func Redact(rawURL string) string {
+	if uri, err := url.Parse(rawURL); err == nil {
+		return uri.Redacted()
+	}
+	return userinfo.ReplaceAllString(rawURL, "://$1:xxxxx@")
+}
+
+// ParseURL parses a controller or MQTT URL, masking any password in the error
+func ParseURL(rawURL string) (*url.URL, error) {
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	return uri, nil
+}
+
+// redactError masks the password in the URL quoted by a url.Parse error
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = Redact(urlErr.URL)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+// Features toggles the optional bridge subsystems
+type Features struct {
+	Solar       bool `yaml:"solar"`
+	Zones       bool `yaml:"zones"`
+	AuxHeater   bool `yaml:"aux_heater"`
+	Consumption bool `yaml:"consumption"`
+	REST        bool `yaml:"rest"`
+	WebUI       bool `yaml:"web-ui"`
+	HomeKit     bool `yaml:"homekit"`
+	Modbus      bool `yaml:"modbus"`
+	Rules       bool `yaml:"rules"`
+}
+
+// Enabled returns the state of every feature keyed by its config name, suitable
+// for publishing on the bridge/features topic
+func (f Features) Enabled() map[string]bool {
+	return map[string]bool{
+		"solar":       f.Solar,
+		"zones":       f.Zones,
+		"aux_heater":  f.AuxHeater,
+		"consumption": f.Consumption,
+		"rest":        f.REST,
+		"web-ui":      f.WebUI,
+		"homekit":     f.HomeKit,
+		"modbus":      f.Modbus,
+		"rules":       f.Rules,
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	yaml "go.yaml.in/yaml/v2"
+)
+
+// AddonOptionsFile is where the Home Assistant Supervisor hands an add-on its
+// options
+const AddonOptionsFile = "/data/options.json"
+
+// addonFlags maps the add-on options that stand in for command-line flags to
+// the flags they set
+var addonFlags = map[string]string{
+	"log_level":          "log-level",
+	"bind":               "bind",
+	"controller":         "controller",
+	"installer_password": "installer-password",
+	"mqtt":               "mqtt",
+	"homeassistant":      "homeassistant",
+	"config_file":        "config",
+	"device_id":          "device-id",
+	"shadow_boiler":      "shadow-boiler",
+	"read_only":          "read-only",
+	"state_dir":          "state-dir",
+	"pcap_dir":           "pcap-dir",
+}
+
+// AddonOptions are the options of the Home Assistant add-on: the settings
+// otherwise given as flags, under their names in addonFlags, and any
+// section of the configuration file
+type AddonOptions struct {
+	// Flags holds the values of the flag options, by flag name
+	Flags map[string]string
+	// Sections holds the rest of the options as a configuration file
+	Sections []byte
+}
+
+// ReadAddonOptions reads the add-on options from filename, returning nil
+// if the file doesn't exist
+func ReadAddonOptions(filename string) (*AddonOptions, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+
+	options := &AddonOptions{Flags: make(map[string]string)}
+	for option, name := range addonFlags {
+		value, ok := raw[option]
+		if !ok {
+			continue
+		}
+		delete(raw, option)
+		var flagValue interface{}
+		if err := json.Unmarshal(value, &flagValue); err != nil {
+			return nil, fmt.Errorf("parsing %s: %s: %w", filename, option, err)
+		}
+		switch v := flagValue.(type) {
+		case nil:
+		case string:
+			// the Supervisor passes optional options left empty as ""
+			if v != "" {
+				options.Flags[name] = v
+			}
+		case bool:
+			options.Flags[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("parsing %s: %s must be a string or a boolean", filename, option)
+		}
+	}
+	// JSON is YAML, so the sections load like the configuration file
+	if options.Sections, err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// applyFlags sets the flags given as options, unless they were given on the
+// command line
+func (options *AddonOptions) applyFlags(flags *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for option, name := range addonFlags {
+		value, ok := options.Flags[name]
+		if !ok || explicit[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", option, err)
+		}
+	}
+	return nil
+}
+
+// LoadSections reads the configuration file sections of the add-on options on
+// top of the configuration loaded so far
+func (cfg *Config) LoadSections(options *AddonOptions) error {
+	if err := yaml.UnmarshalStrict(options.Sections, cfg); err != nil {
+		return fmt.Errorf("parsing the add-on options: %w", err)
+	}
+	return cfg.validate()
+}
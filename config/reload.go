@@ -0,0 +1,90 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Reload reads the configuration file again, keeping the command-line and
+// environment settings and the add-on options of cfg
+func (cfg *Config) Reload() (*Config, error) {
+	if cfg.ConfigFile == "" {
+		return nil, fmt.Errorf("no configuration file")
+	}
+
+	next := newConfig()
+	next.LogLevel = cfg.logLevelFlag
+	next.logLevelFlag = cfg.logLevelFlag
+	next.Bind = cfg.Bind
+	next.ControllerURL = cfg.ControllerURL
+	next.InstallerPassword = cfg.InstallerPassword
+	next.MQTTURL = cfg.MQTTURL
+	next.HADiscovery = cfg.HADiscovery
+	next.ConfigFile = cfg.ConfigFile
+	next.DeviceID = cfg.DeviceID
+	next.ReadOnly = cfg.ReadOnly
+	next.ShadowBoiler = cfg.ShadowBoiler
+	if err := next.LoadFile(cfg.ConfigFile); err != nil {
+		return nil, err
+	}
+	if next.addonOptions = cfg.addonOptions; next.addonOptions != nil {
+		if err := next.LoadSections(next.addonOptions); err != nil {
+			return nil, err
+		}
+	}
+	if next.ReadOnly {
+		next.DisableWrites()
+	}
+	return next, nil
+}
+
+// RestartRequired returns the sections of the file that differ in next and
+// can only be applied by restarting. The log level, poll interval, rate limit,
+// max silence, cache TTLs and Home Assistant entity filters and overrides are
+// applied at runtime.
+func (cfg *Config) RestartRequired(next *Config) []string {
+	current, updated := *cfg, *next
+	for _, c := range []*Config{&current, &updated} {
+		c.LogLevel = ""
+		c.Polling.Interval = 0
+		c.Polling.RateLimit = 0
+		c.Polling.Burst = 0
+		c.Polling.MaxSilence = nil
+		c.Polling.CacheTTL = nil
+		c.HomeAssistant.Include = nil
+		c.HomeAssistant.Exclude = nil
+		c.HomeAssistant.Overrides = nil
+	}
+
+	var changed []string
+	a, b := reflect.ValueOf(current), reflect.ValueOf(updated)
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
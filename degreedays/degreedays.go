@@ -0,0 +1,375 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package degreedays relates the pellets burned each day to the heating
+// degree-days, the daily shortfall of the outdoor temperature below a base
+// temperature, so consumption can be compared across mild and cold days.
+package degreedays
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	log "github.com/sirupsen/logrus"
+)
+
+// publishInterval is how often the running figures are published
+const publishInterval = time.Minute
+
+// OpenWeatherURL is the OpenWeather current weather endpoint
+var OpenWeatherURL = "https://api.openweathermap.org/data/2.5/weather"
+
+// Day holds the figures of a finished day
+type Day struct {
+	// MeanTemp is the time-weighted mean outdoor temperature
+	MeanTemp float64
+	// DegreeDays is the shortfall below the base temperature integrated over
+	// the day, in °C·days
+	DegreeDays  float64
+	PelletsKg   float64
+	ProducedKWh float64
+}
+
+// Tracker integrates the outdoor temperature, the burner output and the
+// pellet consumption counter from the bus, and publishes today's
+// degree-days and the previous day's figures below degree_days/. The
+// outdoor temperature comes from the controller's sensor unless another
+// source calls SetOutdoor.
+type Tracker struct {
+	// BaseTemp is the outdoor temperature in °C above which no heating is
+	// needed
+	BaseTemp float64
+	// CalorificValue is the energy content of the pellets in kWh/kg
+	CalorificValue float64
+
+	eventBus  *bus.Bus
+	pipelines *pipeline.Pipelines
+	now       func() time.Time
+	// controller takes the outdoor temperature from operating data
+	controller bool
+
+	mu          sync.Mutex
+	tomorrow    time.Time
+	last        time.Time
+	outdoor     float64
+	haveOutdoor bool
+	power       float64
+
+	// today's integrals, in hours
+	tempHours   float64
+	degreeHours float64
+	hours       float64
+	produced    float64
+
+	counter     float64
+	start       float64
+	haveCounter bool
+
+	yesterday     Day
+	haveYesterday bool
+}
+
+// New creates a tracker for baseTemp in °C and pellets of calorificValue in
+// kWh/kg, undoing the conversions of pipelines. With controller set the
+// outdoor temperature is read from the controller's sensor.
+func New(eventBus *bus.Bus, pipelines *pipeline.Pipelines, baseTemp, calorificValue float64, controller bool) *Tracker {
+	return &Tracker{
+		BaseTemp:       baseTemp,
+		CalorificValue: calorificValue,
+		eventBus:       eventBus,
+		pipelines:      pipelines,
+		now:            time.Now,
+		controller:     controller,
+	}
+}
+
+// Run starts following the bus and publishing the figures
+func (t *Tracker) Run() {
+	t.eventBus.Subscribe(t.handle, bus.ValueChanged)
+
+	go func() {
+		for range time.Tick(publishInterval) {
+			t.Publish()
+		}
+	}()
+}
+
+func (t *Tracker) handle(event bus.Event) {
+	switch event.Category {
+	case "operating_data":
+		if value, ok := nbe.ToFloat(event.Values["power_kw"]); ok {
+			t.mu.Lock()
+			t.advance(t.now())
+			t.power = t.pipelines.Unconvert("operating_data/power_kw", value)
+			t.mu.Unlock()
+		}
+		if value, ok := nbe.ToFloat(event.Values["external_temp"]); ok && t.controller {
+			t.SetOutdoor(t.pipelines.Unconvert("operating_data/external_temp", value))
+		}
+	case "consumption":
+		value, ok := nbe.ToFloat(event.Values["pellets_kg"])
+		if !ok {
+			return
+		}
+		value = t.pipelines.Unconvert("consumption/pellets_kg", value)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.advance(t.now())
+		if !t.haveCounter || value < t.start {
+			// first reading of the day, or the controller's counter was reset
+			t.start = value
+		}
+		t.counter = value
+		t.haveCounter = true
+	}
+}
+
+// SetOutdoor records the current outdoor temperature in °C
+func (t *Tracker) SetOutdoor(temp float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+	t.outdoor = temp
+	t.haveOutdoor = true
+}
+
+// advance integrates up to now, closing the day at each midnight passed on
+// the way
+func (t *Tracker) advance(now time.Time) {
+	if t.last.IsZero() {
+		t.last = now
+		t.tomorrow = clock.NextMidnight(now)
+		return
+	}
+
+	for !now.Before(t.tomorrow) {
+		t.integrate(t.tomorrow)
+		if t.hours > 0 {
+			t.yesterday, t.haveYesterday = t.today(), true
+		} else {
+			t.haveYesterday = false
+		}
+		t.tempHours, t.degreeHours, t.hours, t.produced = 0, 0, 0, 0
+		t.start = t.counter
+		t.tomorrow = clock.NextMidnight(t.tomorrow)
+	}
+	t.integrate(now)
+}
+
+func (t *Tracker) integrate(until time.Time) {
+	if !until.After(t.last) {
+		return
+	}
+	hours := until.Sub(t.last).Hours()
+	t.produced += t.power * hours
+	if t.haveOutdoor {
+		t.tempHours += t.outdoor * hours
+		if t.outdoor < t.BaseTemp {
+			t.degreeHours += (t.BaseTemp - t.outdoor) * hours
+		}
+		t.hours += hours
+	}
+	t.last = until
+}
+
+// today returns the figures of the day so far
+func (t *Tracker) today() Day {
+	day := Day{
+		DegreeDays:  t.degreeHours / 24,
+		PelletsKg:   t.counter - t.start,
+		ProducedKWh: t.produced,
+	}
+	if t.hours > 0 {
+		day.MeanTemp = t.tempHours / t.hours
+	}
+	return day
+}
+
+// Values returns the figures published: today's degree-days so far in
+// "today", and the previous day's degree-days, pellets per degree-day and
+// estimated efficiency, with that day's inputs in "attributes"
+func (t *Tracker) Values() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+
+	values := map[string]interface{}{}
+	if t.hours > 0 {
+		values["today"] = nbe.RoundedFloat(t.degreeHours / 24)
+	}
+	if !t.haveYesterday {
+		return values
+	}
+	day := t.yesterday
+	values["yesterday"] = nbe.RoundedFloat(day.DegreeDays)
+	attributes := map[string]interface{}{
+		"mean_temp":    nbe.RoundedFloat(day.MeanTemp),
+		"pellets_kg":   nbe.RoundedFloat(day.PelletsKg),
+		"produced_kwh": nbe.RoundedFloat(day.ProducedKWh),
+	}
+	if day.DegreeDays > 0 {
+		values["kg_per_hdd"] = nbe.RoundedFloat(day.PelletsKg / day.DegreeDays)
+		attributes["kwh_per_hdd"] = nbe.RoundedFloat(day.ProducedKWh / day.DegreeDays)
+	}
+	if day.PelletsKg > 0 && t.CalorificValue > 0 {
+		values["efficiency"] = nbe.RoundedFloat(day.ProducedKWh / (day.PelletsKg * t.CalorificValue) * 100)
+	}
+	values["attributes"] = attributes
+	return values
+}
+
+// Baseline is the part of today's figures that would be lost on a restart
+type Baseline struct {
+	Day         string  `json:"day"`
+	HaveCounter bool    `json:"have_counter"`
+	Start       float64 `json:"start_kg"`
+	Counter     float64 `json:"counter_kg"`
+	Produced    float64 `json:"produced_kwh"`
+	TempHours   float64 `json:"temp_hours"`
+	DegreeHours float64 `json:"degree_hours"`
+	Hours       float64 `json:"hours"`
+	Yesterday   *Day    `json:"yesterday,omitempty"`
+}
+
+// Baseline returns today's figures so far, to be restored after a restart
+func (t *Tracker) Baseline() Baseline {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.advance(now)
+
+	baseline := Baseline{
+		Day:         now.Format("2006-01-02"),
+		HaveCounter: t.haveCounter,
+		Start:       t.start,
+		Counter:     t.counter,
+		Produced:    t.produced,
+		TempHours:   t.tempHours,
+		DegreeHours: t.degreeHours,
+		Hours:       t.hours,
+	}
+	if t.haveYesterday {
+		yesterday := t.yesterday
+		baseline.Yesterday = &yesterday
+	}
+	return baseline
+}
+
+// Restore continues from a baseline saved earlier today; a baseline from
+// another day is ignored. The time the bridge was down is not integrated.
+func (t *Tracker) Restore(baseline Baseline) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if baseline.Day != now.Format("2006-01-02") {
+		return
+	}
+	t.advance(now)
+
+	if baseline.HaveCounter {
+		t.start, t.counter, t.haveCounter = baseline.Start, baseline.Counter, true
+	}
+	t.produced += baseline.Produced
+	t.tempHours += baseline.TempHours
+	t.degreeHours += baseline.DegreeHours
+	t.hours += baseline.Hours
+	if baseline.Yesterday != nil {
+		t.yesterday, t.haveYesterday = *baseline.Yesterday, true
+	}
+}
+
+// Publish publishes the current figures on the bus
+func (t *Tracker) Publish() {
+	t.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "degree_days", Values: t.Values()})
+}
+
+// FollowMQTT takes the outdoor temperature from a full MQTT topic carrying a
+// number in °C
+func (t *Tracker) FollowMQTT(mqttClient *mqtt.Client, topic string) error {
+	return mqttClient.SubscribeTopic(topic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		temp, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+		if err != nil {
+			log.Warnf("Ignoring outdoor temperature %q on %s: not a number", msg.Payload(), topic)
+			return
+		}
+		t.SetOutdoor(temp)
+	})
+}
+
+// FollowOpenWeather fetches the outdoor temperature at a location from
+// OpenWeather every interval
+func (t *Tracker) FollowOpenWeather(apiKey string, latitude, longitude float64, interval time.Duration) {
+	query := url.Values{
+		"lat":   {strconv.FormatFloat(latitude, 'f', -1, 64)},
+		"lon":   {strconv.FormatFloat(longitude, 'f', -1, 64)},
+		"units": {"metric"},
+		"appid": {apiKey},
+	}
+	endpoint := OpenWeatherURL + "?" + query.Encode()
+	go func() {
+		for {
+			temp, err := fetchOpenWeather(endpoint)
+			if err != nil {
+				log.Warnf("Failed to fetch the outdoor temperature from OpenWeather: %v", err)
+			} else {
+				t.SetOutdoor(temp)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func fetchOpenWeather(endpoint string) (float64, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		// the URL holds the API key
+		if urlErr, ok := err.(*url.Error); ok {
+			return 0, urlErr.Err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("OpenWeather returned %s", resp.Status)
+	}
+	var doc struct {
+		Main struct {
+			Temp *float64 `json:"temp"`
+		} `json:"main"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&doc); err != nil {
+		return 0, fmt.Errorf("parsing OpenWeather response: %w", err)
+	}
+	if doc.Main.Temp == nil {
+		return 0, fmt.Errorf("no temperature in OpenWeather response")
+	}
+	return *doc.Main.Temp, nil
+}
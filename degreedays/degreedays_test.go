@@ -0,0 +1,129 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package degreedays
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestTracker(start time.Time) (*Tracker, *clock.Fake) {
+	c := clock.NewFake(start)
+	tracker := New(bus.New(), nil, 15, 5, true)
+	tracker.now = c.Now
+	return tracker, c
+}
+
+func operating(values map[string]interface{}) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: values}
+}
+
+func pellets(kg float64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "consumption", Values: map[string]interface{}{"pellets_kg": nbe.RoundedFloat(kg)}}
+}
+
+func TestTrackerDegreeDays(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+
+	tracker.handle(pellets(1000))
+	tracker.handle(operating(map[string]interface{}{"external_temp": nbe.RoundedFloat(5), "power_kw": nbe.RoundedFloat(10)}))
+	if _, ok := tracker.Values()["today"]; ok {
+		t.Error("Expected no degree-days before any time has passed")
+	}
+
+	// 12 hours at 5°C and 12 hours at 20°C against a base of 15°C: 5 degree-days
+	fake.Advance(12 * time.Hour)
+	tracker.handle(operating(map[string]interface{}{"external_temp": nbe.RoundedFloat(20), "power_kw": nbe.RoundedFloat(0)}))
+	if today := tracker.Values()["today"]; today != nbe.RoundedFloat(5) {
+		t.Errorf("Expected 5 degree-days by noon, got %v", today)
+	}
+	tracker.handle(pellets(1030))
+	fake.Advance(13 * time.Hour)
+
+	values := tracker.Values()
+	if values["yesterday"] != nbe.RoundedFloat(5) {
+		t.Errorf("Expected 5 degree-days yesterday, got %v", values["yesterday"])
+	}
+	if values["kg_per_hdd"] != nbe.RoundedFloat(6) {
+		t.Errorf("Expected 6 kg per degree-day, got %v", values["kg_per_hdd"])
+	}
+	// 120 kWh from 30 kg at 5 kWh/kg
+	if values["efficiency"] != nbe.RoundedFloat(80) {
+		t.Errorf("Expected an efficiency of 80, got %v", values["efficiency"])
+	}
+	attributes := values["attributes"].(map[string]interface{})
+	if attributes["mean_temp"] != nbe.RoundedFloat(12.5) || attributes["kwh_per_hdd"] != nbe.RoundedFloat(24) {
+		t.Errorf("Unexpected attributes %v", attributes)
+	}
+	if values["today"] != nbe.RoundedFloat(0) {
+		t.Errorf("Expected no degree-days today above the base temperature, got %v", values["today"])
+	}
+}
+
+func TestTrackerExternalSource(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+	tracker.controller = false
+
+	tracker.handle(operating(map[string]interface{}{"external_temp": nbe.RoundedFloat(-20)}))
+	tracker.SetOutdoor(3)
+	fake.Advance(24 * time.Hour)
+	if yesterday := tracker.Values()["yesterday"]; yesterday != nbe.RoundedFloat(12) {
+		t.Errorf("Expected the controller's sensor to be ignored, got %v degree-days", yesterday)
+	}
+}
+
+func TestTrackerRestore(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+	tracker.handle(operating(map[string]interface{}{"external_temp": nbe.RoundedFloat(5)}))
+	fake.Advance(12 * time.Hour)
+	baseline := tracker.Baseline()
+
+	// the bridge was down for an hour, which is not counted
+	restored, restoredFake := newTestTracker(fake.Now().Add(time.Hour))
+	restored.Restore(baseline)
+	restored.handle(operating(map[string]interface{}{"external_temp": nbe.RoundedFloat(5)}))
+	restoredFake.Advance(6 * time.Hour)
+	if today := restored.Values()["today"]; today != nbe.RoundedFloat(7.5) {
+		t.Errorf("Expected 7.5 degree-days over the restart, got %v", today)
+	}
+}
+
+func TestFetchOpenWeather(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("appid") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"main": {"temp": -3.5, "humidity": 80}}`))
+	}))
+	defer server.Close()
+
+	temp, err := fetchOpenWeather(server.URL + "?appid=key")
+	if err != nil || temp != -3.5 {
+		t.Errorf("fetchOpenWeather() = %v, %v, want -3.5", temp, err)
+	}
+	if _, err := fetchOpenWeather(server.URL + "?appid=wrong"); err == nil {
+		t.Error("Expected an error for a rejected API key")
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package derive turns the controller's raw counters into rates that are
+// easier to read: the pellet feed rate, the auger duty cycle and cycle rate,
+// and the number of ignitions per day.
+package derive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+// publishInterval is how often the derived values are published
+const publishInterval = time.Minute
+
+// minFillKg is the smallest rise of the hopper content counted as a refill
+const minFillKg = 5
+
+// maxFills is how many hopper refills are kept
+const maxFills = 20
+
+// Fill is a refill of the hopper, seen as a rise of its content
+type Fill struct {
+	Time time.Time `json:"time"`
+	Kg   float64   `json:"kg"`
+}
+
+// augerCapacityMinutes is the run time hopper.auger_capacity is measured
+// over: the grams the auger feeds in 6 minutes of continuous running
+const augerCapacityMinutes = 6
+
+// Deriver follows the counters on the bus and publishes the derived values
+// below derived/
+type Deriver struct {
+	// Window is the period the rates are averaged over
+	Window time.Duration
+
+	eventBus  *bus.Bus
+	pipelines *pipeline.Pipelines
+	now       func() time.Time
+
+	mu            sync.Mutex
+	pellets       counter
+	cycles        counter
+	augerCapacity float64
+
+	tomorrow      time.Time
+	ignitions     int64
+	yesterday     int64
+	haveYesterday bool
+
+	content     float64
+	haveContent bool
+	fills       []Fill
+}
+
+// New creates a deriver averaging the rates over window, undoing the
+// conversions of pipelines
+func New(eventBus *bus.Bus, pipelines *pipeline.Pipelines, window time.Duration) *Deriver {
+	return &Deriver{
+		Window:    window,
+		eventBus:  eventBus,
+		pipelines: pipelines,
+		now:       time.Now,
+	}
+}
+
+// Run starts following the counters and publishes the derived values every
+// minute
+func (d *Deriver) Run() {
+	d.eventBus.Subscribe(d.handle, bus.ValueChanged, bus.StateTransition)
+
+	go func() {
+		for range time.Tick(publishInterval) {
+			d.Publish()
+		}
+	}()
+}
+
+func (d *Deriver) handle(event bus.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.advance(now)
+
+	if event.Kind == bus.StateTransition {
+		if event.Key == "state" && isIgnition(event.Value) && !isIgnition(event.Previous) {
+			d.ignitions++
+		}
+		return
+	}
+
+	switch event.Category {
+	case "operating_data":
+		if content, ok := nbe.ToFloat(event.Values["content"]); ok {
+			d.hopper(now, d.pipelines.Unconvert("operating_data/content", content))
+		}
+	case "consumption":
+		if kg, ok := nbe.ToFloat(event.Values["pellets_kg"]); ok {
+			d.pellets.add(now, d.pipelines.Unconvert("consumption/pellets_kg", kg)*1000)
+		}
+	case "advanced_data":
+		if cycles, ok := nbe.ToFloat(event.Values["auger_cycles"]); ok {
+			d.cycles.add(now, d.pipelines.Unconvert("advanced_data/auger_cycles", cycles))
+		}
+	case "hopper":
+		if capacity, ok := nbe.ToFloat(event.Values["auger_capacity"]); ok {
+			d.augerCapacity = d.pipelines.Unconvert("hopper/auger_capacity", capacity)
+		}
+	}
+}
+
+// hopper records a refill when the hopper content rises by at least
+// minFillKg
+func (d *Deriver) hopper(now time.Time, content float64) {
+	if d.haveContent && content-d.content >= minFillKg {
+		d.fills = append(d.fills, Fill{Time: now, Kg: content - d.content})
+		if len(d.fills) > maxFills {
+			d.fills = d.fills[len(d.fills)-maxFills:]
+		}
+	}
+	d.content, d.haveContent = content, true
+}
+
+// advance starts a new day of ignitions at each midnight passed
+func (d *Deriver) advance(now time.Time) {
+	if d.tomorrow.IsZero() {
+		d.tomorrow = clock.NextMidnight(now)
+		return
+	}
+	for !now.Before(d.tomorrow) {
+		d.yesterday, d.haveYesterday = d.ignitions, true
+		d.ignitions = 0
+		d.tomorrow = clock.NextMidnight(d.tomorrow)
+	}
+}
+
+// Values returns the derived values that can be computed so far: the feed
+// rate in grams per minute, the auger duty cycle in percent, the auger cycles
+// per hour, today's ignitions and the last hopper refill, with the previous
+// day's ignitions and the recent refills in "attributes"
+func (d *Deriver) Values() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.advance(now)
+
+	attributes := map[string]interface{}{
+		"window_minutes": int64(d.Window / time.Minute),
+	}
+	if d.haveYesterday {
+		attributes["ignitions_yesterday"] = d.yesterday
+	}
+	values := map[string]interface{}{
+		"ignitions_today": d.ignitions,
+		"attributes":      attributes,
+	}
+	if feedRate, ok := d.pellets.perMinute(now, d.Window); ok {
+		values["feed_rate"] = nbe.RoundedFloat(feedRate)
+		if d.augerCapacity > 0 {
+			// the auger runs for the share of the time it would take to feed
+			// this much at its rated capacity
+			values["auger_duty_cycle"] = nbe.RoundedFloat(feedRate / (d.augerCapacity / augerCapacityMinutes) * 100)
+		}
+	}
+	if cycles, ok := d.cycles.perMinute(now, d.Window); ok {
+		values["auger_cycles_per_hour"] = nbe.RoundedFloat(cycles * 60)
+	}
+	if n := len(d.fills); n > 0 {
+		last := d.fills[n-1]
+		values["hopper_last_fill"] = last.Time.Format(time.RFC3339)
+		values["hopper_last_fill_kg"] = nbe.RoundedFloat(last.Kg)
+		attributes["hopper_fills"] = append([]Fill(nil), d.fills...)
+	}
+	return values
+}
+
+// Baseline is what the deriver keeps across restarts: today's ignitions and
+// the hopper refills
+type Baseline struct {
+	Day       string `json:"day"`
+	Ignitions int64  `json:"ignitions"`
+	Yesterday *int64 `json:"yesterday,omitempty"`
+	Fills     []Fill `json:"hopper_fills,omitempty"`
+}
+
+// Baseline returns the figures to restore after a restart
+func (d *Deriver) Baseline() Baseline {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.advance(now)
+
+	baseline := Baseline{
+		Day:       now.Format("2006-01-02"),
+		Ignitions: d.ignitions,
+		Fills:     append([]Fill(nil), d.fills...),
+	}
+	if d.haveYesterday {
+		yesterday := d.yesterday
+		baseline.Yesterday = &yesterday
+	}
+	return baseline
+}
+
+// Restore takes back the hopper refills of a saved baseline, and its
+// ignitions if it was saved earlier today
+func (d *Deriver) Restore(baseline Baseline) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.advance(now)
+
+	d.fills = append(baseline.Fills, d.fills...)
+	if len(d.fills) > maxFills {
+		d.fills = d.fills[len(d.fills)-maxFills:]
+	}
+	if baseline.Day != now.Format("2006-01-02") {
+		return
+	}
+	d.ignitions += baseline.Ignitions
+	if baseline.Yesterday != nil {
+		d.yesterday, d.haveYesterday = *baseline.Yesterday, true
+	}
+}
+
+// Publish publishes the derived values on the bus
+func (d *Deriver) Publish() {
+	d.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "derived", Values: d.Values()})
+}
+
+// counter keeps the readings of a monotonic counter needed to average its
+// rate over a window. Only changes are published on the bus, so the latest
+// reading holds until the next one.
+type counter struct {
+	readings []reading
+}
+
+type reading struct {
+	at    time.Time
+	value float64
+}
+
+// add records a reading; a value below the previous one means the
+// controller's counter was reset and starts over
+func (c *counter) add(now time.Time, value float64) {
+	if n := len(c.readings); n > 0 && value < c.readings[n-1].value {
+		c.readings = nil
+	}
+	c.readings = append(c.readings, reading{at: now, value: value})
+}
+
+// perMinute returns the average increase per minute over the window ending
+// now, once the counter has been followed for at least a minute. The last
+// reading before the window is kept as its starting value.
+func (c *counter) perMinute(now time.Time, window time.Duration) (float64, bool) {
+	start := now.Add(-window)
+	for len(c.readings) > 1 && !c.readings[1].at.After(start) {
+		c.readings = c.readings[1:]
+	}
+	if len(c.readings) == 0 {
+		return 0, false
+	}
+
+	first, last := c.readings[0], c.readings[len(c.readings)-1]
+	from := first.at
+	if from.Before(start) {
+		from = start
+	}
+	elapsed := now.Sub(from)
+	if elapsed < time.Minute {
+		return 0, false
+	}
+	return (last.value - first.value) / elapsed.Minutes(), true
+}
+
+// isIgnition reports whether a power state is one of the ignition phases
+func isIgnition(state interface{}) bool {
+	s, ok := state.(int64)
+	return ok && s >= 1 && s <= 4
+}
@@ -0,0 +1,164 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package derive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestDeriver(start time.Time) (*Deriver, *clock.Fake) {
+	c := clock.NewFake(start)
+	deriver := New(bus.New(), nil, 10*time.Minute)
+	deriver.now = c.Now
+	return deriver, c
+}
+
+func pellets(kg float64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "consumption", Values: map[string]interface{}{"pellets_kg": nbe.RoundedFloat(kg)}}
+}
+
+func cycles(n int64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "advanced_data", Values: map[string]interface{}{"auger_cycles": n}}
+}
+
+func state(previous, value int64) bus.Event {
+	return bus.Event{Kind: bus.StateTransition, Category: "operating_data", Key: "state", Previous: previous, Value: value}
+}
+
+func TestDeriverFeedRate(t *testing.T) {
+	deriver, fake := newTestDeriver(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	deriver.handle(pellets(100))
+	deriver.handle(cycles(1000))
+	if _, ok := deriver.Values()["feed_rate"]; ok {
+		t.Error("Expected no feed rate before a minute of readings")
+	}
+
+	// 200 g and 30 cycles in 5 minutes
+	fake.Advance(5 * time.Minute)
+	deriver.handle(pellets(100.2))
+	deriver.handle(cycles(1030))
+
+	values := deriver.Values()
+	if values["feed_rate"] != nbe.RoundedFloat(40) {
+		t.Errorf("Expected 40 g/min, got %v", values["feed_rate"])
+	}
+	if values["auger_cycles_per_hour"] != nbe.RoundedFloat(360) {
+		t.Errorf("Expected 360 cycles/h, got %v", values["auger_cycles_per_hour"])
+	}
+	if _, ok := values["auger_duty_cycle"]; ok {
+		t.Error("Expected no duty cycle without the auger capacity")
+	}
+
+	// 600 g per 6 minutes is 100 g/min at full duty
+	deriver.handle(bus.Event{Kind: bus.ValueChanged, Category: "hopper", Values: map[string]interface{}{"auger_capacity": nbe.RoundedFloat(600)}})
+	if got := deriver.Values()["auger_duty_cycle"]; got != nbe.RoundedFloat(40) {
+		t.Errorf("Expected a 40%% duty cycle, got %v", got)
+	}
+
+	// with no further consumption the rate falls as the window moves on
+	fake.Advance(10 * time.Minute)
+	if got := deriver.Values()["feed_rate"]; got != nbe.RoundedFloat(0) {
+		t.Errorf("Expected the feed rate to drop to 0, got %v", got)
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	start := time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC)
+	var c counter
+	c.add(start, 500)
+	c.add(start.Add(time.Minute), 10)
+	c.add(start.Add(3*time.Minute), 30)
+
+	rate, ok := c.perMinute(start.Add(3*time.Minute), 10*time.Minute)
+	if !ok || rate != 10 {
+		t.Errorf("Expected 10 per minute after the reset, got %v (%v)", rate, ok)
+	}
+}
+
+func TestDeriverCountsIgnitions(t *testing.T) {
+	deriver, fake := newTestDeriver(time.Date(2024, 1, 10, 22, 0, 0, 0, time.UTC))
+
+	deriver.handle(state(14, 1))
+	deriver.handle(state(1, 2))
+	deriver.handle(state(2, 5))
+	deriver.handle(state(5, 6))
+	deriver.handle(state(6, 3))
+	if got := deriver.Values()["ignitions_today"]; got != int64(2) {
+		t.Errorf("Expected 2 ignitions, got %v", got)
+	}
+
+	fake.Advance(3 * time.Hour)
+	values := deriver.Values()
+	if values["ignitions_today"] != int64(0) {
+		t.Errorf("Expected the count to reset at midnight, got %v", values["ignitions_today"])
+	}
+	if attributes := values["attributes"].(map[string]interface{}); attributes["ignitions_yesterday"] != int64(2) {
+		t.Errorf("Expected yesterday's ignitions in the attributes, got %v", attributes)
+	}
+}
+
+func content(kg float64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{"content": nbe.RoundedFloat(kg)}}
+}
+
+func TestDeriverRecordsHopperFills(t *testing.T) {
+	deriver, fake := newTestDeriver(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	deriver.handle(content(40))
+	fake.Advance(time.Hour)
+	deriver.handle(content(42))
+	if _, ok := deriver.Values()["hopper_last_fill"]; ok {
+		t.Error("Expected a small rise not to count as a refill")
+	}
+
+	fake.Advance(time.Hour)
+	deriver.handle(content(80))
+	values := deriver.Values()
+	if values["hopper_last_fill"] != "2024-01-10T10:00:00Z" || values["hopper_last_fill_kg"] != nbe.RoundedFloat(38) {
+		t.Errorf("Unexpected last fill %v of %v kg", values["hopper_last_fill"], values["hopper_last_fill_kg"])
+	}
+}
+
+func TestDeriverRestore(t *testing.T) {
+	deriver, fake := newTestDeriver(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+	deriver.handle(state(14, 1))
+	deriver.handle(content(10))
+	deriver.handle(content(60))
+	baseline := deriver.Baseline()
+
+	restored, _ := newTestDeriver(fake.Now().Add(time.Hour))
+	restored.Restore(baseline)
+	values := restored.Values()
+	if values["ignitions_today"] != int64(1) || values["hopper_last_fill_kg"] != nbe.RoundedFloat(50) {
+		t.Errorf("Expected the ignitions and the refill restored, got %v", values)
+	}
+
+	// the next day only the refills carry over
+	restored, _ = newTestDeriver(fake.Now().Add(24 * time.Hour))
+	restored.Restore(baseline)
+	values = restored.Values()
+	if values["ignitions_today"] != int64(0) || values["hopper_last_fill_kg"] != nbe.RoundedFloat(50) {
+		t.Errorf("Expected only the refill restored, got %v", values)
+	}
+}
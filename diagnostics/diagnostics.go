@@ -0,0 +1,167 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package diagnostics
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subsystem tracks the resource usage of one optional part of the bridge
+type Subsystem struct {
+	Name string
+
+	goroutines atomic.Int64
+	polls      atomic.Int64
+	published  atomic.Int64
+	lastPoll   atomic.Int64
+	lastAnswer atomic.Int64
+	queueDepth func() int
+}
+
+var (
+	registry      = make(map[string]*Subsystem)
+	registryMutex sync.Mutex
+)
+
+// Track returns the subsystem registered under name, creating it if needed
+func Track(name string) *Subsystem {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if s, ok := registry[name]; ok {
+		return s
+	}
+	s := &Subsystem{Name: name}
+	registry[name] = s
+	return s
+}
+
+// Go runs fn in a new goroutine that is counted against the subsystem
+func (s *Subsystem) Go(fn func()) {
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Add(-1)
+		fn()
+	}()
+}
+
+// Poll records a request sent to the boiler on behalf of the subsystem
+func (s *Subsystem) Poll() {
+	s.polls.Add(1)
+	s.lastPoll.Store(time.Now().UnixNano())
+}
+
+// LastPoll returns when the subsystem last polled the boiler, or the zero
+// time if it never has
+func (s *Subsystem) LastPoll() time.Time {
+	last := s.lastPoll.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// Published records n values published by the subsystem from an answered
+// poll
+func (s *Subsystem) Published(n int) {
+	s.published.Add(int64(n))
+	s.lastAnswer.Store(time.Now().UnixNano())
+}
+
+// LastAnswer returns when a poll of the subsystem was last answered, or the
+// zero time if none has been
+func (s *Subsystem) LastAnswer() time.Time {
+	last := s.lastAnswer.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// SetQueueDepth registers a function reporting the subsystem's pending work
+func (s *Subsystem) SetQueueDepth(fn func() int) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	s.queueDepth = fn
+}
+
+// Stats returns the current counters of the subsystem
+func (s *Subsystem) Stats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"goroutines": s.goroutines.Load(),
+		"polls":      s.polls.Load(),
+		"published":  s.published.Load(),
+	}
+	if s.queueDepth != nil {
+		stats["queue_depth"] = s.queueDepth()
+	}
+	return stats
+}
+
+// Snapshot returns the stats of every registered subsystem along with
+// process-wide runtime figures, which Go cannot attribute per subsystem
+func Snapshot() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	registryMutex.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	subsystems := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		subsystems[name] = registry[name].Stats()
+	}
+	registryMutex.Unlock()
+
+	return map[string]interface{}{
+		"runtime": map[string]interface{}{
+			"goroutines":  runtime.NumGoroutine(),
+			"heap_alloc":  mem.HeapAlloc,
+			"sys":         mem.Sys,
+			"mallocs":     mem.Mallocs,
+			"frees":       mem.Frees,
+			"gc_cycles":   mem.NumGC,
+			"gc_pause_ns": mem.PauseTotalNs,
+		},
+		"subsystems": subsystems,
+	}
+}
+
+// StartPublisher periodically publishes the diagnostics snapshot on bridge/diagnostics
+func StartPublisher(mqttClient *mqtt.Client, interval time.Duration) {
+	go func() {
+		for {
+			if err := mqttClient.PublishMany("bridge", map[string]interface{}{
+				"diagnostics": Snapshot(),
+			}); err != nil {
+				log.Debugf("Failed to publish diagnostics: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package diagnostics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackReturnsSameSubsystem(t *testing.T) {
+	a := Track("test_same")
+	b := Track("test_same")
+	if a != b {
+		t.Error("Expected Track to return the same subsystem for the same name")
+	}
+}
+
+func TestSubsystemCounters(t *testing.T) {
+	s := Track("test_counters")
+	s.Poll()
+	s.Poll()
+	s.Published(3)
+	s.SetQueueDepth(func() int { return 7 })
+
+	stats := s.Stats()
+	if stats["polls"] != int64(2) {
+		t.Errorf("Expected polls=2, got %v", stats["polls"])
+	}
+	if stats["published"] != int64(3) {
+		t.Errorf("Expected published=3, got %v", stats["published"])
+	}
+	if stats["queue_depth"] != 7 {
+		t.Errorf("Expected queue_depth=7, got %v", stats["queue_depth"])
+	}
+}
+
+func TestSubsystemGoCountsGoroutines(t *testing.T) {
+	s := Track("test_goroutines")
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s.Go(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	if got := s.Stats()["goroutines"]; got != int64(1) {
+		t.Errorf("Expected goroutines=1, got %v", got)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for s.Stats()["goroutines"] != int64(0) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := s.Stats()["goroutines"]; got != int64(0) {
+		t.Errorf("Expected goroutines=0 after exit, got %v", got)
+	}
+}
+
+func TestSnapshotIncludesRuntimeAndSubsystems(t *testing.T) {
+	Track("test_snapshot")
+	snapshot := Snapshot()
+
+	if _, ok := snapshot["runtime"]; !ok {
+		t.Error("Expected runtime stats in snapshot")
+	}
+	subsystems, ok := snapshot["subsystems"].(map[string]interface{})
+	if !ok {
+		t.Fatal("Expected subsystems map in snapshot")
+	}
+	if _, ok := subsystems["test_snapshot"]; !ok {
+		t.Error("Expected test_snapshot subsystem in snapshot")
+	}
+}
+
+func TestNewInfo(t *testing.T) {
+	polled := Track("test_info_polled")
+	polled.Poll()
+	polled.Published(4)
+	Track("test_info_idle")
+
+	started := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	info := NewInfo(started, started.Add(90*time.Minute), Controller{Serial: "1234", Firmware: "13.1.05"})
+	if info.UptimeSeconds != 5400 {
+		t.Errorf("Expected an uptime of 5400s, got %d", info.UptimeSeconds)
+	}
+	if info.Version == "" || info.GoVersion == "" {
+		t.Errorf("Expected the build version, got %q and %q", info.Version, info.GoVersion)
+	}
+	if info.Controller.Serial != "1234" || info.Controller.Firmware != "13.1.05" {
+		t.Errorf("Unexpected controller %+v", info.Controller)
+	}
+	stats, ok := info.Polling["test_info_polled"]
+	if !ok || stats.Polls != 1 || stats.Published != 4 || stats.LastPoll == nil {
+		t.Errorf("Expected the poll statistics, got %+v", info.Polling)
+	}
+	if _, ok := info.Polling["test_info_idle"]; ok {
+		t.Error("Expected subsystems that never polled to be left out")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package diagnostics
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Info describes the bridge and the controller it serves, published as JSON
+// on bridge/info
+type Info struct {
+	Version       string                 `json:"version"`
+	Commit        string                 `json:"commit,omitempty"`
+	GoVersion     string                 `json:"go_version"`
+	Started       time.Time              `json:"started"`
+	UptimeSeconds int64                  `json:"uptime_s"`
+	ReadOnly      bool                   `json:"read_only"`
+	Features      map[string]bool        `json:"features"`
+	Controller    Controller             `json:"controller"`
+	Polling       map[string]PollingInfo `json:"polling"`
+}
+
+// Controller describes the controller in the bridge info
+type Controller struct {
+	Serial       string     `json:"serial"`
+	DeviceID     string     `json:"device_id"`
+	IPAddress    string     `json:"ip_address"`
+	Model        string     `json:"model,omitempty"`
+	Firmware     string     `json:"firmware,omitempty"`
+	LastResponse *time.Time `json:"last_response,omitempty"`
+	// Pending is the number of requests waiting to be sent or answered
+	Pending int `json:"pending"`
+	// Dropped counts the packets ignored because they came from another
+	// host or were not answers to the bridge
+	Dropped uint64 `json:"dropped"`
+}
+
+// PollingInfo holds the poll statistics of one subsystem
+type PollingInfo struct {
+	Polls     int64      `json:"polls"`
+	Published int64      `json:"published"`
+	LastPoll  *time.Time `json:"last_poll,omitempty"`
+}
+
+// BuildVersion returns the module version and VCS revision the bridge was
+// built from; the version is "(devel)" for a build from a source checkout
+func BuildVersion() (version, commit string) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown", ""
+	}
+	version = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			commit = setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" && commit != "" {
+				commit += "-dirty"
+			}
+		}
+	}
+	return version, commit
+}
+
+// NewInfo returns the bridge info at now for a bridge started at started,
+// with the poll statistics of every subsystem that has polled
+func NewInfo(started, now time.Time, controller Controller) Info {
+	version, commit := BuildVersion()
+	return Info{
+		Version:       version,
+		Commit:        commit,
+		GoVersion:     runtime.Version(),
+		Started:       started,
+		UptimeSeconds: int64(now.Sub(started).Seconds()),
+		Controller:    controller,
+		Polling:       pollingInfo(),
+	}
+}
+
+// pollingInfo returns the poll statistics of the subsystems that poll the
+// controller
+func pollingInfo() map[string]PollingInfo {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	polling := make(map[string]PollingInfo)
+	for _, name := range names {
+		s := registry[name]
+		polls := s.polls.Load()
+		if polls == 0 {
+			continue
+		}
+		info := PollingInfo{Polls: polls, Published: s.published.Load()}
+		if last := s.LastPoll(); !last.IsZero() {
+			info.LastPoll = &last
+		}
+		polling[name] = info
+	}
+	return polling
+}
+
+// StartInfoPublisher publishes the bridge info returned by describe on
+// bridge/info now and then every interval
+func StartInfoPublisher(mqttClient *mqtt.Client, interval time.Duration, describe func() Info) {
+	go func() {
+		for {
+			if err := mqttClient.PublishJSON(mqttClient.Prefix+"/bridge/info", describe()); err != nil {
+				log.Debugf("Failed to publish the bridge info: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
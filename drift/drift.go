@@ -0,0 +1,331 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drift
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Baseline is the known-good copy of the controller settings, keyed by
+// "<category>.<key>"
+type Baseline struct {
+	Time   time.Time         `json:"time"`
+	Values map[string]string `json:"values"`
+}
+
+// Change is a setting whose value differs from the baseline. Old is empty for
+// settings missing from the baseline, New for settings the controller no
+// longer reports.
+type Change struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Report lists the settings changed since the baseline was taken
+type Report struct {
+	Time     time.Time `json:"time"`
+	Baseline time.Time `json:"baseline"`
+	Changes  []Change  `json:"changes"`
+}
+
+// Detector periodically compares the controller settings with a baseline
+// saved to disk. Writes made through the bridge update the baseline, so only
+// changes made elsewhere (e.g. at the panel) are reported.
+type Detector struct {
+	Path     string
+	Interval time.Duration
+	// Ignore lists path.Match patterns of keys left out of the comparison
+	Ignore []string
+
+	boiler     *nbe.NBE
+	mqttClient *mqtt.Client
+	fetch      func() (map[string]string, error)
+	now        func() time.Time
+
+	mu       sync.Mutex
+	baseline *Baseline
+	current  map[string]string
+	reported map[string]string
+}
+
+// New creates a detector comparing the boiler settings with the baseline
+// stored at path, publishing its report below drift/
+func New(boiler *nbe.NBE, mqttClient *mqtt.Client, path string, interval time.Duration, ignore []string) *Detector {
+	return &Detector{
+		Path:       path,
+		Interval:   interval,
+		Ignore:     ignore,
+		boiler:     boiler,
+		mqttClient: mqttClient,
+		fetch: func() (map[string]string, error) {
+			return fetchSettings(boiler)
+		},
+		now:      time.Now,
+		reported: make(map[string]string),
+	}
+}
+
+// fetchSettings reads every settings category from the controller
+func fetchSettings(boiler *nbe.NBE) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, category := range nbe.Settings {
+		response, err := boiler.GetWithPriority(nbe.PriorityPoll, nbe.GetSetupFunction, fmt.Sprintf("%s.*", category))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s settings: %w", category, err)
+		}
+		for key, value := range response.Payload {
+			values[category+"."+key] = formatValue(value)
+		}
+	}
+	return values, nil
+}
+
+// Run loads the baseline, records writes made through the bridge, subscribes
+// to drift/accept and checks for drift every interval
+func (d *Detector) Run() error {
+	if err := d.load(); err != nil {
+		return err
+	}
+	d.boiler.OnWrite(d.Record)
+	if err := d.mqttClient.Subscribe("drift/accept", 1, func(client *mqtt.Client, msg mqtt.Message) {
+		if err := d.Accept(); err != nil {
+			log.Errorf("Failed to accept settings drift: %v", err)
+			return
+		}
+		d.publish(d.report())
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			if _, err := d.Check(); err != nil {
+				log.Errorf("Settings drift check failed: %v", err)
+			}
+			time.Sleep(d.Interval)
+		}
+	}()
+	return nil
+}
+
+// Check fetches the controller settings and compares them with the baseline.
+// Without a baseline, the fetched settings become the baseline.
+func (d *Detector) Check() (Report, error) {
+	current, err := d.fetch()
+	if err != nil {
+		return Report{}, err
+	}
+
+	d.mu.Lock()
+	d.current = d.filter(current)
+	if d.baseline == nil {
+		d.baseline = &Baseline{Time: d.now(), Values: copyValues(d.current)}
+		if err := d.save(); err != nil {
+			d.mu.Unlock()
+			return Report{}, err
+		}
+		log.Infof("Saved settings baseline with %d values to %s", len(d.current), d.Path)
+	}
+	d.mu.Unlock()
+
+	report := d.report()
+	d.publish(report)
+	return report, nil
+}
+
+// Accept makes the last fetched settings the new baseline
+func (d *Detector) Accept() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.current == nil {
+		return errors.New("settings have not been read yet")
+	}
+	d.baseline = &Baseline{Time: d.now(), Values: copyValues(d.current)}
+	log.Infof("Accepted current settings as the baseline")
+	return d.save()
+}
+
+// Record updates the baseline after a write made through the bridge
+func (d *Detector) Record(key string, value []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.baseline == nil {
+		return
+	}
+	if _, ok := d.baseline.Values[key]; !ok {
+		return
+	}
+	d.baseline.Values[key] = string(value)
+	if err := d.save(); err != nil {
+		log.Errorf("Failed to save settings baseline: %v", err)
+	}
+}
+
+func (d *Detector) report() Report {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := Report{Time: d.now(), Changes: []Change{}}
+	if d.baseline == nil || d.current == nil {
+		return report
+	}
+	report.Baseline = d.baseline.Time
+	report.Changes = Compare(d.baseline.Values, d.current)
+
+	reported := make(map[string]string, len(report.Changes))
+	for _, change := range report.Changes {
+		if previous, ok := d.reported[change.Key]; !ok || previous != change.New {
+			log.Warnf("Setting %s changed outside boiler-mate: %q -> %q", change.Key, change.Old, change.New)
+		}
+		reported[change.Key] = change.New
+	}
+	d.reported = reported
+	return report
+}
+
+func (d *Detector) publish(report Report) {
+	if d.mqttClient == nil {
+		return
+	}
+	if err := d.mqttClient.PublishMany("drift", map[string]interface{}{
+		"report": report,
+		"count":  len(report.Changes),
+	}); err != nil {
+		log.Errorf("Failed to publish settings drift: %v", err)
+	}
+}
+
+func (d *Detector) filter(values map[string]string) map[string]string {
+	filtered := make(map[string]string, len(values))
+	for key, value := range values {
+		if !d.ignored(key) {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+func (d *Detector) ignored(key string) bool {
+	for _, pattern := range d.Ignore {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the baseline file; a missing file leaves the detector without a
+// baseline until the first check
+func (d *Detector) load() error {
+	data, err := os.ReadFile(d.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var baseline Baseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return fmt.Errorf("parsing %s: %w", d.Path, err)
+	}
+	if baseline.Values == nil {
+		baseline.Values = make(map[string]string)
+	}
+
+	d.mu.Lock()
+	d.baseline = &baseline
+	d.mu.Unlock()
+	return nil
+}
+
+// save writes the baseline file; the caller holds d.mu
+func (d *Detector) save() error {
+	data, err := json.MarshalIndent(d.baseline, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.Path)
+}
+
+// Compare returns the settings that differ between baseline and current,
+// sorted by key. Numbers are compared by value, so "75" equals "75.00".
+func Compare(baseline, current map[string]string) []Change {
+	changes := []Change{}
+	for key, value := range current {
+		old, ok := baseline[key]
+		if !ok || !equalValues(old, value) {
+			changes = append(changes, Change{Key: key, Old: old, New: value})
+		}
+	}
+	for key, old := range baseline {
+		if _, ok := current[key]; !ok {
+			changes = append(changes, Change{Key: key, Old: old})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func copyValues(values map[string]string) map[string]string {
+	copied := make(map[string]string, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
+
+func equalValues(a, b string) bool {
+	if a == b {
+		return true
+	}
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	return errX == nil && errY == nil && x == y
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
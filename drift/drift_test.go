@@ -0,0 +1,138 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package drift
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestCompare(t *testing.T) {
+	baseline := map[string]string{
+		"boiler.temp":     "70",
+		"hot_water.temp":  "50",
+		"pump.start_temp": "45",
+		"fan.speed":       "60.5",
+	}
+	current := map[string]string{
+		"boiler.temp":    "70.00",
+		"hot_water.temp": "55",
+		"fan.speed":      "60.5",
+		"hopper.content": "120",
+	}
+
+	changes := Compare(baseline, current)
+	expected := []Change{
+		{Key: "hopper.content", Old: "", New: "120"},
+		{Key: "hot_water.temp", Old: "50", New: "55"},
+		{Key: "pump.start_temp", Old: "45", New: ""},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Compare() = %v, want %v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("changes[%d] = %v, want %v", i, changes[i], expected[i])
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{nbe.RoundedFloat(70), "70"},
+		{nbe.RoundedFloat(2.5), "2.5"},
+		{int64(3), "3"},
+		{"auto", "auto"},
+	}
+
+	for _, tt := range tests {
+		if got := formatValue(tt.value); got != tt.expected {
+			t.Errorf("formatValue(%v) = %q, want %q", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func newTestDetector(t *testing.T, settings map[string]string) *Detector {
+	return &Detector{
+		Path:   filepath.Join(t.TempDir(), "baseline.json"),
+		Ignore: []string{"misc.*"},
+		fetch: func() (map[string]string, error) {
+			return copyValues(settings), nil
+		},
+		now:      time.Now,
+		reported: make(map[string]string),
+	}
+}
+
+func TestDetectorCheck(t *testing.T) {
+	settings := map[string]string{"boiler.temp": "70", "hot_water.temp": "50", "misc.start": "0"}
+	d := newTestDetector(t, settings)
+
+	report, err := d.Check()
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("Expected no drift against a fresh baseline, got %v", report.Changes)
+	}
+
+	// changed at the panel
+	settings["hot_water.temp"] = "60"
+	settings["misc.start"] = "1"
+	// written through the bridge
+	settings["boiler.temp"] = "75"
+	d.Record("boiler.temp", []byte("75"))
+
+	report, err = d.Check()
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if len(report.Changes) != 1 || report.Changes[0] != (Change{Key: "hot_water.temp", Old: "50", New: "60"}) {
+		t.Errorf("Expected only hot_water.temp to drift, got %v", report.Changes)
+	}
+
+	// a restarted detector reads the saved baseline
+	restarted := newTestDetector(t, settings)
+	restarted.Path = d.Path
+	if err := restarted.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if report, _ := restarted.Check(); len(report.Changes) != 1 {
+		t.Errorf("Expected the saved baseline to report one change, got %v", report.Changes)
+	}
+
+	if err := d.Accept(); err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	if report, _ := d.Check(); len(report.Changes) != 0 {
+		t.Errorf("Expected no drift after accepting, got %v", report.Changes)
+	}
+}
+
+func TestAcceptBeforeCheck(t *testing.T) {
+	d := newTestDetector(t, nil)
+	if err := d.Accept(); err == nil {
+		t.Error("Expected Accept() to fail before the settings were read")
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package efficiency derives the boiler's daily efficiency: the heat produced,
+// integrated from the reported burner output, as a share of the energy in the
+// pellets burned.
+package efficiency
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+// publishInterval is how often the running figures are published
+const publishInterval = time.Minute
+
+// Tracker accumulates today's produced heat and pellet consumption from the
+// bus and publishes the efficiency below efficiency/. At midnight the day
+// starts over and the finished day is kept as "yesterday".
+type Tracker struct {
+	// CalorificValue is the energy content of the pellets in kWh/kg
+	CalorificValue float64
+
+	eventBus  *bus.Bus
+	pipelines *pipeline.Pipelines
+	now       func() time.Time
+
+	mu       sync.Mutex
+	tomorrow time.Time
+	last     time.Time
+	power    float64
+	produced float64
+
+	counter     float64
+	start       float64
+	haveCounter bool
+
+	yesterday     float64
+	haveYesterday bool
+}
+
+// New creates a tracker using calorificValue in kWh/kg, undoing the
+// conversions of pipelines
+func New(eventBus *bus.Bus, pipelines *pipeline.Pipelines, calorificValue float64) *Tracker {
+	return &Tracker{
+		CalorificValue: calorificValue,
+		eventBus:       eventBus,
+		pipelines:      pipelines,
+		now:            time.Now,
+	}
+}
+
+// Run starts following the burner output and consumption counter
+func (t *Tracker) Run() {
+	t.eventBus.Subscribe(t.handle, bus.ValueChanged)
+
+	go func() {
+		for range time.Tick(publishInterval) {
+			t.Publish()
+		}
+	}()
+}
+
+func (t *Tracker) handle(event bus.Event) {
+	var key string
+	switch event.Category {
+	case "operating_data":
+		key = "power_kw"
+	case "consumption":
+		key = "pellets_kg"
+	default:
+		return
+	}
+	value, ok := nbe.ToFloat(event.Values[key])
+	if !ok {
+		return
+	}
+	value = t.pipelines.Unconvert(event.Category+"/"+key, value)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+	if key == "power_kw" {
+		t.power = value
+		return
+	}
+
+	if !t.haveCounter || value < t.start {
+		// first reading of the day, or the controller's counter was reset
+		t.start = value
+	}
+	t.counter = value
+	t.haveCounter = true
+}
+
+// advance integrates the burner output up to now, closing the day at each
+// midnight passed on the way
+func (t *Tracker) advance(now time.Time) {
+	if t.last.IsZero() {
+		t.last = now
+		t.tomorrow = clock.NextMidnight(now)
+		return
+	}
+
+	for !now.Before(t.tomorrow) {
+		t.integrate(t.tomorrow)
+		t.yesterday, t.haveYesterday = t.efficiency()
+		t.produced = 0
+		t.start = t.counter
+		t.tomorrow = clock.NextMidnight(t.tomorrow)
+	}
+	t.integrate(now)
+}
+
+func (t *Tracker) integrate(until time.Time) {
+	if until.After(t.last) {
+		t.produced += t.power * until.Sub(t.last).Hours()
+		t.last = until
+	}
+}
+
+// efficiency returns today's efficiency in percent, if any pellets were burned
+func (t *Tracker) efficiency() (float64, bool) {
+	burned := t.counter - t.start
+	if burned <= 0 || t.CalorificValue <= 0 {
+		return 0, false
+	}
+	return t.produced / (burned * t.CalorificValue) * 100, true
+}
+
+// Values returns the figures published for today: the efficiency in
+// "today", once pellets have been burned, and its inputs together with the
+// previous day's efficiency in "attributes"
+func (t *Tracker) Values() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(t.now())
+
+	attributes := map[string]interface{}{
+		"produced_kwh": nbe.RoundedFloat(t.produced),
+		"pellets_kg":   nbe.RoundedFloat(t.counter - t.start),
+	}
+	if t.haveYesterday {
+		attributes["yesterday"] = nbe.RoundedFloat(t.yesterday)
+	}
+	values := map[string]interface{}{"attributes": attributes}
+	if today, ok := t.efficiency(); ok {
+		values["today"] = nbe.RoundedFloat(today)
+	}
+	return values
+}
+
+// Baseline is the part of today's figures that would be lost on a restart
+type Baseline struct {
+	Day         string   `json:"day"`
+	HaveCounter bool     `json:"have_counter"`
+	Start       float64  `json:"start_kg"`
+	Counter     float64  `json:"counter_kg"`
+	Produced    float64  `json:"produced_kwh"`
+	Yesterday   *float64 `json:"yesterday,omitempty"`
+}
+
+// Baseline returns today's figures so far, to be restored after a restart
+func (t *Tracker) Baseline() Baseline {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.advance(now)
+
+	baseline := Baseline{
+		Day:         now.Format("2006-01-02"),
+		HaveCounter: t.haveCounter,
+		Start:       t.start,
+		Counter:     t.counter,
+		Produced:    t.produced,
+	}
+	if t.haveYesterday {
+		yesterday := t.yesterday
+		baseline.Yesterday = &yesterday
+	}
+	return baseline
+}
+
+// Restore continues from a baseline saved earlier today; a baseline from
+// another day is ignored
+func (t *Tracker) Restore(baseline Baseline) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if baseline.Day != now.Format("2006-01-02") {
+		return
+	}
+	t.advance(now)
+
+	if baseline.HaveCounter {
+		t.start, t.counter, t.haveCounter = baseline.Start, baseline.Counter, true
+	}
+	t.produced += baseline.Produced
+	if baseline.Yesterday != nil {
+		t.yesterday, t.haveYesterday = *baseline.Yesterday, true
+	}
+}
+
+// Publish publishes the current figures on the bus
+func (t *Tracker) Publish() {
+	t.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "efficiency", Values: t.Values()})
+}
@@ -0,0 +1,153 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package efficiency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+func newTestTracker(start time.Time) (*Tracker, *clock.Fake) {
+	c := clock.NewFake(start)
+	tracker := New(bus.New(), nil, 5)
+	tracker.now = c.Now
+	return tracker, c
+}
+
+func power(kw float64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{"power_kw": nbe.RoundedFloat(kw)}}
+}
+
+func pellets(kg float64) bus.Event {
+	return bus.Event{Kind: bus.ValueChanged, Category: "consumption", Values: map[string]interface{}{"pellets_kg": nbe.RoundedFloat(kg)}}
+}
+
+func TestTrackerEfficiency(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	tracker.handle(pellets(1000))
+	if _, ok := tracker.Values()["today"]; ok {
+		t.Error("Expected no efficiency before any pellets are burned")
+	}
+
+	// 10 kW for 2 hours = 20 kWh from 5 kg of pellets at 5 kWh/kg = 80%
+	tracker.handle(power(10))
+	fake.Advance(2 * time.Hour)
+	tracker.handle(power(0))
+	tracker.handle(pellets(1005))
+
+	values := tracker.Values()
+	if values["today"] != nbe.RoundedFloat(80) {
+		t.Errorf("Expected efficiency 80, got %v", values["today"])
+	}
+	attributes := values["attributes"].(map[string]interface{})
+	if attributes["produced_kwh"] != nbe.RoundedFloat(20) || attributes["pellets_kg"] != nbe.RoundedFloat(5) {
+		t.Errorf("Unexpected attributes %v", attributes)
+	}
+	if _, ok := attributes["yesterday"]; ok {
+		t.Error("Expected no previous day on the first day")
+	}
+}
+
+func TestTrackerResetsAtMidnight(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 23, 0, 0, 0, time.UTC))
+
+	tracker.handle(pellets(1000))
+	tracker.handle(power(12))
+	fake.Advance(30 * time.Minute)
+	tracker.handle(pellets(1003))
+
+	// the burner keeps running across midnight
+	fake.Advance(time.Hour)
+	values := tracker.Values()
+	attributes := values["attributes"].(map[string]interface{})
+	if attributes["yesterday"] != nbe.RoundedFloat(80) {
+		t.Errorf("Expected yesterday 80, got %v", attributes["yesterday"])
+	}
+	if attributes["produced_kwh"] != nbe.RoundedFloat(6) {
+		t.Errorf("Expected 6 kWh since midnight, got %v", attributes["produced_kwh"])
+	}
+	if _, ok := values["today"]; ok {
+		t.Errorf("Expected no efficiency before pellets are burned today, got %v", values["today"])
+	}
+
+	tracker.handle(pellets(1004.5))
+	if today := tracker.Values()["today"]; today != nbe.RoundedFloat(80) {
+		t.Errorf("Expected today 80, got %v", today)
+	}
+}
+
+func TestTrackerCounterReset(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+
+	tracker.handle(pellets(1000))
+	tracker.handle(pellets(3))
+	tracker.handle(power(10))
+	fake.Advance(time.Hour)
+	tracker.handle(pellets(5))
+
+	if today := tracker.Values()["today"]; today != nbe.RoundedFloat(100) {
+		t.Errorf("Expected today 100 after the counter reset, got %v", today)
+	}
+}
+
+func TestTrackerRestore(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+	tracker.handle(pellets(1000))
+	tracker.handle(power(10))
+	fake.Advance(2 * time.Hour)
+	tracker.handle(power(0))
+	tracker.handle(pellets(1005))
+	baseline := tracker.Baseline()
+
+	restored, _ := newTestTracker(fake.Now().Add(time.Hour))
+	restored.Restore(baseline)
+	if today := restored.Values()["today"]; today != nbe.RoundedFloat(80) {
+		t.Errorf("Expected today 80 after the restart, got %v", today)
+	}
+
+	stale, _ := newTestTracker(fake.Now().Add(24 * time.Hour))
+	stale.Restore(baseline)
+	if attributes := stale.Values()["attributes"].(map[string]interface{}); attributes["produced_kwh"] != nbe.RoundedFloat(0) {
+		t.Errorf("Expected a baseline from another day to be ignored, got %v", attributes)
+	}
+}
+
+func TestTrackerUndoesConversions(t *testing.T) {
+	tracker, fake := newTestTracker(time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC))
+	tracker.pipelines = pipeline.New(map[string][]config.PipelineStep{
+		"operating_data/power_kw": {{Convert: "kw_to_btuh"}},
+	})
+
+	// 34121.42 BTU/h is 10 kW
+	tracker.handle(pellets(1000))
+	tracker.handle(power(34121.42))
+	fake.Advance(2 * time.Hour)
+	tracker.handle(power(0))
+	tracker.handle(pellets(1005))
+
+	if today := tracker.Values()["today"]; today != nbe.RoundedFloat(80) {
+		t.Errorf("Expected efficiency 80 from converted readings, got %v", today)
+	}
+}
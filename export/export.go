@@ -0,0 +1,143 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package export turns the local value history into files for spreadsheets
+// and data analysis tools.
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/history"
+)
+
+// TimeLayout is how times are written to CSV files, understood by common
+// spreadsheet applications
+const TimeLayout = "2006-01-02 15:04:05"
+
+// Table is the history of a set of series with one row for every time any of
+// them changed. A series keeps its last value until it changes again, and has
+// no value before its first point.
+type Table struct {
+	Columns []string
+	Rows    []Row
+}
+
+// Row holds the values of the table's columns at a time; Set marks the
+// columns with a value
+type Row struct {
+	Time   time.Time
+	Values []float64
+	Set    []bool
+}
+
+// Build collects the series of the store matching any of the patterns, such
+// as "operating_data/*", between from and to. No patterns selects every
+// series.
+func Build(store *history.Store, patterns []string, from, to time.Time) (*Table, error) {
+	columns, err := match(store.Series(), patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{Columns: columns}
+	series := make([][]history.Point, len(columns))
+	var times []time.Time
+	seen := make(map[int64]bool)
+	for i, column := range columns {
+		series[i] = store.Query(column, from, to, 0)
+		for _, point := range series[i] {
+			if ms := point.Time.UnixMilli(); !seen[ms] {
+				seen[ms] = true
+				times = append(times, point.Time)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	next := make([]int, len(columns))
+	values := make([]float64, len(columns))
+	set := make([]bool, len(columns))
+	for _, at := range times {
+		for i, points := range series {
+			for next[i] < len(points) && !points[next[i]].Time.After(at) {
+				values[i] = points[next[i]].Value
+				set[i] = true
+				next[i]++
+			}
+		}
+		table.Rows = append(table.Rows, Row{
+			Time:   at,
+			Values: append([]float64(nil), values...),
+			Set:    append([]bool(nil), set...),
+		})
+	}
+	return table, nil
+}
+
+// match returns the series matching any of the patterns, in order
+func match(series, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return series, nil
+	}
+	var matched []string
+	for _, name := range series {
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+			}
+			if ok {
+				matched = append(matched, name)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// WriteCSV writes the table with a header row, the times in their location
+// and empty cells for series without a value yet
+func WriteCSV(w io.Writer, table *Table) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(append([]string{"time"}, table.Columns...)); err != nil {
+		return err
+	}
+	record := make([]string, len(table.Columns)+1)
+	for _, row := range table.Rows {
+		record[0] = row.Time.Format(TimeLayout)
+		for i, value := range row.Values {
+			record[i+1] = ""
+			if row.Set[i] {
+				record[i+1] = strconv.FormatFloat(value, 'f', -1, 64)
+			}
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,127 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package export
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/history"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/parquet-go/parquet-go"
+)
+
+var start = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func testStore() *history.Store {
+	store := history.New("", 0, time.Minute)
+	store.Record("operating_data", map[string]interface{}{"boiler_temp": nbe.RoundedFloat(65.5)}, start)
+	store.Record("operating_data", map[string]interface{}{"power_pct": int64(40)}, start.Add(time.Minute))
+	store.Record("operating_data", map[string]interface{}{"boiler_temp": nbe.RoundedFloat(67)}, start.Add(2*time.Minute))
+	store.Record("settings", map[string]interface{}{"boiler/temp": "70"}, start)
+	return store
+}
+
+func TestBuild(t *testing.T) {
+	table, err := Build(testStore(), []string{"operating_data/*"}, time.Time{}, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(table.Columns, ",") != "operating_data/boiler_temp,operating_data/power_pct" {
+		t.Fatalf("Unexpected columns %v", table.Columns)
+	}
+	if len(table.Rows) != 3 {
+		t.Fatalf("Expected a row per change, got %v", table.Rows)
+	}
+	if row := table.Rows[0]; !row.Set[0] || row.Set[1] || row.Values[0] != 65.5 {
+		t.Errorf("Expected only the boiler temperature in the first row, got %+v", row)
+	}
+	if row := table.Rows[2]; !row.Time.Equal(start.Add(2*time.Minute)) || row.Values[0] != 67 || row.Values[1] != 40 {
+		t.Errorf("Expected the power to carry forward to the last row, got %+v", row)
+	}
+
+	table, err = Build(testStore(), nil, start.Add(90*time.Second), start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.Columns) != 3 || len(table.Rows) != 2 || !table.Rows[0].Set[2] || table.Rows[0].Values[2] != 70 {
+		t.Errorf("Expected every series with the values in effect at the start, got %v %+v", table.Columns, table.Rows)
+	}
+
+	if _, err := Build(testStore(), []string{"["}, time.Time{}, start); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	table, _ := Build(testStore(), []string{"operating_data/*"}, time.Time{}, start.Add(time.Hour))
+	var out bytes.Buffer
+	if err := WriteCSV(&out, table); err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,operating_data/boiler_temp,operating_data/power_pct\n" +
+		"2024-01-10 12:00:00,65.5,\n" +
+		"2024-01-10 12:01:00,65.5,40\n" +
+		"2024-01-10 12:02:00,67,40\n"
+	if out.String() != expected {
+		t.Errorf("WriteCSV() = %q, want %q", out.String(), expected)
+	}
+}
+
+func TestWriteParquet(t *testing.T) {
+	table, _ := Build(testStore(), []string{"operating_data/*"}, time.Time{}, start.Add(time.Hour))
+	var out bytes.Buffer
+	if err := WriteParquet(&out, table); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("Failed to open the file with a Parquet reader: %v", err)
+	}
+	if file.NumRows() != 3 {
+		t.Errorf("Expected 3 rows, got %d", file.NumRows())
+	}
+	var names []string
+	for _, field := range file.Schema().Fields() {
+		names = append(names, field.Name())
+	}
+	if strings.Join(names, ",") != "time,operating_data/boiler_temp,operating_data/power_pct" {
+		t.Errorf("Unexpected schema %v", names)
+	}
+
+	rows := make([]parquet.Row, 3)
+	reader := parquet.NewReader(file)
+	if n, err := reader.ReadRows(rows); n != 3 || (err != nil && err != io.EOF) {
+		t.Fatalf("Expected to read 3 rows, got %d: %v", n, err)
+	}
+	if ms := rows[2][0].Int64(); ms != start.Add(2*time.Minute).UnixMilli() {
+		t.Errorf("Expected the last time to be %v, got %d", start.Add(2*time.Minute), ms)
+	}
+	if !rows[0][2].IsNull() {
+		t.Errorf("Expected the first power value to be null, got %v", rows[0][2])
+	}
+	if rows[1][2].Double() != 40 || rows[2][2].Double() != 40 {
+		t.Errorf("Expected two power values of 40, got %v and %v", rows[1][2], rows[2][2])
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package export
+
+import (
+	"io"
+	"reflect"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// WriteParquet writes the table as a Parquet file: a required "time" column
+// of millisecond timestamps and an optional double column per series, null
+// before the series' first value
+func WriteParquet(w io.Writer, table *Table) error {
+	fields := []parquet.Field{column{Node: parquet.Timestamp(parquet.Millisecond), name: "time"}}
+	for _, name := range table.Columns {
+		fields = append(fields, column{Node: parquet.Optional(parquet.Leaf(parquet.DoubleType)), name: name})
+	}
+	writer := parquet.NewWriter(w, parquet.NewSchema("history", group{fields: fields}))
+
+	rows := make([]parquet.Row, 0, len(table.Rows))
+	for _, row := range table.Rows {
+		values := make(parquet.Row, 0, len(fields))
+		values = append(values, parquet.Int64Value(row.Time.UnixMilli()).Level(0, 0, 0))
+		for i, value := range row.Values {
+			if row.Set[i] {
+				values = append(values, parquet.DoubleValue(value).Level(0, 1, i+1))
+			} else {
+				values = append(values, parquet.NullValue().Level(0, 0, i+1))
+			}
+		}
+		rows = append(rows, values)
+	}
+	if _, err := writer.WriteRows(rows); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// group is the file's schema. Unlike parquet.Group, which sorts its fields
+// by name, it keeps the time first and the series in the table's order.
+type group struct {
+	parquet.Group
+	fields []parquet.Field
+}
+
+func (g group) Fields() []parquet.Field { return g.fields }
+
+// column is a named field of the schema
+type column struct {
+	parquet.Node
+	name string
+}
+
+func (c column) Name() string { return c.name }
+
+func (c column) Value(base reflect.Value) reflect.Value {
+	return base.MapIndex(reflect.ValueOf(c.name))
+}
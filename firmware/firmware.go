@@ -0,0 +1,147 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package firmware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// versionKeys are the info keys that may carry the controller software version
+var versionKeys = []string{"version", "sw_version", "software_version", "firmware"}
+
+// modelKeys are the info keys that may carry the boiler model
+var modelKeys = []string{"model", "boiler_model", "boiler_type"}
+
+// Start publishes the controller's installed software version and, when
+// checkURL is set, the latest version reported by the update server. Without
+// checkURL the latest version is unknown and not published.
+func Start(boiler *nbe.NBE, mqttClient *mqtt.Client, checkURL string, interval time.Duration) {
+	go func() {
+		for {
+			response, err := boiler.GetWithPriority(nbe.PriorityPoll, nbe.GetInfoFunction, "*")
+			if err != nil {
+				log.Debugf("Failed to get controller info: %v", err)
+			} else if installed, ok := installedVersion(response.Payload); ok {
+				if err := mqttClient.PublishMany("firmware", map[string]interface{}{
+					"installed_version": installed,
+				}); err != nil {
+					log.Debugf("Failed to publish firmware version: %v", err)
+				}
+			} else {
+				log.Debugf("Controller info has no software version: %v", response.Payload)
+			}
+
+			if checkURL != "" {
+				latest, err := fetchLatestVersion(checkURL)
+				if err != nil {
+					log.Warnf("Failed to check for firmware updates: %v", err)
+				} else if err := mqttClient.PublishMany("firmware", map[string]interface{}{
+					"latest_version": latest,
+				}); err != nil {
+					log.Debugf("Failed to publish latest firmware version: %v", err)
+				}
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Version reads the controller's installed software version
+func Version(boiler *nbe.NBE) (string, error) {
+	version, _, err := Info(boiler)
+	return version, err
+}
+
+// Info reads the controller's installed software version and the boiler
+// model, which is empty if the controller doesn't report it
+func Info(boiler *nbe.NBE) (version, model string, err error) {
+	response, err := boiler.GetWithPriority(nbe.PriorityPoll, nbe.GetInfoFunction, "*")
+	if err != nil {
+		return "", "", err
+	}
+	model, _ = infoValue(response.Payload, modelKeys)
+	version, ok := installedVersion(response.Payload)
+	if !ok {
+		return "", model, fmt.Errorf("controller info has no software version: %v", response.Payload)
+	}
+	return version, model, nil
+}
+
+func installedVersion(payload map[string]interface{}) (string, bool) {
+	return infoValue(payload, versionKeys)
+}
+
+// infoValue returns the first non-empty value of keys in the info payload
+func infoValue(payload map[string]interface{}, keys []string) (string, bool) {
+	for _, key := range keys {
+		if val, ok := payload[key]; ok {
+			value := strings.TrimSpace(fmt.Sprintf("%v", val))
+			if value != "" {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+func fetchLatestVersion(checkURL string) (string, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(checkURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", checkURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	return parseLatestVersion(body)
+}
+
+// parseLatestVersion accepts either a JSON object with a "version" field or a
+// plain-text version string
+func parseLatestVersion(body []byte) (string, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "{") {
+		var doc struct {
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(trimmed), &doc); err != nil {
+			return "", fmt.Errorf("parsing version document: %w", err)
+		}
+		trimmed = strings.TrimSpace(doc.Version)
+	}
+	if trimmed == "" || strings.ContainsAny(trimmed, "\n<") {
+		return "", fmt.Errorf("no version in response")
+	}
+	return trimmed, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package firmware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestInstalledVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  map[string]interface{}
+		expected string
+		ok       bool
+	}{
+		{"version key", map[string]interface{}{"version": "13.1.05"}, "13.1.05", true},
+		{"sw_version key", map[string]interface{}{"sw_version": "7.22"}, "7.22", true},
+		{"numeric version", map[string]interface{}{"version": nbe.RoundedFloat(7.5)}, "7.5", true},
+		{"missing", map[string]interface{}{"serial": "1234"}, "", false},
+		{"empty", map[string]interface{}{"version": ""}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, ok := installedVersion(tt.payload)
+			if version != tt.expected || ok != tt.ok {
+				t.Errorf("installedVersion() = %q, %v, want %q, %v", version, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
+func TestInfoModel(t *testing.T) {
+	payload := map[string]interface{}{"version": "13.1.05", "boiler_type": " RTB 16 "}
+	if model, ok := infoValue(payload, modelKeys); !ok || model != "RTB 16" {
+		t.Errorf("infoValue() = %q, %v, want RTB 16", model, ok)
+	}
+	if model, ok := infoValue(map[string]interface{}{"version": "13.1.05"}, modelKeys); ok {
+		t.Errorf("Expected no model, got %q", model)
+	}
+}
+
+func TestParseLatestVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+		wantErr  bool
+	}{
+		{"plain text", "13.2.01\n", "13.2.01", false},
+		{"json", `{"version": "13.2.01", "date": "2026-01-01"}`, "13.2.01", false},
+		{"json without version", `{"date": "2026-01-01"}`, "", true},
+		{"empty", "", "", true},
+		{"html", "<html><body>not found</body></html>", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := parseLatestVersion([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLatestVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if version != tt.expected {
+				t.Errorf("parseLatestVersion() = %q, want %q", version, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFetchLatestVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("13.2.01"))
+	}))
+	defer server.Close()
+
+	version, err := fetchLatestVersion(server.URL + "/latest")
+	if err != nil {
+		t.Fatalf("fetchLatestVersion() error = %v", err)
+	}
+	if version != "13.2.01" {
+		t.Errorf("Expected 13.2.01, got %q", version)
+	}
+
+	if _, err := fetchLatestVersion(server.URL + "/missing"); err == nil {
+		t.Error("Expected error for missing document")
+	}
+}
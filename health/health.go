@@ -0,0 +1,102 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package health provides the checks behind the /healthz and /readyz
+// endpoints used by container orchestrators.
+package health
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	healthz "github.com/klyve/go-healthz"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Check adapts a function to the healthz.Checkable interface
+type Check func() error
+
+// Healthz runs the check
+func (c Check) Healthz() error {
+	return c()
+}
+
+// checkAge fails if last is zero or older than maxAge
+func checkAge(what string, last time.Time, maxAge time.Duration) error {
+	if last.IsZero() {
+		return fmt.Errorf("no %s yet", what)
+	}
+	if age := time.Since(last); age > maxAge {
+		return fmt.Errorf("last %s %s ago", what, age.Round(time.Second))
+	}
+	return nil
+}
+
+// NBE reports the controller as unreachable when it hasn't answered for maxAge
+func NBE(boiler *nbe.NBE, maxAge time.Duration) healthz.Provider {
+	return healthz.Provider{
+		Name: "nbe",
+		Handle: Check(func() error {
+			return checkAge("controller response", boiler.LastResponse(), maxAge)
+		}),
+	}
+}
+
+// MQTT reports whether the broker connection is up
+func MQTT(mqttClient *mqtt.Client) healthz.Provider {
+	return healthz.Provider{
+		Name: "mqtt",
+		Handle: Check(func() error {
+			if !mqttClient.IsConnected() {
+				return errors.New("not connected to broker")
+			}
+			return nil
+		}),
+	}
+}
+
+// Poll reports a stalled monitor when the subsystem hasn't polled for maxAge
+func Poll(stats *diagnostics.Subsystem, maxAge time.Duration) healthz.Provider {
+	return healthz.Provider{
+		Name: "poll_" + stats.Name,
+		Handle: Check(func() error {
+			return checkAge("poll", stats.LastPoll(), maxAge)
+		}),
+	}
+}
+
+// Readiness fails until MarkReady is called
+type Readiness struct {
+	ready atomic.Bool
+}
+
+// MarkReady records that the bridge has published its initial data
+func (r *Readiness) MarkReady() {
+	r.ready.Store(true)
+}
+
+// Healthz fails while the bridge is still starting up
+func (r *Readiness) Healthz() error {
+	if !r.ready.Load() {
+		return errors.New("waiting for initial data")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	healthz "github.com/klyve/go-healthz"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+)
+
+func TestCheckAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		last    time.Time
+		wantErr bool
+	}{
+		{"never", time.Time{}, true},
+		{"recent", time.Now().Add(-10 * time.Second), false},
+		{"stale", time.Now().Add(-2 * time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAge("poll", tt.last, time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAge(%v) error = %v, wantErr %v", tt.last, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPollCheck(t *testing.T) {
+	stats := diagnostics.Track("health_test")
+	provider := Poll(stats, time.Minute)
+
+	if err := provider.Handle.Healthz(); err == nil {
+		t.Error("Expected check to fail before the first poll")
+	}
+	stats.Poll()
+	if err := provider.Handle.Healthz(); err != nil {
+		t.Errorf("Expected check to pass after a poll, got %v", err)
+	}
+}
+
+func TestReadinessEndpoint(t *testing.T) {
+	readiness := &Readiness{}
+	instance := &healthz.Instance{
+		Providers: []healthz.Provider{{Name: "ready", Handle: readiness}},
+	}
+	handler := instance.Healthz()
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before ready, got %d", recorder.Code)
+	}
+
+	readiness.MarkReady()
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200 once ready, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,250 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package history keeps a local, size-bounded history of the numeric values
+// published by the bridge, so they can be charted without a time-series
+// database.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Available reports whether this build includes the history
+const Available = true
+
+// Point is one sample of a series
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// file is the on-disk form of the history: each series as [unix ms, value]
+// pairs
+type file struct {
+	Series map[string][][2]float64 `json:"series"`
+}
+
+// Store records the numeric values changed on the bus, keyed by their
+// "<category>/<key>" path. Values changing within Resolution of a series'
+// last point replace it, and points older than Retention are dropped.
+type Store struct {
+	Path       string
+	Retention  time.Duration
+	Resolution time.Duration
+
+	mu     sync.RWMutex
+	series map[string][]Point
+	now    func() time.Time
+}
+
+// New creates a store, saved to path unless it is empty
+func New(path string, retention, resolution time.Duration) *Store {
+	return &Store{
+		Path:       path,
+		Retention:  retention,
+		Resolution: resolution,
+		series:     make(map[string][]Point),
+		now:        time.Now,
+	}
+}
+
+// Run loads the saved history, records the value changes on the bus and
+// prunes and saves the history every saveInterval
+func (s *Store) Run(eventBus *bus.Bus, saveInterval time.Duration) error {
+	if err := s.Load(); err != nil {
+		return err
+	}
+	eventBus.Subscribe(func(event bus.Event) {
+		s.Record(event.Category, event.Values, event.Time)
+	}, bus.ValueChanged)
+
+	go func() {
+		for range time.Tick(saveInterval) {
+			if err := s.Save(); err != nil {
+				log.Errorf("Failed to save the history: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Record adds the numeric values of a category changed at the given time
+func (s *Store) Record(category string, values map[string]interface{}, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range values {
+		number, ok := numeric(value)
+		if !ok {
+			continue
+		}
+		path := category + "/" + key
+		points := s.series[path]
+		if n := len(points); n > 0 && at.Sub(points[n-1].Time) < s.Resolution {
+			points[n-1].Value = number
+			continue
+		}
+		s.series[path] = append(points, Point{Time: at, Value: number})
+	}
+}
+
+// numeric converts a published value to a number; ON and OFF count as 1
+// and 0 so binary states can be charted
+func numeric(value interface{}) (float64, bool) {
+	switch value {
+	case true, "ON":
+		return 1, true
+	case false, "OFF":
+		return 0, true
+	}
+	return nbe.ParseFloat(value)
+}
+
+// Series returns the paths with recorded values, sorted
+func (s *Store) Series() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	paths := make([]string, 0, len(s.series))
+	for path := range s.series {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Query returns the points of a series between from and to. The value in
+// effect at from is included, as values are only recorded when they change.
+// With maxPoints above zero, the points are thinned to at most that many by
+// keeping the last of each equal slice of the range.
+func (s *Store) Query(path string, from, to time.Time, maxPoints int) []Point {
+	s.mu.RLock()
+	points := s.series[path]
+	start := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(from) })
+	end := sort.Search(len(points), func(i int) bool { return points[i].Time.After(to) })
+	var result []Point
+	if start > 0 && start <= end && (start == len(points) || points[start].Time.After(from)) {
+		result = append(result, Point{Time: from, Value: points[start-1].Value})
+	}
+	if start < end {
+		result = append(result, points[start:end]...)
+	}
+	s.mu.RUnlock()
+
+	if maxPoints <= 0 || len(result) <= maxPoints {
+		return result
+	}
+	step := to.Sub(from) / time.Duration(maxPoints)
+	if step <= 0 {
+		return result[len(result)-maxPoints:]
+	}
+	thinned := make([]Point, 0, maxPoints)
+	for _, point := range result {
+		bucket := from.Add(point.Time.Sub(from) / step * step)
+		if n := len(thinned); n > 0 && !thinned[n-1].Time.Before(bucket) {
+			thinned[n-1] = point
+			continue
+		}
+		thinned = append(thinned, point)
+	}
+	return thinned
+}
+
+// prune drops the points older than the retention
+func (s *Store) prune() {
+	cutoff := s.now().Add(-s.Retention)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path, points := range s.series {
+		keep := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(cutoff) })
+		if keep == len(points) {
+			delete(s.series, path)
+			continue
+		}
+		if keep > 0 {
+			s.series[path] = append([]Point(nil), points[keep:]...)
+		}
+	}
+}
+
+// Load reads the history file; a missing file starts an empty history
+func (s *Store) Load() error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved file
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("parsing %s: %w", s.Path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path, pairs := range saved.Series {
+		points := make([]Point, 0, len(pairs))
+		for _, pair := range pairs {
+			points = append(points, Point{Time: time.UnixMilli(int64(pair[0])), Value: pair[1]})
+		}
+		s.series[path] = points
+	}
+	return nil
+}
+
+// Save prunes the history and writes it to the file, if there is one
+func (s *Store) Save() error {
+	s.prune()
+	if s.Path == "" {
+		return nil
+	}
+	s.mu.RLock()
+	saved := file{Series: make(map[string][][2]float64, len(s.series))}
+	for path, points := range s.series {
+		pairs := make([][2]float64, len(points))
+		for i, point := range points {
+			pairs[i] = [2]float64{float64(point.Time.UnixMilli()), point.Value}
+		}
+		saved.Series[path] = pairs
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
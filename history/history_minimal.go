@@ -0,0 +1,48 @@
+//go:build minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package history
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+)
+
+// Available reports whether this build includes the history
+const Available = false
+
+// Store is empty in minimal builds, which leave out the history
+type Store struct{}
+
+// New returns an empty store
+func New(path string, retention, resolution time.Duration) *Store {
+	return &Store{}
+}
+
+// Run fails in minimal builds
+func (s *Store) Run(eventBus *bus.Bus, saveInterval time.Duration) error {
+	return errors.New("the history is not included in minimal builds")
+}
+
+// Save does nothing in minimal builds
+func (s *Store) Save() error {
+	return nil
+}
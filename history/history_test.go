@@ -0,0 +1,118 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+var start = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func TestRecord(t *testing.T) {
+	store := New("", time.Hour, time.Minute)
+	store.Record("operating_data", map[string]interface{}{
+		"boiler_temp": nbe.RoundedFloat(65.5),
+		"power_kw":    int64(12),
+		"state_text":  "Power",
+		"pump":        "ON",
+	}, start)
+	store.Record("operating_data", map[string]interface{}{"boiler_temp": nbe.RoundedFloat(66)}, start.Add(30*time.Second))
+	store.Record("operating_data", map[string]interface{}{"boiler_temp": nbe.RoundedFloat(67)}, start.Add(2*time.Minute))
+
+	series := store.Series()
+	expected := []string{"operating_data/boiler_temp", "operating_data/power_kw", "operating_data/pump"}
+	if len(series) != len(expected) {
+		t.Fatalf("Series() = %v, want %v", series, expected)
+	}
+	for i := range expected {
+		if series[i] != expected[i] {
+			t.Errorf("Series()[%d] = %s, want %s", i, series[i], expected[i])
+		}
+	}
+
+	points := store.Query("operating_data/boiler_temp", start, start.Add(time.Hour), 0)
+	if len(points) != 2 || points[0].Value != 66 || !points[0].Time.Equal(start) || points[1].Value != 67 {
+		t.Errorf("Expected the change within the resolution to replace the first point, got %v", points)
+	}
+	if points := store.Query("operating_data/pump", start, start, 0); len(points) != 1 || points[0].Value != 1 {
+		t.Errorf("Expected ON to be recorded as 1, got %v", points)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	store := New("", 24*time.Hour, time.Second)
+	for i := 0; i < 60; i++ {
+		store.Record("boiler", map[string]interface{}{"temp": int64(i)}, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	tests := []struct {
+		name      string
+		from, to  time.Time
+		maxPoints int
+		count     int
+		first     float64
+	}{
+		{"everything", start, start.Add(time.Hour), 0, 60, 0},
+		{"carries the value in effect", start.Add(90 * time.Second), start.Add(5 * time.Minute), 0, 5, 1},
+		{"from on a point", start.Add(time.Minute), start.Add(3 * time.Minute), 0, 3, 1},
+		{"between two points", start.Add(90 * time.Second), start.Add(100 * time.Second), 0, 1, 1},
+		{"before the first point", start.Add(-time.Hour), start.Add(-time.Minute), 0, 0, 0},
+		{"thinned", start, start.Add(time.Hour), 10, 10, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := store.Query("boiler/temp", tt.from, tt.to, tt.maxPoints)
+			if len(points) != tt.count {
+				t.Fatalf("Expected %d points, got %d: %v", tt.count, len(points), points)
+			}
+			if tt.count > 0 && points[0].Value != tt.first {
+				t.Errorf("Expected the first value %v, got %v", tt.first, points[0].Value)
+			}
+			if tt.count > 0 && points[0].Time.Before(tt.from) {
+				t.Errorf("Expected no point before %s, got %s", tt.from, points[0].Time)
+			}
+		})
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	store := New(path, time.Hour, time.Second)
+	store.now = func() time.Time { return start.Add(time.Hour + time.Minute) }
+	store.Record("boiler", map[string]interface{}{"temp": int64(60)}, start)
+	store.Record("boiler", map[string]interface{}{"temp": int64(65)}, start.Add(30*time.Minute))
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded := New(path, time.Hour, time.Second)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	points := loaded.Query("boiler/temp", start, start.Add(time.Hour), 0)
+	if len(points) != 1 || points[0].Value != 65 || !points[0].Time.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("Expected the point past the retention to be pruned, got %v", points)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homeassistant
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiscoveryTopicFilter matches every discovery topic published for a device
+func DiscoveryTopicFilter(deviceID string) string {
+	return fmt.Sprintf("homeassistant/+/nbe_%s/+/config", deviceID)
+}
+
+// FindDiscoveryTopics collects the retained discovery topics of a device that
+// the broker delivers within wait
+func FindDiscoveryTopics(mqttClient *mqtt.Client, deviceID string, wait time.Duration) ([]string, error) {
+	var mu sync.Mutex
+	found := make(map[string]bool)
+
+	if err := mqttClient.SubscribeTopic(DiscoveryTopicFilter(deviceID), 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		if len(msg.Payload()) == 0 {
+			return
+		}
+		mu.Lock()
+		found[msg.Topic()] = true
+		mu.Unlock()
+	}); err != nil {
+		return nil, err
+	}
+	time.Sleep(wait)
+
+	mu.Lock()
+	defer mu.Unlock()
+	topics := make([]string, 0, len(found))
+	for topic := range found {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// ClearDiscoveryTopics publishes empty retained payloads to the topics, so
+// Home Assistant removes the entities
+func ClearDiscoveryTopics(mqttClient *mqtt.Client, topics []string) {
+	for _, topic := range topics {
+		if err := mqttClient.PublishRaw(topic, ""); err != nil {
+			log.Errorf("Error removing discovery message %s: %v", topic, err)
+		}
+	}
+}
@@ -19,15 +19,22 @@ package homeassistant
 
 import (
 	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
 	log "github.com/sirupsen/logrus"
 )
 
-// PublishDiscovery sends Home Assistant MQTT discovery messages
-// Waits for data to be ready before publishing
-func PublishDiscovery(mqttClient *mqtt.Client, serial, prefix string, ready <-chan bool) {
-	log.Infof("Publishing Home Assistant discovery messages for %s", serial)
+// PublishDiscovery sends Home Assistant MQTT discovery messages for the given entities
+// Waits for data to be ready before publishing. Unique IDs are derived from
+// deviceID, which stays the same when the controller (and its serial) is replaced.
+func PublishDiscovery(mqttClient *mqtt.Client, deviceID, serial, prefix string, entities []EntityConfig, ready <-chan bool) {
+	log.Infof("Publishing Home Assistant discovery messages for %s", deviceID)
 
 	// Wait for initial data to be ready
 	if ready != nil {
@@ -36,28 +43,27 @@ func PublishDiscovery(mqttClient *mqtt.Client, serial, prefix string, ready <-ch
 		log.Debug("Initial data ready, publishing discovery messages")
 	}
 
-	devBlock := createDeviceBlock(serial)
+	devBlock := createDeviceBlock(deviceID, serial)
 
 	// Publish all entities
-	publishEntities(mqttClient, serial, prefix, devBlock)
+	publishEntities(mqttClient, deviceID, prefix, entities, devBlock)
 }
 
-func createDeviceBlock(serial string) map[string]interface{} {
+func createDeviceBlock(deviceID, serial string) map[string]interface{} {
 	return map[string]interface{}{
-		"ids":  []string{fmt.Sprintf("nbe_%s", serial)},
-		"name": fmt.Sprintf("NBE Boiler (%s)", serial),
+		"ids":  []string{fmt.Sprintf("nbe_%s", deviceID)},
+		"name": fmt.Sprintf("NBE Boiler (%s)", deviceID),
+		"sn":   serial,
 		"sw":   "boiler-mate",
 		"mf":   "NBE",
 		"sa":   "",
 	}
 }
 
-func publishEntities(mqttClient *mqtt.Client, serial, prefix string, devBlock map[string]interface{}) {
-	entities := AllEntities()
-
+func publishEntities(mqttClient *mqtt.Client, deviceID, prefix string, entities []EntityConfig, devBlock map[string]interface{}) {
 	for _, entity := range entities {
-		config := entity.Build(serial, prefix, devBlock)
-		topic := entity.GetDiscoveryTopic(serial)
+		config := entity.Build(deviceID, prefix, devBlock)
+		topic := entity.GetDiscoveryTopic(deviceID)
 
 		if err := mqttClient.PublishJSON(topic, config); err != nil {
 			log.Errorf("Error publishing discovery message for %s (%s): %v", entity.Name, entity.Key, err)
@@ -68,3 +74,141 @@ func publishEntities(mqttClient *mqtt.Client, serial, prefix string, devBlock ma
 
 	log.Infof("Published %d entity discovery messages", len(entities))
 }
+
+// FilterEntities splits entities into those matching the include and exclude
+// key patterns and those that were filtered out. An empty include list keeps
+// every entity. Patterns use path.Match syntax, e.g. "dhw_*".
+func FilterEntities(entities []EntityConfig, include, exclude []string) (kept, removed []EntityConfig) {
+	for _, entity := range entities {
+		if (len(include) == 0 || matchesAny(entity.Key, include)) && !matchesAny(entity.Key, exclude) {
+			kept = append(kept, entity)
+		} else {
+			removed = append(removed, entity)
+		}
+	}
+	return kept, removed
+}
+
+// ReadOnlyEntities replaces writable entities with sensors showing the same
+// state and drops buttons and climates. The originals are returned in removed
+// so their discovery messages can be cleared.
+func ReadOnlyEntities(entities []EntityConfig) (kept, removed []EntityConfig) {
+	for _, entity := range entities {
+		switch entity.EntityType {
+		case Button, Climate:
+			removed = append(removed, entity)
+		case Number, Switch, Select:
+			removed = append(removed, entity)
+			sensor := EntityConfig{
+				Key:             entity.Key,
+				Name:            entity.Name,
+				EntityType:      Sensor,
+				EntityCategory:  entity.EntityCategory,
+				DeviceClass:     entity.DeviceClass,
+				Icon:            entity.Icon,
+				Unit:            entity.Unit,
+				StateTopic:      entity.StateTopic,
+				Precision:       entity.Precision,
+				AttributesTopic: entity.AttributesTopic,
+				Disabled:        entity.Disabled,
+			}
+			if sensor.EntityCategory == "config" {
+				sensor.EntityCategory = "diagnostic"
+			}
+			if entity.EntityType == Switch {
+				sensor.DeviceClass = ""
+			}
+			kept = append(kept, sensor)
+		default:
+			kept = append(kept, entity)
+		}
+	}
+	return kept, removed
+}
+
+// WithSettingRanges sets the min, max and step of the number and climate
+// entities writing a setting to the range the controller reports for it, in
+// place of the built-in range, which does not match every boiler model.
+// ranges is keyed by "<group>.<name>", as returned by LoadSettingRanges.
+func WithSettingRanges(entities []EntityConfig, ranges map[string]nbe.SettingRange) []EntityConfig {
+	for i, entity := range entities {
+		if entity.EntityType != Number && entity.EntityType != Climate {
+			continue
+		}
+		setting, ok := ranges[strings.ReplaceAll(strings.TrimPrefix(entity.CommandTopic, "set/"), "/", ".")]
+		if !ok {
+			continue
+		}
+		entities[i].MinValue = float64(setting.Min)
+		entities[i].MaxValue = float64(setting.Max)
+		entities[i].Step = strconv.FormatFloat(math.Pow10(-int(setting.Decimals)), 'f', -1, 64)
+	}
+	return entities
+}
+
+// WithPipelines gives the entities of the keys whose pipeline converts or
+// rounds their values the converted unit, the rounded precision and, for
+// number and climate entities, the range and step in the published form. It
+// runs after WithSettingRanges, whose ranges are in the controller's units.
+func WithPipelines(entities []EntityConfig, pipelines *pipeline.Pipelines) []EntityConfig {
+	for i, entity := range entities {
+		if entity.StateTopic == "" || entity.StateTopic[0] == '/' {
+			continue
+		}
+		display, ok := pipelines.Display(entity.StateTopic)
+		if !ok {
+			continue
+		}
+		if display.Unit != "" {
+			entities[i].Unit = display.Unit
+		}
+		if display.Decimals >= 0 {
+			entities[i].Precision = display.Decimals
+		}
+		if entity.EntityType != Number && entity.EntityType != Climate {
+			continue
+		}
+		low, okLow := rangeEnd(entity.MinValue)
+		high, okHigh := rangeEnd(entity.MaxValue)
+		if okLow && okHigh {
+			low, high = pipelines.Range(entity.StateTopic, low, high)
+			entities[i].MinValue = low
+			entities[i].MaxValue = high
+		}
+		if display.Decimals >= 0 {
+			entities[i].Step = strconv.FormatFloat(math.Pow10(-display.Decimals), 'f', -1, 64)
+		}
+	}
+	return entities
+}
+
+// rangeEnd returns the minimum or maximum of an entity as a float
+func rangeEnd(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// RemoveEntities clears the retained discovery messages of the given entities,
+// so Home Assistant drops entities that are no longer announced
+func RemoveEntities(mqttClient *mqtt.Client, deviceID string, entities []EntityConfig) {
+	for _, entity := range entities {
+		topic := entity.GetDiscoveryTopic(deviceID)
+		if err := mqttClient.PublishRaw(topic, ""); err != nil {
+			log.Errorf("Error removing discovery message for %s (%s): %v", entity.Name, entity.Key, err)
+		}
+	}
+}
+
+func matchesAny(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -18,12 +18,17 @@
 package homeassistant
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
 )
 
 func TestCreateDeviceBlock(t *testing.T) {
 	serial := "TEST12345"
-	devBlock := createDeviceBlock(serial)
+	devBlock := createDeviceBlock(serial, serial)
 
 	// Check that device block has expected fields
 	if devBlock["sw"] != "boiler-mate" {
@@ -56,6 +61,20 @@ func TestCreateDeviceBlock(t *testing.T) {
 	}
 }
 
+func TestCreateDeviceBlockWithAlias(t *testing.T) {
+	devBlock := createDeviceBlock("home", "TEST12345")
+
+	if ids := devBlock["ids"].([]string); ids[0] != "nbe_home" {
+		t.Errorf("Expected id='nbe_home', got '%s'", ids[0])
+	}
+	if devBlock["name"] != "NBE Boiler (home)" {
+		t.Errorf("Expected name='NBE Boiler (home)', got '%v'", devBlock["name"])
+	}
+	if devBlock["sn"] != "TEST12345" {
+		t.Errorf("Expected sn='TEST12345', got '%v'", devBlock["sn"])
+	}
+}
+
 func TestPublishSensorsCreatesCorrectTopics(t *testing.T) {
 	// This is more of an integration test, but we can at least verify
 	// that the function doesn't panic and creates expected sensor configs
@@ -65,7 +84,7 @@ func TestPublishSensorsCreatesCorrectTopics(t *testing.T) {
 
 	serial := "TEST12345"
 	prefix := "nbe/TEST12345"
-	devBlock := createDeviceBlock(serial)
+	devBlock := createDeviceBlock(serial, serial)
 
 	// These are the sensors we expect to be created
 	expectedSensors := []string{
@@ -155,7 +174,7 @@ func TestPublishSwitchesCreatesCorrectTopics(t *testing.T) {
 func TestEntityConfigBuildUsesNativeStepForTemperature(t *testing.T) {
 	serial := "TEST12345"
 	prefix := "nbe/TEST12345"
-	devBlock := createDeviceBlock(serial)
+	devBlock := createDeviceBlock(serial, serial)
 
 	// Test temperature entity
 	tempEntity := EntityConfig{
@@ -210,3 +229,479 @@ func TestEntityConfigBuildUsesNativeStepForTemperature(t *testing.T) {
 		t.Errorf("Expected max=100 for percentage entity, got %v", config["max"])
 	}
 }
+
+func TestConsumptionEntitiesUseEnergyDashboardClasses(t *testing.T) {
+	serial := "TEST12345"
+	prefix := "nbe/TEST12345"
+	devBlock := createDeviceBlock(serial, serial)
+
+	for _, entity := range ConsumptionEntities() {
+		config := entity.Build(serial, prefix, devBlock)
+
+		if config["state_class"] != "total_increasing" {
+			t.Errorf("Expected state_class=total_increasing for %s, got %v", entity.Key, config["state_class"])
+		}
+		if _, ok := config["device_class"]; !ok {
+			t.Errorf("Expected device_class to be set for %s", entity.Key)
+		}
+	}
+}
+
+func TestEfficiencyEntityAttributes(t *testing.T) {
+	entity := EfficiencyEntities()[0]
+	config := entity.Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+
+	if config["stat_t"] != "nbe/TEST/efficiency/today" {
+		t.Errorf("Unexpected state topic %v", config["stat_t"])
+	}
+	if config["json_attr_t"] != "nbe/TEST/efficiency/attributes" {
+		t.Errorf("Unexpected attributes topic %v", config["json_attr_t"])
+	}
+}
+
+func TestEntityOverrides(t *testing.T) {
+	SetOverrides(map[string]config.EntityOverride{
+		"dhw_temp_sensor": {Name: "Hot Water Tank", Icon: "mdi:water-boiler"},
+		"power_kw":        {DeviceClass: "energy"},
+	})
+	t.Cleanup(func() { SetOverrides(nil) })
+
+	entity := EntityConfig{Key: "dhw_temp_sensor", Name: "DHW Temperature", EntityType: Sensor, DeviceClass: "temperature", Unit: "°C"}
+	built := entity.Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+	if built["name"] != "Hot Water Tank" || built["ic"] != "mdi:water-boiler" {
+		t.Errorf("Expected the overridden name and icon, got %v and %v", built["name"], built["ic"])
+	}
+	if built["device_class"] != "temperature" || built["native_unit_of_measurement"] != "°C" {
+		t.Errorf("Expected the device class to be kept, got %v", built["device_class"])
+	}
+	if entity.Name != "DHW Temperature" {
+		t.Errorf("Expected the entity itself to be left unchanged, got %q", entity.Name)
+	}
+
+	entity = EntityConfig{Key: "power_kw", Name: "Power", EntityType: Sensor, DeviceClass: "power", Unit: "kW"}
+	if built := entity.Build("TEST", "nbe/TEST", nil); built["device_class"] != "energy" || built["name"] != "Power" {
+		t.Errorf("Expected only the device class to be overridden, got %v and %v", built["device_class"], built["name"])
+	}
+}
+
+func TestEntitySourceAvailability(t *testing.T) {
+	SetSources([]string{"operating_data", "settings"})
+	t.Cleanup(func() { SetSources(nil) })
+
+	tests := []struct {
+		topic  string
+		source string
+	}{
+		{"operating_data/boiler_temp", "operating_data"},
+		{"boiler/temp", "settings"},
+		{"district_heating/temp", "settings"},
+		{"advanced_data/fan_speed", ""},
+		{"profile/active", ""},
+		{"/absolute/topic", ""},
+	}
+	for _, tt := range tests {
+		entity := EntityConfig{Key: "test", Name: "Test", EntityType: Sensor, StateTopic: tt.topic}
+		built := entity.Build("TEST", "nbe/TEST", nil)
+		if tt.source == "" {
+			if built["avty_t"] != "nbe/TEST/device/status" || built["avty"] != nil {
+				t.Errorf("%s: expected only the bridge status, got %v and %v", tt.topic, built["avty_t"], built["avty"])
+			}
+			continue
+		}
+		availability, ok := built["avty"].([]map[string]string)
+		if !ok || len(availability) != 2 || availability[1]["t"] != "nbe/TEST/device/status/"+tt.source || built["avty_mode"] != "all" {
+			t.Errorf("%s: expected the bridge and %s status, got %v", tt.topic, tt.source, built["avty"])
+		}
+		if _, ok := built["avty_t"]; ok {
+			t.Errorf("%s: expected avty_t to be replaced", tt.topic)
+		}
+	}
+}
+
+func TestProfileEntityBuildsSelect(t *testing.T) {
+	entity := ProfileEntities([]string{"comfort", "eco"})[0]
+	built := entity.Build("TEST", "nbe/TEST", nil)
+	if options, ok := built["options"].([]string); !ok || len(options) != 2 || options[0] != "comfort" {
+		t.Errorf("Expected the profile names as options, got %v", built["options"])
+	}
+	if built["stat_t"] != "nbe/TEST/profile/active" || built["cmd_t"] != "nbe/TEST/profile/set" {
+		t.Errorf("Unexpected topics %v and %v", built["stat_t"], built["cmd_t"])
+	}
+	if entity.GetDiscoveryTopic("TEST") != "homeassistant/select/nbe_TEST/profile/config" {
+		t.Errorf("Unexpected discovery topic %s", entity.GetDiscoveryTopic("TEST"))
+	}
+
+	kept, _ := ReadOnlyEntities([]EntityConfig{entity})
+	if len(kept) != 1 || kept[0].EntityType != Sensor {
+		t.Errorf("Expected a sensor in read-only mode, got %+v", kept)
+	}
+}
+
+func TestFilterEntities(t *testing.T) {
+	entities := []EntityConfig{
+		{Key: "boiler_temp"},
+		{Key: "oxygen"},
+		{Key: "photo_level"},
+		{Key: "dhw_setpoint"},
+		{Key: "dhw_diff_under"},
+	}
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{"no filters", nil, nil, []string{"boiler_temp", "oxygen", "photo_level", "dhw_setpoint", "dhw_diff_under"}},
+		{"exclude keys", nil, []string{"photo_level", "oxygen"}, []string{"boiler_temp", "dhw_setpoint", "dhw_diff_under"}},
+		{"include pattern", []string{"dhw_*"}, nil, []string{"dhw_setpoint", "dhw_diff_under"}},
+		{"include and exclude", []string{"dhw_*"}, []string{"*_diff_*"}, []string{"dhw_setpoint"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, removed := FilterEntities(entities, tt.include, tt.exclude)
+
+			if len(kept) != len(tt.expected) {
+				t.Fatalf("Expected %d entities, got %d", len(tt.expected), len(kept))
+			}
+			for i, key := range tt.expected {
+				if kept[i].Key != key {
+					t.Errorf("Expected entity %d to be %s, got %s", i, key, kept[i].Key)
+				}
+			}
+			if len(kept)+len(removed) != len(entities) {
+				t.Errorf("Expected kept+removed=%d, got %d", len(entities), len(kept)+len(removed))
+			}
+		})
+	}
+}
+
+func TestReadOnlyEntities(t *testing.T) {
+	entities := []EntityConfig{
+		{Key: "boiler_temp", EntityType: Sensor, StateTopic: "operating_data/boiler_temp"},
+		{Key: "boiler_setpoint", EntityType: Number, EntityCategory: "config", DeviceClass: "temperature", StateTopic: "settings/boiler/temp", CommandTopic: "set/boiler/temp", MinValue: 40},
+		{Key: "pump_startup", EntityType: Switch, DeviceClass: "switch", StateTopic: "settings/pump/startup", CommandTopic: "set/pump/startup"},
+		{Key: "start_boiler", EntityType: Button, CommandTopic: "set/misc/start"},
+		{Key: "dhw", EntityType: Climate},
+	}
+
+	kept, removed := ReadOnlyEntities(entities)
+
+	if len(kept) != 3 || len(removed) != 4 {
+		t.Fatalf("Expected 3 kept and 4 removed entities, got %d and %d", len(kept), len(removed))
+	}
+	for _, entity := range kept {
+		if entity.EntityType != Sensor || entity.CommandTopic != "" {
+			t.Errorf("Entity %s is writable: %+v", entity.Key, entity)
+		}
+	}
+	if setpoint := kept[1]; setpoint.EntityCategory != "diagnostic" || setpoint.DeviceClass != "temperature" || setpoint.StateTopic != "settings/boiler/temp" {
+		t.Errorf("Unexpected read-only setpoint %+v", setpoint)
+	}
+	if kept[2].DeviceClass != "" {
+		t.Errorf("Expected the switch device class to be dropped, got %q", kept[2].DeviceClass)
+	}
+}
+
+func TestUpdateEntityPublishesLatestVersionTopic(t *testing.T) {
+	serial := "TEST12345"
+	prefix := "nbe/TEST12345"
+	devBlock := createDeviceBlock(serial, serial)
+
+	entity := EntityConfig{
+		Key:         "firmware",
+		Name:        "Controller Firmware",
+		EntityType:  Update,
+		StateTopic:  "firmware/installed_version",
+		LatestTopic: "firmware/latest_version",
+	}
+	config := entity.Build(serial, prefix, devBlock)
+
+	if config["stat_t"] != "nbe/TEST12345/firmware/installed_version" {
+		t.Errorf("Expected installed version state topic, got %v", config["stat_t"])
+	}
+	if config["latest_version_topic"] != "nbe/TEST12345/firmware/latest_version" {
+		t.Errorf("Expected latest version topic, got %v", config["latest_version_topic"])
+	}
+	if topic := entity.GetDiscoveryTopic(serial); topic != "homeassistant/update/nbe_TEST12345/firmware/config" {
+		t.Errorf("Unexpected discovery topic %s", topic)
+	}
+}
+
+func TestOutputEntitiesBuildBinarySensors(t *testing.T) {
+	serial := "TEST12345"
+	prefix := "nbe/TEST12345"
+	devBlock := createDeviceBlock(serial, serial)
+
+	entities := OutputEntities()
+	if len(entities) != len(nbe.Outputs) {
+		t.Fatalf("Expected %d output entities, got %d", len(nbe.Outputs), len(entities))
+	}
+	for _, entity := range entities {
+		if entity.Icon == "" {
+			t.Errorf("Output entity %s has no icon", entity.Key)
+		}
+	}
+
+	entity := entities[0]
+	config := entity.Build(serial, prefix, devBlock)
+	if config["stat_t"] != "nbe/TEST12345/advanced_data/output_exhaust_fan" {
+		t.Errorf("Unexpected state topic %v", config["stat_t"])
+	}
+	if config["payload_on"] != "ON" || config["payload_off"] != "OFF" {
+		t.Errorf("Expected ON/OFF payloads, got %v/%v", config["payload_on"], config["payload_off"])
+	}
+	if config["device_class"] != "running" {
+		t.Errorf("Expected running device class, got %v", config["device_class"])
+	}
+	if topic := entity.GetDiscoveryTopic(serial); topic != "homeassistant/binary_sensor/nbe_TEST12345/output_exhaust_fan/config" {
+		t.Errorf("Unexpected discovery topic %s", topic)
+	}
+
+	kept, removed := ReadOnlyEntities(entities)
+	if len(kept) != len(entities) || len(removed) != 0 {
+		t.Errorf("Expected read-only mode to keep binary sensors, kept %d removed %d", len(kept), len(removed))
+	}
+}
+
+func TestFieldEntitiesSkipCoveredTopics(t *testing.T) {
+	entities := FieldEntities(AllEntities())
+
+	keys := make(map[string]EntityConfig)
+	for _, entity := range entities {
+		keys[entity.Key] = entity
+		if !entity.Disabled {
+			t.Errorf("Expected generated entity %s to be disabled by default", entity.Key)
+		}
+	}
+
+	if _, ok := keys["operating_data_boiler_temp"]; ok {
+		t.Error("Expected boiler_temp to be skipped, it is already published")
+	}
+	shaft, ok := keys["operating_data_shaft_temp"]
+	if !ok {
+		t.Fatal("Expected a generated shaft_temp sensor")
+	}
+	if shaft.Unit != "°C" || shaft.DeviceClass != "temperature" || shaft.StateClass != "measurement" {
+		t.Errorf("Unexpected shaft_temp entity: %+v", shaft)
+	}
+	if _, ok := keys["advanced_data_fan_speed"]; !ok {
+		t.Error("Expected a generated advanced_data fan_speed sensor")
+	}
+
+	config := shaft.Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+	if config["enabled_by_default"] != false {
+		t.Errorf("Expected enabled_by_default=false, got %v", config["enabled_by_default"])
+	}
+}
+
+func TestEntityUnitsMatchFieldDictionary(t *testing.T) {
+	for _, entity := range AllEntities() {
+		name := strings.TrimPrefix(entity.StateTopic, "operating_data/")
+		field, ok := nbe.OperatingFields[name]
+		if name == entity.StateTopic || !ok {
+			continue
+		}
+		if entity.Unit != field.Unit {
+			t.Errorf("Entity %s has unit %q, field dictionary says %q", entity.Key, entity.Unit, field.Unit)
+		}
+	}
+}
+
+func TestCircuitEntitiesMatchSchemaAndFields(t *testing.T) {
+	schema := nbe.DefaultSettingSchema()
+	keys := make(map[string]bool)
+	for _, entity := range CircuitEntities() {
+		if keys[entity.Key] {
+			t.Errorf("Duplicate entity key %s", entity.Key)
+		}
+		keys[entity.Key] = true
+
+		if entity.CommandTopic != "" {
+			setting, ok := schema[strings.ReplaceAll(strings.TrimPrefix(entity.CommandTopic, "set/"), "/", ".")]
+			if !ok {
+				t.Errorf("Entity %s writes %s, which is not in the setting schema", entity.Key, entity.CommandTopic)
+			} else if entity.MinValue != int(setting.Min) || entity.MaxValue != int(setting.Max) {
+				t.Errorf("Entity %s range %v..%v, schema allows %v..%v", entity.Key, entity.MinValue, entity.MaxValue, setting.Min, setting.Max)
+			}
+			continue
+		}
+		name := strings.TrimPrefix(entity.StateTopic, "operating_data/")
+		field, ok := nbe.OperatingFields[name]
+		if !ok {
+			t.Errorf("Entity %s reads %s, which is not in the field dictionary", entity.Key, entity.StateTopic)
+		} else if entity.Unit != field.Unit {
+			t.Errorf("Entity %s has unit %q, field dictionary says %q", entity.Key, entity.Unit, field.Unit)
+		}
+	}
+}
+
+func TestAuxHeaterEntitiesBuild(t *testing.T) {
+	schema := nbe.DefaultSettingSchema()
+	for _, entity := range AuxHeaterEntities() {
+		config := entity.Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+		switch entity.EntityType {
+		case Switch:
+			if _, ok := schema[strings.ReplaceAll(strings.TrimPrefix(entity.CommandTopic, "set/"), "/", ".")]; !ok {
+				t.Errorf("Entity %s writes %s, which is not in the setting schema", entity.Key, entity.CommandTopic)
+			}
+			if config["state_topic"] != "nbe/TEST/aux_heater/active" || config["cmd_t"] != "nbe/TEST/set/aux_heater/active" {
+				t.Errorf("Unexpected switch topics %v/%v", config["state_topic"], config["cmd_t"])
+			}
+			fallthrough
+		case BinarySensor:
+			if config["payload_on"] != "1" || config["payload_off"] != "0" {
+				t.Errorf("Entity %s expected 1/0 payloads, got %v/%v", entity.Key, config["payload_on"], config["payload_off"])
+			}
+		}
+	}
+}
+
+func TestHydronicEntities(t *testing.T) {
+	if entities := HydronicEntities(false); len(entities) != 1 || entities[0].StateTopic != "hydronic/delta_t" {
+		t.Errorf("Expected only the delta-T sensor without a flow rate, got %+v", entities)
+	}
+	config := HydronicEntities(true)[0].Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+	// a temperature device class would make Home Assistant convert the
+	// difference like an absolute temperature
+	if config["device_class"] != nil || config["unit_of_measurement"] != "K" {
+		t.Errorf("Expected the delta-T in K without a device class, got %v", config)
+	}
+	if len(HydronicEntities(true)) != 2 {
+		t.Error("Expected the transferred heat sensor with a flow rate")
+	}
+}
+
+func TestDHWClimateEntityBuild(t *testing.T) {
+	entities := DHWClimateEntities(true)
+	if len(entities) != 1 {
+		t.Fatalf("Expected one climate entity, got %d", len(entities))
+	}
+	climate := entities[0]
+	if topic := climate.GetDiscoveryTopic("TEST"); topic != "homeassistant/climate/nbe_TEST/dhw_climate/config" {
+		t.Errorf("Unexpected discovery topic %s", topic)
+	}
+
+	config := climate.Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+	expected := map[string]interface{}{
+		"temperature_state_topic":   "nbe/TEST/hot_water/temp",
+		"temperature_command_topic": "nbe/TEST/set/hot_water/temp",
+		"current_temperature_topic": "nbe/TEST/operating_data/dhw_temp",
+		"preset_mode_state_topic":   "nbe/TEST/scheduler/dhw_boost/preset",
+		"preset_mode_command_topic": "nbe/TEST/scheduler/dhw_boost/preset/set",
+		"min_temp":                  0,
+		"max_temp":                  85,
+	}
+	for key, value := range expected {
+		if config[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, config[key])
+		}
+	}
+	if _, ok := config["stat_t"]; ok {
+		t.Error("Expected climate entity not to use stat_t")
+	}
+
+	config = DHWClimateEntities(false)[0].Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+	if _, ok := config["preset_modes"]; ok {
+		t.Error("Expected no presets without DHW boost")
+	}
+}
+
+func TestDiscoveryTopicFilter(t *testing.T) {
+	filter := DiscoveryTopicFilter("home")
+	if filter != "homeassistant/+/nbe_home/+/config" {
+		t.Errorf("Unexpected filter %q", filter)
+	}
+
+	// every published topic must match the filter
+	filterParts := strings.Split(filter, "/")
+	for _, entity := range AllEntities() {
+		parts := strings.Split(entity.GetDiscoveryTopic("home"), "/")
+		if len(parts) != len(filterParts) {
+			t.Fatalf("Topic %v doesn't match filter %s", parts, filter)
+		}
+		for i, part := range filterParts {
+			if part != "+" && part != parts[i] {
+				t.Errorf("Topic %v doesn't match filter %s", parts, filter)
+			}
+		}
+	}
+}
+
+func TestMaintenanceEntitiesMatchSchema(t *testing.T) {
+	schema := nbe.DefaultSettingSchema()
+	if got := len(MaintenanceEntities(false)); got != 2 {
+		t.Errorf("Expected 2 buttons without destructive actions, got %d", got)
+	}
+	for _, entity := range MaintenanceEntities(true) {
+		key := strings.ReplaceAll(strings.TrimPrefix(entity.CommandTopic, "set/"), "/", ".")
+		setting, ok := schema[key]
+		if !ok {
+			t.Errorf("Entity %s writes %s, which is not in the setting schema", entity.Key, entity.CommandTopic)
+			continue
+		}
+		if err := setting.Validate([]byte(entity.PayloadPress)); err != nil {
+			t.Errorf("Entity %s presses %q: %v", entity.Key, entity.PayloadPress, err)
+		}
+	}
+}
+
+func TestWithSettingRanges(t *testing.T) {
+	ranges := map[string]nbe.SettingRange{
+		"boiler.temp":     {Min: 20, Max: 90, Decimals: 0},
+		"hot_water.temp":  {Min: 40, Max: 70, Decimals: 1},
+		"regulation.none": {Min: 0, Max: 1},
+	}
+	entities := WithSettingRanges(append(AllEntities(), DHWClimateEntities(false)...), ranges)
+
+	for _, entity := range entities {
+		switch {
+		case entity.Key == "boiler_setpoint":
+			if entity.MinValue != 20.0 || entity.MaxValue != 90.0 || entity.Step != "1" {
+				t.Errorf("Unexpected boiler setpoint range %v..%v step %s", entity.MinValue, entity.MaxValue, entity.Step)
+			}
+		case entity.CommandTopic == "set/hot_water/temp":
+			if entity.MinValue != 40.0 || entity.MaxValue != 70.0 || entity.Step != "0.1" {
+				t.Errorf("Unexpected %s range %v..%v step %s", entity.Key, entity.MinValue, entity.MaxValue, entity.Step)
+			}
+		case entity.Key == "boiler_power_min":
+			if entity.MinValue != 10 || entity.MaxValue != 100 {
+				t.Errorf("Expected settings the controller did not report to keep their range, got %v..%v", entity.MinValue, entity.MaxValue)
+			}
+		}
+	}
+}
+
+func TestWithPipelines(t *testing.T) {
+	round := 0
+	pipelines := pipeline.New(map[string][]config.PipelineStep{
+		"operating_data/boiler_temp": {{Convert: "c_to_f"}},
+		"hot_water/temp":             {{Convert: "c_to_f"}, {Round: &round}},
+	})
+	entities := WithPipelines(append(AllEntities(), DHWClimateEntities(false)...), pipelines)
+
+	for _, entity := range entities {
+		switch entity.StateTopic {
+		case "operating_data/boiler_temp":
+			if entity.Unit != "°F" || entity.Precision != 2 {
+				t.Errorf("Expected %s in °F keeping its precision, got %s with %d", entity.Key, entity.Unit, entity.Precision)
+			}
+		case "hot_water/temp":
+			if entity.MinValue != 32.0 || entity.MaxValue != 185.0 || entity.Step != "1" || entity.Precision != 0 {
+				t.Errorf("Unexpected %s range %v..%v step %s", entity.Key, entity.MinValue, entity.MaxValue, entity.Step)
+			}
+			if entity.EntityType != Climate {
+				continue
+			}
+			config := entity.Build("TEST", "nbe/TEST", createDeviceBlock("TEST", "TEST"))
+			if config["temperature_unit"] != "F" || config["unit_of_measurement"] != nil {
+				t.Errorf("Expected the climate entity in Fahrenheit, got %v", config)
+			}
+		case "boiler/temp":
+			if entity.Unit != "°C" || entity.MinValue != 0 {
+				t.Errorf("Expected %s without a pipeline unchanged, got %s from %v", entity.Key, entity.Unit, entity.MinValue)
+			}
+		}
+	}
+}
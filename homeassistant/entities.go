@@ -17,6 +17,12 @@
 
 package homeassistant
 
+import (
+	"fmt"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
 // AllEntities returns all entity configurations for NBE boiler
 func AllEntities() []EntityConfig {
 	return []EntityConfig{
@@ -35,6 +41,18 @@ func AllEntities() []EntityConfig {
 			EntityCategory: "diagnostic",
 			StateTopic:     "device/serial",
 		},
+		{
+			Key:             "publish_latency",
+			Name:            "Publish Latency",
+			EntityType:      Sensor,
+			EntityCategory:  "diagnostic",
+			StateClass:      "measurement",
+			Unit:            "ms",
+			Icon:            "mdi:timer-sand",
+			Precision:       1,
+			StateTopic:      "bridge/latency/publish_ms",
+			AttributesTopic: "bridge/latency/attributes",
+		},
 		{
 			Key:            "boiler_temp",
 			Name:           "Boiler Temperature",
@@ -269,7 +287,16 @@ func AllEntities() []EntityConfig {
 			EntityCategory: "config",
 			Icon:           "mdi:air-filter",
 			StateTopic:     "oxygen/start_calibrate",
-			CommandTopic:   "set/oxygen/start_calibrate",
+			CommandTopic:   "calibration/oxygen/start",
+			PayloadPress:   "1",
+		},
+		{
+			Key:            "refresh",
+			Name:           "Refresh",
+			EntityType:     Button,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:refresh",
+			CommandTopic:   "refresh",
 			PayloadPress:   "1",
 		},
 
@@ -283,5 +310,778 @@ func AllEntities() []EntityConfig {
 			StateTopic:     "operating_data/state_on",
 			CommandTopic:   "set/device/power_switch",
 		},
+
+		// Updates
+		{
+			Key:            "firmware",
+			Name:           "Controller Firmware",
+			EntityType:     Update,
+			EntityCategory: "diagnostic",
+			DeviceClass:    "firmware",
+			StateTopic:     "firmware/installed_version",
+			LatestTopic:    "firmware/latest_version",
+		},
+	}
+}
+
+// ConsumptionEntities returns the pellet consumption sensors used by the Home
+// Assistant energy dashboard
+func ConsumptionEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:         "pellets_consumed",
+			Name:        "Pellets Consumed",
+			EntityType:  Sensor,
+			DeviceClass: "weight",
+			StateClass:  "total_increasing",
+			Unit:        "kg",
+			Icon:        "mdi:grain",
+			Precision:   1,
+			StateTopic:  "consumption/pellets_kg",
+		},
+		{
+			Key:         "pellet_energy",
+			Name:        "Pellet Energy",
+			EntityType:  Sensor,
+			DeviceClass: "energy",
+			StateClass:  "total_increasing",
+			Unit:        "kWh",
+			Precision:   1,
+			StateTopic:  "consumption/energy_kwh",
+		},
+	}
+}
+
+// EfficiencyEntities returns the daily boiler efficiency sensor, with the
+// previous day's efficiency among its attributes
+func EfficiencyEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:             "efficiency_today",
+			Name:            "Boiler Efficiency Today",
+			EntityType:      Sensor,
+			StateClass:      "measurement",
+			Unit:            "%",
+			Icon:            "mdi:gauge",
+			Precision:       1,
+			StateTopic:      "efficiency/today",
+			AttributesTopic: "efficiency/attributes",
+		},
+	}
+}
+
+// CombustionEntities returns the combustion quality sensors, with the
+// reasons for degraded combustion among the attributes of its binary sensor
+func CombustionEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:        "excess_air",
+			Name:       "Excess Air Ratio",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Icon:       "mdi:weather-windy",
+			Precision:  2,
+			StateTopic: "combustion/excess_air",
+		},
+		{
+			Key:        "smoke_ratio",
+			Name:       "Flue Gas Temperature per kW",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "°C/kW",
+			Icon:       "mdi:chart-bell-curve-cumulative",
+			Precision:  1,
+			StateTopic: "combustion/smoke_ratio",
+		},
+		{
+			Key:             "combustion_degraded",
+			Name:            "Combustion Degraded",
+			EntityType:      BinarySensor,
+			DeviceClass:     "problem",
+			StateTopic:      "combustion/degraded",
+			AttributesTopic: "combustion/attributes",
+		},
+	}
+}
+
+// HydronicEntities returns the delta-T sensor and, with a flow rate, the
+// transferred heat sensor
+func HydronicEntities(heat bool) []EntityConfig {
+	entities := []EntityConfig{
+		{
+			Key:        "delta_t",
+			Name:       "Supply/Return Delta-T",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "K",
+			Icon:       "mdi:thermometer-lines",
+			Precision:  1,
+			StateTopic: "hydronic/delta_t",
+		},
+	}
+	if heat {
+		entities = append(entities, EntityConfig{
+			Key:         "transferred_heat",
+			Name:        "Transferred Heat",
+			EntityType:  Sensor,
+			DeviceClass: "power",
+			StateClass:  "measurement",
+			Unit:        "kW",
+			Precision:   2,
+			StateTopic:  "hydronic/heat_kw",
+		})
+	}
+	return entities
+}
+
+// DegreeDayEntities returns the heating degree-day sensors, with the previous
+// day's inputs among the attributes of the pellets per degree-day sensor
+func DegreeDayEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:        "degree_days_today",
+			Name:       "Heating Degree Days Today",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "°C·d",
+			Icon:       "mdi:thermometer-low",
+			Precision:  1,
+			StateTopic: "degree_days/today",
+		},
+		{
+			Key:        "degree_days_yesterday",
+			Name:       "Heating Degree Days Yesterday",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "°C·d",
+			Icon:       "mdi:thermometer-low",
+			Precision:  1,
+			StateTopic: "degree_days/yesterday",
+		},
+		{
+			Key:             "pellets_per_degree_day",
+			Name:            "Pellets per Degree Day",
+			EntityType:      Sensor,
+			StateClass:      "measurement",
+			Unit:            "kg/°C·d",
+			Icon:            "mdi:grain",
+			Precision:       2,
+			StateTopic:      "degree_days/kg_per_hdd",
+			AttributesTopic: "degree_days/attributes",
+		},
+		{
+			Key:        "estimated_efficiency_yesterday",
+			Name:       "Estimated Efficiency Yesterday",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "%",
+			Icon:       "mdi:gauge",
+			Precision:  1,
+			StateTopic: "degree_days/efficiency",
+		},
+	}
+}
+
+// DeriveEntities returns the sensors derived from the raw counters
+func DeriveEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:        "feed_rate",
+			Name:       "Pellet Feed Rate",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "g/min",
+			Icon:       "mdi:grain",
+			Precision:  1,
+			StateTopic: "derived/feed_rate",
+		},
+		{
+			Key:        "auger_duty_cycle",
+			Name:       "Auger Duty Cycle",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "%",
+			Icon:       "mdi:screw-lag",
+			Precision:  1,
+			StateTopic: "derived/auger_duty_cycle",
+		},
+		{
+			Key:        "auger_cycles_per_hour",
+			Name:       "Auger Cycles per Hour",
+			EntityType: Sensor,
+			StateClass: "measurement",
+			Unit:       "cycles/h",
+			Icon:       "mdi:rotate-right",
+			StateTopic: "derived/auger_cycles_per_hour",
+		},
+		{
+			Key:             "ignitions_today",
+			Name:            "Ignitions Today",
+			EntityType:      Sensor,
+			StateClass:      "total_increasing",
+			Icon:            "mdi:fire",
+			StateTopic:      "derived/ignitions_today",
+			AttributesTopic: "derived/attributes",
+		},
+		{
+			Key:         "hopper_last_fill",
+			Name:        "Last Hopper Fill",
+			EntityType:  Sensor,
+			DeviceClass: "timestamp",
+			Icon:        "mdi:basket-fill",
+			StateTopic:  "derived/hopper_last_fill",
+		},
+	}
+}
+
+// DHWBoostEntities returns the controls and sensor for the scheduler's DHW boost
+func DHWBoostEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:          "dhw_boost_start",
+			Name:         "DHW Boost",
+			EntityType:   Button,
+			Icon:         "mdi:water-boiler",
+			CommandTopic: "scheduler/dhw_boost/start",
+			PayloadPress: "1",
+		},
+		{
+			Key:          "dhw_boost_cancel",
+			Name:         "Cancel DHW Boost",
+			EntityType:   Button,
+			Icon:         "mdi:water-boiler-off",
+			CommandTopic: "scheduler/dhw_boost/cancel",
+			PayloadPress: "1",
+		},
+		{
+			Key:            "dhw_boost_delta",
+			Name:           "DHW Boost Delta",
+			EntityType:     Number,
+			EntityCategory: "config",
+			DeviceClass:    "temperature",
+			Unit:           "°C",
+			Mode:           "box",
+			MinValue:       1,
+			MaxValue:       30,
+			Step:           "1",
+			StateTopic:     "scheduler/dhw_boost/delta",
+			CommandTopic:   "scheduler/dhw_boost/delta/set",
+		},
+		{
+			Key:            "dhw_boost_duration",
+			Name:           "DHW Boost Duration",
+			EntityType:     Number,
+			EntityCategory: "config",
+			Unit:           "min",
+			Mode:           "box",
+			MinValue:       5,
+			MaxValue:       240,
+			Step:           "5",
+			StateTopic:     "scheduler/dhw_boost/duration",
+			CommandTopic:   "scheduler/dhw_boost/duration/set",
+		},
+		{
+			Key:         "dhw_boost_remaining",
+			Name:        "DHW Boost Remaining",
+			EntityType:  Sensor,
+			DeviceClass: "duration",
+			Unit:        "min",
+			Icon:        "mdi:timer-sand",
+			StateTopic:  "scheduler/dhw_boost/remaining",
+		},
+	}
+}
+
+// DHWClimateEntities returns a climate entity for the hot water, with the
+// target temperature from hot_water.temp and the measured DHW temperature.
+// With boost enabled, the scheduler's DHW boost is offered as the "boost" preset.
+func DHWClimateEntities(boost bool) []EntityConfig {
+	climate := EntityConfig{
+		Key:                     "dhw_climate",
+		Name:                    "Hot Water",
+		EntityType:              Climate,
+		Icon:                    "mdi:water-boiler",
+		MinValue:                0,
+		MaxValue:                85,
+		Step:                    "1",
+		StateTopic:              "hot_water/temp",
+		CommandTopic:            "set/hot_water/temp",
+		CurrentTemperatureTopic: "operating_data/dhw_temp",
+	}
+	if boost {
+		climate.PresetModes = []string{"boost"}
+		climate.PresetTopic = "scheduler/dhw_boost/preset"
+	}
+	return []EntityConfig{climate}
+}
+
+// NightSetbackEntities returns the switch arming the scheduler's night setback
+func NightSetbackEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "night_setback",
+			Name:           "Night Setback",
+			EntityType:     Switch,
+			EntityCategory: "config",
+			Icon:           "mdi:weather-night",
+			StateTopic:     "scheduler/night_setback/enabled",
+			CommandTopic:   "scheduler/night_setback/enabled/set",
+		},
+	}
+}
+
+// PreheatEntities returns the switch and sensors of the forecast preheat
+func PreheatEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "preheat",
+			Name:           "Forecast Preheat",
+			EntityType:     Switch,
+			EntityCategory: "config",
+			Icon:           "mdi:snowflake-thermometer",
+			StateTopic:     "scheduler/preheat/enabled",
+			CommandTopic:   "scheduler/preheat/enabled/set",
+		},
+		{
+			Key:        "preheat_active",
+			Name:       "Forecast Preheat Active",
+			EntityType: BinarySensor,
+			Icon:       "mdi:snowflake-thermometer",
+			StateTopic: "scheduler/preheat/active",
+		},
+		{
+			Key:         "preheat_forecast_min",
+			Name:        "Forecast Minimum Temperature",
+			EntityType:  Sensor,
+			DeviceClass: "temperature",
+			StateClass:  "measurement",
+			Unit:        "°C",
+			StateTopic:  "scheduler/preheat/forecast_min",
+		},
+	}
+}
+
+// BurstEntities returns the buttons starting and ending fast polling of the
+// operating data and the sensors showing it
+func BurstEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "burst_start",
+			Name:           "Start Burst Polling",
+			EntityType:     Button,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:chart-bell-curve",
+			CommandTopic:   "burst/start",
+			PayloadPress:   "0",
+		},
+		{
+			Key:            "burst_cancel",
+			Name:           "Stop Burst Polling",
+			EntityType:     Button,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:chart-line",
+			CommandTopic:   "burst/cancel",
+			PayloadPress:   "1",
+		},
+		{
+			Key:            "burst_active",
+			Name:           "Burst Polling",
+			EntityType:     BinarySensor,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:chart-bell-curve",
+			StateTopic:     "burst/active",
+		},
+		{
+			Key:            "burst_remaining",
+			Name:           "Burst Polling Remaining",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			DeviceClass:    "duration",
+			Unit:           "min",
+			StateTopic:     "burst/remaining",
+		},
+	}
+}
+
+// ProfileEntities returns the select applying one of the named setting
+// profiles and showing the one in effect
+func ProfileEntities(names []string) []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:          "profile",
+			Name:         "Profile",
+			EntityType:   Select,
+			Icon:         "mdi:tune-variant",
+			StateTopic:   "profile/active",
+			CommandTopic: "profile/set",
+			Options:      names,
+		},
+	}
+}
+
+// QuietHoursEntities returns the sensor showing whether quiet hours are in
+// effect
+func QuietHoursEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "quiet_hours",
+			Name:           "Quiet Hours",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:sleep",
+			StateTopic:     "quiet_hours/active",
+		},
+	}
+}
+
+// WeeklyScheduleEntities returns the switch for the scheduler's weekly schedule
+func WeeklyScheduleEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "weekly_schedule",
+			Name:           "Weekly Schedule",
+			EntityType:     Switch,
+			EntityCategory: "config",
+			Icon:           "mdi:calendar-clock",
+			StateTopic:     "scheduler/weekly/enabled",
+			CommandTopic:   "scheduler/weekly/enabled/set",
+		},
+	}
+}
+
+// DriftEntities returns the settings drift report entities
+func DriftEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "settings_drift",
+			Name:           "Settings Changed Outside boiler-mate",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:file-compare",
+			StateTopic:     "drift/count",
+		},
+		{
+			Key:            "settings_drift_accept",
+			Name:           "Accept Settings Changes",
+			EntityType:     Button,
+			EntityCategory: "config",
+			Icon:           "mdi:check-all",
+			CommandTopic:   "drift/accept",
+			PayloadPress:   "1",
+		},
+	}
+}
+
+// MaintenanceEntities returns buttons for the controller's maintenance
+// actions, including chimney sweep mode and a controller restart when
+// destructive is set
+func MaintenanceEntities(destructive bool) []EntityConfig {
+	entities := []EntityConfig{
+		{
+			Key:            "reset_ash",
+			Name:           "Reset Ash Cleaning Reminder",
+			EntityType:     Button,
+			EntityCategory: "config",
+			Icon:           "mdi:delete-empty",
+			CommandTopic:   "set/misc/reset_ash",
+			PayloadPress:   "1",
+		},
+		{
+			Key:            "compressor_clean",
+			Name:           "Start Compressor Cleaning",
+			EntityType:     Button,
+			EntityCategory: "config",
+			Icon:           "mdi:air-purifier",
+			CommandTopic:   "set/misc/compressor_clean",
+			PayloadPress:   "1",
+		},
+	}
+	if destructive {
+		entities = append(entities,
+			EntityConfig{
+				Key:            "chimney_sweep",
+				Name:           "Start Chimney Sweep Mode",
+				EntityType:     Button,
+				EntityCategory: "config",
+				Icon:           "mdi:broom",
+				CommandTopic:   "set/misc/chimney_sweep",
+				PayloadPress:   "1",
+			},
+			EntityConfig{
+				Key:            "restart_controller",
+				Name:           "Restart Controller",
+				EntityType:     Button,
+				EntityCategory: "config",
+				DeviceClass:    "restart",
+				CommandTopic:   "set/misc/restart",
+				PayloadPress:   "1",
+			},
+		)
+	}
+	return entities
+}
+
+// AvailabilityEntities returns the controller's monthly uptime and outage
+// count sensors
+func AvailabilityEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:             "availability_uptime",
+			Name:            "Controller Uptime This Month",
+			EntityType:      Sensor,
+			EntityCategory:  "diagnostic",
+			StateClass:      "measurement",
+			Unit:            "%",
+			Icon:            "mdi:lan-connect",
+			Precision:       2,
+			StateTopic:      "availability/uptime",
+			AttributesTopic: "availability/attributes",
+		},
+		{
+			Key:            "availability_outages",
+			Name:           "Controller Outages This Month",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			StateClass:     "measurement",
+			Icon:           "mdi:lan-disconnect",
+			StateTopic:     "availability/outages",
+		},
+	}
+}
+
+// ClockEntities returns the controller clock drift and last sync sensors and
+// a button setting the clock now
+func ClockEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:            "clock_drift",
+			Name:           "Controller Clock Drift",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			DeviceClass:    "duration",
+			StateClass:     "measurement",
+			Unit:           "s",
+			Icon:           "mdi:clock-alert-outline",
+			StateTopic:     "clock/drift",
+		},
+		{
+			Key:            "clock_synced",
+			Name:           "Controller Clock Last Set",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			DeviceClass:    "timestamp",
+			Icon:           "mdi:clock-check-outline",
+			StateTopic:     "clock/synced",
+		},
+		{
+			Key:            "clock_sync",
+			Name:           "Set Controller Clock",
+			EntityType:     Button,
+			EntityCategory: "config",
+			Icon:           "mdi:clock-edit-outline",
+			CommandTopic:   "clock/sync",
+			PayloadPress:   "1",
+		},
+	}
+}
+
+// CalibrationEntities returns the progress and last calibration time sensors
+// of the oxygen sensor calibration workflow
+func CalibrationEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:             "oxygen_calibration",
+			Name:            "O2 Sensor Calibration",
+			EntityType:      Sensor,
+			EntityCategory:  "diagnostic",
+			Icon:            "mdi:air-filter",
+			StateTopic:      "calibration/oxygen/state",
+			AttributesTopic: "calibration/oxygen/attributes",
+		},
+		{
+			Key:            "oxygen_last_calibrated",
+			Name:           "O2 Sensor Last Calibrated",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			DeviceClass:    "timestamp",
+			Icon:           "mdi:calendar-check",
+			StateTopic:     "calibration/oxygen/last_calibrated",
+		},
+	}
+}
+
+// CircuitEntities returns the sensors and weather compensation setpoints of
+// the controller's two heating circuits and its district heating circuit
+func CircuitEntities() []EntityConfig {
+	var entities []EntityConfig
+	for i, category := range []string{"weather", "weather2"} {
+		circuit := fmt.Sprintf("circuit%d", i+1)
+		name := fmt.Sprintf("Circuit %d", i+1)
+		entities = append(entities,
+			circuitTemperature(circuit+"_flow_temp", name+" Flow Temperature", "operating_data/"+circuit+"_temp"),
+			circuitTemperature(circuit+"_flow_ref", name+" Reference Temperature", "operating_data/"+circuit+"_ref"),
+			EntityConfig{
+				Key:        circuit + "_valve",
+				Name:       name + " Mixer Valve",
+				EntityType: Sensor,
+				StateClass: "measurement",
+				Unit:       "%",
+				Icon:       "mdi:valve",
+				StateTopic: "operating_data/" + circuit + "_valve",
+			},
+			circuitPump(circuit+"_pump", name+" Pump", "operating_data/"+circuit+"_pump"),
+			circuitSetpoint(circuit+"_out_cold", name+" Cold Outdoor Temperature", category, "out_cold", -30, 10),
+			circuitSetpoint(circuit+"_flow_cold", name+" Flow at Cold Outdoor", category, "flow_cold", 20, 90),
+			circuitSetpoint(circuit+"_out_warm", name+" Warm Outdoor Temperature", category, "out_warm", 0, 25),
+			circuitSetpoint(circuit+"_flow_warm", name+" Flow at Warm Outdoor", category, "flow_warm", 10, 70),
+		)
+	}
+
+	return append(entities,
+		circuitTemperature("district_temp", "District Heating Temperature", "operating_data/district_temp"),
+		circuitTemperature("district_ref", "District Heating Reference Temperature", "operating_data/district_ref"),
+		circuitPump("district_pump", "District Heating Pump", "operating_data/district_pump"),
+		circuitSetpoint("district_setpoint", "District Heating Wanted Temperature", "district_heating", "temp", 0, 90),
+	)
+}
+
+func circuitTemperature(key, name, topic string) EntityConfig {
+	return EntityConfig{
+		Key:         key,
+		Name:        name,
+		EntityType:  Sensor,
+		DeviceClass: "temperature",
+		StateClass:  "measurement",
+		Unit:        "°C",
+		Precision:   1,
+		StateTopic:  topic,
+	}
+}
+
+func circuitPump(key, name, topic string) EntityConfig {
+	return EntityConfig{
+		Key:        key,
+		Name:       name,
+		EntityType: Sensor,
+		Icon:       "mdi:pump",
+		StateTopic: topic,
+	}
+}
+
+func circuitSetpoint(key, name, category, setting string, min, max int) EntityConfig {
+	return EntityConfig{
+		Key:            key,
+		Name:           name,
+		EntityType:     Number,
+		EntityCategory: "config",
+		DeviceClass:    "temperature",
+		Unit:           "°C",
+		Mode:           "box",
+		MinValue:       min,
+		MaxValue:       max,
+		Precision:      1,
+		Step:           "1",
+		StateTopic:     category + "/" + setting,
+		CommandTopic:   "set/" + category + "/" + setting,
+	}
+}
+
+// outputIcons holds the icon shown for each relay output binary sensor
+var outputIcons = map[string]string{
+	"exhaust_fan":      "mdi:fan",
+	"auger":            "mdi:screw-machine-flat-top",
+	"ignition":         "mdi:fire",
+	"circulation_pump": "mdi:pump",
+	"dhw_pump":         "mdi:water-pump",
+}
+
+// OutputEntities returns a binary sensor for every relay output decoded from
+// the controller's advanced data bitmask
+func OutputEntities() []EntityConfig {
+	entities := make([]EntityConfig, 0, len(nbe.Outputs))
+	for _, output := range nbe.Outputs {
+		entities = append(entities, EntityConfig{
+			Key:         output.Key(),
+			Name:        output.Description,
+			EntityType:  BinarySensor,
+			DeviceClass: output.DeviceClass,
+			Icon:        outputIcons[output.Name],
+			StateTopic:  "advanced_data/" + output.Key(),
+		})
+	}
+	return entities
+}
+
+// AuxHeaterEntities returns the state, counters and power of the electric
+// backup element and a switch for its enable flag
+func AuxHeaterEntities() []EntityConfig {
+	return []EntityConfig{
+		{
+			Key:         "aux_heater",
+			Name:        "Auxiliary Heater",
+			EntityType:  BinarySensor,
+			DeviceClass: "heat",
+			Icon:        "mdi:radiator",
+			StateTopic:  "aux_heater/state",
+			PayloadOn:   "1",
+			PayloadOff:  "0",
+		},
+		{
+			Key:            "aux_heater_active",
+			Name:           "Auxiliary Heater Enabled",
+			EntityType:     Switch,
+			EntityCategory: "config",
+			Icon:           "mdi:radiator",
+			StateTopic:     "aux_heater/active",
+			CommandTopic:   "set/aux_heater/active",
+			PayloadOn:      "1",
+			PayloadOff:     "0",
+		},
+		{
+			Key:         "aux_heater_power",
+			Name:        "Auxiliary Heater Power",
+			EntityType:  Sensor,
+			DeviceClass: "power",
+			StateClass:  "measurement",
+			Unit:        "W",
+			StateTopic:  "aux_heater/current_power",
+		},
+		{
+			Key:         "aux_heater_energy",
+			Name:        "Auxiliary Heater Energy",
+			EntityType:  Sensor,
+			DeviceClass: "energy",
+			StateClass:  "total_increasing",
+			Unit:        "kWh",
+			Precision:   1,
+			StateTopic:  "aux_heater/energy",
+		},
+		{
+			Key:         "aux_heater_runtime",
+			Name:        "Auxiliary Heater Runtime",
+			EntityType:  Sensor,
+			DeviceClass: "duration",
+			StateClass:  "total_increasing",
+			Unit:        "h",
+			StateTopic:  "aux_heater/runtime",
+		},
+		{
+			Key:            "aux_heater_starts",
+			Name:           "Auxiliary Heater Starts",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			StateClass:     "total_increasing",
+			Icon:           "mdi:counter",
+			StateTopic:     "aux_heater/starts",
+		},
+		{
+			Key:            "aux_heater_rated_power",
+			Name:           "Auxiliary Heater Rated Power",
+			EntityType:     Sensor,
+			EntityCategory: "diagnostic",
+			DeviceClass:    "power",
+			Unit:           "kW",
+			StateTopic:     "aux_heater/power",
+		},
 	}
 }
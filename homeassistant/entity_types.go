@@ -17,16 +17,27 @@
 
 package homeassistant
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
 
 // EntityType represents the type of Home Assistant entity
 type EntityType string
 
 const (
-	Sensor EntityType = "sensor"
-	Number EntityType = "number"
-	Button EntityType = "button"
-	Switch EntityType = "switch"
+	Sensor       EntityType = "sensor"
+	BinarySensor EntityType = "binary_sensor"
+	Number       EntityType = "number"
+	Button       EntityType = "button"
+	Switch       EntityType = "switch"
+	Update       EntityType = "update"
+	Climate      EntityType = "climate"
+	Select       EntityType = "select"
 )
 
 // EntityConfig represents a Home Assistant entity configuration
@@ -36,6 +47,7 @@ type EntityConfig struct {
 	EntityType     EntityType
 	EntityCategory string
 	DeviceClass    string
+	StateClass     string
 	Icon           string
 	Unit           string
 	StateTopic     string
@@ -46,24 +58,128 @@ type EntityConfig struct {
 	Step           string
 	Mode           string
 	PayloadPress   string
+	// LatestTopic is the topic carrying the latest available version of an update entity
+	LatestTopic string
+	// CurrentTemperatureTopic is the measured temperature shown by a climate entity
+	CurrentTemperatureTopic string
+	// PresetModes and PresetTopic expose climate presets; commands go to <PresetTopic>/set
+	PresetModes []string
+	PresetTopic string
+	// Options are the choices of a select entity
+	Options []string
+	// PayloadOn and PayloadOff are the on and off states of a binary sensor
+	// or switch, when they differ from ON and OFF
+	PayloadOn  string
+	PayloadOff string
+	// AttributesTopic carries a JSON object published as the entity's attributes
+	AttributesTopic string
+	// Disabled entities are registered but left disabled until enabled in Home Assistant
+	Disabled bool
 }
 
-// Build creates the MQTT discovery message for this entity
-func (e *EntityConfig) Build(serial, prefix string, devBlock map[string]interface{}) map[string]interface{} {
+var (
+	overridesMutex sync.RWMutex
+	overrides      map[string]config.EntityOverride
+)
+
+// SetOverrides replaces the name, icon or device class of the entities with
+// the given keys in the discovery messages built from now on
+func SetOverrides(entityOverrides map[string]config.EntityOverride) {
+	overridesMutex.Lock()
+	defer overridesMutex.Unlock()
+	overrides = entityOverrides
+}
+
+var (
+	sourcesMutex sync.RWMutex
+	sources      map[string]bool
+)
+
+// SetSources makes the entities of the named data sources also depend on
+// <prefix>/device/status/<source> in the discovery messages built from now
+// on, so they turn unavailable when only their source stops answering
+func SetSources(names []string) {
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+	sources = make(map[string]bool, len(names))
+	for _, name := range names {
+		sources[name] = true
+	}
+}
+
+// source returns the data source the entity's state comes from, if its
+// availability is published
+func (e *EntityConfig) source() string {
+	category, _, ok := strings.Cut(e.StateTopic, "/")
+	if !ok || category == "" {
+		return ""
+	}
+	name := category
+	if nbe.IsSettingsCategory(category) {
+		name = "settings"
+	}
+	sourcesMutex.RLock()
+	defer sourcesMutex.RUnlock()
+	if !sources[name] {
+		return ""
+	}
+	return name
+}
+
+// overridden returns the entity with its override applied, or the entity
+// itself if it has none
+func (e *EntityConfig) overridden() *EntityConfig {
+	overridesMutex.RLock()
+	override, ok := overrides[e.Key]
+	overridesMutex.RUnlock()
+	if !ok {
+		return e
+	}
+	entity := *e
+	if override.Name != "" {
+		entity.Name = override.Name
+	}
+	if override.Icon != "" {
+		entity.Icon = override.Icon
+	}
+	if override.DeviceClass != "" {
+		entity.DeviceClass = override.DeviceClass
+	}
+	return &entity
+}
+
+// Build creates the MQTT discovery message for this entity, with any
+// override set for its key applied
+func (e *EntityConfig) Build(deviceID, prefix string, devBlock map[string]interface{}) map[string]interface{} {
+	e = e.overridden()
 	config := map[string]interface{}{
 		"name":    e.Name,
-		"uniq_id": fmt.Sprintf("nbe_%s_%s", serial, e.Key),
+		"uniq_id": fmt.Sprintf("nbe_%s_%s", deviceID, e.Key),
 		"avty_t":  fmt.Sprintf("%s/device/status", prefix),
 		"dev":     devBlock,
 	}
+	if source := e.source(); source != "" {
+		delete(config, "avty_t")
+		config["avty"] = []map[string]string{
+			{"t": fmt.Sprintf("%s/device/status", prefix)},
+			{"t": fmt.Sprintf("%s/device/status/%s", prefix, source)},
+		}
+		config["avty_mode"] = "all"
+	}
 
 	// Add optional fields only if they're set
 	if e.EntityCategory != "" {
 		config["entity_category"] = e.EntityCategory
 	}
+	if e.Disabled {
+		config["enabled_by_default"] = false
+	}
 	if e.DeviceClass != "" {
 		config["device_class"] = e.DeviceClass
 	}
+	if e.StateClass != "" {
+		config["state_class"] = e.StateClass
+	}
 	if e.Icon != "" {
 		config["ic"] = e.Icon
 	}
@@ -90,6 +206,10 @@ func (e *EntityConfig) Build(serial, prefix string, devBlock map[string]interfac
 		}
 	}
 
+	if e.AttributesTopic != "" {
+		config["json_attr_t"] = fmt.Sprintf("%s/%s", prefix, e.AttributesTopic)
+	}
+
 	// Command topic (for numbers, switches, buttons)
 	if e.CommandTopic != "" {
 		if e.CommandTopic[0] == '/' {
@@ -133,6 +253,63 @@ func (e *EntityConfig) Build(serial, prefix string, devBlock map[string]interfac
 		config["payload_press"] = e.PayloadPress
 	}
 
+	// Select-specific fields
+	if e.EntityType == Select {
+		config["options"] = e.Options
+	}
+
+	// Binary sensors read the ON/OFF values published by boiler-mate
+	if e.EntityType == BinarySensor {
+		config["payload_on"] = "ON"
+		config["payload_off"] = "OFF"
+	}
+	if (e.EntityType == BinarySensor || e.EntityType == Switch) && e.PayloadOn != "" {
+		config["payload_on"] = e.PayloadOn
+		config["payload_off"] = e.PayloadOff
+	}
+
+	// Update-specific fields
+	if e.EntityType == Update && e.LatestTopic != "" {
+		config["latest_version_topic"] = fmt.Sprintf("%s/%s", prefix, e.LatestTopic)
+	}
+
+	// Climate entities take the target temperature on StateTopic/CommandTopic
+	if e.EntityType == Climate {
+		delete(config, "stat_t")
+		delete(config, "cmd_t")
+		config["modes"] = []string{"heat"}
+		config["temperature_unit"] = "C"
+		if e.Unit == "°F" {
+			config["temperature_unit"] = "F"
+		}
+		delete(config, "unit_of_measurement")
+		delete(config, "native_unit_of_measurement")
+		delete(config, "suggested_unit_of_measurement")
+		if e.StateTopic != "" {
+			config["temperature_state_topic"] = fmt.Sprintf("%s/%s", prefix, e.StateTopic)
+		}
+		if e.CommandTopic != "" {
+			config["temperature_command_topic"] = fmt.Sprintf("%s/%s", prefix, e.CommandTopic)
+		}
+		if e.CurrentTemperatureTopic != "" {
+			config["current_temperature_topic"] = fmt.Sprintf("%s/%s", prefix, e.CurrentTemperatureTopic)
+		}
+		if e.MinValue != nil {
+			config["min_temp"] = e.MinValue
+		}
+		if e.MaxValue != nil {
+			config["max_temp"] = e.MaxValue
+		}
+		if e.Step != "" {
+			config["temp_step"] = e.Step
+		}
+		if len(e.PresetModes) > 0 && e.PresetTopic != "" {
+			config["preset_modes"] = e.PresetModes
+			config["preset_mode_state_topic"] = fmt.Sprintf("%s/%s", prefix, e.PresetTopic)
+			config["preset_mode_command_topic"] = fmt.Sprintf("%s/%s/set", prefix, e.PresetTopic)
+		}
+	}
+
 	// Switch uses state_topic instead of stat_t
 	if e.EntityType == Switch && e.StateTopic != "" {
 		delete(config, "stat_t")
@@ -143,6 +320,6 @@ func (e *EntityConfig) Build(serial, prefix string, devBlock map[string]interfac
 }
 
 // GetDiscoveryTopic returns the MQTT discovery topic for this entity
-func (e *EntityConfig) GetDiscoveryTopic(serial string) string {
-	return fmt.Sprintf("homeassistant/%s/nbe_%s/%s/config", e.EntityType, serial, e.Key)
+func (e *EntityConfig) GetDiscoveryTopic(deviceID string) string {
+	return fmt.Sprintf("homeassistant/%s/nbe_%s/%s/config", e.EntityType, deviceID, e.Key)
 }
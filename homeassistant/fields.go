@@ -0,0 +1,78 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homeassistant
+
+import (
+	"sort"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// FieldEntities returns a sensor for every operating and advanced data field
+// in the nbe field dictionary that is not already published by one of the
+// given entities. The generated sensors are disabled by default.
+func FieldEntities(existing []EntityConfig) []EntityConfig {
+	covered := make(map[string]bool, len(existing))
+	for _, entity := range existing {
+		covered[entity.StateTopic] = true
+	}
+
+	var entities []EntityConfig
+	for _, category := range []struct {
+		topic  string
+		fields map[string]nbe.FieldDefinition
+	}{
+		{"operating_data", nbe.OperatingFields},
+		{"advanced_data", nbe.AdvancedFields},
+	} {
+		names := make([]string, 0, len(category.fields))
+		for name := range category.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			topic := category.topic + "/" + name
+			if covered[topic] {
+				continue
+			}
+			entities = append(entities, fieldEntity(category.topic, category.fields[name]))
+		}
+	}
+	return entities
+}
+
+func fieldEntity(topic string, field nbe.FieldDefinition) EntityConfig {
+	entity := EntityConfig{
+		Key:            topic + "_" + field.Name,
+		Name:           field.Description,
+		EntityType:     Sensor,
+		EntityCategory: "diagnostic",
+		DeviceClass:    field.DeviceClass,
+		Unit:           field.Unit,
+		StateTopic:     topic + "/" + field.Name,
+		Disabled:       true,
+	}
+	if field.Unit != "" && field.Type != nbe.TextField {
+		entity.StateClass = "measurement"
+	}
+	if field.Type == nbe.FloatField {
+		entity.Precision = 1
+	}
+	return entity
+}
@@ -0,0 +1,42 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package homeassistant
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// BirthDelay is how long to wait after Home Assistant comes online before
+// republishing, so it has subscribed to the entity topics
+const BirthDelay = 5 * time.Second
+
+// OnBirth calls republish each time Home Assistant announces "online" on its
+// status topic (homeassistant/status by default), after BirthDelay. A retained
+// status is left alone, so subscribing does not republish at startup.
+func OnBirth(mqttClient *mqtt.Client, statusTopic string, republish func()) error {
+	return mqttClient.SubscribeTopic(statusTopic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() || strings.TrimSpace(string(msg.Payload())) != "online" {
+			return
+		}
+		log.Infof("Home Assistant is online, republishing discovery and states in %s", BirthDelay)
+		time.AfterFunc(BirthDelay, republish)
+	})
+}
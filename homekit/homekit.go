@@ -0,0 +1,283 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package homekit exposes the boiler and its hot water tank to Apple Home as
+// two thermostats behind a bridge, served with the HomeKit Accessory Protocol
+// library hap.
+package homekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	haplog "github.com/brutella/hap/log"
+	"github.com/brutella/hap/service"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	log "github.com/sirupsen/logrus"
+)
+
+// Available reports whether this build includes the HomeKit bridge
+const Available = true
+
+// Accessory IDs of the bridge and the thermostats behind it
+const (
+	aidBridge   = 1
+	aidBoiler   = 2
+	aidHotWater = 3
+)
+
+// The heating modes used by both thermostats
+const (
+	heatingOff = characteristic.TargetHeatingCoolingStateOff
+	heatingOn  = characteristic.TargetHeatingCoolingStateHeat
+)
+
+// Bridge is the HomeKit accessory server for one boiler
+type Bridge struct {
+	server    *hap.Server
+	name      string
+	setupCode string
+	pipelines *pipeline.Pipelines
+	set       func(key string, value []byte)
+	boiler    *service.Thermostat
+	hotWater  *service.Thermostat
+	cancel    context.CancelFunc
+}
+
+// New creates the bridge for the boiler with the given serial and firmware
+// version. The thermostats work in the controller's units: published values
+// have pipelines undone, and values written in Apple Home are passed to set
+// as a "<category>.<key>" setting as the controller takes it. They are set in
+// the background, so that the controller gets its answer without waiting for
+// the boiler, and are refused in read-only mode.
+func New(cfg config.HomeKitConfig, serial, firmware string, schema map[string]nbe.SettingDefinition, pipelines *pipeline.Pipelines, readOnly bool, set func(key string, value []byte)) (*Bridge, error) {
+	store, err := openStore(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	code := cfg.SetupCode
+	if code == "" {
+		if code, err = store.setupCode(); err != nil {
+			return nil, err
+		}
+	}
+	// hap logs to standard output, which the stdout sink writes events to
+	haplog.Info.SetOutput(log.StandardLogger().WriterLevel(log.DebugLevel))
+
+	b := &Bridge{name: cfg.Name, setupCode: code, pipelines: pipelines, set: set}
+	revision := firmwareRevision(firmware)
+	bridge := accessory.NewBridge(accessory.Info{Name: cfg.Name, Manufacturer: "NBE", Model: "boiler-mate", SerialNumber: serial, Firmware: revision})
+	bridge.Id = aidBridge
+
+	boiler := accessory.NewThermostat(accessory.Info{Name: "Boiler", Manufacturer: "NBE", Model: "Pellet boiler", SerialNumber: serial, Firmware: revision})
+	boiler.Id = aidBoiler
+	b.boiler = newThermostat(boiler.Thermostat, schema["boiler.temp"], []int{heatingOff, heatingOn}, readOnly)
+
+	hotWater := accessory.NewThermostat(accessory.Info{Name: "Hot Water", Manufacturer: "NBE", Model: "Hot water tank", SerialNumber: serial, Firmware: revision})
+	hotWater.Id = aidHotWater
+	b.hotWater = newThermostat(hotWater.Thermostat, schema["hot_water.temp"], []int{heatingOn}, readOnly)
+
+	if !readOnly {
+		b.boiler.TargetTemperature.OnSetRemoteValue(b.writeTemperature("boiler.temp", schema["boiler.temp"]))
+		b.boiler.TargetHeatingCoolingState.OnSetRemoteValue(b.writePower)
+		b.hotWater.TargetTemperature.OnSetRemoteValue(b.writeTemperature("hot_water.temp", schema["hot_water.temp"]))
+	}
+
+	if b.server, err = hap.NewServer(store, bridge.A, boiler.A, hotWater.A); err != nil {
+		return nil, err
+	}
+	b.server.Pin = strings.ReplaceAll(code, "-", "")
+	b.server.Addr = fmt.Sprintf(":%d", cfg.Port)
+	return b, nil
+}
+
+// newThermostat limits the target temperature of a thermostat service to the
+// range of setting and its target heating state to modes
+func newThermostat(t *service.Thermostat, setting nbe.SettingDefinition, modes []int, readOnly bool) *service.Thermostat {
+	minimum, maximum := float64(setting.Min), float64(setting.Max)
+	if maximum <= minimum {
+		minimum, maximum = 0, 100
+	}
+	step := 1.0
+	if setting.Decimals > 0 {
+		step = 0.5
+	}
+
+	t.CurrentHeatingCoolingState.ValidVals = []int{heatingOff, heatingOn}
+	t.TargetHeatingCoolingState.ValidVals = modes
+	t.TargetHeatingCoolingState.SetValue(modes[0])
+	t.CurrentTemperature.SetMinValue(-50)
+	t.CurrentTemperature.SetMaxValue(150)
+	t.TargetTemperature.SetMinValue(minimum)
+	t.TargetTemperature.SetMaxValue(maximum)
+	t.TargetTemperature.SetStepValue(step)
+	t.TargetTemperature.SetValue(minimum)
+	if readOnly {
+		for _, c := range []*characteristic.C{t.TargetTemperature.C, t.TargetHeatingCoolingState.C} {
+			c.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+		}
+	}
+	return t
+}
+
+// writeTemperature returns the handler writing a target temperature to key
+func (b *Bridge) writeTemperature(key string, setting nbe.SettingDefinition) func(float64) error {
+	return func(temperature float64) error {
+		go b.set(key, []byte(strconv.FormatFloat(temperature, 'f', int(setting.Decimals), 64)))
+		return nil
+	}
+}
+
+// writePower turns the boiler on or off
+func (b *Bridge) writePower(mode int) error {
+	switch mode {
+	case heatingOn:
+		go b.set("device.power_switch", []byte("ON"))
+	case heatingOff:
+		go b.set("device.power_switch", []byte("OFF"))
+	default:
+		return fmt.Errorf("unsupported heating mode %d", mode)
+	}
+	return nil
+}
+
+// Run starts serving HomeKit controllers in the background and keeps the
+// thermostats up to date with the values published on eventBus
+func (b *Bridge) Run(eventBus *bus.Bus) {
+	eventBus.Subscribe(func(event bus.Event) {
+		for key, value := range event.Values {
+			b.apply(event.Category, key, value)
+		}
+	}, bus.ValueChanged)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go func() {
+		if err := b.server.ListenAndServe(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HomeKit bridge stopped: %v", err)
+		}
+	}()
+	if !b.server.IsPaired() {
+		log.Infof("HomeKit bridge %q is ready to pair with setup code %s", b.name, b.setupCode)
+	}
+}
+
+// Close stops the accessory server
+func (b *Bridge) Close() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+// apply updates the characteristics that follow a published value
+func (b *Bridge) apply(category, key string, value interface{}) {
+	value = b.raw(category, key, value)
+	switch category + "/" + key {
+	case "operating_data/boiler_temp":
+		updateTemperature(b.boiler.CurrentTemperature.Float, value)
+	case "operating_data/dhw_temp":
+		updateTemperature(b.hotWater.CurrentTemperature.Float, value)
+	case "boiler/temp":
+		updateTemperature(b.boiler.TargetTemperature.Float, value)
+	case "hot_water/temp":
+		updateTemperature(b.hotWater.TargetTemperature.Float, value)
+	case "operating_data/power_kw":
+		if power, ok := number(value); ok {
+			b.boiler.CurrentHeatingCoolingState.SetValue(heatingState(power > 0))
+		}
+	case "operating_data/state_on":
+		b.boiler.TargetHeatingCoolingState.SetValue(heatingState(value == "ON"))
+	case "advanced_data/output_dhw_pump":
+		b.hotWater.CurrentHeatingCoolingState.SetValue(heatingState(value == "ON"))
+	}
+}
+
+// raw undoes the pipeline of a published value, returning it as the
+// controller reported it
+func (b *Bridge) raw(category, key string, value interface{}) interface{} {
+	published := fmt.Sprintf("%v", value)
+	raw, err := b.pipelines.Write(category+"."+key, []byte(published))
+	if err != nil || string(raw) == published {
+		return value
+	}
+	return string(raw)
+}
+
+// updateTemperature rounds a temperature to the characteristic's step and
+// keeps it within its range
+func updateTemperature(c *characteristic.Float, value interface{}) {
+	temperature, ok := number(value)
+	if !ok {
+		return
+	}
+	step := c.StepValue()
+	temperature = math.Round(temperature/step) * step
+	temperature = math.Round(temperature*10) / 10
+	c.SetValue(math.Max(c.MinValue(), math.Min(c.MaxValue(), temperature)))
+}
+
+func heatingState(on bool) int {
+	if on {
+		return heatingOn
+	}
+	return heatingOff
+}
+
+// number converts a published or written value to a float
+func number(value interface{}) (float64, bool) {
+	switch value {
+	case true:
+		return 1, true
+	case false:
+		return 0, true
+	}
+	return nbe.ParseFloat(value)
+}
+
+// firmwareRevision returns the leading x.y.z numbers of a firmware version,
+// the form HomeKit accepts
+func firmwareRevision(version string) string {
+	var parts []string
+	for _, part := range strings.SplitN(version, ".", 3) {
+		end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if end == 0 || part == "" {
+			break
+		}
+		if end > 0 {
+			parts = append(parts, part[:end])
+			break
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "1.0.0"
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,46 @@
+//go:build minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	log "github.com/sirupsen/logrus"
+)
+
+// Available reports whether this build includes the HomeKit bridge
+const Available = false
+
+// Bridge does nothing in minimal builds, which leave out the HomeKit bridge
+type Bridge struct{}
+
+// New returns a bridge that does nothing
+func New(cfg config.HomeKitConfig, serial, firmware string, schema map[string]nbe.SettingDefinition, pipelines *pipeline.Pipelines, readOnly bool, set func(key string, value []byte)) (*Bridge, error) {
+	log.Warn("HomeKit is not included in minimal builds")
+	return &Bridge{}, nil
+}
+
+// Run does nothing in minimal builds
+func (b *Bridge) Run(eventBus *bus.Bus) {}
+
+// Close does nothing in minimal builds
+func (b *Bridge) Close() {}
@@ -0,0 +1,208 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+func testBridge(t *testing.T, set chan<- string) *Bridge {
+	t.Helper()
+	schema := map[string]nbe.SettingDefinition{
+		"boiler.temp":    {Min: 40, Max: 85},
+		"hot_water.temp": {Min: 10, Max: 70},
+	}
+	cfg := config.HomeKitConfig{Name: "boiler-mate", SetupCode: "031-45-154", StateFile: filepath.Join(t.TempDir(), "homekit.json")}
+	b, err := New(cfg, "12345", "10.2.1", schema, nil, false, func(key string, value []byte) {
+		set <- key + "=" + string(value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// remoteWrite writes value to c the way a paired controller does, returning
+// the HAP status code
+func remoteWrite(c *characteristic.C, value interface{}) int {
+	_, code := c.SetValueRequest(value, httptest.NewRequest("PUT", "/characteristics", nil))
+	return code
+}
+
+func TestBridgeApply(t *testing.T) {
+	b := testBridge(t, make(chan string, 1))
+	tests := []struct {
+		name     string
+		category string
+		key      string
+		value    interface{}
+		c        *characteristic.C
+		expected interface{}
+	}{
+		{"boiler temperature", "operating_data", "boiler_temp", nbe.RoundedFloat(61.26), b.boiler.CurrentTemperature.C, 61.3},
+		{"hot water temperature", "operating_data", "dhw_temp", 48.0, b.hotWater.CurrentTemperature.C, 48.0},
+		{"boiler setpoint", "boiler", "temp", nbe.RoundedFloat(70), b.boiler.TargetTemperature.C, 70.0},
+		{"setpoint clamped", "hot_water", "temp", int64(90), b.hotWater.TargetTemperature.C, 70.0},
+		{"burning", "operating_data", "power_kw", nbe.RoundedFloat(12.5), b.boiler.CurrentHeatingCoolingState.C, heatingOn},
+		{"idle", "operating_data", "power_kw", nbe.RoundedFloat(0), b.boiler.CurrentHeatingCoolingState.C, heatingOff},
+		{"switched on", "operating_data", "state_on", "ON", b.boiler.TargetHeatingCoolingState.C, heatingOn},
+		{"switched off", "operating_data", "state_on", "OFF", b.boiler.TargetHeatingCoolingState.C, heatingOff},
+		{"hot water pump", "advanced_data", "output_dhw_pump", "ON", b.hotWater.CurrentHeatingCoolingState.C, heatingOn},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.apply(tt.category, tt.key, tt.value)
+			if value := tt.c.Value(); value != tt.expected {
+				t.Errorf("Expected %v (%T), got %v (%T)", tt.expected, tt.expected, value, value)
+			}
+		})
+	}
+}
+
+func TestBridgeUndoesPipelines(t *testing.T) {
+	pipelines := pipeline.New(map[string][]config.PipelineStep{
+		"hot_water/temp":          {{Convert: "c_to_f"}},
+		"operating_data/dhw_temp": {{Convert: "c_to_f"}},
+	})
+	cfg := config.HomeKitConfig{Name: "boiler-mate", SetupCode: "031-45-154", StateFile: filepath.Join(t.TempDir(), "homekit.json")}
+	b, err := New(cfg, "12345", "", map[string]nbe.SettingDefinition{"hot_water.temp": {Min: 10, Max: 70}}, pipelines, false, func(string, []byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 131 °F and 120.2 °F as published are 55 °C and 49 °C on the controller
+	b.apply("hot_water", "temp", nbe.RoundedFloat(131))
+	b.apply("operating_data", "dhw_temp", nbe.RoundedFloat(120.2))
+	if target, current := b.hotWater.TargetTemperature.Value(), b.hotWater.CurrentTemperature.Value(); target != 55.0 || current != 49.0 {
+		t.Errorf("Expected 55 °C and 49 °C, got %v and %v", target, current)
+	}
+}
+
+func TestBridgeWrites(t *testing.T) {
+	set := make(chan string, 1)
+	b := testBridge(t, set)
+	tests := []struct {
+		name     string
+		c        *characteristic.C
+		value    interface{}
+		expected string
+	}{
+		{"boiler setpoint", b.boiler.TargetTemperature.C, 72.0, "boiler.temp=72"},
+		{"hot water setpoint", b.hotWater.TargetTemperature.C, 55.0, "hot_water.temp=55"},
+		{"heat", b.boiler.TargetHeatingCoolingState.C, 1, "device.power_switch=ON"},
+		{"off", b.boiler.TargetHeatingCoolingState.C, 0, "device.power_switch=OFF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := remoteWrite(tt.c, tt.value); code != 0 {
+				t.Fatalf("Expected the write to succeed, got status %d", code)
+			}
+			if written := <-set; written != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, written)
+			}
+		})
+	}
+
+	if code := remoteWrite(b.boiler.TargetHeatingCoolingState.C, 3); code == 0 {
+		t.Error("Expected auto mode to be rejected")
+	}
+	if code := remoteWrite(b.hotWater.TargetHeatingCoolingState.C, 0); code == 0 {
+		t.Error("Expected turning the hot water off to be rejected")
+	}
+}
+
+func TestBridgeReadOnly(t *testing.T) {
+	cfg := config.HomeKitConfig{Name: "boiler-mate", StateFile: filepath.Join(t.TempDir(), "homekit.json")}
+	b, err := New(cfg, "12345", "", nil, nil, true, func(string, []byte) {
+		t.Error("Expected no writes in read-only mode")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*characteristic.C{b.boiler.TargetTemperature.C, b.boiler.TargetHeatingCoolingState.C, b.hotWater.TargetTemperature.C} {
+		if c.IsWritable() || remoteWrite(c, 1) == 0 {
+			t.Errorf("Expected characteristic %s to be read-only", c.Type)
+		}
+	}
+	if err := config.ValidateSetupCode(b.setupCode); err != nil {
+		t.Errorf("Expected a valid generated setup code: %v", err)
+	}
+}
+
+func TestStoreKeepsEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "homekit.json")
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := s.setupCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("AB.pairing", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := reopened.setupCode(); err != nil || again != code {
+		t.Errorf("Expected the setup code %s to be kept, got %s, %v", code, again, err)
+	}
+	if keys, _ := reopened.KeysWithSuffix(".pairing"); len(keys) != 1 || keys[0] != "AB.pairing" {
+		t.Errorf("Expected the pairing to be kept, got %v", keys)
+	}
+	if err := reopened.Delete("AB.pairing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Get("AB.pairing"); err == nil {
+		t.Error("Expected the pairing to be deleted")
+	}
+}
+
+func TestFirmwareRevision(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{"10.2.1", "10.2.1"},
+		{"7.10", "7.10"},
+		{"10.2.1.5", "10.2.1"},
+		{"7.10b", "7.10"},
+		{"V13", "1.0.0"},
+		{"", "1.0.0"},
+	}
+
+	for _, tt := range tests {
+		if got := firmwareRevision(tt.version); got != tt.expected {
+			t.Errorf("firmwareRevision(%q) = %q, expected %q", tt.version, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package homekit
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/config"
+)
+
+// setupCodeKey is the store entry holding the generated setup code
+const setupCodeKey = "boiler-mate.setup_code"
+
+// store is the hap.Store of the bridge. It keeps every entry, such as the
+// accessory identity and the paired controllers, in one JSON file that is
+// rewritten whenever an entry changes.
+type store struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// openStore loads the entries from path, starting empty if the file doesn't
+// exist yet
+func openStore(path string) (*store, error) {
+	s := &store{path: path, entries: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Set stores value under key
+func (s *store) Set(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = value
+	return s.save()
+}
+
+// Get returns the value stored under key
+func (s *store) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("no entry for %s", key)
+	}
+	return value, nil
+}
+
+// Delete removes the value stored under key
+func (s *store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.save()
+}
+
+// KeysWithSuffix returns the keys ending in suffix
+func (s *store) KeysWithSuffix(suffix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.entries {
+		if strings.HasSuffix(key, suffix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// save writes the entries; the caller holds mu
+func (s *store) save() error {
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0o600)
+}
+
+// setupCode returns the generated setup code, creating it on first use
+func (s *store) setupCode() (string, error) {
+	if code, err := s.Get(setupCodeKey); err == nil {
+		return string(code), nil
+	}
+	code, err := randomSetupCode()
+	if err != nil {
+		return "", err
+	}
+	return code, s.Set(setupCodeKey, []byte(code))
+}
+
+// randomSetupCode returns a valid setup code in the form XXX-XX-XXX
+func randomSetupCode() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+		digits := fmt.Sprintf("%08d", n.Int64())
+		code := digits[:3] + "-" + digits[3:5] + "-" + digits[5:]
+		if config.ValidateSetupCode(code) == nil {
+			return code, nil
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package hydronic shows how well the heat leaves the boiler: the delta-T
+// between the supply and return temperatures and, with the flow rate known,
+// the heat the water carries. A delta-T that stays small points at too much
+// flow or a short-circuited loop, a large one at too little flow.
+package hydronic
+
+import (
+	"math"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+const (
+	// Category is the bus category the values are published in
+	Category = "hydronic"
+	// waterHeatCapacity is the heat capacity of a litre of water in kJ/K
+	waterHeatCapacity = 4.186
+)
+
+// Monitor follows the supply and return temperatures on the bus and
+// publishes hydronic/delta_t in K and, with a flow rate, hydronic/heat_kw as
+// they change. Temperatures a pipeline converts to another unit are converted
+// back first.
+type Monitor struct {
+	// Supply and Return are the operating data keys of the temperatures
+	Supply string
+	Return string
+	// FlowRate is the flow through the boiler in l/min, zero if unknown
+	FlowRate float64
+
+	eventBus  *bus.Bus
+	pipelines *pipeline.Pipelines
+
+	mu         sync.Mutex
+	supply     float64
+	ret        float64
+	haveSupply bool
+	haveReturn bool
+	published  map[string]interface{}
+}
+
+// New creates a monitor publishing on eventBus, undoing the conversions of
+// pipelines
+func New(eventBus *bus.Bus, pipelines *pipeline.Pipelines, supply, ret string, flowRate float64) *Monitor {
+	return &Monitor{
+		Supply:    supply,
+		Return:    ret,
+		FlowRate:  flowRate,
+		eventBus:  eventBus,
+		pipelines: pipelines,
+		published: make(map[string]interface{}),
+	}
+}
+
+// Run starts following the operating data
+func (m *Monitor) Run() {
+	m.eventBus.Subscribe(m.handle, bus.ValueChanged)
+}
+
+func (m *Monitor) handle(event bus.Event) {
+	if event.Category != "operating_data" {
+		return
+	}
+	if changes := m.update(event.Values); len(changes) > 0 {
+		m.eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: Category, Values: changes})
+	}
+}
+
+// update takes the temperatures from values and returns the derived values
+// that changed. Nothing is derived until the controller has reported both
+// temperatures, so boilers without a return sensor publish nothing.
+func (m *Monitor) update(values map[string]interface{}) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if value, ok := nbe.ToFloat(values[m.Supply]); ok {
+		m.supply, m.haveSupply = m.pipelines.Unconvert("operating_data/"+m.Supply, value), true
+	}
+	if value, ok := nbe.ToFloat(values[m.Return]); ok {
+		m.ret, m.haveReturn = m.pipelines.Unconvert("operating_data/"+m.Return, value), true
+	}
+	if !m.haveSupply || !m.haveReturn {
+		return nil
+	}
+
+	delta := m.supply - m.ret
+	derived := map[string]interface{}{"delta_t": nbe.RoundedFloat(delta)}
+	if m.FlowRate > 0 {
+		// a return warmer than the supply means the water is standing, not
+		// carrying heat back into the boiler
+		derived["heat_kw"] = nbe.RoundedFloat(m.FlowRate / 60 * waterHeatCapacity * math.Max(delta, 0))
+	}
+	changes := make(map[string]interface{})
+	for key, value := range derived {
+		if m.published[key] != value {
+			changes[key] = value
+			m.published[key] = value
+		}
+	}
+	return changes
+}
@@ -0,0 +1,86 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hydronic
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+func TestMonitorDerivesDeltaTAndHeat(t *testing.T) {
+	eventBus := bus.New()
+	New(eventBus, nil, "boiler_temp", "return_temp", 12).Run()
+	var published []map[string]interface{}
+	eventBus.Subscribe(func(event bus.Event) {
+		if event.Category == Category {
+			published = append(published, event.Values)
+		}
+	}, bus.ValueChanged)
+	operating := func(values map[string]interface{}) {
+		eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: values})
+	}
+
+	// nothing is derived before both temperatures are known
+	operating(map[string]interface{}{"boiler_temp": nbe.RoundedFloat(70)})
+	if len(published) != 0 {
+		t.Fatalf("Expected nothing without the return temperature, got %v", published)
+	}
+
+	// 12 l/min at 20 K carries 12/60 * 4.186 * 20 kW
+	operating(map[string]interface{}{"return_temp": nbe.RoundedFloat(50)})
+	if len(published) != 1 || published[0]["delta_t"] != nbe.RoundedFloat(20) || published[0]["heat_kw"] != nbe.RoundedFloat(16.744) {
+		t.Fatalf("Expected 20 K and 16.74 kW, got %v", published)
+	}
+
+	// unchanged values are not published again
+	operating(map[string]interface{}{"boiler_temp": nbe.RoundedFloat(70), "power_kw": nbe.RoundedFloat(15)})
+	if len(published) != 1 {
+		t.Errorf("Expected nothing new, got %v", published)
+	}
+
+	// a warmer return carries no heat
+	operating(map[string]interface{}{"boiler_temp": nbe.RoundedFloat(45)})
+	if len(published) != 2 || published[1]["delta_t"] != nbe.RoundedFloat(-5) || published[1]["heat_kw"] != nbe.RoundedFloat(0) {
+		t.Errorf("Expected -5 K and no heat, got %v", published)
+	}
+}
+
+func TestMonitorWithoutFlowRate(t *testing.T) {
+	m := New(bus.New(), nil, "boiler_temp", "return_temp", 0)
+	changes := m.update(map[string]interface{}{"boiler_temp": int64(60), "return_temp": int64(48)})
+	if len(changes) != 1 || changes["delta_t"] != nbe.RoundedFloat(12) {
+		t.Errorf("Expected only a delta-T of 12 K, got %v", changes)
+	}
+}
+
+func TestMonitorUndoesConversions(t *testing.T) {
+	pipelines := pipeline.New(map[string][]config.PipelineStep{
+		"operating_data/boiler_temp": {{Convert: "c_to_f"}},
+		"operating_data/return_temp": {{Convert: "c_to_f"}},
+	})
+	m := New(bus.New(), pipelines, "boiler_temp", "return_temp", 12)
+	// 158 °F and 122 °F are 70 °C and 50 °C
+	changes := m.update(map[string]interface{}{"boiler_temp": nbe.RoundedFloat(158), "return_temp": nbe.RoundedFloat(122)})
+	if changes["delta_t"] != nbe.RoundedFloat(20) || changes["heat_kw"] != nbe.RoundedFloat(16.744) {
+		t.Errorf("Expected 20 K and 16.74 kW, got %v", changes)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package interfaces describes the external boundaries of boiler-mate, the
+// controller, the broker and the event sinks, so code embedding the library
+// can depend on them and be tested against the mocks in interfaces/mocks, or
+// mocks generated with mockgen or testify, without UDP or a broker.
+package interfaces
+
+import (
+	"context"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Controller is the NBE client: reading and writing the controller. It is
+// implemented by *nbe.NBE.
+type Controller interface {
+	Get(function nbe.Function, path string) (*nbe.NBEResponse, error)
+	GetWithPriority(priority nbe.Priority, function nbe.Function, path string) (*nbe.NBEResponse, error)
+	GetAsync(function nbe.Function, path string, cb func(*nbe.NBEResponse)) (int8, error)
+	GetAsyncWithPriority(priority nbe.Priority, function nbe.Function, path string, cb func(*nbe.NBEResponse)) (int8, error)
+	Set(path string, value []byte) (*nbe.NBEResponse, error)
+	SetContext(ctx context.Context, path string, value []byte) (*nbe.NBEResponse, error)
+	SetAsync(path string, value []byte, cb func(*nbe.NBEResponse)) (int8, error)
+	SetAsyncContext(ctx context.Context, path string, value []byte, cb func(*nbe.NBEResponse)) (int8, error)
+	ValidateSetting(path string, value []byte) error
+	OnWrite(handler func(path string, value []byte))
+	LastResponse() time.Time
+}
+
+// Broker is the MQTT client: publishing below the topic prefix and
+// subscribing to commands. It is implemented by *mqtt.Client.
+type Broker interface {
+	PublishMany(topic string, values map[string]interface{}) error
+	PublishRaw(topic string, val interface{}) error
+	PublishJSON(topic string, val interface{}) error
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) error
+	SubscribeTopic(fullTopic string, qos byte, callback mqtt.MessageHandler) error
+	IsConnected() bool
+	OnConnectionChange(handler func(connected bool))
+}
+
+// Sink receives the events published on the bus, such as the MQTT and REST
+// API sinks
+type Sink interface {
+	Handle(event bus.Event)
+}
+
+// SinkFunc adapts a bus handler to the Sink interface
+type SinkFunc bus.Handler
+
+// Handle calls f with the event
+func (f SinkFunc) Handle(event bus.Event) {
+	f(event)
+}
+
+// Subscribe delivers the events of the given kinds, or of every kind, to sink
+func Subscribe(b *bus.Bus, sink Sink, kinds ...bus.Kind) {
+	b.Subscribe(sink.Handle, kinds...)
+}
+
+var (
+	_ Controller = (*nbe.NBE)(nil)
+	_ Broker     = (*mqtt.Client)(nil)
+)
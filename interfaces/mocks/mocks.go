@@ -0,0 +1,402 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package mocks provides hand-written mocks of the boundaries in the
+// interfaces package. Each method calls the matching ...Func field when set
+// and records the call; an unset method returns ErrUnexpectedCall.
+package mocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/interfaces"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// ErrUnexpectedCall is returned by a mocked method that has no ...Func set
+var ErrUnexpectedCall = errors.New("unexpected call")
+
+// Call is a recorded call of a mocked method
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// recorder keeps the calls of a mock
+type recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *recorder) record(method string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls recorded so far, oldest first
+func (r *recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// CallsTo returns the recorded calls of method
+func (r *recorder) CallsTo(method string) []Call {
+	var calls []Call
+	for _, call := range r.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func unexpected(method string) error {
+	return fmt.Errorf("%s: %w", method, ErrUnexpectedCall)
+}
+
+// Controller mocks the NBE client. The priority and async variants fall back
+// to GetFunc and SetFunc, calling the callback before returning.
+type Controller struct {
+	recorder
+
+	GetFunc             func(function nbe.Function, path string) (*nbe.NBEResponse, error)
+	SetFunc             func(path string, value []byte) (*nbe.NBEResponse, error)
+	ValidateSettingFunc func(path string, value []byte) error
+	LastResponseFunc    func() time.Time
+
+	mu       sync.Mutex
+	onWrite  []func(path string, value []byte)
+	sequence int8
+}
+
+// Get calls GetFunc
+func (c *Controller) Get(function nbe.Function, path string) (*nbe.NBEResponse, error) {
+	c.record("Get", function, path)
+	return c.get(function, path)
+}
+
+// GetWithPriority calls GetFunc
+func (c *Controller) GetWithPriority(priority nbe.Priority, function nbe.Function, path string) (*nbe.NBEResponse, error) {
+	c.record("GetWithPriority", priority, function, path)
+	return c.get(function, path)
+}
+
+// GetAsync calls GetFunc and passes a successful response to cb
+func (c *Controller) GetAsync(function nbe.Function, path string, cb func(*nbe.NBEResponse)) (int8, error) {
+	c.record("GetAsync", function, path)
+	return c.async(cb)(c.get(function, path))
+}
+
+// GetAsyncWithPriority calls GetFunc and passes a successful response to cb
+func (c *Controller) GetAsyncWithPriority(priority nbe.Priority, function nbe.Function, path string, cb func(*nbe.NBEResponse)) (int8, error) {
+	c.record("GetAsyncWithPriority", priority, function, path)
+	return c.async(cb)(c.get(function, path))
+}
+
+// Set calls SetFunc
+func (c *Controller) Set(path string, value []byte) (*nbe.NBEResponse, error) {
+	c.record("Set", path, value)
+	return c.set(path, value)
+}
+
+// SetContext calls SetFunc unless ctx is done
+func (c *Controller) SetContext(ctx context.Context, path string, value []byte) (*nbe.NBEResponse, error) {
+	c.record("SetContext", path, value)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.set(path, value)
+}
+
+// SetAsync calls SetFunc and passes a successful response to cb
+func (c *Controller) SetAsync(path string, value []byte, cb func(*nbe.NBEResponse)) (int8, error) {
+	c.record("SetAsync", path, value)
+	return c.async(cb)(c.set(path, value))
+}
+
+// SetAsyncContext calls SetFunc unless ctx is done, and passes a successful
+// response to cb
+func (c *Controller) SetAsyncContext(ctx context.Context, path string, value []byte, cb func(*nbe.NBEResponse)) (int8, error) {
+	c.record("SetAsyncContext", path, value)
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return c.async(cb)(c.set(path, value))
+}
+
+// ValidateSetting calls ValidateSettingFunc; unset, every value is valid
+func (c *Controller) ValidateSetting(path string, value []byte) error {
+	c.record("ValidateSetting", path, value)
+	if c.ValidateSettingFunc == nil {
+		return nil
+	}
+	return c.ValidateSettingFunc(path, value)
+}
+
+// OnWrite registers handler to be called after each successful Set
+func (c *Controller) OnWrite(handler func(path string, value []byte)) {
+	c.record("OnWrite")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onWrite = append(c.onWrite, handler)
+}
+
+// LastResponse calls LastResponseFunc; unset, the controller never answered
+func (c *Controller) LastResponse() time.Time {
+	c.record("LastResponse")
+	if c.LastResponseFunc == nil {
+		return time.Time{}
+	}
+	return c.LastResponseFunc()
+}
+
+func (c *Controller) get(function nbe.Function, path string) (*nbe.NBEResponse, error) {
+	if c.GetFunc == nil {
+		return nil, unexpected("Get")
+	}
+	return c.GetFunc(function, path)
+}
+
+func (c *Controller) set(path string, value []byte) (*nbe.NBEResponse, error) {
+	if c.SetFunc == nil {
+		return nil, unexpected("Set")
+	}
+	response, err := c.SetFunc(path, value)
+	if err == nil {
+		c.mu.Lock()
+		var handlers []func(path string, value []byte)
+		handlers = append(handlers, c.onWrite...)
+		c.mu.Unlock()
+		for _, handler := range handlers {
+			handler(path, value)
+		}
+	}
+	return response, err
+}
+
+// async hands a response to cb the way the client does, returning the
+// sequence number the request would have been sent with
+func (c *Controller) async(cb func(*nbe.NBEResponse)) func(*nbe.NBEResponse, error) (int8, error) {
+	return func(response *nbe.NBEResponse, err error) (int8, error) {
+		if err != nil {
+			return -1, err
+		}
+		c.mu.Lock()
+		c.sequence = (c.sequence + 1) % 100
+		sequence := c.sequence
+		c.mu.Unlock()
+		if cb != nil {
+			cb(response)
+		}
+		return sequence, nil
+	}
+}
+
+// Broker mocks the MQTT client. Publishes are kept by full topic below
+// Prefix, and Deliver hands a message to the matching subscriptions.
+type Broker struct {
+	recorder
+
+	// Prefix is the topic prefix publishes and relative subscriptions go below
+	Prefix string
+	// PublishErr, when set, is returned by every publish
+	PublishErr error
+	// Connected is returned by IsConnected
+	Connected bool
+
+	mu            sync.Mutex
+	published     map[string]interface{}
+	subscriptions map[string]mqtt.MessageHandler
+	onConnection  []func(connected bool)
+}
+
+// PublishMany publishes each value to <prefix>/<topic>/<key>
+func (b *Broker) PublishMany(topic string, values map[string]interface{}) error {
+	b.record("PublishMany", topic, values)
+	if b.PublishErr != nil {
+		return b.PublishErr
+	}
+	for key, value := range values {
+		b.store(b.topic(topic+"/"+key), value)
+	}
+	return nil
+}
+
+// PublishRaw publishes val to <prefix>/<topic>
+func (b *Broker) PublishRaw(topic string, val interface{}) error {
+	b.record("PublishRaw", topic, val)
+	if b.PublishErr != nil {
+		return b.PublishErr
+	}
+	b.store(b.topic(topic), val)
+	return nil
+}
+
+// PublishJSON publishes val to <prefix>/<topic>
+func (b *Broker) PublishJSON(topic string, val interface{}) error {
+	b.record("PublishJSON", topic, val)
+	if b.PublishErr != nil {
+		return b.PublishErr
+	}
+	b.store(b.topic(topic), val)
+	return nil
+}
+
+// Subscribe registers callback for <prefix>/<topic>
+func (b *Broker) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) error {
+	b.record("Subscribe", topic, qos)
+	b.subscribe(b.topic(topic), callback)
+	return nil
+}
+
+// SubscribeTopic registers callback for fullTopic
+func (b *Broker) SubscribeTopic(fullTopic string, qos byte, callback mqtt.MessageHandler) error {
+	b.record("SubscribeTopic", fullTopic, qos)
+	b.subscribe(fullTopic, callback)
+	return nil
+}
+
+// IsConnected returns Connected
+func (b *Broker) IsConnected() bool {
+	b.record("IsConnected")
+	return b.Connected
+}
+
+// OnConnectionChange registers handler to be called by SetConnected
+func (b *Broker) OnConnectionChange(handler func(connected bool)) {
+	b.record("OnConnectionChange")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onConnection = append(b.onConnection, handler)
+}
+
+// SetConnected changes Connected and calls the connection change handlers
+func (b *Broker) SetConnected(connected bool) {
+	b.mu.Lock()
+	b.Connected = connected
+	var handlers []func(connected bool)
+	handlers = append(handlers, b.onConnection...)
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(connected)
+	}
+}
+
+// Published returns the last value published to the full topic
+func (b *Broker) Published(fullTopic string) (interface{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	value, ok := b.published[fullTopic]
+	return value, ok
+}
+
+// Deliver hands payload to the subscription of the full topic, returning
+// false if there is none. Wildcard subscriptions are not matched.
+func (b *Broker) Deliver(fullTopic string, payload []byte) bool {
+	b.mu.Lock()
+	callback, ok := b.subscriptions[fullTopic]
+	b.mu.Unlock()
+	if !ok {
+		return false
+	}
+	callback(nil, &Message{TopicName: fullTopic, Body: payload})
+	return true
+}
+
+func (b *Broker) topic(topic string) string {
+	if b.Prefix == "" {
+		return topic
+	}
+	return b.Prefix + "/" + topic
+}
+
+func (b *Broker) store(fullTopic string, value interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.published == nil {
+		b.published = make(map[string]interface{})
+	}
+	b.published[fullTopic] = value
+}
+
+func (b *Broker) subscribe(fullTopic string, callback mqtt.MessageHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[string]mqtt.MessageHandler)
+	}
+	b.subscriptions[fullTopic] = callback
+}
+
+// Message is a received MQTT message
+type Message struct {
+	TopicName string
+	Body      []byte
+	QoS       byte
+	Retain    bool
+}
+
+func (m *Message) Duplicate() bool   { return false }
+func (m *Message) Qos() byte         { return m.QoS }
+func (m *Message) Retained() bool    { return m.Retain }
+func (m *Message) Topic() string     { return m.TopicName }
+func (m *Message) MessageID() uint16 { return 0 }
+func (m *Message) Payload() []byte   { return m.Body }
+func (m *Message) Ack()              {}
+
+// Sink mocks an event sink, keeping the events it receives
+type Sink struct {
+	recorder
+
+	// HandleFunc, when set, is called with each event
+	HandleFunc func(event bus.Event)
+
+	mu     sync.Mutex
+	events []bus.Event
+}
+
+// Handle keeps event and calls HandleFunc
+func (s *Sink) Handle(event bus.Event) {
+	s.record("Handle", event)
+	s.mu.Lock()
+	s.events = append(s.events, event)
+	s.mu.Unlock()
+	if s.HandleFunc != nil {
+		s.HandleFunc(event)
+	}
+}
+
+// Events returns the events received so far, oldest first
+func (s *Sink) Events() []bus.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bus.Event(nil), s.events...)
+}
+
+var (
+	_ interfaces.Controller = (*Controller)(nil)
+	_ interfaces.Broker     = (*Broker)(nil)
+	_ interfaces.Sink       = (*Sink)(nil)
+	_ mqtt.Message          = (*Message)(nil)
+)
@@ -0,0 +1,108 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package mocks
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/interfaces"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestController(t *testing.T) {
+	controller := &Controller{
+		SetFunc: func(path string, value []byte) (*nbe.NBEResponse, error) {
+			if path == "boiler.temp" {
+				return nil, errors.New("timeout")
+			}
+			return &nbe.NBEResponse{}, nil
+		},
+	}
+	var written []string
+	controller.OnWrite(func(path string, value []byte) {
+		written = append(written, path+"="+string(value))
+	})
+
+	var answered int
+	if _, err := controller.SetAsync("hot_water.temp", []byte("55"), func(*nbe.NBEResponse) { answered++ }); err != nil {
+		t.Fatalf("SetAsync: %v", err)
+	}
+	if _, err := controller.Set("boiler.temp", []byte("70")); err == nil {
+		t.Fatal("expected the Set error")
+	}
+	if _, err := controller.Get(nbe.GetSetupFunction, "boiler.temp"); !errors.Is(err, ErrUnexpectedCall) {
+		t.Fatalf("expected ErrUnexpectedCall, got %v", err)
+	}
+
+	if answered != 1 {
+		t.Errorf("expected the callback once, got %d", answered)
+	}
+	if len(written) != 1 || written[0] != "hot_water.temp=55" {
+		t.Errorf("expected only the successful write, got %v", written)
+	}
+	if calls := controller.CallsTo("Set"); len(calls) != 1 || calls[0].Args[0] != "boiler.temp" {
+		t.Errorf("unexpected Set calls: %v", calls)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	broker := &Broker{Prefix: "nbe/1234"}
+	var client interfaces.Broker = broker
+
+	if err := client.PublishMany("operating", map[string]interface{}{"boiler_temp": 65}); err != nil {
+		t.Fatalf("PublishMany: %v", err)
+	}
+	if value, ok := broker.Published("nbe/1234/operating/boiler_temp"); !ok || value != 65 {
+		t.Errorf("expected the published value, got %v %v", value, ok)
+	}
+
+	var received string
+	client.Subscribe("set/boiler/temp", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		received = msg.Topic() + " " + string(msg.Payload())
+	})
+	if !broker.Deliver("nbe/1234/set/boiler/temp", []byte("70")) {
+		t.Fatal("expected the subscription to be found")
+	}
+	if received != "nbe/1234/set/boiler/temp 70" {
+		t.Errorf("unexpected message %q", received)
+	}
+	if broker.Deliver("nbe/1234/set/other", nil) {
+		t.Error("expected no subscription for another topic")
+	}
+
+	broker.PublishErr = errors.New("not connected")
+	if err := client.PublishRaw("status", "online"); err == nil {
+		t.Error("expected the publish error")
+	}
+}
+
+func TestSink(t *testing.T) {
+	eventBus := bus.New()
+	sink := &Sink{}
+	interfaces.Subscribe(eventBus, sink, bus.Alarm)
+
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "operating"})
+	eventBus.Publish(bus.Event{Kind: bus.Alarm, Key: "alarm"})
+
+	events := sink.Events()
+	if len(events) != 1 || events[0].Kind != bus.Alarm {
+		t.Errorf("expected only the alarm, got %v", events)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package keyring looks up passwords stored in the operating system's keyring
+// using the platform's command-line tools, so no cgo or D-Bus bindings are
+// needed.
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Service is the service name boiler-mate's keyring entries are stored under
+const Service = "boiler-mate"
+
+const (
+	Auto          = "auto"
+	SecretService = "secret-service"
+	KWallet       = "kwallet"
+	MacOS         = "macos"
+)
+
+// ErrNotFound is returned when the keyring has no entry for the name
+var ErrNotFound = errors.New("keyring entry not found")
+
+// run and lookPath are replaced in tests
+var (
+	run      = runCommand
+	lookPath = lookPathCommand
+)
+
+// runCommand executes a keyring tool and returns its output
+func runCommand(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// lookPathCommand reports whether a tool is installed
+func lookPathCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// Lookup returns the secret stored under name in the given backend. The auto
+// backend picks the macOS keychain on macOS, otherwise the Secret Service
+// (GNOME Keyring, KeePassXC) if secret-tool is installed, and KWallet last.
+//
+// Entries are expected under the "boiler-mate" service, e.g.
+//
+//	secret-tool store --label boiler-mate service boiler-mate name controller
+func Lookup(backend, name string) (string, error) {
+	if backend == "" || backend == Auto {
+		backend = detect()
+	}
+
+	var out []byte
+	var err error
+	switch backend {
+	case SecretService:
+		out, err = run("secret-tool", "lookup", "service", Service, "name", name)
+	case KWallet:
+		out, err = run("kwallet-query", "--folder", Service, "--read-password", name, "kdewallet")
+	case MacOS:
+		out, err = run("security", "find-generic-password", "-s", Service, "-a", name, "-w")
+	default:
+		return "", fmt.Errorf("unknown keyring backend %q", backend)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s lookup of %q: %w", backend, name, err)
+	}
+
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s lookup of %q: %w", backend, name, ErrNotFound)
+	}
+	return secret, nil
+}
+
+func detect() string {
+	if runtime.GOOS == "darwin" {
+		return MacOS
+	}
+	if lookPath("secret-tool") {
+		return SecretService
+	}
+	return KWallet
+}
@@ -0,0 +1,88 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package keyring
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	var called string
+	run = func(name string, args ...string) ([]byte, error) {
+		called = name + " " + strings.Join(args, " ")
+		return []byte("s3cret\n"), nil
+	}
+	defer func() { run = runCommand }()
+
+	tests := []struct {
+		backend  string
+		expected string
+	}{
+		{SecretService, "secret-tool lookup service boiler-mate name controller"},
+		{KWallet, "kwallet-query --folder boiler-mate --read-password controller kdewallet"},
+		{MacOS, "security find-generic-password -s boiler-mate -a controller -w"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			secret, err := Lookup(tt.backend, "controller")
+			if err != nil {
+				t.Fatalf("Lookup failed: %v", err)
+			}
+			if secret != "s3cret" {
+				t.Errorf("Expected trailing newline to be trimmed, got %q", secret)
+			}
+			if called != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, called)
+			}
+		})
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	run = func(name string, args ...string) ([]byte, error) {
+		return []byte("\n"), nil
+	}
+	defer func() { run = runCommand }()
+
+	if _, err := Lookup(SecretService, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an empty secret, got %v", err)
+	}
+	if _, err := Lookup("vault", "controller"); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("macOS always uses the keychain")
+	}
+	defer func() { lookPath = lookPathCommand }()
+
+	lookPath = func(string) bool { return true }
+	if backend := detect(); backend != SecretService {
+		t.Errorf("Expected secret-service when secret-tool is installed, got %s", backend)
+	}
+	lookPath = func(string) bool { return false }
+	if backend := detect(); backend != KWallet {
+		t.Errorf("Expected kwallet fallback, got %s", backend)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapping
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Start polls every mapped key and publishes it on its topic, subscribing to
+// <topic>/set for writable mappings. A value received there is checked against
+// the mapping's type, scaled back and handed to set with the topic it came on
+// and the mapped key.
+func Start(boiler *nbe.NBE, mqttClient *mqtt.Client, mappings []config.KeyMapping, set func(topic, key string, value []byte)) {
+	for _, m := range mappings {
+		m := m
+		go poll(boiler, mqttClient, m)
+
+		if !m.Writable {
+			continue
+		}
+		if err := mqttClient.Subscribe(fmt.Sprintf("%s/set", m.Topic), 1, func(client *mqtt.Client, msg mqtt.Message) {
+			value, err := FromMQTT(m, msg.Payload())
+			if err != nil {
+				log.Errorf("Invalid value for %s: %v", m.Topic, err)
+				return
+			}
+			set(msg.Topic(), m.Key, []byte(value))
+		}); err != nil {
+			log.Errorf("Failed to subscribe to %s/set: %v", m.Topic, err)
+		}
+	}
+}
+
+func poll(boiler *nbe.NBE, mqttClient *mqtt.Client, m config.KeyMapping) {
+	function, path := request(m)
+	name := m.Key[strings.LastIndex(m.Key, ".")+1:]
+	var last interface{}
+
+	for {
+		_, err := boiler.GetAsyncWithPriority(nbe.PriorityPoll, function, path, func(response *nbe.NBEResponse) {
+			raw, ok := response.Payload[name]
+			if !ok {
+				log.Debugf("Mapped key %s missing from response", m.Key)
+				return
+			}
+			value := ToMQTT(m, raw)
+			if value == last {
+				return
+			}
+			last = value
+			if err := mqttClient.PublishRaw(fmt.Sprintf("%s/%s", mqttClient.Prefix, m.Topic), value); err != nil {
+				log.Debugf("Failed to publish %s: %v", m.Topic, err)
+			}
+		})
+		if err != nil {
+			log.Debugf("Failed to get mapped key %s: %v", m.Key, err)
+		}
+		time.Sleep(m.Interval)
+	}
+}
+
+// request returns the NBE function and path used to read the mapped key
+func request(m config.KeyMapping) (nbe.Function, string) {
+	switch m.Source {
+	case "operating":
+		return nbe.GetOperatingDataFunction, m.Key
+	case "advanced":
+		return nbe.GetAdvancedDataFunction, m.Key
+	default:
+		return nbe.GetSetupFunction, m.Key
+	}
+}
+
+// ToMQTT converts a raw controller value into the mapping's published form
+func ToMQTT(m config.KeyMapping, raw interface{}) interface{} {
+	if m.Type == "string" {
+		return fmt.Sprintf("%v", raw)
+	}
+
+	var f float64
+	switch v := raw.(type) {
+	case int64:
+		f = float64(v)
+	case nbe.RoundedFloat:
+		f = float64(v)
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return v
+		}
+		f = parsed
+	default:
+		return fmt.Sprintf("%v", raw)
+	}
+	f = f*m.Scale + m.Offset
+
+	switch m.Type {
+	case "int":
+		return int64(math.Round(f))
+	case "bool":
+		if f != 0 {
+			return "ON"
+		}
+		return "OFF"
+	default:
+		return nbe.RoundedFloat(f)
+	}
+}
+
+// FromMQTT converts a payload received on the set topic into the raw value
+// written to the controller
+func FromMQTT(m config.KeyMapping, payload []byte) (string, error) {
+	value := strings.TrimSpace(string(payload))
+
+	switch m.Type {
+	case "string":
+		return value, nil
+	case "bool":
+		switch strings.ToUpper(value) {
+		case "ON", "1", "TRUE":
+			return "1", nil
+		case "OFF", "0", "FALSE":
+			return "0", nil
+		}
+		return "", fmt.Errorf("invalid boolean %q", value)
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid number %q", value)
+	}
+	f = (f - m.Offset) / m.Scale
+
+	if m.Type == "int" {
+		return strconv.FormatInt(int64(math.Round(f)), 10), nil
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapping
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestToMQTT(t *testing.T) {
+	tests := []struct {
+		name     string
+		mapping  config.KeyMapping
+		raw      interface{}
+		expected interface{}
+	}{
+		{"float scaled", config.KeyMapping{Type: "float", Scale: 0.1}, int64(655), nbe.RoundedFloat(65.5)},
+		{"float offset", config.KeyMapping{Type: "float", Scale: 1, Offset: -2}, nbe.RoundedFloat(20.5), nbe.RoundedFloat(18.5)},
+		{"int rounded", config.KeyMapping{Type: "int", Scale: 0.5}, int64(5), int64(3)},
+		{"bool on", config.KeyMapping{Type: "bool", Scale: 1}, int64(1), "ON"},
+		{"bool off", config.KeyMapping{Type: "bool", Scale: 1}, int64(0), "OFF"},
+		{"string", config.KeyMapping{Type: "string", Scale: 1}, int64(7), "7"},
+		{"numeric string", config.KeyMapping{Type: "float", Scale: 2}, "1.5", nbe.RoundedFloat(3)},
+		{"non-numeric string", config.KeyMapping{Type: "float", Scale: 1}, "abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ToMQTT(tt.mapping, tt.raw)
+			if result != tt.expected {
+				t.Errorf("ToMQTT(%v) = %v (%T), want %v (%T)", tt.raw, result, result, tt.expected, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFromMQTT(t *testing.T) {
+	tests := []struct {
+		name     string
+		mapping  config.KeyMapping
+		payload  string
+		expected string
+		wantErr  bool
+	}{
+		{"float unscaled", config.KeyMapping{Type: "float", Scale: 0.1}, "65.5", "655", false},
+		{"float offset", config.KeyMapping{Type: "float", Scale: 1, Offset: -2}, "18.5", "20.5", false},
+		{"int", config.KeyMapping{Type: "int", Scale: 1}, "42", "42", false},
+		{"bool on", config.KeyMapping{Type: "bool", Scale: 1}, "ON", "1", false},
+		{"bool off", config.KeyMapping{Type: "bool", Scale: 1}, "false", "0", false},
+		{"bool invalid", config.KeyMapping{Type: "bool", Scale: 1}, "maybe", "", true},
+		{"number invalid", config.KeyMapping{Type: "float", Scale: 1}, "hot", "", true},
+		{"string", config.KeyMapping{Type: "string", Scale: 1}, " auto ", "auto", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := FromMQTT(tt.mapping, []byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromMQTT(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("FromMQTT(%q) = %q, want %q", tt.payload, result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Burst polls the operating data every Interval for a while, for tracing the
+// oxygen and photo sensor while tuning the combustion, and returns to the
+// normal interval on its own afterwards
+type Burst struct {
+	Interval    time.Duration
+	Duration    time.Duration
+	MaxDuration time.Duration
+
+	mqttClient *mqtt.Client
+	now        func() time.Time
+	wake       chan struct{}
+
+	mu    sync.Mutex
+	until time.Time
+	timer *time.Timer
+}
+
+// Burst defaults for the zero values given to NewBurst
+const (
+	defaultBurstInterval    = time.Second
+	defaultBurstDuration    = 10 * time.Minute
+	defaultBurstMaxDuration = time.Hour
+)
+
+// NewBurst creates a burst polling every interval, for duration unless asked
+// otherwise and for at most maxDuration; zero values take the defaults
+func NewBurst(interval, duration, maxDuration time.Duration) *Burst {
+	if interval <= 0 {
+		interval = defaultBurstInterval
+	}
+	if duration <= 0 {
+		duration = defaultBurstDuration
+	}
+	if maxDuration <= 0 {
+		maxDuration = defaultBurstMaxDuration
+	}
+	if duration > maxDuration {
+		duration = maxDuration
+	}
+	return &Burst{
+		Interval:    interval,
+		Duration:    duration,
+		MaxDuration: maxDuration,
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Start polls at the burst interval for duration, or the default duration if
+// it is zero, capped at MaxDuration. Starting an active burst extends it.
+func (b *Burst) Start(duration time.Duration) (time.Time, error) {
+	if duration < 0 {
+		return time.Time{}, errors.New("duration must not be negative")
+	}
+	if duration == 0 {
+		duration = b.Duration
+	}
+	if duration > b.MaxDuration {
+		duration = b.MaxDuration
+	}
+
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+	} else {
+		log.Infof("Polling the operating data every %s for %s", b.Interval, duration)
+	}
+	b.until = b.now().Add(duration)
+	b.timer = time.AfterFunc(duration, func() {
+		b.Cancel()
+		b.publish()
+	})
+	until := b.until
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return until, nil
+}
+
+// Cancel returns to the normal interval
+func (b *Burst) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer == nil {
+		return
+	}
+	b.timer.Stop()
+	b.timer = nil
+	b.until = time.Time{}
+	log.Info("Burst polling ended")
+}
+
+// Until returns the end of the active burst, false if there is none
+func (b *Burst) Until() (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.until, b.timer != nil
+}
+
+// wait sleeps until the next poll: the burst interval during a burst,
+// otherwise interval, cut short when a burst starts. It reports whether
+// refresh cut it short.
+func (b *Burst) wait(interval time.Duration, refresh <-chan struct{}) bool {
+	if b == nil {
+		return sleep(interval, refresh)
+	}
+	if _, ok := b.Until(); ok {
+		return sleep(b.Interval, refresh)
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.wake:
+	case <-refresh:
+		return true
+	}
+	return false
+}
+
+// Run subscribes to burst/start, whose payload is the duration in minutes or
+// as a Go duration (empty or 0 for the default), and burst/cancel, and
+// publishes the burst state below burst every minute
+func (b *Burst) Run(mqttClient *mqtt.Client) error {
+	b.mqttClient = mqttClient
+	if err := mqttClient.Subscribe("burst/start", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		duration, err := ParseBurstDuration(string(msg.Payload()))
+		if err == nil {
+			_, err = b.Start(duration)
+		}
+		if err != nil {
+			log.Errorf("Failed to start burst polling: %v", err)
+		}
+		b.publish()
+	}); err != nil {
+		return err
+	}
+	if err := mqttClient.Subscribe("burst/cancel", 1, func(_ *mqtt.Client, _ mqtt.Message) {
+		b.Cancel()
+		b.publish()
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			b.publish()
+			time.Sleep(time.Minute)
+		}
+	}()
+	return nil
+}
+
+// ParseBurstDuration parses a burst duration given as minutes ("10") or as a
+// Go duration ("90s"); empty or zero is the default duration
+func ParseBurstDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if minutes, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(minutes * float64(time.Minute)), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+func (b *Burst) publish() {
+	if b.mqttClient == nil {
+		return
+	}
+	values := map[string]interface{}{"active": "OFF", "remaining": int64(0)}
+	if until, ok := b.Until(); ok {
+		values["active"] = "ON"
+		values["remaining"] = int64(math.Ceil(until.Sub(b.now()).Minutes()))
+	}
+	if err := b.mqttClient.PublishMany("burst", values); err != nil {
+		log.Debugf("Failed to publish the burst state: %v", err)
+	}
+}
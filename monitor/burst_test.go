@@ -0,0 +1,96 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBurstStartAndCancel(t *testing.T) {
+	burst := NewBurst(time.Second, 10*time.Minute, 30*time.Minute)
+	start := time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC)
+	burst.now = func() time.Time { return start }
+
+	until, err := burst.Start(0)
+	if err != nil || !until.Equal(start.Add(10*time.Minute)) {
+		t.Errorf("Start(0) = %v, %v, want the default duration", until, err)
+	}
+	if until, _ := burst.Start(2 * time.Hour); !until.Equal(start.Add(30 * time.Minute)) {
+		t.Errorf("Expected the duration capped at 30m, ends %v", until)
+	}
+	if _, err := burst.Start(-time.Minute); err == nil {
+		t.Error("Expected an error for a negative duration")
+	}
+
+	burst.Cancel()
+	if _, ok := burst.Until(); ok {
+		t.Error("Expected no burst after cancelling it")
+	}
+}
+
+func TestBurstEndsOnItsOwn(t *testing.T) {
+	burst := NewBurst(time.Second, time.Minute, time.Minute)
+	if _, err := burst.Start(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := burst.Until(); !ok {
+		t.Fatal("Expected the burst to be active")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := burst.Until(); ok {
+		t.Error("Expected the burst to end after its duration")
+	}
+}
+
+func TestBurstWakesTheMonitor(t *testing.T) {
+	burst := NewBurst(time.Second, time.Minute, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		burst.wait(time.Hour, nil)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := burst.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected starting a burst to cut the wait short")
+	}
+	burst.Cancel()
+}
+
+func TestParseBurstDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":    0,
+		"0":   0,
+		"15":  15 * time.Minute,
+		"90s": 90 * time.Second,
+	}
+	for value, want := range tests {
+		if got, err := ParseBurstDuration(value); err != nil || got != want {
+			t.Errorf("ParseBurstDuration(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := ParseBurstDuration("later"); err == nil {
+		t.Error("Expected an error for an invalid duration")
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// EventLog follows the controller's event log, reporting every entry once
+type EventLog struct {
+	fetch func(path string) (map[string]interface{}, error)
+	next  int64
+}
+
+// NewEventLog creates a follower for the boiler's event log, starting with
+// the entries it currently holds
+func NewEventLog(boiler *nbe.NBE) *EventLog {
+	return &EventLog{
+		fetch: func(path string) (map[string]interface{}, error) {
+			response, err := boiler.Get(nbe.GetEventLogFunction, path)
+			if err != nil {
+				return nil, err
+			}
+			return response.Payload, nil
+		},
+	}
+}
+
+// Poll returns the entries logged since the previous poll, oldest first
+func (l *EventLog) Poll() ([]nbe.Event, error) {
+	path := "*"
+	if l.next > 0 {
+		path = strconv.FormatInt(l.next, 10)
+	}
+	payload, err := l.fetch(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []nbe.Event
+	for _, event := range nbe.ParseEvents(payload) {
+		if event.Seq < l.next {
+			continue
+		}
+		events = append(events, event)
+		l.next = event.Seq + 1
+	}
+	return events, nil
+}
+
+// Follow polls the event log every interval, calling handler for each new
+// entry, until stop is closed. Failed polls are passed to onError and retried.
+func (l *EventLog) Follow(interval time.Duration, stop <-chan struct{}, handler func(nbe.Event), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		events, err := l.Poll()
+		if err != nil {
+			onError(err)
+		}
+		for _, event := range events {
+			handler(event)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEventLogPollReportsEachEntryOnce(t *testing.T) {
+	var paths []string
+	responses := []map[string]interface{}{
+		{"0": "240110 08:00:00,1,Power on", "1": "240110 09:30:00,9,Alarm burner is too hot"},
+		{},
+		{"1": "240110 09:30:00,9,Alarm burner is too hot", "2": "240110 10:00:00,20,Error no fire - out of pellets"},
+	}
+	log := &EventLog{fetch: func(path string) (map[string]interface{}, error) {
+		paths = append(paths, path)
+		response := responses[0]
+		responses = responses[1:]
+		return response, nil
+	}}
+
+	var codes []int64
+	for i := 0; i < 3; i++ {
+		events, err := log.Poll()
+		if err != nil {
+			t.Fatalf("Poll() error = %v", err)
+		}
+		for _, event := range events {
+			codes = append(codes, event.Code)
+		}
+	}
+
+	if len(codes) != 3 || codes[0] != 1 || codes[1] != 9 || codes[2] != 20 {
+		t.Errorf("Expected codes [1 9 20], got %v", codes)
+	}
+	if len(paths) != 3 || paths[0] != "*" || paths[1] != "2" || paths[2] != "2" {
+		t.Errorf("Expected requests for *, 2, 2; got %v", paths)
+	}
+}
+
+func TestEventLogPollError(t *testing.T) {
+	log := &EventLog{fetch: func(string) (map[string]interface{}, error) {
+		return nil, errors.New("timeout")
+	}}
+	if _, err := log.Poll(); err == nil {
+		t.Error("Expected the fetch error to be returned")
+	}
+}
@@ -18,67 +18,195 @@
 package monitor
 
 import (
-	"fmt"
-	"reflect"
+	"sync"
 	"time"
 
 	cmp "github.com/google/go-cmp/cmp"
-	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
 	"github.com/mlipscombe/boiler-mate/nbe"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	"github.com/mlipscombe/boiler-mate/quiethours"
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultPollInterval is how often operating and advanced data are polled
+// unless SetPollInterval changes it
+const defaultPollInterval = 5 * time.Second
+
+var (
+	optionsMutex sync.RWMutex
+	pipelines    *pipeline.Pipelines
+	quietHours   *quiethours.Hours
+	states       *nbe.StateTable
+	burst        *Burst
+	pollInterval = defaultPollInterval
+	// advancedPath is the request path of the advanced data monitor
+	advancedPath = nbe.FieldsPath(nil)
+)
+
+// SetPipelines makes the monitors started afterwards correct the values they
+// read with p before caching and publishing them
+func SetPipelines(p *pipeline.Pipelines) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	pipelines = p
+}
+
+func currentPipelines() *pipeline.Pipelines {
+	optionsMutex.RLock()
+	defer optionsMutex.RUnlock()
+	return pipelines
+}
+
+// SetQuietHours makes the operating and advanced data monitors started
+// afterwards poll at the slower interval of hours while it is quiet
+func SetQuietHours(hours *quiethours.Hours) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	quietHours = hours
+}
+
+// SetBurst makes the operating data monitor started afterwards poll at the
+// burst interval while b is active
+func SetBurst(b *Burst) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	burst = b
+}
+
+func currentBurst() *Burst {
+	optionsMutex.RLock()
+	defer optionsMutex.RUnlock()
+	return burst
+}
+
+// SetStates makes the operating data monitor started afterwards name the
+// power states and translate the alarm texts with table; nil uses the
+// embedded defaults
+func SetStates(table *nbe.StateTable) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	states = table
+}
+
+func currentStates() *nbe.StateTable {
+	optionsMutex.RLock()
+	defer optionsMutex.RUnlock()
+	return states
+}
+
+func currentQuietHours() *quiethours.Hours {
+	optionsMutex.RLock()
+	defer optionsMutex.RUnlock()
+	return quietHours
+}
+
+// SetAdvancedFields makes the advanced data monitor started afterwards request
+// only the named fields; none requests all of them
+func SetAdvancedFields(names []string) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	advancedPath = nbe.FieldsPath(names)
+}
+
+func currentAdvancedPath() string {
+	optionsMutex.RLock()
+	defer optionsMutex.RUnlock()
+	return advancedPath
+}
+
+// SetPollInterval changes how often the operating and advanced data monitors
+// poll, from their next poll on; zero restores the default
+func SetPollInterval(interval time.Duration) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	pollInterval = interval
+}
+
+func currentPollInterval() time.Duration {
+	optionsMutex.RLock()
+	defer optionsMutex.RUnlock()
+	return pollInterval
+}
+
 // StartSettingsMonitor polls settings data and publishes changes
 // If ready channel is provided, it will be signaled when first data is published
-func StartSettingsMonitor(boiler *nbe.NBE, mqttClient *mqtt.Client, category string) chan bool {
-	return StartSettingsMonitorWithReady(boiler, mqttClient, category, true)
+func StartSettingsMonitor(boiler *nbe.NBE, eventBus *bus.Bus, category string) chan bool {
+	return StartSettingsMonitorWithReady(boiler, eventBus, category, true)
 }
 
 // StartSettingsMonitorWithReady polls settings data with optional ready notification
-func StartSettingsMonitorWithReady(boiler *nbe.NBE, mqttClient *mqtt.Client, category string, notifyReady bool) chan bool {
-	cache := make(map[string]interface{})
-	gauges := make(map[string]*prometheus.GaugeVec)
-	var ready chan bool
-	if notifyReady {
-		ready = make(chan bool, 1)
+func StartSettingsMonitorWithReady(boiler *nbe.NBE, eventBus *bus.Bus, category string, notifyReady bool) chan bool {
+	ready := StartSettingsMonitors(boiler, eventBus, []string{category}, 1)[0]
+	if !notifyReady {
+		return nil
 	}
+	return ready
+}
 
+// StartOperatingDataMonitor polls operating data and publishes changes
+// Returns a channel that signals when first data is published
+func StartOperatingDataMonitor(boiler *nbe.NBE, eventBus *bus.Bus) chan bool {
+	cache := make(map[string]interface{})
+	ready := make(chan bool, 1)
 	firstPublish := true
+	stats := diagnostics.Track("operating_data")
+	quiet := newSilence("operating_data")
+	corrections := currentPipelines()
+	hours := currentQuietHours()
+	stateTable := currentStates()
+	bursts := currentBurst()
+	republish := false
 
-	go func() {
+	stats.Go(func() {
 		for {
-			_, err := boiler.GetAsync(nbe.GetSetupFunction, fmt.Sprintf("%s.*", category), func(response *nbe.NBEResponse) {
+			refresh := refreshSignal()
+			all := republish
+			stats.Poll()
+			_, err := boiler.GetAsyncWithPriority(nbe.PriorityPoll, nbe.GetOperatingDataFunction, "*", func(response *nbe.NBEResponse) {
+				nbe.ScaleFields(nbe.OperatingFields, response.Payload)
+				corrections.Read("operating_data", response.Payload)
+				if text, ok := response.Payload["alarm_text"].(string); ok {
+					response.Payload["alarm_text"] = stateTable.Translate(text)
+				}
 				changeSet := make(map[string]interface{})
+				var transitions []bus.Event
 				for key, value := range response.Payload {
-					// Register prometheus gauge if numeric and not exists
-					if gauges[key] == nil && isNumeric(value) {
-						gauges[key] = prometheus.NewGaugeVec(
-							prometheus.GaugeOpts{
-								Namespace: "boiler_mate",
-								Subsystem: category,
-								Name:      key,
-							},
-							[]string{"serial"},
-						)
-						if err := prometheus.Register(gauges[key]); err != nil {
-							log.Debugf("Failed to register gauge %s.%s: %v", category, key, err)
-						}
-					}
-
 					// Publish if changed
 					if !cmp.Equal(cache[key], value) {
+						if event, ok := transition(stateTable, key, cache[key], value, response.Payload); ok {
+							transitions = append(transitions, event)
+						}
 						changeSet[key] = value
 						cache[key] = value
-						updateGauge(gauges[key], boiler.Serial, value)
+					} else if all || quiet.due(key) {
+						changeSet[key] = value
+					}
+				}
+				// Add state_text and state_on for state field
+				if curState, ok := changeSet["state"].(int64); ok {
+					changeSet["state_text"] = stateTable.Text(curState)
+					if stateTable.On(curState) {
+						changeSet["state_on"] = "ON"
+					} else {
+						changeSet["state_on"] = "OFF"
 					}
 				}
-				if err := mqttClient.PublishMany(category, changeSet); err != nil {
-					log.Debugf("Failed to publish %s changes: %v", category, err)
+				if len(changeSet) > 0 {
+					eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: changeSet})
+					quiet.published(changeSet)
 				}
+				for _, event := range transitions {
+					eventBus.Publish(event)
+				}
+				stats.Published(len(changeSet))
 
 				// Signal ready after first successful publish
-				if firstPublish && ready != nil {
+				if firstPublish {
 					select {
 					case ready <- true:
 					default:
@@ -87,145 +215,142 @@ func StartSettingsMonitorWithReady(boiler *nbe.NBE, mqttClient *mqtt.Client, cat
 				}
 			})
 			if err != nil {
-				log.Debugf("Failed to get %s settings: %v", category, err)
+				log.Debugf("Failed to get operating data: %v", err)
 			}
-			time.Sleep(10 * time.Second)
+			republish = bursts.wait(hours.Poll(currentPollInterval()), refresh)
 		}
-	}()
+	})
 
 	return ready
 }
 
-// StartOperatingDataMonitor polls operating data and publishes changes
-// Returns a channel that signals when first data is published
-func StartOperatingDataMonitor(boiler *nbe.NBE, mqttClient *mqtt.Client) chan bool {
+// StartAdvancedDataMonitor polls advanced data and publishes changes
+func StartAdvancedDataMonitor(boiler *nbe.NBE, eventBus *bus.Bus) {
 	cache := make(map[string]interface{})
-	gauges := make(map[string]*prometheus.GaugeVec)
-	ready := make(chan bool, 1)
-	firstPublish := true
+	stats := diagnostics.Track("advanced_data")
+	quiet := newSilence("advanced_data")
+	corrections := currentPipelines()
+	hours := currentQuietHours()
+	supported := newSupport(boiler, eventBus, "advanced_data")
+	path := currentAdvancedPath()
+	republish := false
 
-	go func() {
+	stats.Go(func() {
 		for {
-			_, err := boiler.GetAsync(nbe.GetOperatingDataFunction, "*", func(response *nbe.NBEResponse) {
+			refresh := refreshSignal()
+			all := republish
+			stats.Poll()
+			_, err := boiler.GetAsyncWithPriority(nbe.PriorityPoll, nbe.GetAdvancedDataFunction, path, func(response *nbe.NBEResponse) {
+				if supported.rejected(response) {
+					return
+				}
+				nbe.ScaleFields(nbe.AdvancedFields, response.Payload)
+				nbe.ExpandOutputs(response.Payload)
+				corrections.Read("advanced_data", response.Payload)
 				changeSet := make(map[string]interface{})
 				for key, value := range response.Payload {
-					// Register prometheus gauge if numeric and not exists
-					if gauges[key] == nil && isNumeric(value) {
-						gauges[key] = prometheus.NewGaugeVec(
-							prometheus.GaugeOpts{
-								Namespace: "boiler_mate",
-								Subsystem: "operating_data",
-								Name:      key,
-							},
-							[]string{"serial"},
-						)
-						prometheus.MustRegister(gauges[key])
-					}
-
 					// Publish if changed
 					if !cmp.Equal(cache[key], value) {
 						changeSet[key] = value
 						cache[key] = value
-						updateGauge(gauges[key], boiler.Serial, value)
-
-						// Add state_text and state_on for state field
-						if key == "state" {
-							if curState, ok := value.(int64); ok {
-								changeSet["state_text"] = nbe.PowerStates[curState]
-								if curState != 14 {
-									changeSet["state_on"] = "ON"
-								} else {
-									changeSet["state_on"] = "OFF"
-								}
-							}
-						}
+					} else if all || quiet.due(key) {
+						changeSet[key] = value
 					}
 				}
-				go func() {
-					if err := mqttClient.PublishMany("operating_data", changeSet); err != nil {
-						log.Debugf("Failed to publish operating_data: %v", err)
-					}
-				}()
-
-				// Signal ready after first successful publish
-				if firstPublish {
-					select {
-					case ready <- true:
-					default:
-					}
-					firstPublish = false
+				if len(changeSet) > 0 {
+					eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "advanced_data", Values: changeSet})
+					quiet.published(changeSet)
 				}
+				stats.Published(len(changeSet))
 			})
 			if err != nil {
-				log.Debugf("Failed to get operating data: %v", err)
+				log.Debugf("Failed to get advanced data: %v", err)
 			}
-			time.Sleep(5 * time.Second)
+			republish = sleep(hours.Poll(currentPollInterval()), refresh)
+			supported.wait()
 		}
-	}()
-
-	return ready
+	})
 }
 
-// StartAdvancedDataMonitor polls advanced data and publishes changes
-func StartAdvancedDataMonitor(boiler *nbe.NBE, mqttClient *mqtt.Client) {
+// StartConsumptionMonitor polls the controller's pellet consumption counter and
+// publishes it together with its energy equivalent, using calorificValue in kWh/kg
+func StartConsumptionMonitor(boiler *nbe.NBE, eventBus *bus.Bus, calorificValue float64) {
 	cache := make(map[string]interface{})
-	gauges := make(map[string]*prometheus.GaugeVec)
+	stats := diagnostics.Track("consumption")
+	quiet := newSilence("consumption")
+	corrections := currentPipelines()
+	supported := newSupport(boiler, eventBus, "consumption")
+	republish := false
 
-	go func() {
+	stats.Go(func() {
 		for {
-			_, err := boiler.GetAsync(nbe.GetAdvancedDataFunction, "*", func(response *nbe.NBEResponse) {
-				changeSet := make(map[string]interface{})
-				for key, value := range response.Payload {
-					// Register prometheus gauge if numeric and not exists
-					if gauges[key] == nil && isNumeric(value) {
-						gauges[key] = prometheus.NewGaugeVec(
-							prometheus.GaugeOpts{
-								Namespace: "boiler_mate",
-								Subsystem: "operating_data",
-								Name:      key,
-							},
-							[]string{"serial"},
-						)
-						prometheus.MustRegister(gauges[key])
-					}
+			refresh := refreshSignal()
+			all := republish
+			stats.Poll()
+			_, err := boiler.GetAsyncWithPriority(nbe.PriorityPoll, nbe.GetConsumptionDataFunction, "counter", func(response *nbe.NBEResponse) {
+				if supported.rejected(response) {
+					return
+				}
+				counter, ok := nbe.ToFloat(response.Payload["counter"])
+				if !ok {
+					log.Debugf("Unexpected consumption counter: %v", response.Payload)
+					return
+				}
 
-					// Publish if changed
+				values := consumptionValues(counter, calorificValue)
+				corrections.Read("consumption", values)
+				changeSet := make(map[string]interface{})
+				for key, value := range values {
 					if !cmp.Equal(cache[key], value) {
 						changeSet[key] = value
 						cache[key] = value
-						updateGauge(gauges[key], boiler.Serial, value)
+					} else if all || quiet.due(key) {
+						changeSet[key] = value
 					}
 				}
-				go func() {
-					if err := mqttClient.PublishMany("advanced_data", changeSet); err != nil {
-						log.Debugf("Failed to publish advanced_data: %v", err)
-					}
-				}()
+				if len(changeSet) > 0 {
+					eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "consumption", Values: changeSet})
+					quiet.published(changeSet)
+				}
+				stats.Published(len(changeSet))
 			})
 			if err != nil {
-				log.Debugf("Failed to get advanced data: %v", err)
+				log.Debugf("Failed to get consumption data: %v", err)
 			}
-			time.Sleep(5 * time.Second)
+			republish = sleep(60*time.Second, refresh)
+			supported.wait()
 		}
-	}()
+	})
 }
 
-func isNumeric(value interface{}) bool {
-	if value == nil {
-		return false
+// transition returns the event raised when an operating data key changes from
+// previous to value, if any, naming power states with states. The first value
+// seen is not a transition.
+func transition(states *nbe.StateTable, key string, previous, value interface{}, payload map[string]interface{}) (bus.Event, bool) {
+	switch key {
+	case "state":
+		if previous == nil {
+			return bus.Event{}, false
+		}
+		event := bus.Event{Kind: bus.StateTransition, Category: "operating_data", Key: key, Previous: previous, Value: value}
+		if state, ok := value.(int64); ok {
+			event.Text = states.Text(state)
+		}
+		return event, true
+	case "alarm":
+		if code, ok := value.(int64); !ok || code == 0 {
+			return bus.Event{}, false
+		}
+		text, _ := payload["alarm_text"].(string)
+		return bus.Event{Kind: bus.Alarm, Category: "operating_data", Key: key, Previous: previous, Value: value, Text: text}, true
 	}
-	dataType := reflect.TypeOf(value).Kind()
-	return dataType == reflect.Float64 || dataType == reflect.Int64
+	return bus.Event{}, false
 }
 
-func updateGauge(gauge *prometheus.GaugeVec, serial string, value interface{}) {
-	if gauge == nil {
-		return
-	}
-	switch v := value.(type) {
-	case nbe.RoundedFloat:
-		gauge.WithLabelValues(serial).Set(float64(v))
-	case int64:
-		gauge.WithLabelValues(serial).Set(float64(v))
+// consumptionValues derives the published consumption values from the raw counter
+func consumptionValues(counter float64, calorificValue float64) map[string]interface{} {
+	return map[string]interface{}{
+		"pellets_kg": nbe.RoundedFloat(counter),
+		"energy_kwh": nbe.RoundedFloat(counter * calorificValue),
 	}
 }
@@ -20,42 +20,19 @@ package monitor
 import (
 	"testing"
 
+	"github.com/mlipscombe/boiler-mate/bus"
 	"github.com/mlipscombe/boiler-mate/nbe"
 )
 
-func TestIsNumeric(t *testing.T) {
-	tests := []struct {
-		name     string
-		value    interface{}
-		expected bool
-	}{
-		{"int64", int64(42), true},
-		{"float64", float64(3.14), true},
-		{"RoundedFloat", nbe.RoundedFloat(2.5), true},
-		{"string", "hello", false},
-		{"bool", true, false},
-		{"nil", nil, false},
-	}
+func TestConsumptionValues(t *testing.T) {
+	values := consumptionValues(100, 4.8)
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := isNumeric(tt.value)
-			if result != tt.expected {
-				t.Errorf("isNumeric(%v) = %v, want %v", tt.value, result, tt.expected)
-			}
-		})
+	if values["pellets_kg"] != nbe.RoundedFloat(100) {
+		t.Errorf("Expected pellets_kg=100, got %v", values["pellets_kg"])
+	}
+	if values["energy_kwh"] != nbe.RoundedFloat(480) {
+		t.Errorf("Expected energy_kwh=480, got %v", values["energy_kwh"])
 	}
-}
-
-func TestUpdateGauge(t *testing.T) {
-	// Test that updateGauge doesn't panic with nil gauge
-	updateGauge(nil, "test-serial", int64(42))
-
-	// Test with RoundedFloat
-	updateGauge(nil, "test-serial", nbe.RoundedFloat(3.14))
-
-	// Test with string (should be ignored)
-	updateGauge(nil, "test-serial", "not a number")
 }
 
 func TestStartSettingsMonitor(t *testing.T) {
@@ -69,3 +46,39 @@ func TestStartOperatingDataMonitor(t *testing.T) {
 func TestStartAdvancedDataMonitor(t *testing.T) {
 	t.Skip("Skipping integration test - requires working network communication")
 }
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		previous interface{}
+		value    interface{}
+		payload  map[string]interface{}
+		expected bus.Kind
+		ok       bool
+	}{
+		{"first state", "state", nil, int64(5), nil, "", false},
+		{"state change", "state", int64(5), int64(14), nil, bus.StateTransition, true},
+		{"alarm raised", "alarm", int64(0), int64(9), map[string]interface{}{"alarm_text": "Burner too hot"}, bus.Alarm, true},
+		{"alarm cleared", "alarm", int64(9), int64(0), nil, "", false},
+		{"other key", "boiler_temp", nbe.RoundedFloat(60), nbe.RoundedFloat(61), nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := transition(nil, tt.key, tt.previous, tt.value, tt.payload)
+			if ok != tt.ok || event.Kind != tt.expected {
+				t.Errorf("transition(%s, %v, %v) = %v, %v; want %v, %v", tt.key, tt.previous, tt.value, event.Kind, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+
+	event, _ := transition(nil, "state", int64(5), int64(14), nil)
+	if event.Text != nbe.DefaultStates().Text(14) || event.Previous != int64(5) {
+		t.Errorf("Unexpected state transition event: %+v", event)
+	}
+	event, _ = transition(nil, "alarm", int64(0), int64(9), map[string]interface{}{"alarm_text": "Burner too hot"})
+	if event.Text != "Burner too hot" {
+		t.Errorf("Expected alarm text, got %q", event.Text)
+	}
+}
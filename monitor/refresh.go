@@ -0,0 +1,69 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	refreshMutex sync.Mutex
+	refreshed    = make(chan struct{})
+)
+
+// Refresh makes the running monitors poll right away and republish all their
+// values, the unchanged ones included
+func Refresh() {
+	refreshMutex.Lock()
+	defer refreshMutex.Unlock()
+	log.Info("Refreshing all values")
+	close(refreshed)
+	refreshed = make(chan struct{})
+}
+
+// refreshSignal returns a channel closed by the next Refresh. Monitors take it
+// before polling, so a refresh during the poll still wakes them afterwards.
+func refreshSignal() <-chan struct{} {
+	refreshMutex.Lock()
+	defer refreshMutex.Unlock()
+	return refreshed
+}
+
+// sleep waits for interval and reports whether refresh cut it short
+func sleep(interval time.Duration, refresh <-chan struct{}) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-refresh:
+		return true
+	}
+}
+
+// RunRefresh subscribes to refresh, which refreshes all values whatever its
+// payload
+func RunRefresh(mqttClient *mqtt.Client) error {
+	return mqttClient.Subscribe("refresh", 1, func(_ *mqtt.Client, _ mqtt.Message) {
+		Refresh()
+	})
+}
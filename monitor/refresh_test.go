@@ -0,0 +1,81 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+)
+
+func TestRefreshCutsTheSleepShort(t *testing.T) {
+	refresh := refreshSignal()
+	if sleep(time.Millisecond, refresh) {
+		t.Error("Expected the sleep to end on its own")
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- sleep(time.Hour, refresh)
+	}()
+	Refresh()
+	select {
+	case refreshed := <-done:
+		if !refreshed {
+			t.Error("Expected the sleep to report the refresh")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the refresh to cut the sleep short")
+	}
+
+	// a refresh taken before polling still wakes the monitor after it
+	refresh = refreshSignal()
+	Refresh()
+	if !sleep(time.Hour, refresh) {
+		t.Error("Expected a refresh during the poll to be noticed")
+	}
+}
+
+func TestRefreshRepublishesSettings(t *testing.T) {
+	events := make(chan bus.Event, 10)
+	poller := &settingsPoller{
+		fetch: func(category string) (map[string]interface{}, error) {
+			return map[string]interface{}{"temp": int64(60), "mode": "auto"}, nil
+		},
+		publish:  func(event bus.Event) { events <- event },
+		interval: time.Hour,
+		stats:    diagnostics.Track("refresh_test"),
+	}
+	poller.start([]string{"boiler"}, 1)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if len(event.Values) != 2 {
+				t.Errorf("Expected all values to be published, got %v", event.Values)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected publish %d", i+1)
+		}
+		if i == 0 {
+			Refresh()
+		}
+	}
+}
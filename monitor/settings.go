@@ -0,0 +1,153 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"fmt"
+	"time"
+
+	cmp "github.com/google/go-cmp/cmp"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+	log "github.com/sirupsen/logrus"
+)
+
+// settingsInterval is how long each category waits after a fetch before it is
+// fetched again
+const settingsInterval = 10 * time.Second
+
+// StartSettingsMonitors polls the settings categories with at most workers
+// requests in flight and publishes changes. It returns one channel per
+// category, signaled when that category's first data is published.
+func StartSettingsMonitors(boiler *nbe.NBE, eventBus *bus.Bus, categories []string, workers int) []chan bool {
+	poller := &settingsPoller{
+		fetch: func(category string) (map[string]interface{}, error) {
+			response, err := boiler.GetWithPriority(nbe.PriorityPoll, nbe.GetSetupFunction, fmt.Sprintf("%s.*", category))
+			if err != nil {
+				return nil, err
+			}
+			return response.Payload, nil
+		},
+		publish:     eventBus.Publish,
+		interval:    settingsInterval,
+		stats:       diagnostics.Track("settings"),
+		corrections: currentPipelines(),
+	}
+	return poller.start(categories, workers)
+}
+
+// settingsPoller shares a bounded pool of workers between the settings
+// categories. Each category is queued again one interval after its own fetch
+// completes, so a slow or failing category only delays itself.
+type settingsPoller struct {
+	fetch       func(category string) (map[string]interface{}, error)
+	publish     func(bus.Event)
+	interval    time.Duration
+	stats       *diagnostics.Subsystem
+	corrections *pipeline.Pipelines
+
+	jobs chan *settingsCategory
+}
+
+// settingsCategory is the published state of one settings category; it is
+// only ever handled by one worker at a time
+type settingsCategory struct {
+	name  string
+	cache map[string]interface{}
+	quiet *silence
+	ready chan bool
+	// republish publishes the unchanged values too on the next update, after
+	// a Refresh
+	republish bool
+}
+
+func (p *settingsPoller) start(categories []string, workers int) []chan bool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p.jobs = make(chan *settingsCategory, len(categories))
+	ready := make([]chan bool, len(categories))
+	for i, name := range categories {
+		category := &settingsCategory{
+			name:  name,
+			cache: make(map[string]interface{}),
+			quiet: newSilence(name),
+			ready: make(chan bool, 1),
+		}
+		ready[i] = category.ready
+		p.jobs <- category
+	}
+	for i := 0; i < workers; i++ {
+		p.stats.Go(p.work)
+	}
+	return ready
+}
+
+func (p *settingsPoller) work() {
+	for category := range p.jobs {
+		refresh := refreshSignal()
+		p.poll(category)
+		go func() {
+			category.republish = sleep(p.interval, refresh)
+			p.jobs <- category
+		}()
+	}
+}
+
+func (p *settingsPoller) poll(category *settingsCategory) {
+	p.stats.Poll()
+	payload, err := p.fetch(category.name)
+	if err != nil {
+		log.Debugf("Failed to get %s settings: %v", category.name, err)
+		return
+	}
+
+	p.corrections.Read(category.name, payload)
+	changeSet := category.update(payload)
+	if len(changeSet) > 0 {
+		p.publish(bus.Event{Kind: bus.ValueChanged, Category: category.name, Values: changeSet, Guaranteed: true})
+	}
+	p.stats.Published(len(changeSet))
+
+	// Signal ready after first successful publish
+	select {
+	case category.ready <- true:
+	default:
+	}
+}
+
+// update caches the payload, returning the values that changed along with
+// unchanged values due to be republished
+func (c *settingsCategory) update(payload map[string]interface{}) map[string]interface{} {
+	changeSet := make(map[string]interface{})
+	for key, value := range payload {
+		// Publish if changed
+		if !cmp.Equal(c.cache[key], value) {
+			changeSet[key] = value
+			c.cache[key] = value
+		} else if c.republish || c.quiet.due(key) {
+			changeSet[key] = value
+		}
+	}
+	c.republish = false
+	c.quiet.published(changeSet)
+	return changeSet
+}
@@ -0,0 +1,198 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/mlipscombe/boiler-mate/pipeline"
+)
+
+func TestSettingsPollerIsolatesSlowCategories(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		fetches  = make(map[string]int)
+		events   []bus.Event
+		inFlight atomic.Int32
+		maxSeen  atomic.Int32
+	)
+	release := make(chan struct{})
+	defer close(release)
+
+	poller := &settingsPoller{
+		fetch: func(category string) (map[string]interface{}, error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				seen := maxSeen.Load()
+				if n <= seen || maxSeen.CompareAndSwap(seen, n) {
+					break
+				}
+			}
+
+			mu.Lock()
+			fetches[category]++
+			count := fetches[category]
+			mu.Unlock()
+
+			switch category {
+			case "slow":
+				<-release
+			case "broken":
+				return nil, errors.New("timeout waiting for request")
+			}
+			return map[string]interface{}{"temp": nbe.RoundedFloat(count)}, nil
+		},
+		publish: func(event bus.Event) {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		},
+		interval: 5 * time.Millisecond,
+		stats:    diagnostics.Track("settings_test"),
+	}
+	ready := poller.start([]string{"slow", "broken", "boiler", "hot_water"}, 2)
+
+	for i, name := range []string{"boiler", "hot_water"} {
+		select {
+		case <-ready[i+2]:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s never became ready", name)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := fetches["boiler"] >= 3 && fetches["broken"] >= 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches["boiler"] < 3 || fetches["broken"] < 3 {
+		t.Errorf("Expected repeated fetches while slow is blocked, got %v", fetches)
+	}
+	if fetches["slow"] != 1 {
+		t.Errorf("Expected slow to be fetched once, got %d", fetches["slow"])
+	}
+	if max := maxSeen.Load(); max > 2 {
+		t.Errorf("Expected at most 2 fetches in flight, saw %d", max)
+	}
+	select {
+	case <-ready[1]:
+		t.Error("Expected broken category not to become ready")
+	default:
+	}
+	for _, event := range events {
+		if event.Category == "broken" || event.Category == "slow" {
+			t.Errorf("Unexpected event for %s", event.Category)
+		}
+	}
+}
+
+func TestSettingsCategoryUpdate(t *testing.T) {
+	category := &settingsCategory{
+		name:  "test_category",
+		cache: make(map[string]interface{}),
+	}
+
+	changes := category.update(map[string]interface{}{"temp": int64(60), "mode": "auto"})
+	if len(changes) != 2 {
+		t.Errorf("Expected 2 changes on first update, got %v", changes)
+	}
+	changes = category.update(map[string]interface{}{"temp": int64(61), "mode": "auto"})
+	if len(changes) != 1 || changes["temp"] != int64(61) {
+		t.Errorf("Expected only temp to change, got %v", changes)
+	}
+}
+
+func TestSettingsCategoryRepublishesSilentKeys(t *testing.T) {
+	SetMaxSilence(map[string]time.Duration{"test_category/temp": time.Minute})
+	t.Cleanup(func() { SetMaxSilence(nil) })
+
+	now := time.Unix(0, 0)
+	category := &settingsCategory{
+		name:  "test_category",
+		cache: make(map[string]interface{}),
+		quiet: &silence{
+			category: "test_category",
+			last:     make(map[string]time.Time),
+			now:      func() time.Time { return now },
+		},
+	}
+	payload := map[string]interface{}{"temp": int64(60), "mode": "auto"}
+
+	category.update(payload)
+	now = now.Add(30 * time.Second)
+	if changes := category.update(payload); len(changes) != 0 {
+		t.Errorf("Expected no changes before the max silence, got %v", changes)
+	}
+	now = now.Add(30 * time.Second)
+	if changes := category.update(payload); len(changes) != 1 || changes["temp"] != int64(60) {
+		t.Errorf("Expected temp to be republished, got %v", changes)
+	}
+	now = now.Add(30 * time.Second)
+	if changes := category.update(payload); len(changes) != 0 {
+		t.Errorf("Expected the republish to restart the max silence, got %v", changes)
+	}
+}
+
+func TestSettingsPollerAppliesPipelines(t *testing.T) {
+	offset := -1.5
+	var events []bus.Event
+	poller := &settingsPoller{
+		fetch: func(category string) (map[string]interface{}, error) {
+			return map[string]interface{}{"temp": int64(65), "mode": "auto"}, nil
+		},
+		publish: func(event bus.Event) {
+			events = append(events, event)
+		},
+		stats: diagnostics.Track("settings_test"),
+		corrections: pipeline.New(map[string][]config.PipelineStep{
+			"boiler/temp": {{Offset: &offset}},
+		}),
+	}
+	category := &settingsCategory{
+		name:  "boiler",
+		cache: make(map[string]interface{}),
+	}
+
+	poller.poll(category)
+	if len(events) != 1 {
+		t.Fatalf("Expected one event, got %v", events)
+	}
+	if got := events[0].Values["temp"]; got != nbe.RoundedFloat(63.5) {
+		t.Errorf("Expected the corrected temp 63.5, got %v", got)
+	}
+	if got := events[0].Values["mode"]; got != "auto" {
+		t.Errorf("Expected mode unchanged, got %v", got)
+	}
+}
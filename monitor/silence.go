@@ -0,0 +1,84 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	maxSilenceMutex sync.RWMutex
+	maxSilence      map[string]time.Duration
+)
+
+// SetMaxSilence makes the monitors publish each listed key, named
+// <category>/<key>, at least once per duration even while its value is
+// unchanged. Calling it again changes the limits of the running monitors.
+func SetMaxSilence(limits map[string]time.Duration) {
+	maxSilenceMutex.Lock()
+	defer maxSilenceMutex.Unlock()
+	maxSilence = limits
+}
+
+// silence tracks when the keys of one category with a max silence were last
+// published. A nil silence never republishes.
+type silence struct {
+	category string
+	last     map[string]time.Time
+	now      func() time.Time
+}
+
+// newSilence returns the tracker for category
+func newSilence(category string) *silence {
+	return &silence{category: category, last: make(map[string]time.Time), now: time.Now}
+}
+
+// limit returns the max silence currently set for key
+func (s *silence) limit(key string) (time.Duration, bool) {
+	maxSilenceMutex.RLock()
+	defer maxSilenceMutex.RUnlock()
+	limit, ok := maxSilence[s.category+"/"+key]
+	return limit, ok && limit > 0
+}
+
+// due reports whether an unchanged key has been silent for its max silence
+func (s *silence) due(key string) bool {
+	if s == nil {
+		return false
+	}
+	limit, ok := s.limit(key)
+	if !ok {
+		return false
+	}
+	last, ok := s.last[key]
+	return ok && s.now().Sub(last) >= limit
+}
+
+// published records that the values were just published
+func (s *silence) published(values map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	now := s.now()
+	for key := range values {
+		if _, ok := s.limit(key); ok {
+			s.last[key] = now
+		}
+	}
+}
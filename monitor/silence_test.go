@@ -0,0 +1,110 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSilence(t *testing.T) {
+	SetMaxSilence(map[string]time.Duration{
+		"operating_data/boiler_temp": 10 * time.Minute,
+		"operating_data/oxygen":      time.Minute,
+		"boiler/temp":                time.Hour,
+	})
+	t.Cleanup(func() { SetMaxSilence(nil) })
+
+	quiet := newSilence("operating_data")
+	if limit, ok := quiet.limit("boiler_temp"); !ok || limit != 10*time.Minute {
+		t.Errorf("Unexpected boiler_temp limit %v", limit)
+	}
+	if _, ok := quiet.limit("temp"); ok {
+		t.Error("Expected limits of other categories to be ignored")
+	}
+	if _, ok := newSilence("advanced_data").limit("boiler_temp"); ok {
+		t.Error("Expected no limits for advanced data")
+	}
+	// a nil tracker never republishes
+	var none *silence
+	none.published(map[string]interface{}{"boiler_temp": 1})
+	if none.due("boiler_temp") {
+		t.Error("Expected a nil tracker never to be due")
+	}
+}
+
+func TestSilenceDue(t *testing.T) {
+	SetMaxSilence(map[string]time.Duration{"operating_data/boiler_temp": time.Minute})
+	t.Cleanup(func() { SetMaxSilence(nil) })
+
+	now := time.Unix(0, 0)
+	quiet := &silence{
+		category: "operating_data",
+		last:     make(map[string]time.Time),
+		now:      func() time.Time { return now },
+	}
+
+	if quiet.due("boiler_temp") {
+		t.Error("Expected a key never published not to be due")
+	}
+	quiet.published(map[string]interface{}{"boiler_temp": 60, "oxygen": 12})
+	if _, ok := quiet.last["oxygen"]; ok {
+		t.Error("Expected keys without a limit not to be tracked")
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		due     bool
+	}{
+		{0, false},
+		{59 * time.Second, false},
+		{time.Minute, true},
+		{time.Hour, true},
+	}
+	start := now
+	for _, tt := range tests {
+		now = start.Add(tt.elapsed)
+		if got := quiet.due("boiler_temp"); got != tt.due {
+			t.Errorf("due() after %v = %v, want %v", tt.elapsed, got, tt.due)
+		}
+	}
+	if quiet.due("oxygen") {
+		t.Error("Expected a key without a limit never to be due")
+	}
+}
+
+func TestSilenceFollowsChangedLimits(t *testing.T) {
+	SetMaxSilence(nil)
+	t.Cleanup(func() { SetMaxSilence(nil) })
+
+	now := time.Unix(0, 0)
+	quiet := &silence{category: "operating_data", last: make(map[string]time.Time), now: func() time.Time { return now }}
+	quiet.published(map[string]interface{}{"boiler_temp": 60})
+
+	SetMaxSilence(map[string]time.Duration{"operating_data/boiler_temp": time.Minute})
+	quiet.published(map[string]interface{}{"boiler_temp": 60})
+	now = now.Add(time.Minute)
+	if !quiet.due("boiler_temp") {
+		t.Error("Expected a limit added later to apply")
+	}
+
+	SetMaxSilence(nil)
+	if quiet.due("boiler_temp") {
+		t.Error("Expected a removed limit to stop republishing")
+	}
+}
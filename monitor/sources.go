@@ -0,0 +1,96 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+)
+
+const (
+	// sourceCheckInterval is how often the availability of the data sources
+	// is checked
+	sourceCheckInterval = 5 * time.Second
+	// minSourceAge is the least time a source may go unanswered before it is
+	// offline, so one lost poll doesn't flap its entities
+	minSourceAge = 30 * time.Second
+)
+
+// Source is a data source polled from the controller, whose availability is
+// published on device/status/<Name>
+type Source struct {
+	Name string
+	// MaxAge is how long the source may go without an answered poll before
+	// it is offline
+	MaxAge func() time.Duration
+}
+
+// Sources returns the data sources of the monitors: the operating and
+// advanced data, the consumption counter and the settings. A source is
+// offline once three of its polls in a row went unanswered.
+func Sources() []Source {
+	polled := func() time.Duration {
+		return max(3*currentQuietHours().Poll(currentPollInterval()), minSourceAge)
+	}
+	return []Source{
+		{Name: "operating_data", MaxAge: polled},
+		{Name: "advanced_data", MaxAge: polled},
+		{Name: "consumption", MaxAge: func() time.Duration { return 3 * time.Minute }},
+		{Name: "settings", MaxAge: func() time.Duration { return max(3*settingsInterval, minSourceAge) }},
+	}
+}
+
+// StartSourceAvailability publishes "online" or "offline" on
+// device/status/<source> for each source as its polls are answered or not
+func StartSourceAvailability(eventBus *bus.Bus, sources []Source) {
+	started := time.Now()
+	published := make(map[string]string, len(sources))
+	go func() {
+		for {
+			now := time.Now()
+			changes := make(map[string]interface{})
+			for _, source := range sources {
+				last := diagnostics.Track(source.Name).LastAnswer()
+				status, known := sourceStatus(last, started, now, source.MaxAge())
+				if known && published[source.Name] != status {
+					changes[source.Name] = status
+					published[source.Name] = status
+				}
+			}
+			if len(changes) > 0 {
+				eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "device/status", Values: changes, Guaranteed: true})
+			}
+			time.Sleep(sourceCheckInterval)
+		}
+	}()
+}
+
+// sourceStatus returns whether a source last answered at last is online at
+// now. A source that never answered is only known to be offline once maxAge
+// has passed since started.
+func sourceStatus(last, started, now time.Time, maxAge time.Duration) (string, bool) {
+	if last.IsZero() {
+		return "offline", now.Sub(started) >= maxAge
+	}
+	if now.Sub(last) >= maxAge {
+		return "offline", true
+	}
+	return "online", true
+}
@@ -0,0 +1,61 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceStatus(t *testing.T) {
+	started := time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC)
+	maxAge := 30 * time.Second
+	tests := []struct {
+		name   string
+		last   time.Time
+		now    time.Time
+		status string
+		known  bool
+	}{
+		{"starting", time.Time{}, started.Add(10 * time.Second), "offline", false},
+		{"never answered", time.Time{}, started.Add(maxAge), "offline", true},
+		{"answered", started.Add(time.Minute), started.Add(time.Minute + 20*time.Second), "online", true},
+		{"silent", started.Add(time.Minute), started.Add(time.Minute + maxAge), "offline", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, known := sourceStatus(tt.last, started, tt.now, maxAge)
+			if status != tt.status || known != tt.known {
+				t.Errorf("sourceStatus() = %s, %v, want %s, %v", status, known, tt.status, tt.known)
+			}
+		})
+	}
+}
+
+func TestSourcesFollowPollInterval(t *testing.T) {
+	SetPollInterval(time.Minute)
+	t.Cleanup(func() { SetPollInterval(0) })
+
+	ages := make(map[string]time.Duration)
+	for _, source := range Sources() {
+		ages[source.Name] = source.MaxAge()
+	}
+	if ages["operating_data"] != 3*time.Minute || ages["settings"] != minSourceAge {
+		t.Errorf("Unexpected max ages %v", ages)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package monitor
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/firmware"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// unsupportedAfter is how many rejections in a row mark a function as
+	// unsupported by the controller
+	unsupportedAfter = 5
+	// recheckInterval is how often the firmware version is read while a
+	// function is unsupported, to retry it after a firmware update
+	recheckInterval = time.Hour
+)
+
+var (
+	unsupportedMutex sync.Mutex
+	unsupported      = make(map[string]bool)
+)
+
+// Unsupported returns the monitors paused because the controller rejects
+// their function, sorted by name
+func Unsupported() []string {
+	unsupportedMutex.Lock()
+	defer unsupportedMutex.Unlock()
+	names := make([]string, 0, len(unsupported))
+	for name := range unsupported {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setUnsupported records whether the monitor name is paused and publishes the
+// paused monitors on bridge/unsupported
+func setUnsupported(eventBus *bus.Bus, name string, paused bool) {
+	unsupportedMutex.Lock()
+	if paused {
+		unsupported[name] = true
+	} else {
+		delete(unsupported, name)
+	}
+	unsupportedMutex.Unlock()
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "bridge", Values: map[string]interface{}{
+		"unsupported": Unsupported(),
+	}})
+}
+
+// support detects a function the controller persistently rejects, as older
+// firmware does for the advanced and consumption data
+type support struct {
+	name       string
+	eventBus   *bus.Bus
+	version    func() (string, error)
+	interval   time.Duration
+	rejections atomic.Int64
+}
+
+func newSupport(boiler *nbe.NBE, eventBus *bus.Bus, name string) *support {
+	return &support{
+		name:     name,
+		eventBus: eventBus,
+		version:  func() (string, error) { return firmware.Version(boiler) },
+		interval: recheckInterval,
+	}
+}
+
+// rejected records a response and reports whether the controller rejected it
+func (s *support) rejected(response *nbe.NBEResponse) bool {
+	if response.Status == 0 {
+		s.rejections.Store(0)
+		return false
+	}
+	if s.rejections.Add(1) == 1 {
+		log.Debugf("Controller rejected %s with status %d", s.name, response.Status)
+	}
+	return true
+}
+
+// wait pauses the monitor while its function is unsupported, until the
+// firmware version changes, and returns at once otherwise
+func (s *support) wait() {
+	if s.rejections.Load() < unsupportedAfter {
+		return
+	}
+
+	installed, _ := s.version()
+	log.Warnf("Controller firmware %q does not support %s, pausing it until the firmware is updated", installed, s.name)
+	setUnsupported(s.eventBus, s.name, true)
+	for {
+		time.Sleep(s.interval)
+		if version, err := s.version(); err == nil && version != installed {
+			log.Infof("Controller firmware changed to %q, retrying %s", version, s.name)
+			break
+		}
+	}
+	s.rejections.Store(0)
+	setUnsupported(s.eventBus, s.name, false)
+}
@@ -0,0 +1,83 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package monitor
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestSupportPausesUntilFirmwareChanges(t *testing.T) {
+	eventBus := bus.New()
+	published := make(chan []string, 2)
+	eventBus.Subscribe(func(event bus.Event) {
+		if names, ok := event.Values["unsupported"].([]string); ok {
+			published <- names
+		}
+	}, bus.ValueChanged)
+
+	var version atomic.Value
+	version.Store("1.0")
+	s := &support{
+		name:     "test_support",
+		eventBus: eventBus,
+		version:  func() (string, error) { return version.Load().(string), nil },
+		interval: time.Millisecond,
+	}
+
+	rejected := &nbe.NBEResponse{Status: 1}
+	for i := 0; i < unsupportedAfter-1; i++ {
+		if !s.rejected(rejected) {
+			t.Fatal("Expected a non-zero status to be a rejection")
+		}
+	}
+	s.rejected(&nbe.NBEResponse{})
+	s.wait() // a success resets the count, so this returns at once
+
+	for i := 0; i < unsupportedAfter; i++ {
+		s.rejected(rejected)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wait()
+		close(done)
+	}()
+
+	if names := <-published; !reflect.DeepEqual(names, []string{"test_support"}) {
+		t.Fatalf("Expected test_support to be unsupported, got %v", names)
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected the monitor to stay paused on the same firmware")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	version.Store("1.1")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the monitor to resume after the firmware changed")
+	}
+	if names := <-published; len(names) != 0 {
+		t.Errorf("Expected no unsupported monitors after resuming, got %v", names)
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -36,8 +39,23 @@ type Client struct {
 	ClientID      string
 	Prefix        string
 	connection    mqtt.Client
+	connMutex     sync.RWMutex
 	subscriptions map[string]subscriptionInfo
 	subMutex      sync.RWMutex
+	// echoes recognizes our own publishes coming back on a subscription
+	echoes echoes
+	// connectedAt and takeovers detect another client using our client ID,
+	// after which ClientID is baseID with a random suffix
+	baseID      string
+	connectedAt time.Time
+	takeovers   int
+	rotating    atomic.Bool
+	// connectionHandlers are notified when the broker connection goes up or down
+	connectionHandlers []func(connected bool)
+	// outbox buffers publishes while the broker is unreachable
+	outbox *outbox
+	// deviceOffline holds device/status at offline while the bridge is up
+	deviceOffline atomic.Bool
 }
 
 type subscriptionInfo struct {
@@ -49,26 +67,111 @@ type Message mqtt.Message
 
 type MessageHandler func(client *Client, message Message)
 
+// OnConnectionChange registers handler to be called whenever the connection to
+// the broker is lost or re-established
+func (client *Client) OnConnectionChange(handler func(connected bool)) {
+	client.subMutex.Lock()
+	defer client.subMutex.Unlock()
+	client.connectionHandlers = append(client.connectionHandlers, handler)
+}
+
+// IsConnected reports whether the client currently has a connection to the broker
+func (client *Client) IsConnected() bool {
+	connection := client.conn()
+	return connection != nil && connection.IsConnectionOpen()
+}
+
+func (client *Client) conn() mqtt.Client {
+	client.connMutex.RLock()
+	defer client.connMutex.RUnlock()
+	return client.connection
+}
+
+func (client *Client) notifyConnection(connected bool) {
+	client.subMutex.RLock()
+	handlers := client.connectionHandlers
+	client.subMutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(connected)
+	}
+}
+
+// NewClient connects to the broker. An empty prefix creates a client for
+// one-off tools, which neither announces a device status nor keeps a session.
 func NewClient(uri *url.URL, clientID string, prefix string) (*Client, error) {
 	client := Client{
 		URI:           uri,
 		ClientID:      clientID,
 		Prefix:        prefix,
+		baseID:        clientID,
 		subscriptions: make(map[string]subscriptionInfo),
+		outbox:        newOutbox(DefaultBufferSize),
 	}
-	opts := createClientOptions(&client)
-
-	opts.SetWill(fmt.Sprintf("%s/device/status", client.Prefix), "offline", 1, true)
-	err := client.connect(opts)
+	err := client.connect(client.options())
 
-	client.connection.Publish(fmt.Sprintf("%s/device/status", client.Prefix), 1, true, "online")
+	client.publishStatus("online")
 
 	return &client, err
 }
 
+// publishStatus publishes status, online or offline, on device/status and as
+// {"state": status} on bridge/state, returning the token of the last publish.
+// device/status stays offline while SetDeviceOnline(false) holds it there.
+func (client *Client) publishStatus(status string) mqtt.Token {
+	if client.Prefix == "" {
+		return nil
+	}
+	client.conn().Publish(fmt.Sprintf("%s/device/status", client.Prefix), 1, true, client.deviceStatus(status))
+	return client.conn().Publish(fmt.Sprintf("%s/bridge/state", client.Prefix), 1, true, fmt.Sprintf(`{"state":%q}`, status))
+}
+
+// SetDeviceOnline publishes whether the controller can be reached on
+// device/status, which otherwise follows the broker connection of the
+// bridge. bridge/state keeps showing the bridge itself.
+func (client *Client) SetDeviceOnline(online bool) {
+	client.deviceOffline.Store(!online)
+	if client.Prefix == "" || !client.IsConnected() {
+		return
+	}
+	client.conn().Publish(fmt.Sprintf("%s/device/status", client.Prefix), 1, true, client.deviceStatus("online"))
+}
+
+// deviceStatus returns the device/status for the bridge status
+func (client *Client) deviceStatus(status string) string {
+	if client.deviceOffline.Load() {
+		return "offline"
+	}
+	return status
+}
+
+// Close publishes the offline status and disconnects once pending publishes
+// have been sent
+func (client *Client) Close() {
+	if client.IsConnected() {
+		if token := client.publishStatus("offline"); token != nil {
+			token.WaitTimeout(time.Second)
+		}
+	}
+	client.conn().Disconnect(500)
+}
+
+// options returns the connection options, with the offline status as the will
+// of a bridge client
+func (client *Client) options() *mqtt.ClientOptions {
+	opts := createClientOptions(client)
+	if client.Prefix != "" {
+		opts.SetWill(fmt.Sprintf("%s/device/status", client.Prefix), "offline", 1, true)
+	}
+	return opts
+}
+
 func (client *Client) connect(opts *mqtt.ClientOptions) error {
-	client.connection = mqtt.NewClient(opts)
-	token := client.connection.Connect()
+	connection := mqtt.NewClient(opts)
+	client.connMutex.Lock()
+	client.connection = connection
+	client.connMutex.Unlock()
+	token := connection.Connect()
 	token.Wait()
 	if err := token.Error(); err != nil {
 		return err
@@ -87,50 +190,129 @@ func (client *Client) PublishMany(topic string, values map[string]interface{}) e
 }
 
 func (client *Client) PublishRaw(topic string, val interface{}) error {
-	var payload []byte
-	switch p := val.(type) {
-	case string:
-		payload = []byte(p)
-	case []byte:
-		payload = p
-	default:
-		jsonVal, err := json.Marshal(val)
+	payload, err := encode(topic, val)
+	if err != nil {
+		return err
+	}
+	client.publish(topic, payload)
+	return nil
+}
+
+// PublishManyAcked publishes like PublishMany and calls acked once every value
+// has been delivered to the broker. Values buffered while the broker is
+// unreachable never call acked.
+func (client *Client) PublishManyAcked(topic string, values map[string]interface{}, acked func()) error {
+	tokens := make([]mqtt.Token, 0, len(values))
+	buffered := false
+	for key, val := range values {
+		fullTopic := fmt.Sprintf("%s/%s/%s", client.Prefix, topic, key)
+		payload, err := encode(fullTopic, val)
 		if err != nil {
-			return fmt.Errorf("marshalling %s: %v", topic, val)
+			return err
+		}
+		if token := client.publish(fullTopic, payload); token != nil {
+			tokens = append(tokens, token)
+		} else {
+			buffered = true
 		}
-		payload = jsonVal
 	}
-
-	token := client.connection.Publish(topic, 0, true, payload)
+	if buffered {
+		return nil
+	}
 	go func() {
-		<-token.Done()
-		if token.Error() != nil {
-			log.Error(token.Error())
+		for _, token := range tokens {
+			<-token.Done()
+			if token.Error() != nil {
+				return
+			}
 		}
+		acked()
 	}()
-
 	return nil
 }
 
+// encode returns the payload published for val: strings and bytes as they
+// are, anything else as JSON
+func encode(topic string, val interface{}) ([]byte, error) {
+	switch p := val.(type) {
+	case string:
+		return []byte(p), nil
+	case []byte:
+		return p, nil
+	}
+	payload, err := json.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling %s: %v", topic, val)
+	}
+	return payload, nil
+}
+
 func (client *Client) PublishJSON(topic string, val interface{}) error {
 	jsonVal, err := json.Marshal(val)
 	if err != nil {
 		return fmt.Errorf("marshalling %s: %v", topic, val)
 	}
-	token := client.connection.Publish(topic, 0, true, jsonVal)
+
+	client.publish(topic, jsonVal)
+	return nil
+}
+
+// SetBufferSize changes how many publishes are kept while the broker is
+// unreachable; publishes already buffered are kept up to the new size
+func (client *Client) SetBufferSize(size int) {
+	resized := newOutbox(size)
+	if client.outbox != nil {
+		for _, message := range client.outbox.drain() {
+			resized.push(message)
+		}
+	}
+	client.outbox = resized
+}
+
+// publish sends a retained message and returns its token, or buffers it until
+// the connection is restored and returns nil
+func (client *Client) publish(topic string, payload []byte) mqtt.Token {
+	if client.outbox != nil && !client.IsConnected() {
+		client.echoes.sent(topic, payload)
+		if client.outbox.push(pendingPublish{topic: topic, payload: payload}) {
+			log.Debugf("mqtt offline buffer full, dropped oldest publish")
+		}
+		return nil
+	}
+
+	client.echoes.sent(topic, payload)
+	token := client.conn().Publish(topic, 0, true, payload)
 	go func() {
 		<-token.Done()
 		if token.Error() != nil {
 			log.Error(token.Error())
 		}
 	}()
+	return token
+}
 
-	return nil
+// replay publishes the messages buffered while the broker was unreachable
+func (client *Client) replay() {
+	if client.outbox == nil {
+		return
+	}
+	messages := client.outbox.drain()
+	for _, message := range messages {
+		client.echoes.sent(message.topic, message.payload)
+		client.conn().Publish(message.topic, 0, true, message.payload)
+	}
+	if len(messages) > 0 {
+		log.Infof("replayed %d publishes buffered while disconnected", len(messages))
+	}
 }
 
 func (client *Client) Subscribe(topic string, qos byte, callback MessageHandler) error {
-	full_topic := fmt.Sprintf("%s/%s", client.Prefix, topic)
+	return client.SubscribeTopic(fmt.Sprintf("%s/%s", client.Prefix, topic), qos, callback)
+}
 
+// SubscribeTopic subscribes to a topic outside the client prefix, such as the
+// Home Assistant discovery topics
+func (client *Client) SubscribeTopic(full_topic string, qos byte, callback MessageHandler) error {
 	// Store subscription info for automatic re-subscription on reconnect
 	client.subMutex.Lock()
 	client.subscriptions[full_topic] = subscriptionInfo{
@@ -139,8 +321,14 @@ func (client *Client) Subscribe(topic string, qos byte, callback MessageHandler)
 	}
 	client.subMutex.Unlock()
 
-	token := client.connection.Subscribe(full_topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
-		callback(client, msg)
+	if !client.IsConnected() {
+		// The connect handler subscribes once the broker is reachable again
+		log.Infof("mqtt not connected, deferring subscription to %s", full_topic)
+		return nil
+	}
+
+	token := client.conn().Subscribe(full_topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		client.deliver(callback, msg)
 	})
 	token.Wait()
 	if err := token.Error(); err != nil {
@@ -149,53 +337,78 @@ func (client *Client) Subscribe(topic string, qos byte, callback MessageHandler)
 	return nil
 }
 
-func createClientOptions(client *Client) *mqtt.ClientOptions {
-	opts := mqtt.NewClientOptions()
+// brokerURL converts an MQTT URI into the broker URL to connect to. The path
+// of a ws:// or wss:// broker comes from the ws_path option (default /mqtt),
+// as the URI's own path is the topic prefix.
+func brokerURL(uri *url.URL) string {
+	scheme, port := "tcp", "1883"
+	switch uri.Scheme {
+	case "mqtts":
+		scheme, port = "ssl", "8883"
+	case "ws":
+		scheme, port = "ws", "80"
+	case "wss":
+		scheme, port = "wss", "443"
+	}
+	if uri.Port() != "" {
+		port = uri.Port()
+	}
 
-	port := client.URI.Port()
-	if port == "" {
-		if client.URI.Scheme == "mqtts" {
-			port = "8883"
-		} else {
-			port = "1883"
+	broker := fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(uri.Hostname(), port))
+	if scheme == "ws" || scheme == "wss" {
+		path := uri.Query().Get("ws_path")
+		if path == "" {
+			path = "/mqtt"
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
 		}
+		broker += path
 	}
+	return broker
+}
 
-	if client.URI.Scheme == "mqtts" {
-		query := client.URI.Query()
-		tlsCert := query.Get("tls_cert")
-		tlsKey := query.Get("tls_key")
-		caCert := query.Get("tls_cacert")
-		insecure := query.Get("insecure")
+// tlsConfig builds the TLS configuration of an mqtts:// or wss:// URI from its
+// tls_cert, tls_key, tls_cacert and insecure options
+func tlsConfig(query url.Values) *tls.Config {
+	tlsCert := query.Get("tls_cert")
+	tlsKey := query.Get("tls_key")
+	caCert := query.Get("tls_cacert")
+	insecure := query.Get("insecure")
 
-		tlsConfig := &tls.Config{}
+	tlsConfig := &tls.Config{}
 
-		if insecure == "true" {
-			tlsConfig.InsecureSkipVerify = true
-		}
+	if insecure == "true" {
+		tlsConfig.InsecureSkipVerify = true
+	}
 
-		if tlsCert != "" && tlsKey != "" {
-			cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
-			if err != nil {
-				log.Fatalf("failed to load tls cert and key: %v", err)
-			}
-			tlsConfig.Certificates = []tls.Certificate{cert}
+	if tlsCert != "" && tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("failed to load tls cert and key: %v", err)
 		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		if caCert != "" {
-			caCertPool := x509.NewCertPool()
-			caCertData, err := os.ReadFile(caCert)
-			if err != nil {
-				log.Fatalf("failed to read ca cert: %v", err)
-			}
-			caCertPool.AppendCertsFromPEM(caCertData)
-			tlsConfig.RootCAs = caCertPool
+	if caCert != "" {
+		caCertPool := x509.NewCertPool()
+		caCertData, err := os.ReadFile(caCert)
+		if err != nil {
+			log.Fatalf("failed to read ca cert: %v", err)
 		}
+		caCertPool.AppendCertsFromPEM(caCertData)
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	return tlsConfig
+}
+
+func createClientOptions(client *Client) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
 
-		opts.SetTLSConfig(tlsConfig)
-		opts.AddBroker(fmt.Sprintf("ssl://%s:%s", client.URI.Hostname(), port))
-	} else {
-		opts.AddBroker(fmt.Sprintf("tcp://%s:%s", client.URI.Hostname(), port))
+	opts.AddBroker(brokerURL(client.URI))
+	if client.URI.Scheme == "mqtts" || client.URI.Scheme == "wss" {
+		opts.SetTLSConfig(tlsConfig(client.URI.Query()))
 	}
 
 	opts.SetUsername(client.URI.User.Username())
@@ -205,28 +418,38 @@ func createClientOptions(client *Client) *mqtt.ClientOptions {
 	opts.SetKeepAlive(30 * time.Second)
 	opts.SetMaxReconnectInterval(10 * time.Second)
 	opts.SetAutoReconnect(true)
+	// Keep the session so the broker queues commands sent while we are away
+	opts.SetCleanSession(client.Prefix == "")
 
 	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		log.Errorf("mqtt connection lost: %v", err)
+		client.notifyConnection(false)
+		if client.takenOver(time.Now()) {
+			go client.rotateClientID()
+		}
 	})
 	opts.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
 		log.Warn("mqtt reconnecting")
 	})
 	opts.SetOnConnectHandler(func(_ mqtt.Client) {
 		log.Info("mqtt connected")
+		client.connMutex.Lock()
+		client.connectedAt = time.Now()
+		client.connMutex.Unlock()
 
 		// Republish online status on every connection
-		client.connection.Publish(fmt.Sprintf("%s/device/status", client.Prefix), 1, true, "online")
+		client.publishStatus("online")
 
 		// Restore all subscriptions after reconnection
 		client.subMutex.RLock()
 		defer client.subMutex.RUnlock()
+		defer client.replay()
 
 		for fullTopic, sub := range client.subscriptions {
 			// Capture loop variable for closure
 			subInfo := sub
-			token := client.connection.Subscribe(fullTopic, subInfo.qos, func(_ mqtt.Client, msg mqtt.Message) {
-				subInfo.callback(client, msg)
+			token := client.conn().Subscribe(fullTopic, subInfo.qos, func(_ mqtt.Client, msg mqtt.Message) {
+				client.deliver(subInfo.callback, msg)
 			})
 			token.Wait()
 			if err := token.Error(); err != nil {
@@ -235,6 +458,8 @@ func createClientOptions(client *Client) *mqtt.ClientOptions {
 				log.Infof("resubscribed to %s", fullTopic)
 			}
 		}
+
+		go client.notifyConnection(true)
 	})
 
 	return opts
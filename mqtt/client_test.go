@@ -20,6 +20,7 @@ package mqtt
 import (
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestCreateClientOptions(t *testing.T) {
@@ -59,6 +60,24 @@ func TestCreateClientOptions(t *testing.T) {
 			expectBroker: "tcp://localhost:1883",
 			expectPort:   "1883",
 		},
+		{
+			name:         "ws with default port and path",
+			uriString:    "ws://localhost/nbe/home",
+			expectBroker: "ws://localhost:80/mqtt",
+			expectPort:   "80",
+		},
+		{
+			name:         "ws with custom path",
+			uriString:    "ws://localhost:9001?ws_path=/",
+			expectBroker: "ws://localhost:9001/",
+			expectPort:   "9001",
+		},
+		{
+			name:         "wss with default port",
+			uriString:    "wss://broker.example.com?ws_path=ws",
+			expectBroker: "wss://broker.example.com:443/ws",
+			expectPort:   "443",
+		},
 	}
 
 	for _, tt := range tests {
@@ -82,8 +101,16 @@ func TestCreateClientOptions(t *testing.T) {
 				t.Fatal("Expected options to be created")
 			}
 
-			// Test would verify broker URL, but that's private in paho
-			// So we just ensure no panic and options are created
+			if len(opts.Servers) != 1 || opts.Servers[0].String() != tt.expectBroker {
+				t.Errorf("Expected broker %s, got %v", tt.expectBroker, opts.Servers)
+			}
+			if opts.Servers[0].Port() != tt.expectPort {
+				t.Errorf("Expected port %s, got %s", tt.expectPort, opts.Servers[0].Port())
+			}
+			secure := uri.Scheme == "mqtts" || uri.Scheme == "wss"
+			if (opts.TLSConfig != nil) != secure {
+				t.Errorf("Expected TLS configured %v, got %v", secure, opts.TLSConfig != nil)
+			}
 		})
 	}
 }
@@ -210,3 +237,120 @@ func TestClientTopicFormatting(t *testing.T) {
 		t.Errorf("Expected topic %s, got %s", expectedDataTopic, actualDataTopic)
 	}
 }
+
+func TestOutboxKeepsNewestPublishes(t *testing.T) {
+	box := newOutbox(3)
+	for i, topic := range []string{"a", "b", "c", "d", "e"} {
+		dropped := box.push(pendingPublish{topic: topic})
+		if dropped != (i >= 3) {
+			t.Errorf("push(%s) dropped = %v", topic, dropped)
+		}
+	}
+
+	messages := box.drain()
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 buffered publishes, got %d", len(messages))
+	}
+	for i, topic := range []string{"c", "d", "e"} {
+		if messages[i].topic != topic {
+			t.Errorf("messages[%d] = %s, want %s", i, messages[i].topic, topic)
+		}
+	}
+	if box.Len() != 0 {
+		t.Errorf("Expected drained buffer to be empty, got %d", box.Len())
+	}
+}
+
+func TestPublishBuffersWhileDisconnected(t *testing.T) {
+	client := &Client{
+		Prefix:        "test/boiler",
+		subscriptions: make(map[string]subscriptionInfo),
+		outbox:        newOutbox(10),
+	}
+
+	if err := client.PublishMany("operating_data", map[string]interface{}{"boiler_temp": 65.5}); err != nil {
+		t.Fatalf("PublishMany() error = %v", err)
+	}
+	if err := client.PublishJSON("test/boiler/bridge/diagnostics", map[string]int{"goroutines": 12}); err != nil {
+		t.Fatalf("PublishJSON() error = %v", err)
+	}
+	if client.outbox.Len() != 2 {
+		t.Fatalf("Expected 2 buffered publishes, got %d", client.outbox.Len())
+	}
+
+	client.SetBufferSize(1)
+	messages := client.outbox.drain()
+	if len(messages) != 1 || messages[0].topic != "test/boiler/bridge/diagnostics" {
+		t.Errorf("Expected the newest publish to survive resizing, got %v", messages)
+	}
+}
+
+func TestPublishManyAckedWhileDisconnected(t *testing.T) {
+	client := &Client{
+		Prefix:        "test/boiler",
+		subscriptions: make(map[string]subscriptionInfo),
+		outbox:        newOutbox(10),
+	}
+
+	acked := make(chan struct{}, 1)
+	if err := client.PublishManyAcked("operating_data", map[string]interface{}{"boiler_temp": 65.5, "state": 5}, func() {
+		acked <- struct{}{}
+	}); err != nil {
+		t.Fatalf("PublishManyAcked() error = %v", err)
+	}
+	if client.outbox.Len() != 2 {
+		t.Fatalf("Expected 2 buffered publishes, got %d", client.outbox.Len())
+	}
+	select {
+	case <-acked:
+		t.Error("Expected buffered publishes not to be acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribeWhileDisconnectedIsDeferred(t *testing.T) {
+	client := &Client{
+		Prefix:        "test/boiler",
+		subscriptions: make(map[string]subscriptionInfo),
+	}
+
+	if err := client.Subscribe("set/+/+", 1, func(*Client, Message) {}); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if _, ok := client.subscriptions["test/boiler/set/+/+"]; !ok {
+		t.Error("Expected subscription to be kept for the next connection")
+	}
+}
+
+func TestCreateClientOptionsKeepsSession(t *testing.T) {
+	uri, _ := url.Parse("mqtt://localhost:1883")
+	opts := createClientOptions(&Client{URI: uri, ClientID: "test-client", Prefix: "test/boiler"})
+
+	if opts.CleanSession {
+		t.Error("Expected a persistent session so queued commands survive a reconnect")
+	}
+
+	opts = createClientOptions(&Client{URI: uri, ClientID: "test-client"})
+	if !opts.CleanSession {
+		t.Error("Expected one-off clients without a prefix not to keep a session")
+	}
+}
+
+func TestCreateClientOptionsWebSocketTLS(t *testing.T) {
+	uri, _ := url.Parse("wss://broker.example.com:8884/nbe/home?ws_path=/mqtt&insecure=true")
+	client := &Client{
+		URI:           uri,
+		ClientID:      "test-client",
+		Prefix:        "nbe/home",
+		subscriptions: make(map[string]subscriptionInfo),
+	}
+
+	opts := createClientOptions(client)
+
+	if opts.Servers[0].String() != "wss://broker.example.com:8884/mqtt" {
+		t.Errorf("Unexpected broker %v", opts.Servers[0])
+	}
+	if opts.TLSConfig == nil || !opts.TLSConfig.InsecureSkipVerify {
+		t.Errorf("Expected the insecure option to apply to wss, got %+v", opts.TLSConfig)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// echoWindow is how long a publish is remembered to recognize it coming
+	// back on one of our subscriptions
+	echoWindow = 10 * time.Second
+	// takeoverWindow is how soon after connecting a lost connection counts as
+	// taken over by another client with the same client ID
+	takeoverWindow = 15 * time.Second
+	// maxTakeovers is how many takeovers in a row make the client switch to
+	// another client ID
+	maxTakeovers = 3
+	// maxCollisionBackoff caps the wait before connecting with a new client ID
+	maxCollisionBackoff = 2 * time.Minute
+)
+
+var echoesDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "boiler_mate",
+		Subsystem: "mqtt",
+		Name:      "echoes_dropped_total",
+		Help:      "Messages received on a subscription that were our own publishes",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(echoesDropped)
+}
+
+// echo is the last publish on a topic
+type echo struct {
+	sum uint64
+	at  time.Time
+}
+
+// echoes remembers the last payload published on each topic, so that a
+// subscription receiving it back, e.g. through a bridged broker or a topic
+// both published and subscribed to, does not act on it as a command
+type echoes struct {
+	mu   sync.Mutex
+	last map[string]echo
+}
+
+func checksum(payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64()
+}
+
+// sent records a publish
+func (e *echoes) sent(topic string, payload []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.last == nil {
+		e.last = make(map[string]echo)
+	}
+	e.last[topic] = echo{sum: checksum(payload), at: time.Now()}
+}
+
+// isEcho reports whether a received message is one we published recently
+func (e *echoes) isEcho(topic string, payload []byte) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last, ok := e.last[topic]
+	return ok && time.Since(last.at) < echoWindow && last.sum == checksum(payload)
+}
+
+// deliver passes a received message to callback unless it is our own
+func (client *Client) deliver(callback MessageHandler, msg mqtt.Message) {
+	if client.echoes.isEcho(msg.Topic(), msg.Payload()) {
+		echoesDropped.Inc()
+		log.Warnf("mqtt: ignoring our own message on %s, check for a bridge or mapping looping it back", msg.Topic())
+		return
+	}
+	callback(client, msg)
+}
+
+// takenOver records a lost connection and reports whether the client ID
+// should change: the broker drops a client when another one connects with
+// its ID, and the two then keep taking the connection from each other
+func (client *Client) takenOver(now time.Time) bool {
+	client.connMutex.Lock()
+	defer client.connMutex.Unlock()
+	if client.connectedAt.IsZero() || now.Sub(client.connectedAt) > takeoverWindow {
+		client.takeovers = 0
+		return false
+	}
+	client.takeovers++
+	return client.takeovers >= maxTakeovers
+}
+
+// uniqueClientID appends a random suffix to the configured client ID
+func uniqueClientID(base string) string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return base + "-" + time.Now().Format("150405")
+	}
+	return base + "-" + hex.EncodeToString(suffix)
+}
+
+// collisionBackoff returns how long to wait before the attempt'th connection
+// with a new client ID: doubling from 5 seconds, with jitter so that two
+// colliding clients don't reconnect in step
+func collisionBackoff(attempt int) time.Duration {
+	backoff := 5 * time.Second
+	for i := 0; i < attempt && backoff < maxCollisionBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxCollisionBackoff {
+		backoff = maxCollisionBackoff
+	}
+	return backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)))
+}
+
+// rotateClientID stops the connection fighting over the client ID and
+// connects again with a unique one. The broker keeps no session for the new
+// ID, so commands sent while disconnected are lost until the next restart.
+func (client *Client) rotateClientID() {
+	if !client.rotating.CompareAndSwap(false, true) {
+		return
+	}
+	defer client.rotating.Store(false)
+
+	client.conn().Disconnect(0)
+	base := client.baseID
+	if base == "" {
+		base = client.ClientID
+	}
+	for attempt := 0; ; attempt++ {
+		client.ClientID = uniqueClientID(base)
+		delay := collisionBackoff(attempt)
+		log.Errorf("mqtt: another client keeps taking over the connection as %s; reconnecting as %s in %s", base, client.ClientID, delay.Round(time.Second))
+		time.Sleep(delay)
+
+		client.connMutex.Lock()
+		client.takeovers = 0
+		client.connMutex.Unlock()
+		if err := client.connect(client.options()); err != nil {
+			log.Errorf("mqtt: failed to connect as %s: %v", client.ClientID, err)
+			continue
+		}
+		return
+	}
+}
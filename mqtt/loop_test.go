@@ -0,0 +1,91 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+func TestDeliverDropsOwnMessages(t *testing.T) {
+	client := &Client{
+		Prefix:        "test/boiler",
+		subscriptions: make(map[string]subscriptionInfo),
+		outbox:        newOutbox(10),
+	}
+	if err := client.PublishMany("set/boiler", map[string]interface{}{"temp": "70"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []string
+	callback := func(_ *Client, msg Message) { received = append(received, string(msg.Payload())) }
+	client.deliver(callback, fakeMessage{topic: "test/boiler/set/boiler/temp", payload: []byte("70")})
+	client.deliver(callback, fakeMessage{topic: "test/boiler/set/boiler/temp", payload: []byte("72")})
+	client.deliver(callback, fakeMessage{topic: "test/boiler/set/hot_water/temp", payload: []byte("70")})
+	if len(received) != 2 || received[0] != "72" {
+		t.Errorf("Expected only the other messages delivered, got %v", received)
+	}
+}
+
+func TestTakenOver(t *testing.T) {
+	client := &Client{}
+	start := time.Date(2024, 1, 10, 8, 0, 0, 0, time.UTC)
+
+	client.connectedAt = start
+	if client.takenOver(start.Add(time.Hour)) {
+		t.Error("Expected a connection lost after an hour not to count")
+	}
+	for i := 1; i <= maxTakeovers; i++ {
+		client.connectedAt = start.Add(time.Duration(i) * time.Minute)
+		if got := client.takenOver(client.connectedAt.Add(time.Second)); got != (i == maxTakeovers) {
+			t.Errorf("takenOver() after %d quick drops = %v", i, got)
+		}
+	}
+}
+
+func TestUniqueClientID(t *testing.T) {
+	first, second := uniqueClientID("nbemqtt-12345"), uniqueClientID("nbemqtt-12345")
+	if !strings.HasPrefix(first, "nbemqtt-12345-") || first == second {
+		t.Errorf("Expected distinct IDs based on the client ID, got %s and %s", first, second)
+	}
+}
+
+func TestCollisionBackoff(t *testing.T) {
+	for attempt, max := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		if backoff := collisionBackoff(attempt); backoff < max/2 || backoff >= max {
+			t.Errorf("collisionBackoff(%d) = %v, want between %v and %v", attempt, backoff, max/2, max)
+		}
+	}
+	if backoff := collisionBackoff(100); backoff >= maxCollisionBackoff {
+		t.Errorf("Expected the backoff capped, got %v", backoff)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultBufferSize is the number of publishes kept while the broker is unreachable
+const DefaultBufferSize = 1000
+
+var (
+	bufferedGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "mqtt",
+			Name:      "buffered",
+			Help:      "Publishes waiting for the broker connection to be restored",
+		},
+	)
+	bufferDroppedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "boiler_mate",
+			Subsystem: "mqtt",
+			Name:      "buffer_dropped_total",
+			Help:      "Publishes dropped because the offline buffer was full",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bufferedGauge, bufferDroppedCounter)
+}
+
+type pendingPublish struct {
+	topic   string
+	payload []byte
+}
+
+// outbox is a ring buffer of publishes made while the broker is unreachable.
+// Once full, the oldest publish is overwritten.
+type outbox struct {
+	mu       sync.Mutex
+	messages []pendingPublish
+	start    int
+	count    int
+}
+
+func newOutbox(size int) *outbox {
+	if size < 1 {
+		size = 1
+	}
+	return &outbox{messages: make([]pendingPublish, size)}
+}
+
+// push adds a publish, reporting whether an older one had to be dropped
+func (o *outbox) push(message pendingPublish) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	dropped := o.count == len(o.messages)
+	if dropped {
+		o.start = (o.start + 1) % len(o.messages)
+		o.count--
+		bufferDroppedCounter.Inc()
+	}
+	o.messages[(o.start+o.count)%len(o.messages)] = message
+	o.count++
+	bufferedGauge.Set(float64(o.count))
+	return dropped
+}
+
+// drain removes and returns the buffered publishes, oldest first
+func (o *outbox) drain() []pendingPublish {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	messages := make([]pendingPublish, o.count)
+	for i := range messages {
+		messages[i] = o.messages[(o.start+i)%len(o.messages)]
+		o.messages[(o.start+i)%len(o.messages)] = pendingPublish{}
+	}
+	o.start, o.count = 0, 0
+	bufferedGauge.Set(0)
+	return messages
+}
+
+// Len returns the number of buffered publishes
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
@@ -0,0 +1,205 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchWrite is the outcome of one write of a batch
+type BatchWrite struct {
+	Path  string `json:"path"`
+	Value string `json:"value"`
+	// Previous is the value before the batch, written back on a rollback
+	Previous interface{} `json:"previous,omitempty"`
+	// Stored is the value read back after the write
+	Stored     interface{} `json:"stored,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	RolledBack bool        `json:"rolled_back,omitempty"`
+
+	accepted bool
+}
+
+// BatchError reports a batch that was not applied because the write to Path
+// failed. The writes already made were restored to their previous values,
+// except those listed in Unrestored.
+type BatchError struct {
+	Path       string
+	Err        error
+	Unrestored []string
+}
+
+func (e *BatchError) Error() string {
+	msg := fmt.Sprintf("batch: %s: %v", e.Path, e.Err)
+	if len(e.Unrestored) > 0 {
+		msg += fmt.Sprintf("; failed to restore %s", strings.Join(e.Unrestored, ", "))
+	}
+	return msg
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// SetMany writes several settings as one batch
+func (nbe *NBE) SetMany(values map[string]string) ([]BatchWrite, error) {
+	return nbe.SetManyContext(context.Background(), values)
+}
+
+// SetManyContext writes several settings as one batch, traced and audited
+// like SetContext. Every value is validated before anything is written. The
+// writes are sent one at a time, in path order and under the rate limit, and
+// each is read back. If one fails, or the controller stores another value,
+// the settings already written are restored, so the batch is applied
+// completely or not at all. Batches don't interleave with each other.
+func (nbe *NBE) SetManyContext(ctx context.Context, values map[string]string) ([]BatchWrite, error) {
+	if len(values) == 0 {
+		return nil, errors.New("batch: no settings to write")
+	}
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	writes := make([]BatchWrite, len(paths))
+	for i, path := range paths {
+		writes[i] = BatchWrite{Path: path, Value: values[path]}
+		if definition, ok := nbe.SettingSchema[path]; ok && definition.Action {
+			return nil, &BatchError{Path: path, Err: errors.New("actions cannot be rolled back")}
+		}
+		if err := nbe.ValidateSetting(path, []byte(values[path])); err != nil {
+			return nil, &BatchError{Path: path, Err: err}
+		}
+		if err := nbe.guardWrite([]byte(path + "=" + values[path])); err != nil {
+			return nil, &BatchError{Path: path, Err: err}
+		}
+	}
+
+	nbe.batchMutex.Lock()
+	defer nbe.batchMutex.Unlock()
+
+	for i := range writes {
+		previous, err := nbe.readSetting(writes[i].Path)
+		if err != nil {
+			return nil, &BatchError{Path: writes[i].Path, Err: fmt.Errorf("reading the current value: %w", err)}
+		}
+		writes[i].Previous = previous
+	}
+
+	for i := range writes {
+		if err := nbe.applyWrite(ctx, &writes[i]); err != nil {
+			writes[i].Error = err.Error()
+			batchErr := &BatchError{Path: writes[i].Path, Err: err}
+			nbe.rollback(ctx, writes[:i+1], batchErr)
+			return writes, batchErr
+		}
+	}
+	return writes, nil
+}
+
+// readSetting returns the value of the setting at path
+func (nbe *NBE) readSetting(path string) (interface{}, error) {
+	_, name, _ := strings.Cut(path, ".")
+	response, err := nbe.Get(GetSetupFunction, path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := response.Payload[name]
+	if !ok {
+		return nil, fmt.Errorf("the controller did not return %s", path)
+	}
+	return value, nil
+}
+
+// applyWrite writes one setting of a batch and reads it back, failing when
+// the controller stored another value
+func (nbe *NBE) applyWrite(ctx context.Context, write *BatchWrite) error {
+	response, err := nbe.SetContext(ctx, write.Path, []byte(write.Value))
+	if err != nil {
+		return err
+	}
+	if err := StatusErr(write.Path, response); err != nil {
+		return err
+	}
+	write.accepted = true
+
+	stored, err := nbe.readSetting(write.Path)
+	if err != nil {
+		return fmt.Errorf("written, but reading it back failed: %w", err)
+	}
+	write.Stored = stored
+	if !SameValue([]byte(write.Value), stored) {
+		return fmt.Errorf("controller stored %v instead of %s", stored, write.Value)
+	}
+	return nil
+}
+
+// rollback writes the previous values of the accepted writes back, the last
+// write first, adding those that fail to batchErr
+func (nbe *NBE) rollback(ctx context.Context, writes []BatchWrite, batchErr *BatchError) {
+	for i := len(writes) - 1; i >= 0; i-- {
+		write := &writes[i]
+		if !write.accepted {
+			continue
+		}
+		previous := formatSetting(write.Previous)
+		response, err := nbe.SetContext(ctx, write.Path, []byte(previous))
+		if err == nil {
+			err = StatusErr(write.Path, response)
+		}
+		if err != nil {
+			log.Errorf("Failed to restore %s to %s: %v", write.Path, previous, err)
+			batchErr.Unrestored = append(batchErr.Unrestored, write.Path)
+			continue
+		}
+		write.RolledBack = true
+	}
+}
+
+// SameValue reports whether a value read from the controller is the one that
+// was written, comparing numbers to the controller's precision
+func SameValue(written []byte, stored interface{}) bool {
+	want := strings.TrimSpace(string(written))
+	got := fmt.Sprintf("%v", stored)
+	wantFloat, wantErr := strconv.ParseFloat(want, 64)
+	gotFloat, gotErr := strconv.ParseFloat(got, 64)
+	if wantErr == nil && gotErr == nil {
+		return RoundedFloat(wantFloat).Equal(RoundedFloat(gotFloat))
+	}
+	return want == got
+}
+
+// formatSetting returns a value read from the controller in the form it is
+// written back in
+func formatSetting(value interface{}) string {
+	switch v := value.(type) {
+	case RoundedFloat:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
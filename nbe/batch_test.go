@@ -0,0 +1,126 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSetMany(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	writes, err := boiler.SetMany(map[string]string{"boiler.temp": "70", "boiler.diff_over": "20"})
+	if err != nil {
+		t.Fatalf("SetMany() error = %v", err)
+	}
+	if len(writes) != 2 || writes[0].Path != "boiler.diff_over" || writes[1].Path != "boiler.temp" {
+		t.Fatalf("Expected the writes in path order, got %+v", writes)
+	}
+	if got := fmt.Sprint(writes[1].Previous); got != "65" {
+		t.Errorf("Expected the previous boiler temp 65, got %v", got)
+	}
+	for key, want := range map[string]string{"temp": "70", "diff_over": "20"} {
+		if got, _ := mb.GetValue("boiler", key); fmt.Sprint(got) != want {
+			t.Errorf("Expected boiler.%s %s, got %v", key, want, got)
+		}
+	}
+}
+
+func TestSetManyRollsBack(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	// the controller clamps the hot water temp without an error
+	mb.SetLimit("boiler.temp", 0, 75)
+
+	writes, err := boiler.SetMany(map[string]string{"boiler.diff_over": "20", "boiler.temp": "80"})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Path != "boiler.temp" {
+		t.Fatalf("Expected the batch to fail on boiler.temp, got %v", err)
+	}
+	if len(batchErr.Unrestored) != 0 {
+		t.Errorf("Expected every setting to be restored, got %v", batchErr.Unrestored)
+	}
+	for _, write := range writes {
+		if !write.RolledBack {
+			t.Errorf("Expected %s to be rolled back", write.Path)
+		}
+	}
+	for key, want := range map[string]string{"temp": "65", "diff_over": "15"} {
+		if got, _ := mb.GetValue("boiler", key); fmt.Sprint(got) != want {
+			t.Errorf("Expected boiler.%s to be restored to %s, got %v", key, want, got)
+		}
+	}
+}
+
+func TestSetManyValidatesFirst(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"empty", nil},
+		{"out of range", map[string]string{"boiler.temp": "70", "boiler.diff_over": "120"}},
+		{"unknown", map[string]string{"boiler.temp": "70", "boiler.nonexistent": "1"}},
+		{"action", map[string]string{"boiler.temp": "70", "misc.start": "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb, boiler := newMockClient(t)
+			if _, err := boiler.SetMany(tt.values); err == nil {
+				t.Fatal("Expected an error")
+			}
+			if writes := mb.Writes(); len(writes) != 0 {
+				t.Errorf("Expected nothing written, got %v", writes)
+			}
+		})
+	}
+}
+
+func TestSetManyReadOnly(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	boiler.SetReadOnly(true)
+
+	if _, err := boiler.SetMany(map[string]string{"boiler.temp": "70"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if writes := mb.Writes(); len(writes) != 0 {
+		t.Errorf("Expected nothing written, got %v", writes)
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	tests := []struct {
+		written string
+		stored  interface{}
+		want    bool
+	}{
+		{"72", int64(72), true},
+		{"72.5", RoundedFloat(72.5), true},
+		{" 70.0 ", int64(70), true},
+		{"80", int64(75), false},
+		{"on", "on", true},
+		{"on", "off", false},
+	}
+
+	for _, tt := range tests {
+		if got := SameValue([]byte(tt.written), tt.stored); got != tt.want {
+			t.Errorf("SameValue(%q, %v) = %v, want %v", tt.written, tt.stored, got, tt.want)
+		}
+	}
+}
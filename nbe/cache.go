@@ -0,0 +1,124 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// readCache keeps the responses to recent reads, so that a burst of identical
+// reads within the TTL of their category costs one request. A write empties
+// it, as a setting can change values in other categories too.
+type readCache struct {
+	mu         sync.Mutex
+	ttls       map[string]time.Duration
+	entries    map[string]cachedRead
+	generation uint64 // counts the writes, so reads sent before one aren't kept
+}
+
+type cachedRead struct {
+	seq      int8
+	response *NBEResponse
+	expires  time.Time
+}
+
+func newReadCache() *readCache {
+	return &readCache{entries: make(map[string]cachedRead)}
+}
+
+// cacheCategory is the category whose TTL applies to a read: the settings
+// category for setup reads, and the function name without "get_" otherwise,
+// e.g. operating_data
+func cacheCategory(function Function, path string) string {
+	if function == GetSetupFunction || function == GetSetupRangeFunction {
+		category, _, _ := strings.Cut(path, ".")
+		return category
+	}
+	return strings.TrimPrefix(functionName(function), "get_")
+}
+
+// ttl returns how long reads of category are kept; "*" applies to the
+// categories without their own TTL
+func (c *readCache) ttl(category string) time.Duration {
+	if ttl, ok := c.ttls[category]; ok {
+		return ttl
+	}
+	return c.ttls["*"]
+}
+
+// get returns a copy of the cached response to key, if it is still fresh,
+// and the generation a response to a new request has to be stored with
+func (c *readCache) get(key string, now time.Time) (cachedRead, uint64, bool) {
+	if c == nil {
+		return cachedRead{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return cachedRead{}, c.generation, false
+	}
+	entry.response = entry.response.clone()
+	return entry, c.generation, true
+}
+
+// put keeps a successful response for the TTL of its category, unless a
+// write completed since the request was made
+func (c *readCache) put(key, category string, generation uint64, seq int8, response *NBEResponse, now time.Time) {
+	if c == nil || response.Status != StatusOK {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.ttl(category)
+	if ttl <= 0 || generation != c.generation {
+		return
+	}
+	c.entries[key] = cachedRead{seq: seq, response: response.clone(), expires: now.Add(ttl)}
+}
+
+// invalidate drops every cached read after a write
+func (c *readCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]cachedRead)
+}
+
+// setTTLs replaces the TTLs, keyed by category or "*", and drops the reads
+// cached under the previous ones
+func (c *readCache) setTTLs(ttls map[string]time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttls = ttls
+	c.entries = make(map[string]cachedRead)
+}
+
+// SetCacheTTLs keeps the responses to reads for the TTL of their category,
+// keyed by settings category (e.g. boiler) or read function (e.g.
+// operating_data), with "*" for the others. Identical reads within the TTL
+// are answered from the cache; a write empties it. No TTLs turn it off.
+func (nbe *NBE) SetCacheTTLs(ttls map[string]time.Duration) {
+	nbe.cache.setTTLs(ttls)
+}
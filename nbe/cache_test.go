@@ -0,0 +1,111 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGetServedFromCache(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	boiler.SetCacheTTLs(map[string]time.Duration{"*": time.Minute, "hot_water": 0})
+	read := func(path, key string) string {
+		t.Helper()
+		response, err := boiler.Get(GetSetupFunction, path)
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", path, err)
+		}
+		return fmt.Sprint(response.Payload[key])
+	}
+
+	first := read("boiler.temp", "temp")
+	mb.SetValue("boiler", "temp", "70")
+	if got := read("boiler.temp", "temp"); got != first {
+		t.Errorf("Expected the cached %s within the TTL, got %s", first, got)
+	}
+
+	// a category with a zero TTL is always read
+	read("hot_water.diff_under", "diff_under")
+	mb.SetValue("hot_water", "diff_under", "8")
+	if got := read("hot_water.diff_under", "diff_under"); got != "8" {
+		t.Errorf("Expected an uncached hot_water read, got %s", got)
+	}
+
+	// a write empties the cache
+	if _, err := boiler.Set("boiler.diff_over", []byte("12")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got := read("boiler.temp", "temp"); got != "70" {
+		t.Errorf("Expected a fresh read after the write, got %s", got)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	cache := newReadCache()
+	cache.setTTLs(map[string]time.Duration{"*": time.Second})
+	now := time.Now()
+	response := &NBEResponse{Status: StatusOK, Payload: map[string]interface{}{"temp": int64(65)}}
+
+	_, generation, _ := cache.get("1:boiler.temp", now)
+	cache.put("1:boiler.temp", "boiler", generation, 3, response, now)
+	cached, _, ok := cache.get("1:boiler.temp", now.Add(500*time.Millisecond))
+	if !ok || cached.seq != 3 || cached.response.Payload["temp"] != int64(65) {
+		t.Fatalf("Expected the cached response, got %+v (%v)", cached, ok)
+	}
+	cached.response.Payload["temp"] = int64(0)
+	if cached, _, _ := cache.get("1:boiler.temp", now); cached.response.Payload["temp"] != int64(65) {
+		t.Error("Expected callers to get their own copy of the payload")
+	}
+	if _, _, ok := cache.get("1:boiler.temp", now.Add(time.Second)); ok {
+		t.Error("Expected the response to expire after the TTL")
+	}
+
+	// a read answered after a write was made before it isn't kept
+	_, generation, _ = cache.get("1:boiler.temp", now)
+	cache.invalidate()
+	cache.put("1:boiler.temp", "boiler", generation, 4, response, now)
+	if _, _, ok := cache.get("1:boiler.temp", now); ok {
+		t.Error("Expected a read overtaken by a write not to be cached")
+	}
+
+	cache.put("4:", "operating_data", generation+1, 5, &NBEResponse{Status: StatusDenied}, now)
+	if _, _, ok := cache.get("4:", now); ok {
+		t.Error("Expected a failed read not to be cached")
+	}
+}
+
+func TestCacheCategory(t *testing.T) {
+	tests := []struct {
+		function Function
+		path     string
+		want     string
+	}{
+		{GetSetupFunction, "boiler.temp", "boiler"},
+		{GetSetupRangeFunction, "hot_water.*", "hot_water"},
+		{GetOperatingDataFunction, "*", "operating_data"},
+		{GetAdvancedDataFunction, "", "advanced_data"},
+		{GetEventLogFunction, "*", "event_log"},
+	}
+	for _, tt := range tests {
+		if got := cacheCategory(tt.function, tt.path); got != tt.want {
+			t.Errorf("cacheCategory(%s, %q) = %q, want %q", tt.function, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const eventTimeLayout = "060102 15:04:05"
+
+// Event is a single entry in the controller's event log
+type Event struct {
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	Code int64     `json:"code"`
+	Text string    `json:"text"`
+}
+
+// String encodes the event the way the controller reports it in an event log
+// response: "<YYMMDD hh:mm:ss>,<code>,<text>"
+func (e Event) String() string {
+	return fmt.Sprintf("%s,%d,%s", e.Time.Format(eventTimeLayout), e.Code, e.Text)
+}
+
+// ParseEvents decodes an event log response payload, keyed by sequence
+// number, into events ordered by sequence. Malformed entries are skipped.
+func ParseEvents(payload map[string]interface{}) []Event {
+	var events []Event
+	for key, value := range payload {
+		seq, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		entry, ok := value.(string)
+		if !ok {
+			continue
+		}
+		parts := strings.SplitN(entry, ",", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		timestamp, err := time.ParseInLocation(eventTimeLayout, parts[0], time.Local)
+		if err != nil {
+			continue
+		}
+		code, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		events = append(events, Event{Seq: seq, Time: timestamp, Code: code, Text: parts[2]})
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events
+}
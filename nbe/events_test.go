@@ -0,0 +1,54 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEvents(t *testing.T) {
+	payload := map[string]interface{}{
+		"2":       "231104 07:15:00,19,Error no fire, out of pellets",
+		"1":       "231104 06:00:30,9,Alarm burner is too hot",
+		"3":       "not an event",
+		"summary": "231104 07:15:00,1,ignored",
+		"4":       int64(12),
+	}
+
+	events := ParseEvents(payload)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %+v", len(events), events)
+	}
+
+	expected := time.Date(2023, 11, 4, 6, 0, 30, 0, time.Local)
+	if events[0].Seq != 1 || events[0].Code != 9 || !events[0].Time.Equal(expected) {
+		t.Errorf("Unexpected first event: %+v", events[0])
+	}
+	if events[1].Text != "Error no fire, out of pellets" {
+		t.Errorf("Expected text with comma preserved, got %q", events[1].Text)
+	}
+}
+
+func TestEventStringRoundTrip(t *testing.T) {
+	event := Event{Seq: 5, Time: time.Date(2023, 1, 2, 3, 4, 5, 0, time.Local), Code: 12, Text: "Fault ignition"}
+	events := ParseEvents(map[string]interface{}{"5": event.String()})
+	if len(events) != 1 || events[0] != event {
+		t.Errorf("Expected %+v, got %+v", event, events)
+	}
+}
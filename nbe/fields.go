@@ -0,0 +1,197 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type FieldType string
+
+const (
+	FloatField FieldType = "float"
+	IntField   FieldType = "int"
+	TextField  FieldType = "text"
+)
+
+// FieldDefinition describes a value reported in operating or advanced data
+type FieldDefinition struct {
+	Name        string
+	Description string
+	Type        FieldType
+	Unit        string
+	DeviceClass string
+	// Scale converts the raw controller number into Unit; zero means 1
+	Scale float64
+}
+
+// OperatingFields describes the operating data reported by V7 and V13 controllers
+var OperatingFields = fieldMap([]FieldDefinition{
+	{Name: "boiler_temp", Description: "Boiler temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "boiler_ref", Description: "Boiler reference temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "dhw_temp", Description: "Hot water temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "dhw_ref", Description: "Hot water reference temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "return_temp", Description: "Return temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "shaft_temp", Description: "Burner shaft temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "smoke_temp", Description: "Flue gas temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "external_temp", Description: "Outdoor temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "sun_temp", Description: "Solar collector temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "oxygen", Description: "Flue gas oxygen", Type: FloatField, Unit: "%"},
+	{Name: "oxygen_ref", Description: "Oxygen reference", Type: FloatField, Unit: "%"},
+	{Name: "photo_level", Description: "Flame photo sensor level", Type: FloatField, Unit: "%"},
+	{Name: "power_kw", Description: "Burner output", Type: FloatField, Unit: "kW", DeviceClass: "power"},
+	{Name: "power_pct", Description: "Burner output relative to maximum", Type: FloatField, Unit: "%"},
+	{Name: "content", Description: "Hopper content", Type: FloatField, Unit: "kg", DeviceClass: "weight"},
+	{Name: "state", Description: "Power state", Type: IntField},
+	{Name: "substate", Description: "Power sub-state", Type: IntField},
+	{Name: "substate_sec", Description: "Time in sub-state", Type: IntField, Unit: "s", DeviceClass: "duration"},
+	{Name: "circuit1_temp", Description: "Heating circuit 1 flow temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "circuit1_ref", Description: "Heating circuit 1 reference temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "circuit1_valve", Description: "Heating circuit 1 mixer valve position", Type: IntField, Unit: "%"},
+	{Name: "circuit1_pump", Description: "Heating circuit 1 pump output", Type: IntField},
+	{Name: "circuit2_temp", Description: "Heating circuit 2 flow temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "circuit2_ref", Description: "Heating circuit 2 reference temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "circuit2_valve", Description: "Heating circuit 2 mixer valve position", Type: IntField, Unit: "%"},
+	{Name: "circuit2_pump", Description: "Heating circuit 2 pump output", Type: IntField},
+	{Name: "district_temp", Description: "District heating supply temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "district_ref", Description: "District heating reference temperature", Type: FloatField, Unit: "°C", DeviceClass: "temperature"},
+	{Name: "district_pump", Description: "District heating pump output", Type: IntField},
+})
+
+// advancedFields lists the advanced data in the order the controller numbers
+// it, starting at 0
+var advancedFields = []FieldDefinition{
+	{Name: "fan_speed", Description: "Exhaust fan speed", Type: IntField, Unit: "rpm"},
+	{Name: "auger_cycles", Description: "Auger cycles", Type: IntField},
+	{Name: "boiler_pump_state", Description: "Boiler pump output", Type: IntField},
+	{Name: "dhw_valve_state", Description: "Hot water valve output", Type: IntField},
+	{Name: "outputs", Description: "Relay output bitmask", Type: IntField},
+}
+
+// AdvancedFields describes the advanced data reported by V7 and V13 controllers
+var AdvancedFields = fieldMap(advancedFields)
+
+// SelectAdvancedFields resolves a selection of advanced data fields to their
+// names. Each entry is a field name, a field ID or an inclusive ID range such
+// as "0-2". Names missing from AdvancedFields are kept, as the controller may
+// report more than is described here.
+func SelectAdvancedFields(selection []string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, entry := range selection {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || entry[0] < '0' || entry[0] > '9' {
+			if !isFieldName(entry) {
+				return nil, fmt.Errorf("invalid advanced data field %q", entry)
+			}
+			add(strings.ToLower(entry))
+			continue
+		}
+		first, last, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			last = first
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("invalid advanced data field ID %q", entry)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil {
+			return nil, fmt.Errorf("invalid advanced data field ID %q", entry)
+		}
+		if from > to || to >= len(advancedFields) {
+			return nil, fmt.Errorf("advanced data field IDs %q must be within 0-%d", entry, len(advancedFields)-1)
+		}
+		for id := from; id <= to; id++ {
+			add(advancedFields[id].Name)
+		}
+	}
+	return names, nil
+}
+
+func isFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range strings.ToLower(name) {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// FieldsPath returns the request path reading only the named fields of
+// operating or advanced data, or all of them when names is empty
+func FieldsPath(names []string) string {
+	if len(names) == 0 {
+		return "*"
+	}
+	return strings.Join(names, ";")
+}
+
+func fieldMap(definitions []FieldDefinition) map[string]FieldDefinition {
+	fields := make(map[string]FieldDefinition, len(definitions))
+	for _, definition := range definitions {
+		fields[definition.Name] = definition
+	}
+	return fields
+}
+
+// Apply scales a raw value and converts it to the field's type. Values that
+// are not numeric are returned unchanged.
+func (field FieldDefinition) Apply(value interface{}) interface{} {
+	var f float64
+	switch v := value.(type) {
+	case int64:
+		f = float64(v)
+	case RoundedFloat:
+		f = float64(v)
+	default:
+		return value
+	}
+	if field.Scale != 0 {
+		f *= field.Scale
+	}
+
+	switch field.Type {
+	case IntField:
+		return int64(math.Round(f))
+	case FloatField:
+		return RoundedFloat(f)
+	}
+	return value
+}
+
+// ScaleFields applies the matching field definitions to every value in payload
+func ScaleFields(fields map[string]FieldDefinition, payload map[string]interface{}) {
+	for key, value := range payload {
+		if field, ok := fields[key]; ok {
+			payload[key] = field.Apply(value)
+		}
+	}
+}
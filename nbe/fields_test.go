@@ -0,0 +1,113 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "testing"
+
+func TestFieldDefinitionApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    FieldDefinition
+		value    interface{}
+		expected interface{}
+	}{
+		{"float from int", FieldDefinition{Type: FloatField}, int64(62), RoundedFloat(62)},
+		{"float scaled", FieldDefinition{Type: FloatField, Scale: 0.1}, int64(625), RoundedFloat(62.5)},
+		{"int from float", FieldDefinition{Type: IntField}, RoundedFloat(4.6), int64(5)},
+		{"int scaled", FieldDefinition{Type: IntField, Scale: 10}, int64(25), int64(250)},
+		{"text unchanged", FieldDefinition{Type: TextField}, int64(3), int64(3)},
+		{"string unchanged", FieldDefinition{Type: FloatField}, "n/a", "n/a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.field.Apply(tt.value)
+			if result != tt.expected {
+				t.Errorf("Apply(%v) = %v (%T), want %v (%T)", tt.value, result, result, tt.expected, tt.expected)
+			}
+		})
+	}
+}
+
+func TestScaleFields(t *testing.T) {
+	payload := map[string]interface{}{
+		"boiler_temp": int64(62),
+		"state":       int64(5),
+		"unknown":     int64(7),
+	}
+	ScaleFields(OperatingFields, payload)
+
+	if payload["boiler_temp"] != RoundedFloat(62) {
+		t.Errorf("Expected boiler_temp as RoundedFloat, got %v (%T)", payload["boiler_temp"], payload["boiler_temp"])
+	}
+	if payload["state"] != int64(5) {
+		t.Errorf("Expected state to stay int64, got %v (%T)", payload["state"], payload["state"])
+	}
+	if payload["unknown"] != int64(7) {
+		t.Errorf("Expected unknown field unchanged, got %v", payload["unknown"])
+	}
+}
+
+func TestFieldDictionaryIsConsistent(t *testing.T) {
+	for _, fields := range []map[string]FieldDefinition{OperatingFields, AdvancedFields} {
+		for key, field := range fields {
+			if key != field.Name {
+				t.Errorf("Field %s registered under %s", field.Name, key)
+			}
+			if field.Description == "" {
+				t.Errorf("Field %s has no description", key)
+			}
+			if field.DeviceClass == "temperature" && field.Unit != "°C" {
+				t.Errorf("Temperature field %s has unit %q", key, field.Unit)
+			}
+		}
+	}
+}
+
+func TestSelectAdvancedFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection []string
+		expected  string
+		wantErr   bool
+	}{
+		{"all", nil, "*", false},
+		{"names", []string{"fan_speed", "Outputs"}, "fan_speed;outputs", false},
+		{"ID", []string{"1"}, "auger_cycles", false},
+		{"ID range", []string{"0-2"}, "fan_speed;auger_cycles;boiler_pump_state", false},
+		{"mixed without duplicates", []string{"outputs", "3-4", "fan_speed"}, "outputs;dhw_valve_state;fan_speed", false},
+		{"undescribed name", []string{"ash_level"}, "ash_level", false},
+		{"ID out of range", []string{"2-9"}, "", true},
+		{"reversed range", []string{"3-1"}, "", true},
+		{"invalid range", []string{"1-x"}, "", true},
+		{"invalid name", []string{"fan speed"}, "", true},
+		{"empty", []string{""}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := SelectAdvancedFields(tt.selection)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SelectAdvancedFields(%v) error = %v, wantErr %v", tt.selection, err, tt.wantErr)
+			}
+			if !tt.wantErr && FieldsPath(names) != tt.expected {
+				t.Errorf("SelectAdvancedFields(%v) requests %q, want %q", tt.selection, FieldsPath(names), tt.expected)
+			}
+		})
+	}
+}
@@ -235,6 +235,8 @@ func parsePayload(payloadStr string, function Function) map[string]interface{} {
 					"decimals": parseValue(values[3]),
 				}
 			}
+		} else if function == GetLogFileFunction {
+			payload[key] = keyValue[1]
 		} else {
 			payload[key] = parseValue(keyValue[1])
 		}
@@ -0,0 +1,168 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoPublicKey refuses a request carrying a password while the
+// controller's public key is unknown, instead of sending the password in
+// plain text
+var ErrNoPublicKey = errors.New("refusing to send the password unencrypted: the controller's public key is unknown")
+
+// KeyMismatchError is returned when the controller presents a public key
+// other than the one pinned with the key parameter of the controller URL
+type KeyMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (e *KeyMismatchError) Error() string {
+	return fmt.Sprintf("controller public key %s does not match the pinned key %s: the controller may have been reset or replaced, or another device answers on its address", e.Got, e.Expected)
+}
+
+// keyCheckInterval limits how often an unanswered encrypted request makes
+// the client fetch the controller's key again
+const keyCheckInterval = time.Minute
+
+// KeyFingerprint returns the hex SHA-256 of the key's PKIX encoding, as used
+// to pin the key in the controller URL
+func KeyFingerprint(key *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// MarshalPublicKey encodes a key the way the controller reports it: base64
+// of its PKIX encoding
+func MarshalPublicKey(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParsePublicKey decodes a key encoded by MarshalPublicKey
+func ParsePublicKey(encoded string) (*rsa.PublicKey, error) {
+	return rsaKeyFromBase64(encoded)
+}
+
+// PublicKey returns the controller's public key, nil until it is known
+func (nbe *NBE) PublicKey() *rsa.PublicKey {
+	nbe.pinMutex.RLock()
+	defer nbe.pinMutex.RUnlock()
+	return nbe.RSAKey
+}
+
+// PublicKeyFingerprint returns the fingerprint of the controller's public
+// key, to pin it with the key parameter of the controller URL
+func (nbe *NBE) PublicKeyFingerprint() string {
+	key := nbe.PublicKey()
+	if key == nil {
+		return ""
+	}
+	return KeyFingerprint(key)
+}
+
+// discoverKey takes the public key from the discovery response, falling back
+// to the misc.rsa_key setting for controllers that don't announce it, and
+// checks it against the pinned fingerprint
+func (nbe *NBE) discoverKey(discovery *NBEResponse) (*rsa.PublicKey, error) {
+	var key *rsa.PublicKey
+	if encoded, ok := discovery.Payload["rsa_key"].(string); ok && encoded != "" {
+		pub, err := rsaKeyFromBase64(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the public key from discovery: %w", err)
+		}
+		key = pub
+	} else {
+		pub, err := nbe.getRSAKey()
+		if err != nil {
+			return nil, err
+		}
+		key = pub
+	}
+	if err := nbe.verifyKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// verifyKey checks key against the fingerprint pinned with the key parameter
+// of the controller URL, if any
+func (nbe *NBE) verifyKey(key *rsa.PublicKey) error {
+	pinned := nbe.URI.Query().Get("key")
+	if pinned == "" {
+		return nil
+	}
+	if got := KeyFingerprint(key); got != pinned {
+		return &KeyMismatchError{Expected: pinned, Got: got}
+	}
+	return nil
+}
+
+// checkKey fetches the controller's key again after an encrypted request
+// went unanswered, which is what a controller does with a request encrypted
+// for a key it no longer has. A changed key is adopted unless a key is
+// pinned.
+func (nbe *NBE) checkKey() {
+	now := time.Now().UnixNano()
+	last := nbe.lastKeyCheck.Load()
+	if now-last < int64(keyCheckInterval) || !nbe.lastKeyCheck.CompareAndSwap(last, now) {
+		return
+	}
+
+	response, err := nbe.Get(GetSetupFunction, "misc.rsa_key")
+	if err != nil {
+		log.Debugf("Failed to check the controller's public key: %v", err)
+		return
+	}
+	encoded, _ := response.Payload["rsa_key"].(string)
+	key, err := rsaKeyFromBase64(encoded)
+	if err != nil {
+		log.Warnf("The controller returned an invalid public key: %v", err)
+		return
+	}
+	current := nbe.PublicKey()
+	if current != nil && key.Equal(current) {
+		return
+	}
+	if err := nbe.verifyKey(key); err != nil {
+		log.Errorf("Writes to the controller will fail: %v", err)
+		return
+	}
+
+	nbe.pinMutex.Lock()
+	nbe.RSAKey = key
+	nbe.pinMutex.Unlock()
+	log.Warnf("The controller's public key changed to %s; writes are encrypted with the new key", KeyFingerprint(key))
+}
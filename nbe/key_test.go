@@ -0,0 +1,128 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestPinnedKey(t *testing.T) {
+	mb, err := NewMockBoiler("TEST12345")
+	if err != nil {
+		t.Fatalf("Failed to create mock boiler: %v", err)
+	}
+	if err := mb.Start(); err != nil {
+		t.Fatalf("Failed to start mock boiler: %v", err)
+	}
+	t.Cleanup(mb.Stop)
+
+	fingerprint := KeyFingerprint(mb.rsaPublicKey)
+	uri, _ := url.Parse(fmt.Sprintf("tcp://TEST12345:1234@%s?key=%s", mb.GetAddr(), fingerprint))
+	boiler, err := NewNBE(uri)
+	if err != nil {
+		t.Fatalf("NewNBE() with the right key error = %v", err)
+	}
+	if !boiler.PublicKey().Equal(mb.rsaPublicKey) {
+		t.Error("Expected the key from discovery")
+	}
+
+	uri, _ = url.Parse(fmt.Sprintf("tcp://TEST12345:1234@%s?key=%064d", mb.GetAddr(), 0))
+	_, err = NewNBE(uri)
+	var mismatch *KeyMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Got != fingerprint {
+		t.Errorf("NewNBE() with another key error = %v, want a key mismatch", err)
+	}
+}
+
+func TestPasswordNeverSentInPlainText(t *testing.T) {
+	boiler, _ := newTestNBE(t)
+	boiler.PinCode = "1234567890"
+
+	var mu sync.Mutex
+	var sent int
+	boiler.SetTracer(func(outgoing bool, local, remote net.Addr, packet []byte) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+	})
+
+	if _, err := boiler.SetAsync("boiler.temp", []byte("65"), func(*NBEResponse) {}); !errors.Is(err, ErrNoPublicKey) {
+		t.Errorf("SetAsync() error = %v, want %v", err, ErrNoPublicKey)
+	}
+	if queued := boiler.Queued(); queued != 0 {
+		t.Errorf("Expected an empty queue, got %d", queued)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 0 {
+		t.Errorf("Expected nothing on the wire, got %d requests", sent)
+	}
+}
+
+func TestCheckKeyAdoptsChangedKey(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	// the controller was reset and generated a new key
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	mb.mu.Lock()
+	mb.rsaPrivateKey = privateKey
+	mb.rsaPublicKey = &privateKey.PublicKey
+	mb.rsaKeyBase64 = base64.StdEncoding.EncodeToString(der)
+	mb.mu.Unlock()
+	mb.SetValue("misc", "rsa_key", mb.rsaKeyBase64)
+
+	boiler.checkKey()
+	if !boiler.PublicKey().Equal(&privateKey.PublicKey) {
+		t.Fatal("Expected the client to adopt the new key")
+	}
+	if _, err := boiler.Set("boiler.temp", []byte("70")); err != nil {
+		t.Errorf("Set() with the new key error = %v", err)
+	}
+}
+
+func TestMarshalPublicKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := MarshalPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPublicKey() error = %v", err)
+	}
+	key, err := ParsePublicKey(encoded)
+	if err != nil || !key.Equal(&privateKey.PublicKey) {
+		t.Errorf("ParsePublicKey() = %v, %v, want the marshalled key", key, err)
+	}
+	if _, err := ParsePublicKey("not a key"); err == nil {
+		t.Error("Expected an error parsing garbage")
+	}
+}
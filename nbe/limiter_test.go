@@ -0,0 +1,60 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Unix(1700000000, 0)
+
+	// the burst goes out immediately
+	for i := 0; i < 3; i++ {
+		if delay := limiter.reserve(now); delay != 0 {
+			t.Fatalf("request %d delayed by %s, want none", i, delay)
+		}
+	}
+	// then requests queue up at the rate
+	if delay := limiter.reserve(now); delay != 500*time.Millisecond {
+		t.Errorf("4th request delayed by %s, want 500ms", delay)
+	}
+	if delay := limiter.reserve(now); delay != time.Second {
+		t.Errorf("5th request delayed by %s, want 1s", delay)
+	}
+
+	// idle time refills the bucket up to the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if delay := limiter.reserve(later); delay != 0 {
+			t.Fatalf("request %d after idling delayed by %s, want none", i, delay)
+		}
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(0, 1)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if delay := limiter.reserve(now); delay != 0 {
+			t.Fatalf("request %d delayed by %s without a limit", i, delay)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// logChunkSize is how many bytes of a log file are asked for per request
+const logChunkSize = 512
+
+// LogFile is one of the log files the controller keeps internally
+type LogFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// LogFiles lists the controller's log files, ordered by name. The controller
+// answers "*" with the size of each file, keyed by its name.
+func (nbe *NBE) LogFiles() ([]LogFile, error) {
+	response, err := nbe.Get(GetLogFileFunction, "*")
+	if err != nil {
+		return nil, err
+	}
+	var files []LogFile
+	for name, value := range response.Payload {
+		size, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q of the log file %s", value, name)
+		}
+		files = append(files, LogFile{Name: name, Size: size})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// ReadLogFile copies the log file name to w and returns the number of bytes
+// copied. The file is read in chunks, "<name>:<offset>" answering with the
+// file's size and up to logChunkSize base64 encoded bytes from offset.
+func (nbe *NBE) ReadLogFile(name string, w io.Writer) (int64, error) {
+	var offset int64
+	for {
+		response, err := nbe.Get(GetLogFileFunction, fmt.Sprintf("%s:%d", name, offset))
+		if err != nil {
+			return offset, err
+		}
+		size, chunk, err := parseLogChunk(response.Payload)
+		if err != nil {
+			return offset, fmt.Errorf("log file %s at %d: %w", name, offset, err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return offset, err
+		}
+		offset += int64(len(chunk))
+		if offset >= size {
+			return offset, nil
+		}
+		if len(chunk) == 0 {
+			return offset, fmt.Errorf("log file %s ended at %d of %d bytes", name, offset, size)
+		}
+	}
+}
+
+// parseLogChunk decodes the size and data of a log file chunk response
+func parseLogChunk(payload map[string]interface{}) (int64, []byte, error) {
+	if reason, ok := payload["error"]; ok {
+		return 0, nil, fmt.Errorf("%v", reason)
+	}
+	size, err := strconv.ParseInt(fmt.Sprint(payload["size"]), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid size %q", payload["size"])
+	}
+	data, _ := payload["data"].(string)
+	chunk, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid data: %w", err)
+	}
+	return size, chunk, nil
+}
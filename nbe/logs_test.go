@@ -0,0 +1,82 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadLogFile(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	// longer than a chunk
+	long := []byte(strings.Repeat("230101 10:00:00 ignition started\n", 40))
+	mb.AddLogFile("system.log", long)
+	mb.AddLogFile("boot.log", []byte("123"))
+
+	files, err := boiler.LogFiles()
+	if err != nil {
+		t.Fatalf("LogFiles() error = %v", err)
+	}
+	if len(files) != 2 || files[0] != (LogFile{"boot.log", 3}) || files[1] != (LogFile{"system.log", int64(len(long))}) {
+		t.Fatalf("Unexpected log files %v", files)
+	}
+
+	for name, want := range map[string][]byte{"system.log": long, "boot.log": []byte("123")} {
+		var buf bytes.Buffer
+		n, err := boiler.ReadLogFile(name, &buf)
+		if err != nil {
+			t.Fatalf("ReadLogFile(%s) error = %v", name, err)
+		}
+		if n != int64(len(want)) || !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("Expected %d bytes of %s, got %d", len(want), name, n)
+		}
+	}
+
+	if _, err := boiler.ReadLogFile("missing.log", &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for a missing log file")
+	}
+}
+
+func TestParseLogChunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload map[string]interface{}
+		size    int64
+		chunk   string
+		wantErr bool
+	}{
+		{"chunk", map[string]interface{}{"size": "10", "data": "aGVsbG8="}, 10, "hello", false},
+		{"empty file", map[string]interface{}{"size": "0"}, 0, "", false},
+		{"error", map[string]interface{}{"error": "no such log file"}, 0, "", true},
+		{"bad size", map[string]interface{}{"size": "x", "data": ""}, 0, "", true},
+		{"bad data", map[string]interface{}{"size": "3", "data": "!!"}, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, chunk, err := parseLogChunk(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLogChunk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if size != tt.size || string(chunk) != tt.chunk {
+				t.Errorf("Expected %d and %q, got %d and %q", tt.size, tt.chunk, size, chunk)
+			}
+		})
+	}
+}
@@ -24,10 +24,13 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"math"
 	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // MockBoiler simulates an NBE boiler for testing
@@ -38,11 +41,34 @@ type MockBoiler struct {
 	running       bool              // Protected by mu
 	mu            sync.RWMutex      // Protects running and data
 	data          map[string]map[string]interface{}
+	events        []Event
+	logs          map[string][]byte
+	writes        []string
+	limits        map[string][2]float64
+	ranges        map[string]map[string]interface{}
+	faults        []mockFault
+	held          []mockPacket
+	protected     map[string]string
+	maxDatagram   int
 	rsaPrivateKey *rsa.PrivateKey
 	rsaPublicKey  *rsa.PublicKey
 	rsaKeyBase64  string
 }
 
+// mockFault is a misbehaviour applied to a single response
+type mockFault struct {
+	status    uint8
+	truncate  int
+	duplicate bool
+	hold      bool
+}
+
+// mockPacket is a response held back to be sent out of order
+type mockPacket struct {
+	data []byte
+	addr net.Addr
+}
+
 // NewMockBoiler creates a new mock boiler server
 func NewMockBoiler(serial string) (*MockBoiler, error) {
 	// Generate RSA key for mock boiler
@@ -71,9 +97,15 @@ func NewMockBoiler(serial string) (*MockBoiler, error) {
 	return mb, nil
 }
 
-// Start begins listening for UDP packets
+// Start begins listening for UDP packets on a free local port
 func (mb *MockBoiler) Start() error {
-	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	return mb.Listen("127.0.0.1:0")
+}
+
+// Listen begins listening for UDP packets on address, such as ":8483" for
+// clients on other hosts
+func (mb *MockBoiler) Listen(address string) error {
+	listener, err := net.ListenPacket("udp4", address)
 	if err != nil {
 		return err
 	}
@@ -124,11 +156,17 @@ func (mb *MockBoiler) listen() {
 			}
 			return
 		}
-		go mb.handleRequest(buffer[:n], addr)
+		if fault := mb.nextFault(); fault != nil {
+			// answered in order, so each fault hits the request it was
+			// queued for
+			mb.handleRequest(buffer[:n], addr, fault)
+			continue
+		}
+		go mb.handleRequest(buffer[:n], addr, nil)
 	}
 }
 
-func (mb *MockBoiler) handleRequest(data []byte, addr net.Addr) {
+func (mb *MockBoiler) handleRequest(data []byte, addr net.Addr, fault *mockFault) {
 	// Ignore empty or too-small packets
 	if len(data) < 20 {
 		return
@@ -182,18 +220,142 @@ func (mb *MockBoiler) handleRequest(data []byte, addr net.Addr) {
 		return
 	}
 
-	response := mb.processRequest(&request)
+	var response *NBEResponse
+	if fault != nil && fault.status != 0 {
+		// the controller rejects the request without acting on it
+		response = &NBEResponse{
+			AppID:        request.AppID,
+			ControllerID: request.ControllerID,
+			Function:     request.Function,
+			SeqNo:        request.SeqNo,
+			Status:       fault.status,
+			Payload:      make(map[string]interface{}),
+		}
+	} else {
+		response = mb.processRequest(&request)
+	}
 	responseBuffer := new(bytes.Buffer)
 	err = response.Pack(responseBuffer)
 	if err != nil {
 		return
 	}
 
-	_, err = mb.listener.WriteTo(responseBuffer.Bytes(), addr)
+	packet := responseBuffer.Bytes()
+	if fault != nil {
+		if fault.truncate > 0 && fault.truncate < len(packet) {
+			packet = packet[:fault.truncate]
+		}
+		if fault.hold {
+			mb.mu.Lock()
+			mb.held = append(mb.held, mockPacket{data: packet, addr: addr})
+			mb.mu.Unlock()
+			return
+		}
+	}
+
+	err = mb.send(packet, addr)
 	if err != nil {
 		// Log error but don't fail - this is a mock server
 		return
 	}
+	if fault != nil && fault.duplicate {
+		mb.send(packet, addr)
+	}
+
+	mb.mu.Lock()
+	held := mb.held
+	mb.held = nil
+	mb.mu.Unlock()
+	for _, p := range held {
+		mb.listener.WriteTo(p.data, p.addr)
+	}
+}
+
+// send writes a response, cut into datagrams of at most maxDatagram bytes
+// if it is set
+func (mb *MockBoiler) send(packet []byte, addr net.Addr) error {
+	mb.mu.RLock()
+	size := mb.maxDatagram
+	mb.mu.RUnlock()
+	for size > 0 && len(packet) > size {
+		if _, err := mb.listener.WriteTo(packet[:size], addr); err != nil {
+			return err
+		}
+		packet = packet[size:]
+	}
+	_, err := mb.listener.WriteTo(packet, addr)
+	return err
+}
+
+// SetMaxDatagram makes the controller cut its responses into datagrams of
+// at most size bytes, as firmwares with small network buffers do; zero
+// sends each response in one datagram
+func (mb *MockBoiler) SetMaxDatagram(size int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.maxDatagram = size
+}
+
+// InjectStatus makes the controller reject the next request with status,
+// a single digit, without acting on it
+func (mb *MockBoiler) InjectStatus(status uint8) {
+	mb.injectFault(mockFault{status: status})
+}
+
+// ProtectSettings makes the controller deny writes to paths unless they are
+// sent with pin, as it does for installer settings
+func (mb *MockBoiler) ProtectSettings(pin string, paths ...string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.protected == nil {
+		mb.protected = make(map[string]string)
+	}
+	for _, path := range paths {
+		mb.protected[path] = pin
+	}
+}
+
+// InjectTruncated cuts the next response short after length bytes
+func (mb *MockBoiler) InjectTruncated(length int) {
+	mb.injectFault(mockFault{truncate: length})
+}
+
+// InjectDuplicate sends the next response twice
+func (mb *MockBoiler) InjectDuplicate() {
+	mb.injectFault(mockFault{duplicate: true})
+}
+
+// InjectOutOfOrder holds the next response back until the response after it
+// has been sent, so sequence numbers arrive out of order
+func (mb *MockBoiler) InjectOutOfOrder() {
+	mb.injectFault(mockFault{hold: true})
+}
+
+// ClearFaults drops every injected fault that has not been used yet
+func (mb *MockBoiler) ClearFaults() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.faults = nil
+}
+
+// injectFault queues fault for the next request without a fault. Faults are
+// used one per request, in the order they were injected.
+func (mb *MockBoiler) injectFault(fault mockFault) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.faults = append(mb.faults, fault)
+}
+
+// nextFault takes the fault for the request just received, if any
+func (mb *MockBoiler) nextFault() *mockFault {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if len(mb.faults) == 0 {
+		return nil
+	}
+	fault := mb.faults[0]
+	mb.faults = mb.faults[1:]
+	return &fault
 }
 
 func (mb *MockBoiler) processRequest(request *NBERequest) *NBEResponse {
@@ -215,6 +377,14 @@ func (mb *MockBoiler) processRequest(request *NBERequest) *NBEResponse {
 		path := string(request.Payload)
 		response.Payload = mb.getData(path)
 
+	case GetSetupRangeFunction:
+		category := strings.TrimSuffix(string(request.Payload), ".*")
+		mb.mu.RLock()
+		if ranges, ok := mb.ranges[category]; ok {
+			response.Payload = copyMap(ranges)
+		}
+		mb.mu.RUnlock()
+
 	case GetOperatingDataFunction:
 		mb.mu.RLock()
 		if data, ok := mb.data["operating"]; ok {
@@ -225,18 +395,51 @@ func (mb *MockBoiler) processRequest(request *NBERequest) *NBEResponse {
 	case GetAdvancedDataFunction:
 		mb.mu.RLock()
 		if data, ok := mb.data["advanced"]; ok {
+			response.Payload = selectFields(data, string(request.Payload))
+		}
+		mb.mu.RUnlock()
+
+	case GetInfoFunction:
+		mb.mu.RLock()
+		if data, ok := mb.data["info"]; ok {
 			response.Payload = copyMap(data)
 		}
 		mb.mu.RUnlock()
 
+	case GetConsumptionDataFunction:
+		path := string(request.Payload)
+		mb.mu.RLock()
+		if data, ok := mb.data["consumption"]; ok {
+			if val, ok := data[path]; ok {
+				response.Payload[path] = val
+			}
+		}
+		mb.mu.RUnlock()
+
+	case GetEventLogFunction:
+		response.Payload = mb.getEvents(string(request.Payload))
+
+	case GetLogFileFunction:
+		response.Payload = mb.getLogFile(string(request.Payload))
+
 	case SetSetupFunction:
 		// Parse key=value from payload
 		payload := string(request.Payload)
 		parts := strings.SplitN(payload, "=", 2)
+		mb.mu.RLock()
+		pin, protected := mb.protected[parts[0]]
+		mb.mu.RUnlock()
+		if protected && strings.TrimSpace(request.PinCode) != pin {
+			response.Status = StatusDenied
+			break
+		}
 		if len(parts) == 2 {
 			mb.setData(parts[0], parts[1])
 			response.Payload["status"] = "ok"
 		}
+		mb.mu.Lock()
+		mb.writes = append(mb.writes, payload)
+		mb.mu.Unlock()
 
 	default:
 		response.Payload["error"] = "unsupported function"
@@ -292,8 +495,42 @@ func (mb *MockBoiler) setData(path, value string) {
 		if _, ok := mb.data[category]; !ok {
 			mb.data[category] = make(map[string]interface{})
 		}
+		if limit, ok := mb.limits[path]; ok {
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				value = strconv.FormatFloat(math.Max(limit[0], math.Min(limit[1], f)), 'f', -1, 64)
+			}
+		}
 		mb.data[category][key] = value
+		mb.updateFlowSetpoint()
+	}
+}
+
+// SetLimit makes the mock clamp writes to path into min..max without an
+// error, as the controller does for settings it restricts further
+func (mb *MockBoiler) SetLimit(path string, min, max float64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.limits == nil {
+		mb.limits = make(map[string][2]float64)
+	}
+	mb.limits[path] = [2]float64{min, max}
+}
+
+// SetRange makes the mock report min..max with the given number of decimals
+// as the range of path, answering get_setup_range for its category
+func (mb *MockBoiler) SetRange(path string, min, max float64, decimals int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	category, key, _ := strings.Cut(path, ".")
+	if mb.ranges == nil {
+		mb.ranges = make(map[string]map[string]interface{})
+	}
+	if mb.ranges[category] == nil {
+		mb.ranges[category] = make(map[string]interface{})
 	}
+	mb.ranges[category][key] = fmt.Sprintf("%v,%v,%v,%d", min, max, min, decimals)
 }
 
 // SetValue allows tests to set mock data
@@ -305,6 +542,98 @@ func (mb *MockBoiler) SetValue(category, key string, value interface{}) {
 		mb.data[category] = make(map[string]interface{})
 	}
 	mb.data[category][key] = value
+	mb.updateFlowSetpoint()
+}
+
+// Snapshot returns a copy of every value held by the mock
+func (mb *MockBoiler) Snapshot() map[string]map[string]interface{} {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	snapshot := make(map[string]map[string]interface{}, len(mb.data))
+	for category, values := range mb.data {
+		snapshot[category] = copyMap(values)
+	}
+	return snapshot
+}
+
+// Restore replaces every value held by the mock with a snapshot
+func (mb *MockBoiler) Restore(snapshot map[string]map[string]interface{}) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.data = make(map[string]map[string]interface{}, len(snapshot))
+	for category, values := range snapshot {
+		mb.data[category] = copyMap(values)
+	}
+}
+
+// Writes returns the "key=value" payloads of every write received, in order
+func (mb *MockBoiler) Writes() []string {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	return append([]string(nil), mb.writes...)
+}
+
+// SetOutdoorTemp simulates the reading of the controller's outdoor sensor
+func (mb *MockBoiler) SetOutdoorTemp(temp float64) {
+	mb.SetValue("operating", "external_temp", RoundedFloat(temp))
+}
+
+// updateFlowSetpoint recalculates the boiler reference temperature. With
+// weather compensation active it follows the curve through (out_cold,
+// flow_cold) and (out_warm, flow_warm), clamped to the flow temperatures at
+// either end; otherwise it is the boiler.temp setpoint. A written
+// weather.external_temp takes the place of the outdoor sensor, as an
+// injected external reading would. The caller holds mb.mu.
+func (mb *MockBoiler) updateFlowSetpoint() {
+	operating := mb.data["operating"]
+	weather := mb.data["weather"]
+	if operating == nil {
+		return
+	}
+
+	setpoint, _ := mockFloat(mb.data["boiler"]["temp"])
+	if active, _ := mockFloat(weather["active"]); active != 0 {
+		outdoor, ok := mockFloat(weather["external_temp"])
+		if !ok {
+			outdoor, _ = mockFloat(operating["external_temp"])
+		}
+		coldOut, _ := mockFloat(weather["out_cold"])
+		coldFlow, _ := mockFloat(weather["flow_cold"])
+		warmOut, _ := mockFloat(weather["out_warm"])
+		warmFlow, _ := mockFloat(weather["flow_warm"])
+		setpoint = weatherCurve(outdoor, coldOut, coldFlow, warmOut, warmFlow)
+	}
+	operating["boiler_ref"] = RoundedFloat(setpoint)
+}
+
+// weatherCurve interpolates the flow temperature for an outdoor temperature
+func weatherCurve(outdoor, coldOut, coldFlow, warmOut, warmFlow float64) float64 {
+	if warmOut <= coldOut {
+		return coldFlow
+	}
+	switch {
+	case outdoor <= coldOut:
+		return coldFlow
+	case outdoor >= warmOut:
+		return warmFlow
+	}
+	return coldFlow + (outdoor-coldOut)*(warmFlow-coldFlow)/(warmOut-coldOut)
+}
+
+// mockFloat reads a numeric mock value, which is a string after a write
+func mockFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case RoundedFloat:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
 }
 
 // GetValue allows tests to get mock data
@@ -319,10 +648,98 @@ func (mb *MockBoiler) GetValue(category, key string) (interface{}, bool) {
 	return nil, false
 }
 
+// RaiseAlarm simulates the controller entering an alarm. The alarm is
+// recorded in the event log and reported in operating data until ClearAlarm
+// is called.
+func (mb *MockBoiler) RaiseAlarm(code int64, text string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.events = append(mb.events, Event{
+		Seq:  int64(len(mb.events)),
+		Time: time.Now().Truncate(time.Second),
+		Code: code,
+		Text: text,
+	})
+	mb.data["operating"]["alarm"] = code
+	mb.data["operating"]["alarm_text"] = text
+}
+
+// ClearAlarm simulates the alarm being acknowledged on the controller
+func (mb *MockBoiler) ClearAlarm() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.data["operating"]["alarm"] = int64(0)
+	delete(mb.data["operating"], "alarm_text")
+}
+
+// getEvents returns the event log. A numeric path returns only the events
+// from that sequence number on, "*" returns them all.
+func (mb *MockBoiler) getEvents(path string) map[string]interface{} {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	since, err := strconv.ParseInt(path, 10, 64)
+	if err != nil {
+		since = 0
+	}
+
+	result := make(map[string]interface{})
+	for _, event := range mb.events {
+		if event.Seq >= since {
+			result[strconv.FormatInt(event.Seq, 10)] = event.String()
+		}
+	}
+	return result
+}
+
+// AddLogFile makes the mock keep a log file for download
+func (mb *MockBoiler) AddLogFile(name string, data []byte) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.logs == nil {
+		mb.logs = make(map[string][]byte)
+	}
+	mb.logs[name] = data
+}
+
+// getLogFile answers "*" with the size of every log file, and
+// "<name>:<offset>" with a chunk of that file from offset
+func (mb *MockBoiler) getLogFile(path string) map[string]interface{} {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	result := make(map[string]interface{})
+	if path == "*" {
+		for name, data := range mb.logs {
+			result[name] = strconv.Itoa(len(data))
+		}
+		return result
+	}
+	name, at, _ := strings.Cut(path, ":")
+	data, ok := mb.logs[name]
+	offset, err := strconv.Atoi(at)
+	if !ok || err != nil || offset < 0 || offset > len(data) {
+		result["error"] = "no such log file"
+		return result
+	}
+	end := offset + 512
+	if end > len(data) {
+		end = len(data)
+	}
+	result["size"] = strconv.Itoa(len(data))
+	result["data"] = base64.StdEncoding.EncodeToString(data[offset:end])
+	return result
+}
+
 func (mb *MockBoiler) initializeData() {
 	// Initialize misc settings
 	mb.data["misc"] = map[string]interface{}{
 		"rsa_key": mb.rsaKeyBase64,
+		"date":    "01-01-20",
+		"time":    "00:00",
 	}
 
 	// Initialize boiler settings
@@ -343,6 +760,37 @@ func (mb *MockBoiler) initializeData() {
 		"boiler_power_max": int64(100),
 	}
 
+	// Initialize weather compensation settings, off by default
+	mb.data["weather"] = map[string]interface{}{
+		"active":    int64(0),
+		"out_cold":  RoundedFloat(-10.0),
+		"flow_cold": RoundedFloat(75.0),
+		"out_warm":  RoundedFloat(15.0),
+		"flow_warm": RoundedFloat(35.0),
+	}
+	mb.data["weather2"] = map[string]interface{}{
+		"active":    int64(0),
+		"out_cold":  RoundedFloat(-10.0),
+		"flow_cold": RoundedFloat(45.0),
+		"out_warm":  RoundedFloat(15.0),
+		"flow_warm": RoundedFloat(25.0),
+	}
+
+	// Initialize district heating circuit settings
+	mb.data["district_heating"] = map[string]interface{}{
+		"active": int64(0),
+		"temp":   RoundedFloat(60.0),
+	}
+
+	// Initialize electric backup element settings
+	mb.data["aux_heater"] = map[string]interface{}{
+		"active":  int64(0),
+		"state":   int64(0),
+		"power":   RoundedFloat(3.0),
+		"runtime": int64(0),
+		"starts":  int64(0),
+	}
+
 	// Initialize oxygen settings
 	mb.data["oxygen"] = map[string]interface{}{
 		"start_calibrate": int64(0),
@@ -362,16 +810,48 @@ func (mb *MockBoiler) initializeData() {
 		"power_pct":       RoundedFloat(75.0),
 		"photo_level":     RoundedFloat(88.0),
 		"state":           int64(5), // Power state
-		"state_text":      PowerStates[5],
+		"state_text":      DefaultStates().Text(5),
+		"circuit1_temp":   RoundedFloat(42.0),
+		"circuit1_ref":    RoundedFloat(45.0),
+		"circuit1_valve":  int64(60),
+		"circuit1_pump":   int64(1),
+		"alarm":           int64(0),
+		"external_temp":   RoundedFloat(5.0),
+	}
+	mb.updateFlowSetpoint()
+
+	// Initialize controller info
+	mb.data["info"] = map[string]interface{}{
+		"version": "13.1.05",
+	}
+
+	// Initialize consumption data
+	mb.data["consumption"] = map[string]interface{}{
+		"counter": RoundedFloat(1234.5),
 	}
 
 	// Initialize advanced data
 	mb.data["advanced"] = map[string]interface{}{
 		"fan_speed":    int64(2500),
 		"auger_cycles": int64(120),
+		"outputs":      int64(11),
 	}
 }
 
+// selectFields copies the fields named in a request path, or all of them for "*"
+func selectFields(src map[string]interface{}, path string) map[string]interface{} {
+	if path == "*" || path == "" {
+		return copyMap(src)
+	}
+	dst := make(map[string]interface{})
+	for _, name := range strings.Split(path, ";") {
+		if v, ok := src[name]; ok {
+			dst[name] = v
+		}
+	}
+	return dst
+}
+
 func copyMap(src map[string]interface{}) map[string]interface{} {
 	dst := make(map[string]interface{})
 	for k, v := range src {
@@ -18,7 +18,13 @@
 package nbe
 
 import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMockBoilerCreation(t *testing.T) {
@@ -93,6 +99,18 @@ func TestMockBoilerSetValue(t *testing.T) {
 	}
 }
 
+func TestMockBoilerSelectFields(t *testing.T) {
+	data := map[string]interface{}{"fan_speed": int64(2500), "auger_cycles": int64(120), "outputs": int64(11)}
+
+	if selected := selectFields(data, "*"); len(selected) != 3 {
+		t.Errorf("Expected all fields for *, got %v", selected)
+	}
+	selected := selectFields(data, "fan_speed;outputs;missing")
+	if len(selected) != 2 || selected["fan_speed"] != int64(2500) || selected["outputs"] != int64(11) {
+		t.Errorf("Expected fan_speed and outputs, got %v", selected)
+	}
+}
+
 func TestMockBoilerAsyncRequests(t *testing.T) {
 	t.Skip("Skipping integration test - requires working network communication")
 }
@@ -100,3 +118,277 @@ func TestMockBoilerAsyncRequests(t *testing.T) {
 func TestMockBoilerMultipleClients(t *testing.T) {
 	t.Skip("Skipping integration test - requires working network communication")
 }
+
+func TestMockBoilerRaiseAlarm(t *testing.T) {
+	mb, err := NewMockBoiler("TEST12345")
+	if err != nil {
+		t.Fatalf("Failed to create mock boiler: %v", err)
+	}
+
+	mb.RaiseAlarm(9, "Alarm burner is too hot")
+	mb.RaiseAlarm(19, "Error no fire - out of pellets")
+
+	if val, _ := mb.GetValue("operating", "alarm"); val != int64(19) {
+		t.Errorf("Expected operating alarm 19, got %v", val)
+	}
+
+	response := mb.processRequest(&NBERequest{Function: GetEventLogFunction, Payload: []byte("*")})
+	events := ParseEvents(roundTrip(t, response).Payload)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %v", len(events), response.Payload)
+	}
+	if events[0].Code != 9 || events[0].Text != "Alarm burner is too hot" {
+		t.Errorf("Unexpected first event: %+v", events[0])
+	}
+	if events[1].Code != 19 || events[1].Text != "Error no fire - out of pellets" {
+		t.Errorf("Unexpected second event: %+v", events[1])
+	}
+
+	response = mb.processRequest(&NBERequest{Function: GetEventLogFunction, Payload: []byte("1")})
+	if events := ParseEvents(response.Payload); len(events) != 1 || events[0].Seq != 1 {
+		t.Errorf("Expected only event 1 since sequence 1, got %v", response.Payload)
+	}
+
+	mb.ClearAlarm()
+	if val, _ := mb.GetValue("operating", "alarm"); val != int64(0) {
+		t.Errorf("Expected alarm to be cleared, got %v", val)
+	}
+}
+
+// roundTrip packs and unpacks a response the way it travels over the wire
+func roundTrip(t *testing.T, response *NBEResponse) *NBEResponse {
+	t.Helper()
+	response.AppID = "000000000000"
+	response.ControllerID = "TEST12"
+
+	buffer := new(bytes.Buffer)
+	if err := response.Pack(buffer); err != nil {
+		t.Fatalf("Failed to pack response: %v", err)
+	}
+	var decoded NBEResponse
+	if err := decoded.Unpack(buffer); err != nil {
+		t.Fatalf("Failed to unpack response: %v", err)
+	}
+	return &decoded
+}
+
+func TestMockBoilerWeatherCompensation(t *testing.T) {
+	mb, err := NewMockBoiler("TEST12345")
+	if err != nil {
+		t.Fatalf("Failed to create mock boiler: %v", err)
+	}
+
+	if val, _ := mb.GetValue("operating", "boiler_ref"); val != RoundedFloat(65) {
+		t.Errorf("Expected boiler_ref to follow boiler.temp without compensation, got %v", val)
+	}
+
+	// enabled through the protocol, as a client would
+	mb.processRequest(&NBERequest{Function: SetSetupFunction, Payload: []byte("weather.active=1")})
+
+	tests := []struct {
+		outdoor  float64
+		expected float64
+	}{
+		{-20, 75},
+		{-10, 75},
+		{2.5, 55},
+		{15, 35},
+		{25, 35},
+	}
+	for _, tt := range tests {
+		mb.SetOutdoorTemp(tt.outdoor)
+		response := roundTrip(t, mb.processRequest(&NBERequest{Function: GetOperatingDataFunction, Payload: []byte("*")}))
+		// whole numbers come back as integers from the wire
+		if got, _ := mockFloat(response.Payload["boiler_ref"]); got != tt.expected {
+			t.Errorf("outdoor %v: boiler_ref = %v, want %v", tt.outdoor, response.Payload["boiler_ref"], tt.expected)
+		}
+	}
+
+	// an injected external temperature overrides the sensor
+	mb.SetOutdoorTemp(-20)
+	mb.processRequest(&NBERequest{Function: SetSetupFunction, Payload: []byte("weather.external_temp=15")})
+	if val, _ := mb.GetValue("operating", "boiler_ref"); val != RoundedFloat(35) {
+		t.Errorf("Expected injected 15°C to give 35, got %v", val)
+	}
+
+	mb.processRequest(&NBERequest{Function: SetSetupFunction, Payload: []byte("weather.active=0")})
+	if val, _ := mb.GetValue("operating", "boiler_ref"); val != RoundedFloat(65) {
+		t.Errorf("Expected boiler_ref back at boiler.temp, got %v", val)
+	}
+}
+
+// newMockClient starts a mock boiler and connects a client to it without a
+// rate limit
+func newMockClient(t *testing.T) (*MockBoiler, *NBE) {
+	t.Helper()
+	mb, err := NewMockBoiler("TEST12345")
+	if err != nil {
+		t.Fatalf("Failed to create mock boiler: %v", err)
+	}
+	if err := mb.Start(); err != nil {
+		t.Fatalf("Failed to start mock boiler: %v", err)
+	}
+	t.Cleanup(mb.Stop)
+
+	uri, _ := url.Parse(fmt.Sprintf("tcp://TEST12345:1234@%s", mb.GetAddr()))
+	boiler, err := NewNBE(uri)
+	if err != nil {
+		t.Fatalf("Failed to connect to mock boiler: %v", err)
+	}
+	boiler.SetRateLimit(0, 0)
+	return mb, boiler
+}
+
+func TestMockBoilerInjectStatus(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	var notified bool
+	boiler.OnWrite(func(path string, value []byte) {
+		notified = true
+	})
+
+	mb.InjectStatus(3)
+	response, err := boiler.Set("boiler.temp", []byte("70"))
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if response.Status != 3 {
+		t.Errorf("Expected status 3, got %d", response.Status)
+	}
+	if notified {
+		t.Error("Expected a rejected write not to notify write handlers")
+	}
+	if writes := mb.Writes(); len(writes) != 0 {
+		t.Errorf("Expected the rejected write not to reach the controller, got %v", writes)
+	}
+
+	// only the next request is rejected
+	response, err = boiler.Set("boiler.temp", []byte("70"))
+	if err != nil || response.Status != 0 {
+		t.Fatalf("Set() = %+v, %v after the fault", response, err)
+	}
+	if !notified {
+		t.Error("Expected the accepted write to notify write handlers")
+	}
+}
+
+func TestMockBoilerInjectTruncated(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	answered := make(chan *NBEResponse, 1)
+	mb.InjectTruncated(30)
+	if _, err := boiler.GetAsync(GetSetupFunction, "boiler.temp", func(response *NBEResponse) {
+		answered <- response
+	}); err != nil {
+		t.Fatalf("GetAsync() error = %v", err)
+	}
+
+	// the client drops the broken packet and carries on with the next request
+	response, err := boiler.Get(GetOperatingDataFunction, "*")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if _, ok := response.Payload["boiler_temp"]; !ok {
+		t.Errorf("Expected operating data, got %v", response.Payload)
+	}
+	select {
+	case response := <-answered:
+		t.Errorf("Expected no response to the truncated packet, got %+v", response)
+	default:
+	}
+	if pending := boiler.Pending(); pending != 1 {
+		t.Errorf("Expected the truncated request to still be pending, got %d", pending)
+	}
+}
+
+func TestMockBoilerInjectDuplicate(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	var mu sync.Mutex
+	var calls int
+	mb.InjectDuplicate()
+	done := make(chan struct{})
+	if _, err := boiler.GetAsync(GetSetupFunction, "boiler.temp", func(*NBEResponse) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(done)
+	}); err != nil {
+		t.Fatalf("GetAsync() error = %v", err)
+	}
+	<-done
+
+	// the copy arrives before the answer to a later request
+	if _, err := boiler.Get(GetOperatingDataFunction, "*"); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("Expected the callback to run once, got %d", calls)
+	}
+}
+
+func TestMockBoilerInjectOutOfOrder(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	// the tracer sees packets in the order they arrive
+	var mu sync.Mutex
+	var arrived []int8
+	boiler.SetTracer(func(outgoing bool, local, remote net.Addr, packet []byte) {
+		var response NBEResponse
+		if outgoing || response.Unpack(bytes.NewReader(packet)) != nil {
+			return
+		}
+		mu.Lock()
+		arrived = append(arrived, response.SeqNo)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	var answered [2]*NBEResponse
+	mb.InjectOutOfOrder()
+	var seqs [2]int8
+	for i, path := range []string{"boiler.temp", "hopper.content"} {
+		i := i
+		wg.Add(1)
+		seq, err := boiler.GetAsync(GetSetupFunction, path, func(response *NBEResponse) {
+			answered[i] = response
+			wg.Done()
+		})
+		if err != nil {
+			t.Fatalf("GetAsync(%s) error = %v", path, err)
+		}
+		seqs[i] = seq
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arrived) != 2 || arrived[0] != seqs[1] || arrived[1] != seqs[0] {
+		t.Errorf("Expected sequence numbers %d then %d, got %v", seqs[1], seqs[0], arrived)
+	}
+	if _, ok := answered[0].Payload["temp"]; !ok {
+		t.Errorf("Expected boiler.temp in the held response, got %v", answered[0].Payload)
+	}
+	if _, ok := answered[1].Payload["content"]; !ok {
+		t.Errorf("Expected hopper.content in the second response, got %v", answered[1].Payload)
+	}
+}
+
+func TestMockBoilerLargeResponseAcrossDatagrams(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	for i := 0; i < 150; i++ {
+		mb.SetValue("hot_water", fmt.Sprintf("extra_%03d", i), int64(i))
+	}
+	mb.SetMaxDatagram(200)
+
+	response, err := boiler.Get(GetSetupFunction, "hot_water.*")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(response.Payload) < 150 || response.Payload["extra_149"] != int64(149) {
+		t.Errorf("Expected the whole category, got %d keys", len(response.Payload))
+	}
+}
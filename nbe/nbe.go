@@ -19,19 +19,26 @@ package nbe
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mlipscombe/boiler-mate/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func randomString(len int) (string, error) {
@@ -51,20 +58,94 @@ type NBE struct {
 	AppID        string
 	ControllerID string
 	Serial       string
-	IPAddress    string
-	SeqNo        int8
 	PinCode      string
 	RSAKey       *rsa.PublicKey // rsa key
 
 	SettingSchema map[string]SettingDefinition
 	Ready         chan bool
 
-	listener   net.PacketConn
-	queue      map[int8]func(*NBEResponse)
-	queueMutex sync.RWMutex
+	pinMutex     sync.RWMutex // protects PinCode, installerPin and RSAKey
+	installerPin string
+	lastKeyCheck atomic.Int64
+
+	listener      net.PacketConn
+	listenerMutex sync.RWMutex                // protects listener, which Reconnect replaces
+	remote        atomic.Pointer[net.UDPAddr] // the controller, resolved on connect
+	dropped       atomic.Uint64
+	requests      *sequencer
+	lastResponse  atomic.Int64
+	failures      atomic.Int64 // requests timed out since the last response
+	tracer        atomic.Pointer[Tracer]
+	recorder      atomic.Pointer[FrameRecorder]
+
+	writeMutex      sync.RWMutex
+	writeHandlers   []func(path string, value []byte)
+	attemptHandlers []func(WriteAttempt)
+
+	readOnly      atomic.Bool
+	writeGuard    atomic.Pointer[WriteGuard]
+	limiter       *rateLimiter
+	dispatcher    *dispatcher
+	inflight      map[string]*inflightGet
+	inflightMutex sync.Mutex
+
+	// partial is the start of a response cut across datagrams, received at
+	// partialAt; only the listener uses them
+	partial   []byte
+	partialAt time.Time
+
+	lastRediscovery  atomic.Int64
+	discoveryTargets func(port int) []*net.UDPAddr // broadcastTargets when nil
+	addressMutex     sync.RWMutex
+	addressHandlers  []func(ip string)
+	lookup           func(ctx context.Context, host string) ([]net.IP, error) // lookupHost when nil
+
+	batchMutex sync.Mutex // held while a batch of writes is applied
+
+	cache *readCache
 }
 
+// inflightGet is a Get request on the wire that later identical requests
+// share instead of sending their own
+type inflightGet struct {
+	seq       int8
+	sent      time.Time
+	ticket    *ticket
+	callbacks []func(*NBEResponse)
+}
+
+// requestTimeout is how long a request waits for the controller to answer
+const requestTimeout = 3 * time.Second
+
+// maxDatagram is the largest UDP datagram the controller can send
+const maxDatagram = 65535
+
+// partialTimeout is how long the start of a response cut across datagrams
+// waits for the rest
+const partialTimeout = 2 * time.Second
+
+// Default rate limit for requests sent to the controller
+const (
+	DefaultRateLimit = 5.0
+	DefaultBurst     = 10
+)
+
+// Tracer receives every packet exchanged with the controller, as sent on the wire
+type Tracer func(outgoing bool, local, remote net.Addr, packet []byte)
+
+// FrameRecorder receives every frame exchanged with the controller in plain
+// text: requests before encryption, with the password masked, and responses
+// once reassembled from their datagrams
+type FrameRecorder func(outgoing bool, frame []byte)
+
 func NewNBE(uri *url.URL) (*NBE, error) {
+	return NewNBEWithKey(uri, nil)
+}
+
+// NewNBEWithKey connects like NewNBE, starting from a public key saved on a
+// previous run. The key from the discovery answer replaces it; the saved key
+// spares fetching it for controllers that don't announce theirs.
+func NewNBEWithKey(uri *url.URL, key *rsa.PublicKey) (*NBE, error) {
 	appID, err := randomString(12)
 	if err != nil {
 		return nil, err
@@ -73,42 +154,99 @@ func NewNBE(uri *url.URL) (*NBE, error) {
 	if err != nil {
 		return nil, err
 	}
+	if uri.Hostname() == APModeHost {
+		if uri, err = resolveAPMode(uri); err != nil {
+			return nil, err
+		}
+	}
 	password, _ := uri.User.Password()
+	limiter := newRateLimiter(DefaultRateLimit, DefaultBurst)
 	nbe := NBE{
 		URI:          uri,
 		AppID:        appID,
 		ControllerID: controllerID,
 		Serial:       uri.User.Username(),
-		IPAddress:    uri.Hostname(),
 		PinCode:      password,
-		SeqNo:        0,
+		RSAKey:       key,
 		Ready:        make(chan bool),
-		queue:        make(map[int8]func(*NBEResponse)),
-		queueMutex:   sync.RWMutex{},
+		requests:     newSequencer(requestTimeout),
+		limiter:      limiter,
+		dispatcher:   newDispatcher(limiter),
+		inflight:     make(map[string]*inflightGet),
+		cache:        newReadCache(),
 	}
+	nbe.SettingSchema = DefaultSettingSchema()
 	err = nbe.connect()
 	return &nbe, err
 }
 
-func (nbe *NBE) listen() chan error {
-	// doneChan := make(chan error, 1)
-	defer nbe.listener.Close()
+// listen reads responses from listener until it is closed, dropping
+// packets that don't come from the controller
+func (nbe *NBE) listen(listener net.PacketConn) {
+	defer listener.Close()
 
+	buffer := make([]byte, maxDatagram)
 	for {
-		buffer := make([]byte, 1024)
-
-		_, addr, err := nbe.listener.ReadFrom(buffer)
-		if addr.String() != nbe.URI.Host {
-			// ignore packets from other hosts
-			continue
-		}
+		n, addr, err := listener.ReadFrom(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Errorln(err)
+			continue
+		}
+		if remote := nbe.remoteAddr(); !sameAddr(addr, remote) {
+			nbe.dropped.Add(1)
+			log.Debugf("dropping %d bytes from %s: not the controller at %s", n, addr, remote)
+			continue
 		}
-		go nbe.handle(buffer)
+		nbe.trace(false, addr, buffer[:n])
+		if packet, ok := nbe.assemble(append([]byte(nil), buffer[:n]...), time.Now()); ok {
+			nbe.record(false, packet)
+			go nbe.handle(packet)
+		}
+	}
+}
+
+// assemble returns the packet to handle for a datagram received at now,
+// joining a response cut across datagrams. It returns false while the
+// response is incomplete; a datagram starting a new frame, or arriving
+// after partialTimeout, drops the incomplete response.
+func (nbe *NBE) assemble(datagram []byte, now time.Time) ([]byte, bool) {
+	packet := datagram
+	if partial := nbe.partial; partial != nil {
+		header := partial[:min(len(partial), AppIDSize+ControllerIDSize+1)]
+		if now.Sub(nbe.partialAt) < partialTimeout && !bytes.HasPrefix(datagram, header) {
+			packet = append(partial, datagram...)
+		} else {
+			log.Debugf("dropping an incomplete response of %d bytes", len(partial))
+		}
+		nbe.partial = nil
 	}
 
-	// return doneChan
+	// only the start of a frame is worth waiting for
+	marker := AppIDSize + ControllerIDSize
+	if len(packet) <= marker || packet[marker] != StartMarker || len(packet) >= maxDatagram {
+		return packet, true
+	}
+	var response NBEResponse
+	if err := response.Unpack(bytes.NewReader(packet)); errors.Is(err, io.ErrUnexpectedEOF) {
+		nbe.partial, nbe.partialAt = packet, now
+		return nil, false
+	}
+	return packet, true
+}
+
+// sameAddr reports whether addr is the IP and port of remote
+func sameAddr(addr net.Addr, remote *net.UDPAddr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	return ok && udp.Port == remote.Port && udp.IP.Equal(remote.IP)
+}
+
+// Dropped returns the number of packets ignored because they came from
+// another host or were not answers to this client
+func (nbe *NBE) Dropped() uint64 {
+	return nbe.dropped.Load()
 }
 
 func (nbe *NBE) handle(buffer []byte) {
@@ -120,7 +258,15 @@ func (nbe *NBE) handle(buffer []byte) {
 		return
 	}
 
+	if response.AppID != nbe.AppID {
+		nbe.dropped.Add(1)
+		log.Debugf("dropping response %d to function %d: sent to app %q", response.SeqNo, response.Function, response.AppID)
+		return
+	}
+
 	log.Debugf("recv %d %d %s", response.SeqNo, response.Function, response.Payload)
+	nbe.lastResponse.Store(time.Now().UnixNano())
+	nbe.failures.Store(0)
 
 	if response.SeqNo == -1 {
 		// Probably an error packet, log the payload.
@@ -128,28 +274,77 @@ func (nbe *NBE) handle(buffer []byte) {
 		return
 	}
 
-	nbe.queueMutex.RLock()
-	if val, ok := nbe.queue[response.SeqNo]; ok {
-		nbe.queueMutex.RUnlock()
-		val(&response)
-		nbe.queueMutex.Lock()
-		delete(nbe.queue, response.SeqNo)
-		nbe.queueMutex.Unlock()
-	} else {
-		nbe.queueMutex.RUnlock()
-		log.Infof("sequence %d has no callback", response.SeqNo)
+	// the request is taken before its callback runs, so a duplicate
+	// response finds nothing to answer
+	request, ok := nbe.requests.take(&response)
+	if !ok {
+		log.Debugf("dropping response %d to function %d: no request waiting for it", response.SeqNo, response.Function)
+		return
+	}
+	request.callback(&response)
+}
+
+// LastResponse returns when the controller last answered a request, or the
+// zero time if it never has
+func (nbe *NBE) LastResponse() time.Time {
+	last := nbe.lastResponse.Load()
+	if last == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, last)
+}
+
+// Failures returns the number of requests that timed out since the
+// controller last answered
+func (nbe *NBE) Failures() int64 {
+	return nbe.failures.Load()
 }
 
+// connect binds the socket every request is sent and answered on, and finds
+// the controller's serial and RSA key
 func (nbe *NBE) connect() error {
+	remote, err := nbe.resolveHost(nil)
+	if err != nil {
+		return err
+	}
+	nbe.remote.Store(remote)
+	if nbe.isHostName() {
+		go nbe.watchHost(remote)
+	}
+	if err := nbe.bind(); err != nil {
+		return err
+	}
+	return nbe.handshake()
+}
+
+// bind opens a new socket for the requests and their responses, closing the
+// previous one
+func (nbe *NBE) bind() error {
 	listener, err := net.ListenPacket("udp4", "0.0.0.0:0")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	nbe.listenerMutex.Lock()
+	previous := nbe.listener
 	nbe.listener = listener
+	nbe.listenerMutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	go nbe.listen(listener)
+	return nil
+}
 
-	go nbe.listen()
+func (nbe *NBE) socket() net.PacketConn {
+	nbe.listenerMutex.RLock()
+	defer nbe.listenerMutex.RUnlock()
+	return nbe.listener
+}
 
+// handshake sends the discovery request, taking the controller's serial and
+// RSA key from its answer
+func (nbe *NBE) handshake() error {
 	request := NBERequest{
 		AppID:        nbe.AppID,
 		ControllerID: nbe.ControllerID,
@@ -162,54 +357,196 @@ func (nbe *NBE) connect() error {
 		return err
 	}
 	nbe.Serial = fmt.Sprintf("%v", response.Payload["serial"])
-	pub, err := nbe.getRSAKey()
+	pub, err := nbe.discoverKey(response)
 	if err != nil {
 		return err
 	}
+	nbe.pinMutex.Lock()
 	nbe.RSAKey = pub
+	nbe.pinMutex.Unlock()
+	log.Debugf("Controller public key %s", KeyFingerprint(pub))
 
 	return nil
 }
 
+// SendAsync sends request once it reaches the front of the queue; writes are
+// sent ahead of reads
 func (nbe *NBE) SendAsync(request *NBERequest, cb func(*NBEResponse)) (int8, error) {
+	priority := PriorityRead
+	if request.Function == SetSetupFunction {
+		priority = PriorityWrite
+	}
+	return nbe.send(context.Background(), request, nbe.dispatcher.enqueue(priority), cb)
+}
+
+// send transmits request once t is released, tracing it as a child of any
+// span in ctx until the response arrives or the request times out
+func (nbe *NBE) send(ctx context.Context, request *NBERequest, t *ticket, cb func(*NBEResponse)) (int8, error) {
 	var err error
 
-	nbe.queueMutex.Lock()
-	nbe.SeqNo++
-	if nbe.SeqNo > 99 {
-		nbe.SeqNo = 0
+	if request.Function == SetSetupFunction {
+		if err := nbe.guardWrite(request.Payload); err != nil {
+			nbe.dispatcher.cancel(t)
+			nbe.notifyAttempt(ctx, request.Payload, err)
+			return 0, err
+		}
+	}
+
+	// a password is only ever sent encrypted
+	if request.PinCode != "" && request.RSAKey == nil {
+		request.RSAKey = nbe.PublicKey()
+		if request.RSAKey == nil {
+			nbe.dispatcher.cancel(t)
+			if request.Function == SetSetupFunction {
+				nbe.notifyAttempt(ctx, request.Payload, ErrNoPublicKey)
+			}
+			return 0, ErrNoPublicKey
+		}
+	}
+
+	_, span := tracing.Start(ctx, "nbe "+functionName(request.Function),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int("nbe.function", int(request.Function)),
+			attribute.Int("nbe.priority", int(t.priority)),
+		))
+	var once sync.Once
+	finish := func(err error) {
+		once.Do(func() {
+			tracing.End(span, err)
+			if request.Function == SetSetupFunction {
+				nbe.notifyAttempt(ctx, request.Payload, err)
+			}
+		})
+	}
+
+	var timeout atomic.Pointer[time.Timer]
+	pending := &outstanding{function: request.Function}
+	pending.callback = func(response *NBEResponse) {
+		if timer := timeout.Load(); timer != nil {
+			timer.Stop()
+		}
+		span.SetAttributes(attribute.Int("nbe.status", int(response.Status)))
+		var err error
+		if request.Function == SetSetupFunction {
+			path, _, _ := strings.Cut(string(request.Payload), "=")
+			err = StatusErr(path, response)
+		} else if response.Status != 0 {
+			err = fmt.Errorf("controller returned status %d", response.Status)
+		}
+		finish(err)
+		cb(response)
 	}
-	request.SeqNo = nbe.SeqNo
-	nbe.queueMutex.Unlock()
 
-	addr, err := net.ResolveUDPAddr("udp4", nbe.URI.Host)
+	// the sequence number is only taken once the request is sent, so
+	// requests waiting in the queue don't use them up
+	<-t.ready
+	request.SeqNo, err = nbe.requests.allocate(pending)
 	if err != nil {
-		return request.SeqNo, err
+		finish(err)
+		return 0, err
 	}
+	span.SetAttributes(attribute.Int("nbe.seq", int(request.SeqNo)))
+
 	packet := new(bytes.Buffer)
-	err = request.Pack(packet)
-	if err != nil {
+	if err = request.Pack(packet); err != nil {
+		nbe.requests.release(request.SeqNo, pending)
+		finish(err)
 		return request.SeqNo, err
 	}
 
-	nbe.queueMutex.Lock()
-	nbe.queue[request.SeqNo] = cb
-	nbe.queueMutex.Unlock()
-
+	span.AddEvent("sent")
+	seq := request.SeqNo
+	timeout.Store(time.AfterFunc(requestTimeout, func() {
+		if nbe.requests.expire(seq, pending) {
+			nbe.failures.Add(1)
+			finish(errors.New("timeout waiting for request"))
+			if request.RSAKey != nil {
+				go nbe.checkKey()
+			}
+			if nbe.shouldRediscover(time.Now()) {
+				go nbe.rediscover()
+			}
+		}
+	}))
 	log.Debugf("send %d %d %s", request.SeqNo, request.Function, request.Payload)
 
-	_, err = nbe.listener.WriteTo(packet.Bytes(), addr)
+	remote := nbe.remoteAddr()
+	nbe.trace(true, remote, packet.Bytes())
+	if nbe.recorder.Load() != nil {
+		nbe.record(true, plainFrame(request))
+	}
+	_, err = nbe.socket().WriteTo(packet.Bytes(), remote)
 	if err != nil {
-		nbe.queueMutex.Lock()
-		delete(nbe.queue, request.SeqNo)
-		nbe.queueMutex.Unlock()
-
+		timeout.Load().Stop()
+		nbe.requests.release(request.SeqNo, pending)
+		finish(err)
 		return request.SeqNo, err
 	}
 
 	return request.SeqNo, nil
 }
 
+// SetTracer installs a tracer for all controller traffic; nil removes it
+func (nbe *NBE) SetTracer(tracer Tracer) {
+	if tracer == nil {
+		nbe.tracer.Store(nil)
+		return
+	}
+	nbe.tracer.Store(&tracer)
+}
+
+func (nbe *NBE) trace(outgoing bool, remote net.Addr, packet []byte) {
+	if tracer := nbe.tracer.Load(); tracer != nil {
+		(*tracer)(outgoing, nbe.socket().LocalAddr(), remote, packet)
+	}
+}
+
+// SetFrameRecorder installs a recorder for all controller frames; nil
+// removes it
+func (nbe *NBE) SetFrameRecorder(recorder FrameRecorder) {
+	if recorder == nil {
+		nbe.recorder.Store(nil)
+		return
+	}
+	nbe.recorder.Store(&recorder)
+}
+
+func (nbe *NBE) record(outgoing bool, frame []byte) {
+	if recorder := nbe.recorder.Load(); recorder != nil {
+		(*recorder)(outgoing, frame)
+	}
+}
+
+// plainFrame packs a sent request again without encryption and with the
+// password masked. An encrypted request keeps its "*" marker.
+func plainFrame(request *NBERequest) []byte {
+	plain := *request
+	plain.RSAKey = nil
+	if plain.PinCode != "" {
+		plain.PinCode = strings.Repeat("*", PinCodeSize)
+	}
+	buf := new(bytes.Buffer)
+	if err := plain.Pack(buf); err != nil {
+		return nil
+	}
+	frame := buf.Bytes()
+	if request.RSAKey != nil {
+		frame[AppIDSize+ControllerIDSize] = '*'
+	}
+	return frame
+}
+
+// Pending returns the number of requests still waiting for a response
+func (nbe *NBE) Pending() int {
+	return nbe.requests.pending()
+}
+
+// Queued returns the number of requests waiting for their turn to be sent
+func (nbe *NBE) Queued() int {
+	return nbe.dispatcher.queued()
+}
+
 func (nbe *NBE) Send(request *NBERequest) (*NBEResponse, error) {
 	responseChan := make(chan *NBEResponse, 1)
 
@@ -224,69 +561,282 @@ func (nbe *NBE) Send(request *NBERequest) (*NBEResponse, error) {
 	select {
 	case response := <-responseChan:
 		return response, nil
-	case <-time.After(time.Duration(3) * time.Second):
+	case <-time.After(requestTimeout):
 		return nil, errors.New("timeout waiting for request")
 	}
 }
 
+// SetReadOnly rejects every write with ErrReadOnly while readOnly is set
+func (nbe *NBE) SetReadOnly(readOnly bool) {
+	nbe.readOnly.Store(readOnly)
+}
+
+// WriteGuard decides whether a write may be sent to the controller
+type WriteGuard func(path string, value []byte) error
+
+// SetWriteGuard makes every write pass guard before it is sent; a write the
+// guard returns an error for is rejected with that error. nil removes it.
+func (nbe *NBE) SetWriteGuard(guard WriteGuard) {
+	if guard == nil {
+		nbe.writeGuard.Store(nil)
+		return
+	}
+	nbe.writeGuard.Store(&guard)
+}
+
+// guardWrite checks a "path=value" write payload against read-only mode and
+// the write guard
+func (nbe *NBE) guardWrite(payload []byte) error {
+	if nbe.readOnly.Load() {
+		return ErrReadOnly
+	}
+	guard := nbe.writeGuard.Load()
+	if guard == nil {
+		return nil
+	}
+	path, value, _ := strings.Cut(string(payload), "=")
+	return (*guard)(path, []byte(value))
+}
+
+// SetRateLimit limits the requests sent to the controller to rate per second,
+// allowing bursts of up to burst requests; a zero rate removes the limit
+func (nbe *NBE) SetRateLimit(rate float64, burst int) {
+	nbe.limiter.set(rate, burst)
+}
+
+// GetAsync reads path on demand, calling cb with the response. While an
+// identical request is waiting for its response, the call joins it instead
+// of sending another, and within the cache TTL it is answered from the cache.
 func (nbe *NBE) GetAsync(function Function, path string, cb func(*NBEResponse)) (int8, error) {
+	return nbe.GetAsyncWithPriority(PriorityRead, function, path, cb)
+}
+
+// GetAsyncWithPriority is GetAsync queued at priority. Joining a request that
+// has not been sent yet raises it to the higher of the two priorities.
+func (nbe *NBE) GetAsyncWithPriority(priority Priority, function Function, path string, cb func(*NBEResponse)) (int8, error) {
+	key := fmt.Sprintf("%d:%s", function, path)
+	cached, generation, ok := nbe.cache.get(key, time.Now())
+	if ok {
+		go cb(cached.response)
+		return cached.seq, nil
+	}
+
+	nbe.inflightMutex.Lock()
+	if pending, ok := nbe.inflight[key]; ok && time.Since(pending.sent) < requestTimeout {
+		pending.callbacks = append(pending.callbacks, cb)
+		nbe.dispatcher.promote(pending.ticket, priority)
+		nbe.inflightMutex.Unlock()
+		return pending.seq, nil
+	}
+	pending := &inflightGet{
+		sent:      time.Now(),
+		ticket:    nbe.dispatcher.enqueue(priority),
+		callbacks: []func(*NBEResponse){cb},
+	}
+	nbe.inflight[key] = pending
+	nbe.inflightMutex.Unlock()
+
 	request := NBERequest{
 		AppID:        nbe.AppID,
 		ControllerID: nbe.ControllerID,
 		Function:     function,
 		Payload:      []byte(path),
 	}
-	seq, err := nbe.SendAsync(&request, cb)
+	seq, err := nbe.send(context.Background(), &request, pending.ticket, func(response *NBEResponse) {
+		nbe.inflightMutex.Lock()
+		if nbe.inflight[key] == pending {
+			delete(nbe.inflight, key)
+		}
+		callbacks := pending.callbacks
+		seq := pending.seq
+		nbe.inflightMutex.Unlock()
+		nbe.cache.put(key, cacheCategory(function, path), generation, seq, response, time.Now())
+
+		// callers may modify the payload, so each gets its own copy
+		responses := []*NBEResponse{response}
+		for range callbacks[1:] {
+			responses = append(responses, response.clone())
+		}
+		for i, callback := range callbacks {
+			callback(responses[i])
+		}
+	})
+
+	nbe.inflightMutex.Lock()
+	pending.seq = seq
+	if err != nil && nbe.inflight[key] == pending {
+		delete(nbe.inflight, key)
+	}
+	nbe.inflightMutex.Unlock()
 
 	return seq, err
 }
 
+// Get reads path on demand and waits for the response
 func (nbe *NBE) Get(function Function, path string) (*NBEResponse, error) {
-	request := NBERequest{
-		AppID:        nbe.AppID,
-		ControllerID: nbe.ControllerID,
-		Function:     function,
-		Payload:      []byte(path),
+	return nbe.GetWithPriority(PriorityRead, function, path)
+}
+
+// GetWithPriority is Get queued at priority
+func (nbe *NBE) GetWithPriority(priority Priority, function Function, path string) (*NBEResponse, error) {
+	responseChan := make(chan *NBEResponse, 1)
+
+	_, err := nbe.GetAsyncWithPriority(priority, function, path, func(response *NBEResponse) {
+		responseChan <- response
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nbe.Send(&request)
+	select {
+	case response := <-responseChan:
+		return response, nil
+	case <-time.After(requestTimeout):
+		return nil, errors.New("timeout waiting for request")
+	}
 }
 
 func (nbe *NBE) SetAsync(path string, value []byte, cb func(*NBEResponse)) (int8, error) {
-	payload := new(bytes.Buffer)
-	payload.Write([]byte(path))
-	payload.Write([]byte("="))
-	payload.Write(value)
+	return nbe.SetAsyncContext(context.Background(), path, value, cb)
+}
 
-	request := NBERequest{
-		AppID:        nbe.AppID,
-		ControllerID: nbe.ControllerID,
-		Function:     SetSetupFunction,
-		RSAKey:       nbe.RSAKey,
-		PinCode:      nbe.PinCode,
-		Payload:      payload.Bytes(),
+// SetAsyncContext is SetAsync traced as part of the span in ctx. A write the
+// controller denies for the user password is sent once more with the
+// installer password, if one is set
+func (nbe *NBE) SetAsyncContext(ctx context.Context, path string, value []byte, cb func(*NBEResponse)) (int8, error) {
+	user, installer := nbe.passwords()
+	done := func(response *NBEResponse) {
+		nbe.cache.invalidate()
+		nbe.notifyWrite(path, value, response)
+		cb(response)
 	}
-	seq, err := nbe.SendAsync(&request, cb)
 
-	return seq, err
+	return nbe.send(ctx, nbe.setRequest(path, value, user), nbe.dispatcher.enqueue(PriorityWrite), func(response *NBEResponse) {
+		if response.Status != StatusDenied || installer == "" || installer == user {
+			done(response)
+			return
+		}
+		log.Infof("Controller denied the write to %s, retrying with the installer password", path)
+		// send waits for its turn in the queue, which must not hold up the
+		// listener delivering this response
+		go func() {
+			if _, err := nbe.send(ctx, nbe.setRequest(path, value, installer), nbe.dispatcher.enqueue(PriorityWrite), done); err != nil {
+				log.Warnf("Failed to retry the write to %s: %v", path, err)
+				done(response)
+			}
+		}()
+	})
 }
 
 func (nbe *NBE) Set(path string, value []byte) (*NBEResponse, error) {
+	return nbe.SetContext(context.Background(), path, value)
+}
+
+// SetContext is Set traced as part of the span in ctx, and audited with the
+// source in ctx
+func (nbe *NBE) SetContext(ctx context.Context, path string, value []byte) (*NBEResponse, error) {
+	responseChan := make(chan *NBEResponse, 1)
+
+	_, err := nbe.SetAsyncContext(ctx, path, value, func(response *NBEResponse) {
+		responseChan <- response
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responseChan:
+		return response, nil
+	case <-time.After(requestTimeout):
+		return nil, errors.New("timeout waiting for request")
+	}
+}
+
+func (nbe *NBE) setRequest(path string, value []byte, pin string) *NBERequest {
 	payload := new(bytes.Buffer)
 	payload.Write([]byte(path))
 	payload.Write([]byte("="))
 	payload.Write(value)
 
-	request := NBERequest{
+	return &NBERequest{
 		AppID:        nbe.AppID,
 		ControllerID: nbe.ControllerID,
 		Function:     SetSetupFunction,
-		RSAKey:       nbe.RSAKey,
-		PinCode:      nbe.PinCode,
+		RSAKey:       nbe.PublicKey(),
+		PinCode:      pin,
 		Payload:      payload.Bytes(),
 	}
+}
+
+// SetPasswords replaces the user password writes are sent with, and the
+// installer password they are retried with when the controller denies them
+func (nbe *NBE) SetPasswords(user, installer string) {
+	nbe.pinMutex.Lock()
+	defer nbe.pinMutex.Unlock()
+	nbe.PinCode = user
+	nbe.installerPin = installer
+}
+
+func (nbe *NBE) passwords() (user, installer string) {
+	nbe.pinMutex.RLock()
+	defer nbe.pinMutex.RUnlock()
+	return nbe.PinCode, nbe.installerPin
+}
+
+// OnWrite registers a handler called after the controller accepts a write
+func (nbe *NBE) OnWrite(handler func(path string, value []byte)) {
+	nbe.writeMutex.Lock()
+	defer nbe.writeMutex.Unlock()
+	nbe.writeHandlers = append(nbe.writeHandlers, handler)
+}
+
+func (nbe *NBE) notifyWrite(path string, value []byte, response *NBEResponse) {
+	if response.Status != StatusOK {
+		return
+	}
+	nbe.writeMutex.RLock()
+	defer nbe.writeMutex.RUnlock()
+	for _, handler := range nbe.writeHandlers {
+		handler(path, value)
+	}
+}
+
+// WriteAttempt is the outcome of one write sent to the controller, or refused
+// before it was sent
+type WriteAttempt struct {
+	Source string // the source in the context the write was made with
+	Path   string
+	Value  []byte
+	Err    error // nil when the controller accepted the write
+}
+
+// OnWriteAttempt registers a handler called with the outcome of every write:
+// accepted, denied by the controller, refused by the write guard or read-only
+// mode, failed to send or left unanswered. A write the controller denies is
+// retried with the installer password as a second attempt.
+func (nbe *NBE) OnWriteAttempt(handler func(WriteAttempt)) {
+	nbe.writeMutex.Lock()
+	defer nbe.writeMutex.Unlock()
+	nbe.attemptHandlers = append(nbe.attemptHandlers, handler)
+}
+
+func (nbe *NBE) notifyAttempt(ctx context.Context, payload []byte, err error) {
+	path, value, _ := strings.Cut(string(payload), "=")
+	attempt := WriteAttempt{Source: Source(ctx), Path: path, Value: []byte(value), Err: err}
+	nbe.writeMutex.RLock()
+	defer nbe.writeMutex.RUnlock()
+	for _, handler := range nbe.attemptHandlers {
+		handler(attempt)
+	}
+}
 
-	return nbe.Send(&request)
+// ValidateSetting checks a write against the setting schema
+func (nbe *NBE) ValidateSetting(path string, value []byte) error {
+	setting, ok := nbe.SettingSchema[path]
+	if !ok {
+		return fmt.Errorf("%s: %w", path, ErrUnknownSetting)
+	}
+	return setting.Validate(value)
 }
 
 func (nbe *NBE) getRSAKey() (*rsa.PublicKey, error) {
@@ -315,5 +865,9 @@ func rsaKeyFromBase64(key string) (*rsa.PublicKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	return pub.(*rsa.PublicKey), nil
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return rsaKey, nil
 }
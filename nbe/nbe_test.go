@@ -0,0 +1,322 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestNBE returns a client whose requests go to a local socket that never
+// answers; the socket is returned to count the requests sent
+func newTestNBE(t *testing.T) (*NBE, net.PacketConn) {
+	controller, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		controller.Close()
+		listener.Close()
+	})
+
+	limiter := newRateLimiter(0, 1)
+	boiler := &NBE{
+		URI:          &url.URL{Host: controller.LocalAddr().String()},
+		AppID:        "APPID0000000",
+		ControllerID: "CTRL00",
+		listener:     listener,
+		requests:     newSequencer(requestTimeout),
+		limiter:      limiter,
+		dispatcher:   newDispatcher(limiter),
+		inflight:     make(map[string]*inflightGet),
+	}
+	boiler.remote.Store(controller.LocalAddr().(*net.UDPAddr))
+	return boiler, controller
+}
+
+func TestGetAsyncCoalescesIdenticalRequests(t *testing.T) {
+	boiler, controller := newTestNBE(t)
+
+	var mu sync.Mutex
+	var sent int
+	boiler.SetTracer(func(outgoing bool, local, remote net.Addr, packet []byte) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+	})
+
+	responses := make(chan *NBEResponse, 3)
+	var seq int8
+	for i := 0; i < 3; i++ {
+		s, err := boiler.GetAsync(GetOperatingDataFunction, "*", func(response *NBEResponse) {
+			responses <- response
+		})
+		if err != nil {
+			t.Fatalf("GetAsync() error = %v", err)
+		}
+		seq = s
+	}
+	if _, err := boiler.GetAsync(GetSetupFunction, "boiler.*", func(*NBEResponse) {}); err != nil {
+		t.Fatalf("GetAsync() error = %v", err)
+	}
+
+	mu.Lock()
+	if sent != 2 {
+		t.Errorf("Expected 2 requests on the wire, got %d", sent)
+	}
+	mu.Unlock()
+	controller.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := controller.ReadFrom(make([]byte, 1024)); err != nil {
+		t.Fatalf("Controller received nothing: %v", err)
+	}
+
+	// answer the shared request
+	response := &NBEResponse{SeqNo: seq, Function: GetOperatingDataFunction, Payload: map[string]interface{}{"boiler_temp": RoundedFloat(65)}}
+	request, ok := boiler.requests.take(response)
+	if !ok {
+		t.Fatalf("No request waiting for sequence %d", seq)
+	}
+	request.callback(response)
+
+	var got []*NBEResponse
+	for i := 0; i < 3; i++ {
+		select {
+		case response := <-responses:
+			got = append(got, response)
+		case <-time.After(time.Second):
+			t.Fatalf("Only %d of 3 callers got a response", i)
+		}
+	}
+	got[0].Payload["boiler_temp"] = RoundedFloat(0)
+	if got[1].Payload["boiler_temp"] != RoundedFloat(65) {
+		t.Error("Expected each caller to get its own payload")
+	}
+
+	// once answered, the next request goes to the controller again
+	if _, err := boiler.GetAsync(GetOperatingDataFunction, "*", func(*NBEResponse) {}); err != nil {
+		t.Fatalf("GetAsync() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 3 {
+		t.Errorf("Expected a new request after the response, got %d on the wire", sent)
+	}
+}
+
+func TestListenDropsForeignPackets(t *testing.T) {
+	boiler, controller := newTestNBE(t)
+	go boiler.listen(boiler.listener)
+
+	responses := make(chan *NBEResponse, 1)
+	seq, err := boiler.GetAsync(GetSetupFunction, "boiler.temp", func(response *NBEResponse) {
+		responses <- response
+	})
+	if err != nil {
+		t.Fatalf("GetAsync() error = %v", err)
+	}
+	controller.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := controller.ReadFrom(make([]byte, 1024)); err != nil {
+		t.Fatalf("Controller received nothing: %v", err)
+	}
+
+	foreign, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+	reply := func(conn net.PacketConn, appID string, temp float64) {
+		response := &NBEResponse{AppID: appID, ControllerID: boiler.ControllerID, Function: GetSetupFunction, SeqNo: seq, Payload: map[string]interface{}{"temp": RoundedFloat(temp)}}
+		packet := new(bytes.Buffer)
+		if err := response.Pack(packet); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(packet.Bytes(), boiler.listener.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply(foreign, boiler.AppID, 99)
+	reply(controller, "OTHERAPP0000", 98)
+	reply(controller, boiler.AppID, 65)
+
+	select {
+	case response := <-responses:
+		if fmt.Sprint(response.Payload["temp"]) != "65" {
+			t.Errorf("Expected the controller's answer, got %v", response.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No response delivered")
+	}
+	// packets are handled concurrently, so the last may overtake the others
+	deadline := time.Now().Add(time.Second)
+	for boiler.Dropped() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := boiler.Dropped(); dropped != 2 {
+		t.Errorf("Expected 2 dropped packets, got %d", dropped)
+	}
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	boiler, _ := newTestNBE(t)
+
+	var mu sync.Mutex
+	var sent int
+	boiler.SetTracer(func(outgoing bool, local, remote net.Addr, packet []byte) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+	})
+
+	boiler.SetReadOnly(true)
+	if _, err := boiler.SetAsync("boiler.temp", []byte("65"), func(*NBEResponse) {}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetAsync() error = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err := boiler.GetAsync(GetSetupFunction, "boiler.temp", func(*NBEResponse) {}); err != nil {
+		t.Errorf("GetAsync() error = %v", err)
+	}
+	if queued := boiler.Queued(); queued != 0 {
+		t.Errorf("Expected an empty queue, got %d", queued)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 1 {
+		t.Errorf("Expected only the read on the wire, got %d requests", sent)
+	}
+}
+
+func TestFrameRecorderMasksEncryptedRequests(t *testing.T) {
+	boiler, controller := newTestNBE(t)
+	boiler.PinCode = "1234567890"
+	boiler.RSAKey = &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 520), E: 65537}
+
+	var mu sync.Mutex
+	var frames [][]byte
+	boiler.SetFrameRecorder(func(outgoing bool, frame []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if outgoing {
+			frames = append(frames, frame)
+		}
+	})
+
+	if _, err := boiler.SetAsync("boiler.temp", []byte("65"), func(*NBEResponse) {}); err != nil {
+		t.Fatalf("SetAsync() error = %v", err)
+	}
+	controller.SetReadDeadline(time.Now().Add(time.Second))
+	wire := make([]byte, 1024)
+	n, _, err := controller.ReadFrom(wire)
+	if err != nil {
+		t.Fatalf("Controller received nothing: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(frames) != 1 {
+		t.Fatalf("Expected 1 recorded request, got %d", len(frames))
+	}
+	if bytes.Contains(wire[:n], []byte("boiler.temp")) {
+		t.Error("Expected the request on the wire to be encrypted")
+	}
+	var request NBERequest
+	if err := request.Unpack(bytes.NewReader(frames[0])); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+	if string(request.Payload) != "boiler.temp=65" || request.PinCode != "**********" {
+		t.Errorf("Unexpected recorded request %q with password %q", request.Payload, request.PinCode)
+	}
+	if frames[0][AppIDSize+ControllerIDSize] != '*' {
+		t.Error("Expected the recorded request to keep its encryption marker")
+	}
+}
+
+func TestWriteGuard(t *testing.T) {
+	boiler, _ := newTestNBE(t)
+
+	var mu sync.Mutex
+	var sent int
+	boiler.SetTracer(func(outgoing bool, local, remote net.Addr, packet []byte) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+	})
+
+	errRejected := errors.New("rejected")
+	var guarded []string
+	boiler.SetWriteGuard(func(path string, value []byte) error {
+		guarded = append(guarded, path+"="+string(value))
+		if path == "boiler.temp" {
+			return errRejected
+		}
+		return nil
+	})
+
+	if _, err := boiler.SetAsync("boiler.temp", []byte("65"), func(*NBEResponse) {}); !errors.Is(err, errRejected) {
+		t.Errorf("SetAsync() error = %v, want %v", err, errRejected)
+	}
+	if _, err := boiler.SetAsync("hot_water.temp", []byte("55"), func(*NBEResponse) {}); err != nil {
+		t.Errorf("SetAsync() error = %v", err)
+	}
+	if len(guarded) != 2 || guarded[0] != "boiler.temp=65" || guarded[1] != "hot_water.temp=55" {
+		t.Errorf("Unexpected guarded writes %v", guarded)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 1 {
+		t.Errorf("Expected only the allowed write on the wire, got %d requests", sent)
+	}
+}
+
+func TestAssembleResponseAcrossDatagrams(t *testing.T) {
+	nbe, _ := newTestNBE(t)
+	var packet bytes.Buffer
+	(&NBEResponse{AppID: nbe.AppID, ControllerID: nbe.ControllerID, Function: GetSetupFunction, SeqNo: 3, Payload: map[string]interface{}{"temp": int64(70)}}).Pack(&packet)
+	data := packet.Bytes()
+	now := time.Now()
+
+	if _, ok := nbe.assemble(data[:20], now); ok {
+		t.Fatal("Expected the start of a response to wait for the rest")
+	}
+	if assembled, ok := nbe.assemble(data[20:], now); !ok || !bytes.Equal(assembled, data) {
+		t.Errorf("Expected the datagrams joined, got %q", assembled)
+	}
+
+	nbe.assemble(data[:20], now)
+	if assembled, ok := nbe.assemble(data, now); !ok || !bytes.Equal(assembled, data) {
+		t.Errorf("Expected a new response to replace the incomplete one, got %q", assembled)
+	}
+
+	nbe.assemble(data[:20], now)
+	if _, ok := nbe.assemble(data[20:], now.Add(partialTimeout)); !ok || nbe.partial != nil {
+		t.Error("Expected a late continuation to drop the incomplete response")
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+// OutputsField is the advanced data value holding the controller's relay bitmask
+const OutputsField = "outputs"
+
+// OutputDefinition describes one relay output in the controller's bitmask
+type OutputDefinition struct {
+	Name        string
+	Description string
+	Bit         uint
+	DeviceClass string
+}
+
+// Outputs describes the relay outputs reported by V7 and V13 controllers
+var Outputs = []OutputDefinition{
+	{Name: "exhaust_fan", Description: "Exhaust fan", Bit: 0, DeviceClass: "running"},
+	{Name: "auger", Description: "Auger", Bit: 1, DeviceClass: "running"},
+	{Name: "ignition", Description: "Ignition element", Bit: 2, DeviceClass: "heat"},
+	{Name: "circulation_pump", Description: "Circulation pump", Bit: 3, DeviceClass: "running"},
+	{Name: "dhw_pump", Description: "Hot water pump", Bit: 4, DeviceClass: "running"},
+}
+
+// Key returns the advanced data key the output's state is published under
+func (output OutputDefinition) Key() string {
+	return "output_" + output.Name
+}
+
+// ExpandOutputs adds an ON/OFF value for every known output to payload when it
+// carries the relay bitmask. Payloads without a numeric bitmask are unchanged.
+func ExpandOutputs(payload map[string]interface{}) {
+	var mask int64
+	switch v := payload[OutputsField].(type) {
+	case int64:
+		mask = v
+	case RoundedFloat:
+		mask = int64(v)
+	default:
+		return
+	}
+
+	for _, output := range Outputs {
+		if mask&(1<<output.Bit) != 0 {
+			payload[output.Key()] = "ON"
+		} else {
+			payload[output.Key()] = "OFF"
+		}
+	}
+}
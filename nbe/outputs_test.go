@@ -0,0 +1,73 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "testing"
+
+func TestExpandOutputs(t *testing.T) {
+	tests := []struct {
+		name     string
+		mask     interface{}
+		expected map[string]interface{}
+	}{
+		{"all off", int64(0), map[string]interface{}{
+			"output_exhaust_fan": "OFF", "output_auger": "OFF", "output_ignition": "OFF",
+			"output_circulation_pump": "OFF", "output_dhw_pump": "OFF",
+		}},
+		{"fan, auger and circulation pump", int64(11), map[string]interface{}{
+			"output_exhaust_fan": "ON", "output_auger": "ON", "output_ignition": "OFF",
+			"output_circulation_pump": "ON", "output_dhw_pump": "OFF",
+		}},
+		{"ignition and hot water pump", RoundedFloat(20), map[string]interface{}{
+			"output_exhaust_fan": "OFF", "output_auger": "OFF", "output_ignition": "ON",
+			"output_circulation_pump": "OFF", "output_dhw_pump": "ON",
+		}},
+		{"unknown bits ignored", int64(1 << 7), map[string]interface{}{
+			"output_exhaust_fan": "OFF", "output_auger": "OFF", "output_ignition": "OFF",
+			"output_circulation_pump": "OFF", "output_dhw_pump": "OFF",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := map[string]interface{}{OutputsField: tt.mask}
+			ExpandOutputs(payload)
+			for key, want := range tt.expected {
+				if payload[key] != want {
+					t.Errorf("%s = %v, want %v", key, payload[key], want)
+				}
+			}
+			if len(payload) != len(tt.expected)+1 {
+				t.Errorf("Unexpected payload %v", payload)
+			}
+		})
+	}
+}
+
+func TestExpandOutputsWithoutBitmask(t *testing.T) {
+	for _, payload := range []map[string]interface{}{
+		{"fan_speed": int64(2500)},
+		{OutputsField: "n/a"},
+	} {
+		size := len(payload)
+		ExpandOutputs(payload)
+		if len(payload) != size {
+			t.Errorf("Expected payload unchanged, got %v", payload)
+		}
+	}
+}
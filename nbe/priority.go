@@ -0,0 +1,159 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"sync"
+	"time"
+)
+
+// Priority orders requests waiting to be sent to the controller; lower
+// values are sent first
+type Priority int
+
+const (
+	// PriorityWrite is used for every write
+	PriorityWrite Priority = iota
+	// PriorityRead is used for reads made on demand
+	PriorityRead
+	// PriorityPoll is used for background polling
+	PriorityPoll
+)
+
+// maxQueueWait is how long a request may be passed over by higher priority
+// requests before it is sent ahead of them
+const maxQueueWait = 2 * time.Second
+
+// ticket is a request waiting for its turn to be sent
+type ticket struct {
+	priority Priority
+	queued   time.Time
+	ready    chan struct{}
+}
+
+// dispatcher hands out the rate limiter's tokens to waiting requests by
+// priority, oldest first within a priority
+type dispatcher struct {
+	limiter *rateLimiter
+	now     func() time.Time
+
+	mu      sync.Mutex
+	waiting []*ticket
+	running bool
+}
+
+func newDispatcher(limiter *rateLimiter) *dispatcher {
+	return &dispatcher{limiter: limiter, now: time.Now}
+}
+
+// enqueue queues a request at priority and returns its ticket
+func (d *dispatcher) enqueue(priority Priority) *ticket {
+	t := &ticket{priority: priority, queued: d.now(), ready: make(chan struct{})}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waiting = append(d.waiting, t)
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+	return t
+}
+
+// promote raises a waiting ticket to priority if it is currently lower
+func (d *dispatcher) promote(t *ticket, priority Priority) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if priority < t.priority {
+		t.priority = priority
+	}
+}
+
+// cancel removes a ticket that will no longer be sent
+func (d *dispatcher) cancel(t *ticket) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, waiting := range d.waiting {
+		if waiting == t {
+			d.waiting = append(d.waiting[:i], d.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// queued returns the number of requests waiting to be sent
+func (d *dispatcher) queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.waiting)
+}
+
+func (d *dispatcher) run() {
+	for {
+		d.mu.Lock()
+		if len(d.waiting) == 0 {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+
+		// Take the token before choosing, so requests queued while waiting
+		// for it are considered too
+		d.limiter.wait()
+
+		d.mu.Lock()
+		t := d.next()
+		d.mu.Unlock()
+		if t != nil {
+			close(t.ready)
+		}
+	}
+}
+
+// next removes and returns the ticket to send next, or nil if none are
+// waiting. Tickets passed over for longer than maxQueueWait go first, oldest
+// first; otherwise the highest priority wins.
+func (d *dispatcher) next() *ticket {
+	if len(d.waiting) == 0 {
+		return nil
+	}
+
+	now := d.now()
+	best := 0
+	for i, t := range d.waiting[1:] {
+		i++
+		if d.before(t, d.waiting[best], now) {
+			best = i
+		}
+	}
+	t := d.waiting[best]
+	d.waiting = append(d.waiting[:best], d.waiting[best+1:]...)
+	return t
+}
+
+// before reports whether a should be sent before b. The waiting list is in
+// queue order, so ties keep the older ticket.
+func (d *dispatcher) before(a, b *ticket, now time.Time) bool {
+	aStarved := now.Sub(a.queued) >= maxQueueWait
+	bStarved := now.Sub(b.queued) >= maxQueueWait
+	if aStarved || bStarved {
+		return aStarved && (!bStarved || a.queued.Before(b.queued))
+	}
+	return a.priority < b.priority
+}
@@ -0,0 +1,106 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDispatcherNext(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ticketAt := func(priority Priority, age time.Duration) *ticket {
+		return &ticket{priority: priority, queued: now.Add(-age)}
+	}
+
+	poll := ticketAt(PriorityPoll, 300*time.Millisecond)
+	read := ticketAt(PriorityRead, 200*time.Millisecond)
+	write := ticketAt(PriorityWrite, 100*time.Millisecond)
+	laterWrite := ticketAt(PriorityWrite, 0)
+	starved := ticketAt(PriorityPoll, maxQueueWait+time.Second)
+	starvedSooner := ticketAt(PriorityPoll, maxQueueWait)
+
+	tests := []struct {
+		name    string
+		waiting []*ticket
+		want    *ticket
+	}{
+		{"empty", nil, nil},
+		{"writes before reads before polls", []*ticket{poll, read, write}, write},
+		{"reads before polls", []*ticket{poll, read}, read},
+		{"oldest first within a priority", []*ticket{write, laterWrite}, write},
+		{"starved request goes first", []*ticket{starved, write, read}, starved},
+		{"oldest starved request goes first", []*ticket{starvedSooner, write, starved}, starved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDispatcher(newRateLimiter(0, 1))
+			d.now = func() time.Time { return now }
+			d.waiting = append([]*ticket(nil), tt.waiting...)
+
+			if got := d.next(); got != tt.want {
+				t.Errorf("next() = %+v, want %+v", got, tt.want)
+			}
+			if len(tt.waiting) > 0 && len(d.waiting) != len(tt.waiting)-1 {
+				t.Errorf("%d tickets left waiting, want %d", len(d.waiting), len(tt.waiting)-1)
+			}
+		})
+	}
+}
+
+func TestDispatcherPromote(t *testing.T) {
+	d := newDispatcher(newRateLimiter(0, 1))
+	poll := &ticket{priority: PriorityPoll, queued: time.Now()}
+	read := &ticket{priority: PriorityRead, queued: time.Now()}
+	d.waiting = []*ticket{read, poll}
+
+	d.promote(poll, PriorityWrite)
+	d.promote(poll, PriorityPoll)
+	if got := d.next(); got != poll {
+		t.Errorf("next() = %+v, want the promoted poll", got)
+	}
+}
+
+func TestDispatcherReleasesByPriority(t *testing.T) {
+	d := newDispatcher(newRateLimiter(20, 1))
+	<-d.enqueue(PriorityPoll).ready // uses up the burst so the rest queue
+
+	order := make(chan Priority, 3)
+	for _, priority := range []Priority{PriorityPoll, PriorityRead, PriorityWrite} {
+		ticket := d.enqueue(priority)
+		go func(priority Priority) {
+			<-ticket.ready
+			order <- priority
+		}(priority)
+	}
+
+	for _, want := range []Priority{PriorityWrite, PriorityRead, PriorityPoll} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("released priority %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for a request to be released")
+		}
+	}
+	if queued := d.queued(); queued != 0 {
+		t.Errorf("%d requests still queued", queued)
+	}
+}
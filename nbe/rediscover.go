@@ -0,0 +1,224 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rediscoverAfter is how long the controller has to stay silent before a
+// timed out request looks for it at another address
+const rediscoverAfter = 15 * time.Second
+
+// rediscoveryInterval is the least time between two searches for the
+// controller
+const rediscoveryInterval = time.Minute
+
+// discoveryTimeout is how long a search waits for the controller to answer
+const discoveryTimeout = 3 * time.Second
+
+// Address returns the IP address requests are sent to; it changes when the
+// controller is found at a new address
+func (nbe *NBE) Address() string {
+	return nbe.remoteAddr().IP.String()
+}
+
+func (nbe *NBE) remoteAddr() *net.UDPAddr {
+	return nbe.remote.Load()
+}
+
+// OnAddressChange registers a handler called with the controller's new IP
+// address after it was found at another one
+func (nbe *NBE) OnAddressChange(handler func(ip string)) {
+	nbe.addressMutex.Lock()
+	defer nbe.addressMutex.Unlock()
+	nbe.addressHandlers = append(nbe.addressHandlers, handler)
+}
+
+// shouldRediscover reports whether a request timing out at now means the
+// controller may have moved: it answered before, but not for rediscoverAfter
+func (nbe *NBE) shouldRediscover(now time.Time) bool {
+	last := nbe.LastResponse()
+	return !last.IsZero() && now.Sub(last) >= rediscoverAfter
+}
+
+// rediscover looks for the controller on the local networks after it stopped
+// answering, in case DHCP handed it a new address, and sends every request
+// to the address its serial answers from
+func (nbe *NBE) rediscover() {
+	now := time.Now().UnixNano()
+	last := nbe.lastRediscovery.Load()
+	if now-last < int64(rediscoveryInterval) || !nbe.lastRediscovery.CompareAndSwap(last, now) {
+		return
+	}
+
+	log.Infof("The controller at %s stopped answering; looking for %s on the local network", nbe.remoteAddr().IP, nbe.Serial)
+	addr, err := nbe.search()
+	if err != nil {
+		log.Debugf("Failed to find the controller: %v", err)
+		return
+	}
+	nbe.moveTo(addr)
+}
+
+// search broadcasts a discovery request on the local networks and returns
+// the address the controller with the configured serial answers from
+func (nbe *NBE) search() (*net.UDPAddr, error) {
+	targets := nbe.discoveryTargets
+	if targets == nil {
+		targets = broadcastTargets
+	}
+	return discover(nbe.AppID, nbe.ControllerID, nbe.Serial, targets(nbe.remoteAddr().Port), discoveryTimeout)
+}
+
+// Reconnect starts over after the controller stopped answering: it replaces
+// the socket, looks for the controller on the local network or, failing that,
+// resolves its host name again, and repeats the discovery exchange. Requests
+// waiting on the old socket time out. It returns an error if the controller
+// still doesn't answer.
+func (nbe *NBE) Reconnect() error {
+	if err := nbe.bind(); err != nil {
+		return err
+	}
+	if addr, err := nbe.search(); err == nil {
+		nbe.moveTo(addr)
+	} else if nbe.isHostName() {
+		if addr, err := nbe.resolveHost(nbe.remoteAddr()); err == nil {
+			nbe.moveTo(addr)
+		}
+	}
+	return nbe.handshake()
+}
+
+// moveTo sends every request to addr from now on and tells the address
+// handlers, unless the controller is already reached there
+func (nbe *NBE) moveTo(addr *net.UDPAddr) {
+	remote := nbe.remoteAddr()
+	if sameAddr(addr, remote) {
+		return
+	}
+
+	nbe.remote.Store(addr)
+	log.Warnf("The controller %s moved from %s to %s", nbe.Serial, remote, addr)
+	nbe.addressMutex.RLock()
+	defer nbe.addressMutex.RUnlock()
+	for _, handler := range nbe.addressHandlers {
+		handler(addr.IP.String())
+	}
+}
+
+// discover sends a discovery request to every target and returns the address
+// of the first controller answering with serial
+func discover(appID, controllerID, serial string, targets []*net.UDPAddr, timeout time.Duration) (*net.UDPAddr, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no network to search")
+	}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := NBERequest{
+		AppID:        appID,
+		ControllerID: controllerID,
+		Function:     DiscoveryFunction,
+		Payload:      []byte("NBE Discovery"),
+	}
+	packet := new(bytes.Buffer)
+	if err := request.Pack(packet); err != nil {
+		return nil, err
+	}
+	sent := 0
+	for _, target := range targets {
+		if _, err := conn.WriteTo(packet.Bytes(), target); err != nil {
+			log.Debugf("Failed to send discovery to %s: %v", target, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return nil, errors.New("discovery could not be sent")
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("no answer from %s: %w", serial, err)
+		}
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		var response NBEResponse
+		if err := response.Unpack(bytes.NewReader(buffer[:n])); err != nil {
+			continue
+		}
+		if response.AppID != appID || response.Function != DiscoveryFunction {
+			continue
+		}
+		if got := fmt.Sprintf("%v", response.Payload["serial"]); got != serial {
+			log.Debugf("Ignoring the controller %s at %s", got, udp)
+			continue
+		}
+		return udp, nil
+	}
+}
+
+// broadcastTargets returns the broadcast address of every local IPv4
+// network, and the limited broadcast address, on port
+func broadcastTargets(port int) []*net.UDPAddr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Debugf("Failed to list the local networks: %v", err)
+	}
+	return broadcastAddrs(addrs, port)
+}
+
+func broadcastAddrs(addrs []net.Addr, port int) []*net.UDPAddr {
+	targets := []*net.UDPAddr{{IP: net.IPv4bcast, Port: port}}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, mask := ipNet.IP.To4(), ipNet.Mask
+		if ip == nil || ip.IsLoopback() || len(mask) != net.IPv4len {
+			continue
+		}
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = ip[i] | ^mask[i]
+		}
+		if broadcast.Equal(net.IPv4bcast) {
+			continue
+		}
+		targets = append(targets, &net.UDPAddr{IP: broadcast, Port: port})
+	}
+	return targets
+}
@@ -0,0 +1,167 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRediscoverFollowsMovedController(t *testing.T) {
+	old, boiler := newMockClient(t)
+	old.Stop()
+
+	// DHCP handed the controller a new address, next to another controller
+	other, err := NewMockBoiler("OTHER0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := NewMockBoiler("TEST12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mb := range []*MockBoiler{other, moved} {
+		if err := mb.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(mb.Stop)
+	}
+	boiler.discoveryTargets = func(int) []*net.UDPAddr {
+		return []*net.UDPAddr{
+			{IP: net.IPv4(127, 0, 0, 1), Port: other.Port},
+			{IP: net.IPv4(127, 0, 0, 1), Port: moved.Port},
+		}
+	}
+	var notified []string
+	boiler.OnAddressChange(func(ip string) {
+		notified = append(notified, ip)
+	})
+
+	boiler.rediscover()
+	if got := boiler.remoteAddr().Port; got != moved.Port {
+		t.Fatalf("Expected requests to go to port %d, got %d", moved.Port, got)
+	}
+	if len(notified) != 1 || notified[0] != "127.0.0.1" {
+		t.Errorf("Expected one address change to 127.0.0.1, got %v", notified)
+	}
+	moved.SetValue("boiler", "temp", "55")
+	response, err := boiler.Get(GetSetupFunction, "boiler.temp")
+	if err != nil {
+		t.Fatalf("Get() after moving error = %v", err)
+	}
+	if got := fmt.Sprint(response.Payload["temp"]); got != "55" {
+		t.Errorf("Expected the moved controller's temp 55, got %v", got)
+	}
+
+	// searches are spaced out
+	boiler.discoveryTargets = func(int) []*net.UDPAddr {
+		t.Error("Expected no second search within a minute")
+		return nil
+	}
+	boiler.rediscover()
+}
+
+func TestReconnectFindsMovedController(t *testing.T) {
+	old, boiler := newMockClient(t)
+	old.Stop()
+	if _, err := boiler.Get(GetSetupFunction, "boiler.temp"); err == nil {
+		t.Fatal("Expected the stopped controller not to answer")
+	}
+	deadline := time.Now().Add(time.Second)
+	for boiler.Failures() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failures := boiler.Failures(); failures != 1 {
+		t.Errorf("Expected 1 failure, got %d", failures)
+	}
+
+	moved, err := NewMockBoiler("TEST12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := moved.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(moved.Stop)
+	boiler.discoveryTargets = func(int) []*net.UDPAddr {
+		return []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: moved.Port}}
+	}
+	socket := boiler.socket()
+
+	if err := boiler.Reconnect(); err != nil {
+		t.Fatalf("Reconnect() error = %v", err)
+	}
+	if boiler.socket() == socket {
+		t.Error("Expected a new socket")
+	}
+	if got := boiler.remoteAddr().Port; got != moved.Port {
+		t.Errorf("Expected requests to go to port %d, got %d", moved.Port, got)
+	}
+	if failures := boiler.Failures(); failures != 0 {
+		t.Errorf("Expected the failures reset by the answer, got %d", failures)
+	}
+	if _, err := boiler.Get(GetSetupFunction, "boiler.temp"); err != nil {
+		t.Errorf("Get() after reconnecting error = %v", err)
+	}
+
+	moved.Stop()
+	boiler.discoveryTargets = func(int) []*net.UDPAddr { return nil }
+	if err := boiler.Reconnect(); err == nil {
+		t.Error("Expected an error while the controller is gone")
+	}
+}
+
+func TestShouldRediscover(t *testing.T) {
+	boiler, _ := newTestNBE(t)
+	now := time.Now()
+	if boiler.shouldRediscover(now) {
+		t.Error("Expected no search for a controller that never answered")
+	}
+	boiler.lastResponse.Store(now.Add(-5 * time.Second).UnixNano())
+	if boiler.shouldRediscover(now) {
+		t.Error("Expected no search while the controller answers")
+	}
+	boiler.lastResponse.Store(now.Add(-rediscoverAfter).UnixNano())
+	if !boiler.shouldRediscover(now) {
+		t.Error("Expected a search once the controller went silent")
+	}
+}
+
+func TestBroadcastAddrs(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.IPv4(192, 168, 1, 20).To4(), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.IPv4(10, 1, 2, 3).To4(), Mask: net.CIDRMask(16, 32)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	var got []string
+	for _, target := range broadcastAddrs(addrs, 8483) {
+		got = append(got, target.String())
+	}
+	want := []string{"255.255.255.255:8483", "192.168.1.255:8483", "10.1.255.255:8483"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+}
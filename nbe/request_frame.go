@@ -22,6 +22,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
@@ -115,6 +116,9 @@ func (frame *NBERequest) Pack(writer io.Writer) error {
 
 	if frame.RSAKey != nil {
 		padLen := 64 - buf.Len()
+		if padLen < 0 {
+			return fmt.Errorf("%w: %d of 64 bytes", ErrFrameTooLong, buf.Len())
+		}
 		padBytes := make([]byte, padLen)
 		_, err = rand.Read(padBytes)
 		if err != nil {
@@ -147,6 +151,10 @@ func (frame *NBERequest) Pack(writer io.Writer) error {
 	return err
 }
 
+// ErrFrameTooLong is returned when a request does not fit in the single RSA
+// block used for encrypted requests
+var ErrFrameTooLong = errors.New("request too long to encrypt")
+
 func (frame *NBERequest) Unpack(reader io.Reader) error {
 	// Read fixed-size string fields
 	var err error
@@ -0,0 +1,124 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/zeroconf"
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveInterval is how often a controller given by host name is looked up
+// again
+const resolveInterval = time.Minute
+
+// resolveTimeout bounds a single lookup of the controller's host name
+const resolveTimeout = 5 * time.Second
+
+// lookupHost returns the IPv4 addresses of host, asking the local network
+// for names in the .local domain and the system resolver for the others
+func lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".local") {
+		return zeroconf.LookupHost(ctx, host)
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip4", host)
+}
+
+// resolveHost looks up the controller's address from the boiler URI. When
+// the name has several addresses, current is kept if it is one of them.
+func (nbe *NBE) resolveHost(current *net.UDPAddr) (*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(nbe.URI.Host)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(service)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", service)
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+
+	lookup := nbe.lookup
+	if lookup == nil {
+		lookup = lookupHost
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, ip := range ips {
+		ip = ip.To4()
+		if ip == nil {
+			continue
+		}
+		if current != nil && current.Port == port && ip.Equal(current.IP) {
+			return current, nil
+		}
+		if found == nil {
+			found = ip
+		}
+	}
+	if found == nil {
+		return nil, errors.New("no IPv4 address for " + host)
+	}
+	return &net.UDPAddr{IP: found, Port: port}, nil
+}
+
+// isHostName reports whether the boiler URI names the controller instead of
+// giving its IP address
+func (nbe *NBE) isHostName() bool {
+	return net.ParseIP(nbe.URI.Hostname()) == nil
+}
+
+// watchHost looks the controller's host name up every resolveInterval, for
+// dynamic DNS and mDNS names whose address changes
+func (nbe *NBE) watchHost(resolved *net.UDPAddr) {
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		resolved = nbe.refreshHost(resolved)
+	}
+}
+
+// refreshHost resolves the host name again and moves requests to its new
+// address when the record changed since it last resolved to resolved. An
+// address found by rediscovery is kept until the record itself changes.
+func (nbe *NBE) refreshHost(resolved *net.UDPAddr) *net.UDPAddr {
+	addr, err := nbe.resolveHost(resolved)
+	if err != nil {
+		log.Debugf("Failed to resolve %s: %v", nbe.URI.Hostname(), err)
+		return resolved
+	}
+	if sameAddr(addr, resolved) {
+		return resolved
+	}
+	log.Infof("%s now resolves to %s", nbe.URI.Hostname(), addr.IP)
+	nbe.moveTo(addr)
+	return addr
+}
@@ -0,0 +1,97 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestResolveHost(t *testing.T) {
+	boiler, _ := newTestNBE(t)
+	boiler.URI = &url.URL{Host: "boiler.example.net:8483"}
+	boiler.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		if host != "boiler.example.net" {
+			t.Errorf("Expected a lookup of boiler.example.net, got %s", host)
+		}
+		return []net.IP{net.ParseIP("fe80::1"), net.IPv4(10, 0, 0, 5), net.IPv4(10, 0, 0, 6)}, nil
+	}
+
+	addr, err := boiler.resolveHost(nil)
+	if err != nil {
+		t.Fatalf("resolveHost() error = %v", err)
+	}
+	if addr.String() != "10.0.0.5:8483" {
+		t.Errorf("Expected the first IPv4 address 10.0.0.5:8483, got %s", addr)
+	}
+	current := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 6), Port: 8483}
+	if addr, _ := boiler.resolveHost(current); addr != current {
+		t.Errorf("Expected the current address to be kept, got %s", addr)
+	}
+
+	boiler.URI = &url.URL{Host: "192.168.1.50:8483"}
+	boiler.lookup = func(context.Context, string) ([]net.IP, error) {
+		t.Error("Expected no lookup for an IP address")
+		return nil, nil
+	}
+	if addr, err := boiler.resolveHost(nil); err != nil || addr.String() != "192.168.1.50:8483" {
+		t.Errorf("Expected 192.168.1.50:8483, got %v (%v)", addr, err)
+	}
+}
+
+func TestRefreshHostFollowsRecord(t *testing.T) {
+	boiler, controller := newTestNBE(t)
+	boiler.URI = &url.URL{Host: "boiler.example.net:8483"}
+	record := net.IPv4(10, 0, 0, 5)
+	var lookupErr error
+	boiler.lookup = func(context.Context, string) ([]net.IP, error) {
+		return []net.IP{record}, lookupErr
+	}
+	var notified []string
+	boiler.OnAddressChange(func(ip string) {
+		notified = append(notified, ip)
+	})
+
+	// the record changed: requests follow it
+	resolved := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 4), Port: 8483}
+	resolved = boiler.refreshHost(resolved)
+	if got := boiler.Address(); got != "10.0.0.5" {
+		t.Fatalf("Expected requests to go to 10.0.0.5, got %s", got)
+	}
+	if len(notified) != 1 || notified[0] != "10.0.0.5" {
+		t.Errorf("Expected one address change to 10.0.0.5, got %v", notified)
+	}
+
+	// rediscovery found the controller elsewhere; an unchanged record
+	// doesn't take it back
+	boiler.moveTo(controller.LocalAddr().(*net.UDPAddr))
+	resolved = boiler.refreshHost(resolved)
+	if got := boiler.Address(); got != "127.0.0.1" {
+		t.Errorf("Expected the rediscovered address to be kept, got %s", got)
+	}
+
+	// a failed lookup keeps the address
+	lookupErr = errors.New("no such host")
+	record = net.IPv4(10, 0, 0, 7)
+	if got := boiler.refreshHost(resolved); got != resolved || boiler.Address() != "127.0.0.1" {
+		t.Errorf("Expected a failed lookup to change nothing, got %s", got)
+	}
+}
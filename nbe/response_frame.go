@@ -18,8 +18,11 @@
 package nbe
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // Use shared constants from frame_helpers.go
@@ -33,7 +36,47 @@ type NBEResponse struct {
 	Payload      map[string]interface{}
 }
 
+// clone returns a copy of the response with its own payload map
+func (frame *NBEResponse) clone() *NBEResponse {
+	copied := *frame
+	copied.Payload = make(map[string]interface{}, len(frame.Payload))
+	for key, value := range frame.Payload {
+		copied.Payload[key] = value
+	}
+	return &copied
+}
+
+// MaxPayloadLen is the longest payload a single frame can carry; longer
+// responses are sent as consecutive frames with the same sequence number
+const MaxPayloadLen = 999
+
+// Pack writes the response as a frame, or as consecutive frames when the
+// payload is longer than MaxPayloadLen
 func (frame *NBEResponse) Pack(writer io.Writer) error {
+	for _, payload := range splitPayload(serializePayload(frame.Payload), MaxPayloadLen) {
+		if err := frame.packFrame(writer, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitPayload cuts a serialized payload into parts of at most size bytes,
+// after the separator of a key=value entry where possible
+func splitPayload(payload string, size int) []string {
+	var parts []string
+	for len(payload) > size {
+		cut := strings.LastIndexByte(payload[:size], ';') + 1
+		if cut == 0 {
+			cut = size
+		}
+		parts = append(parts, payload[:cut])
+		payload = payload[cut:]
+	}
+	return append(parts, payload)
+}
+
+func (frame *NBEResponse) packFrame(writer io.Writer, payloadStr string) error {
 	// Write header fields
 	if err := writeString(writer, frame.AppID, AppIDSize, "AppID"); err != nil {
 		return err
@@ -60,8 +103,7 @@ func (frame *NBEResponse) Pack(writer io.Writer) error {
 		return err
 	}
 
-	// Serialize and write payload
-	payloadStr := serializePayload(frame.Payload)
+	// Write payload
 	if err := writeASCIIInt(writer, len(payloadStr), PayloadLenSize, "payload length"); err != nil {
 		return err
 	}
@@ -77,19 +119,68 @@ func (frame *NBEResponse) Pack(writer io.Writer) error {
 	return nil
 }
 
+// Unpack reads a response. Frames following the first one with the same
+// header, function and sequence number are continuations of it, and their
+// payload is appended to its payload; other trailing bytes are ignored. A
+// response cut short returns an error wrapping io.ErrUnexpectedEOF.
 func (frame *NBEResponse) Unpack(reader io.Reader) error {
+	payload, err := frame.unpackFrame(reader)
+	if err != nil {
+		return cutShort(err)
+	}
+
+	header := []byte(frame.AppID + frame.ControllerID + string(StartMarker))
+	for {
+		next := make([]byte, len(header))
+		n, err := io.ReadFull(reader, next)
+		if n == 0 || !bytes.Equal(next[:n], header[:n]) {
+			frame.Payload = parsePayload(payload, frame.Function)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read continuation frame: %w", io.ErrUnexpectedEOF)
+		}
+
+		var continuation NBEResponse
+		more, err := continuation.unpackFrame(io.MultiReader(bytes.NewReader(next), reader))
+		if err != nil {
+			return fmt.Errorf("continuation frame: %w", cutShort(err))
+		}
+		if continuation.Function != frame.Function || continuation.SeqNo != frame.SeqNo {
+			return fmt.Errorf("continuation frame for function %d sequence %d in the response to function %d sequence %d",
+				continuation.Function, continuation.SeqNo, frame.Function, frame.SeqNo)
+		}
+		if continuation.Status != StatusOK {
+			frame.Status = continuation.Status
+		}
+		payload += more
+	}
+}
+
+// cutShort makes a frame that ended early return io.ErrUnexpectedEOF, even
+// when it ended between two fields
+func cutShort(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%v: %w", err, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// unpackFrame reads the header of a single frame into the response and
+// returns its raw payload
+func (frame *NBEResponse) unpackFrame(reader io.Reader) (string, error) {
 	// Read header fields
 	var err error
 	if frame.AppID, err = readStringFull(reader, AppIDSize, "AppID"); err != nil {
-		return err
+		return "", err
 	}
 	if frame.ControllerID, err = readStringFull(reader, ControllerIDSize, "ControllerID"); err != nil {
-		return err
+		return "", err
 	}
 
 	// Validate start marker
 	if err := validateMarker(reader, StartMarker, "start marker"); err != nil {
-		return err
+		return "", err
 	}
 
 	// Read function, sequence number, and status (ASCII encoded)
@@ -109,30 +200,27 @@ func (frame *NBEResponse) Unpack(reader io.Reader) error {
 
 	var statusInt int64
 	if statusInt, err = readASCIIInt64Full(reader, StatusSize, "Status"); err != nil {
-		return fmt.Errorf("invalid status: %w", err)
+		return "", fmt.Errorf("invalid status: %w", err)
 	}
 	frame.Status = uint8(statusInt)
 
 	// Read payload length and payload
 	var payloadLen int64
 	if payloadLen, err = readASCIIInt64Full(reader, PayloadLenSize, "payload length"); err != nil {
-		return fmt.Errorf("invalid payload length: %w", err)
+		return "", fmt.Errorf("invalid payload length: %w", err)
 	}
 
 	payloadBytes, err := readBytesFull(reader, int(payloadLen), "payload")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Parse payload
-	frame.Payload = parsePayload(string(payloadBytes), frame.Function)
-
 	// Validate end marker
 	if err := validateMarker(reader, EndMarker, "end marker"); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return string(payloadBytes), nil
 }
 
 // Helper functions are now in frame_helpers.go
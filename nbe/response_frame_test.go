@@ -0,0 +1,112 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func largeResponse(keys int) *NBEResponse {
+	response := &NBEResponse{
+		AppID:        "ABCDEFGHIJKL",
+		ControllerID: "123456",
+		Function:     GetSetupFunction,
+		SeqNo:        7,
+		Payload:      make(map[string]interface{}),
+	}
+	for i := 0; i < keys; i++ {
+		response.Payload[fmt.Sprintf("key_%03d", i)] = int64(i)
+	}
+	return response
+}
+
+func TestResponseSplitsLargePayloads(t *testing.T) {
+	var packet bytes.Buffer
+	if err := largeResponse(200).Pack(&packet); err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	if frames := bytes.Count(packet.Bytes(), []byte{StartMarker}); frames < 2 {
+		t.Fatalf("Expected the payload to be split into several frames, got %d", frames)
+	}
+
+	var response NBEResponse
+	if err := response.Unpack(bytes.NewReader(packet.Bytes())); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+	if len(response.Payload) != 200 || response.Payload["key_199"] != int64(199) || response.SeqNo != 7 {
+		t.Errorf("Expected all 200 keys to be reassembled, got %d", len(response.Payload))
+	}
+
+	long := largeResponse(0)
+	long.Payload["rsa_key"] = strings.Repeat("A", 1500)
+	packet.Reset()
+	long.Pack(&packet)
+	if err := response.Unpack(bytes.NewReader(packet.Bytes())); err != nil || response.Payload["rsa_key"] != long.Payload["rsa_key"] {
+		t.Errorf("Expected a value longer than a frame to be reassembled, got %v", err)
+	}
+
+	packet.Reset()
+	largeResponse(200).Pack(&packet)
+	cut := packet.Bytes()[:packet.Len()-10]
+	if err := response.Unpack(bytes.NewReader(cut)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a response cut short to return io.ErrUnexpectedEOF, got %v", err)
+	}
+	if err := response.Unpack(bytes.NewReader(packet.Bytes()[:AppIDSize+3])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a response cut in its header to return io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestResponseContinuationFrames(t *testing.T) {
+	first, second := largeResponse(0), largeResponse(0)
+	var packet bytes.Buffer
+	first.packFrame(&packet, "key_000=0;oth")
+	second.packFrame(&packet, "er=2")
+	packet.WriteString("\x00\x00")
+
+	var response NBEResponse
+	if err := response.Unpack(bytes.NewReader(packet.Bytes())); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+	if response.Payload["key_000"] != int64(0) || response.Payload["other"] != int64(2) {
+		t.Errorf("Expected the continuation merged and the padding ignored, got %v", response.Payload)
+	}
+
+	second.SeqNo = 8
+	packet.Reset()
+	first.packFrame(&packet, "key_000=0;")
+	second.packFrame(&packet, "other=2")
+	if err := response.Unpack(bytes.NewReader(packet.Bytes())); err == nil {
+		t.Error("Expected an error for a frame of another sequence number")
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	parts := splitPayload("a=1;bb=2;c=3", 5)
+	if strings.Join(parts, "|") != "a=1;|bb=2;|c=3" {
+		t.Errorf("Expected the payload split between entries, got %q", parts)
+	}
+	parts = splitPayload("abcdefgh", 5)
+	if strings.Join(parts, "|") != "abcde|fgh" {
+		t.Errorf("Expected an entry longer than a frame to be cut, got %q", parts)
+	}
+}
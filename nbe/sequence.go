@@ -0,0 +1,134 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxSeqNo is the highest sequence number; the two digits on the wire wrap
+// around to 0 after it
+const maxSeqNo = 99
+
+// ErrNoSequenceNumber is returned when every sequence number is waiting for a
+// response or was retired too recently to be reused
+var ErrNoSequenceNumber = errors.New("no free sequence number")
+
+// outstanding is a request waiting for its response
+type outstanding struct {
+	function Function
+	callback func(*NBEResponse)
+}
+
+// sequencer allocates sequence numbers and matches responses to the requests
+// waiting for them. The number of a request that timed out is retired for a
+// while, so a late response is dropped rather than delivered to the next
+// request given that number.
+type sequencer struct {
+	mu          sync.Mutex
+	last        int8
+	outstanding map[int8]*outstanding
+	retired     map[int8]time.Time
+	retirement  time.Duration
+	now         func() time.Time
+}
+
+func newSequencer(retirement time.Duration) *sequencer {
+	return &sequencer{
+		outstanding: make(map[int8]*outstanding),
+		retired:     make(map[int8]time.Time),
+		retirement:  retirement,
+		now:         time.Now,
+	}
+}
+
+// allocate registers request under the next free sequence number
+func (s *sequencer) allocate(request *outstanding) (int8, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for i := 0; i <= maxSeqNo; i++ {
+		s.last++
+		if s.last > maxSeqNo || s.last < 0 {
+			s.last = 0
+		}
+		if _, busy := s.outstanding[s.last]; busy {
+			continue
+		}
+		if until, ok := s.retired[s.last]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(s.retired, s.last)
+		}
+		s.outstanding[s.last] = request
+		return s.last, nil
+	}
+	return 0, ErrNoSequenceNumber
+}
+
+// take removes and returns the request that response answers. Late and
+// duplicate responses, and responses to another function, match nothing.
+func (s *sequencer) take(response *NBEResponse) (*outstanding, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, ok := s.outstanding[response.SeqNo]
+	if !ok {
+		return nil, false
+	}
+	if response.Function != UnknownFunction && response.Function != request.function {
+		return nil, false
+	}
+	delete(s.outstanding, response.SeqNo)
+	return request, true
+}
+
+// expire gives up waiting for request and retires its sequence number,
+// reporting false if it was answered first
+func (s *sequencer) expire(seq int8, request *outstanding) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.outstanding[seq] != request {
+		return false
+	}
+	delete(s.outstanding, seq)
+	s.retired[seq] = s.now().Add(s.retirement)
+	return true
+}
+
+// release frees the sequence number of a request that was never sent
+func (s *sequencer) release(seq int8, request *outstanding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.outstanding[seq] == request {
+		delete(s.outstanding, seq)
+	}
+}
+
+// pending returns the number of requests waiting for a response
+func (s *sequencer) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.outstanding)
+}
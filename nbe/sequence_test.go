@@ -0,0 +1,129 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSequencerAllocateWrapsAround(t *testing.T) {
+	s := newSequencer(time.Minute)
+	s.last = maxSeqNo - 1
+
+	var got []int8
+	for i := 0; i < 3; i++ {
+		seq, err := s.allocate(&outstanding{})
+		if err != nil {
+			t.Fatalf("allocate() error = %v", err)
+		}
+		got = append(got, seq)
+	}
+	if got[0] != 99 || got[1] != 0 || got[2] != 1 {
+		t.Errorf("Expected 99, 0, 1, got %v", got)
+	}
+}
+
+func TestSequencerSkipsBusyAndRetiredNumbers(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newSequencer(time.Minute)
+	s.now = func() time.Time { return now }
+
+	first := &outstanding{}
+	s.allocate(first) // 1, still waiting
+	expired := &outstanding{}
+	s.allocate(expired) // 2, timed out
+	if !s.expire(2, expired) {
+		t.Fatal("Expected the request to expire")
+	}
+
+	// wrap around to the numbers in use
+	s.last = 0
+	if seq, _ := s.allocate(&outstanding{}); seq != 3 {
+		t.Errorf("Expected busy and retired numbers to be skipped, got %d", seq)
+	}
+
+	now = now.Add(time.Minute)
+	s.last = 0
+	if seq, _ := s.allocate(&outstanding{}); seq != 2 {
+		t.Errorf("Expected the retired number to be reused after its retirement, got %d", seq)
+	}
+}
+
+func TestSequencerExhausted(t *testing.T) {
+	s := newSequencer(time.Minute)
+	for i := 0; i <= maxSeqNo; i++ {
+		if _, err := s.allocate(&outstanding{}); err != nil {
+			t.Fatalf("allocate() %d error = %v", i, err)
+		}
+	}
+	if _, err := s.allocate(&outstanding{}); !errors.Is(err, ErrNoSequenceNumber) {
+		t.Errorf("Expected %v, got %v", ErrNoSequenceNumber, err)
+	}
+	if pending := s.pending(); pending != maxSeqNo+1 {
+		t.Errorf("Expected %d pending requests, got %d", maxSeqNo+1, pending)
+	}
+}
+
+func TestSequencerTake(t *testing.T) {
+	s := newSequencer(time.Minute)
+	request := &outstanding{function: GetSetupFunction}
+	seq, _ := s.allocate(request)
+
+	tests := []struct {
+		name     string
+		response *NBEResponse
+		matched  bool
+	}{
+		{"another function", &NBEResponse{SeqNo: seq, Function: GetOperatingDataFunction}, false},
+		{"unknown sequence", &NBEResponse{SeqNo: seq + 1, Function: GetSetupFunction}, false},
+		{"answer", &NBEResponse{SeqNo: seq, Function: GetSetupFunction}, true},
+		{"duplicate", &NBEResponse{SeqNo: seq, Function: GetSetupFunction}, false},
+	}
+	for _, tt := range tests {
+		got, ok := s.take(tt.response)
+		if ok != tt.matched || (ok && got != request) {
+			t.Errorf("%s: take() = %v, %v, want matched %v", tt.name, got, ok, tt.matched)
+		}
+	}
+}
+
+func TestSequencerDropsLateResponses(t *testing.T) {
+	s := newSequencer(time.Minute)
+	request := &outstanding{function: GetSetupFunction}
+	seq, _ := s.allocate(request)
+
+	if !s.expire(seq, request) {
+		t.Fatal("Expected the request to expire")
+	}
+	if _, ok := s.take(&NBEResponse{SeqNo: seq, Function: GetSetupFunction}); ok {
+		t.Error("Expected the late response to be dropped")
+	}
+	if s.expire(seq, request) {
+		t.Error("Expected a request to expire only once")
+	}
+
+	// an answered request does not expire
+	answered := &outstanding{function: GetSetupFunction}
+	seq, _ = s.allocate(answered)
+	s.take(&NBEResponse{SeqNo: seq, Function: GetSetupFunction})
+	if s.expire(seq, answered) {
+		t.Error("Expected an answered request not to expire")
+	}
+}
@@ -17,14 +17,227 @@
 
 package nbe
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// plainNumber is the number format the controller accepts: no exponents, hex
+// or special values, and short enough to fit an encrypted request
+var plainNumber = regexp.MustCompile(`^-?[0-9]{1,4}(\.[0-9]{1,3})?$`)
+
+// ErrUnknownSetting is returned when a write targets a key without a schema
+var ErrUnknownSetting = errors.New("unknown setting")
+
+// ErrReadOnly is returned for every write while the client is read-only
+var ErrReadOnly = errors.New("writes are disabled in read-only mode")
+
+type SettingType string
+
+const (
+	IntSetting   SettingType = "int"
+	FloatSetting SettingType = "float"
+	EnumSetting  SettingType = "enum"
+)
+
 type SettingDefinition struct {
 	Name     string       `json:"name"`
 	Group    string       `json:"group"`
+	Type     SettingType  `json:"type"`
 	Min      RoundedFloat `json:"min"`
 	Max      RoundedFloat `json:"max"`
 	Decimals int64        `json:"decimals"`
+	Enum     []string     `json:"enum,omitempty"`
+	// Action marks a command, such as starting the boiler, that triggers
+	// something rather than storing a value that can be read back
+	Action bool `json:"action,omitempty"`
+	// Destructive marks an action that interrupts heating, which is only
+	// written when explicitly enabled
+	Destructive bool `json:"destructive,omitempty"`
 }
 
+// Validate checks that value is acceptable for the setting before it is sent
+// to the controller
 func (setting *SettingDefinition) Validate(value interface{}) error {
+	var str string
+	switch v := value.(type) {
+	case []byte:
+		str = string(v)
+	case string:
+		str = v
+	default:
+		str = fmt.Sprintf("%v", v)
+	}
+	str = strings.TrimSpace(str)
+
+	if setting.Type == EnumSetting {
+		for _, allowed := range setting.Enum {
+			if str == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s.%s: %q is not one of %s", setting.Group, setting.Name, str, strings.Join(setting.Enum, ", "))
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || !plainNumber.MatchString(str) {
+		return fmt.Errorf("%s.%s: %q is not a number", setting.Group, setting.Name, str)
+	}
+	if setting.Type == IntSetting && f != math.Trunc(f) {
+		return fmt.Errorf("%s.%s: %q is not an integer", setting.Group, setting.Name, str)
+	}
+	if f < float64(setting.Min) || f > float64(setting.Max) {
+		return fmt.Errorf("%s.%s: %s is outside %v..%v", setting.Group, setting.Name, str, float64(setting.Min), float64(setting.Max))
+	}
 	return nil
 }
+
+// DefaultSettingSchema returns the built-in schema of the settings that may
+// be written through MQTT, keyed by "<group>.<name>"
+func DefaultSettingSchema() map[string]SettingDefinition {
+	definitions := []SettingDefinition{
+		{Group: "boiler", Name: "temp", Type: FloatSetting, Min: 0, Max: 85, Decimals: 1},
+		{Group: "boiler", Name: "diff_under", Type: FloatSetting, Min: 0, Max: 50, Decimals: 1},
+		{Group: "boiler", Name: "diff_over", Type: FloatSetting, Min: 0, Max: 50, Decimals: 1},
+		{Group: "hot_water", Name: "temp", Type: FloatSetting, Min: 0, Max: 85, Decimals: 1},
+		{Group: "hot_water", Name: "diff_under", Type: FloatSetting, Min: 5, Max: 30, Decimals: 1},
+		{Group: "regulation", Name: "boiler_power_min", Type: IntSetting, Min: 10, Max: 100},
+		{Group: "regulation", Name: "boiler_power_max", Type: IntSetting, Min: 10, Max: 100},
+		{Group: "hopper", Name: "content", Type: FloatSetting, Min: 0, Max: 999, Decimals: 1},
+		{Group: "hopper", Name: "auger_capacity", Type: FloatSetting, Min: 0, Max: 9999, Decimals: 1},
+		{Group: "weather", Name: "active", Type: EnumSetting, Enum: []string{"0", "1"}},
+		{Group: "weather", Name: "out_cold", Type: FloatSetting, Min: -30, Max: 10, Decimals: 1},
+		{Group: "weather", Name: "flow_cold", Type: FloatSetting, Min: 20, Max: 90, Decimals: 1},
+		{Group: "weather", Name: "out_warm", Type: FloatSetting, Min: 0, Max: 25, Decimals: 1},
+		{Group: "weather", Name: "flow_warm", Type: FloatSetting, Min: 10, Max: 70, Decimals: 1},
+		{Group: "weather2", Name: "active", Type: EnumSetting, Enum: []string{"0", "1"}},
+		{Group: "weather2", Name: "out_cold", Type: FloatSetting, Min: -30, Max: 10, Decimals: 1},
+		{Group: "weather2", Name: "flow_cold", Type: FloatSetting, Min: 20, Max: 90, Decimals: 1},
+		{Group: "weather2", Name: "out_warm", Type: FloatSetting, Min: 0, Max: 25, Decimals: 1},
+		{Group: "weather2", Name: "flow_warm", Type: FloatSetting, Min: 10, Max: 70, Decimals: 1},
+		{Group: "district_heating", Name: "active", Type: EnumSetting, Enum: []string{"0", "1"}},
+		{Group: "district_heating", Name: "temp", Type: FloatSetting, Min: 0, Max: 90, Decimals: 1},
+		{Group: "aux_heater", Name: "active", Type: EnumSetting, Enum: []string{"0", "1"}},
+		{Group: "oxygen", Name: "start_calibrate", Type: EnumSetting, Enum: []string{"0", "1"}, Action: true},
+		{Group: "misc", Name: "start", Type: EnumSetting, Enum: []string{"1"}, Action: true},
+		{Group: "misc", Name: "stop", Type: EnumSetting, Enum: []string{"1"}, Action: true},
+		{Group: "misc", Name: "reset_ash", Type: EnumSetting, Enum: []string{"1"}, Action: true},
+		{Group: "misc", Name: "compressor_clean", Type: EnumSetting, Enum: []string{"1"}, Action: true},
+		{Group: "misc", Name: "chimney_sweep", Type: EnumSetting, Enum: []string{"1"}, Action: true, Destructive: true},
+		{Group: "misc", Name: "restart", Type: EnumSetting, Enum: []string{"1"}, Action: true, Destructive: true},
+	}
+
+	schema := make(map[string]SettingDefinition, len(definitions))
+	for _, definition := range definitions {
+		schema[fmt.Sprintf("%s.%s", definition.Group, definition.Name)] = definition
+	}
+	return schema
+}
+
+// SettingRange is the range and precision the controller reports for a
+// numeric setting
+type SettingRange struct {
+	Min      RoundedFloat
+	Max      RoundedFloat
+	Decimals int64
+}
+
+// LoadSettingRanges asks the controller for the range of every numeric
+// setting in the schema and replaces the built-in ranges with them, as they
+// differ between boiler models. It returns the ranges read, keyed by
+// "<group>.<name>"; settings the controller reports no usable range for keep
+// their built-in one. A controller that fails to answer is not asked for the
+// remaining groups, so one without range support doesn't hold up startup
+// for every group.
+func (nbe *NBE) LoadSettingRanges() (map[string]SettingRange, error) {
+	var groups []string
+	for _, definition := range nbe.SettingSchema {
+		if definition.Type != EnumSetting && !slices.Contains(groups, definition.Group) {
+			groups = append(groups, definition.Group)
+		}
+	}
+	sort.Strings(groups)
+
+	ranges := make(map[string]SettingRange)
+	var failed error
+	for _, group := range groups {
+		response, err := nbe.Get(GetSetupRangeFunction, group+".*")
+		if err != nil {
+			failed = fmt.Errorf("%s: %w", group, err)
+			break
+		}
+		for name, setting := range parseSettingRanges(response.Payload) {
+			ranges[group+"."+name] = setting
+		}
+	}
+
+	return nbe.ApplySettingRanges(ranges), failed
+}
+
+// ApplySettingRanges replaces the ranges of the settings in the schema, such
+// as ranges read on a previous run, and returns the ones that were applied
+func (nbe *NBE) ApplySettingRanges(ranges map[string]SettingRange) map[string]SettingRange {
+	applied := make(map[string]SettingRange, len(ranges))
+	schema := make(map[string]SettingDefinition, len(nbe.SettingSchema))
+	for key, definition := range nbe.SettingSchema {
+		if setting, ok := ranges[key]; ok && definition.Type != EnumSetting {
+			definition.Min = setting.Min
+			definition.Max = setting.Max
+			definition.Decimals = setting.Decimals
+			if setting.Decimals > 0 {
+				definition.Type = FloatSetting
+			}
+			applied[key] = setting
+		}
+		schema[key] = definition
+	}
+	nbe.SettingSchema = schema
+	return applied
+}
+
+// parseSettingRanges reads the ranges in a get_setup_range payload, skipping
+// any that are incomplete or empty
+func parseSettingRanges(payload map[string]interface{}) map[string]SettingRange {
+	ranges := make(map[string]SettingRange)
+	for name, value := range payload {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		low, okLow := rangeNumber(fields["min"])
+		high, okHigh := rangeNumber(fields["max"])
+		decimals, okDecimals := rangeNumber(fields["decimals"])
+		if !okLow || !okHigh || !okDecimals || low > high || decimals < 0 {
+			continue
+		}
+		ranges[name] = SettingRange{Min: RoundedFloat(low), Max: RoundedFloat(high), Decimals: int64(decimals)}
+	}
+	return ranges
+}
+
+func rangeNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case RoundedFloat:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// WithoutDestructive returns schema without its destructive actions
+func WithoutDestructive(schema map[string]SettingDefinition) map[string]SettingDefinition {
+	kept := make(map[string]SettingDefinition, len(schema))
+	for key, definition := range schema {
+		if !definition.Destructive {
+			kept[key] = definition
+		}
+	}
+	return kept
+}
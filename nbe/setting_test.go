@@ -0,0 +1,123 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSettingDefinitionValidate(t *testing.T) {
+	schema := DefaultSettingSchema()
+
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"float in range", "boiler.temp", "65", false},
+		{"float with decimals", "boiler.temp", "65.5", false},
+		{"float above max", "boiler.temp", "90", true},
+		{"float below min", "hot_water.diff_under", "2", true},
+		{"not a number", "boiler.temp", "hot", true},
+		{"int in range", "regulation.boiler_power_max", "80", false},
+		{"int with fraction", "regulation.boiler_power_max", "80.5", true},
+		{"enum allowed", "misc.start", "1", false},
+		{"enum rejected", "misc.start", "0", true},
+		{"whitespace trimmed", "hopper.content", " 120 ", false},
+		{"NaN", "boiler.temp", "NaN", true},
+		{"hex float", "boiler.temp", "0x1p6", true},
+		{"exponent", "boiler.temp", "7e1", true},
+		{"zero padded", "boiler.temp", "0000000000000070", true},
+		{"injected key", "boiler.temp", "70;misc.start=1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting, ok := schema[tt.key]
+			if !ok {
+				t.Fatalf("Expected schema entry for %s", tt.key)
+			}
+			err := setting.Validate([]byte(tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSettingUnknownKey(t *testing.T) {
+	boiler := &NBE{SettingSchema: DefaultSettingSchema()}
+
+	err := boiler.ValidateSetting("boiler.self_destruct", []byte("1"))
+	if !errors.Is(err, ErrUnknownSetting) {
+		t.Errorf("Expected ErrUnknownSetting, got %v", err)
+	}
+	if err := boiler.ValidateSetting("boiler.temp", []byte("70")); err != nil {
+		t.Errorf("Expected boiler.temp=70 to be valid, got %v", err)
+	}
+}
+
+func TestWithoutDestructive(t *testing.T) {
+	schema := WithoutDestructive(DefaultSettingSchema())
+
+	for _, key := range []string{"misc.chimney_sweep", "misc.restart"} {
+		if _, ok := schema[key]; ok {
+			t.Errorf("Expected %s to be removed", key)
+		}
+	}
+	for _, key := range []string{"misc.reset_ash", "misc.compressor_clean", "misc.start"} {
+		if _, ok := schema[key]; !ok {
+			t.Errorf("Expected %s to be kept", key)
+		}
+	}
+}
+
+func TestLoadSettingRanges(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	mb.SetRange("boiler.temp", 10, 90, 0)
+	mb.SetRange("regulation.boiler_power_min", 10, 100, 1)
+	mb.SetRange("boiler.diff_under", 50, 0, 0) // unusable, min above max
+	mb.SetRange("weather.active", 0, 5, 0)     // enums keep their values
+
+	ranges, err := boiler.LoadSettingRanges()
+	if err != nil {
+		t.Fatalf("LoadSettingRanges() error = %v", err)
+	}
+	if len(ranges) != 2 {
+		t.Errorf("Expected 2 ranges, got %+v", ranges)
+	}
+
+	temp := boiler.SettingSchema["boiler.temp"]
+	if temp.Min != 10 || temp.Max != 90 || temp.Decimals != 0 {
+		t.Errorf("Expected boiler.temp to take the controller's range, got %+v", temp)
+	}
+	if err := boiler.ValidateSetting("boiler.temp", []byte("88")); err != nil {
+		t.Errorf("Expected 88 to be valid within the controller's range: %v", err)
+	}
+	if power := boiler.SettingSchema["regulation.boiler_power_min"]; power.Type != FloatSetting || power.Decimals != 1 {
+		t.Errorf("Expected a setting with decimals to become a float, got %+v", power)
+	}
+	if diff := boiler.SettingSchema["boiler.diff_under"]; diff.Min != 0 || diff.Max != 50 {
+		t.Errorf("Expected an unusable range to keep the built-in one, got %+v", diff)
+	}
+	if active := boiler.SettingSchema["weather.active"]; len(active.Enum) != 2 {
+		t.Errorf("Expected the enum to be unchanged, got %+v", active)
+	}
+}
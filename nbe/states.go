@@ -0,0 +1,178 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package nbe
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path"
+
+	yaml "go.yaml.in/yaml/v2"
+)
+
+//go:embed states.yaml
+var defaultStatesFile []byte
+
+// StateMapping maps power state numbers to their texts
+type StateMapping struct {
+	States map[int64]string `yaml:"states"`
+	// Off lists the states in which the boiler is off; empty keeps the
+	// states of the mapping applied before
+	Off []int64 `yaml:"off"`
+}
+
+// FirmwareStates is a state mapping applied to matching firmware versions
+type FirmwareStates struct {
+	// Version is a path.Match pattern of the firmware versions, e.g. "7.*"
+	Version      string `yaml:"version"`
+	StateMapping `yaml:",inline"`
+}
+
+// StateFile is a power state mapping file
+type StateFile struct {
+	Default  StateMapping     `yaml:"default"`
+	Firmware []FirmwareStates `yaml:"firmware"`
+}
+
+// StateTable resolves the power states of one firmware version. A nil
+// StateTable uses the embedded defaults.
+type StateTable struct {
+	texts map[int64]string
+	off   map[int64]bool
+	// translations apply to the texts reported by the controller
+	translations *Translations
+}
+
+var defaultStates = mustDefaultStates()
+
+func mustDefaultStates() *StateTable {
+	file, err := ParseStates(defaultStatesFile)
+	if err != nil {
+		panic(fmt.Sprintf("embedded states.yaml: %v", err))
+	}
+	return file.Table("")
+}
+
+// DefaultStates returns the embedded power states, which apply to any
+// firmware version
+func DefaultStates() *StateTable {
+	return defaultStates
+}
+
+// ParseStates parses a state mapping file
+func ParseStates(data []byte) (*StateFile, error) {
+	var file StateFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	for i, firmware := range file.Firmware {
+		if _, err := path.Match(firmware.Version, ""); err != nil || firmware.Version == "" {
+			return nil, fmt.Errorf("firmware[%d]: invalid version pattern %q", i, firmware.Version)
+		}
+	}
+	return &file, nil
+}
+
+// LoadStates returns the embedded state mappings with the file at filename,
+// if any, applied over them
+func LoadStates(filename string) (*StateFile, error) {
+	file, err := ParseStates(defaultStatesFile)
+	if err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return file, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	override, err := ParseStates(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	// the override's default applies to every version, after the embedded
+	// firmware mappings
+	file.Firmware = append(file.Firmware, FirmwareStates{Version: "*", StateMapping: override.Default})
+	file.Firmware = append(file.Firmware, override.Firmware...)
+	return file, nil
+}
+
+// Table returns the power states of firmware version: the default mapping
+// with each matching firmware mapping applied over it in order
+func (f *StateFile) Table(version string) *StateTable {
+	table := &StateTable{texts: make(map[int64]string), off: make(map[int64]bool)}
+	table.apply(f.Default)
+	for _, firmware := range f.Firmware {
+		if ok, _ := path.Match(firmware.Version, version); ok {
+			table.apply(firmware.StateMapping)
+		}
+	}
+	return table
+}
+
+func (t *StateTable) apply(mapping StateMapping) {
+	for state, text := range mapping.States {
+		t.texts[state] = text
+	}
+	if len(mapping.Off) > 0 {
+		t.off = make(map[int64]bool, len(mapping.Off))
+		for _, state := range mapping.Off {
+			t.off[state] = true
+		}
+	}
+}
+
+// Localize returns the table with its texts, and the texts passed to
+// Translate, translated with translations
+func (t *StateTable) Localize(translations *Translations) *StateTable {
+	if t == nil {
+		t = defaultStates
+	}
+	localized := &StateTable{texts: make(map[int64]string, len(t.texts)), off: t.off, translations: translations}
+	for state, text := range t.texts {
+		localized.texts[state] = translations.Text(text)
+	}
+	return localized
+}
+
+// Translate returns a text reported by the controller, such as an alarm
+// text, in the table's locale
+func (t *StateTable) Translate(text string) string {
+	if t == nil {
+		return text
+	}
+	return t.translations.Text(text)
+}
+
+// Text returns the text of state, or "" for an unknown state
+func (t *StateTable) Text(state int64) string {
+	if t == nil {
+		t = defaultStates
+	}
+	return t.texts[state]
+}
+
+// On reports whether the boiler is on in state
+func (t *StateTable) On(state int64) bool {
+	if t == nil {
+		t = defaultStates
+	}
+	return !t.off[state]
+}
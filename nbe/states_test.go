@@ -0,0 +1,98 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package nbe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultStates(t *testing.T) {
+	states := DefaultStates()
+	if text := states.Text(5); text != "Power" {
+		t.Errorf("Expected state 5 to be Power, got %q", text)
+	}
+	if text := states.Text(18); text != "" {
+		t.Errorf("Expected no text for state 18, got %q", text)
+	}
+	if states.On(14) || !states.On(5) {
+		t.Error("Expected only state 14 to be off")
+	}
+
+	var unset *StateTable
+	if unset.Text(14) != "Off" || unset.On(14) {
+		t.Error("Expected a nil table to use the defaults")
+	}
+}
+
+func TestLoadStates(t *testing.T) {
+	override := `default:
+  states:
+    5: Leistung
+    14: Aus
+firmware:
+  - version: "7.*"
+    off: [14, 32]
+    states:
+      32: Standby
+`
+	filename := filepath.Join(t.TempDir(), "states.yaml")
+	if err := os.WriteFile(filename, []byte(override), 0o600); err != nil {
+		t.Fatalf("Failed to write states file: %v", err)
+	}
+	file, err := LoadStates(filename)
+	if err != nil {
+		t.Fatalf("LoadStates: %v", err)
+	}
+
+	tests := []struct {
+		version string
+		state   int64
+		text    string
+		on      bool
+	}{
+		{"6.0.1", 5, "Leistung", true},
+		{"6.0.1", 6, "Pause", true},
+		{"6.0.1", 32, "", true},
+		{"7.2.0", 14, "Aus", false},
+		{"7.2.0", 32, "Standby", false},
+		{"", 14, "Aus", false},
+	}
+	for _, tt := range tests {
+		table := file.Table(tt.version)
+		if text := table.Text(tt.state); text != tt.text {
+			t.Errorf("Table(%q).Text(%d) = %q, want %q", tt.version, tt.state, text, tt.text)
+		}
+		if on := table.On(tt.state); on != tt.on {
+			t.Errorf("Table(%q).On(%d) = %v, want %v", tt.version, tt.state, on, tt.on)
+		}
+	}
+}
+
+func TestParseStatesRejectsInvalidFiles(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown field":   "default:\n  texts: {}\n",
+		"missing version": "firmware:\n  - states: {1: One}\n",
+		"invalid pattern": "firmware:\n  - version: \"[\"\n",
+		"invalid number":  "default:\n  states:\n    one: One\n",
+	} {
+		if _, err := ParseStates([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Response statuses the controller answers with
+const (
+	StatusOK uint8 = 0
+	// StatusDenied rejects a write the password is not allowed to make, such
+	// as an installer setting written with the user password
+	StatusDenied uint8 = 2
+)
+
+// ErrPermissionDenied is returned when the controller refuses a write for
+// the password it was sent with
+var ErrPermissionDenied = errors.New("permission denied")
+
+// StatusError is a write the controller rejected with a non-zero status
+type StatusError struct {
+	Path   string
+	Status uint8
+}
+
+func (e *StatusError) Error() string {
+	if e.Status == StatusDenied {
+		return fmt.Sprintf("%s: %v by the controller (status %d)", e.Path, ErrPermissionDenied, e.Status)
+	}
+	return fmt.Sprintf("%s: controller returned status %d", e.Path, e.Status)
+}
+
+// Unwrap lets errors.Is match ErrPermissionDenied
+func (e *StatusError) Unwrap() error {
+	if e.Status == StatusDenied {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// Code is a stable, machine-readable name for the failure
+func (e *StatusError) Code() string {
+	if e.Status == StatusDenied {
+		return "permission_denied"
+	}
+	return fmt.Sprintf("status_%d", e.Status)
+}
+
+// StatusErr returns the error for a write to path answered by response, or
+// nil once the controller accepted it
+func StatusErr(path string, response *NBEResponse) error {
+	if response.Status == StatusOK {
+		return nil
+	}
+	return &StatusError{Path: path, Status: response.Status}
+}
@@ -0,0 +1,90 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatusErr(t *testing.T) {
+	tests := []struct {
+		status uint8
+		code   string
+		denied bool
+	}{
+		{status: StatusOK},
+		{status: StatusDenied, code: "permission_denied", denied: true},
+		{status: 3, code: "status_3"},
+	}
+
+	for _, tt := range tests {
+		err := StatusErr("boiler.temp", &NBEResponse{Status: tt.status})
+		if tt.code == "" {
+			if err != nil {
+				t.Errorf("StatusErr(%d) = %v, want nil", tt.status, err)
+			}
+			continue
+		}
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("StatusErr(%d) = %v, want a *StatusError", tt.status, err)
+		}
+		if statusErr.Code() != tt.code {
+			t.Errorf("StatusErr(%d).Code() = %q, want %q", tt.status, statusErr.Code(), tt.code)
+		}
+		if errors.Is(err, ErrPermissionDenied) != tt.denied {
+			t.Errorf("errors.Is(StatusErr(%d), ErrPermissionDenied) = %v", tt.status, !tt.denied)
+		}
+	}
+}
+
+func TestSetRetriesWithInstallerPassword(t *testing.T) {
+	mb, boiler := newMockClient(t)
+	mb.ProtectSettings("5678", "boiler.temp")
+
+	response, err := boiler.Set("boiler.temp", []byte("70"))
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if response.Status != StatusDenied {
+		t.Errorf("Expected the user password to be denied, got status %d", response.Status)
+	}
+
+	var notified bool
+	boiler.OnWrite(func(path string, value []byte) {
+		notified = true
+	})
+	boiler.SetPasswords("1234", "5678")
+	response, err = boiler.Set("boiler.temp", []byte("70"))
+	if err != nil || response.Status != StatusOK {
+		t.Fatalf("Set() = %+v, %v with the installer password", response, err)
+	}
+	if !notified {
+		t.Error("Expected the retried write to notify write handlers")
+	}
+	if writes := mb.Writes(); len(writes) != 1 || writes[0] != "boiler.temp=70" {
+		t.Errorf("Unexpected writes %v", writes)
+	}
+
+	// settings the user password may write are not retried
+	mb.InjectStatus(3)
+	if response, err = boiler.Set("hot_water.temp", []byte("55")); err != nil || response.Status != 3 {
+		t.Errorf("Set() = %+v, %v, want status 3", response, err)
+	}
+}
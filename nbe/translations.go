@@ -0,0 +1,139 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+
+	yaml "go.yaml.in/yaml/v2"
+)
+
+//go:embed translations.yaml
+var defaultTranslationsFile []byte
+
+// Phrase is a text by locale code, e.g. "en" and "da"
+type Phrase map[string]string
+
+// Translations replace the texts the controller reports, in whatever
+// language its display is set to, with their text in one locale. A nil
+// Translations leaves texts as they are.
+type Translations struct {
+	Locale string
+	texts  map[string]string
+}
+
+// ParseTranslations parses a translation file, a list of phrases
+func ParseTranslations(data []byte) ([]Phrase, error) {
+	var phrases []Phrase
+	if err := yaml.UnmarshalStrict(data, &phrases); err != nil {
+		return nil, err
+	}
+	return phrases, nil
+}
+
+// LoadTranslations returns the translations to locale of the embedded
+// phrases and those in the file at filename, if any. An empty locale
+// returns nil, leaving texts as the controller reports them.
+func LoadTranslations(locale, filename string) (*Translations, error) {
+	if locale == "" {
+		return nil, nil
+	}
+	phrases, err := ParseTranslations(defaultTranslationsFile)
+	if err != nil {
+		return nil, err
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		extra, err := ParseTranslations(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", filename, err)
+		}
+		phrases = mergePhrases(phrases, extra)
+	}
+
+	translations := &Translations{Locale: locale, texts: make(map[string]string)}
+	for _, phrase := range phrases {
+		target := phrase[locale]
+		if target == "" {
+			continue
+		}
+		for _, text := range phrase {
+			translations.texts[translationKey(text)] = target
+		}
+	}
+	if len(translations.texts) == 0 {
+		return nil, fmt.Errorf("no translations to locale %q", locale)
+	}
+	return translations, nil
+}
+
+// mergePhrases adds the extra phrases to phrases. An extra phrase sharing a
+// text in the same locale with one of phrases is merged into it, its texts
+// replacing those of the same locales.
+func mergePhrases(phrases, extra []Phrase) []Phrase {
+	index := make(map[string]int)
+	add := func(i int) {
+		for locale, text := range phrases[i] {
+			index[locale+"\x00"+translationKey(text)] = i
+		}
+	}
+	for i := range phrases {
+		add(i)
+	}
+	for _, phrase := range extra {
+		merged := false
+		for locale, text := range phrase {
+			i, ok := index[locale+"\x00"+translationKey(text)]
+			if !ok {
+				continue
+			}
+			for locale, text := range phrase {
+				phrases[i][locale] = text
+			}
+			add(i)
+			merged = true
+			break
+		}
+		if !merged {
+			phrases = append(phrases, phrase)
+			add(len(phrases) - 1)
+		}
+	}
+	return phrases
+}
+
+func translationKey(text string) string {
+	return strings.ToLower(strings.TrimSpace(text))
+}
+
+// Text returns text in the locale, or text itself without a translation
+func (t *Translations) Text(text string) string {
+	if t == nil {
+		return text
+	}
+	if translated, ok := t.texts[translationKey(text)]; ok {
+		return translated
+	}
+	return text
+}
@@ -0,0 +1,92 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTranslations(t *testing.T) {
+	if translations, err := LoadTranslations("", ""); err != nil || translations != nil {
+		t.Fatalf("Expected no translations without a locale, got %v, %v", translations, err)
+	}
+
+	english, err := LoadTranslations("en", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := english.Text("Tænding 1"); text != "Ignition 1" {
+		t.Errorf("Expected the Danish text in English, got %q", text)
+	}
+	if text := english.Text(" zündung 2 "); text != "Ignition 2" {
+		t.Errorf("Expected the German text in English ignoring case and spaces, got %q", text)
+	}
+	if text := english.Text("Something new"); text != "Something new" {
+		t.Errorf("Expected an unknown text to be kept, got %q", text)
+	}
+
+	file := filepath.Join(t.TempDir(), "translations.yaml")
+	if err := os.WriteFile(file, []byte("- {en: Power, da: Drift}\n- {en: Cleaning, de: Reinigung}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	german, err := LoadTranslations("de", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := german.Text("Drift"); text != "Leistung" {
+		t.Errorf("Expected a phrase from the file to join the embedded one, got %q", text)
+	}
+	if text := german.Text("Cleaning"); text != "Reinigung" {
+		t.Errorf("Expected a phrase from the file, got %q", text)
+	}
+
+	if _, err := LoadTranslations("fr", ""); err == nil {
+		t.Error("Expected an error for a locale without translations")
+	}
+	if err := os.WriteFile(file, []byte("en: Power\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTranslations("en", file); err == nil {
+		t.Error("Expected an error for a file that is not a list of phrases")
+	}
+}
+
+func TestLocalizeStates(t *testing.T) {
+	translations, err := LoadTranslations("da", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := DefaultStates().Localize(translations)
+	if text := table.Text(5); text != "Effekt" {
+		t.Errorf("Expected state 5 in Danish, got %q", text)
+	}
+	if table.On(14) {
+		t.Error("Expected the off states to be kept")
+	}
+	if text := table.Translate("Door is open"); text != "Lågen er åben" {
+		t.Errorf("Expected the alarm text in Danish, got %q", text)
+	}
+	if DefaultStates().Text(5) != "Power" {
+		t.Error("Expected the default states to be left as they are")
+	}
+	if text := DefaultStates().Translate("Lågen er åben"); text != "Lågen er åben" {
+		t.Errorf("Expected no translation without a locale, got %q", text)
+	}
+}
@@ -18,7 +18,10 @@
 package nbe
 
 import (
+	"fmt"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 type RoundedFloat float64
@@ -31,6 +34,32 @@ func (r RoundedFloat) Equal(other RoundedFloat) bool {
 	return strconv.FormatFloat(float64(r), 'f', 2, 32) == strconv.FormatFloat(float64(other), 'f', 2, 32)
 }
 
+// ToFloat returns a numeric value read from the controller or derived from
+// one as a float64, and false for any other value
+func ToFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case RoundedFloat:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// ParseFloat is ToFloat that also accepts numbers written as text, such as
+// values received on MQTT
+func ParseFloat(value interface{}) (float64, bool) {
+	if text, ok := value.(string); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return f, err == nil
+	}
+	return ToFloat(value)
+}
+
 type Function int16
 
 const (
@@ -45,6 +74,7 @@ const (
 	GetEventLogFunction          Function = 8
 	GetInfoFunction              Function = 9
 	GetAvailableProgramsFunction Function = 10
+	GetLogFileFunction           Function = 11
 	UnknownFunction              Function = -1
 )
 
@@ -68,37 +98,48 @@ var Settings = []string{
 	"manual",
 }
 
-var PowerStates = []string{
-	"Wait a moment",
-	"Ignition 1",
-	"Ignition 1",
-	"Ignition 2",
-	"Ignition 2",
-	"Power",
-	"Pause",
-	"DHW",
-	"Temperature error boiler",
-	"Stopped - temperature reached",
-	"Summer stop",
-	"Alarm burner is too hot, do not restart before the problem is found !!",
-	"Plug is disconnected",
-	"Fault ignition",
-	"Off",
-	"Error boiler temp. sensor",
-	"Error photo sensor",
-	"Error burner temp. sensor",
-	"",
-	"Error on a motor output",
-	"Error no fire - out of pellets",
-	"",
-	"Stopped by external temperature",
-	"Stopped by timer",
-	"Stopped by external contact",
-	"Stopped by weather comp.",
-	"Fail on fan",
-	"Error no fire - adjustment low",
-	"Door is open",
-	"Overheat/auger disconnected",
-	"Stopped by cascade",
-	"Compressor failure",
+// CircuitSettings are the setup categories only present on controllers that
+// manage heating circuits
+var CircuitSettings = []string{
+	"district_heating",
+}
+
+// AuxHeaterSettings are the setup categories only present on controllers
+// driving an electric backup element
+var AuxHeaterSettings = []string{
+	"aux_heater",
+}
+
+// IsSettingsCategory reports whether category is one of the setup categories
+func IsSettingsCategory(category string) bool {
+	return slices.Contains(Settings, category) || slices.Contains(CircuitSettings, category) ||
+		slices.Contains(AuxHeaterSettings, category)
+}
+
+var functionNames = map[Function]string{
+	DiscoveryFunction:            "discovery",
+	GetSetupFunction:             "get_setup",
+	SetSetupFunction:             "set_setup",
+	GetSetupRangeFunction:        "get_setup_range",
+	GetOperatingDataFunction:     "get_operating_data",
+	GetAdvancedDataFunction:      "get_advanced_data",
+	GetConsumptionDataFunction:   "get_consumption_data",
+	GetChartDataFunction:         "get_chart_data",
+	GetEventLogFunction:          "get_event_log",
+	GetInfoFunction:              "get_info",
+	GetAvailableProgramsFunction: "get_available_programs",
+	GetLogFileFunction:           "get_log_file",
+}
+
+// functionName returns a readable name for function, used to name its spans
+func functionName(function Function) string {
+	if name, ok := functionNames[function]; ok {
+		return name
+	}
+	return fmt.Sprintf("function_%d", function)
+}
+
+// String returns the readable name of the function
+func (f Function) String() string {
+	return functionName(f)
 }
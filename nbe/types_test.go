@@ -0,0 +1,50 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import "testing"
+
+func TestToFloat(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected float64
+		ok       bool
+		parsed   float64
+		parsedOK bool
+	}{
+		{"int64", int64(42), 42, true, 42, true},
+		{"int", 7, 7, true, 7, true},
+		{"RoundedFloat", RoundedFloat(2.5), 2.5, true, 2.5, true},
+		{"float64", 1.25, 1.25, true, 1.25, true},
+		{"numeric string", " 21.5 ", 0, false, 21.5, true},
+		{"string", "hello", 0, false, 0, false},
+		{"nil", nil, 0, false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result, ok := ToFloat(tt.value); ok != tt.ok || result != tt.expected {
+				t.Errorf("ToFloat(%v) = %v, %v, want %v, %v", tt.value, result, ok, tt.expected, tt.ok)
+			}
+			if result, ok := ParseFloat(tt.value); ok != tt.parsedOK || result != tt.parsed {
+				t.Errorf("ParseFloat(%v) = %v, %v, want %v, %v", tt.value, result, ok, tt.parsed, tt.parsedOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// APModeHost is the controller host that stands for the WiFi dongle while it
+// is in setup mode, e.g. tcp://<serial>:<password>@ap
+const APModeHost = "ap"
+
+// DefaultPort is the UDP port the controller listens on
+const DefaultPort = "8483"
+
+// The settings holding the network the dongle joins when it leaves setup mode
+const (
+	WiFiSSIDSetting     = "wifi.ssid"
+	WiFiPasswordSetting = "wifi.password"
+)
+
+// resolveAPMode replaces the ap host with the dongle's address on the network
+// it has handed this host an address on
+func resolveAPMode(uri *url.URL) (*url.URL, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	host, err := apModeAddress(addrs)
+	if err != nil {
+		return nil, err
+	}
+	port := uri.Port()
+	if port == "" {
+		port = DefaultPort
+	}
+	resolved := *uri
+	resolved.Host = net.JoinHostPort(host, port)
+	return &resolved, nil
+}
+
+// apModeAddress returns the dongle's address, 192.168.<x>.1 on the first
+// local 192.168.<x>.0/24 network
+func apModeAddress(addrs []net.Addr) (string, error) {
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || ip[0] != 192 || ip[1] != 168 {
+			continue
+		}
+		return net.IPv4(192, 168, ip[2], 1).String(), nil
+	}
+	return "", errors.New("not connected to the WiFi dongle's setup network (no 192.168.x.x address)")
+}
+
+// ProvisionWiFi writes the home network the dongle joins when it leaves setup
+// mode. An empty password is an open network.
+func (nbe *NBE) ProvisionWiFi(ssid, password string) error {
+	if ssid == "" {
+		return errors.New("wifi: missing SSID")
+	}
+	for _, setting := range []struct {
+		path  string
+		value string
+	}{
+		{WiFiSSIDSetting, ssid},
+		{WiFiPasswordSetting, password},
+	} {
+		response, err := nbe.Set(setting.path, []byte(setting.value))
+		if errors.Is(err, ErrFrameTooLong) {
+			return fmt.Errorf("wifi: %s is too long to send to the controller", setting.path)
+		}
+		if err != nil {
+			return fmt.Errorf("wifi: failed to write %s: %w", setting.path, err)
+		}
+		if response.Status != 0 {
+			return fmt.Errorf("wifi: controller rejected %s with status %d", setting.path, response.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nbe
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAPModeAddress(t *testing.T) {
+	network := func(cidr string) net.Addr {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipNet.IP = ip
+		return ipNet
+	}
+
+	tests := []struct {
+		name     string
+		addrs    []net.Addr
+		expected string
+		wantErr  bool
+	}{
+		{"setup network", []net.Addr{network("127.0.0.1/8"), network("192.168.4.2/24")}, "192.168.4.1", false},
+		{"first match", []net.Addr{network("192.168.0.10/24"), network("192.168.4.2/24")}, "192.168.0.1", false},
+		{"ipv6 only", []net.Addr{network("::1/128"), network("fe80::1/64")}, "", true},
+		{"other network", []net.Addr{network("10.0.0.5/8")}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, err := apModeAddress(tt.addrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apModeAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.expected {
+				t.Errorf("apModeAddress() = %q, want %q", host, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProvisionWiFi(t *testing.T) {
+	mb, boiler := newMockClient(t)
+
+	if err := boiler.ProvisionWiFi("Home", "hunter22"); err != nil {
+		t.Fatalf("ProvisionWiFi() error = %v", err)
+	}
+	writes := mb.Writes()
+	if len(writes) != 2 || writes[0] != "wifi.ssid=Home" || writes[1] != "wifi.password=hunter22" {
+		t.Errorf("Unexpected writes %v", writes)
+	}
+
+	if err := boiler.ProvisionWiFi("", "hunter22"); err == nil {
+		t.Error("Expected an error without an SSID")
+	}
+	err := boiler.ProvisionWiFi(strings.Repeat("x", 32), "hunter22")
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("Expected a too long error, got %v", err)
+	}
+
+	mb.InjectStatus(1)
+	err = boiler.ProvisionWiFi("Home", "hunter22")
+	if err == nil || !strings.Contains(err.Error(), "status 1") {
+		t.Errorf("Expected the rejected write to fail, got %v", err)
+	}
+}
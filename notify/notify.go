@@ -0,0 +1,147 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package notify publishes the boiler's alarms and power state changes as
+// notifications, for automations that forward them to a phone.
+package notify
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/watchdog"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// topic is where notifications are published, below the MQTT prefix
+	topic = "notifications"
+	// maxHeld is how many held notifications are kept; older ones are dropped
+	maxHeld = 100
+)
+
+// Notification is a single published notification
+type Notification struct {
+	Time time.Time `json:"time"`
+	Kind bus.Kind  `json:"kind"`
+	// Critical notifications are never held back
+	Critical bool   `json:"critical"`
+	Text     string `json:"text"`
+	// Held is set on a notification delivered after quiet hours
+	Held bool `json:"held,omitempty"`
+}
+
+// Notifier publishes a notification on notifications/last for each alarm,
+// power state change and change in the watchdog's view of the controller.
+// Alarms and losing the controller are critical; other notifications are held
+// back while hold returns true and published once it no longer does.
+type Notifier struct {
+	mqttClient *mqtt.Client
+	hold       func() bool
+	publish    func(Notification) error
+
+	mu   sync.Mutex
+	held []Notification
+}
+
+// New creates a notifier publishing on mqttClient; hold may be nil
+func New(mqttClient *mqtt.Client, hold func() bool) *Notifier {
+	if hold == nil {
+		hold = func() bool { return false }
+	}
+	return &Notifier{
+		mqttClient: mqttClient,
+		hold:       hold,
+		publish: func(notification Notification) error {
+			return mqttClient.PublishJSON(topic+"/last", notification)
+		},
+	}
+}
+
+// Run subscribes to the bus and delivers the held notifications every minute
+// once they are no longer held
+func (n *Notifier) Run(eventBus *bus.Bus) {
+	eventBus.Subscribe(n.handle, bus.Alarm, bus.StateTransition, bus.ConnectivityChanged)
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			n.Flush()
+		}
+	}()
+}
+
+func (n *Notifier) handle(event bus.Event) {
+	notification := Notification{Time: event.Time, Kind: event.Kind, Critical: event.Kind == bus.Alarm}
+	switch event.Kind {
+	case bus.Alarm:
+		notification.Text = fmt.Sprintf("Alarm %v: %s", event.Value, event.Text)
+	case bus.StateTransition:
+		notification.Text = fmt.Sprintf("Boiler state changed to %s", event.Text)
+	case bus.ConnectivityChanged:
+		// only losing the controller is worth a notification; the others
+		// are connections the notification itself needs
+		if event.Key != watchdog.Key {
+			return
+		}
+		online, _ := event.Value.(bool)
+		notification.Text = event.Text
+		notification.Critical = !online
+	}
+
+	if !notification.Critical && n.hold() {
+		n.mu.Lock()
+		n.held = append(n.held, notification)
+		if len(n.held) > maxHeld {
+			n.held = n.held[len(n.held)-maxHeld:]
+		}
+		n.mu.Unlock()
+		return
+	}
+	n.send(notification)
+}
+
+// Flush publishes the held notifications, oldest first, unless they are still
+// held
+func (n *Notifier) Flush() {
+	if n.hold() {
+		return
+	}
+	n.mu.Lock()
+	held := n.held
+	n.held = nil
+	n.mu.Unlock()
+
+	for _, notification := range held {
+		notification.Held = true
+		n.send(notification)
+	}
+}
+
+// Held returns the number of notifications waiting to be published
+func (n *Notifier) Held() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.held)
+}
+
+func (n *Notifier) send(notification Notification) {
+	if err := n.publish(notification); err != nil {
+		log.Debugf("Failed to publish notification %q: %v", notification.Text, err)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package notify
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/watchdog"
+)
+
+func TestNotifierHoldsNonCritical(t *testing.T) {
+	quiet := true
+	var sent []Notification
+	n := New(nil, func() bool { return quiet })
+	n.publish = func(notification Notification) error {
+		sent = append(sent, notification)
+		return nil
+	}
+
+	n.handle(bus.Event{Kind: bus.StateTransition, Key: "state", Previous: int64(5), Value: int64(14), Text: "Off"})
+	n.handle(bus.Event{Kind: bus.Alarm, Key: "alarm", Value: int64(3), Text: "Ignition failed"})
+	if len(sent) != 1 || !sent[0].Critical || sent[0].Text != "Alarm 3: Ignition failed" {
+		t.Fatalf("Expected only the alarm during quiet hours, got %+v", sent)
+	}
+	if n.Held() != 1 {
+		t.Fatalf("Expected 1 held notification, got %d", n.Held())
+	}
+
+	n.Flush()
+	if len(sent) != 1 {
+		t.Fatalf("Expected nothing to be flushed while quiet, got %+v", sent)
+	}
+
+	quiet = false
+	n.Flush()
+	if len(sent) != 2 || !sent[1].Held || sent[1].Text != "Boiler state changed to Off" {
+		t.Fatalf("Expected the held notification after quiet hours, got %+v", sent)
+	}
+	if n.Held() != 0 {
+		t.Errorf("Expected no held notifications, got %d", n.Held())
+	}
+}
+
+func TestNotifierReportsTheLostController(t *testing.T) {
+	var sent []Notification
+	n := New(nil, func() bool { return true })
+	n.publish = func(notification Notification) error {
+		sent = append(sent, notification)
+		return nil
+	}
+
+	n.handle(bus.Event{Kind: bus.ConnectivityChanged, Key: "mqtt", Value: false})
+	n.handle(bus.Event{Kind: bus.ConnectivityChanged, Key: watchdog.Key, Value: false, Text: "The controller is unreachable"})
+	if len(sent) != 1 || !sent[0].Critical || sent[0].Text != "The controller is unreachable" {
+		t.Fatalf("Expected only the lost controller, sent at once, got %+v", sent)
+	}
+	n.handle(bus.Event{Kind: bus.ConnectivityChanged, Key: watchdog.Key, Value: true, Text: "The controller answers again"})
+	if len(sent) != 1 || n.Held() != 1 {
+		t.Errorf("Expected the recovery to be held, got %+v", sent)
+	}
+}
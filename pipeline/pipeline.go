@@ -0,0 +1,289 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package pipeline corrects the values of specific keys, such as an inverted
+// photo level or an offset temperature, and smooths noisy ones with steps
+// defined in the config.
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Pipelines holds the steps of every configured key. A nil Pipelines leaves
+// every value unchanged.
+type Pipelines struct {
+	steps map[string][]config.PipelineStep
+
+	mu sync.Mutex
+	// smoothing holds the readings of the smoothing steps of each key
+	smoothing map[string][]*smoothing
+}
+
+// smoothing is the state of an ema or median step
+type smoothing struct {
+	average  float64
+	seeded   bool
+	readings []float64
+}
+
+// New returns the pipelines keyed by <category>/<key>, or nil if there are none
+func New(pipelines map[string][]config.PipelineStep) *Pipelines {
+	if len(pipelines) == 0 {
+		return nil
+	}
+	return &Pipelines{steps: pipelines, smoothing: make(map[string][]*smoothing)}
+}
+
+// Read runs the pipelines of category over the values of payload in place
+func (p *Pipelines) Read(category string, payload map[string]interface{}) {
+	if p == nil {
+		return
+	}
+	for key, value := range payload {
+		name := category + "/" + key
+		steps, ok := p.steps[name]
+		if !ok {
+			continue
+		}
+		for i, step := range steps {
+			if step.EMA != nil || step.Median != nil {
+				value = p.smooth(name, i, step, value)
+			} else {
+				value = read(step, value)
+			}
+		}
+		payload[key] = value
+	}
+}
+
+// smooth runs the ema or median step i of a key over a new reading
+func (p *Pipelines) smooth(name string, i int, step config.PipelineStep, value interface{}) interface{} {
+	f, ok := nbe.ParseFloat(value)
+	if !ok {
+		return value
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	states := p.smoothing[name]
+	if states == nil {
+		states = make([]*smoothing, len(p.steps[name]))
+		p.smoothing[name] = states
+	}
+	if states[i] == nil {
+		states[i] = &smoothing{}
+	}
+	state := states[i]
+
+	if step.EMA != nil {
+		if !state.seeded {
+			state.average, state.seeded = f, true
+		} else {
+			state.average += *step.EMA * (f - state.average)
+		}
+		return nbe.RoundedFloat(state.average)
+	}
+
+	state.readings = append(state.readings, f)
+	if len(state.readings) > *step.Median {
+		state.readings = state.readings[len(state.readings)-*step.Median:]
+	}
+	sorted := slices.Sorted(slices.Values(state.readings))
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return nbe.RoundedFloat((sorted[middle-1] + sorted[middle]) / 2)
+	}
+	return nbe.RoundedFloat(sorted[middle])
+}
+
+// Write inverts the pipeline of path, in the form <category>.<key>, turning a
+// value written in its corrected form into the raw value for the controller
+func (p *Pipelines) Write(path string, value []byte) ([]byte, error) {
+	if p == nil {
+		return value, nil
+	}
+	steps, ok := p.steps[strings.Replace(path, ".", "/", 1)]
+	if !ok {
+		return value, nil
+	}
+
+	raw := strings.TrimSpace(string(value))
+	for i := len(steps) - 1; i >= 0; i-- {
+		var err error
+		if raw, err = write(steps[i], raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return []byte(raw), nil
+}
+
+// Display describes how the values of a key are published after its pipeline
+type Display struct {
+	// Unit is the unit of the key's last convert step, empty if it has none
+	Unit string
+	// Decimals is the precision of the key's last round step, -1 if it has none
+	Decimals int
+}
+
+// Display returns how the values of name, in the form <category>/<key>, are
+// published, and false if its pipeline neither converts nor rounds them
+func (p *Pipelines) Display(name string) (Display, bool) {
+	display := Display{Decimals: -1}
+	if p == nil {
+		return display, false
+	}
+	for _, step := range p.steps[name] {
+		if step.Convert != "" {
+			display.Unit = config.UnitConversions[step.Convert].Unit
+		}
+		if step.Round != nil {
+			display.Decimals = *step.Round
+		}
+	}
+	return display, display.Unit != "" || display.Decimals >= 0
+}
+
+// Range runs the scale, offset and convert steps of name over the ends of a
+// range of raw values, such as the limits of a setting, keeping low below high
+func (p *Pipelines) Range(name string, low, high float64) (float64, float64) {
+	if p == nil {
+		return low, high
+	}
+	for _, step := range p.steps[name] {
+		if step.Scale == nil && step.Offset == nil && step.Convert == "" {
+			continue
+		}
+		low, _ = nbe.ParseFloat(read(step, low))
+		high, _ = nbe.ParseFloat(read(step, high))
+	}
+	if low > high {
+		low, high = high, low
+	}
+	return low, high
+}
+
+// Unconvert undoes the convert steps of name, in the form <category>/<key>,
+// on a published value, returning it in the controller's unit. Corrections
+// such as offsets stay applied.
+func (p *Pipelines) Unconvert(name string, value float64) float64 {
+	if p == nil {
+		return value
+	}
+	steps := p.steps[name]
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].Convert != "" {
+			conversion := config.UnitConversions[steps[i].Convert]
+			value = (value - conversion.Offset) / conversion.Scale
+		}
+	}
+	return value
+}
+
+// read applies one step to a value read from the controller. Values a
+// numeric step cannot parse, such as names from an earlier map, pass through.
+func read(step config.PipelineStep, value interface{}) interface{} {
+	if step.Map != nil {
+		if name, ok := step.Map[format(value)]; ok {
+			return name
+		}
+		return value
+	}
+
+	f, ok := nbe.ParseFloat(value)
+	if !ok {
+		return value
+	}
+	switch {
+	case step.Scale != nil:
+		f *= *step.Scale
+	case step.Offset != nil:
+		f += *step.Offset
+	case step.Clamp != nil:
+		if step.Clamp.Min != nil {
+			f = math.Max(f, *step.Clamp.Min)
+		}
+		if step.Clamp.Max != nil {
+			f = math.Min(f, *step.Clamp.Max)
+		}
+	case step.Convert != "":
+		conversion := config.UnitConversions[step.Convert]
+		f = f*conversion.Scale + conversion.Offset
+	case step.Round != nil:
+		if *step.Round == 0 {
+			return int64(math.Round(f))
+		}
+		shift := math.Pow(10, float64(*step.Round))
+		f = math.Round(f*shift) / shift
+	}
+	return nbe.RoundedFloat(f)
+}
+
+// write undoes one step for a written value. Rounding and smoothing cannot be
+// undone and leave the value as written.
+func write(step config.PipelineStep, value string) (string, error) {
+	if step.Map != nil {
+		for raw, name := range step.Map {
+			if name == value {
+				return raw, nil
+			}
+		}
+		return value, nil
+	}
+	if step.Round != nil || step.EMA != nil || step.Median != nil {
+		return value, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid number %q", value)
+	}
+	switch {
+	case step.Scale != nil:
+		f /= *step.Scale
+	case step.Offset != nil:
+		f -= *step.Offset
+	case step.Convert != "":
+		// settings take at most one decimal
+		conversion := config.UnitConversions[step.Convert]
+		return strconv.FormatFloat(math.Round((f-conversion.Offset)/conversion.Scale*10)/10, 'f', -1, 64), nil
+	case step.Clamp != nil:
+		if (step.Clamp.Min != nil && f < *step.Clamp.Min) || (step.Clamp.Max != nil && f > *step.Clamp.Max) {
+			return "", fmt.Errorf("%s is outside the clamped range", value)
+		}
+	}
+	// drop the float noise of undoing a scale, e.g. 21.3/0.1
+	return strconv.FormatFloat(math.Round(f*1e6)/1e6, 'f', -1, 64), nil
+}
+
+// format renders a raw value the way it is written in a map step
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,209 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func float(f float64) *float64 { return &f }
+
+func decimals(n int) *int { return &n }
+
+func testPipelines() *Pipelines {
+	return New(map[string][]config.PipelineStep{
+		"operating_data/photo_level": {
+			{Scale: float(-1)},
+			{Offset: float(100)},
+		},
+		"boiler/temp": {
+			{Offset: float(-1.5)},
+			{Clamp: &config.ValueRange{Min: float(0), Max: float(85)}},
+			{Round: decimals(0)},
+		},
+		"operating_data/power_kw": {
+			{Scale: float(0.1)},
+			{Round: decimals(1)},
+		},
+		"hot_water/temp": {
+			{Convert: "c_to_f"},
+			{Round: decimals(0)},
+		},
+		"hot_water/mode": {
+			{Map: map[string]string{"0": "off", "1": "eco", "2": "comfort"}},
+		},
+	})
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		category string
+		key      string
+		value    interface{}
+		want     interface{}
+	}{
+		{"operating_data", "photo_level", int64(30), nbe.RoundedFloat(70)},
+		{"operating_data", "power_kw", int64(213), nbe.RoundedFloat(21.3)},
+		{"boiler", "temp", "65", int64(64)},
+		{"boiler", "temp", nbe.RoundedFloat(90), int64(85)},
+		{"hot_water", "temp", int64(55), int64(131)},
+		{"hot_water", "mode", int64(1), "eco"},
+		{"hot_water", "mode", int64(7), int64(7)},
+		{"boiler", "effect_min", int64(30), int64(30)},
+		{"operating_data", "state", "unknown", "unknown"},
+	}
+
+	p := testPipelines()
+	for _, tt := range tests {
+		t.Run(tt.category+"/"+tt.key, func(t *testing.T) {
+			payload := map[string]interface{}{tt.key: tt.value}
+			p.Read(tt.category, payload)
+			if payload[tt.key] != tt.want {
+				t.Errorf("Read(%v) = %#v, want %#v", tt.value, payload[tt.key], tt.want)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		path    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"boiler.temp", "64", "65.5", false},
+		{"boiler.temp", " 70 ", "71.5", false},
+		{"boiler.temp", "90", "", true},
+		{"boiler.temp", "warm", "", true},
+		{"operating_data.power_kw", "21.3", "213", false},
+		{"operating_data.photo_level", "70", "30", false},
+		{"hot_water.temp", "131", "55", false},
+		{"hot_water.temp", "120", "48.9", false},
+		{"hot_water.mode", "comfort", "2", false},
+		{"hot_water.mode", "2", "2", false},
+		{"boiler.effect_min", "30", "30", false},
+	}
+
+	p := testPipelines()
+	for _, tt := range tests {
+		t.Run(tt.path+"="+tt.value, func(t *testing.T) {
+			got, err := p.Write(tt.path, []byte(tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write(%s=%q) error = %v, wantErr %v", tt.path, tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("Write(%s=%q) = %q, want %q", tt.path, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayAndRange(t *testing.T) {
+	p := testPipelines()
+	if display, ok := p.Display("hot_water/temp"); !ok || display.Unit != "°F" || display.Decimals != 0 {
+		t.Errorf("Display(hot_water/temp) = %+v, %v, want °F with 0 decimals", display, ok)
+	}
+	if display, ok := p.Display("operating_data/photo_level"); ok {
+		t.Errorf("Display(operating_data/photo_level) = %+v, want none", display)
+	}
+	if low, high := p.Range("hot_water/temp", 0, 85); low != 32 || high != 185 {
+		t.Errorf("Range(hot_water/temp) = %v, %v, want 32, 185", low, high)
+	}
+	if low, high := p.Range("operating_data/photo_level", 0, 100); low != 0 || high != 100 {
+		t.Errorf("Range(operating_data/photo_level) = %v, %v, want 0, 100", low, high)
+	}
+	if got := p.Unconvert("hot_water/temp", 131); got != 55 {
+		t.Errorf("Unconvert(hot_water/temp) = %v, want 55", got)
+	}
+	if got := p.Unconvert("boiler/temp", 64); got != 64 {
+		t.Errorf("Unconvert(boiler/temp) = %v, want 64", got)
+	}
+}
+
+func TestSmoothing(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []config.PipelineStep
+		readings []interface{}
+		want     []nbe.RoundedFloat
+	}{
+		{
+			"ema",
+			[]config.PipelineStep{{EMA: float(0.5)}},
+			[]interface{}{nbe.RoundedFloat(8), nbe.RoundedFloat(10), int64(4), "n/a"},
+			[]nbe.RoundedFloat{8, 9, 6.5, 6.5},
+		},
+		{
+			"median",
+			[]config.PipelineStep{{Median: decimals(3)}},
+			[]interface{}{int64(50), int64(90), int64(52), int64(51), int64(10), int64(49)},
+			[]nbe.RoundedFloat{50, 70, 52, 52, 51, 49},
+		},
+		{
+			"median then ema",
+			[]config.PipelineStep{{Median: decimals(3)}, {EMA: float(0.5)}},
+			[]interface{}{int64(6), int64(6), int64(30), int64(8)},
+			[]nbe.RoundedFloat{6, 6, 6, 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(map[string][]config.PipelineStep{"operating_data/oxygen": tt.steps})
+			last := nbe.RoundedFloat(0)
+			for i, reading := range tt.readings {
+				payload := map[string]interface{}{"oxygen": reading}
+				p.Read("operating_data", payload)
+				if got, ok := payload["oxygen"].(nbe.RoundedFloat); ok {
+					last = got
+				}
+				if last != tt.want[i] {
+					t.Errorf("Reading %d (%v) = %v, want %v", i, reading, payload["oxygen"], tt.want[i])
+				}
+			}
+		})
+	}
+
+	p := New(map[string][]config.PipelineStep{"operating_data/oxygen": {{EMA: float(0.2)}}})
+	if got, err := p.Write("operating_data.oxygen", []byte("7.5")); err != nil || string(got) != "7.5" {
+		t.Errorf("Write() = %q, %v; want the value as written", got, err)
+	}
+}
+
+func TestNilPipelines(t *testing.T) {
+	var p *Pipelines
+	if New(nil) != nil {
+		t.Error("Expected no pipelines without configuration")
+	}
+
+	payload := map[string]interface{}{"temp": int64(65)}
+	p.Read("boiler", payload)
+	if payload["temp"] != int64(65) {
+		t.Errorf("Expected the value unchanged, got %v", payload["temp"])
+	}
+	if got, err := p.Write("boiler.temp", []byte("65")); err != nil || string(got) != "65" {
+		t.Errorf("Write() = %q, %v", got, err)
+	}
+	if got := p.Unconvert("boiler/temp", 65); got != 65 {
+		t.Errorf("Unconvert() = %v", got)
+	}
+}
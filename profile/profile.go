@@ -0,0 +1,181 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package profile applies named bundles of settings, such as "eco", "comfort"
+// or "away", as one batch and keeps track of the profile in effect.
+package profile
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// None is published as the active profile while no profile is in effect,
+// which Home Assistant shows as unknown
+const None = "None"
+
+// ApplyFunc writes settings, keyed by <category>.<name>, as one batch
+type ApplyFunc func(ctx context.Context, values map[string]string) ([]nbe.BatchWrite, error)
+
+// Baseline is the active profile and the values it wrote, kept across
+// restarts
+type Baseline struct {
+	Active  string            `json:"active,omitempty"`
+	Written map[string]string `json:"written,omitempty"`
+}
+
+// Profiles applies the configured profiles and tracks the active one: the
+// profile applied last, until one of its settings is changed to another
+// value
+type Profiles struct {
+	profiles map[string]map[string]string
+	apply    ApplyFunc
+	eventBus *bus.Bus
+
+	applyMutex sync.Mutex // held while a profile is applied
+	mu         sync.Mutex
+	active     string
+	written    map[string]string
+	applying   bool
+}
+
+// New returns the profiles, keyed by name, applied through apply
+func New(eventBus *bus.Bus, profiles map[string]map[string]string, apply ApplyFunc) *Profiles {
+	return &Profiles{
+		profiles: profiles,
+		apply:    apply,
+		eventBus: eventBus,
+	}
+}
+
+// Names returns the profile names in order
+func (p *Profiles) Names() []string {
+	names := make([]string, 0, len(p.profiles))
+	for name := range p.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Active returns the profile in effect, or "" if there is none
+func (p *Profiles) Active() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// Apply writes the settings of the named profile as one batch and makes it
+// the active profile. If the batch is rolled back, the active profile stays
+// as it was.
+func (p *Profiles) Apply(ctx context.Context, name string) error {
+	values, ok := p.profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	p.applyMutex.Lock()
+	defer p.applyMutex.Unlock()
+	p.mu.Lock()
+	p.applying = true
+	p.mu.Unlock()
+	writes, err := p.apply(ctx, values)
+
+	p.mu.Lock()
+	p.applying = false
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	p.active = name
+	p.written = make(map[string]string, len(writes))
+	for _, write := range writes {
+		p.written[write.Path] = write.Value
+	}
+	p.mu.Unlock()
+
+	log.Infof("Applied the %s profile", name)
+	p.Publish()
+	return nil
+}
+
+// Written is called with every write the controller accepts. A write that
+// changes a setting of the active profile to another value ends it.
+func (p *Profiles) Written(path string, value []byte) {
+	p.mu.Lock()
+	want, ok := p.written[path]
+	if p.applying || p.active == "" || !ok || nbe.SameValue(value, want) {
+		p.mu.Unlock()
+		return
+	}
+	log.Infof("The %s profile is no longer in effect: %s was changed to %s", p.active, path, value)
+	p.active, p.written = "", nil
+	p.mu.Unlock()
+	p.Publish()
+}
+
+// Publish publishes the active profile on profile/active
+func (p *Profiles) Publish() {
+	active := p.Active()
+	if active == "" {
+		active = None
+	}
+	p.eventBus.Publish(bus.Event{
+		Kind:       bus.ValueChanged,
+		Category:   "profile",
+		Values:     map[string]interface{}{"active": active},
+		Guaranteed: true,
+	})
+}
+
+// Run applies the profile named in the messages on profile/set
+func (p *Profiles) Run(mqttClient *mqtt.Client) error {
+	return mqttClient.Subscribe("profile/set", 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		name := string(msg.Payload())
+		ctx := nbe.WithSource(context.Background(), "mqtt:"+msg.Topic())
+		if err := p.Apply(ctx, name); err != nil {
+			log.Warnf("Failed to apply a profile: %v", err)
+			// the select in Home Assistant reverts to the profile in effect
+			p.Publish()
+		}
+	})
+}
+
+// Baseline returns the active profile to keep across restarts
+func (p *Profiles) Baseline() Baseline {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Baseline{Active: p.active, Written: p.written}
+}
+
+// Restore makes a profile kept from a previous run active again, unless it
+// is no longer configured
+func (p *Profiles) Restore(baseline Baseline) {
+	if _, ok := p.profiles[baseline.Active]; !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active, p.written = baseline.Active, baseline.Written
+}
@@ -0,0 +1,123 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package profile
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// newTestProfiles returns profiles whose batches succeed unless they write
+// boiler.temp 90, and the active profiles published
+func newTestProfiles(t *testing.T) (*Profiles, *[]string) {
+	eventBus := bus.New()
+	var published []string
+	eventBus.Subscribe(func(event bus.Event) {
+		if event.Category == "profile" {
+			published = append(published, event.Values["active"].(string))
+		}
+	}, bus.ValueChanged)
+
+	apply := func(_ context.Context, values map[string]string) ([]nbe.BatchWrite, error) {
+		if values["boiler.temp"] == "90" {
+			return nil, errors.New("rolled back")
+		}
+		var writes []nbe.BatchWrite
+		for path, value := range values {
+			writes = append(writes, nbe.BatchWrite{Path: path, Value: value})
+		}
+		return writes, nil
+	}
+	return New(eventBus, map[string]map[string]string{
+		"eco":     {"boiler.temp": "60", "hot_water.temp": "45"},
+		"comfort": {"boiler.temp": "70", "hot_water.temp": "55"},
+		"broken":  {"boiler.temp": "90"},
+	}, apply), &published
+}
+
+func TestApply(t *testing.T) {
+	profiles, published := newTestProfiles(t)
+
+	if names := profiles.Names(); len(names) != 3 || names[0] != "broken" || names[2] != "eco" {
+		t.Errorf("Expected the names in order, got %v", names)
+	}
+	if err := profiles.Apply(context.Background(), "eco"); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if profiles.Active() != "eco" {
+		t.Errorf("Expected eco to be active, got %q", profiles.Active())
+	}
+
+	if err := profiles.Apply(context.Background(), "broken"); err == nil {
+		t.Error("Expected the rolled back profile to fail")
+	}
+	if err := profiles.Apply(context.Background(), "away"); err == nil {
+		t.Error("Expected an unknown profile to fail")
+	}
+	if profiles.Active() != "eco" {
+		t.Errorf("Expected eco to stay active, got %q", profiles.Active())
+	}
+	if len(*published) != 1 || (*published)[0] != "eco" {
+		t.Errorf("Expected eco to be published, got %v", *published)
+	}
+}
+
+func TestWrittenEndsProfile(t *testing.T) {
+	profiles, published := newTestProfiles(t)
+	if err := profiles.Apply(context.Background(), "comfort"); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles.Written("boiler.temp", []byte("70.0"))
+	profiles.Written("boiler.diff_over", []byte("20"))
+	if profiles.Active() != "comfort" {
+		t.Errorf("Expected comfort to stay active, got %q", profiles.Active())
+	}
+
+	profiles.Written("hot_water.temp", []byte("50"))
+	if profiles.Active() != "" {
+		t.Errorf("Expected no active profile, got %q", profiles.Active())
+	}
+	if got := *published; len(got) != 2 || got[1] != None {
+		t.Errorf("Expected %s to be published, got %v", None, got)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	profiles, _ := newTestProfiles(t)
+	profiles.Restore(Baseline{Active: "away"})
+	if profiles.Active() != "" {
+		t.Errorf("Expected a profile no longer configured to be ignored, got %q", profiles.Active())
+	}
+
+	profiles.Restore(Baseline{Active: "eco", Written: map[string]string{"boiler.temp": "60"}})
+	if profiles.Active() != "eco" {
+		t.Errorf("Expected eco to be restored, got %q", profiles.Active())
+	}
+	profiles.Written("boiler.temp", []byte("65"))
+	if profiles.Active() != "" {
+		t.Errorf("Expected the restored profile to end, got %q", profiles.Active())
+	}
+	if baseline := profiles.Baseline(); baseline.Active != "" || baseline.Written != nil {
+		t.Errorf("Expected an empty baseline, got %+v", baseline)
+	}
+}
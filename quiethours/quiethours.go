@@ -0,0 +1,117 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package quiethours keeps the boiler quiet during a daily window, for
+// boilers installed next to bedrooms: polling slows down and the manual
+// commands that run the auger or start the boiler are refused.
+package quiethours
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrQuietHours is returned for a command refused during quiet hours
+var ErrQuietHours = errors.New("refused during quiet hours")
+
+// Hours is the quiet hours window. A nil Hours is never quiet.
+type Hours struct {
+	// PollInterval is how often operating data is polled while quiet
+	PollInterval time.Duration
+	// Block lists path.Match patterns of the setting keys refused while quiet
+	Block []string
+
+	window scheduler.Window
+	now    func() time.Time
+}
+
+// New returns the quiet hours of cfg, or nil if they are disabled
+func New(cfg config.QuietHoursConfig) *Hours {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Hours{
+		PollInterval: cfg.PollInterval,
+		Block:        cfg.Block,
+		window: scheduler.Window{
+			Start:     cfg.Start,
+			End:       cfg.End,
+			Latitude:  cfg.Latitude,
+			Longitude: cfg.Longitude,
+		},
+		now: time.Now,
+	}
+}
+
+// Active reports whether it is quiet now. A window that cannot be resolved,
+// such as sunset during the polar day, is never quiet.
+func (h *Hours) Active() bool {
+	if h == nil {
+		return false
+	}
+	inside, err := h.window.Contains(h.now())
+	if err != nil {
+		log.Debugf("Quiet hours: %v", err)
+		return false
+	}
+	return inside
+}
+
+// Poll returns the interval to wait before the next poll, normally interval
+// and the longer quiet interval while quiet
+func (h *Hours) Poll(interval time.Duration) time.Duration {
+	if h.Active() && h.PollInterval > interval {
+		return h.PollInterval
+	}
+	return interval
+}
+
+// Check returns an error wrapping ErrQuietHours if writing the setting key,
+// in the form <category>.<key>, is refused now
+func (h *Hours) Check(key string) error {
+	if !h.Active() {
+		return nil
+	}
+	for _, pattern := range h.Block {
+		if ok, _ := path.Match(pattern, key); ok {
+			return fmt.Errorf("%s: %w", key, ErrQuietHours)
+		}
+	}
+	return nil
+}
+
+// Run publishes whether it is quiet on quiet_hours/active every minute
+func (h *Hours) Run(mqttClient *mqtt.Client) {
+	go func() {
+		for {
+			active := "OFF"
+			if h.Active() {
+				active = "ON"
+			}
+			if err := mqttClient.PublishMany("quiet_hours", map[string]interface{}{"active": active}); err != nil {
+				log.Debugf("Failed to publish the quiet hours state: %v", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
@@ -0,0 +1,80 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package quiethours
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/config"
+)
+
+func newTestHours(now time.Time) *Hours {
+	hours := New(config.QuietHoursConfig{
+		Enabled:      true,
+		Start:        "22:00",
+		End:          "07:00",
+		PollInterval: 30 * time.Second,
+		Block:        []string{"manual.*", "misc.start"},
+	})
+	hours.now = func() time.Time { return now }
+	return hours
+}
+
+func TestHours(t *testing.T) {
+	tests := []struct {
+		name      string
+		at        string
+		key       string
+		wantQuiet bool
+		wantPoll  time.Duration
+		wantErr   bool
+	}{
+		{"daytime", "12:00", "misc.start", false, 5 * time.Second, false},
+		{"evening", "22:30", "misc.start", true, 30 * time.Second, true},
+		{"after midnight", "03:00", "manual.auger", true, 30 * time.Second, true},
+		{"unblocked key", "03:00", "boiler.temp", true, 30 * time.Second, false},
+		{"morning", "07:00", "manual.auger", false, 5 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock, _ := time.Parse("15:04", tt.at)
+			hours := newTestHours(time.Date(2024, 3, 10, clock.Hour(), clock.Minute(), 0, 0, time.UTC))
+			if got := hours.Active(); got != tt.wantQuiet {
+				t.Errorf("Active() = %v, want %v", got, tt.wantQuiet)
+			}
+			if got := hours.Poll(5 * time.Second); got != tt.wantPoll {
+				t.Errorf("Poll() = %s, want %s", got, tt.wantPoll)
+			}
+			if err := hours.Check(tt.key); (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrQuietHours)) {
+				t.Errorf("Check(%q) = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDisabledHours(t *testing.T) {
+	hours := New(config.QuietHoursConfig{Start: "00:00", End: "00:00", Block: []string{"*"}})
+	if hours != nil {
+		t.Fatal("Expected no quiet hours when disabled")
+	}
+	if hours.Active() || hours.Poll(time.Second) != time.Second || hours.Check("misc.start") != nil {
+		t.Error("Expected nil quiet hours to never be quiet")
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package remap republishes the bridge's values on topics and in payload
+// formats of the user's choosing, rendered with Go templates, for setups
+// that expect their own topic tree or JSON envelope.
+package remap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// funcs are the functions available to the templates besides the builtins
+var funcs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// replace takes the string last, so it can be piped: {{.Key | replace "_" "-"}}
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+}
+
+// Data is what the topic and payload templates are rendered with
+type Data struct {
+	// Prefix is the bridge's MQTT prefix
+	Prefix   string
+	Category string
+	Key      string
+	// Value is the payload published on the bridge's own topic, e.g. 21.30
+	Value string
+	// Raw is the value itself, for the json function
+	Raw  interface{}
+	Time time.Time
+}
+
+// Rule republishes the values whose <category>/<key> matches its pattern
+type Rule struct {
+	match   string
+	topic   *template.Template
+	payload *template.Template
+}
+
+// Compile parses a rule: match is a path.Match pattern of <category>/<key>,
+// empty for every value, and topic and payload are templates rendered with
+// Data. An empty payload publishes the value as the bridge does.
+func Compile(match, topic, payload string) (*Rule, error) {
+	if _, err := path.Match(match, ""); err != nil {
+		return nil, fmt.Errorf("invalid match %q: %w", match, err)
+	}
+	if topic == "" {
+		return nil, errors.New("topic is required")
+	}
+	rule := &Rule{match: match}
+	var err error
+	if rule.topic, err = template.New("topic").Funcs(funcs).Parse(topic); err != nil {
+		return nil, err
+	}
+	if payload != "" {
+		if rule.payload, err = template.New("payload").Funcs(funcs).Parse(payload); err != nil {
+			return nil, err
+		}
+	}
+	// fields that don't exist only show when rendering
+	sample := Data{Category: "operating_data", Key: "boiler_temp", Value: "0", Raw: 0, Time: time.Now()}
+	for _, t := range []*template.Template{rule.topic, rule.payload} {
+		if _, err := execute(t, sample); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule republishes key of category
+func (r *Rule) matches(category, key string) bool {
+	if r.match == "" {
+		return true
+	}
+	ok, _ := path.Match(r.match, category+"/"+key)
+	return ok
+}
+
+// render returns the topic and payload of a value
+func (r *Rule) render(data Data) (string, string, error) {
+	topic, err := execute(r.topic, data)
+	if err != nil {
+		return "", "", err
+	}
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return "", "", fmt.Errorf("invalid topic %q", topic)
+	}
+	if r.payload == nil {
+		return topic, data.Value, nil
+	}
+	payload, err := execute(r.payload, data)
+	if err != nil {
+		return "", "", err
+	}
+	return topic, payload, nil
+}
+
+// execute renders t, if there is one, with data
+func execute(t *template.Template, data Data) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Remapper publishes every value changed on the bus with the first rule
+// matching it; values no rule matches are only published on the bridge's
+// own topics
+type Remapper struct {
+	prefix  string
+	rules   []*Rule
+	publish func(topic string, val interface{}) error
+}
+
+// New creates a remapper publishing with mqttClient
+func New(mqttClient *mqtt.Client, rules []*Rule) *Remapper {
+	return &Remapper{prefix: mqttClient.Prefix, rules: rules, publish: mqttClient.PublishRaw}
+}
+
+// Run republishes the value changes on the bus
+func (r *Remapper) Run(eventBus *bus.Bus) {
+	eventBus.SubscribeQueued("remap", 256, r.Handle, bus.ValueChanged)
+}
+
+// Handle republishes the changed values of an event
+func (r *Remapper) Handle(event bus.Event) {
+	for key, value := range event.Values {
+		rule := r.rule(event.Category, key)
+		if rule == nil {
+			continue
+		}
+		topic, payload, err := rule.render(Data{
+			Prefix:   r.prefix,
+			Category: event.Category,
+			Key:      key,
+			Value:    text(value),
+			Raw:      value,
+			Time:     event.Time,
+		})
+		if err != nil {
+			log.Debugf("Failed to render the template of %s/%s: %v", event.Category, key, err)
+			continue
+		}
+		if err := r.publish(topic, payload); err != nil {
+			log.Debugf("Failed to publish %s: %v", topic, err)
+		}
+	}
+}
+
+func (r *Remapper) rule(category, key string) *Rule {
+	for _, rule := range r.rules {
+		if rule.matches(category, key) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// text returns value as the bridge publishes it: strings as they are, other
+// values as JSON
+func text(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
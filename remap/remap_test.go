@@ -0,0 +1,84 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package remap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestRemapperPublishesWithTheFirstMatchingRule(t *testing.T) {
+	var rules []*Rule
+	for _, spec := range [][3]string{
+		{"operating_data/boiler_temp", "house/heating/boiler/temperature", `{"value": {{json .Raw}}, "time": "{{.Time.Format "15:04"}}"}`},
+		{"operating_data/*", "house/heating/{{.Category}}/{{.Key | replace \"_\" \"-\"}}", ""},
+	} {
+		rule, err := Compile(spec[0], spec[1], spec[2])
+		if err != nil {
+			t.Fatalf("Compile(%q) error = %v", spec[1], err)
+		}
+		rules = append(rules, rule)
+	}
+	published := make(map[string]interface{})
+	r := &Remapper{prefix: "nbe/1234", rules: rules, publish: func(topic string, val interface{}) error {
+		published[topic] = val
+		return nil
+	}}
+
+	r.Handle(bus.Event{
+		Kind:     bus.ValueChanged,
+		Time:     time.Date(2024, 1, 10, 8, 30, 0, 0, time.UTC),
+		Category: "operating_data",
+		Values: map[string]interface{}{
+			"boiler_temp": nbe.RoundedFloat(65.5),
+			"state_text":  "Power",
+			"power_kw":    nbe.RoundedFloat(12),
+		},
+	})
+	r.Handle(bus.Event{Kind: bus.ValueChanged, Category: "boiler", Values: map[string]interface{}{"temp": int64(70)}})
+
+	want := map[string]interface{}{
+		"house/heating/boiler/temperature":        `{"value": 65.50, "time": "08:30"}`,
+		"house/heating/operating_data/state-text": "Power",
+		"house/heating/operating_data/power-kw":   "12.00",
+	}
+	if len(published) != len(want) {
+		t.Errorf("Expected %v, got %v", want, published)
+	}
+	for topic, payload := range want {
+		if published[topic] != payload {
+			t.Errorf("%s: expected %v, got %v", topic, payload, published[topic])
+		}
+	}
+}
+
+func TestCompileRejectsInvalidRules(t *testing.T) {
+	for name, spec := range map[string][3]string{
+		"bad pattern":   {"[", "a/b", ""},
+		"no topic":      {"", "", ""},
+		"syntax":        {"", "a/{{.Key", ""},
+		"unknown field": {"", "a/b", "{{.Unit}}"},
+	} {
+		if _, err := Compile(spec[0], spec[1], spec[2]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// revertRetry is how long a boost whose setpoint could not be restored waits
+// before trying again
+var revertRetry = time.Minute
+
+// Boost temporarily raises a setpoint by a delta and reverts it once the
+// boost period has elapsed
+type Boost struct {
+	Name string
+	Key  string
+
+	mqttClient *mqtt.Client
+	setpoint   setpoint
+	now        func() time.Time
+
+	mu       sync.Mutex
+	delta    float64
+	duration time.Duration
+	original float64
+	until    time.Time
+	timer    *time.Timer
+}
+
+// NewBoost creates a boost for the setup key (e.g. "hot_water.temp"), publishing
+// its state below scheduler/<name>
+func NewBoost(boiler *nbe.NBE, mqttClient *mqtt.Client, name, key string, delta float64, duration time.Duration) *Boost {
+	return &Boost{
+		Name:       name,
+		Key:        key,
+		mqttClient: mqttClient,
+		setpoint:   newSetpoint(boiler, name, key),
+		now:        time.Now,
+		delta:      delta,
+		duration:   duration,
+	}
+}
+
+// Run subscribes to the boost command topics and publishes the remaining boost
+// time every minute
+func (b *Boost) Run() error {
+	topic := fmt.Sprintf("scheduler/%s", b.Name)
+	// only the command topics: the state published below topic would come
+	// back as echoes
+	for _, command := range []string{"/start", "/cancel", "/+/set"} {
+		if err := b.mqttClient.Subscribe(topic+command, 1, func(client *mqtt.Client, msg mqtt.Message) {
+			b.handleCommand(msg.Topic(), msg.Payload())
+		}); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			b.publish()
+			time.Sleep(time.Minute)
+		}
+	}()
+	return nil
+}
+
+func (b *Boost) handleCommand(topic string, payload []byte) {
+	prefix := fmt.Sprintf("%s/scheduler/%s/", b.mqttClient.Prefix, b.Name)
+	if len(topic) <= len(prefix) {
+		return
+	}
+
+	var err error
+	switch topic[len(prefix):] {
+	case "start":
+		err = b.Start()
+	case "cancel":
+		err = b.Cancel()
+	case "preset/set":
+		// Climate presets: "boost" starts the boost, anything else ("none") cancels it
+		if string(payload) == "boost" {
+			err = b.Start()
+		} else {
+			err = b.Cancel()
+		}
+	case "delta/set":
+		var delta float64
+		if delta, err = strconv.ParseFloat(string(payload), 64); err == nil {
+			b.mu.Lock()
+			b.delta = delta
+			b.mu.Unlock()
+		}
+	case "duration/set":
+		var minutes float64
+		if minutes, err = strconv.ParseFloat(string(payload), 64); err == nil {
+			b.mu.Lock()
+			b.duration = time.Duration(minutes * float64(time.Minute))
+			b.mu.Unlock()
+		}
+	default:
+		return
+	}
+	if err != nil {
+		log.Errorf("Boost %s command %s failed: %v", b.Name, topic, err)
+	}
+	b.publish()
+}
+
+// Start raises the setpoint by the configured delta. Starting an active boost
+// extends it without raising the setpoint again.
+func (b *Boost) Start() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer == nil {
+		current, err := b.setpoint.get()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", b.Key, err)
+		}
+		if err := b.setpoint.set(current + b.delta); err != nil {
+			return fmt.Errorf("raising %s: %w", b.Key, err)
+		}
+		b.original = current
+		log.Infof("Boost %s raised %s from %v to %v for %s", b.Name, b.Key, current, current+b.delta, b.duration)
+	} else {
+		b.timer.Stop()
+	}
+
+	b.arm(b.duration)
+	return nil
+}
+
+// arm ends the boost after d. Must be called with b.mu held.
+func (b *Boost) arm(d time.Duration) {
+	b.until = b.now().Add(d)
+	b.timer = time.AfterFunc(d, func() {
+		if err := b.Cancel(); err != nil {
+			log.Errorf("Boost %s failed to revert: %v", b.Name, err)
+		}
+		b.publish()
+	})
+}
+
+// Cancel ends an active boost and restores the original setpoint. If the
+// setpoint cannot be restored, the boost stays active and the restore is
+// tried again after revertRetry.
+func (b *Boost) Cancel() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer == nil {
+		return nil
+	}
+	b.timer.Stop()
+	if err := b.setpoint.set(b.original); err != nil {
+		b.arm(revertRetry)
+		return fmt.Errorf("reverting %s, retrying in %s: %w", b.Key, revertRetry, err)
+	}
+	b.timer = nil
+	b.until = time.Time{}
+	log.Infof("Boost %s restored %s to %v", b.Name, b.Key, b.original)
+	return nil
+}
+
+// Remaining returns the time left on the active boost
+func (b *Boost) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer == nil {
+		return 0
+	}
+	remaining := b.until.Sub(b.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (b *Boost) publish() {
+	if b.mqttClient == nil {
+		return
+	}
+
+	b.mu.Lock()
+	values := map[string]interface{}{
+		"delta":    nbe.RoundedFloat(b.delta),
+		"duration": int64(b.duration / time.Minute),
+	}
+	b.mu.Unlock()
+
+	remaining := b.Remaining()
+	values["remaining"] = int64(math.Ceil(remaining.Minutes()))
+	values["active"] = onOff(remaining > 0)
+	values["preset"] = "none"
+	if remaining > 0 {
+		values["preset"] = "boost"
+	}
+
+	if err := b.mqttClient.PublishMany(fmt.Sprintf("scheduler/%s", b.Name), values); err != nil {
+		log.Debugf("Failed to publish boost %s: %v", b.Name, err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSetpoint struct {
+	mu     sync.Mutex
+	value  float64
+	writes []float64
+}
+
+func (f *fakeSetpoint) get() (float64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.value, nil
+}
+
+func (f *fakeSetpoint) set(value float64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.value = value
+	f.writes = append(f.writes, value)
+	return nil
+}
+
+func (f *fakeSetpoint) current() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.value
+}
+
+func newTestBoost(sp *fakeSetpoint, delta float64, duration time.Duration) *Boost {
+	return &Boost{
+		Name:     "dhw_boost",
+		Key:      "hot_water.temp",
+		setpoint: setpoint{get: sp.get, set: sp.set},
+		now:      time.Now,
+		delta:    delta,
+		duration: duration,
+	}
+}
+
+func TestBoostStartAndCancel(t *testing.T) {
+	sp := &fakeSetpoint{value: 50}
+	boost := newTestBoost(sp, 10, time.Hour)
+
+	if err := boost.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if sp.current() != 60 {
+		t.Errorf("Expected setpoint 60 during boost, got %v", sp.current())
+	}
+	if boost.Remaining() <= 59*time.Minute {
+		t.Errorf("Expected about an hour remaining, got %v", boost.Remaining())
+	}
+
+	if err := boost.Cancel(); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	if sp.current() != 50 {
+		t.Errorf("Expected setpoint restored to 50, got %v", sp.current())
+	}
+	if boost.Remaining() != 0 {
+		t.Errorf("Expected no time remaining, got %v", boost.Remaining())
+	}
+}
+
+func TestBoostRestartExtendsWithoutRaisingAgain(t *testing.T) {
+	sp := &fakeSetpoint{value: 50}
+	boost := newTestBoost(sp, 10, time.Hour)
+
+	if err := boost.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := boost.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if sp.current() != 60 {
+		t.Errorf("Expected setpoint 60 after second start, got %v", sp.current())
+	}
+	if err := boost.Cancel(); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	if len(sp.writes) != 2 {
+		t.Errorf("Expected 2 writes, got %v", sp.writes)
+	}
+}
+
+func TestBoostRevertsAutomatically(t *testing.T) {
+	sp := &fakeSetpoint{value: 45}
+	boost := newTestBoost(sp, 5, 20*time.Millisecond)
+
+	if err := boost.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sp.current() != 45 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sp.current() != 45 {
+		t.Errorf("Expected setpoint reverted to 45, got %v", sp.current())
+	}
+	if boost.Remaining() != 0 {
+		t.Errorf("Expected no time remaining, got %v", boost.Remaining())
+	}
+}
+
+func TestBoostRetriesFailedRevert(t *testing.T) {
+	defer func(retry time.Duration) { revertRetry = retry }(revertRetry)
+	revertRetry = 20 * time.Millisecond
+
+	sp := &fakeSetpoint{value: 50}
+	failures := 1
+	b := newTestBoost(sp, 10, time.Hour)
+	b.setpoint.set = func(value float64) error {
+		if value == 50 && failures > 0 {
+			failures--
+			return errors.New("refused")
+		}
+		return sp.set(value)
+	}
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := b.Cancel(); err == nil {
+		t.Fatal("Expected the failed revert to be reported")
+	}
+	if b.Remaining() == 0 {
+		t.Error("Expected the boost to stay active until the setpoint is restored")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sp.current() != 50 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sp.current() != 50 || b.Remaining() != 0 {
+		t.Errorf("Expected the revert to be retried, setpoint %v, remaining %s", sp.current(), b.Remaining())
+	}
+}
+
+func TestBoostStartFailsWhenReadFails(t *testing.T) {
+	boost := &Boost{
+		Key: "hot_water.temp",
+		setpoint: setpoint{
+			get: func() (float64, error) { return 0, errors.New("timeout") },
+			set: func(float64) error { t.Error("Unexpected write"); return nil },
+		},
+		now:      time.Now,
+		delta:    10,
+		duration: time.Hour,
+	}
+
+	if err := boost.Start(); err == nil {
+		t.Error("Expected error when the setpoint cannot be read")
+	}
+	if boost.Remaining() != 0 {
+		t.Errorf("Expected boost to stay inactive, got %v remaining", boost.Remaining())
+	}
+}
@@ -0,0 +1,354 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenMeteoURL is the Open-Meteo forecast endpoint
+var OpenMeteoURL = "https://api.open-meteo.com/v1/forecast"
+
+// ForecastPoint is the forecast outdoor temperature in °C at a time
+type ForecastPoint struct {
+	Time time.Time
+	Temp float64
+}
+
+// PreheatRule raises the setpoint by Delta while the forecast drops below
+// Below within the next Within. With Start set the boiler is also started
+// when the rule comes into effect.
+type PreheatRule struct {
+	Below  float64
+	Within time.Duration
+	Delta  float64
+	Start  bool
+}
+
+// Preheat raises a setpoint ahead of forecast cold snaps and restores it
+// once none of its rules match. It can be switched off at runtime through
+// MQTT.
+type Preheat struct {
+	Name string
+	Key  string
+
+	mqttClient *mqtt.Client
+	setpoint   setpoint
+	start      func() error
+	now        func() time.Time
+	rules      []PreheatRule
+
+	mu       sync.Mutex
+	forecast []ForecastPoint
+	enabled  bool
+	applied  float64
+	started  bool
+	original float64
+}
+
+// NewPreheat creates a preheat for the setup key (e.g. "boiler.temp"),
+// publishing its state below scheduler/<name>
+func NewPreheat(boiler *nbe.NBE, mqttClient *mqtt.Client, name, key string, rules []PreheatRule) *Preheat {
+	ctx := nbe.WithSource(context.Background(), "scheduler:"+name)
+	return &Preheat{
+		Name:       name,
+		Key:        key,
+		mqttClient: mqttClient,
+		setpoint:   newSetpoint(boiler, name, key),
+		start: func() error {
+			response, err := boiler.SetContext(ctx, "misc.start", []byte("1"))
+			if err != nil {
+				return err
+			}
+			return nbe.StatusErr("misc.start", response)
+		},
+		now:     time.Now,
+		rules:   rules,
+		enabled: true,
+	}
+}
+
+// Run subscribes to the enable switch and checks the forecast every minute
+func (p *Preheat) Run() error {
+	if err := p.mqttClient.Subscribe(fmt.Sprintf("scheduler/%s/enabled/set", p.Name), 1, func(client *mqtt.Client, msg mqtt.Message) {
+		p.SetEnabled(string(msg.Payload()) == "ON")
+		p.update()
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			p.update()
+			time.Sleep(time.Minute)
+		}
+	}()
+	return nil
+}
+
+// SetEnabled arms or disarms the preheat; a disarmed preheat is restored on
+// the next evaluation
+func (p *Preheat) SetEnabled(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enabled = enabled
+}
+
+// SetForecast replaces the forecast the rules are evaluated against
+func (p *Preheat) SetForecast(forecast []ForecastPoint) {
+	sorted := append([]ForecastPoint(nil), forecast...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	p.mu.Lock()
+	p.forecast = sorted
+	p.mu.Unlock()
+}
+
+// FollowMQTT takes the forecast from a JSON array published on a full topic.
+// Each entry holds a time ("time" or "datetime", RFC 3339) and a temperature
+// ("temp" or "temperature"), so Home Assistant's weather forecasts can be
+// forwarded as they are.
+func (p *Preheat) FollowMQTT(mqttClient *mqtt.Client, topic string) error {
+	return mqttClient.SubscribeTopic(topic, 1, func(_ *mqtt.Client, msg mqtt.Message) {
+		forecast, err := parseForecast(msg.Payload())
+		if err != nil {
+			log.Warnf("Ignoring forecast on %s: %v", topic, err)
+			return
+		}
+		p.SetForecast(forecast)
+		p.update()
+	})
+}
+
+// FollowOpenMeteo fetches the hourly forecast at a location from Open-Meteo
+// every interval
+func (p *Preheat) FollowOpenMeteo(latitude, longitude float64, interval time.Duration) {
+	query := url.Values{
+		"latitude":      {strconv.FormatFloat(latitude, 'f', -1, 64)},
+		"longitude":     {strconv.FormatFloat(longitude, 'f', -1, 64)},
+		"hourly":        {"temperature_2m"},
+		"forecast_days": {"2"},
+		"timezone":      {"UTC"},
+	}
+	endpoint := OpenMeteoURL + "?" + query.Encode()
+	go func() {
+		for {
+			forecast, err := fetchOpenMeteo(endpoint)
+			if err != nil {
+				log.Warnf("Failed to fetch the forecast from Open-Meteo: %v", err)
+			} else {
+				p.SetForecast(forecast)
+				p.update()
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func parseForecast(payload []byte) ([]ForecastPoint, error) {
+	var entries []struct {
+		Time        *time.Time `json:"time"`
+		Datetime    *time.Time `json:"datetime"`
+		Temp        *float64   `json:"temp"`
+		Temperature *float64   `json:"temperature"`
+	}
+	if err := json.Unmarshal(payload, &entries); err != nil {
+		return nil, err
+	}
+
+	forecast := make([]ForecastPoint, 0, len(entries))
+	for i, entry := range entries {
+		at, temp := entry.Time, entry.Temp
+		if at == nil {
+			at = entry.Datetime
+		}
+		if temp == nil {
+			temp = entry.Temperature
+		}
+		if at == nil || temp == nil {
+			return nil, fmt.Errorf("entry %d needs a time and a temperature", i)
+		}
+		forecast = append(forecast, ForecastPoint{Time: *at, Temp: *temp})
+	}
+	return forecast, nil
+}
+
+func fetchOpenMeteo(endpoint string) ([]ForecastPoint, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Open-Meteo returned %s", resp.Status)
+	}
+	var doc struct {
+		Hourly struct {
+			Time        []string   `json:"time"`
+			Temperature []*float64 `json:"temperature_2m"`
+		} `json:"hourly"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 256*1024)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing Open-Meteo response: %w", err)
+	}
+	if len(doc.Hourly.Time) != len(doc.Hourly.Temperature) {
+		return nil, fmt.Errorf("Open-Meteo returned %d times and %d temperatures", len(doc.Hourly.Time), len(doc.Hourly.Temperature))
+	}
+
+	forecast := make([]ForecastPoint, 0, len(doc.Hourly.Time))
+	for i, s := range doc.Hourly.Time {
+		if doc.Hourly.Temperature[i] == nil {
+			continue
+		}
+		at, err := time.Parse("2006-01-02T15:04", s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Open-Meteo time %q: %w", s, err)
+		}
+		forecast = append(forecast, ForecastPoint{Time: at, Temp: *doc.Hourly.Temperature[i]})
+	}
+	return forecast, nil
+}
+
+func (p *Preheat) update() {
+	if err := p.Evaluate(); err != nil {
+		log.Errorf("Preheat %s: %v", p.Name, err)
+	}
+	p.publish()
+}
+
+// match returns the rule with the largest delta whose cold snap is forecast
+// within its lookahead
+func (p *Preheat) match(now time.Time) (PreheatRule, bool) {
+	var best PreheatRule
+	found := false
+	for _, rule := range p.rules {
+		if low, ok := p.lowest(now, rule.Within); !ok || low >= rule.Below {
+			continue
+		}
+		if !found || rule.Delta > best.Delta {
+			best, found = rule, true
+		}
+	}
+	return best, found
+}
+
+// lowest returns the lowest forecast temperature between now and now+within
+func (p *Preheat) lowest(now time.Time, within time.Duration) (float64, bool) {
+	low, found := math.Inf(1), false
+	for _, point := range p.forecast {
+		if point.Time.Before(now.Truncate(time.Hour)) || point.Time.After(now.Add(within)) {
+			continue
+		}
+		low, found = math.Min(low, point.Temp), true
+	}
+	return low, found
+}
+
+// Evaluate raises, adjusts or restores the setpoint according to the
+// forecast
+func (p *Preheat) Evaluate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rule, found := p.match(p.now())
+	want := 0.0
+	if p.enabled && found {
+		want = rule.Delta
+	}
+
+	if want != p.applied {
+		if p.applied == 0 {
+			current, err := p.setpoint.get()
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", p.Key, err)
+			}
+			p.original = current
+		}
+		if err := p.setpoint.set(p.original + want); err != nil {
+			return fmt.Errorf("setting %s: %w", p.Key, err)
+		}
+		p.applied = want
+		if want == 0 {
+			log.Infof("Preheat %s restored %s to %v", p.Name, p.Key, p.original)
+		} else {
+			log.Infof("Preheat %s raised %s from %v to %v ahead of forecast below %v", p.Name, p.Key, p.original, p.original+want, rule.Below)
+		}
+	}
+
+	switch {
+	case p.enabled && found && rule.Start && !p.started:
+		if err := p.start(); err != nil {
+			return fmt.Errorf("starting the boiler: %w", err)
+		}
+		p.started = true
+		log.Infof("Preheat %s started the boiler ahead of forecast below %v", p.Name, rule.Below)
+	case !(p.enabled && found && rule.Start):
+		p.started = false
+	}
+	return nil
+}
+
+// Active reports whether the setpoint is currently raised
+func (p *Preheat) Active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.applied != 0
+}
+
+func (p *Preheat) publish() {
+	if p.mqttClient == nil {
+		return
+	}
+
+	p.mu.Lock()
+	values := map[string]interface{}{
+		"enabled": onOff(p.enabled),
+		"active":  onOff(p.applied != 0),
+		"delta":   p.applied,
+	}
+	var lookahead time.Duration
+	for _, rule := range p.rules {
+		if rule.Within > lookahead {
+			lookahead = rule.Within
+		}
+	}
+	if low, ok := p.lowest(p.now(), lookahead); ok {
+		values["forecast_min"] = low
+	}
+	p.mu.Unlock()
+
+	if err := p.mqttClient.PublishMany(fmt.Sprintf("scheduler/%s", p.Name), values); err != nil {
+		log.Debugf("Failed to publish preheat %s: %v", p.Name, err)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestPreheat(sp *fakeSetpoint, now *time.Time, rules ...PreheatRule) (*Preheat, *int) {
+	starts := 0
+	return &Preheat{
+		Name:     "preheat",
+		Key:      "boiler.temp",
+		setpoint: setpoint{get: sp.get, set: sp.set},
+		start: func() error {
+			starts++
+			return nil
+		},
+		now:     func() time.Time { return *now },
+		rules:   rules,
+		enabled: true,
+	}, &starts
+}
+
+func hourlyForecast(from time.Time, temps ...float64) []ForecastPoint {
+	forecast := make([]ForecastPoint, len(temps))
+	for i, temp := range temps {
+		forecast[i] = ForecastPoint{Time: from.Add(time.Duration(i) * time.Hour), Temp: temp}
+	}
+	return forecast
+}
+
+func TestPreheatEvaluate(t *testing.T) {
+	sp := &fakeSetpoint{value: 70}
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	preheat, starts := newTestPreheat(sp, &now,
+		PreheatRule{Below: -5, Within: 6 * time.Hour, Delta: 5},
+		PreheatRule{Below: -15, Within: 12 * time.Hour, Delta: 10, Start: true},
+	)
+
+	// -8 °C in 4 hours matches the first rule only
+	preheat.SetForecast(hourlyForecast(now, 2, 0, -3, -6, -8, -7, -6, -4, -2, 0, 1, 1, 2))
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 75 || !preheat.Active() || *starts != 0 {
+		t.Errorf("Expected setpoint raised to 75 without a start, got %v (active=%v, starts=%d)", sp.current(), preheat.Active(), *starts)
+	}
+
+	// A deeper cold snap switches to the larger delta from the original
+	preheat.SetForecast(hourlyForecast(now, 2, 0, -3, -6, -8, -10, -12, -14, -16, -18, -17, -15, -12))
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 80 || *starts != 1 {
+		t.Errorf("Expected setpoint raised to 80 and one start, got %v (starts=%d)", sp.current(), *starts)
+	}
+
+	// The start is only sent once while the rule keeps matching
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if *starts != 1 || len(sp.writes) != 2 {
+		t.Errorf("Expected no further writes, got starts=%d writes=%v", *starts, sp.writes)
+	}
+
+	preheat.SetForecast(hourlyForecast(now, 5, 5, 5))
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 70 || preheat.Active() {
+		t.Errorf("Expected setpoint restored to 70, got %v (active=%v)", sp.current(), preheat.Active())
+	}
+}
+
+func TestPreheatIgnoresColdBeyondLookahead(t *testing.T) {
+	sp := &fakeSetpoint{value: 70}
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	preheat, _ := newTestPreheat(sp, &now, PreheatRule{Below: -5, Within: 3 * time.Hour, Delta: 5})
+
+	preheat.SetForecast(hourlyForecast(now, 0, 0, 0, 0, -10))
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if preheat.Active() {
+		t.Error("Expected no preheat for cold forecast beyond the lookahead")
+	}
+
+	now = now.Add(time.Hour)
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if !preheat.Active() {
+		t.Error("Expected preheat once the cold is within the lookahead")
+	}
+}
+
+func TestPreheatDisabledRestores(t *testing.T) {
+	sp := &fakeSetpoint{value: 70}
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	preheat, _ := newTestPreheat(sp, &now, PreheatRule{Below: -5, Within: 6 * time.Hour, Delta: 5})
+	preheat.SetForecast(hourlyForecast(now, -10))
+
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	preheat.SetEnabled(false)
+	if err := preheat.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 70 {
+		t.Errorf("Expected setpoint restored to 70 after disabling, got %v", sp.current())
+	}
+}
+
+func TestParseForecast(t *testing.T) {
+	payload := []byte(`[
+		{"time": "2024-01-10T12:00:00Z", "temp": -3.5},
+		{"datetime": "2024-01-10T13:00:00+00:00", "temperature": -4}
+	]`)
+	forecast, err := parseForecast(payload)
+	if err != nil {
+		t.Fatalf("parseForecast() error = %v", err)
+	}
+	if len(forecast) != 2 || forecast[0].Temp != -3.5 || forecast[1].Temp != -4 {
+		t.Fatalf("Unexpected forecast %+v", forecast)
+	}
+	if !forecast[1].Time.Equal(time.Date(2024, 1, 10, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected time %v", forecast[1].Time)
+	}
+
+	if _, err := parseForecast([]byte(`[{"temp": 1}]`)); err == nil {
+		t.Error("Expected an error for an entry without a time")
+	}
+}
+
+func TestFetchOpenMeteo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("hourly") != "temperature_2m" {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"hourly": {"time": ["2024-01-10T12:00", "2024-01-10T13:00", "2024-01-10T14:00"], "temperature_2m": [-1.5, null, -2.5]}}`)
+	}))
+	defer server.Close()
+
+	forecast, err := fetchOpenMeteo(server.URL + "?hourly=temperature_2m")
+	if err != nil {
+		t.Fatalf("fetchOpenMeteo() error = %v", err)
+	}
+	if len(forecast) != 2 || forecast[1].Temp != -2.5 {
+		t.Fatalf("Unexpected forecast %+v", forecast)
+	}
+	if !forecast[1].Time.Equal(time.Date(2024, 1, 10, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected time %v", forecast[1].Time)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Window is a daily period bounded by clock times ("22:00") or by "sunset"
+// and "sunrise", which need the location's coordinates
+type Window struct {
+	Start     string
+	End       string
+	Latitude  float64
+	Longitude float64
+}
+
+// Contains reports whether t falls inside the window. Windows that end before
+// they start wrap around midnight.
+func (w Window) Contains(t time.Time) (bool, error) {
+	start, err := w.resolve(w.Start, t)
+	if err != nil {
+		return false, err
+	}
+	end, err := w.resolve(w.End, t)
+	if err != nil {
+		return false, err
+	}
+	if start.Before(end) {
+		return !t.Before(start) && t.Before(end), nil
+	}
+	return !t.Before(start) || t.Before(end), nil
+}
+
+// resolve returns the time of spec on the day of t
+func (w Window) resolve(spec string, t time.Time) (time.Time, error) {
+	switch spec {
+	case "sunrise", "sunset":
+		sunrise, sunset, ok := sunTimes(t, w.Latitude, w.Longitude)
+		if !ok {
+			return time.Time{}, fmt.Errorf("no %s on %s at %v,%v", spec, t.Format("2006-01-02"), w.Latitude, w.Longitude)
+		}
+		if spec == "sunrise" {
+			return sunrise, nil
+		}
+		return sunset, nil
+	}
+
+	clock, err := time.Parse("15:04", spec)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", spec)
+	}
+	y, m, d := t.Date()
+	return time.Date(y, m, d, clock.Hour(), clock.Minute(), 0, 0, t.Location()), nil
+}
+
+// NightSetback lowers a setpoint by a delta while inside a daily window and
+// restores it afterwards. It can be switched off at runtime through MQTT.
+type NightSetback struct {
+	Name string
+	Key  string
+
+	mqttClient *mqtt.Client
+	setpoint   setpoint
+	now        func() time.Time
+	window     Window
+
+	mu       sync.Mutex
+	delta    float64
+	enabled  bool
+	applied  bool
+	original float64
+}
+
+// NewNightSetback creates a setback for the setup key (e.g. "boiler.temp"),
+// publishing its state below scheduler/<name>
+func NewNightSetback(boiler *nbe.NBE, mqttClient *mqtt.Client, name, key string, delta float64, window Window) *NightSetback {
+	return &NightSetback{
+		Name:       name,
+		Key:        key,
+		mqttClient: mqttClient,
+		setpoint:   newSetpoint(boiler, name, key),
+		now:        time.Now,
+		window:     window,
+		delta:      delta,
+		enabled:    true,
+	}
+}
+
+// Run subscribes to the enable switch and checks the window every minute
+func (n *NightSetback) Run() error {
+	if err := n.mqttClient.Subscribe(fmt.Sprintf("scheduler/%s/enabled/set", n.Name), 1, func(client *mqtt.Client, msg mqtt.Message) {
+		n.SetEnabled(string(msg.Payload()) == "ON")
+		n.update()
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			n.update()
+			time.Sleep(time.Minute)
+		}
+	}()
+	return nil
+}
+
+// SetEnabled arms or disarms the setback; a disarmed setback is restored on
+// the next evaluation
+func (n *NightSetback) SetEnabled(enabled bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.enabled = enabled
+}
+
+func (n *NightSetback) update() {
+	if err := n.Evaluate(); err != nil {
+		log.Errorf("Night setback %s: %v", n.Name, err)
+	}
+	n.publish()
+}
+
+// Evaluate lowers or restores the setpoint according to the window
+func (n *NightSetback) Evaluate() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	inside, err := n.window.Contains(n.now())
+	if err != nil {
+		return err
+	}
+	want := n.enabled && inside
+
+	switch {
+	case want && !n.applied:
+		current, err := n.setpoint.get()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", n.Key, err)
+		}
+		if err := n.setpoint.set(current - n.delta); err != nil {
+			return fmt.Errorf("lowering %s: %w", n.Key, err)
+		}
+		n.original = current
+		n.applied = true
+		log.Infof("Night setback %s lowered %s from %v to %v", n.Name, n.Key, current, current-n.delta)
+	case !want && n.applied:
+		if err := n.setpoint.set(n.original); err != nil {
+			return fmt.Errorf("restoring %s: %w", n.Key, err)
+		}
+		n.applied = false
+		log.Infof("Night setback %s restored %s to %v", n.Name, n.Key, n.original)
+	}
+	return nil
+}
+
+// Active reports whether the setpoint is currently lowered
+func (n *NightSetback) Active() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applied
+}
+
+func (n *NightSetback) publish() {
+	if n.mqttClient == nil {
+		return
+	}
+
+	n.mu.Lock()
+	values := map[string]interface{}{
+		"enabled": onOff(n.enabled),
+		"active":  onOff(n.applied),
+	}
+	n.mu.Unlock()
+
+	if err := n.mqttClient.PublishMany(fmt.Sprintf("scheduler/%s", n.Name), values); err != nil {
+		log.Debugf("Failed to publish night setback %s: %v", n.Name, err)
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
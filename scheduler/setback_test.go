@@ -0,0 +1,142 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	// London on the March 2024 equinox: sunrise 06:04 UTC, sunset 18:14 UTC
+	day := time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC)
+	sunrise, sunset, ok := sunTimes(day, 51.5074, -0.1278)
+	if !ok {
+		t.Fatal("Expected sunrise and sunset in London")
+	}
+
+	expectedRise := time.Date(2024, 3, 20, 6, 4, 0, 0, time.UTC)
+	expectedSet := time.Date(2024, 3, 20, 18, 14, 0, 0, time.UTC)
+	if d := sunrise.Sub(expectedRise); d < -5*time.Minute || d > 5*time.Minute {
+		t.Errorf("Expected sunrise near %v, got %v", expectedRise, sunrise)
+	}
+	if d := sunset.Sub(expectedSet); d < -5*time.Minute || d > 5*time.Minute {
+		t.Errorf("Expected sunset near %v, got %v", expectedSet, sunset)
+	}
+}
+
+func TestSunTimesPolarNight(t *testing.T) {
+	day := time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC)
+	if _, _, ok := sunTimes(day, 78.2, 15.6); ok {
+		t.Error("Expected no sunrise during polar night in Svalbard")
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 20, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		window   Window
+		t        time.Time
+		expected bool
+	}{
+		{"daytime window inside", Window{Start: "09:00", End: "17:00"}, at(12, 0), true},
+		{"daytime window outside", Window{Start: "09:00", End: "17:00"}, at(18, 0), false},
+		{"overnight before midnight", Window{Start: "22:00", End: "06:00"}, at(23, 30), true},
+		{"overnight after midnight", Window{Start: "22:00", End: "06:00"}, at(5, 59), true},
+		{"overnight end exclusive", Window{Start: "22:00", End: "06:00"}, at(6, 0), false},
+		{"overnight afternoon", Window{Start: "22:00", End: "06:00"}, at(15, 0), false},
+		{"sunset to sunrise at night", Window{Start: "sunset", End: "sunrise", Latitude: 51.5, Longitude: -0.13}, at(21, 0), true},
+		{"sunset to sunrise at noon", Window{Start: "sunset", End: "sunrise", Latitude: 51.5, Longitude: -0.13}, at(12, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inside, err := tt.window.Contains(tt.t)
+			if err != nil {
+				t.Fatalf("Contains() error = %v", err)
+			}
+			if inside != tt.expected {
+				t.Errorf("Contains(%v) = %v, want %v", tt.t, inside, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNightSetbackEvaluate(t *testing.T) {
+	sp := &fakeSetpoint{value: 70}
+	now := time.Date(2024, 3, 20, 23, 0, 0, 0, time.UTC)
+	setback := &NightSetback{
+		Name:     "night_setback",
+		Key:      "boiler.temp",
+		setpoint: setpoint{get: sp.get, set: sp.set},
+		now:      func() time.Time { return now },
+		window:   Window{Start: "22:00", End: "06:00"},
+		delta:    5,
+		enabled:  true,
+	}
+
+	if err := setback.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 65 || !setback.Active() {
+		t.Errorf("Expected setpoint lowered to 65, got %v (active=%v)", sp.current(), setback.Active())
+	}
+
+	// A second evaluation inside the window must not lower it again
+	if err := setback.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 65 {
+		t.Errorf("Expected setpoint to stay at 65, got %v", sp.current())
+	}
+
+	now = time.Date(2024, 3, 21, 7, 0, 0, 0, time.UTC)
+	if err := setback.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 70 || setback.Active() {
+		t.Errorf("Expected setpoint restored to 70, got %v (active=%v)", sp.current(), setback.Active())
+	}
+}
+
+func TestNightSetbackDisabledRestores(t *testing.T) {
+	sp := &fakeSetpoint{value: 70}
+	setback := &NightSetback{
+		Key:      "boiler.temp",
+		setpoint: setpoint{get: sp.get, set: sp.set},
+		now:      func() time.Time { return time.Date(2024, 3, 20, 23, 0, 0, 0, time.UTC) },
+		window:   Window{Start: "22:00", End: "06:00"},
+		delta:    5,
+		enabled:  true,
+	}
+
+	if err := setback.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	setback.SetEnabled(false)
+	if err := setback.Evaluate(); err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if sp.current() != 70 {
+		t.Errorf("Expected setpoint restored to 70 after disabling, got %v", sp.current())
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// setpoint reads and writes a numeric setup key on the controller
+type setpoint struct {
+	get func() (float64, error)
+	set func(float64) error
+}
+
+func newSetpoint(boiler *nbe.NBE, name, key string) setpoint {
+	ctx := nbe.WithSource(context.Background(), "scheduler:"+name)
+	return setpoint{
+		get: func() (float64, error) {
+			return getSetpoint(boiler, key)
+		},
+		set: func(value float64) error {
+			response, err := boiler.SetContext(ctx, key, []byte(strconv.FormatFloat(value, 'f', -1, 64)))
+			if err != nil {
+				return err
+			}
+			return nbe.StatusErr(key, response)
+		},
+	}
+}
+
+// getSetpoint reads the current numeric value of a setup key
+func getSetpoint(boiler *nbe.NBE, key string) (float64, error) {
+	response, err := boiler.Get(nbe.GetSetupFunction, key)
+	if err != nil {
+		return 0, err
+	}
+	switch v := response.Payload[key[strings.LastIndex(key, ".")+1:]].(type) {
+	case int64:
+		return float64(v), nil
+	case nbe.RoundedFloat:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("unexpected response for %s: %v", key, response.Payload)
+}
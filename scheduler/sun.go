@@ -0,0 +1,58 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+// sunTimes returns sunrise and sunset on the given day for a location, using
+// the sunrise equation. ok is false during polar day or night.
+func sunTimes(day time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	y, m, d := day.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	julianDay := float64(noon.Unix())/86400 + 2440587.5
+
+	n := math.Round(julianDay - 2451545.0)
+	meanSolarTime := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	anomalyRad := radians(anomaly)
+	center := 1.9148*math.Sin(anomalyRad) + 0.02*math.Sin(2*anomalyRad) + 0.0003*math.Sin(3*anomalyRad)
+	eclipticLongitude := radians(math.Mod(anomaly+center+180+102.9372, 360))
+	transit := 2451545.0 + meanSolarTime + 0.0053*math.Sin(anomalyRad) - 0.0069*math.Sin(2*eclipticLongitude)
+
+	sinDeclination := math.Sin(eclipticLongitude) * math.Sin(radians(23.44))
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+	latitudeRad := radians(latitude)
+	cosHourAngle := (math.Sin(radians(-0.833)) - math.Sin(latitudeRad)*sinDeclination) / (math.Cos(latitudeRad) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	return fromJulian(transit - hourAngle/360).In(day.Location()), fromJulian(transit + hourAngle/360).In(day.Location()), true
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func fromJulian(julianDay float64) time.Time {
+	return time.Unix(int64(math.Round((julianDay-2440587.5)*86400)), 0).UTC()
+}
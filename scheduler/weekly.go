@@ -0,0 +1,278 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Entry is a single weekly schedule action
+type Entry struct {
+	// Days are weekday abbreviations (mon..sun); empty means every day
+	Days []string `json:"days,omitempty"`
+	// At is the "HH:MM" time of day the action runs
+	At string `json:"at"`
+	// Action is start, stop or setpoint
+	Action string `json:"action"`
+	// Key and Value are the setup key and value written by a setpoint action
+	Key   string  `json:"key,omitempty"`
+	Value float64 `json:"value,omitempty"`
+}
+
+// Validate checks the entry and fills in the default setpoint key
+func (e *Entry) Validate() error {
+	for _, day := range e.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+	if _, err := time.Parse("15:04", e.At); err != nil {
+		return fmt.Errorf("invalid time %q, expected HH:MM", e.At)
+	}
+	switch e.Action {
+	case "start", "stop":
+	case "setpoint":
+		if e.Key == "" {
+			e.Key = "boiler.temp"
+		}
+	default:
+		return fmt.Errorf("unknown action %q", e.Action)
+	}
+	return nil
+}
+
+// occursOn reports whether the entry runs on the given weekday
+func (e Entry) occursOn(day time.Weekday) bool {
+	if len(e.Days) == 0 {
+		return true
+	}
+	for _, d := range e.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// write returns the setup key and value the entry writes to the controller
+func (e Entry) write() (string, []byte) {
+	switch e.Action {
+	case "start":
+		return "misc.start", []byte("1")
+	case "stop":
+		return "misc.stop", []byte("1")
+	}
+	return e.Key, []byte(strconv.FormatFloat(e.Value, 'f', -1, 64))
+}
+
+// Weekly runs start, stop and setpoint actions at fixed times each week. The
+// schedule can be replaced and switched off at runtime through MQTT.
+type Weekly struct {
+	Name string
+
+	mqttClient *mqtt.Client
+	write      func(key string, value []byte) error
+	now        func() time.Time
+
+	mu      sync.Mutex
+	enabled bool
+	entries []Entry
+	last    time.Time
+}
+
+// NewWeekly creates a weekly schedule writing to the boiler, publishing its
+// state below scheduler/<name>
+func NewWeekly(boiler *nbe.NBE, mqttClient *mqtt.Client, name string, entries []Entry) (*Weekly, error) {
+	w := &Weekly{
+		Name:       name,
+		mqttClient: mqttClient,
+		write: func(key string, value []byte) error {
+			if err := boiler.ValidateSetting(key, value); err != nil {
+				return err
+			}
+			response, err := boiler.SetContext(nbe.WithSource(context.Background(), "scheduler:"+name), key, value)
+			if err != nil {
+				return err
+			}
+			return nbe.StatusErr(key, response)
+		},
+		now:     time.Now,
+		enabled: true,
+	}
+	if err := w.SetEntries(entries); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Run subscribes to the enable switch and schedule topics and checks for due
+// actions every 30 seconds
+func (w *Weekly) Run() error {
+	topic := fmt.Sprintf("scheduler/%s", w.Name)
+	if err := w.mqttClient.Subscribe(topic+"/enabled/set", 1, func(client *mqtt.Client, msg mqtt.Message) {
+		w.SetEnabled(string(msg.Payload()) == "ON")
+		w.publish()
+	}); err != nil {
+		return err
+	}
+	if err := w.mqttClient.Subscribe(topic+"/entries/set", 1, func(client *mqtt.Client, msg mqtt.Message) {
+		var entries []Entry
+		if err := json.Unmarshal(msg.Payload(), &entries); err != nil {
+			log.Warnf("Weekly schedule %s: invalid entries: %v", w.Name, err)
+			return
+		}
+		if err := w.SetEntries(entries); err != nil {
+			log.Warnf("Weekly schedule %s: %v", w.Name, err)
+			return
+		}
+		log.Infof("Weekly schedule %s replaced with %d entries", w.Name, len(entries))
+		w.publish()
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			w.Evaluate()
+			w.publish()
+			time.Sleep(30 * time.Second)
+		}
+	}()
+	return nil
+}
+
+// SetEntries replaces the schedule after validating every entry
+func (w *Weekly) SetEntries(entries []Entry) error {
+	validated := make([]Entry, len(entries))
+	for i, entry := range entries {
+		if err := entry.Validate(); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		validated[i] = entry
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries = validated
+	return nil
+}
+
+// SetEnabled switches the schedule on or off; actions that fall due while it
+// is off are skipped, not caught up
+func (w *Weekly) SetEnabled(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enabled = enabled
+}
+
+// Evaluate runs every action that fell due since the previous evaluation.
+// The first evaluation only records the current time.
+func (w *Weekly) Evaluate() {
+	w.mu.Lock()
+	now := w.now()
+	from := w.last
+	w.last = now
+	var due []Entry
+	if w.enabled && !from.IsZero() {
+		due = dueEntries(w.entries, from, now)
+	}
+	w.mu.Unlock()
+
+	for _, entry := range due {
+		key, value := entry.write()
+		if err := w.write(key, value); err != nil {
+			log.Errorf("Weekly schedule %s: %s at %s failed: %v", w.Name, entry.Action, entry.At, err)
+			continue
+		}
+		log.Infof("Weekly schedule %s: %s at %s, set %s to %s", w.Name, entry.Action, entry.At, key, value)
+	}
+}
+
+// dueEntries returns the entries occurring in (from, to], in the order they occur
+func dueEntries(entries []Entry, from, to time.Time) []Entry {
+	type occurrence struct {
+		at    time.Time
+		entry Entry
+	}
+	var due []occurrence
+
+	y, m, d := from.Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, from.Location()); !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, entry := range entries {
+			if !entry.occursOn(day.Weekday()) {
+				continue
+			}
+			clock, err := time.Parse("15:04", entry.At)
+			if err != nil {
+				continue
+			}
+			at := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, day.Location())
+			if at.After(from) && !at.After(to) {
+				due = append(due, occurrence{at, entry})
+			}
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	result := make([]Entry, len(due))
+	for i, o := range due {
+		result[i] = o.entry
+	}
+	return result
+}
+
+func (w *Weekly) publish() {
+	if w.mqttClient == nil {
+		return
+	}
+
+	w.mu.Lock()
+	entries, err := json.Marshal(w.entries)
+	values := map[string]interface{}{
+		"enabled": onOff(w.enabled),
+	}
+	w.mu.Unlock()
+	if err == nil {
+		values["entries"] = string(entries)
+	}
+
+	if err := w.mqttClient.PublishMany(fmt.Sprintf("scheduler/%s", w.Name), values); err != nil {
+		log.Debugf("Failed to publish weekly schedule %s: %v", w.Name, err)
+	}
+}
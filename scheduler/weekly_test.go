@@ -0,0 +1,123 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEntryValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   Entry
+		wantErr bool
+	}{
+		{"start", Entry{Days: []string{"mon", "Fri"}, At: "06:00", Action: "start"}, false},
+		{"setpoint", Entry{At: "22:30", Action: "setpoint", Value: 60}, false},
+		{"bad day", Entry{Days: []string{"monday"}, At: "06:00", Action: "start"}, true},
+		{"bad time", Entry{At: "6am", Action: "stop"}, true},
+		{"bad action", Entry{At: "06:00", Action: "reboot"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.entry.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	entry := Entry{At: "22:30", Action: "setpoint", Value: 60}
+	if err := entry.Validate(); err != nil || entry.Key != "boiler.temp" {
+		t.Errorf("Expected default setpoint key boiler.temp, got %q (%v)", entry.Key, err)
+	}
+}
+
+func TestDueEntries(t *testing.T) {
+	entries := []Entry{
+		{Days: []string{"mon"}, At: "06:00", Action: "start"},
+		{At: "05:30", Action: "setpoint", Key: "boiler.temp", Value: 70},
+		{Days: []string{"tue"}, At: "06:00", Action: "stop"},
+	}
+	// 2024-01-01 is a Monday
+	from := time.Date(2024, 1, 1, 5, 0, 0, 0, time.Local)
+
+	due := dueEntries(entries, from, from.Add(2*time.Hour))
+	if len(due) != 2 || due[0].Action != "setpoint" || due[1].Action != "start" {
+		t.Errorf("Expected setpoint then start on Monday morning, got %+v", due)
+	}
+
+	if due := dueEntries(entries, from.Add(time.Hour), from.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("Expected nothing due in an empty interval, got %+v", due)
+	}
+
+	// Spanning midnight into Tuesday picks up Tuesday's entries
+	due = dueEntries(entries, from.Add(18*time.Hour), from.Add(26*time.Hour))
+	if len(due) != 2 || due[0].Action != "setpoint" || due[1].Action != "stop" {
+		t.Errorf("Expected setpoint then stop on Tuesday, got %+v", due)
+	}
+}
+
+func TestWeeklyEvaluate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 5, 59, 0, 0, time.Local)
+	type write struct{ key, value string }
+	var writes []write
+
+	w := &Weekly{
+		Name:    "weekly",
+		now:     func() time.Time { return now },
+		enabled: true,
+		write: func(key string, value []byte) error {
+			writes = append(writes, write{key, string(value)})
+			return nil
+		},
+	}
+	if err := w.SetEntries([]Entry{
+		{Days: []string{"mon"}, At: "06:00", Action: "start"},
+		{Days: []string{"mon"}, At: "06:01", Action: "setpoint", Value: 72.5},
+	}); err != nil {
+		t.Fatalf("SetEntries failed: %v", err)
+	}
+
+	w.Evaluate()
+	if len(writes) != 0 {
+		t.Fatalf("Expected the first evaluation not to run anything, got %v", writes)
+	}
+
+	now = now.Add(time.Minute)
+	w.Evaluate()
+	if len(writes) != 1 || writes[0] != (write{"misc.start", "1"}) {
+		t.Errorf("Expected misc.start at 06:00, got %v", writes)
+	}
+
+	w.SetEnabled(false)
+	now = now.Add(time.Minute)
+	w.Evaluate()
+	if len(writes) != 1 {
+		t.Errorf("Expected no writes while disabled, got %v", writes)
+	}
+
+	w.SetEnabled(true)
+	now = now.Add(7 * 24 * time.Hour)
+	w.Evaluate()
+	if len(writes) != 3 || writes[2] != (write{"boiler.temp", "72.5"}) {
+		t.Errorf("Expected a week's worth of actions after re-enabling, got %v", writes)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package shadow simulates writes against a copy of the boiler before they
+// are sent, so a write that would leave the boiler outside its sanity rules
+// never reaches the hardware.
+package shadow
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Shadow mirrors the values published on the bus into a MockBoiler and
+// checks every write against it
+type Shadow struct {
+	rules    []config.ShadowRule
+	eventBus *bus.Bus
+
+	mu   sync.Mutex
+	mock *nbe.MockBoiler
+}
+
+// New creates a shadow holding no values until the monitors publish them
+func New(eventBus *bus.Bus, rules []config.ShadowRule) (*Shadow, error) {
+	mock, err := nbe.NewMockBoiler("shadow")
+	if err != nil {
+		return nil, err
+	}
+	mock.Restore(nil)
+	return &Shadow{rules: rules, eventBus: eventBus, mock: mock}, nil
+}
+
+// Run starts mirroring the published settings and operating data
+func (s *Shadow) Run() {
+	s.eventBus.Subscribe(s.handle, bus.ValueChanged)
+}
+
+func (s *Shadow) handle(event bus.Event) {
+	category := event.Category
+	switch {
+	case category == "operating_data":
+		category = "operating"
+	case !nbe.IsSettingsCategory(category):
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range event.Values {
+		s.mock.SetValue(category, key, value)
+	}
+}
+
+// Check simulates writing value to path, returning an error if the boiler
+// does not have the setting or a rule fails afterwards. The simulated write
+// is always undone; the real outcome arrives from the monitors.
+func (s *Shadow) Check(path string, value []byte) error {
+	category, key, _ := strings.Cut(path, ".")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.mock.GetValue(category, key); !ok {
+		return fmt.Errorf("shadow: %s is not a setting of this boiler", path)
+	}
+	snapshot := s.mock.Snapshot()
+	defer s.mock.Restore(snapshot)
+
+	s.mock.SetValue(category, key, strings.TrimSpace(string(value)))
+	for _, rule := range s.rules {
+		if err := s.checkRule(rule); err != nil {
+			return fmt.Errorf("shadow: %s=%s rejected: %w", path, value, err)
+		}
+	}
+	return nil
+}
+
+// checkRule tests a rule against the simulated values; a value the boiler
+// has not reported passes
+func (s *Shadow) checkRule(rule config.ShadowRule) error {
+	category, key, _ := strings.Cut(rule.Key, ".")
+	raw, ok := s.mock.GetValue(category, key)
+	if !ok {
+		return nil
+	}
+	value, ok := nbe.ParseFloat(raw)
+	if !ok {
+		return fmt.Errorf("%s is %v, not a number", rule.Key, raw)
+	}
+	if rule.Min != nil && value < *rule.Min {
+		return fmt.Errorf("%s would be %v, below %v", rule.Key, value, *rule.Min)
+	}
+	if rule.Max != nil && value > *rule.Max {
+		return fmt.Errorf("%s would be %v, above %v", rule.Key, value, *rule.Max)
+	}
+	return nil
+}
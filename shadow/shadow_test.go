@@ -0,0 +1,91 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shadow
+
+import (
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func newTestShadow(t *testing.T, rules ...config.ShadowRule) *Shadow {
+	t.Helper()
+	eventBus := bus.New()
+	s, err := New(eventBus, rules)
+	if err != nil {
+		t.Fatalf("Failed to create shadow: %v", err)
+	}
+	s.Run()
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "boiler", Values: map[string]interface{}{
+		"temp": nbe.RoundedFloat(65),
+	}})
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{
+		"boiler_ref":  nbe.RoundedFloat(65),
+		"boiler_temp": nbe.RoundedFloat(62.5),
+	}})
+	eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: "consumption_data", Values: map[string]interface{}{
+		"counter": int64(100),
+	}})
+	return s
+}
+
+func TestCheck(t *testing.T) {
+	max := 80.0
+	min := 30.0
+	s := newTestShadow(t,
+		config.ShadowRule{Key: "operating.boiler_ref", Max: &max},
+		config.ShadowRule{Key: "boiler.temp", Min: &min},
+	)
+
+	tests := []struct {
+		path    string
+		value   string
+		wantErr bool
+	}{
+		{"boiler.temp", "70", false},
+		{"boiler.temp", "85", true},
+		{"boiler.temp", "20", true},
+		{"boiler.warp_drive", "1", true},
+		{"consumption_data.counter", "0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+"="+tt.value, func(t *testing.T) {
+			err := s.Check(tt.path, []byte(tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check(%s=%s) error = %v, wantErr %v", tt.path, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckRestoresValues(t *testing.T) {
+	s := newTestShadow(t)
+
+	if err := s.Check("boiler.temp", []byte("75")); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if value, _ := s.mock.GetValue("boiler", "temp"); value != nbe.RoundedFloat(65) {
+		t.Errorf("Expected boiler.temp to be restored to 65, got %v", value)
+	}
+	if value, _ := s.mock.GetValue("operating", "boiler_ref"); value != nbe.RoundedFloat(65) {
+		t.Errorf("Expected operating.boiler_ref to be restored to 65, got %v", value)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package simulator drives a MockBoiler with a simple model of a boiler
+// heating a house through the day, so the bridge and Home Assistant can be
+// tried out without a controller.
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+// Profile describes the simulated boiler and the house it heats
+type Profile struct {
+	// RatedPower is the boiler's output at 100% power, in kW
+	RatedPower float64
+	// HeatLoss is the heat the house needs per degree between indoors and
+	// outdoors, in kW/K
+	HeatLoss float64
+	// WaterCapacity is the heat stored in the boiler water per degree, in kWh/K
+	WaterCapacity float64
+	// OutdoorMean and OutdoorSwing set the daily outdoor temperature cycle,
+	// coldest at 03:00 and warmest at 15:00
+	OutdoorMean  float64
+	OutdoorSwing float64
+}
+
+// Profiles are the built-in profiles by name
+var Profiles = map[string]Profile{
+	"cottage_10kw": {RatedPower: 10, HeatLoss: 0.15, WaterCapacity: 0.06, OutdoorMean: 5, OutdoorSwing: 4},
+	"house_20kw":   {RatedPower: 20, HeatLoss: 0.3, WaterCapacity: 0.12, OutdoorMean: 2, OutdoorSwing: 5},
+	"farm_40kw":    {RatedPower: 40, HeatLoss: 0.7, WaterCapacity: 0.3, OutdoorMean: -3, OutdoorSwing: 6},
+}
+
+// ProfileNames returns the names of the built-in profiles, sorted
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Power states the simulated boiler goes through, as numbered by the controller
+const (
+	stateIgnition = 1
+	statePower    = 5
+	stateReached  = 9
+	stateOff      = 14
+)
+
+const (
+	// indoorTemp is the temperature the house is kept at
+	indoorTemp = 21.0
+	// ignitionTime is how long the burner takes to light
+	ignitionTime = 4 * time.Minute
+	// pelletEnergy is the heat delivered per kg of pellets burned, in kWh
+	pelletEnergy = 4.3
+	// hopperSize is what the hopper is refilled to once it runs low, in kg
+	hopperSize = 150.0
+)
+
+// Simulator advances the model and publishes its state as the mock's
+// operating data
+type Simulator struct {
+	Boiler  *nbe.MockBoiler
+	Profile Profile
+
+	mu       sync.Mutex
+	clock    time.Time
+	state    int64
+	ignition time.Duration
+	writes   int
+}
+
+// New creates a simulator whose clock starts at start, with the boiler
+// burning
+func New(boiler *nbe.MockBoiler, profile Profile, start time.Time) *Simulator {
+	s := &Simulator{Boiler: boiler, Profile: profile, clock: start, state: statePower}
+	boiler.SetValue("operating", "external_temp", nbe.RoundedFloat(Outdoor(profile, start)))
+	s.setState(statePower)
+	return s
+}
+
+// Outdoor returns the outdoor temperature of a profile at t
+func Outdoor(profile Profile, t time.Time) float64 {
+	hour := float64(t.Hour()) + float64(t.Minute())/60
+	return profile.OutdoorMean + profile.OutdoorSwing*math.Cos(2*math.Pi*(hour-15)/24)
+}
+
+// Run advances the simulation every interval until stop is closed, by
+// interval times speed of simulated time
+func (s *Simulator) Run(interval time.Duration, speed float64, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Step(time.Duration(float64(interval) * speed))
+		}
+	}
+}
+
+// Step advances the simulation by dt of simulated time
+func (s *Simulator) Step(dt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock = s.clock.Add(dt)
+	s.followCommands()
+	outdoor := Outdoor(s.Profile, s.clock)
+	s.Boiler.SetValue("operating", "external_temp", nbe.RoundedFloat(outdoor))
+
+	temp := s.float("operating", "boiler_temp")
+	// boiler_ref follows the weather compensation curve when it is active
+	setpoint := s.float("operating", "boiler_ref")
+	under := s.float("boiler", "diff_under")
+	over := s.float("boiler", "diff_over")
+
+	switch s.state {
+	case stateReached:
+		if temp <= setpoint-under {
+			s.ignition = ignitionTime
+			s.setState(stateIgnition)
+		}
+	case stateIgnition:
+		if s.ignition -= dt; s.ignition <= 0 {
+			s.setState(statePower)
+		}
+	case statePower:
+		if temp >= setpoint+over {
+			s.setState(stateReached)
+		}
+	}
+
+	pct := 0.0
+	if s.state == statePower {
+		low := s.float("regulation", "boiler_power_min")
+		high := s.float("regulation", "boiler_power_max")
+		pct = math.Max(low, math.Min(high, 50+10*(setpoint-temp)))
+	}
+	power := s.Profile.RatedPower * pct / 100
+
+	// the house draws less heat as the water cools towards room temperature
+	load := s.Profile.HeatLoss * math.Max(0, indoorTemp-outdoor) * math.Max(0, math.Min(1, (temp-indoorTemp)/20))
+	hours := dt.Hours()
+	temp += (power - load) * hours / s.Profile.WaterCapacity
+	temp = math.Max(outdoor, math.Min(95, temp))
+
+	burned := power * hours / pelletEnergy
+	hopper := s.float("hopper", "content") - burned
+	if hopper < 10 {
+		hopper = hopperSize
+	}
+	s.Boiler.SetValue("hopper", "content", nbe.RoundedFloat(hopper))
+	counter := s.float("consumption", "counter") + burned
+	s.Boiler.SetValue("consumption", "counter", nbe.RoundedFloat(counter))
+
+	// the smoke cools off slowly once the burner stops
+	smoke := s.float("operating", "smoke_temp")
+	smoke += (40 + 1.6*pct - smoke) * math.Min(1, hours*6)
+	oxygen, photo := 20.9, 0.0
+	if pct > 0 {
+		oxygen, photo = 8+0.06*(100-pct), 80+0.15*pct
+	}
+
+	for key, value := range map[string]float64{
+		"boiler_temp": temp,
+		"power_pct":   pct,
+		"power_kw":    power,
+		"smoke_temp":  smoke,
+		"oxygen":      oxygen,
+		"photo_level": photo,
+	} {
+		s.Boiler.SetValue("operating", key, nbe.RoundedFloat(math.Round(value*10)/10))
+	}
+	s.Boiler.SetValue("misc", "date", s.clock.Format("02-01-06"))
+	s.Boiler.SetValue("misc", "time", s.clock.Format("15:04"))
+}
+
+// followCommands turns the boiler off and on for the misc.stop and
+// misc.start commands written since the last step
+func (s *Simulator) followCommands() {
+	writes := s.Boiler.Writes()
+	for _, write := range writes[s.writes:] {
+		switch {
+		case strings.HasPrefix(write, "misc.stop="):
+			s.setState(stateOff)
+		case strings.HasPrefix(write, "misc.start=") && s.state == stateOff:
+			s.ignition = ignitionTime
+			s.setState(stateIgnition)
+		}
+	}
+	s.writes = len(writes)
+}
+
+func (s *Simulator) setState(state int64) {
+	s.state = state
+	s.Boiler.SetValue("operating", "state", state)
+	s.Boiler.SetValue("operating", "state_text", nbe.DefaultStates().Text(state))
+}
+
+// float reads a numeric value of the mock, 0 if it is missing
+func (s *Simulator) float(category, key string) float64 {
+	value, _ := s.Boiler.GetValue(category, key)
+	switch v := value.(type) {
+	case nbe.RoundedFloat:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case string:
+		var f float64
+		fmt.Sscan(v, &f)
+		return f
+	}
+	return 0
+}
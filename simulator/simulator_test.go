@@ -0,0 +1,106 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulator
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+var start = time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+
+func newSimulator(t *testing.T) *Simulator {
+	t.Helper()
+	mb, err := nbe.NewMockBoiler("DEMO")
+	if err != nil {
+		t.Fatalf("Failed to create mock boiler: %v", err)
+	}
+	return New(mb, Profiles["house_20kw"], start)
+}
+
+func TestOutdoorCycle(t *testing.T) {
+	profile := Profiles["house_20kw"]
+	cold := Outdoor(profile, start.Add(3*time.Hour))
+	warm := Outdoor(profile, start.Add(15*time.Hour))
+	if cold != profile.OutdoorMean-profile.OutdoorSwing || warm != profile.OutdoorMean+profile.OutdoorSwing {
+		t.Errorf("Expected %v at 03:00 and %v at 15:00, got %v and %v",
+			profile.OutdoorMean-profile.OutdoorSwing, profile.OutdoorMean+profile.OutdoorSwing, cold, warm)
+	}
+}
+
+func TestStepCyclesTheBurner(t *testing.T) {
+	s := newSimulator(t)
+	counter := s.float("consumption", "counter")
+
+	states := make(map[int64]bool)
+	for i := 0; i < 24*60; i++ {
+		s.Step(time.Minute)
+		states[s.state] = true
+		if temp := s.float("operating", "boiler_temp"); temp < 20 || temp > 95 {
+			t.Fatalf("Boiler temperature %v out of bounds after %d minutes", temp, i+1)
+		}
+	}
+
+	for _, state := range []int64{statePower, stateReached, stateIgnition} {
+		if !states[state] {
+			t.Errorf("Expected the boiler to pass through state %d in a day, got %v", state, states)
+		}
+	}
+	if burned := s.float("consumption", "counter") - counter; burned <= 0 {
+		t.Errorf("Expected pellets to be burned, got %v kg", burned)
+	}
+	if date, _ := s.Boiler.GetValue("misc", "date"); date != "11-01-24" {
+		t.Errorf("Expected the controller date to follow the simulated clock, got %v", date)
+	}
+}
+
+func TestStepFollowsStopAndStart(t *testing.T) {
+	s := newSimulator(t)
+	if err := s.Boiler.Start(); err != nil {
+		t.Fatalf("Failed to start mock boiler: %v", err)
+	}
+	t.Cleanup(s.Boiler.Stop)
+	uri, _ := url.Parse(fmt.Sprintf("tcp://DEMO:1234@%s", s.Boiler.GetAddr()))
+	client, err := nbe.NewNBE(uri)
+	if err != nil {
+		t.Fatalf("Failed to connect to mock boiler: %v", err)
+	}
+
+	if _, err := client.Set("misc.stop", []byte("1")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	s.Step(time.Minute)
+	if state, _ := s.Boiler.GetValue("operating", "state"); state != int64(stateOff) {
+		t.Errorf("Expected the boiler to be off, got state %v", state)
+	}
+	if pct := s.float("operating", "power_pct"); pct != 0 {
+		t.Errorf("Expected no power while off, got %v", pct)
+	}
+
+	if _, err := client.Set("misc.start", []byte("1")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	s.Step(time.Minute)
+	if state, _ := s.Boiler.GetValue("operating", "state"); state != int64(stateIgnition) {
+		t.Errorf("Expected the boiler to light, got state %v", state)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultInfluxInterval is how often buffered points are written
+	defaultInfluxInterval = 10 * time.Second
+	// maxInfluxPoints is the most points kept while the server is
+	// unreachable; older points are dropped first
+	maxInfluxPoints = 10000
+)
+
+var (
+	tagEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// InfluxDB writes value changes as points in line protocol, one per category
+// and poll, tagged with the category and the controller serial. Points are
+// buffered and written every interval.
+type InfluxDB struct {
+	client      *http.Client
+	writeURL    string
+	token       string
+	measurement string
+	serial      string
+
+	mu     sync.Mutex
+	points []string
+	done   chan struct{}
+	closed sync.WaitGroup
+}
+
+// NewInfluxDB creates a sink writing to the server in cfg: to the v2 API
+// when an org or token is given, with the database as the bucket, or else
+// to the v1 API
+func NewInfluxDB(cfg config.SinkConfig, serial string) (*InfluxDB, error) {
+	base, err := config.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"precision": {"ms"}}
+	if cfg.Org != "" || cfg.Token != "" {
+		base = base.JoinPath("api/v2/write")
+		query.Set("org", cfg.Org)
+		query.Set("bucket", cfg.Database)
+	} else {
+		base = base.JoinPath("write")
+		query.Set("db", cfg.Database)
+	}
+	base.RawQuery = query.Encode()
+
+	measurement := cfg.Measurement
+	if measurement == "" {
+		measurement = "boiler_mate"
+	}
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = defaultInfluxInterval
+	}
+	s := &InfluxDB{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		writeURL:    base.String(),
+		token:       cfg.Token,
+		measurement: measurement,
+		serial:      serial,
+		done:        make(chan struct{}),
+	}
+	s.closed.Add(1)
+	go s.run(interval)
+	return s, nil
+}
+
+// Handle buffers the values of a value change as a point
+func (s *InfluxDB) Handle(event bus.Event) {
+	if event.Kind != bus.ValueChanged {
+		return
+	}
+	point := s.point(event)
+	if point == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.points = append(s.points, point)
+	if len(s.points) > maxInfluxPoints {
+		s.points = s.points[len(s.points)-maxInfluxPoints:]
+	}
+}
+
+// point returns event in line protocol, or "" if it has no value InfluxDB
+// can store
+func (s *InfluxDB) point(event bus.Event) string {
+	keys := make([]string, 0, len(event.Values))
+	for key := range event.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var fields []string
+	for _, key := range keys {
+		if value, ok := fieldValue(event.Values[key]); ok {
+			fields = append(fields, tagEscaper.Replace(key)+"="+value)
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s,category=%s,serial=%s %s %d",
+		tagEscaper.Replace(s.measurement),
+		tagEscaper.Replace(event.Category),
+		tagEscaper.Replace(s.serial),
+		strings.Join(fields, ","),
+		event.Time.UnixMilli())
+}
+
+// fieldValue formats a polled value as a line protocol field value; nested
+// values such as attributes are left out
+func fieldValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case int:
+		return strconv.Itoa(v) + "i", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	if f, ok := nbe.ToFloat(value); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func (s *InfluxDB) run(interval time.Duration) {
+	defer s.closed.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.Warnf("Failed to write to InfluxDB: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush writes the buffered points, keeping them for the next try if the
+// server can't be reached
+func (s *InfluxDB) flush() error {
+	s.mu.Lock()
+	points := s.points
+	s.points = nil
+	s.mu.Unlock()
+	if len(points) == 0 {
+		return nil
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewBufferString(strings.Join(points, "\n")))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		request.Header.Set("Authorization", "Token "+s.token)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		s.requeue(points)
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		if response.StatusCode >= 500 {
+			s.requeue(points)
+		}
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *InfluxDB) requeue(points []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.points = append(points, s.points...)
+	if len(s.points) > maxInfluxPoints {
+		s.points = s.points[len(s.points)-maxInfluxPoints:]
+	}
+}
+
+// Close writes the buffered points and stops the sink
+func (s *InfluxDB) Close() error {
+	close(s.done)
+	s.closed.Wait()
+	return s.flush()
+}
+
+func init() {
+	Register("influxdb", func(cfg config.SinkConfig, deps Deps) (Sink, error) {
+		return NewInfluxDB(cfg, deps.Serial)
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestInfluxDBPoint(t *testing.T) {
+	sink := &InfluxDB{measurement: "boiler mate", serial: "TEST"}
+
+	point := sink.point(bus.Event{
+		Kind:     bus.ValueChanged,
+		Time:     time.UnixMilli(1700000000000),
+		Category: "operating_data",
+		Values: map[string]interface{}{
+			"boiler_temp": nbe.RoundedFloat(65.5),
+			"state":       int64(5),
+			"state_text":  `Power "high"`,
+			"attributes":  map[string]interface{}{"max": 1},
+		},
+	})
+	want := `boiler\ mate,category=operating_data,serial=TEST boiler_temp=65.5,state=5i,state_text="Power \"high\"" 1700000000000`
+	if point != want {
+		t.Errorf("point() =\n%s\nwant\n%s", point, want)
+	}
+
+	if point := sink.point(bus.Event{Kind: bus.ValueChanged, Values: map[string]interface{}{"attributes": map[string]interface{}{}}}); point != "" {
+		t.Errorf("Expected no point without storable values, got %q", point)
+	}
+}
+
+func TestInfluxDBWritesBatches(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxDB(config.SinkConfig{URL: server.URL, Database: "boiler", Org: "home", Token: "secret", Interval: time.Hour}, "TEST")
+	if err != nil {
+		t.Fatalf("NewInfluxDB() error = %v", err)
+	}
+	at := time.UnixMilli(1700000000000)
+	sink.Handle(bus.Event{Kind: bus.ValueChanged, Time: at, Category: "boiler", Values: map[string]interface{}{"temp": nbe.RoundedFloat(70)}})
+	sink.Handle(bus.Event{Kind: bus.Alarm, Time: at, Value: int64(3)})
+	sink.Handle(bus.Event{Kind: bus.ValueChanged, Time: at, Category: "hot_water", Values: map[string]interface{}{"temp": nbe.RoundedFloat(55)}})
+
+	// closing flushes what is buffered
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case r := <-requests:
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "boiler" || r.URL.Query().Get("org") != "home" {
+			t.Errorf("Unexpected write URL %s", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		want := "boiler_mate,category=boiler,serial=TEST temp=70 1700000000000\n" +
+			"boiler_mate,category=hot_water,serial=TEST temp=55 1700000000000"
+		if body := <-bodies; body != want {
+			t.Errorf("Unexpected body\n%s", body)
+		}
+	default:
+		t.Fatal("Expected the buffered points to be written on close")
+	}
+}
+
+func TestInfluxDBKeepsPointsWhileUnreachable(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	var written string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		written = string(body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxDB(config.SinkConfig{URL: server.URL, Database: "boiler", Interval: time.Hour}, "TEST")
+	if err != nil {
+		t.Fatalf("NewInfluxDB() error = %v", err)
+	}
+	defer sink.Close()
+	at := time.UnixMilli(1700000000000)
+	sink.Handle(bus.Event{Kind: bus.ValueChanged, Time: at, Category: "boiler", Values: map[string]interface{}{"temp": int64(70)}})
+
+	if err := sink.flush(); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	status = http.StatusNoContent
+	if err := sink.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if written != "boiler_mate,category=boiler,serial=TEST temp=70i 1700000000000" {
+		t.Errorf("Expected the point to be written again, got %q", written)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prometheus exports every numeric value as a gauge named
+// boiler_mate_<category>_<key>, labelled with the controller serial
+type Prometheus struct {
+	registerer prometheus.Registerer
+	serial     string
+	// gauges holds nil for the values that can't be registered, so they
+	// are only tried once
+	gauges map[string]*prometheus.GaugeVec
+}
+
+// NewPrometheus creates a sink registering its gauges with registerer
+func NewPrometheus(registerer prometheus.Registerer, serial string) *Prometheus {
+	return &Prometheus{
+		registerer: registerer,
+		serial:     serial,
+		gauges:     make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+// Handle sets the gauges of the numeric values in a value change
+func (p *Prometheus) Handle(event bus.Event) {
+	if event.Kind != bus.ValueChanged {
+		return
+	}
+	for key, value := range event.Values {
+		f, ok := nbe.ToFloat(value)
+		if !ok {
+			continue
+		}
+		if gauge := p.gauge(event.Category, key); gauge != nil {
+			gauge.WithLabelValues(p.serial).Set(f)
+		}
+	}
+}
+
+func (p *Prometheus) gauge(category, key string) *prometheus.GaugeVec {
+	id := category + "." + key
+	if gauge, ok := p.gauges[id]; ok {
+		return gauge
+	}
+	subsystem := category
+	if category == "advanced_data" {
+		// advanced data has always been exported alongside operating data
+		subsystem = "operating_data"
+	}
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "boiler_mate",
+			Subsystem: subsystem,
+			Name:      key,
+		},
+		[]string{"serial"},
+	)
+	if err := p.registerer.Register(gauge); err != nil {
+		log.Debugf("Failed to register gauge %s: %v", id, err)
+		gauge = nil
+	}
+	p.gauges[id] = gauge
+	return gauge
+}
+
+// Close leaves the gauges registered for the metrics endpoint
+func (p *Prometheus) Close() error {
+	return nil
+}
+
+func init() {
+	Register("prometheus", func(cfg config.SinkConfig, deps Deps) (Sink, error) {
+		return NewPrometheus(prometheus.DefaultRegisterer, deps.Serial), nil
+	})
+}
@@ -0,0 +1,136 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package sink writes the values and events published on the bus to outputs
+// such as MQTT, Prometheus or InfluxDB. Each output type registers a factory,
+// and the sinks listed in the configuration are created at startup and run
+// side by side, so a new output needs no change to the monitors.
+package sink
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultQueueSize is the number of events buffered for a slow sink
+const defaultQueueSize = 256
+
+// Sink receives the events published on the bus
+type Sink interface {
+	Handle(event bus.Event)
+	// Close flushes anything buffered and releases the output
+	Close() error
+}
+
+// Deps are the parts of the running bridge a sink may need
+type Deps struct {
+	Broker *mqtt.Client
+	Serial string
+}
+
+// Factory creates a sink from its configuration
+type Factory func(cfg config.SinkConfig, deps Deps) (Sink, error)
+
+var (
+	factoriesMutex sync.RWMutex
+	factories      = make(map[string]Factory)
+)
+
+// Register makes the sink type kind available to the configuration,
+// replacing any factory already registered for it
+func Register(kind string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	factories[kind] = factory
+}
+
+// Types returns the registered sink types in order
+func Types() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	kinds := make([]string, 0, len(factories))
+	for kind := range factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func lookup(kind string) (Factory, bool) {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	factory, ok := factories[kind]
+	return factory, ok
+}
+
+// Start creates the configured sinks and subscribes each to every event on
+// b behind its own queue, so a slow sink only holds up itself. The sinks are
+// returned to be closed on shutdown; none are left running on error.
+func Start(b *bus.Bus, configs []config.SinkConfig, deps Deps) ([]Sink, error) {
+	var sinks []Sink
+	for _, cfg := range configs {
+		name := cfg.Name
+		if name == "" {
+			name = cfg.Type
+		}
+		factory, ok := lookup(cfg.Type)
+		if !ok {
+			Close(sinks)
+			return nil, fmt.Errorf("sink %s: unknown type %q", name, cfg.Type)
+		}
+		sink, err := factory(cfg, deps)
+		if err != nil {
+			Close(sinks)
+			return nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+		size := cfg.QueueSize
+		if size == 0 {
+			size = defaultQueueSize
+		}
+		b.SubscribeQueued(name, size, sink.Handle)
+		sinks = append(sinks, sink)
+		log.Debugf("Started %s sink %s", cfg.Type, name)
+	}
+	return sinks, nil
+}
+
+// Close closes every sink, logging the ones that fail
+func Close(sinks []Sink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Warnf("Failed to close sink: %v", err)
+		}
+	}
+}
+
+func init() {
+	Register("mqtt", func(cfg config.SinkConfig, deps Deps) (Sink, error) {
+		if deps.Broker == nil {
+			return nil, fmt.Errorf("no MQTT broker")
+		}
+		return bus.NewMQTTSinkWithOptions(deps.Broker, bus.MQTTSinkOptions{
+			Aggregate: cfg.Aggregate,
+			Gzip:      cfg.Compression == "gzip",
+		}), nil
+	})
+}
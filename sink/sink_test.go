@@ -0,0 +1,169 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type recordingSink struct {
+	events chan bus.Event
+	closed bool
+}
+
+func (s *recordingSink) Handle(event bus.Event) {
+	s.events <- event
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestStartRunsSinksSideBySide(t *testing.T) {
+	var created []*recordingSink
+	Register("recording", func(cfg config.SinkConfig, deps Deps) (Sink, error) {
+		sink := &recordingSink{events: make(chan bus.Event, 1)}
+		created = append(created, sink)
+		return sink, nil
+	})
+	t.Cleanup(func() {
+		factoriesMutex.Lock()
+		delete(factories, "recording")
+		factoriesMutex.Unlock()
+	})
+
+	b := bus.New()
+	sinks, err := Start(b, []config.SinkConfig{
+		{Type: "recording", Name: "first"},
+		{Type: "recording", Name: "second"},
+	}, Deps{})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if len(sinks) != 2 {
+		t.Fatalf("Expected 2 sinks, got %d", len(sinks))
+	}
+
+	b.Publish(bus.Event{Kind: bus.Alarm, Key: "alarm", Value: int64(3)})
+	for i, sink := range created {
+		select {
+		case event := <-sink.events:
+			if event.Kind != bus.Alarm {
+				t.Errorf("Sink %d got %v", i, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Sink %d got nothing", i)
+		}
+	}
+
+	Close(sinks)
+	for i, sink := range created {
+		if !sink.closed {
+			t.Errorf("Expected sink %d to be closed", i)
+		}
+	}
+}
+
+func TestStartRejectsUnknownType(t *testing.T) {
+	if _, err := Start(bus.New(), []config.SinkConfig{{Type: "carrier-pigeon"}}, Deps{}); err == nil {
+		t.Error("Expected an error for an unknown sink type")
+	}
+	if _, err := Start(bus.New(), []config.SinkConfig{{Type: "mqtt"}}, Deps{}); err == nil {
+		t.Error("Expected an error for an MQTT sink without a broker")
+	}
+}
+
+func TestTypesIncludesBuiltins(t *testing.T) {
+	types := strings.Join(Types(), ",")
+	if types != "influxdb,mqtt,prometheus,sqlite,stdout" {
+		t.Errorf("Unexpected sink types %s", types)
+	}
+}
+
+func TestPrometheusSetsGauges(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	sink := NewPrometheus(registry, "TEST")
+
+	sink.Handle(bus.Event{Kind: bus.ValueChanged, Category: "operating_data", Values: map[string]interface{}{
+		"boiler_temp": nbe.RoundedFloat(65.5),
+		"state":       int64(5),
+		"state_text":  "Power",
+	}})
+	sink.Handle(bus.Event{Kind: bus.ValueChanged, Category: "advanced_data", Values: map[string]interface{}{
+		"fan_speed": int64(40),
+	}})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if label := metric.GetLabel(); len(label) != 1 || label[0].GetValue() != "TEST" {
+				t.Errorf("Unexpected labels %v on %s", label, family.GetName())
+			}
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	if len(values) != 3 {
+		t.Errorf("Expected 3 gauges, got %v", values)
+	}
+	if values["boiler_mate_operating_data_boiler_temp"] != 65.5 {
+		t.Errorf("Expected boiler temp 65.5, got %v", values)
+	}
+	// advanced data has always been exported alongside operating data
+	if values["boiler_mate_operating_data_fan_speed"] != 40 {
+		t.Errorf("Expected fan speed 40, got %v", values)
+	}
+}
+
+func TestJSONLinesWritesEvents(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONLines(&out)
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	sink.Handle(bus.Event{Kind: bus.ValueChanged, Time: at, Category: "boiler", Values: map[string]interface{}{"temp": nbe.RoundedFloat(70)}})
+	sink.Handle(bus.Event{Kind: bus.WritePerformed, Time: at, Key: "boiler.temp", Value: []byte("70"), Err: errors.New("denied")})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", out.String())
+	}
+	var write map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &write); err != nil {
+		t.Fatal(err)
+	}
+	if write["kind"] != "write_performed" || write["value"] != "70" || write["error"] != "denied" {
+		t.Errorf("Unexpected write line %s", lines[1])
+	}
+	if !strings.Contains(lines[0], `"values":{"temp":70.00}`) {
+		t.Errorf("Unexpected value line %s", lines[0])
+	}
+}
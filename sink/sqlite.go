@@ -0,0 +1,139 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultSQLDriver is the database/sql driver name SQLite drivers register,
+// the linked one included
+const defaultSQLDriver = "sqlite"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (
+	time INTEGER NOT NULL,
+	category TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS readings_key_time ON readings (category, key, time);
+CREATE TABLE IF NOT EXISTS events (
+	time INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	category TEXT,
+	key TEXT,
+	value TEXT,
+	previous TEXT,
+	text TEXT,
+	error TEXT
+);
+`
+
+// SQLite stores every value change in the readings table and every other
+// event in the events table, with times in Unix milliseconds. Builds other
+// than minimal link a pure Go driver under the default name.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens, and creates if needed, the database in file
+func OpenSQLite(driver, file string) (*SQLite, error) {
+	if driver == "" {
+		driver = defaultSQLDriver
+	}
+	db, err := sql.Open(driver, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables in %s: %w", file, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Handle inserts the event's rows in one transaction
+func (s *SQLite) Handle(event bus.Event) {
+	if err := s.insert(event); err != nil {
+		log.Warnf("Failed to store %s event: %v", event.Kind, err)
+	}
+}
+
+func (s *SQLite) insert(event bus.Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	at := event.Time.UnixMilli()
+	if event.Kind == bus.ValueChanged {
+		for key, value := range event.Values {
+			if _, err := tx.Exec(`INSERT INTO readings (time, category, key, value) VALUES (?, ?, ?, ?)`,
+				at, event.Category, key, text(value)); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	var errText interface{}
+	if event.Err != nil {
+		errText = event.Err.Error()
+	}
+	if _, err := tx.Exec(`INSERT INTO events (time, kind, category, key, value, previous, text, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		at, string(event.Kind), event.Category, event.Key, text(event.Value), text(event.Previous), event.Text, errText); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// text returns value as stored in a TEXT column: strings as they are and
+// anything else as JSON
+func text(value interface{}) interface{} {
+	switch v := plain(value).(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(encoded)
+	}
+}
+
+// Close closes the database
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func init() {
+	Register("sqlite", func(cfg config.SinkConfig, deps Deps) (Sink, error) {
+		return OpenSQLite(cfg.Driver, cfg.File)
+	})
+}
@@ -0,0 +1,58 @@
+//go:build !minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+func TestSQLiteStoresReadingsAndEvents(t *testing.T) {
+	s, err := OpenSQLite("", filepath.Join(t.TempDir(), "values.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite() error = %v", err)
+	}
+	defer s.Close()
+
+	at := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	s.Handle(bus.Event{Kind: bus.ValueChanged, Time: at, Category: "boiler", Values: map[string]interface{}{"temp": nbe.RoundedFloat(70)}})
+	s.Handle(bus.Event{Kind: bus.WritePerformed, Time: at, Key: "boiler.temp", Value: []byte("70"), Err: errors.New("denied")})
+
+	var ms int64
+	var category, key, value string
+	if err := s.db.QueryRow(`SELECT time, category, key, value FROM readings`).Scan(&ms, &category, &key, &value); err != nil {
+		t.Fatalf("Failed to read the reading: %v", err)
+	}
+	if ms != at.UnixMilli() || category != "boiler" || key != "temp" || value != "70.00" {
+		t.Errorf("Unexpected reading %d %s %s %s", ms, category, key, value)
+	}
+	var kind, errText string
+	if err := s.db.QueryRow(`SELECT kind, key, value, error FROM events`).Scan(&kind, &key, &value, &errText); err != nil {
+		t.Fatalf("Failed to read the event: %v", err)
+	}
+	if kind != "write_performed" || key != "boiler.temp" || value != "70" || errText != "denied" {
+		t.Errorf("Unexpected event %s %s %s %s", kind, key, value, errText)
+	}
+}
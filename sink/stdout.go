@@ -0,0 +1,95 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/config"
+)
+
+// JSONLines writes every event as one JSON object per line, for piping into
+// log collectors
+type JSONLines struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// jsonEvent is the line written for an event
+type jsonEvent struct {
+	Time     time.Time              `json:"time"`
+	Kind     bus.Kind               `json:"kind"`
+	Category string                 `json:"category,omitempty"`
+	Key      string                 `json:"key,omitempty"`
+	Values   map[string]interface{} `json:"values,omitempty"`
+	Value    interface{}            `json:"value,omitempty"`
+	Previous interface{}            `json:"previous,omitempty"`
+	Text     string                 `json:"text,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// NewJSONLines creates a sink writing to w
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{encoder: json.NewEncoder(w)}
+}
+
+// Handle writes event as a line
+func (s *JSONLines) Handle(event bus.Event) {
+	line := jsonEvent{
+		Time:     event.Time,
+		Kind:     event.Kind,
+		Category: event.Category,
+		Key:      event.Key,
+		Values:   event.Values,
+		Value:    plain(event.Value),
+		Previous: plain(event.Previous),
+		Text:     event.Text,
+	}
+	if event.Err != nil {
+		line.Error = event.Err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a value that can't be encoded only loses its own line
+	_ = s.encoder.Encode(line)
+}
+
+// Close does nothing; the writer belongs to the caller
+func (s *JSONLines) Close() error {
+	return nil
+}
+
+// plain returns raw written values as text
+func plain(value interface{}) interface{} {
+	if raw, ok := value.([]byte); ok {
+		return string(raw)
+	}
+	return value
+}
+
+func init() {
+	Register("stdout", func(cfg config.SinkConfig, deps Deps) (Sink, error) {
+		return NewJSONLines(os.Stdout), nil
+	})
+}
@@ -0,0 +1,160 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package state keeps what the bridge learns about a boiler across restarts
+// in a directory per controller serial: the controller's public key and
+// setting ranges, and the daily baselines of the consumption figures
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// unsafeSerial matches the characters not kept in a serial's directory name
+var unsafeSerial = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Controller is what was learned from the controller itself
+type Controller struct {
+	// PublicKey is the controller's key as it reports it, base64 of PKIX
+	PublicKey string `json:"public_key,omitempty"`
+	// Ranges are the setting ranges read from the controller
+	Ranges map[string]nbe.SettingRange `json:"setting_ranges,omitempty"`
+}
+
+// Dir is the state directory of one controller. Each piece of state is a
+// JSON file named after it.
+type Dir struct {
+	Path string
+
+	mu    sync.Mutex
+	saved map[string]func() interface{}
+}
+
+// Open creates the directory for serial below root
+func Open(root, serial string) (*Dir, error) {
+	name := unsafeSerial.ReplaceAllString(serial, "_")
+	if name == "" || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid serial %q", serial)
+	}
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{Path: path, saved: make(map[string]func() interface{})}, nil
+}
+
+// Load reads the named state into v, returning false if it was never saved
+func (d *Dir) Load(name string, v interface{}) (bool, error) {
+	path := d.file(name)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// Save writes the named state, replacing the previous file in one step
+func (d *Dir) Save(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := d.file(name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Keep registers state that is saved by Run and SaveAll, taking a fresh
+// snapshot each time
+func (d *Dir) Keep(name string, snapshot func() interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.saved[name] = snapshot
+}
+
+// Track restores a component from its saved state, if any, and keeps saving
+// its snapshots
+func Track[T any](d *Dir, name string, restore func(T), snapshot func() T) error {
+	var saved T
+	ok, err := d.Load(name, &saved)
+	if err != nil {
+		return err
+	}
+	if ok {
+		restore(saved)
+	}
+	d.Keep(name, func() interface{} { return snapshot() })
+	return nil
+}
+
+// Run saves the kept state every interval
+func (d *Dir) Run(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := d.SaveAll(); err != nil {
+				log.Errorf("Failed to save the state: %v", err)
+			}
+		}
+	}()
+}
+
+// SaveAll saves every piece of kept state, returning the first error
+func (d *Dir) SaveAll() error {
+	d.mu.Lock()
+	names := make([]string, 0, len(d.saved))
+	for name := range d.saved {
+		names = append(names, name)
+	}
+	snapshots := make(map[string]func() interface{}, len(d.saved))
+	for name, snapshot := range d.saved {
+		snapshots[name] = snapshot
+	}
+	d.mu.Unlock()
+
+	sort.Strings(names)
+	var first error
+	for _, name := range names {
+		if err := d.Save(name, snapshots[name]()); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return first
+}
+
+func (d *Dir) file(name string) string {
+	return filepath.Join(d.Path, name+".json")
+}
@@ -0,0 +1,90 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type counter struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+func TestOpenSanitizesSerial(t *testing.T) {
+	root := t.TempDir()
+	dir, err := Open(root, "../12 34")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if dir.Path != filepath.Join(root, ".._12_34") {
+		t.Errorf("Expected the serial to stay below the root, got %s", dir.Path)
+	}
+	if _, err := Open(root, ".."); err == nil {
+		t.Error("Expected an error for a serial naming the parent")
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := Open(t.TempDir(), "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded counter
+	if ok, err := dir.Load("counter", &loaded); ok || err != nil {
+		t.Errorf("Load() of missing state = %v, %v, want false, nil", ok, err)
+	}
+
+	if err := dir.Save("counter", counter{Day: "2024-01-10", Count: 3}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if ok, err := dir.Load("counter", &loaded); !ok || err != nil || loaded.Count != 3 {
+		t.Errorf("Load() = %v, %v, %+v, want the saved state", ok, err, loaded)
+	}
+
+	if err := os.WriteFile(dir.file("broken"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Load("broken", &loaded); err == nil {
+		t.Error("Expected an error loading a corrupt file")
+	}
+}
+
+func TestTrack(t *testing.T) {
+	root := t.TempDir()
+	dir, _ := Open(root, "12345")
+	current := counter{Day: "2024-01-10", Count: 7}
+	if err := Track(dir, "counter", func(c counter) { current = c }, func() counter { return current }); err != nil {
+		t.Fatalf("Track() error = %v", err)
+	}
+	if err := dir.SaveAll(); err != nil {
+		t.Fatalf("SaveAll() error = %v", err)
+	}
+
+	// a restart restores the saved count
+	dir, _ = Open(root, "12345")
+	var restored counter
+	if err := Track(dir, "counter", func(c counter) { restored = c }, func() counter { return restored }); err != nil {
+		t.Fatalf("Track() error = %v", err)
+	}
+	if restored.Count != 7 {
+		t.Errorf("Expected the count restored, got %+v", restored)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package stokercloud reads a boiler through NBE's StokerCloud service, for
+// boilers that report to the cloud but can't be reached on the LAN. The
+// values are published on the bus under the same categories and keys as the
+// values read from the controller.
+package stokercloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/diagnostics"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultURL is the StokerCloud service
+const DefaultURL = "https://stokercloud.dk"
+
+// screen selects the values returned with the controller data, as the
+// StokerCloud web page requests them
+const screen = "b1,3,b2,5,b3,4,b4,6,b5,12,b6,14,b7,15,b8,16,b9,9,b10,7,d1,3,d2,4,d3,4,d4,0,d5,0,d6,0,d7,0,d8,0,d9,0,d10,0,h1,2,h2,3,h3,4,h4,7,h5,8,h6,1,h7,5,h8,0,h9,0,h10,0,w1,2,w2,3,w3,9,w4,0,w5,0"
+
+// DefaultFields maps the StokerCloud values, named <section>/<id> as in the
+// controller data, to the <category>/<key> they are published as
+var DefaultFields = map[string]string{
+	"frontdata/boilertemp":       "operating_data/boiler_temp",
+	"frontdata/boilertempwanted": "operating_data/boiler_ref",
+	"frontdata/dhw":              "operating_data/dhw_temp",
+	"frontdata/dhwwanted":        "operating_data/dhw_ref",
+	"boilerdata/4":               "operating_data/power_pct",
+	"boilerdata/5":               "operating_data/power_kw",
+	"weatherdata/1":              "operating_data/external_temp",
+	"miscdata/state":             "operating_data/state",
+}
+
+var errSession = errors.New("StokerCloud session expired")
+
+// Client reads the controller data of one boiler from StokerCloud
+type Client struct {
+	base     string
+	serial   string
+	password string
+	fields   map[string]string
+	http     *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// New returns a client logging in with the boiler's serial and its
+// StokerCloud password. fields adds to or overrides DefaultFields; an empty
+// topic drops a default.
+func New(base, serial, password string, fields map[string]string) *Client {
+	if base == "" {
+		base = DefaultURL
+	}
+	merged := make(map[string]string, len(DefaultFields)+len(fields))
+	for name, topic := range DefaultFields {
+		merged[name] = topic
+	}
+	for name, topic := range fields {
+		if topic == "" {
+			delete(merged, name)
+		} else {
+			merged[name] = topic
+		}
+	}
+	return &Client{
+		base:     strings.TrimSuffix(base, "/"),
+		serial:   serial,
+		password: password,
+		fields:   merged,
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Topics returns the <category>/<key> of every value the client publishes
+func (c *Client) Topics() []string {
+	var topics []string
+	for _, topic := range c.fields {
+		topics = append(topics, topic)
+		if topic == "operating_data/state" {
+			topics = append(topics, "operating_data/state_text", "operating_data/state_on")
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// login gets a session token
+func (c *Client) login(ctx context.Context) (string, error) {
+	query := url.Values{"user": {c.serial}, "pass": {c.password}}
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := c.get(ctx, "/v2/dataout2/login.php?"+query.Encode(), &response); err != nil {
+		return "", fmt.Errorf("logging in: %w", err)
+	}
+	if response.Token == "" {
+		return "", fmt.Errorf("logging in: StokerCloud refused serial %s", c.serial)
+	}
+	return response.Token, nil
+}
+
+// Fetch reads the controller data and returns the mapped values by category
+func (c *Client) Fetch(ctx context.Context) (map[string]map[string]interface{}, error) {
+	sections, err := c.controllerData(ctx)
+	if errors.Is(err, errSession) {
+		c.mu.Lock()
+		c.token = ""
+		c.mu.Unlock()
+		sections, err = c.controllerData(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalize(sections, c.fields), nil
+}
+
+func (c *Client) controllerData(ctx context.Context) (map[string]json.RawMessage, error) {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if token == "" {
+		var err error
+		if token, err = c.login(ctx); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.token = token
+		c.mu.Unlock()
+	}
+
+	query := url.Values{"screen": {screen}, "token": {token}}
+	var sections map[string]json.RawMessage
+	if err := c.get(ctx, "/v2/dataout2/controllerdata2.php?"+query.Encode(), &sections); err != nil {
+		return nil, err
+	}
+	if _, ok := sections["notvalid"]; ok || len(sections) == 0 {
+		return nil, errSession
+	}
+	return sections, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		return errSession
+	case response.StatusCode != http.StatusOK:
+		return fmt.Errorf("StokerCloud returned %s", response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("parsing StokerCloud response: %w", err)
+	}
+	return nil
+}
+
+// normalize picks the mapped values from the controller data. A section is
+// either a list of {"id", "value"} objects or an object keyed by id.
+func normalize(sections map[string]json.RawMessage, fields map[string]string) map[string]map[string]interface{} {
+	values := make(map[string]map[string]interface{})
+	for name, raw := range sections {
+		for id, value := range entries(raw) {
+			topic, ok := fields[name+"/"+id]
+			if !ok {
+				continue
+			}
+			category, key, _ := strings.Cut(topic, "/")
+			if values[category] == nil {
+				values[category] = make(map[string]interface{})
+			}
+			values[category][key] = parseValue(key, value)
+		}
+	}
+	if operating := values["operating_data"]; operating != nil {
+		nbe.ScaleFields(nbe.OperatingFields, operating)
+	}
+	if advanced := values["advanced_data"]; advanced != nil {
+		nbe.ScaleFields(nbe.AdvancedFields, advanced)
+	}
+	return values
+}
+
+type entry struct {
+	ID    json.RawMessage `json:"id"`
+	Value interface{}     `json:"value"`
+}
+
+func entries(raw json.RawMessage) map[string]interface{} {
+	values := make(map[string]interface{})
+	var list []entry
+	if err := json.Unmarshal(raw, &list); err == nil {
+		for _, e := range list {
+			values[strings.Trim(string(e.ID), `"`)] = e.Value
+		}
+		return values
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return values
+	}
+	for id, field := range object {
+		var e entry
+		if err := json.Unmarshal(field, &e); err == nil && e.Value != nil {
+			values[id] = e.Value
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(field, &value); err == nil {
+			values[id] = value
+		}
+	}
+	return values
+}
+
+// parseValue converts a StokerCloud value, usually a string such as "62.3"
+// or "state_5", into the form read from the controller
+func parseValue(key string, value interface{}) interface{} {
+	text := strings.TrimSpace(fmt.Sprintf("%v", value))
+	if key == "state" {
+		text = strings.TrimPrefix(text, "state_")
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(strings.Replace(text, ",", ".", 1), 64); err == nil {
+		return nbe.RoundedFloat(f)
+	}
+	return text
+}
+
+// Run polls StokerCloud every interval and publishes the values that
+// changed, naming the power state with states, until ctx is done
+func (c *Client) Run(ctx context.Context, eventBus *bus.Bus, states *nbe.StateTable, interval time.Duration) {
+	caches := make(map[string]map[string]interface{})
+	stats := diagnostics.Track("operating_data")
+	stats.Go(func() {
+		connected := false
+		for {
+			stats.Poll()
+			values, err := c.Fetch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Warnf("Failed to read StokerCloud: %v", err)
+			}
+			if up := err == nil; up != connected {
+				connected = up
+				eventBus.Publish(bus.Event{Kind: bus.ConnectivityChanged, Key: "stokercloud", Value: up})
+			}
+
+			published := 0
+			for category, payload := range values {
+				if caches[category] == nil {
+					caches[category] = make(map[string]interface{})
+				}
+				changeSet := changes(caches[category], payload, states)
+				if len(changeSet) > 0 {
+					eventBus.Publish(bus.Event{Kind: bus.ValueChanged, Category: category, Values: changeSet})
+					published += len(changeSet)
+				}
+			}
+			stats.Published(published)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	})
+}
+
+// changes returns the values that differ from cache and updates it, adding
+// state_text and state_on for a changed power state
+func changes(cache, payload map[string]interface{}, states *nbe.StateTable) map[string]interface{} {
+	changeSet := make(map[string]interface{})
+	for key, value := range payload {
+		if cmp.Equal(cache[key], value) {
+			continue
+		}
+		cache[key] = value
+		changeSet[key] = value
+		if state, ok := value.(int64); ok && key == "state" {
+			changeSet["state_text"] = states.Text(state)
+			if states.On(state) {
+				changeSet["state_on"] = "ON"
+			} else {
+				changeSet["state_on"] = "OFF"
+			}
+		}
+	}
+	return changeSet
+}
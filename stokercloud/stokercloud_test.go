@@ -0,0 +1,136 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package stokercloud
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/nbe"
+)
+
+const controllerData = `{
+	"frontdata": [
+		{"id": "boilertemp", "value": "62.3", "unit": "°C"},
+		{"id": "boilertempwanted", "value": "65"},
+		{"id": "dhw", "value": "48,5"},
+		{"id": "dhwwanted", "value": "50"}
+	],
+	"boilerdata": [{"id": 5, "value": "12.4"}, {"id": 4, "value": "40"}, {"id": 12, "value": "7.2"}],
+	"weatherdata": [{"id": "1", "value": "-3.5"}],
+	"miscdata": {"state": {"value": "state_5"}, "alarm": "0"}
+}`
+
+// testService serves logins and controller data, expiring the first token
+func testService(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	logins := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/dataout2/login.php", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("user") != "12345" || r.URL.Query().Get("pass") != "secret" {
+			w.Write([]byte(`{"token": ""}`))
+			return
+		}
+		logins++
+		if logins == 1 {
+			w.Write([]byte(`{"token": "expired"}`))
+			return
+		}
+		w.Write([]byte(`{"token": "valid"}`))
+	})
+	mux.HandleFunc("/v2/dataout2/controllerdata2.php", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "valid" {
+			w.Write([]byte(`{"notvalid": 1}`))
+			return
+		}
+		w.Write([]byte(controllerData))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &logins
+}
+
+func TestFetch(t *testing.T) {
+	server, logins := testService(t)
+	client := New(server.URL, "12345", "secret", map[string]string{
+		"boilerdata/12": "operating_data/oxygen",
+		"weatherdata/1": "",
+	})
+
+	values, err := client.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if *logins != 2 {
+		t.Errorf("Expected to log in again after the session expired, logged in %d times", *logins)
+	}
+
+	expected := map[string]interface{}{
+		"boiler_temp": nbe.RoundedFloat(62.3),
+		"boiler_ref":  nbe.RoundedFloat(65),
+		"dhw_temp":    nbe.RoundedFloat(48.5),
+		"dhw_ref":     nbe.RoundedFloat(50),
+		"power_kw":    nbe.RoundedFloat(12.4),
+		"power_pct":   nbe.RoundedFloat(40),
+		"oxygen":      nbe.RoundedFloat(7.2),
+		"state":       int64(5),
+	}
+	operating := values["operating_data"]
+	if len(operating) != len(expected) {
+		t.Errorf("Expected %d values, got %v", len(expected), operating)
+	}
+	for key, want := range expected {
+		if operating[key] != want {
+			t.Errorf("%s = %v (%T), want %v (%T)", key, operating[key], operating[key], want, want)
+		}
+	}
+}
+
+func TestFetchRefusedLogin(t *testing.T) {
+	server, _ := testService(t)
+	if _, err := New(server.URL, "12345", "wrong", nil).Fetch(context.Background()); err == nil {
+		t.Error("Expected an error for a refused login")
+	}
+}
+
+func TestTopics(t *testing.T) {
+	topics := New("", "12345", "secret", map[string]string{"miscdata/state": ""}).Topics()
+	for _, topic := range topics {
+		if topic == "operating_data/state" || topic == "operating_data/state_text" {
+			t.Errorf("Expected the dropped state mapping to be left out, got %v", topics)
+		}
+	}
+	if len(topics) != len(DefaultFields)-1 {
+		t.Errorf("Expected %d topics, got %v", len(DefaultFields)-1, topics)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	cache := make(map[string]interface{})
+	payload := map[string]interface{}{"state": int64(5), "boiler_temp": nbe.RoundedFloat(62)}
+
+	changed := changes(cache, payload, nil)
+	if len(changed) != 4 || changed["state_text"] != nbe.DefaultStates().Text(5) || changed["state_on"] == nil {
+		t.Errorf("Expected the values with the state text, got %v", changed)
+	}
+	if changed := changes(cache, payload, nil); len(changed) != 0 {
+		t.Errorf("Expected no changes for the same values, got %v", changed)
+	}
+}
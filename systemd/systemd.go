@@ -0,0 +1,152 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package systemd talks to the service manager when the bridge runs as a
+// systemd service: readiness and watchdog notifications over $NOTIFY_SOCKET,
+// and the listening sockets passed by socket activation. Outside systemd
+// everything here does nothing.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// Notify sends state, such as "READY=1", to the service manager. It returns
+// false without an error when not started by systemd with a notify socket.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// an abstract socket is given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// notify sends state and logs a failure
+func notify(state string) {
+	if _, err := Notify(state); err != nil {
+		log.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// Ready tells the service manager that the bridge has started, or finished
+// reloading, with a status line for systemctl status
+func Ready(status string) {
+	notify("READY=1\nSTATUS=" + status)
+}
+
+// Reloading tells the service manager that the configuration is being
+// reloaded; Ready ends the reload
+func Reloading() {
+	notify("RELOADING=1")
+}
+
+// Stopping tells the service manager that the bridge is shutting down
+func Stopping() {
+	notify("STOPPING=1")
+}
+
+// WatchdogInterval returns the interval the service manager expects watchdog
+// pings in, zero when the watchdog is not enabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings the service manager at half the watchdog interval for as
+// long as healthy succeeds. While it fails the pings stop, so systemd
+// restarts the bridge once the interval passes.
+func Watchdog(interval time.Duration, healthy func() error) {
+	go func() {
+		failing := false
+		for range time.Tick(interval / 2) {
+			if err := healthy(); err != nil {
+				if !failing {
+					log.Errorf("Withholding the systemd watchdog ping: %v", err)
+					failing = true
+				}
+				continue
+			}
+			if failing {
+				log.Info("Resuming the systemd watchdog pings")
+				failing = false
+			}
+			notify("WATCHDOG=1")
+		}
+	}()
+}
+
+// Listeners returns the sockets passed by socket activation, none when the
+// bridge was not socket activated
+func Listeners() ([]net.Listener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	// the variables are meant for this process, not for its children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listeners(listenFDsStart, count)
+}
+
+// listeners wraps count listening sockets starting at file descriptor first
+func listeners(first, count int) ([]net.Listener, error) {
+	var result []net.Listener
+	for fd := first; fd < first+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "listen_fd_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d: %w", fd, err)
+		}
+		result = append(result, listener)
+	}
+	return result, nil
+}
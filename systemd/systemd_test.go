@@ -0,0 +1,136 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenNotify creates a notify socket and points $NOTIFY_SOCKET at it
+func listenNotify(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn, timeout time.Duration) (string, bool) {
+	t.Helper()
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Errorf("Notify() outside systemd = %v, %v, want false, nil", sent, err)
+	}
+
+	conn := listenNotify(t)
+	Ready("Connected")
+	if state, ok := receive(t, conn, time.Second); !ok || state != "READY=1\nSTATUS=Connected" {
+		t.Errorf("Expected the readiness notification, got %q", state)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := WatchdogInterval(); interval != 30*time.Second {
+		t.Errorf("WatchdogInterval() = %v, want 30s", interval)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := WatchdogInterval(); interval != 0 {
+		t.Errorf("Expected no watchdog for another process, got %v", interval)
+	}
+	t.Setenv("WATCHDOG_USEC", "")
+	if interval := WatchdogInterval(); interval != 0 {
+		t.Errorf("Expected no watchdog without WATCHDOG_USEC, got %v", interval)
+	}
+}
+
+func TestWatchdogFollowsHealth(t *testing.T) {
+	conn := listenNotify(t)
+	healthy := make(chan error, 1)
+	healthy <- errors.New("controller not answering")
+	var last error
+	Watchdog(20*time.Millisecond, func() error {
+		select {
+		case last = <-healthy:
+		default:
+		}
+		return last
+	})
+
+	if state, ok := receive(t, conn, 50*time.Millisecond); ok {
+		t.Errorf("Expected no ping while unhealthy, got %q", state)
+	}
+	healthy <- nil
+	if state, ok := receive(t, conn, time.Second); !ok || state != "WATCHDOG=1" {
+		t.Errorf("Expected a ping once healthy, got %q", state)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if found, err := Listeners(); found != nil || err != nil {
+		t.Errorf("Listeners() for another process = %v, %v, want none", found, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listeners takes over the descriptor, as it does the ones from systemd
+	found, err := listeners(fd, 1)
+	if err != nil || len(found) != 1 {
+		t.Fatalf("listeners() = %v, %v, want the passed socket", found, err)
+	}
+	defer found[0].Close()
+	if found[0].Addr().String() != listener.Addr().String() {
+		t.Errorf("Expected the socket on %s, got %s", listener.Addr(), found[0].Addr())
+	}
+}
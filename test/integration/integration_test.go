@@ -24,6 +24,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mlipscombe/boiler-mate/bus"
 	"github.com/mlipscombe/boiler-mate/homeassistant"
 	"github.com/mlipscombe/boiler-mate/monitor"
 	"github.com/mlipscombe/boiler-mate/mqtt"
@@ -85,15 +86,18 @@ func TestIntegrationFullStack(t *testing.T) {
 	err = mqttClient.PublishMany("device", map[string]interface{}{
 		"status":     "online",
 		"serial":     boiler.Serial,
-		"ip_address": boiler.IPAddress,
+		"ip_address": boiler.Address(),
 	})
 	if err != nil {
 		t.Errorf("Failed to publish device status: %v", err)
 	}
 
+	eventBus := bus.New()
+	bus.PublishToMQTT(eventBus, mqttClient)
+
 	// Start monitors and collect ready channels
-	settingsReady := monitor.StartSettingsMonitor(boiler, mqttClient, "boiler")
-	operatingReady := monitor.StartOperatingDataMonitor(boiler, mqttClient)
+	settingsReady := monitor.StartSettingsMonitor(boiler, eventBus, "boiler")
+	operatingReady := monitor.StartOperatingDataMonitor(boiler, eventBus)
 
 	// Create a combined ready channel that waits for all monitors
 	allReady := make(chan bool, 1)
@@ -106,7 +110,7 @@ func TestIntegrationFullStack(t *testing.T) {
 	// Test Home Assistant discovery
 	t.Run("HomeAssistantDiscovery", func(t *testing.T) {
 		// Wait for monitors to publish initial data, then publish discovery
-		homeassistant.PublishDiscovery(mqttClient, boiler.Serial, "test/boiler", allReady)
+		homeassistant.PublishDiscovery(mqttClient, boiler.Serial, boiler.Serial, "test/boiler", homeassistant.AllEntities(), allReady)
 
 		// Test passes if no errors occurred during publishing
 		// In a real test, we could subscribe to homeassistant/# and verify messages
@@ -135,6 +139,11 @@ func TestIntegrationFullStack(t *testing.T) {
 	})
 
 	t.Run("SetValue", func(t *testing.T) {
+		var written string
+		boiler.OnWrite(func(path string, value []byte) {
+			written = fmt.Sprintf("%s=%s", path, value)
+		})
+
 		// Test setting a value through the boiler client
 		response, err := boiler.Set("boiler.temp", []byte("75"))
 		if err != nil {
@@ -153,6 +162,9 @@ func TestIntegrationFullStack(t *testing.T) {
 		if val != "75" {
 			t.Errorf("Expected boiler temp '75', got %v", val)
 		}
+		if written != "boiler.temp=75" {
+			t.Errorf("Expected write handler to see boiler.temp=75, got %q", written)
+		}
 	})
 
 	t.Run("GetOperatingData", func(t *testing.T) {
@@ -173,6 +185,44 @@ func TestIntegrationFullStack(t *testing.T) {
 			t.Error("Expected oxygen in operating data")
 		}
 	})
+
+	t.Run("AlarmPropagation", func(t *testing.T) {
+		mockBoiler.RaiseAlarm(9, "Alarm burner is too hot")
+		defer mockBoiler.ClearAlarm()
+
+		response, err := boiler.Get(nbe.GetOperatingDataFunction, "*")
+		if err != nil {
+			t.Fatalf("Failed to get operating data: %v", err)
+		}
+		if response.Payload["alarm"] != int64(9) {
+			t.Errorf("Expected alarm 9 in operating data, got %v", response.Payload["alarm"])
+		}
+
+		response, err = boiler.Get(nbe.GetEventLogFunction, "*")
+		if err != nil {
+			t.Fatalf("Failed to get event log: %v", err)
+		}
+		events := nbe.ParseEvents(response.Payload)
+		if len(events) == 0 || events[len(events)-1].Code != 9 {
+			t.Errorf("Expected alarm 9 in event log, got %v", response.Payload)
+		}
+	})
+
+	t.Run("WeatherCompensation", func(t *testing.T) {
+		if _, err := boiler.Set("weather.active", []byte("1")); err != nil {
+			t.Fatalf("Failed to enable weather compensation: %v", err)
+		}
+		defer boiler.Set("weather.active", []byte("0"))
+		mockBoiler.SetOutdoorTemp(2.5)
+
+		response, err := boiler.Get(nbe.GetOperatingDataFunction, "*")
+		if err != nil {
+			t.Fatalf("Failed to get operating data: %v", err)
+		}
+		if fmt.Sprint(response.Payload["boiler_ref"]) != "55" {
+			t.Errorf("Expected boiler_ref 55 at 2.5°C outdoors, got %v", response.Payload["boiler_ref"])
+		}
+	})
 }
 
 // TestIntegrationMQTTSubscription tests MQTT subscription functionality
@@ -215,3 +265,34 @@ func TestIntegrationMQTTSubscription(t *testing.T) {
 		t.Error("Timeout waiting for MQTT message")
 	}
 }
+
+// TestIntegrationRepublishOnBirth tests that Home Assistant coming online
+// triggers a republish
+func TestIntegrationRepublishOnBirth(t *testing.T) {
+	skipIfNotIntegration(t)
+
+	mqttURL, _ := url.Parse("mqtt://localhost:1883")
+	mqttClient, err := mqtt.NewClient(mqttURL, "test-birth-client", "test/birth")
+	if err != nil {
+		t.Fatalf("Failed to create MQTT client: %v", err)
+	}
+	defer mqttClient.Close()
+
+	republished := make(chan struct{}, 1)
+	if err := homeassistant.OnBirth(mqttClient, "test/birth/ha_status", func() {
+		republished <- struct{}{}
+	}); err != nil {
+		t.Fatalf("Failed to subscribe to the status topic: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if err := mqttClient.PublishRaw("test/birth/ha_status", "online"); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	select {
+	case <-republished:
+	case <-time.After(homeassistant.BirthDelay + 5*time.Second):
+		t.Error("Timeout waiting for the republish")
+	}
+}
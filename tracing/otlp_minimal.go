@@ -0,0 +1,35 @@
+//go:build minimal
+
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Available reports whether this build can export spans
+const Available = false
+
+// Setup does nothing in minimal builds, which leave out the OTLP exporter
+func Setup(cfg Config) (func(context.Context) error, error) {
+	log.Warn("Tracing is not included in minimal builds")
+	return func(context.Context) error { return nil }, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package watchdog reconnects to the controller once its requests keep timing
+// out, and reports it offline when reconnecting doesn't bring it back, so a
+// wedged socket or a controller at a new address no longer needs a restart of
+// the bridge.
+package watchdog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+	"github.com/mlipscombe/boiler-mate/nbe"
+	log "github.com/sirupsen/logrus"
+)
+
+// Key names the controller connection in the bus.ConnectivityChanged events
+// the watchdog publishes
+const Key = "controller"
+
+// Watchdog checks every interval how many requests to the controller timed
+// out in a row. From failures on it reconnects, once per check, and after
+// attempts failed reconnects it publishes the controller as unreachable
+// until it answers again.
+type Watchdog struct {
+	eventBus  *bus.Bus
+	failures  func() int64
+	reconnect func() error
+	threshold int64
+	attempts  int
+	interval  time.Duration
+
+	failed  int
+	offline bool
+}
+
+// New creates a watchdog for boiler publishing on eventBus
+func New(boiler *nbe.NBE, eventBus *bus.Bus, failures, attempts int, interval time.Duration) *Watchdog {
+	return &Watchdog{
+		eventBus:  eventBus,
+		failures:  boiler.Failures,
+		reconnect: boiler.Reconnect,
+		threshold: int64(failures),
+		attempts:  attempts,
+		interval:  interval,
+	}
+}
+
+// Run starts watching the controller
+func (w *Watchdog) Run() {
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.check()
+		}
+	}()
+}
+
+// check reconnects if the controller hasn't answered the last threshold
+// requests, and publishes whether it is reachable when that changes
+func (w *Watchdog) check() {
+	failures := w.failures()
+	if failures < w.threshold {
+		w.failed = 0
+		w.setOnline(true, "The controller answers again")
+		return
+	}
+
+	log.Warnf("The controller has not answered the last %d requests; reconnecting", failures)
+	if err := w.reconnect(); err != nil {
+		w.failed++
+		log.Errorf("Failed to reconnect to the controller (attempt %d): %v", w.failed, err)
+		if w.failed >= w.attempts {
+			w.setOnline(false, fmt.Sprintf("The controller is unreachable after %d reconnects: %v", w.failed, err))
+		}
+		return
+	}
+	log.Info("Reconnected to the controller")
+	w.failed = 0
+	w.setOnline(true, "The controller answers again after reconnecting")
+}
+
+func (w *Watchdog) setOnline(online bool, text string) {
+	if w.offline == !online {
+		return
+	}
+	w.offline = !online
+	w.eventBus.Publish(bus.Event{Kind: bus.ConnectivityChanged, Key: Key, Value: online, Text: text})
+}
@@ -0,0 +1,82 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package watchdog
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mlipscombe/boiler-mate/bus"
+)
+
+func TestWatchdogReconnectsAndEscalates(t *testing.T) {
+	eventBus := bus.New()
+	var events []bus.Event
+	eventBus.Subscribe(func(event bus.Event) {
+		events = append(events, event)
+	}, bus.ConnectivityChanged)
+
+	var failures int64
+	reconnects := 0
+	var reconnectErr error
+	w := &Watchdog{
+		eventBus: eventBus,
+		failures: func() int64 { return failures },
+		reconnect: func() error {
+			reconnects++
+			if reconnectErr == nil {
+				failures = 0
+			}
+			return reconnectErr
+		},
+		threshold: 5,
+		attempts:  2,
+	}
+
+	failures = 4
+	w.check()
+	if reconnects != 0 || len(events) != 0 {
+		t.Fatalf("Expected nothing below the threshold, got %d reconnects and %v", reconnects, events)
+	}
+
+	// a reconnect that works brings the controller back quietly
+	failures = 5
+	w.check()
+	if reconnects != 1 || failures != 0 || len(events) != 0 {
+		t.Fatalf("Expected a quiet reconnect, got %d reconnects and %v", reconnects, events)
+	}
+
+	// it is reported unreachable once reconnecting failed attempts times
+	failures, reconnectErr = 7, errors.New("timeout waiting for request")
+	w.check()
+	if len(events) != 0 {
+		t.Fatalf("Expected no alert after the first failed reconnect, got %v", events)
+	}
+	w.check()
+	w.check()
+	if reconnects != 4 || len(events) != 1 || events[0].Key != Key || events[0].Value != false {
+		t.Fatalf("Expected a single offline event after 2 failed reconnects, got %d reconnects and %v", reconnects, events)
+	}
+
+	// and online again when it answers
+	failures = 0
+	w.check()
+	if len(events) != 2 || events[1].Value != true {
+		t.Errorf("Expected an online event, got %v", events)
+	}
+}
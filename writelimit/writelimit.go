@@ -0,0 +1,125 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package writelimit protects the controller's flash memory from runaway
+// automations: a setting written again too soon, or any setting once the
+// daily write budget is used up, is refused.
+package writelimit
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/clock"
+	"github.com/mlipscombe/boiler-mate/config"
+)
+
+// ErrRateLimited is wrapped by the error of every refused write
+var ErrRateLimited = errors.New("write rate limited")
+
+// Error is a write refused by the limiter
+type Error struct {
+	// Key is the refused setting, in the form <category>.<key>
+	Key    string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Reason)
+}
+
+func (e *Error) Unwrap() error {
+	return ErrRateLimited
+}
+
+// Limiter counts the writes of settings. A nil Limiter allows every write.
+type Limiter struct {
+	minInterval time.Duration
+	dailyBudget int
+	exempt      []string
+	now         func() time.Time
+
+	mu sync.Mutex
+	// last is when each setting was last written
+	last map[string]time.Time
+	// day is the local midnight starting the day written counts
+	day     time.Time
+	written int
+}
+
+// New returns the limiter of cfg, or nil if it is disabled
+func New(cfg config.WriteLimitConfig) *Limiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Limiter{
+		minInterval: cfg.MinInterval,
+		dailyBudget: cfg.DailyBudget,
+		exempt:      cfg.Exempt,
+		now:         time.Now,
+		last:        make(map[string]time.Time),
+	}
+}
+
+// Allow counts a write of the settings keys, in the form <category>.<key>,
+// and returns an *Error for the first one refused, counting none of them
+// then, so a batch is written completely or not at all
+func (l *Limiter) Allow(keys ...string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if day := clock.Midnight(now); !day.Equal(l.day) {
+		l.day, l.written = day, 0
+	}
+
+	var limited []string
+	for _, key := range keys {
+		if l.exempted(key) {
+			continue
+		}
+		if last, ok := l.last[key]; ok && l.minInterval > 0 && now.Sub(last) < l.minInterval {
+			return &Error{Key: key, Reason: fmt.Sprintf("written %s ago, allowed again in %s",
+				now.Sub(last).Round(time.Second), (l.minInterval - now.Sub(last)).Round(time.Second))}
+		}
+		if l.dailyBudget > 0 && l.written+len(limited) >= l.dailyBudget {
+			return &Error{Key: key, Reason: fmt.Sprintf("daily budget of %d writes used up, allowed again after midnight", l.dailyBudget)}
+		}
+		limited = append(limited, key)
+	}
+
+	for _, key := range limited {
+		l.last[key] = now
+	}
+	l.written += len(limited)
+	return nil
+}
+
+func (l *Limiter) exempted(key string) bool {
+	for _, pattern := range l.exempt {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package writelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mlipscombe/boiler-mate/config"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 3, 10, 23, 58, 0, 0, time.UTC)
+	limiter := New(config.WriteLimitConfig{
+		Enabled:     true,
+		MinInterval: time.Minute,
+		DailyBudget: 3,
+		Exempt:      []string{"misc.*"},
+	})
+	limiter.now = func() time.Time { return now }
+
+	steps := []struct {
+		name    string
+		after   time.Duration
+		keys    []string
+		wantErr string
+	}{
+		{"first write", 0, []string{"boiler.temp"}, ""},
+		{"same key too soon", 30 * time.Second, []string{"boiler.temp"}, "boiler.temp"},
+		{"other key", 0, []string{"hot_water.temp"}, ""},
+		{"batch over the budget", 0, []string{"boiler.diff_under", "boiler.diff_over"}, "boiler.diff_over"},
+		{"refused batch not counted", 0, []string{"boiler.diff_under"}, ""},
+		{"budget used up", 0, []string{"weather.out_cold"}, "weather.out_cold"},
+		{"exempt key", 0, []string{"misc.start"}, ""},
+		{"interval passed, budget used up", 30 * time.Second, []string{"boiler.temp"}, "boiler.temp"},
+		{"after midnight", time.Minute, []string{"boiler.temp", "weather.out_cold"}, ""},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.after)
+		err := limiter.Allow(step.keys...)
+		if step.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Allow(%v) = %v, want nil", step.name, step.keys, err)
+			}
+			continue
+		}
+		var limited *Error
+		if !errors.As(err, &limited) || limited.Key != step.wantErr || !errors.Is(err, ErrRateLimited) {
+			t.Errorf("%s: Allow(%v) = %v, want a refusal of %s", step.name, step.keys, err, step.wantErr)
+		}
+	}
+}
+
+func TestDisabledLimiter(t *testing.T) {
+	limiter := New(config.WriteLimitConfig{MinInterval: time.Hour, DailyBudget: 1})
+	if limiter != nil {
+		t.Fatal("Expected no limiter when disabled")
+	}
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow("boiler.temp"); err != nil {
+			t.Errorf("Expected a nil limiter to allow every write, got %v", err)
+		}
+	}
+}
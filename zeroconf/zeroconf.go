@@ -0,0 +1,233 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package zeroconf advertises the bridge over multicast DNS (mDNS/DNS-SD) and
+// browses the local network for other services, such as the MQTT broker.
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/brutella/dnssd"
+	dnssdlog "github.com/brutella/dnssd/log"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceType is the service the bridge's HTTP API is advertised as
+const ServiceType = "_boiler-mate._tcp"
+
+const domain = "local"
+
+func init() {
+	// dnssd logs to standard output, which the stdout sink writes events to
+	dnssdlog.Info.SetOutput(log.StandardLogger().WriterLevel(log.DebugLevel))
+}
+
+// Service is a DNS-SD service instance
+type Service struct {
+	// Instance is the human-readable name, e.g. "boiler-mate 12345"
+	Instance string
+	// Type is the service type, e.g. "_boiler-mate._tcp"
+	Type string
+	// Host is the host name without the .local domain
+	Host string
+	Port int
+	Text map[string]string
+	// Addrs are the IPv4 addresses the service was found at when browsing
+	Addrs []net.IP
+}
+
+// Server answers mDNS queries for a service until it is closed
+type Server struct {
+	responder dnssd.Responder
+	handle    dnssd.ServiceHandle
+	cancel    context.CancelFunc
+}
+
+// Advertise announces service on the local network and answers queries for
+// it, on every interface and with the addresses the host has there
+func Advertise(service Service) (*Server, error) {
+	config, err := dnssd.NewService(dnssd.Config{
+		Name:   service.Instance,
+		Type:   service.Type,
+		Domain: domain,
+		Host:   service.Host,
+		Text:   service.Text,
+		Port:   service.Port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	responder, err := dnssd.NewResponder()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := responder.Add(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := responder.Respond(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("mDNS server error: %v", err)
+		}
+	}()
+	return &Server{responder: responder, handle: handle, cancel: cancel}, nil
+}
+
+// SetText replaces the service's TXT record and announces the change
+func (s *Server) SetText(text map[string]string) {
+	s.handle.UpdateText(text, s.responder)
+}
+
+// Close withdraws the service and stops answering queries
+func (s *Server) Close() {
+	s.responder.Remove(s.handle)
+	s.cancel()
+}
+
+// Browse asks the local network for instances of serviceType, e.g.
+// "_mqtt._tcp", and returns those that answered before ctx is done
+func Browse(ctx context.Context, serviceType string) ([]Service, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("browsing needs a deadline")
+	}
+	found := &browser{}
+	err := dnssd.LookupType(ctx, serviceType+"."+domain+".", found.add, func(dnssd.BrowseEntry) {})
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	return found.services, nil
+}
+
+// browser collects the services found while browsing, in the order found
+type browser struct {
+	services []Service
+}
+
+// add records an instance seen on one interface, merging the addresses of
+// one seen on several
+func (b *browser) add(entry dnssd.BrowseEntry) {
+	var service *Service
+	for i := range b.services {
+		if b.services[i].Instance == entry.Name {
+			service = &b.services[i]
+		}
+	}
+	if service == nil {
+		b.services = append(b.services, Service{
+			Instance: entry.Name,
+			Type:     entry.Type,
+			Host:     entry.Host,
+			Port:     entry.Port,
+			Text:     entry.Text,
+		})
+		service = &b.services[len(b.services)-1]
+	}
+	for _, ip := range entry.IPs {
+		if ip4 := ip.To4(); ip4 != nil && !containsIP(service.Addrs, ip4) {
+			service.Addrs = append(service.Addrs, ip4)
+		}
+	}
+}
+
+// LookupHost asks the local network for the IPv4 addresses of host, a name
+// in the .local domain, and returns those of the first answer before ctx is
+// done
+func LookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("looking up a host needs a deadline")
+	}
+	fqdn := dns.Fqdn(host)
+	message := new(dns.Msg)
+	message.SetQuestion(fqdn, dns.TypeA)
+	message.RecursionDesired = false
+	query, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	go func() {
+		// a second query covers a first one lost on a busy network
+		for i := 0; i < 2; i++ {
+			if _, err := conn.WriteToUDP(query, dnssd.AddrIPv4LinkLocalMulticast); err != nil {
+				log.Debugf("Failed to send an mDNS query: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("no mDNS answer for %s", host)
+			}
+			return nil, err
+		}
+		if ips := hostAddrs(buf[:n], fqdn); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+}
+
+// hostAddrs returns the A records for name in an mDNS response
+func hostAddrs(packet []byte, name string) []net.IP {
+	var message dns.Msg
+	if err := message.Unpack(packet); err != nil || !message.Response {
+		return nil
+	}
+	var ips []net.IP
+	for _, record := range append(message.Answer, message.Extra...) {
+		if a, ok := record.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, name) {
+			if !containsIP(ips, a.A) {
+				ips = append(ips, a.A)
+			}
+		}
+	}
+	return ips
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+/*
+ * This file is part of the boiler-mate distribution (https://github.com/mlipscombe/boiler-mate).
+ * Copyright (c) 2021-2023 Mark Lipscombe.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package zeroconf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/brutella/dnssd"
+	"github.com/miekg/dns"
+)
+
+func TestBrowserMergesInterfaces(t *testing.T) {
+	entry := dnssd.BrowseEntry{
+		Name:      "mosquitto",
+		Type:      "_mqtt._tcp",
+		Domain:    "local",
+		Host:      "broker",
+		Port:      1883,
+		IfaceName: "eth0",
+		IPs:       []net.IP{net.IPv4(192, 168, 1, 10), net.ParseIP("fe80::1")},
+		Text:      map[string]string{"version": "2"},
+	}
+	found := &browser{}
+	found.add(entry)
+	entry.IfaceName = "wlan0"
+	entry.IPs = []net.IP{net.IPv4(192, 168, 1, 10), net.IPv4(10, 0, 0, 10)}
+	found.add(entry)
+
+	if len(found.services) != 1 {
+		t.Fatalf("Expected one service, got %v", found.services)
+	}
+	service := found.services[0]
+	if service.Instance != "mosquitto" || service.Host != "broker" || service.Port != 1883 || service.Text["version"] != "2" {
+		t.Errorf("Unexpected service %+v", service)
+	}
+	if len(service.Addrs) != 2 || !service.Addrs[0].Equal(net.IPv4(192, 168, 1, 10)) || !service.Addrs[1].Equal(net.IPv4(10, 0, 0, 10)) {
+		t.Errorf("Expected the IPv4 addresses of both interfaces, got %v", service.Addrs)
+	}
+}
+
+func reply(t *testing.T, response bool, records ...dns.RR) []byte {
+	t.Helper()
+	message := new(dns.Msg)
+	message.Response = response
+	message.Answer = records
+	packet, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestHostAddrs(t *testing.T) {
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "pi.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.IPv4(192, 168, 1, 20).To4(),
+	}
+	packet := reply(t, true, a)
+	ips := hostAddrs(packet, "PI.local.")
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Errorf("Expected 192.168.1.20, got %v", ips)
+	}
+	if ips := hostAddrs(packet, "other.local."); len(ips) != 0 {
+		t.Errorf("Expected no address for another host, got %v", ips)
+	}
+	if ips := hostAddrs(reply(t, false, a), "pi.local."); len(ips) != 0 {
+		t.Errorf("Expected a query to be ignored, got %v", ips)
+	}
+}